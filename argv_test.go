@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/stretchr/testify/require"
+)
+
+// argvSuperblock is the output of dumpe2fs for the device being resized.
+const argvSuperblock = `Filesystem volume name:   <none>
+Filesystem magic number:  0xEF53
+Block count:              262144
+Block size:               4096
+`
+
+func TestCreateFilesystemArgv(t *testing.T) {
+	cases := map[string]ext4.CreateOptions{
+		"defaults": {Device: "/dev/sdb"},
+		"geometry": {
+			Device:                   "/dev/sdb",
+			Size:                     ext4.GiB,
+			BlockSize:                ptr(4096),
+			BytesPerInode:            ptr(16384),
+			InodeSize:                ptr(256),
+			NumberOfGroups:           ptr(16),
+			NumberOfInodes:           ptr(65536),
+			BlocksPerGroup:           ptr(32768),
+			ReservedBlocksPercentage: ptr(1),
+			FilesystemRevision:       ptr(1),
+			UsageType:                ext4.UsageBig,
+		},
+		"cluster-size": {
+			Device:      "/dev/sdb",
+			BlockSize:   ptr(4096),
+			ClusterSize: ptr(65536),
+			Features:    "bigalloc",
+		},
+		"journal": {
+			Device:         "/dev/sdb",
+			Type:           ext4.Ext3,
+			Journal:        true,
+			JournalOptions: ext4.JournalOptions{Size: 64, Location: "50%"},
+		},
+		"external-journal": {
+			Device:         "/dev/sdb",
+			JournalOptions: ext4.JournalOptions{Device: "UUID=0b4ea0b4-3ac1-4e8e-9d4b-6f8a5b7c3e21"},
+		},
+		"metadata": {
+			Device:               "/dev/sdb",
+			Label:                "my data",
+			LastMountedDirectory: "/mnt/data",
+			UUID:                 "5c0a2dd4-4a6e-4d3e-8e6f-7a5f0e0c9b11",
+			CreatorOS:            ext4.CreatorOSHurd,
+			ErrorBehavior:        ext4.ErrorsRemountReadOnly,
+			RootDirectory:        "/srv/rootfs",
+			UndoFile:             "/var/lib/ext4/sdb.e2undo",
+		},
+		"extended": {
+			Device: "/dev/sdb",
+			ExtendedOptions: ext4.ExtendedOptions{
+				Stride:                 16,
+				StripeWidth:            48,
+				Offset:                 1 << 20,
+				Resize:                 1 << 28,
+				LazyItableInit:         ptr(false),
+				LazyJournalInit:        ptr(true),
+				PackedMetaBlocks:       true,
+				Discard:                ptr(false),
+				AssumeStoragePrezeroed: true,
+				RootOwner:              &ext4.RootOwner{UID: 1000, GID: 100},
+				HashSeed:               "9b2e4a7c-1d3f-4e5a-8b6c-0d1e2f3a4b5c",
+				NumBackupSuperblocks:   ptr(1),
+				MMPUpdateInterval:      5,
+				TestFS:                 true,
+				Extra:                  []string{"orphan_file_size=1M"},
+			},
+		},
+		"flags": {
+			Device:            "/dev/sdb",
+			CheckForBadBlocks: true,
+			DryRun:            true,
+			DirectIO:          true,
+			Force:             true,
+			WriteSuperblocks:  true,
+		},
+		"features": {
+			Device:       "/dev/sdb",
+			Features:     "fast_commit,^resize_inode",
+			FeatureSet:   ext4.FeatureSet{ext4.MetadataCsum: true, "has_journal": false},
+			Label:        "a label that is far too long",
+			LabelPolicy:  ext4.LabelTruncate,
+			Quotas:       []ext4.QuotaType{ext4.UserQuota, ext4.ProjectQuota},
+			Encryption:   true,
+			Verity:       true,
+			Casefold:     &ext4.CasefoldOptions{Strict: true},
+			InlineData:   true,
+			ChecksumSeed: true,
+		},
+		"bigalloc": {
+			Device:   "/dev/sdb",
+			Bigalloc: &ext4.BigallocOptions{ClusterSize: 64 << 10},
+		},
+		"raid": {
+			Device:       "/dev/sdb",
+			RAIDGeometry: &ext4.RAIDGeometry{ChunkSize: 512 * ext4.KiB, DataDisks: 3},
+		},
+	}
+
+	requireArgsCovered(t, cases)
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			e := &ext4test.RecordingExecutor{}
+			c := ext4.NewClient(ext4.WithExecutor(e))
+
+			// The output of mke2fs isn't recorded, so it can't be parsed.
+			_, _ = c.CreateFilesystem(context.Background(), opts)
+
+			ext4test.AssertGoldenArgv(t, filepath.Join("testdata", "argv", "create", name+".golden"), e.Argv())
+		})
+	}
+}
+
+func TestResizeFilesystemArgv(t *testing.T) {
+	cases := map[string]ext4.ResizeOptions{
+		"defaults": {Device: "/dev/sdb"},
+		"grow":     {Device: "/dev/sdb", Size: 2 * ext4.GiB},
+		"shrink":   {Device: "/dev/sdb", Shrink: true},
+		"flags": {
+			Device:      "/dev/sdb",
+			Force:       true,
+			Flush:       true,
+			Enable64Bit: true,
+			RAIDStride:  ptr(16),
+			UndoFile:    "/var/lib/ext4/sdb.e2undo",
+		},
+		"disable-64bit": {Device: "/dev/sdb", Disable64Bit: true},
+		"progress": {
+			Device:   "/dev/sdb",
+			Size:     2 * ext4.GiB,
+			Progress: func(pass int, cur, max float64) {},
+		},
+		"check": {Device: "/dev/sdb", Size: 512 * ext4.MiB, Check: true},
+	}
+
+	requireArgsCovered(t, cases)
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			e := &ext4test.RecordingExecutor{Outputs: map[string]string{"dumpe2fs": argvSuperblock}}
+			c := ext4.NewClient(ext4.WithExecutor(e))
+
+			// The output of resize2fs isn't recorded, so it can't be parsed.
+			_, _ = c.ResizeFilesystem(context.Background(), opts)
+
+			ext4test.AssertGoldenArgv(t, filepath.Join("testdata", "argv", "resize", name+".golden"), e.Argv())
+		})
+	}
+}
+
+func TestCheckFilesystemArgv(t *testing.T) {
+	cases := map[string]ext4.CheckOptions{
+		"defaults":  {Device: "/dev/sdb"},
+		"preen":     {Device: "/dev/sdb", Preen: true, Force: true},
+		"read-only": {Device: "/dev/sdb", NoFix: true},
+		"bad-blocks": {
+			Device:              "/dev/sdb",
+			CheckForBadBlocks:   true,
+			AppendBadBlocks:     true,
+			AppendBadBlocksFile: "/var/lib/ext4/sdb.badblocks",
+		},
+		"bad-blocks-file": {Device: "/dev/sdb", BadBlocksFile: "/var/lib/ext4/sdb.badblocks"},
+		"flags": {
+			Device:              "/dev/sdb",
+			OptimizeDirectories: true,
+			Flush:               true,
+			Superblock:          ptr(32768),
+			Blocksize:           ptr(4096),
+			ExternalJournal:     "/dev/sdc",
+			ExtendedOptions:     "discard,journal_only",
+			UndoFile:            "/var/lib/ext4/sdb.e2undo",
+		},
+		"progress": {
+			Device:   "/dev/sdb",
+			Progress: func(pass int, cur, max float64) {},
+		},
+	}
+
+	requireArgsCovered(t, cases)
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			e := &ext4test.RecordingExecutor{}
+			c := ext4.NewClient(ext4.WithExecutor(e))
+
+			_, err := c.CheckFilesystem(context.Background(), opts)
+			require.NoError(t, err)
+
+			ext4test.AssertGoldenArgv(t, filepath.Join("testdata", "argv", "check", name+".golden"), e.Argv())
+		})
+	}
+}
+
+// requireArgsCovered checks that every field of the options with an arg tag
+// is set by at least one case, so new options are added to the golden files.
+func requireArgsCovered[T any](t *testing.T, cases map[string]T) {
+	t.Helper()
+
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if _, ok := field.Tag.Lookup("arg"); !ok {
+			continue
+		}
+
+		var covered bool
+		for _, opts := range cases {
+			if !reflect.ValueOf(opts).Field(i).IsZero() {
+				covered = true
+				break
+			}
+		}
+		require.True(t, covered, "%s.%s isn't set by any case", typ.Name(), field.Name)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
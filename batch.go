@@ -0,0 +1,185 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultBatchParallelism is the number of devices operated on at once by a
+// batch, unless configured otherwise.
+const DefaultBatchParallelism = 4
+
+// ErrBatchSkipped is returned for the devices of a batch that were never
+// operated on, because an earlier operation failed (with StopOnError) or the
+// context was cancelled.
+var ErrBatchSkipped = errors.New("skipped")
+
+// BatchOptions provides options for running an operation across many devices.
+type BatchOptions struct {
+	// Parallelism is the maximum number of devices operated on at once
+	// (default DefaultBatchParallelism).
+	Parallelism int
+	// StopOnError skips the devices that haven't been started yet once an
+	// operation fails. Operations already in progress run to completion.
+	StopOnError bool
+}
+
+// BatchResult is the outcome of an operation on a single device in a batch.
+type BatchResult[T any] struct {
+	// Device the operation was run on.
+	Device string
+	// Value returned by the operation (if it succeeded).
+	Value T
+	// Err is the error returned by the operation (or ErrBatchSkipped).
+	Err error
+	// Duration the operation took.
+	Duration time.Duration
+}
+
+// RunBatch runs op on each of the devices concurrently, returning the results
+// in the same order as the devices. Operations on the same device are still
+// serialized by the device lock of the client.
+func RunBatch[T any](ctx context.Context, devices []string, opts BatchOptions, op func(ctx context.Context, device string) (T, error)) []BatchResult[T] {
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = DefaultBatchParallelism
+	}
+
+	// Operations run with the caller's context, so that stopping on an error
+	// doesn't cancel those already in progress.
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	results := make([]BatchResult[T], len(devices))
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+	for i, device := range devices {
+		results[i].Device = device
+
+		select {
+		case <-ctx.Done():
+			results[i].Err = fmt.Errorf("%w: %w", ErrBatchSkipped, context.Cause(ctx))
+			continue
+		case <-stop:
+			results[i].Err = fmt.Errorf("%w: an earlier operation failed", ErrBatchSkipped)
+			continue
+		case sem <- struct{}{}:
+		}
+
+		// The batch may have been stopped while we were waiting.
+		if ctx.Err() != nil {
+			<-sem
+			results[i].Err = fmt.Errorf("%w: %w", ErrBatchSkipped, context.Cause(ctx))
+			continue
+		}
+		select {
+		case <-stop:
+			<-sem
+			results[i].Err = fmt.Errorf("%w: an earlier operation failed", ErrBatchSkipped)
+			continue
+		default:
+		}
+
+		wg.Add(1)
+		go func(result *BatchResult[T]) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			result.Value, result.Err = op(ctx, result.Device)
+			result.Duration = time.Since(start)
+
+			if result.Err != nil && opts.StopOnError {
+				stopOnce.Do(func() { close(stop) })
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results
+}
+
+// BatchErrors joins the errors of the failed operations in a batch (each
+// prefixed with its device), returning nil if they all succeeded.
+func BatchErrors[T any](results []BatchResult[T]) error {
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.Device, result.Err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// BatchRunner runs common operations across many devices concurrently.
+type BatchRunner struct {
+	c    FilesystemManager
+	opts BatchOptions
+}
+
+// NewBatchRunner returns a runner that operates on many devices concurrently
+// using m (eg. a Client, or a fake in unit tests).
+func NewBatchRunner(m FilesystemManager, opts BatchOptions) *BatchRunner {
+	return &BatchRunner{c: m, opts: opts}
+}
+
+// Batch returns a runner that operates on many devices concurrently, eg. to
+// check each of the data disks of a server.
+func (c *Client) Batch(opts BatchOptions) *BatchRunner {
+	return NewBatchRunner(c, opts)
+}
+
+// CheckFilesystems checks the filesystem on each device. The device in opts is
+// ignored.
+func (b *BatchRunner) CheckFilesystems(ctx context.Context, devices []string, opts CheckOptions) []BatchResult[*CheckResult] {
+	return RunBatch(ctx, devices, b.opts, func(ctx context.Context, device string) (*CheckResult, error) {
+		opts := opts
+		opts.Device = device
+		return b.c.CheckFilesystem(ctx, opts)
+	})
+}
+
+// CreateFilesystems creates a filesystem on each device. The device in opts is
+// ignored, and opts.UUID may only be a literal UUID for a single device (as
+// UUIDs must be unique).
+func (b *BatchRunner) CreateFilesystems(ctx context.Context, devices []string, opts CreateOptions) []BatchResult[*CreatedFilesystem] {
+	return RunBatch(ctx, devices, b.opts, func(ctx context.Context, device string) (*CreatedFilesystem, error) {
+		if opts.UUID != "" && !opts.UUID.IsKeyword() && len(devices) > 1 {
+			return nil, invalidOption("a UUID cannot be shared by a batch of filesystems")
+		}
+
+		opts := opts
+		opts.Device = device
+		return b.c.CreateFilesystem(ctx, opts)
+	})
+}
+
+// Trim trims the filesystem mounted at each mount point, returning the bytes
+// trimmed from each.
+func (b *BatchRunner) Trim(ctx context.Context, mountPoints []string, opts TrimOptions) []BatchResult[uint64] {
+	return RunBatch(ctx, mountPoints, b.opts, func(ctx context.Context, mountPoint string) (uint64, error) {
+		return b.c.Trim(ctx, mountPoint, opts)
+	})
+}
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBatch(t *testing.T) {
+	ctx := context.Background()
+
+	devices := make([]string, 10)
+	for i := range devices {
+		devices[i] = fmt.Sprintf("/dev/vd%c", 'a'+i)
+	}
+
+	var running, maxRunning atomic.Int32
+	results := ext4.RunBatch(ctx, devices, ext4.BatchOptions{Parallelism: 3}, func(ctx context.Context, device string) (string, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		if device == "/dev/vdc" {
+			return "", errors.New("bad disk")
+		}
+
+		return "ok " + device, nil
+	})
+	require.Len(t, results, len(devices))
+	require.Equal(t, int32(3), maxRunning.Load())
+
+	for i, result := range results {
+		require.Equal(t, devices[i], result.Device)
+		if result.Device == "/dev/vdc" {
+			require.EqualError(t, result.Err, "bad disk")
+		} else {
+			require.NoError(t, result.Err)
+			require.Equal(t, "ok "+result.Device, result.Value)
+			require.Greater(t, result.Duration, time.Duration(0))
+		}
+	}
+
+	require.EqualError(t, ext4.BatchErrors(results), "/dev/vdc: bad disk")
+
+	t.Log("Stopping on the first error")
+
+	var started atomic.Int32
+	results = ext4.RunBatch(ctx, devices, ext4.BatchOptions{Parallelism: 1, StopOnError: true}, func(ctx context.Context, device string) (string, error) {
+		started.Add(1)
+		if device == "/dev/vdc" {
+			return "", errors.New("bad disk")
+		}
+
+		return "ok", nil
+	})
+	require.Equal(t, int32(3), started.Load())
+	require.NoError(t, results[1].Err)
+	require.Error(t, results[2].Err)
+	for _, result := range results[3:] {
+		require.ErrorIs(t, result.Err, ext4.ErrBatchSkipped)
+	}
+
+	t.Log("Letting operations in progress complete after an error")
+
+	failed := make(chan struct{})
+	results = ext4.RunBatch(ctx, devices, ext4.BatchOptions{Parallelism: 2, StopOnError: true}, func(ctx context.Context, device string) (string, error) {
+		switch device {
+		case "/dev/vda":
+			// Still running when the other operation fails.
+			<-failed
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(50 * time.Millisecond):
+				return "ok", nil
+			}
+		case "/dev/vdb":
+			defer close(failed)
+			return "", errors.New("bad disk")
+		}
+
+		return "ok", nil
+	})
+	require.NoError(t, results[0].Err)
+	require.Equal(t, "ok", results[0].Value)
+	require.Error(t, results[1].Err)
+	for _, result := range results[2:] {
+		require.ErrorIs(t, result.Err, ext4.ErrBatchSkipped)
+		require.NotErrorIs(t, result.Err, context.Canceled)
+	}
+}
+
+func TestBatchRunner(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	var devices []string
+	for i := 0; i < 4; i++ {
+		imagePath := filepath.Join(t.TempDir(), fmt.Sprintf("disk%d.img", i))
+		require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+		require.NoError(t, os.Truncate(imagePath, 16<<20))
+		devices = append(devices, imagePath)
+	}
+
+	created := c.Batch(ext4.BatchOptions{Parallelism: 2}).CreateFilesystems(ctx, devices, ext4.CreateOptions{Label: "data"})
+	require.NoError(t, ext4.BatchErrors(created))
+
+	uuids := make(map[string]bool)
+	for _, result := range created {
+		uuids[result.Value.UUID] = true
+	}
+	require.Len(t, uuids, len(devices))
+
+	checked := c.Batch(ext4.BatchOptions{}).CheckFilesystems(ctx, devices, ext4.CheckOptions{Force: true, NoFix: true})
+	require.NoError(t, ext4.BatchErrors(checked))
+	for _, result := range checked {
+		require.True(t, result.Value.Status.OK())
+	}
+
+	t.Log("Sharing a UUID across a batch")
+
+	created = c.Batch(ext4.BatchOptions{}).CreateFilesystems(ctx, devices, ext4.CreateOptions{UUID: "1b4e28ba-2fa1-11d2-883f-0016d3cca427"})
+	for _, result := range created {
+		require.ErrorIs(t, result.Err, ext4.ErrInvalidOptions)
+	}
+}
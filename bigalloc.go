@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import "fmt"
+
+const (
+	// maxClusterSize is the largest cluster size supported by e2fsprogs.
+	maxClusterSize = 256 << 20
+	// experimentalClusterRatio is the number of blocks per cluster above
+	// which mke2fs considers bigalloc experimental.
+	experimentalClusterRatio = 16
+)
+
+// BigallocOptions provides options for the bigalloc feature, which allocates
+// space in clusters of blocks rather than individual blocks. This reduces the
+// overhead of block allocation (and the size of the block bitmaps) on
+// filesystems holding mostly large files.
+type BigallocOptions struct {
+	// ClusterSize in bytes (a power of two, of at least two blocks). If unset,
+	// mke2fs uses 16 times the block size.
+	ClusterSize int
+}
+
+// validate checks the options for obvious mistakes, given the (configured)
+// block size of the filesystem, or zero if unknown.
+func (opts BigallocOptions) validate(blockSize int) error {
+	minClusterSize := 2048
+	if blockSize > 0 {
+		minClusterSize = 2 * blockSize
+	}
+
+	if opts.ClusterSize != 0 && (!isPowerOfTwo(opts.ClusterSize) || opts.ClusterSize < minClusterSize || opts.ClusterSize > maxClusterSize) {
+		return invalidOption("invalid cluster size %d (must be a power of two in [%d, %d])", opts.ClusterSize, minClusterSize, maxClusterSize)
+	}
+
+	return nil
+}
+
+// caveats returns warnings about the known limitations of bigalloc that apply
+// to the options, given the (configured) block size of the filesystem, or
+// zero if unknown.
+func (opts BigallocOptions) caveats(blockSize int) []string {
+	if blockSize == 0 {
+		blockSize = 4096
+	}
+
+	caveats := []string{
+		"bigalloc filesystems require Linux 3.2 or later, and every file uses at least one cluster of space",
+	}
+	if opts.ClusterSize > experimentalClusterRatio*blockSize {
+		caveats = append(caveats, fmt.Sprintf("bigalloc with a cluster size greater than %d times the block size is considered experimental", experimentalClusterRatio))
+	}
+
+	return caveats
+}
@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBigalloc(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	c := ext4.NewClient(ext4.WithLogger(logger))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	blockSize := 4096
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		Size:      256 * ext4.MiB,
+		BlockSize: &blockSize,
+		Bigalloc:  &ext4.BigallocOptions{ClusterSize: 1 << 20},
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "bigalloc")
+	require.Equal(t, 1<<20, sb.ClusterSize)
+
+	require.Contains(t, buf.String(), "considered experimental")
+
+	t.Log("Creating a bigalloc filesystem with the default cluster size")
+
+	buf.Reset()
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		Size:      256 * ext4.MiB,
+		BlockSize: &blockSize,
+		Bigalloc:  &ext4.BigallocOptions{},
+	})
+	require.NoError(t, err)
+
+	sb, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, 16*blockSize, sb.ClusterSize)
+
+	require.NotContains(t, buf.String(), "considered experimental")
+
+	t.Log("Creating a bigalloc filesystem with a cluster smaller than two blocks")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		BlockSize: &blockSize,
+		Bigalloc:  &ext4.BigallocOptions{ClusterSize: 4096},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
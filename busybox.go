@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UnsupportedOptionError is returned when a command line option is not
+// supported by the implementation of a tool that is installed (eg. a BusyBox
+// applet).
+type UnsupportedOptionError struct {
+	// Tool is the name of the tool, eg. "mke2fs".
+	Tool string
+	// Option is the unsupported option, eg. "-t".
+	Option string
+}
+
+func (e *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("%s: option %s is not supported by busybox", e.Tool, e.Option)
+}
+
+// busyboxOptions are the options understood by each BusyBox applet, mapped to
+// whether the option takes a value. Applets not listed are passed all options
+// unchanged.
+//
+// Note that BusyBox mke2fs only creates ext2 filesystems, and so does not
+// support selecting the filesystem type (ext2 is accepted, and dropped).
+//
+// BusyBox has no e2fsck applet, so e2fsck is provided by the fsck applet,
+// which runs the filesystem specific checker. It handles -C itself (passing
+// the progress file descriptor on), and passes on other flags unchanged, but
+// takes the values of any other options to be devices to check (and -t and -V
+// are options of its own).
+var busyboxOptions = map[string]map[string]bool{
+	"e2fsck": {
+		"-C": true,
+		"-c": false,
+		"-D": false,
+		"-f": false,
+		"-F": false,
+		"-k": false,
+		"-n": false,
+		"-p": false,
+		"-y": false,
+	},
+	"mke2fs": {
+		"-b": true,
+		"-i": true,
+		"-I": true,
+		"-L": true,
+		"-m": true,
+		"-F": false,
+		"-n": false,
+		"-q": false,
+		"-v": false,
+	},
+}
+
+// isBusyBox reports whether the binary at cmdPath is a BusyBox applet. The
+// result is cached for the lifetime of the client.
+func (c *Client) isBusyBox(ctx context.Context, cmdPath string) (bool, error) {
+	c.busyboxMu.Lock()
+	defer c.busyboxMu.Unlock()
+
+	if isBusyBox, ok := c.busybox[cmdPath]; ok {
+		return isBusyBox, nil
+	}
+
+	// BusyBox applets print a banner identifying themselves along with their
+	// usage (and exit non-zero).
+	var out bytes.Buffer
+	err := c.executor.Run(ctx, &Command{
+		Path:   cmdPath,
+		Args:   []string{"--help"},
+		Env:    c.environ(),
+		Stdout: &out,
+		Stderr: &out,
+	})
+	if err != nil && exitCode(err) < 0 {
+		return false, fmt.Errorf("failed to identify %s: %w", cmdPath, err)
+	}
+
+	isBusyBox := strings.Contains(out.String(), "BusyBox")
+	if c.busybox == nil {
+		c.busybox = make(map[string]bool)
+	}
+	c.busybox[cmdPath] = isBusyBox
+
+	return isBusyBox, nil
+}
+
+// busyboxArgs validates the given command line against the options supported
+// by the BusyBox applet.
+func busyboxArgs(cmdName string, cmdArgs []string) ([]string, error) {
+	supported, ok := busyboxOptions[cmdName]
+	if !ok {
+		return cmdArgs, nil
+	}
+
+	for i := 0; i < len(cmdArgs); i++ {
+		arg := cmdArgs[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			continue
+		}
+
+		if cmdName == "mke2fs" && arg == "-t" && i+1 < len(cmdArgs) && cmdArgs[i+1] == string(Ext2) {
+			cmdArgs = slices.Delete(slices.Clone(cmdArgs), i, i+2)
+			i--
+			continue
+		}
+
+		takesValue, ok := supported[arg]
+		if !ok {
+			return nil, &UnsupportedOptionError{Tool: cmdName, Option: arg}
+		}
+		if takesValue {
+			i++
+		}
+	}
+
+	return cmdArgs, nil
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBusyBoxCompat(t *testing.T) {
+	ctx := context.Background()
+
+	t.Log("Using e2fsprogs")
+
+	c := ext4.NewClient(ext4.WithBusyBoxCompat())
+
+	imagePath := createTestImage(t, c, "")
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	t.Log("Using a busybox applet")
+
+	// A fake applet that identifies itself as busybox, and records invocations.
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	toolPath := filepath.Join(dir, "mke2fs")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" >> " + logPath + "\n" +
+		"if [ \"$1\" = \"--help\" ]; then\n" +
+		"  echo 'BusyBox v1.36.1 (2023-11-06 11:33:22 UTC) multi-call binary.' >&2\n" +
+		"  exit 1\n" +
+		"fi\n"
+	require.NoError(t, os.WriteFile(toolPath, []byte(script), 0o755))
+
+	c = ext4.NewClient(ext4.WithBusyBoxCompat(), ext4.WithMke2fsPath(toolPath))
+
+	for i := 0; i < 2; i++ {
+		_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+			Device: filepath.Join(dir, "ext4.img"),
+			Size:   64 * ext4.MiB,
+		})
+
+		var unsupportedErr *ext4.UnsupportedOptionError
+		require.True(t, errors.As(err, &unsupportedErr), "expected unsupported option error")
+		require.Equal(t, "mke2fs", unsupportedErr.Tool)
+		require.Equal(t, "-t", unsupportedErr.Option)
+	}
+
+	log, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+
+	// The applet should only have been probed, and only once.
+	require.Equal(t, "--help", strings.TrimSpace(string(log)))
+
+	t.Log("Creating an ext2 filesystem with a busybox applet")
+
+	// The fake applet doesn't produce any output to parse.
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: filepath.Join(dir, "ext2.img"),
+		Size:   64 * ext4.MiB,
+		Type:   ext4.Ext2,
+	})
+	require.Error(t, err)
+
+	log, err = os.ReadFile(logPath)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	require.Equal(t, "-v "+filepath.Join(dir, "ext2.img")+" 64M", lines[len(lines)-1])
+}
+
+func TestBusyBoxCompatCheck(t *testing.T) {
+	ctx := context.Background()
+
+	// A fake fsck applet that identifies itself as busybox, and records
+	// invocations.
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	toolPath := filepath.Join(dir, "fsck")
+	script := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$*\" >> " + logPath + "\n" +
+		"if [ \"$1\" = \"--help\" ]; then\n" +
+		"  echo 'BusyBox v1.36.1 (2023-11-06 11:33:22 UTC) multi-call binary.' >&2\n" +
+		"  exit 1\n" +
+		"fi\n"
+	require.NoError(t, os.WriteFile(toolPath, []byte(script), 0o755))
+
+	c := ext4.NewClient(ext4.WithBusyBoxCompat(), ext4.WithE2fsckPath(toolPath))
+
+	device := filepath.Join(dir, "ext4.img")
+
+	t.Log("Checking with options the applet would misinterpret")
+
+	_, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device:          device,
+		Force:           true,
+		ExtendedOptions: "journal_only",
+	})
+
+	var unsupportedErr *ext4.UnsupportedOptionError
+	require.True(t, errors.As(err, &unsupportedErr), "expected unsupported option error")
+	require.Equal(t, "e2fsck", unsupportedErr.Tool)
+	require.Equal(t, "-E", unsupportedErr.Option)
+
+	t.Log("Checking with supported options")
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: device,
+		Force:  true,
+		NoFix:  true,
+	})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+
+	log, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{"--help", "-n -f " + device}, strings.Split(strings.TrimSpace(string(log)), "\n"))
+}
@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"slices"
+)
+
+// ErrCasefoldUnsupported is returned when mounting a filesystem with the
+// casefold feature on a kernel that doesn't support it.
+var ErrCasefoldUnsupported = errors.New("kernel does not support casefold")
+
+// Encoding is the character encoding used to compare the names of files in
+// case-insensitive directories.
+type Encoding string
+
+const (
+	// EncodingUTF8 is UTF-8, using the latest version of Unicode supported
+	// by e2fsprogs.
+	EncodingUTF8 Encoding = "utf8"
+	// EncodingUTF8v12 is UTF-8, using Unicode 12.1.
+	EncodingUTF8v12 Encoding = "utf8-12.1"
+)
+
+// kernelCasefoldFeature is present if the kernel supports casefold.
+const kernelCasefoldFeature = "/sys/fs/ext4/features/casefold"
+
+const (
+	// incompatFeaturesOffset is the offset of s_feature_incompat within the
+	// superblock.
+	incompatFeaturesOffset = 0x60
+	// incompatCasefold is the incompatible feature flag of casefold.
+	incompatCasefold = 0x20000
+)
+
+// CasefoldOptions provides options for the casefold feature, which allows
+// directories to be made case-insensitive (with chattr +F), eg. for Android or
+// Samba workloads.
+type CasefoldOptions struct {
+	// Encoding of file names (default EncodingUTF8).
+	Encoding Encoding
+	// Strict rejects file names that are invalid in the encoding, rather than
+	// treating them as opaque byte sequences.
+	Strict bool
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts CasefoldOptions) Validate() error {
+	if opts.Encoding != "" && !slices.Contains([]Encoding{EncodingUTF8, EncodingUTF8v12}, opts.Encoding) {
+		return invalidOption("unknown encoding %q", opts.Encoding)
+	}
+
+	return nil
+}
+
+// extendedOptions returns the mke2fs extended options for the encoding.
+func (opts CasefoldOptions) extendedOptions() []string {
+	encoding := opts.Encoding
+	if encoding == "" {
+		encoding = EncodingUTF8
+	}
+
+	extendedOptions := []string{"encoding=" + string(encoding)}
+	if opts.Strict {
+		extendedOptions = append(extendedOptions, "encoding_flags=strict")
+	}
+
+	return extendedOptions
+}
+
+// KernelSupportsCasefold returns true if the kernel of the local host is able
+// to mount filesystems with the casefold feature. Filesystems destined for
+// other hosts can be created regardless.
+func KernelSupportsCasefold() bool {
+	_, err := os.Stat(kernelCasefoldFeature)
+	return err == nil
+}
+
+// hasCasefold returns true if the filesystem on a device has the casefold
+// feature, by reading its superblock directly.
+func hasCasefold(device string) bool {
+	f, err := os.Open(device)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var buf [4]byte
+	if _, err := f.ReadAt(buf[:], superblockOffset+incompatFeaturesOffset); err != nil {
+		return false
+	}
+
+	return binary.LittleEndian.Uint32(buf[:])&incompatCasefold != 0
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCasefold(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	lazyItableInit := true
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:          imagePath,
+		Size:            64 * ext4.MiB,
+		ExtendedOptions: ext4.ExtendedOptions{LazyItableInit: &lazyItableInit},
+		Casefold: &ext4.CasefoldOptions{
+			Encoding: ext4.EncodingUTF8v12,
+			Strict:   true,
+		},
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "casefold")
+	require.Equal(t, "utf8-12.1", sb.Encoding)
+
+	t.Log("Creating a filesystem with an unknown encoding")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:   imagePath,
+		Casefold: &ext4.CasefoldOptions{Encoding: "latin1"},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	t.Log("Mounting the filesystem")
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	mountPath := t.TempDir()
+	err = c.Mount(ctx, devPath, mountPath, ext4.MountOptions{})
+	if !ext4.KernelSupportsCasefold() {
+		require.ErrorIs(t, err, ext4.ErrCasefoldUnsupported)
+		return
+	}
+	require.NoError(t, err)
+	require.NoError(t, c.Unmount(ctx, mountPath, ext4.UnmountOptions{}))
+}
@@ -0,0 +1,225 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CheckStatus is the exit status reported by e2fsck, a bitmask of the
+// conditions below.
+type CheckStatus int
+
+const (
+	// CheckErrorsCorrected indicates filesystem errors were found and corrected.
+	CheckErrorsCorrected CheckStatus = 1 << iota
+	// CheckRebootRequired indicates errors were corrected and the system should
+	// be rebooted (typically because the root filesystem was modified).
+	CheckRebootRequired
+	// CheckErrorsUncorrected indicates filesystem errors were left uncorrected.
+	CheckErrorsUncorrected
+	// CheckOperationalError indicates e2fsck failed to run to completion.
+	CheckOperationalError
+	// CheckUsageError indicates e2fsck was invoked incorrectly.
+	CheckUsageError
+	// CheckCancelled indicates the check was cancelled by request.
+	CheckCancelled
+	_
+	// CheckLibraryError indicates a shared library error.
+	CheckLibraryError
+)
+
+// OK returns true if the filesystem is consistent, ie. no errors were found or
+// all errors were corrected.
+func (s CheckStatus) OK() bool {
+	return s&^(CheckErrorsCorrected|CheckRebootRequired) == 0
+}
+
+// ErrorsCorrected returns true if e2fsck modified the filesystem.
+func (s CheckStatus) ErrorsCorrected() bool {
+	return s&(CheckErrorsCorrected|CheckRebootRequired) != 0
+}
+
+func (s CheckStatus) String() string {
+	if s == 0 {
+		return "no errors"
+	}
+
+	var conditions []string
+	for _, cond := range []struct {
+		status CheckStatus
+		desc   string
+	}{
+		{CheckErrorsCorrected, "errors corrected"},
+		{CheckRebootRequired, "reboot required"},
+		{CheckErrorsUncorrected, "errors left uncorrected"},
+		{CheckOperationalError, "operational error"},
+		{CheckUsageError, "usage or syntax error"},
+		{CheckCancelled, "cancelled by user"},
+		{CheckLibraryError, "shared library error"},
+	} {
+		if s&cond.status != 0 {
+			conditions = append(conditions, cond.desc)
+		}
+	}
+
+	return strings.Join(conditions, ", ")
+}
+
+// CheckResult describes the outcome of a filesystem check.
+type CheckResult struct {
+	// Status is the exit status reported by e2fsck.
+	Status CheckStatus `json:"status"`
+	// Problems found by e2fsck, in the order they were reported. When the
+	// client streams output (see WithOutput), only the last problems reported
+	// are included.
+	Problems []Problem `json:"problems,omitempty"`
+}
+
+// Problem is a filesystem inconsistency reported by e2fsck.
+type Problem struct {
+	// Pass is the e2fsck pass that found the problem (zero if unknown, eg. when
+	// preening).
+	Pass int `json:"pass"`
+	// Inode is the inode number the problem refers to (if any).
+	Inode uint64 `json:"inode,omitempty"`
+	// Block is the block number the problem refers to (if any).
+	Block uint64 `json:"block,omitempty"`
+	// Description of the problem.
+	Description string `json:"description"`
+	// Action is the action proposed (eg. "Fix") or taken (eg. "FIXED") by e2fsck.
+	Action string `json:"action,omitempty"`
+	// Fixed is true if e2fsck repaired the problem.
+	Fixed bool `json:"fixed"`
+}
+
+// CheckError is returned when e2fsck could not leave the filesystem in a
+// consistent state.
+type CheckError struct {
+	// Status is the exit status reported by e2fsck.
+	Status CheckStatus
+	// Problems found by e2fsck, in the order they were reported.
+	Problems []Problem
+	// Err is the underlying command error.
+	Err error
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("filesystem check failed (%s): %v", e.Status, e.Err)
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	checkPassRegexp     = regexp.MustCompile(`^Pass (\d+)[A-Z]?: `)
+	checkQuestionRegexp = regexp.MustCompile(`^(?:(.*?)\s{2,})?([A-Za-z][A-Za-z /+-]*)\? (yes|no)$`)
+	checkPreenRegexp    = regexp.MustCompile(`^\S+: (.*?)\s{2,}([A-Z][A-Z /-]*)\.$`)
+	checkInodeRegexp    = regexp.MustCompile(`\b[Ii]node (\d+)\b`)
+	checkBlockRegexp    = regexp.MustCompile(`\b[Bb]lock (?:#\d+ \()?(\d+)\b`)
+)
+
+// ParseCheckProblems extracts the problems reported in e2fsck's output. It
+// understands both the interactive (-y/-n) and preen (-p) output formats.
+func ParseCheckProblems(out []byte) []Problem {
+	var problems []Problem
+	var pass int
+	var pending []string
+
+	addProblem := func(description, action string, fixed bool) {
+		description = strings.Join(append(pending, description), " ")
+		description = strings.TrimSpace(description)
+		pending = nil
+
+		p := Problem{
+			Pass:        pass,
+			Description: description,
+			Action:      action,
+			Fixed:       fixed,
+		}
+
+		if m := checkInodeRegexp.FindStringSubmatch(description); m != nil {
+			p.Inode, _ = strconv.ParseUint(m[1], 10, 64)
+		}
+
+		if m := checkBlockRegexp.FindStringSubmatch(description); m != nil {
+			p.Block, _ = strconv.ParseUint(m[1], 10, 64)
+		}
+
+		problems = append(problems, p)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " ")
+
+		if m := checkPassRegexp.FindStringSubmatch(line); m != nil {
+			pass, _ = strconv.Atoi(m[1])
+			pending = nil
+		} else if m := checkQuestionRegexp.FindStringSubmatch(line); m != nil {
+			addProblem(m[1], m[2], m[3] == "yes")
+		} else if m := checkPreenRegexp.FindStringSubmatch(line); m != nil {
+			addProblem(m[1], m[2], true)
+		} else if line == "" {
+			pending = nil
+		} else {
+			pending = append(pending, strings.TrimSpace(line))
+		}
+	}
+
+	return problems
+}
+
+// readCheckProgress parses the completion updates written by e2fsck -C to the
+// given reader, until EOF. Each update is of the form "pass cur max device".
+func readCheckProgress(r io.Reader, progress func(pass int, cur, max float64)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		pass, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		cur, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+
+		total, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+
+		progress(pass, cur, total)
+	}
+
+	// Drain any remaining output so e2fsck never blocks on a full pipe.
+	_, _ = io.Copy(io.Discard, r)
+}
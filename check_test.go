@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	srcDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(srcDir, "a"), 0o755)
+	require.NoError(t, err)
+
+	imagePath := createTestImage(t, c, srcDir)
+
+	t.Log("Checking clean filesystem")
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ext4.CheckStatus(0), result.Status)
+
+	t.Log("Corrupting filesystem")
+
+	err = exec.Command("debugfs", "-w", "-R", "sif /a links_count 7", imagePath).Run()
+	require.NoError(t, err)
+
+	t.Log("Checking corrupted filesystem (read-only)")
+
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		NoFix:  true,
+	})
+	require.Error(t, err)
+
+	var checkErr *ext4.CheckError
+	require.True(t, errors.As(err, &checkErr))
+	require.NotZero(t, checkErr.Status&ext4.CheckErrorsUncorrected)
+	require.False(t, result.Status.OK())
+
+	require.Len(t, result.Problems, 1)
+	require.Equal(t, 4, result.Problems[0].Pass)
+	require.Equal(t, uint64(12), result.Problems[0].Inode)
+	require.Equal(t, "Fix", result.Problems[0].Action)
+	require.False(t, result.Problems[0].Fixed)
+
+	t.Log("Repairing corrupted filesystem")
+
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+	})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+	require.True(t, result.Status.ErrorsCorrected())
+
+	require.Len(t, result.Problems, 1)
+	require.True(t, result.Problems[0].Fixed)
+
+	t.Log("Repairing corrupted filesystem (preen)")
+
+	err = exec.Command("debugfs", "-w", "-R", "sif /a links_count 7", imagePath).Run()
+	require.NoError(t, err)
+
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		Preen:  true,
+	})
+	require.NoError(t, err)
+	require.True(t, result.Status.ErrorsCorrected())
+
+	require.Len(t, result.Problems, 1)
+	require.Equal(t, uint64(12), result.Problems[0].Inode)
+	require.Equal(t, "FIXED", result.Problems[0].Action)
+	require.True(t, result.Problems[0].Fixed)
+}
+
+func TestCheckFilesystemProgress(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	passes := make(map[int]bool)
+	var invalid bool
+	_, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		Progress: func(pass int, cur, max float64) {
+			passes[pass] = true
+			invalid = invalid || cur > max
+		},
+	})
+	require.NoError(t, err)
+
+	require.False(t, invalid, "progress exceeded maximum")
+
+	require.True(t, passes[1], "expected progress updates for pass 1")
+	require.True(t, passes[5], "expected progress updates for pass 5")
+}
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// CloneFilesystem copies the ext4 filesystem on src to dst (a block device, or
+// an image file which is created if necessary). Only the blocks in use are
+// copied (using e2image), so image files are left sparse. The clone is then
+// given a new random UUID (see SetUUID), and any multi-mount protection state
+// is cleared, so that it can be used alongside the original. Both filesystems
+// must be unmounted. Returns the superblock of the clone.
+func (c *Client) CloneFilesystem(ctx context.Context, src, dst string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "CloneFilesystem", dst)
+	defer endSpan(span, &err)
+
+	if src == "" || dst == "" {
+		return nil, invalidOption("source and destination are required")
+	}
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return nil, invalidOption("source and destination must differ")
+	}
+
+	if err := c.checkUnmounted(src); err != nil {
+		return nil, err
+	}
+
+	unlock, err := c.requireUnmounted(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := c.run(ctx, "e2image", "-ra", src, dst); err != nil {
+		return nil, fmt.Errorf("failed to copy filesystem: %w", err)
+	}
+
+	sb, err := c.ReadSuperblock(ctx, dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	if sb.HasFeature(MMP) {
+		if err := c.tune2fs(ctx, dst, "-f", "-E", "clear_mmp"); err != nil {
+			return nil, fmt.Errorf("failed to clear multi-mount protection: %w", err)
+		}
+	}
+
+	if _, err := c.setUUID(ctx, dst, RandomUUID); err != nil {
+		return nil, err
+	}
+
+	return c.ReadSuperblock(ctx, dst)
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloneFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	srcDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0o644)
+	require.NoError(t, err)
+
+	srcPath := filepath.Join(t.TempDir(), "src.img")
+	src, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        srcPath,
+		Size:          64 * ext4.MiB,
+		Label:         "clone",
+		RootDirectory: srcDir,
+	})
+	require.NoError(t, err)
+
+	dstPath := filepath.Join(t.TempDir(), "dst.img")
+	sb, err := c.CloneFilesystem(ctx, srcPath, dstPath)
+	require.NoError(t, err)
+
+	require.NotEmpty(t, sb.UUID)
+	require.NotEqual(t, src.UUID, sb.UUID, "clone has the same UUID")
+	require.Equal(t, "clone", sb.Label)
+
+	t.Log("Verifying the contents of the clone")
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, dstPath, "/", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: dstPath, Force: true, NoFix: true})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+
+	t.Log("Cloning a filesystem with multi-mount protection")
+
+	mmpPath := filepath.Join(t.TempDir(), "mmp.img")
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:     mmpPath,
+		Size:       64 * ext4.MiB,
+		FeatureSet: ext4.FeatureSet{ext4.MMP: true},
+	})
+	require.NoError(t, err)
+
+	// A stand-in for tune2fs that records its arguments, as the real one waits
+	// for any other nodes using the filesystem.
+	dir := t.TempDir()
+	tune2fsPath := filepath.Join(dir, "tune2fs")
+	argsPath := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsPath + "\n"
+	require.NoError(t, os.WriteFile(tune2fsPath, []byte(script), 0o755))
+
+	undoDir := t.TempDir()
+	c = ext4.NewClient(ext4.WithToolPath("tune2fs", tune2fsPath), ext4.WithUndoDir(undoDir))
+
+	mmpClonePath := filepath.Join(t.TempDir(), "mmp-clone.img")
+	_, err = c.CloneFilesystem(ctx, mmpPath, mmpClonePath)
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.Regexp(t, "^-f -E clear_mmp -z "+regexp.QuoteMeta(undoDir)+"/\\S+ "+regexp.QuoteMeta(mmpClonePath)+"\n", string(args))
+
+	t.Log("Cloning a filesystem onto itself")
+
+	_, err = c.CloneFilesystem(ctx, srcPath, srcPath)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"io"
+)
+
+// RunOptions provides options for running a command with RunCommand.
+type RunOptions struct {
+	// Path of the binary (by default it's found in the same way as the
+	// e2fsprogs binaries, eg. using the search path of a local executor).
+	Path string
+	// Stdin, if set, is used as the standard input of the command.
+	Stdin io.Reader
+	// SensitiveStdin omits the standard input (eg. a passphrase) from the
+	// DryRunError returned in dry-run mode.
+	SensitiveStdin bool
+	// ReadOnly commands only inspect the system, so are still run in dry-run
+	// mode.
+	ReadOnly bool
+}
+
+// RunCommand runs a command other than those of e2fsprogs (eg. cryptsetup or
+// lvcreate) with the client, returning its standard output. As with the
+// e2fsprogs commands, it's run with the client's executor (eg. on a remote
+// host), and is subject to dry-run mode, hooks, logging, tracing and metrics.
+// If the command fails, a *CommandError is returned.
+func (c *Client) RunCommand(ctx context.Context, name string, args []string, opts RunOptions) (_ []byte, err error) {
+	ctx, span := c.startSpan(ctx, "RunCommand", "")
+	defer endSpan(span, &err)
+
+	out, _, err := c.runWithOptions(ctx, runOptions{
+		path:           opts.Path,
+		stdin:          opts.Stdin,
+		sensitiveStdin: opts.SensitiveStdin,
+		readOnly:       opts.ReadOnly,
+	}, name, args...)
+
+	return out, err
+}
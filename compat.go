@@ -0,0 +1,269 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CompatFeatures are the compatible feature flags of a filesystem. Kernels
+// that don't understand a compatible feature can still mount the filesystem
+// read-write.
+type CompatFeatures uint32
+
+// IncompatFeatures are the incompatible feature flags of a filesystem. Kernels
+// that don't understand an incompatible feature can't mount the filesystem.
+type IncompatFeatures uint32
+
+// ROCompatFeatures are the read-only compatible feature flags of a
+// filesystem. Kernels that don't understand a read-only compatible feature
+// can only mount the filesystem read-only.
+type ROCompatFeatures uint32
+
+// Features returns the names of the flags in the set.
+func (f CompatFeatures) Features() []Feature {
+	return toFeatures(featureNames(uint32(f), 0, 0))
+}
+
+// Features returns the names of the flags in the set.
+func (f IncompatFeatures) Features() []Feature {
+	return toFeatures(featureNames(0, uint32(f), 0))
+}
+
+// Features returns the names of the flags in the set.
+func (f ROCompatFeatures) Features() []Feature {
+	return toFeatures(featureNames(0, 0, uint32(f)))
+}
+
+func toFeatures(names []string) []Feature {
+	features := make([]Feature, len(names))
+	for i, name := range names {
+		features[i] = Feature(name)
+	}
+
+	return features
+}
+
+// FeatureFlags are the feature flags of a filesystem, as stored in the
+// compat, incompat and ro_compat fields of its superblock.
+type FeatureFlags struct {
+	Compat   CompatFeatures   `json:"compat"`
+	Incompat IncompatFeatures `json:"incompat"`
+	ROCompat ROCompatFeatures `json:"roCompat"`
+}
+
+// ParseFeatureFlags returns the feature flags of a list of feature names (as
+// reported by dumpe2fs, including unknown flags such as "FEATURE_I11").
+func ParseFeatureFlags(names []string) (FeatureFlags, error) {
+	var flags FeatureFlags
+	for _, name := range names {
+		kind, mask, ok := featureFlag(name)
+		if !ok {
+			return FeatureFlags{}, fmt.Errorf("unknown feature %q", name)
+		}
+
+		switch kind {
+		case featureCompat:
+			flags.Compat |= CompatFeatures(mask)
+		case featureIncompat:
+			flags.Incompat |= IncompatFeatures(mask)
+		case featureROCompat:
+			flags.ROCompat |= ROCompatFeatures(mask)
+		}
+	}
+
+	return flags, nil
+}
+
+// featureFlag returns the superblock field and mask of a feature flag, by
+// name.
+func featureFlag(name string) (featureKind, uint32, bool) {
+	for _, f := range featureFlags {
+		if f.name == name {
+			return f.kind, f.mask, true
+		}
+	}
+
+	if rest, ok := strings.CutPrefix(name, "FEATURE_"); ok && len(rest) > 1 {
+		kind := strings.IndexByte("CIR", rest[0])
+		bit, err := strconv.Atoi(rest[1:])
+		if kind >= 0 && err == nil && bit >= 0 && bit < 32 {
+			return featureKind(kind), uint32(1) << bit, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Features returns the names of the flags, in the order they are reported by
+// dumpe2fs.
+func (f FeatureFlags) Features() []Feature {
+	return toFeatures(featureNames(uint32(f.Compat), uint32(f.Incompat), uint32(f.ROCompat)))
+}
+
+// Has returns true if the feature flag is set.
+func (f FeatureFlags) Has(feature Feature) bool {
+	kind, mask, ok := featureFlag(string(feature))
+	if !ok {
+		return false
+	}
+
+	switch kind {
+	case featureCompat:
+		return uint32(f.Compat)&mask != 0
+	case featureIncompat:
+		return uint32(f.Incompat)&mask != 0
+	default:
+		return uint32(f.ROCompat)&mask != 0
+	}
+}
+
+// FeatureFlags returns the feature flags of the filesystem.
+func (sb *SuperblockInfo) FeatureFlags() (FeatureFlags, error) {
+	return ParseFeatureFlags(sb.Features)
+}
+
+// MountCompatibility is how a kernel is able to mount a filesystem.
+type MountCompatibility int
+
+const (
+	// MountUnsupported indicates the kernel can't mount the filesystem.
+	MountUnsupported MountCompatibility = iota
+	// MountReadOnly indicates the kernel can only mount the filesystem
+	// read-only.
+	MountReadOnly
+	// MountReadWrite indicates the kernel can mount the filesystem
+	// read-write.
+	MountReadWrite
+)
+
+func (m MountCompatibility) String() string {
+	switch m {
+	case MountUnsupported:
+		return "unsupported"
+	case MountReadOnly:
+		return "read-only"
+	case MountReadWrite:
+		return "read-write"
+	default:
+		return fmt.Sprintf("MountCompatibility(%d)", int(m))
+	}
+}
+
+// Compatibility classifies how a kernel that understands the supported
+// feature flags (eg. from KernelFeatures) is able to mount a filesystem with
+// these flags. Also returns the features responsible for any restriction.
+func (f FeatureFlags) Compatibility(supported FeatureFlags) (MountCompatibility, []Feature) {
+	if unknown := f.Incompat &^ supported.Incompat; unknown != 0 {
+		return MountUnsupported, unknown.Features()
+	}
+	if unknown := f.ROCompat &^ supported.ROCompat; unknown != 0 {
+		return MountReadOnly, unknown.Features()
+	}
+
+	return MountReadWrite, nil
+}
+
+// kernelFeatures are the release of mainline Linux in which the ext4 driver
+// first understood each incompatible and read-only compatible feature flag.
+// Compatible flags don't affect mounting, and flags that are never mountable
+// (eg. journal_dev), or that always restrict mounting to read-only (eg.
+// read-only and shared_blocks), are omitted.
+var kernelFeatures = []struct {
+	major, minor int
+	feature      Feature
+}{
+	{2, 6, Filetype},
+	{2, 6, "needs_recovery"},
+	{2, 6, MetaBG},
+	{2, 6, SparseSuper},
+	{2, 6, LargeFile},
+	{2, 6, Extent},
+	{2, 6, Has64Bit},
+	{2, 6, FlexBG},
+	{2, 6, HugeFile},
+	{2, 6, UninitBG},
+	{2, 6, DirNlink},
+	{2, 6, ExtraIsize},
+	{3, 0, MMP},
+	{3, 2, Bigalloc},
+	{3, 5, MetadataCsum},
+	{3, 6, Quota},
+	{3, 8, InlineData},
+	{4, 1, Encrypt},
+	{4, 4, MetadataCsumSeed},
+	{4, 5, Project},
+	{4, 13, EAInode},
+	{4, 13, LargeDir},
+	{5, 2, Casefold},
+	{5, 4, Verity},
+	{5, 15, "orphan_present"},
+}
+
+// KernelFeatures returns the feature flags understood by the ext4 driver of a
+// release of mainline Linux (eg. "6.1" or "5.15.0-91-generic", as reported by
+// uname -r). Versions of Linux 2.6 are assumed to be at least 2.6.28, in which
+// ext4 was declared stable. Distribution kernels may backport support for
+// newer features.
+func KernelFeatures(release string) (FeatureFlags, error) {
+	major, minor, err := parseKernelRelease(release)
+	if err != nil {
+		return FeatureFlags{}, err
+	}
+
+	var names []string
+	for _, kf := range kernelFeatures {
+		if major > kf.major || (major == kf.major && minor >= kf.minor) {
+			names = append(names, string(kf.feature))
+		}
+	}
+
+	flags, err := ParseFeatureFlags(names)
+	if err != nil {
+		return FeatureFlags{}, err
+	}
+	// Compatible flags are ignored by the kernel.
+	flags.Compat = ^CompatFeatures(0)
+
+	return flags, nil
+}
+
+// parseKernelRelease returns the major and minor version of a kernel release.
+func parseKernelRelease(release string) (int, int, error) {
+	version, _, _ := strings.Cut(release, "-")
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return 0, 0, invalidOption("malformed kernel release %q", release)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, invalidOption("malformed kernel release %q", release)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, invalidOption("malformed kernel release %q", release)
+	}
+	if major < 2 || (major == 2 && minor < 6) {
+		return 0, 0, invalidOption("kernel release %q doesn't support ext4", release)
+	}
+
+	return major, minor, nil
+}
@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	expected, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	sb, err := ext4.ReadSuperblockFile(imagePath)
+	require.NoError(t, err)
+
+	flags, err := sb.FeatureFlags()
+	require.NoError(t, err)
+	require.True(t, flags.Has(ext4.HasJournal))
+	require.True(t, flags.Has(ext4.Extent))
+	require.True(t, flags.Has(ext4.MetadataCsum))
+	require.False(t, flags.Has(ext4.Casefold))
+
+	var features []string
+	for _, f := range flags.Features() {
+		features = append(features, string(f))
+	}
+	require.Equal(t, expected.Features, features)
+
+	require.Contains(t, flags.Compat.Features(), ext4.HasJournal)
+	require.Contains(t, flags.Incompat.Features(), ext4.Extent)
+	require.Contains(t, flags.ROCompat.Features(), ext4.MetadataCsum)
+
+	t.Log("Parsing unknown flags")
+
+	flags, err = ext4.ParseFeatureFlags([]string{"filetype", "FEATURE_I11", "FEATURE_R31"})
+	require.NoError(t, err)
+	require.Equal(t, ext4.FeatureFlags{Incompat: 0x802, ROCompat: 0x80000000}, flags)
+	require.Equal(t, []ext4.Feature{"filetype", "FEATURE_I11", "FEATURE_R31"}, flags.Features())
+
+	_, err = ext4.ParseFeatureFlags([]string{"not_a_feature"})
+	require.Error(t, err)
+}
+
+func TestFeatureFlagsCompatibility(t *testing.T) {
+	linux44, err := ext4.KernelFeatures("4.4.0-210-generic")
+	require.NoError(t, err)
+
+	linux61, err := ext4.KernelFeatures("6.1")
+	require.NoError(t, err)
+
+	flags, err := ext4.ParseFeatureFlags([]string{"has_journal", "fast_commit", "extent", "64bit", "flex_bg", "metadata_csum"})
+	require.NoError(t, err)
+
+	compat, features := flags.Compatibility(linux44)
+	require.Equal(t, ext4.MountReadWrite, compat)
+	require.Empty(t, features)
+
+	flags.ROCompat |= 0x8000 // verity
+
+	compat, features = flags.Compatibility(linux44)
+	require.Equal(t, ext4.MountReadOnly, compat)
+	require.Equal(t, []ext4.Feature{ext4.Verity}, features)
+
+	flags.Incompat |= 0x20000 // casefold
+
+	compat, features = flags.Compatibility(linux44)
+	require.Equal(t, ext4.MountUnsupported, compat)
+	require.Equal(t, "unsupported", compat.String())
+	require.Equal(t, []ext4.Feature{ext4.Casefold}, features)
+
+	compat, _ = flags.Compatibility(linux61)
+	require.Equal(t, ext4.MountReadWrite, compat)
+
+	t.Log("Checking flags that are never supported")
+
+	flags, err = ext4.ParseFeatureFlags([]string{"extent", "read-only"})
+	require.NoError(t, err)
+
+	compat, features = flags.Compatibility(linux61)
+	require.Equal(t, ext4.MountReadOnly, compat)
+	require.Equal(t, []ext4.Feature{"read-only"}, features)
+
+	flags, err = ext4.ParseFeatureFlags([]string{"journal_dev"})
+	require.NoError(t, err)
+
+	compat, _ = flags.Compatibility(linux61)
+	require.Equal(t, ext4.MountUnsupported, compat)
+
+	t.Log("Parsing kernel releases")
+
+	for _, release := range []string{"", "6", "linux", "2.4.37"} {
+		_, err := ext4.KernelFeatures(release)
+		require.ErrorIs(t, err, ext4.ErrInvalidOptions, release)
+	}
+}
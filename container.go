@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// ContainerExecutor runs commands inside a container using a docker compatible
+// container runtime (eg. docker or podman). Commands are either executed in an
+// existing container, or in a new ephemeral container for each invocation.
+type ContainerExecutor struct {
+	// Runtime is the path of the container runtime binary (defaults to "docker").
+	Runtime string
+	// Container is the name or ID of a running container to execute commands in.
+	Container string
+	// Image is used to run ephemeral containers (if Container is not set). The
+	// image must contain a POSIX shell and e2fsprogs.
+	Image string
+	// Devices are passed through to ephemeral containers (eg. "/dev/sdb").
+	Devices []string
+	// Volumes are bind-mounted into ephemeral containers ("host:container").
+	Volumes []string
+	// Privileged runs ephemeral containers in privileged mode.
+	Privileged bool
+	// RunArgs are additional arguments passed to the runtime when running
+	// ephemeral containers.
+	RunArgs []string
+}
+
+// LookPath returns the binary name unchanged, it is resolved using the
+// container's $PATH (extended with /sbin and /usr/sbin).
+func (e *ContainerExecutor) LookPath(name string) (string, error) {
+	return name, nil
+}
+
+func (e *ContainerExecutor) Run(ctx context.Context, cmd *Command) error {
+	if len(cmd.ExtraFiles) > 0 {
+		return ErrExtraFilesUnsupported
+	}
+
+	runtime := e.Runtime
+	if runtime == "" {
+		runtime = "docker"
+	}
+
+	var runtimeArgs []string
+	switch {
+	case e.Container != "":
+		runtimeArgs = []string{"exec", "-i", e.Container}
+	case e.Image != "":
+		runtimeArgs = []string{"run", "--rm", "-i"}
+		if e.Privileged {
+			runtimeArgs = append(runtimeArgs, "--privileged")
+		}
+		for _, dev := range e.Devices {
+			runtimeArgs = append(runtimeArgs, "--device", dev)
+		}
+		for _, vol := range e.Volumes {
+			runtimeArgs = append(runtimeArgs, "-v", vol)
+		}
+		runtimeArgs = append(runtimeArgs, e.RunArgs...)
+		runtimeArgs = append(runtimeArgs, e.Image)
+	default:
+		return errors.New("either a container or an image must be specified")
+	}
+	runtimeArgs = append(runtimeArgs, "sh", "-c", remoteCommandLine(cmd))
+
+	execCmd := exec.CommandContext(ctx, runtime, runtimeArgs...)
+	execCmd.Stdin = cmd.Stdin
+	execCmd.Stdout = cmd.Stdout
+	execCmd.Stderr = cmd.Stderr
+
+	return execCmd.Run()
+}
@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerExecutor(t *testing.T) {
+	ctx := context.Background()
+
+	// A stand-in for the container runtime that records its arguments and
+	// runs the command line locally.
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	runtimePath := filepath.Join(dir, "docker")
+	err := os.WriteFile(runtimePath, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > "+argsPath+"\nfor last; do :; done\nexec sh -c \"$last\"\n"), 0o755)
+	require.NoError(t, err)
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	t.Log("Running commands in an ephemeral container")
+
+	c := ext4.NewClient(ext4.WithExecutor(&ext4.ContainerExecutor{
+		Runtime:    runtimePath,
+		Image:      "debian:bookworm",
+		Devices:    []string{"/dev/loop0"},
+		Volumes:    []string{filepath.Dir(imagePath) + ":" + filepath.Dir(imagePath)},
+		Privileged: true,
+	}))
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+	})
+	require.NoError(t, err)
+
+	recordedArgs, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(recordedArgs), strings.Join([]string{
+		"run", "--rm", "-i", "--privileged",
+		"--device", "/dev/loop0",
+		"-v", filepath.Dir(imagePath) + ":" + filepath.Dir(imagePath),
+		"debian:bookworm", "sh", "-c",
+	}, "\n")))
+
+	t.Log("Running commands in an existing container")
+
+	c = ext4.NewClient(ext4.WithExecutor(&ext4.ContainerExecutor{
+		Runtime:   runtimePath,
+		Container: "e2fsprogs",
+	}))
+
+	_, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	recordedArgs, err = os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(recordedArgs), "exec\n-i\ne2fsprogs\nsh\n-c\n"))
+}
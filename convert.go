@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ext4Features are the features enabled when converting a filesystem to ext4,
+// as documented by the ext4 wiki.
+var ext4Features = []string{"extent", "uninit_bg", "dir_index"}
+
+// ConvertOptions provides options for converting a filesystem to ext4.
+type ConvertOptions struct {
+	// NoJournal skips adding a journal to ext2 filesystems.
+	NoJournal bool
+	// Features are additional features to enable (eg. "huge_file").
+	Features []string
+	// UndoFile is where tune2fs saves the blocks it overwrites, so the
+	// conversion can be reverted using e2undo.
+	UndoFile string
+}
+
+// ConvertToExt4 upgrades an unmounted ext2 or ext3 filesystem to ext4 in
+// place, by enabling the ext4 features (and a journal, for ext2 filesystems)
+// with tune2fs, then rebuilding the directory indexes with e2fsck. The
+// filesystem is checked before conversion, and must be consistent. Existing
+// files keep their block mapped layout, only new files use extents. Returns
+// the superblock of the converted filesystem.
+func (c *Client) ConvertToExt4(ctx context.Context, device string, opts ConvertOptions) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "ConvertToExt4", device)
+	defer endSpan(span, &err)
+
+	if device == "" {
+		return nil, invalidOption("device is required")
+	}
+
+	unlock, err := c.requireUnmounted(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+
+	var features []string
+	for _, feature := range append(slices.Clone(ext4Features), opts.Features...) {
+		if !sb.HasFeature(Feature(feature)) && !slices.Contains(features, feature) {
+			features = append(features, feature)
+		}
+	}
+
+	// uninit_bg is superseded by metadata checksums, and the two are mutually
+	// exclusive.
+	if sb.HasFeature(MetadataCsum) {
+		features = slices.DeleteFunc(features, func(feature string) bool {
+			return feature == string(UninitBG)
+		})
+	}
+
+	addJournal := !opts.NoJournal && !sb.HasFeature(HasJournal)
+	if len(features) == 0 && !addJournal {
+		return sb, nil
+	}
+
+	if _, err := c.checkFilesystem(ctx, CheckOptions{Device: device, Force: true, Preen: true}); err != nil {
+		return nil, fmt.Errorf("filesystem check before conversion failed: %w", err)
+	}
+
+	var cmdArgs []string
+	if len(features) > 0 {
+		cmdArgs = append(cmdArgs, "-O", strings.Join(features, ","))
+	}
+	if addJournal {
+		cmdArgs = append(cmdArgs, "-j")
+	}
+	undoFile, err := c.autoUndoFile(device, opts.UndoFile)
+	if err != nil {
+		return nil, err
+	}
+	if undoFile != "" {
+		cmdArgs = append(cmdArgs, "-z", undoFile)
+	}
+	cmdArgs = append(cmdArgs, device)
+
+	if _, err := c.run(ctx, "tune2fs", cmdArgs...); err != nil {
+		return nil, fmt.Errorf("failed to enable ext4 features: %w", err)
+	}
+
+	// Enabling uninit_bg requires group descriptor checksums to be computed,
+	// and dir_index requires existing directories to be indexed.
+	if _, err := c.checkFilesystem(ctx, CheckOptions{Device: device, Force: true, OptimizeDirectories: true}); err != nil {
+		return nil, fmt.Errorf("filesystem check after conversion failed: %w", err)
+	}
+
+	return c.ReadSuperblock(ctx, device)
+}
@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertToExt4(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	srcDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0o644)
+	require.NoError(t, err)
+
+	// Creating an ext2 filesystem directly requires mke2fs -t ext2.
+	imagePath := filepath.Join(t.TempDir(), "ext2.img")
+	err = exec.Command("mke2fs", "-q", "-t", "ext2", "-d", srcDir, imagePath, "64M").Run()
+	require.NoError(t, err)
+
+	sb, err := c.ConvertToExt4(ctx, imagePath, ext4.ConvertOptions{
+		Features: []string{"huge_file"},
+	})
+	require.NoError(t, err)
+
+	for _, feature := range []string{"has_journal", "extent", "uninit_bg", "dir_index", "huge_file"} {
+		require.Contains(t, sb.Features, feature)
+	}
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, imagePath, "/", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+
+	t.Log("Converting a filesystem that is already ext4")
+
+	imagePath = createTestImage(t, c, "")
+
+	before, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	sb, err = c.ConvertToExt4(ctx, imagePath, ext4.ConvertOptions{})
+	require.NoError(t, err)
+	require.Equal(t, before.Features, sb.Features)
+	require.NotContains(t, sb.Features, "uninit_bg")
+}
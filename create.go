@@ -0,0 +1,351 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FilesystemType is the type of filesystem created by mke2fs, which selects
+// its default features (from mke2fs.conf).
+type FilesystemType string
+
+const (
+	// Ext2 filesystems have no journal, for compatibility with legacy
+	// software (eg. boot loaders) and small or flash based devices.
+	Ext2 FilesystemType = "ext2"
+	// Ext3 filesystems add a journal to ext2.
+	Ext3 FilesystemType = "ext3"
+	// Ext4 filesystems (the default) add extents, flexible block groups and
+	// metadata checksums, among other features, to ext3.
+	Ext4 FilesystemType = "ext4"
+)
+
+// Validate checks that the filesystem type is known.
+func (t FilesystemType) Validate() error {
+	switch t {
+	case "", Ext2, Ext3, Ext4:
+		return nil
+	default:
+		return invalidOption("unknown filesystem type %q", string(t))
+	}
+}
+
+// ErrorBehavior is the kernel behavior when filesystem errors are detected.
+type ErrorBehavior string
+
+const (
+	// ErrorsContinue ignores errors (marking the filesystem as needing a
+	// check).
+	ErrorsContinue ErrorBehavior = "continue"
+	// ErrorsRemountReadOnly remounts the filesystem read-only.
+	ErrorsRemountReadOnly ErrorBehavior = "remount-ro"
+	// ErrorsPanic panics the kernel.
+	ErrorsPanic ErrorBehavior = "panic"
+)
+
+// Validate checks that the error behavior is known.
+func (b ErrorBehavior) Validate() error {
+	switch b {
+	case "", ErrorsContinue, ErrorsRemountReadOnly, ErrorsPanic:
+		return nil
+	default:
+		return invalidOption("unknown error behavior %q", string(b))
+	}
+}
+
+// MarshalArg returns the error behavior in the syntax of the -e option.
+func (b ErrorBehavior) MarshalArg() string {
+	return string(b)
+}
+
+// UsageType is a filesystem usage type, selecting defaults (eg. the block
+// size and inode ratio) from mke2fs.conf.
+type UsageType string
+
+const (
+	// UsageFloppy is for filesystems smaller than 3 megabytes.
+	UsageFloppy UsageType = "floppy"
+	// UsageSmall is for filesystems smaller than 512 megabytes.
+	UsageSmall UsageType = "small"
+	// UsageDefault is for filesystems smaller than 4 terabytes.
+	UsageDefault UsageType = "default"
+	// UsageBig is for filesystems smaller than 16 terabytes.
+	UsageBig UsageType = "big"
+	// UsageHuge is for filesystems of 16 terabytes or more.
+	UsageHuge UsageType = "huge"
+	// UsageNews is for filesystems with many small files (one inode per 4
+	// kilobytes).
+	UsageNews UsageType = "news"
+	// UsageLargeFile is for filesystems with mostly large files (one inode
+	// per megabyte).
+	UsageLargeFile UsageType = "largefile"
+	// UsageLargeFile4 is for filesystems with mostly very large files (one
+	// inode per 4 megabytes).
+	UsageLargeFile4 UsageType = "largefile4"
+	// UsageHurd is for filesystems used by GNU Hurd.
+	UsageHurd UsageType = "hurd"
+)
+
+// Validate checks that the usage type is one of those in the default
+// mke2fs.conf.
+func (t UsageType) Validate() error {
+	switch t {
+	case "", UsageFloppy, UsageSmall, UsageDefault, UsageBig, UsageHuge,
+		UsageNews, UsageLargeFile, UsageLargeFile4, UsageHurd:
+		return nil
+	default:
+		return invalidOption("unknown usage type %q", string(t))
+	}
+}
+
+// MarshalArg returns the usage type in the syntax of the -T option.
+func (t UsageType) MarshalArg() string {
+	return string(t)
+}
+
+// CreatorOS is the operating system recorded as having created a filesystem.
+type CreatorOS string
+
+// The creator operating systems known to e2fsprogs.
+const (
+	CreatorOSLinux   CreatorOS = "linux"
+	CreatorOSHurd    CreatorOS = "hurd"
+	CreatorOSMasix   CreatorOS = "masix"
+	CreatorOSFreeBSD CreatorOS = "freebsd"
+	CreatorOSLites   CreatorOS = "lites"
+)
+
+// Validate checks that the creator OS is known to e2fsprogs.
+func (o CreatorOS) Validate() error {
+	switch o {
+	case "", CreatorOSLinux, CreatorOSHurd, CreatorOSMasix, CreatorOSFreeBSD, CreatorOSLites:
+		return nil
+	default:
+		return invalidOption("unknown creator OS %q", string(o))
+	}
+}
+
+// MarshalArg returns the creator OS in the syntax of the -o option.
+func (o CreatorOS) MarshalArg() string {
+	return string(o)
+}
+
+// CreatedFilesystem describes the geometry of a newly created filesystem.
+type CreatedFilesystem struct {
+	// UUID of the filesystem.
+	UUID string `json:"uuid"`
+	// Label of the filesystem.
+	Label string `json:"label,omitempty"`
+	// BlockSize in bytes.
+	BlockSize int `json:"blockSize"`
+	// BlockCount is the total number of blocks in the filesystem.
+	BlockCount uint64 `json:"blockCount"`
+	// InodeCount is the total number of inodes in the filesystem.
+	InodeCount uint64 `json:"inodeCount"`
+	// ReservedBlockCount is the number of blocks reserved for the super-user.
+	ReservedBlockCount uint64 `json:"reservedBlockCount"`
+	// FirstDataBlock is the block number of the first data block.
+	FirstDataBlock uint64 `json:"firstDataBlock"`
+	// BlockGroupCount is the number of block groups.
+	BlockGroupCount int `json:"blockGroupCount"`
+	// BlocksPerGroup is the number of blocks in each block group.
+	BlocksPerGroup uint64 `json:"blocksPerGroup"`
+	// InodesPerGroup is the number of inodes in each block group.
+	InodesPerGroup uint64 `json:"inodesPerGroup"`
+	// BackupSuperblocks are the block numbers of the backup superblocks.
+	BackupSuperblocks []uint64 `json:"backupSuperblocks,omitempty"`
+	// JournalBlocks is the size of the journal in blocks (if any).
+	JournalBlocks uint64 `json:"journalBlocks,omitempty"`
+}
+
+var (
+	mke2fsBlockSizeRegexp      = regexp.MustCompile(`^Block size=(\d+)`)
+	mke2fsCountsRegexp         = regexp.MustCompile(`^(\d+) inodes, (\d+) blocks$`)
+	mke2fsReservedRegexp       = regexp.MustCompile(`^(\d+) blocks \(.*\) reserved for the super user$`)
+	mke2fsFirstDataBlockRegexp = regexp.MustCompile(`^First data block=(\d+)$`)
+	mke2fsGroupsRegexp         = regexp.MustCompile(`^(\d+) block groups?$`)
+	mke2fsBlocksPerGroupRegexp = regexp.MustCompile(`^(\d+) blocks per group`)
+	mke2fsInodesPerGroupRegexp = regexp.MustCompile(`^(\d+) inodes per group$`)
+	mke2fsJournalRegexp        = regexp.MustCompile(`^Creating journal \((\d+) blocks\)`)
+)
+
+// ParseCreatedFilesystem parses the verbose output of mke2fs.
+func ParseCreatedFilesystem(out []byte) (*CreatedFilesystem, error) {
+	var fs CreatedFilesystem
+	var inBackups bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if inBackups {
+			if line == "" {
+				inBackups = false
+				continue
+			}
+
+			for _, block := range strings.Split(line, ",") {
+				if block = strings.TrimSpace(block); block != "" {
+					fs.BackupSuperblocks = append(fs.BackupSuperblocks, parseUint64(block))
+				}
+			}
+			continue
+		}
+
+		if v, ok := strings.CutPrefix(line, "Filesystem UUID:"); ok {
+			fs.UUID = strings.TrimSpace(v)
+		} else if v, ok := strings.CutPrefix(line, "Filesystem label="); ok {
+			fs.Label = v
+		} else if strings.HasPrefix(line, "Superblock backups stored on blocks:") {
+			inBackups = true
+		} else if m := mke2fsBlockSizeRegexp.FindStringSubmatch(line); m != nil {
+			fs.BlockSize, _ = strconv.Atoi(m[1])
+		} else if m := mke2fsCountsRegexp.FindStringSubmatch(line); m != nil {
+			fs.InodeCount = parseUint64(m[1])
+			fs.BlockCount = parseUint64(m[2])
+		} else if m := mke2fsReservedRegexp.FindStringSubmatch(line); m != nil {
+			fs.ReservedBlockCount = parseUint64(m[1])
+		} else if m := mke2fsFirstDataBlockRegexp.FindStringSubmatch(line); m != nil {
+			fs.FirstDataBlock = parseUint64(m[1])
+		} else if m := mke2fsGroupsRegexp.FindStringSubmatch(line); m != nil {
+			fs.BlockGroupCount, _ = strconv.Atoi(m[1])
+		} else if m := mke2fsBlocksPerGroupRegexp.FindStringSubmatch(line); m != nil {
+			fs.BlocksPerGroup = parseUint64(m[1])
+		} else if m := mke2fsInodesPerGroupRegexp.FindStringSubmatch(line); m != nil {
+			fs.InodesPerGroup = parseUint64(m[1])
+		} else if m := mke2fsJournalRegexp.FindStringSubmatch(line); m != nil {
+			fs.JournalBlocks = parseUint64(m[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if fs.BlockCount == 0 {
+		return nil, fmt.Errorf("unexpected mke2fs output")
+	}
+
+	return &fs, nil
+}
+
+// withFeatures returns the create options with the features, and extended
+// options, implied by the typed options (eg. quotas) added, and the label
+// policy applied.
+func (opts CreateOptions) withFeatures() CreateOptions {
+	// Errors are caught by Validate.
+	opts.Label, _ = opts.LabelPolicy.Apply(opts.Label)
+
+	features := make(FeatureSet, len(opts.FeatureSet))
+	for f, enabled := range opts.FeatureSet {
+		features[f] = enabled
+	}
+
+	if len(opts.Quotas) > 0 {
+		features[Quota] = true
+		if slices.Contains(opts.Quotas, ProjectQuota) {
+			features[Project] = true
+		}
+
+		quotaTypes := make([]string, len(opts.Quotas))
+		for i, t := range opts.Quotas {
+			quotaTypes[i] = string(t)
+		}
+		opts.ExtendedOptions.Extra = append(slices.Clone(opts.ExtendedOptions.Extra), "quotatype="+strings.Join(quotaTypes, ":"))
+	}
+	if opts.Encryption {
+		features[Encrypt] = true
+	}
+	if opts.Verity {
+		features[Verity] = true
+	}
+	if opts.InlineData {
+		features[InlineData] = true
+	}
+	if opts.ChecksumSeed {
+		features[MetadataCsumSeed] = true
+	}
+	if opts.Bigalloc != nil {
+		features[Bigalloc] = true
+		if opts.Bigalloc.ClusterSize != 0 {
+			clusterSize := opts.Bigalloc.ClusterSize
+			opts.ClusterSize = &clusterSize
+		}
+	}
+	if opts.Casefold != nil {
+		features[Casefold] = true
+		opts.ExtendedOptions.Extra = append(slices.Clone(opts.ExtendedOptions.Extra), opts.Casefold.extendedOptions()...)
+	}
+
+	if len(features) > 0 {
+		opts.Features = joinOptions(opts.Features, features.String())
+	}
+	if opts.RAIDGeometry != nil {
+		// Errors are caught by Validate.
+		blockSize := opts.raidBlockSize()
+		opts.BlockSize = &blockSize
+		opts.ExtendedOptions.Stride, opts.ExtendedOptions.StripeWidth, _ = opts.RAIDGeometry.Stride(blockSize)
+	}
+
+	return opts
+}
+
+// fsType returns the type of filesystem to create.
+func (opts CreateOptions) fsType() FilesystemType {
+	if opts.Type == "" {
+		return Ext4
+	}
+
+	return opts.Type
+}
+
+// raidBlockSize returns the block size used to derive the stride from the
+// RAID geometry.
+func (opts CreateOptions) raidBlockSize() int {
+	if opts.BlockSize != nil {
+		return *opts.BlockSize
+	}
+
+	return defaultRAIDBlockSize
+}
+
+// features returns the features explicitly enabled or disabled by the
+// options (whether with Features or FeatureSet).
+func (opts CreateOptions) features() FeatureSet {
+	features := ParseFeatureSet(opts.Features)
+	for f, enabled := range opts.FeatureSet {
+		features[f] = enabled
+	}
+
+	return features
+}
+
+// joinOptions appends options to a comma separated list.
+func joinOptions(list, options string) string {
+	if list == "" {
+		return options
+	}
+
+	return list + "," + options
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	blockSize := 4096
+	fs, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		Size:      100 * ext4.MiB,
+		BlockSize: &blockSize,
+		Label:     "test",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "test", fs.Label)
+	require.Equal(t, 4096, fs.BlockSize)
+	require.Equal(t, uint64(25600), fs.BlockCount)
+	require.NotZero(t, fs.InodeCount)
+	require.Equal(t, 1, fs.BlockGroupCount)
+	require.Equal(t, uint64(32768), fs.BlocksPerGroup)
+	require.Equal(t, fs.InodeCount, fs.InodesPerGroup)
+	require.Empty(t, fs.BackupSuperblocks)
+	require.NotZero(t, fs.JournalBlocks)
+
+	output, err := exec.Command("dumpe2fs", "-h", imagePath).Output()
+	require.NoError(t, err)
+	require.Contains(t, string(output), "Filesystem UUID:          "+fs.UUID)
+
+	t.Log("Creating a filesystem with multiple block groups")
+
+	imagePath = filepath.Join(t.TempDir(), "ext4.img")
+
+	blockSize = 1024
+	fs, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		Size:      64 * ext4.MiB,
+		BlockSize: &blockSize,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 8, fs.BlockGroupCount)
+	require.Equal(t, uint64(1), fs.FirstDataBlock)
+	require.Equal(t, []uint64{8193, 24577, 40961, 57345}, fs.BackupSuperblocks)
+	require.Len(t, fs.UUID, 36)
+}
+
+func TestCreateFilesystemWithInlineData(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "small.txt"), []byte("tiny"), 0o644))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        imagePath,
+		Size:          64 * ext4.MiB,
+		RootDirectory: rootDir,
+		InlineData:    true,
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "inline_data")
+
+	output, err := exec.Command("debugfs", "-R", "stat /small.txt", imagePath).Output()
+	require.NoError(t, err)
+	require.Contains(t, string(output), "Size of inline data")
+
+	t.Log("Creating a filesystem with inodes too small for inline data")
+
+	inodeSize := 128
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:     imagePath,
+		InodeSize:  &inodeSize,
+		InlineData: true,
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestCreateWithEnums(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        imagePath,
+		Size:          64 * ext4.MiB,
+		UsageType:     ext4.UsageLargeFile,
+		ErrorBehavior: ext4.ErrorsRemountReadOnly,
+		CreatorOS:     ext4.CreatorOSFreeBSD,
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, "Remount read-only", sb.ErrorBehavior)
+	require.Equal(t, "FreeBSD", sb.CreatorOS)
+	require.Equal(t, uint64(64), sb.InodeCount)
+}
+
+func TestCreateFilesystemTypes(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	for _, tc := range []struct {
+		fsType     ext4.FilesystemType
+		hasJournal bool
+		hasExtents bool
+	}{
+		{ext4.Ext2, false, false},
+		{ext4.Ext3, true, false},
+		{ext4.Ext4, true, true},
+	} {
+		imagePath := filepath.Join(t.TempDir(), string(tc.fsType)+".img")
+		_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+			Device: imagePath,
+			Size:   64 * ext4.MiB,
+			Type:   tc.fsType,
+		})
+		require.NoError(t, err, tc.fsType)
+
+		sb, err := c.ReadSuperblock(ctx, imagePath)
+		require.NoError(t, err)
+		require.Equal(t, tc.hasJournal, slices.Contains(sb.Features, "has_journal"), tc.fsType)
+		require.Equal(t, tc.hasExtents, slices.Contains(sb.Features, "extent"), tc.fsType)
+	}
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"unknown type":    {Device: "/dev/null", Type: "xfs"},
+		"ext2 journal":    {Device: "/dev/null", Type: ext4.Ext2, Journal: true},
+		"ext2 journal -J": {Device: "/dev/null", Type: ext4.Ext2, JournalOptions: ext4.JournalOptions{Size: 4}},
+		"ext3 inline":     {Device: "/dev/null", Type: ext4.Ext3, InlineData: true},
+	} {
+		require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+	}
+}
@@ -0,0 +1,363 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExtractDirectory recursively copies a directory tree out of an unmounted ext4
+// filesystem onto the host filesystem, preserving permissions. The destination
+// is on the host the commands are run on, so must be an absolute path with a
+// remote executor (eg. SSHExecutor).
+func (c *Client) ExtractDirectory(ctx context.Context, device, srcPath, destDir string) (err error) {
+	ctx, span := c.startSpan(ctx, "ExtractDirectory", device)
+	defer endSpan(span, &err)
+
+	absDestDir, err := c.absHostPath(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve destination directory: %w", err)
+	}
+
+	_, err = c.debugfs(ctx, device, false, debugfsRequest("rdump", srcPath, absDestDir))
+	return err
+}
+
+// WriteFileToImage copies a file from the host into an unmounted ext4
+// filesystem. The parent directory must already exist in the image, and the
+// destination must not. As with ExtractDirectory, the host path must be
+// absolute with a remote executor.
+func (c *Client) WriteFileToImage(ctx context.Context, device, hostPath, imagePath string) (err error) {
+	ctx, span := c.startSpan(ctx, "WriteFileToImage", device)
+	defer endSpan(span, &err)
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	absHostPath, err := c.absHostPath(hostPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve host path: %w", err)
+	}
+
+	// debugfs links the new file into the current directory under the literal
+	// destination name, so we need to change into the parent directory first.
+	_, err = c.debugfs(ctx, device, true,
+		debugfsRequest("cd", path.Dir(imagePath)),
+		debugfsRequest("write", absHostPath, path.Base(imagePath)))
+	return err
+}
+
+// MakeDirectoryInImage creates a directory in an unmounted ext4 filesystem.
+// If the directory already exists, the error wraps fs.ErrExist.
+func (c *Client) MakeDirectoryInImage(ctx context.Context, device, imagePath string) (err error) {
+	ctx, span := c.startSpan(ctx, "MakeDirectoryInImage", device)
+	defer endSpan(span, &err)
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = c.debugfs(ctx, device, true, debugfsRequest("mkdir", imagePath))
+	return err
+}
+
+// SymlinkInImage creates a symbolic link, pointing at target, in an unmounted
+// ext4 filesystem.
+func (c *Client) SymlinkInImage(ctx context.Context, device, target, imagePath string) (err error) {
+	ctx, span := c.startSpan(ctx, "SymlinkInImage", device)
+	defer endSpan(span, &err)
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = c.debugfs(ctx, device, true, debugfsRequest("symlink", imagePath, target))
+	return err
+}
+
+// RemoveFromImage removes a file, symbolic link, or empty directory from an
+// unmounted ext4 filesystem. If it doesn't exist, the error wraps
+// fs.ErrNotExist.
+func (c *Client) RemoveFromImage(ctx context.Context, device, imagePath string) (err error) {
+	ctx, span := c.startSpan(ctx, "RemoveFromImage", device)
+	defer endSpan(span, &err)
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = c.debugfs(ctx, device, true, debugfsRequest("rm", imagePath))
+	if err != nil && strings.Contains(err.Error(), "file is a directory") {
+		_, err = c.debugfs(ctx, device, true, debugfsRequest("rmdir", imagePath))
+	}
+	return err
+}
+
+// BlockOwner describes the inode (and file paths) using a filesystem block.
+type BlockOwner struct {
+	// Block is the filesystem block number.
+	Block uint64 `json:"block"`
+	// Inode is the number of the inode using the block (zero if the block
+	// is not used by any inode, eg. free or filesystem metadata blocks).
+	Inode uint64 `json:"inode,omitempty"`
+	// Paths are the path names linked to the inode.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// FindFilesUsingBlocks maps filesystem blocks to the inodes, and path names,
+// using them. This is typically used to identify the files affected by bad
+// blocks.
+func (c *Client) FindFilesUsingBlocks(ctx context.Context, device string, blocks []uint64) (_ []BlockOwner, err error) {
+	ctx, span := c.startSpan(ctx, "FindFilesUsingBlocks", device)
+	defer endSpan(span, &err)
+
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+
+	icheckArgs := make([]string, len(blocks))
+	for i, block := range blocks {
+		icheckArgs[i] = strconv.FormatUint(block, 10)
+	}
+
+	out, err := c.debugfs(ctx, device, false, debugfsRequest("icheck", icheckArgs...))
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make([]BlockOwner, 0, len(blocks))
+	inodes := make(map[uint64][]string)
+	var ncheckArgs []string
+	for _, fields := range parseDebugfsTable(out) {
+		owner := BlockOwner{Block: parseUint64(fields[0])}
+		if inode, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			owner.Inode = inode
+			if _, ok := inodes[inode]; !ok {
+				inodes[inode] = nil
+				ncheckArgs = append(ncheckArgs, fields[1])
+			}
+		}
+
+		owners = append(owners, owner)
+	}
+
+	if len(ncheckArgs) == 0 {
+		return owners, nil
+	}
+
+	out, err = c.debugfs(ctx, device, false, debugfsRequest("ncheck", ncheckArgs...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fields := range parseDebugfsTable(out) {
+		inode := parseUint64(fields[0])
+		// ncheck reports files in the root directory with a double slash.
+		inodes[inode] = append(inodes[inode], path.Clean(fields[1]))
+	}
+
+	for i := range owners {
+		owners[i].Paths = inodes[owners[i].Inode]
+	}
+
+	return owners, nil
+}
+
+// debugfs runs one or more requests against the filesystem on the given
+// device. debugfs reports most failures on stderr while still exiting
+// successfully, so any unexpected diagnostic output is treated as an error.
+func (c *Client) debugfs(ctx context.Context, device string, writable bool, requests ...string) ([]byte, error) {
+	for _, req := range requests {
+		if strings.ContainsAny(req, "\r\n") {
+			return nil, fmt.Errorf("invalid debugfs request: %q", req)
+		}
+	}
+
+	var cmdArgs []string
+	if writable {
+		cmdArgs = append(cmdArgs, "-w")
+	}
+
+	var stdin io.Reader
+	if len(requests) == 1 {
+		cmdArgs = append(cmdArgs, "-R", requests[0])
+	} else {
+		cmdArgs = append(cmdArgs, "-f", "-")
+		stdin = strings.NewReader(strings.Join(requests, "\n") + "\n")
+	}
+	cmdArgs = append(cmdArgs, device)
+
+	out, errOut, err := c.runWithInput(ctx, stdin, "debugfs", cmdArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg := debugfsErrors(errOut); msg != "" {
+		return nil, debugfsError(msg)
+	}
+
+	return out, nil
+}
+
+// absHostPath returns the absolute form of a path on the host that commands
+// are run on. The working directory is only known for the local executor, so
+// with other executors (eg. SSH) the path must already be absolute.
+func (c *Client) absHostPath(p string) (string, error) {
+	if _, local := c.executor.(*LocalExecutor); local {
+		return filepath.Abs(p)
+	}
+
+	if !path.IsAbs(p) {
+		return "", invalidOption("%s must be an absolute path when commands are run remotely", p)
+	}
+
+	return p, nil
+}
+
+// debugfsError returns an error for the diagnostic output of debugfs, wrapping
+// fs.ErrExist or fs.ErrNotExist where the output indicates it.
+func debugfsError(msg string) error {
+	switch {
+	case strings.Contains(msg, "already exists"):
+		return fmt.Errorf("debugfs: %w: %s", fs.ErrExist, msg)
+	case strings.Contains(msg, "File not found by ext2_lookup"):
+		return fmt.Errorf("debugfs: %w: %s", fs.ErrNotExist, msg)
+	default:
+		return fmt.Errorf("debugfs: %s", msg)
+	}
+}
+
+// debugfsSections runs the requests in a single debugfs session (opened
+// read-only) and returns the output of each request separately.
+func (c *Client) debugfsSections(ctx context.Context, device string, requests ...string) ([]string, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	out, err := c.debugfs(ctx, device, false, requests...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(requests) == 1 {
+		return []string{string(out)}, nil
+	}
+
+	// When reading requests from stdin, debugfs echoes each one before its
+	// output.
+	var sections []string
+	var sb strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	for first := true; scanner.Scan(); {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "debugfs: ") {
+			if !first {
+				sections = append(sections, sb.String())
+				sb.Reset()
+			}
+			first = false
+			continue
+		}
+
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sections = append(sections, sb.String())
+
+	if len(sections) != len(requests) {
+		return nil, fmt.Errorf("unexpected debugfs output: expected %d sections, got %d", len(requests), len(sections))
+	}
+
+	return sections, nil
+}
+
+// debugfsErrors returns any diagnostic messages in debugfs's stderr output,
+// ignoring the version banner.
+func debugfsErrors(errOut []byte) string {
+	var msgs []string
+	scanner := bufio.NewScanner(bytes.NewReader(errOut))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "debugfs ") {
+			continue
+		}
+		msgs = append(msgs, line)
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// debugfsRequest builds a debugfs request line, quoting any arguments that
+// contain whitespace or quotes.
+func debugfsRequest(name string, reqArgs ...string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, arg := range reqArgs {
+		sb.WriteByte(' ')
+		sb.WriteString(debugfsQuote(arg))
+	}
+
+	return sb.String()
+}
+
+func debugfsQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+
+	return `"` + strings.ReplaceAll(arg, `"`, `""`) + `"`
+}
+
+// parseDebugfsTable parses the two column, tab separated, tables printed by
+// commands such as icheck and ncheck (skipping the header row).
+func parseDebugfsTable(out []byte) [][2]string {
+	var rows [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for first := true; scanner.Scan(); first = false {
+		key, value, found := strings.Cut(scanner.Text(), "\t")
+		if first || !found {
+			continue
+		}
+
+		rows = append(rows, [2]string{key, value})
+	}
+
+	return rows
+}
@@ -0,0 +1,183 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractDirectory(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	srcDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(srcDir, "a", "b"), 0o755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(srcDir, "a", "b", "test.txt"), []byte("hello world"), 0o640)
+	require.NoError(t, err)
+
+	imagePath := createTestImage(t, c, srcDir)
+
+	destDir := t.TempDir()
+	err = c.ExtractDirectory(ctx, imagePath, "/a", destDir)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(destDir, "a", "b", "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+
+	fi, err := os.Stat(filepath.Join(destDir, "a", "b", "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), fi.Mode().Perm())
+
+	err = c.ExtractDirectory(ctx, imagePath, "/missing", destDir)
+	require.Error(t, err)
+}
+
+func TestModifyImage(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	hostPath := filepath.Join(t.TempDir(), "test.txt")
+	err := os.WriteFile(hostPath, []byte("hello world"), 0o600)
+	require.NoError(t, err)
+
+	err = c.MakeDirectoryInImage(ctx, imagePath, "/etc")
+	require.NoError(t, err)
+
+	err = c.MakeDirectoryInImage(ctx, imagePath, "/etc")
+	require.ErrorIs(t, err, fs.ErrExist)
+
+	err = c.WriteFileToImage(ctx, imagePath, hostPath, "/etc/test.txt")
+	require.NoError(t, err)
+
+	err = c.WriteFileToImage(ctx, imagePath, hostPath, "/etc/test.txt")
+	require.Error(t, err, "expected an error when overwriting an existing file")
+
+	err = c.SymlinkInImage(ctx, imagePath, "test.txt", "/etc/link")
+	require.NoError(t, err)
+
+	err = c.MakeDirectoryInImage(ctx, imagePath, "/etc/empty")
+	require.NoError(t, err)
+
+	err = c.RemoveFromImage(ctx, imagePath, "/etc/empty")
+	require.NoError(t, err)
+
+	destDir := t.TempDir()
+	err = c.ExtractDirectory(ctx, imagePath, "/etc", destDir)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(destDir, "etc", "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+
+	target, err := os.Readlink(filepath.Join(destDir, "etc", "link"))
+	require.NoError(t, err)
+	require.Equal(t, "test.txt", target)
+
+	_, err = os.Stat(filepath.Join(destDir, "etc", "empty"))
+	require.True(t, os.IsNotExist(err))
+
+	err = c.RemoveFromImage(ctx, imagePath, "/etc/test.txt")
+	require.NoError(t, err)
+
+	err = c.RemoveFromImage(ctx, imagePath, "/etc/test.txt")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestFindFilesUsingBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	srcDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(srcDir, "test.txt"), []byte("hello world"), 0o644)
+	require.NoError(t, err)
+
+	imagePath := createTestImage(t, c, srcDir)
+
+	t.Log("Finding the block used by the file")
+
+	out, err := exec.Command("debugfs", "-R", "bmap /test.txt 0", imagePath).Output()
+	require.NoError(t, err)
+
+	block, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	require.NoError(t, err)
+
+	owners, err := c.FindFilesUsingBlocks(ctx, imagePath, []uint64{block, 1})
+	require.NoError(t, err)
+
+	require.Len(t, owners, 2)
+
+	require.Equal(t, block, owners[0].Block)
+	require.NotZero(t, owners[0].Inode)
+	require.Equal(t, []string{"/test.txt"}, owners[0].Paths)
+
+	require.Equal(t, uint64(1), owners[1].Block)
+	require.Zero(t, owners[1].Inode)
+	require.Empty(t, owners[1].Paths)
+}
+
+func createTestImage(t *testing.T, c *ext4.Client, rootDir string) string {
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := c.CreateFilesystem(context.Background(), ext4.CreateOptions{
+		Device:        imagePath,
+		Size:          64 * ext4.MiB,
+		RootDirectory: rootDir,
+	})
+	require.NoError(t, err)
+
+	return imagePath
+}
+
+func TestRemoteHostPaths(t *testing.T) {
+	ctx := context.Background()
+
+	// The working directory of a remote host is unknown.
+	e := &ext4test.RecordingExecutor{}
+	c := ext4.NewClient(ext4.WithExecutor(e))
+
+	err := c.ExtractDirectory(ctx, "/dev/sdb", "/etc", "out")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	err = c.WriteFileToImage(ctx, "/dev/sdb", "test.txt", "/etc/test.txt")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	require.Empty(t, e.Argv())
+
+	require.NoError(t, c.ExtractDirectory(ctx, "/dev/sdb", "/etc", "/srv/out"))
+	require.NoError(t, c.WriteFileToImage(ctx, "/dev/sdb", "/srv/test.txt", "/etc/test.txt"))
+	require.Len(t, e.Argv(), 2)
+}
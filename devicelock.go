@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// deviceLocks serializes operations that modify a device, so that concurrent
+// calls from the same process (eg. a mke2fs racing an e2fsck) don't corrupt
+// the filesystem.
+type deviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*deviceLock
+}
+
+type deviceLock struct {
+	// ch is a semaphore (with a capacity of one) so that waiters can give up
+	// when their context is cancelled.
+	ch   chan struct{}
+	refs int
+}
+
+// lockDevice acquires exclusive access to the given device, returning a
+// function that releases it.
+func (c *Client) lockDevice(ctx context.Context, device string) (func(), error) {
+	key := filepath.Clean(device)
+
+	c.deviceLocks.mu.Lock()
+	if c.deviceLocks.locks == nil {
+		c.deviceLocks.locks = make(map[string]*deviceLock)
+	}
+	lock, ok := c.deviceLocks.locks[key]
+	if !ok {
+		lock = &deviceLock{ch: make(chan struct{}, 1)}
+		c.deviceLocks.locks[key] = lock
+	}
+	lock.refs++
+	c.deviceLocks.mu.Unlock()
+
+	release := func() {
+		c.deviceLocks.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(c.deviceLocks.locks, key)
+		}
+		c.deviceLocks.mu.Unlock()
+	}
+
+	select {
+	case lock.ch <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+
+	unlockFile := func() {}
+	if _, local := c.executor.(*LocalExecutor); local && c.flockDevices {
+		var err error
+		unlockFile, err = flockDevice(ctx, filepath.Join(c.chroot, device))
+		if errors.Is(err, os.ErrNotExist) {
+			// Eg. an image file that is yet to be created.
+			unlockFile, err = func() {}, nil
+		}
+		if err != nil {
+			<-lock.ch
+			release()
+			return nil, fmt.Errorf("failed to lock device: %w", err)
+		}
+	}
+
+	return func() {
+		unlockFile()
+		<-lock.ch
+		release()
+	}, nil
+}
@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceLocking(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	hostPath := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(hostPath, []byte("Hello, world!"), 0o644))
+
+	t.Log("Writing to the same image concurrently")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.WriteFileToImage(ctx, imagePath, hostPath, fmt.Sprintf("/file%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		NoFix:  true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+}
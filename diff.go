@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Change is a difference between two superblock reports.
+type Change struct {
+	// Field is the name of the SuperblockInfo field that changed (eg.
+	// "FreeBlocks").
+	Field string `json:"field"`
+	// Old is the value of the field in the first report.
+	Old any `json:"old"`
+	// New is the value of the field in the second report.
+	New any `json:"new"`
+	// Added holds the elements added to a list field (eg. enabled features).
+	Added []string `json:"added,omitempty"`
+	// Removed holds the elements removed from a list field.
+	Removed []string `json:"removed,omitempty"`
+}
+
+func (c Change) String() string {
+	if c.Added != nil || c.Removed != nil {
+		var elems []string
+		for _, e := range c.Added {
+			elems = append(elems, "+"+e)
+		}
+		for _, e := range c.Removed {
+			elems = append(elems, "-"+e)
+		}
+		return fmt.Sprintf("%s: %s", c.Field, strings.Join(elems, " "))
+	}
+
+	return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+}
+
+// Diff compares two superblock reports (eg. taken before and after an
+// operation) and returns the fields that changed, in the order they are
+// declared in SuperblockInfo. List fields (eg. Features) are compared as sets.
+func Diff(a, b SuperblockInfo) []Change {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := va.Type()
+
+	var changes []Change
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fa, fb := va.Field(i).Interface(), vb.Field(i).Interface()
+		switch old := fa.(type) {
+		case []string:
+			added, removed := diffSets(old, fb.([]string))
+			if added != nil || removed != nil {
+				changes = append(changes, Change{
+					Field:   field.Name,
+					Old:     fa,
+					New:     fb,
+					Added:   added,
+					Removed: removed,
+				})
+			}
+		case time.Time:
+			if !old.Equal(fb.(time.Time)) {
+				changes = append(changes, Change{Field: field.Name, Old: fa, New: fb})
+			}
+		default:
+			if !reflect.DeepEqual(fa, fb) {
+				changes = append(changes, Change{Field: field.Name, Old: fa, New: fb})
+			}
+		}
+	}
+
+	return changes
+}
+
+// diffSets returns the (sorted) elements of b that aren't in a, and of a that
+// aren't in b.
+func diffSets(a, b []string) (added, removed []string) {
+	for _, e := range b {
+		if !slices.Contains(a, e) && !slices.Contains(added, e) {
+			added = append(added, e)
+		}
+	}
+	for _, e := range a {
+		if !slices.Contains(b, e) && !slices.Contains(removed, e) {
+			removed = append(removed, e)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+
+	return added, removed
+}
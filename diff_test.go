@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	a := ext4.SuperblockInfo{
+		UUID:       "1b4e28ba-2fa1-11d2-883f-0016d3cca427",
+		Features:   []string{"has_journal", "extent", "huge_file"},
+		FreeBlocks: 1000,
+		MountCount: 3,
+		Created:    created,
+	}
+
+	require.Empty(t, ext4.Diff(a, a))
+
+	b := a
+	b.Features = []string{"metadata_csum", "extent", "has_journal"}
+	b.FreeBlocks = 900
+	b.ErrorCount = 2
+	// The same instant, in a different time zone.
+	b.Created = created.In(time.FixedZone("UTC+1", 3600))
+
+	changes := ext4.Diff(a, b)
+	require.Len(t, changes, 3)
+
+	require.Equal(t, "Features", changes[0].Field)
+	require.Equal(t, []string{"metadata_csum"}, changes[0].Added)
+	require.Equal(t, []string{"huge_file"}, changes[0].Removed)
+	require.Equal(t, "Features: +metadata_csum -huge_file", changes[0].String())
+
+	require.Equal(t, "FreeBlocks", changes[1].Field)
+	require.Equal(t, uint64(1000), changes[1].Old)
+	require.Equal(t, uint64(900), changes[1].New)
+	require.Equal(t, "FreeBlocks: 1000 -> 900", changes[1].String())
+
+	require.Equal(t, "ErrorCount", changes[2].Field)
+
+	t.Log("Reordering features")
+
+	b = a
+	b.Features = []string{"huge_file", "has_journal", "extent"}
+	require.Empty(t, ext4.Diff(a, b))
+}
+
+func TestDiffFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	before, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	hostPath := filepath.Join(t.TempDir(), "data.bin")
+	require.NoError(t, os.WriteFile(hostPath, make([]byte, 1<<20), 0o644))
+	require.NoError(t, c.WriteFileToImage(ctx, imagePath, hostPath, "/data.bin"))
+
+	out, err := exec.Command("tune2fs", "-c", "20", "-O", "^huge_file", imagePath).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	after, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	fields := make(map[string]ext4.Change)
+	for _, change := range ext4.Diff(*before, *after) {
+		fields[change.Field] = change
+	}
+
+	require.Equal(t, []string{"huge_file"}, fields["Features"].Removed)
+	require.Equal(t, before.FreeInodes-1, fields["FreeInodes"].New)
+	require.Equal(t, 20, fields["MaxMountCount"].New)
+	require.NotContains(t, fields, "UUID")
+	require.NotContains(t, fields, "BlockCount")
+}
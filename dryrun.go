@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrDryRun is matched (using errors.Is) by errors returned from clients in
+// dry-run mode.
+var ErrDryRun = errors.New("dry run")
+
+// DryRunError is returned by clients in dry-run mode in place of executing a
+// command that would modify a filesystem.
+type DryRunError struct {
+	// Argv is the command line that would have been executed.
+	Argv []string
+	// Env holds the additional environment variables that would have been set.
+	Env []string
+	// Stdin is the input that would have been passed to the command (unless
+	// it's sensitive, eg. a passphrase).
+	Stdin string
+}
+
+func (e *DryRunError) Error() string {
+	return fmt.Sprintf("dry run: %s", strings.Join(e.Argv, " "))
+}
+
+func (e *DryRunError) Is(target error) bool {
+	return target == ErrDryRun
+}
+
+// isReadOnly returns true if the command only inspects a filesystem, and so is
+// safe to execute in dry-run mode.
+func isReadOnly(cmdName string, cmdArgs []string) bool {
+	switch cmdName {
+	case "dumpe2fs", "e2mmpstatus":
+		return true
+	case "debugfs":
+		return !slices.Contains(cmdArgs, "-w")
+	case "e2fsck":
+		return slices.Contains(cmdArgs, "-n")
+	case "resize2fs":
+		return slices.Contains(cmdArgs, "-P")
+	default:
+		return false
+	}
+}
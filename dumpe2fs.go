@@ -0,0 +1,529 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SuperblockInfo describes the superblock of a filesystem.
+type SuperblockInfo struct {
+	// Label is the volume name of the filesystem.
+	Label string `json:"label,omitempty"`
+	// LastMountedOn is the directory where the filesystem was last mounted.
+	LastMountedOn string `json:"lastMountedOn,omitempty"`
+	// UUID of the filesystem.
+	UUID string `json:"uuid"`
+	// Magic number of the filesystem (0xEF53 for ext2/3/4).
+	Magic uint16 `json:"magic"`
+	// Revision level of the filesystem.
+	Revision int `json:"revision"`
+	// Features enabled on the filesystem.
+	Features []string `json:"features,omitempty"`
+	// Flags set on the filesystem (eg. signed_directory_hash).
+	Flags []string `json:"flags,omitempty"`
+	// Encoding of file names in case-insensitive directories (if the casefold
+	// feature is enabled), eg. "utf8-12.1".
+	Encoding string `json:"encoding,omitempty"`
+	// DefaultMountOptions are the mount options applied by default.
+	DefaultMountOptions []string `json:"defaultMountOptions,omitempty"`
+	// State of the filesystem (eg. "clean", "not clean", "clean with errors").
+	State string `json:"state"`
+	// ErrorBehavior is the kernel behavior when errors are detected.
+	ErrorBehavior string `json:"errorBehavior"`
+	// CreatorOS is the operating system that created the filesystem.
+	CreatorOS string `json:"creatorOS"`
+	// InodeCount is the total number of inodes.
+	InodeCount uint64 `json:"inodeCount"`
+	// BlockCount is the total number of blocks.
+	BlockCount uint64 `json:"blockCount"`
+	// ReservedBlockCount is the number of blocks reserved for the super-user.
+	ReservedBlockCount uint64 `json:"reservedBlockCount"`
+	// FreeBlocks is the number of free blocks.
+	FreeBlocks uint64 `json:"freeBlocks"`
+	// FreeInodes is the number of free inodes.
+	FreeInodes uint64 `json:"freeInodes"`
+	// FirstBlock is the block number of the first data block.
+	FirstBlock uint64 `json:"firstBlock"`
+	// BlockSize in bytes.
+	BlockSize int `json:"blockSize"`
+	// ClusterSize in bytes (only reported for bigalloc filesystems).
+	ClusterSize int `json:"clusterSize,omitempty"`
+	// BlocksPerGroup is the number of blocks in each block group.
+	BlocksPerGroup uint64 `json:"blocksPerGroup"`
+	// InodesPerGroup is the number of inodes in each block group.
+	InodesPerGroup uint64 `json:"inodesPerGroup"`
+	// InodeSize in bytes.
+	InodeSize int `json:"inodeSize"`
+	// FirstInode is the first inode number available for files (the inodes
+	// before it are reserved).
+	FirstInode uint64 `json:"firstInode"`
+	// DescriptorSize is the size of the group descriptors in bytes (only
+	// reported for 64bit filesystems).
+	DescriptorSize int `json:"descriptorSize,omitempty"`
+	// ReservedGDTBlocks is the number of blocks reserved for growing the group
+	// descriptor table.
+	ReservedGDTBlocks uint64 `json:"reservedGDTBlocks"`
+	// FirstMetaBlockGroup is the first block group whose descriptors are
+	// stored using the meta_bg layout (if the feature is enabled).
+	FirstMetaBlockGroup uint64 `json:"firstMetaBlockGroup,omitempty"`
+	// BackupBlockGroups are the block groups holding backup superblocks (if
+	// the sparse_super2 feature is enabled).
+	BackupBlockGroups []uint64 `json:"backupBlockGroups,omitempty"`
+	// FlexBlockGroupSize is the number of block groups in a flex_bg group.
+	FlexBlockGroupSize int `json:"flexBlockGroupSize,omitempty"`
+	// RAIDStride is the RAID stride in blocks.
+	RAIDStride uint64 `json:"raidStride,omitempty"`
+	// RAIDStripeWidth is the RAID stripe width in blocks.
+	RAIDStripeWidth uint64 `json:"raidStripeWidth,omitempty"`
+	// HashAlgorithm is the default hash algorithm of indexed directories (eg.
+	// "half_md4").
+	HashAlgorithm string `json:"hashAlgorithm,omitempty"`
+	// HashSeed is the seed of the directory hashes.
+	HashSeed string `json:"hashSeed,omitempty"`
+	// Created is when the filesystem was created.
+	Created time.Time `json:"created"`
+	// LastMounted is when the filesystem was last mounted.
+	LastMounted time.Time `json:"lastMounted"`
+	// LastWritten is when the filesystem was last written.
+	LastWritten time.Time `json:"lastWritten"`
+	// LastChecked is when the filesystem was last checked.
+	LastChecked time.Time `json:"lastChecked"`
+	// MountCount is the number of mounts since the last check.
+	MountCount int `json:"mountCount"`
+	// MaxMountCount is the number of mounts after which a check is forced
+	// (negative if disabled).
+	MaxMountCount int `json:"maxMountCount"`
+	// CheckInterval is the maximum time between checks (zero if disabled).
+	CheckInterval time.Duration `json:"checkInterval"`
+	// ErrorCount is the number of filesystem errors recorded.
+	ErrorCount int `json:"errorCount,omitempty"`
+	// FirstErrorTime is when the first recorded error occurred.
+	FirstErrorTime time.Time `json:"firstErrorTime"`
+	// LastErrorTime is when the most recent recorded error occurred.
+	LastErrorTime time.Time `json:"lastErrorTime"`
+	// MMPBlock is the location of the multi-mount protection block (if enabled).
+	MMPBlock uint64 `json:"mmpBlock,omitempty"`
+	// MMPUpdateInterval is the multi-mount protection update interval.
+	MMPUpdateInterval time.Duration `json:"mmpUpdateInterval,omitempty"`
+	// UserQuotaInode is the inode number of the user quota file (if user
+	// quotas are enabled).
+	UserQuotaInode uint64 `json:"userQuotaInode,omitempty"`
+	// GroupQuotaInode is the inode number of the group quota file (if group
+	// quotas are enabled).
+	GroupQuotaInode uint64 `json:"groupQuotaInode,omitempty"`
+	// ProjectQuotaInode is the inode number of the project quota file (if
+	// project quotas are enabled).
+	ProjectQuotaInode uint64 `json:"projectQuotaInode,omitempty"`
+	// JournalInode is the inode number of the journal (if any).
+	JournalInode uint64 `json:"journalInode,omitempty"`
+	// JournalUUID is the UUID of the external journal (if any).
+	JournalUUID string `json:"journalUUID,omitempty"`
+	// JournalFeatures are the features enabled on the journal.
+	JournalFeatures []string `json:"journalFeatures,omitempty"`
+	// JournalBlocks is the size of the journal in blocks.
+	JournalBlocks uint64 `json:"journalBlocks,omitempty"`
+	// JournalSequence is the sequence number of the next journal transaction.
+	JournalSequence uint32 `json:"journalSequence,omitempty"`
+	// JournalStart is the block where the journal log begins (zero if the
+	// journal is empty).
+	JournalStart uint32 `json:"journalStart,omitempty"`
+	// ChecksumType is the metadata checksum algorithm (eg. crc32c).
+	ChecksumType string `json:"checksumType,omitempty"`
+	// Checksum of the superblock.
+	Checksum uint32 `json:"checksum,omitempty"`
+	// ChecksumSeed is the seed of the metadata checksums (if the
+	// metadata_csum_seed feature is enabled).
+	ChecksumSeed uint32 `json:"checksumSeed,omitempty"`
+}
+
+// ReadSuperblock returns the superblock information of an ext4 filesystem.
+func (c *Client) ReadSuperblock(ctx context.Context, device string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "ReadSuperblock", device)
+	defer endSpan(span, &err)
+
+	out, err := c.run(ctx, "dumpe2fs", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSuperblock(out)
+}
+
+// ParseSuperblock parses the superblock information output by dumpe2fs -h (or
+// tune2fs -l, which uses the same format).
+func ParseSuperblock(out []byte) (*SuperblockInfo, error) {
+	var sb SuperblockInfo
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "Filesystem volume name":
+			if value != "<none>" {
+				sb.Label = value
+			}
+		case "Last mounted on":
+			if value != "<not available>" {
+				sb.LastMountedOn = value
+			}
+		case "Filesystem UUID":
+			sb.UUID = value
+		case "Filesystem magic number":
+			v, _ := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 16)
+			sb.Magic = uint16(v)
+		case "Filesystem revision #":
+			sb.Revision, _ = strconv.Atoi(firstField(value))
+		case "Filesystem features":
+			sb.Features = parseList(value)
+		case "Filesystem flags":
+			sb.Flags = parseList(value)
+		case "Character encoding":
+			sb.Encoding = value
+		case "Default mount options":
+			sb.DefaultMountOptions = parseList(value)
+		case "Filesystem state":
+			sb.State = value
+		case "Errors behavior":
+			sb.ErrorBehavior = value
+		case "Filesystem OS type":
+			sb.CreatorOS = value
+		case "Inode count":
+			sb.InodeCount = parseUint64(value)
+		case "Block count":
+			sb.BlockCount = parseUint64(value)
+		case "Reserved block count":
+			sb.ReservedBlockCount = parseUint64(value)
+		case "Free blocks":
+			sb.FreeBlocks = parseUint64(value)
+		case "Free inodes":
+			sb.FreeInodes = parseUint64(value)
+		case "First block":
+			sb.FirstBlock = parseUint64(value)
+		case "Block size":
+			sb.BlockSize, _ = strconv.Atoi(value)
+		case "Cluster size":
+			sb.ClusterSize, _ = strconv.Atoi(value)
+		case "Blocks per group":
+			sb.BlocksPerGroup = parseUint64(value)
+		case "Inodes per group":
+			sb.InodesPerGroup = parseUint64(value)
+		case "Inode size":
+			sb.InodeSize, _ = strconv.Atoi(value)
+		case "First inode":
+			sb.FirstInode = parseUint64(value)
+		case "Group descriptor size":
+			sb.DescriptorSize, _ = strconv.Atoi(value)
+		case "Reserved GDT blocks":
+			sb.ReservedGDTBlocks = parseUint64(value)
+		case "First meta block group":
+			sb.FirstMetaBlockGroup = parseUint64(value)
+		case "Backup block groups":
+			for _, group := range strings.Fields(value) {
+				sb.BackupBlockGroups = append(sb.BackupBlockGroups, parseUint64(group))
+			}
+		case "Flex block group size":
+			sb.FlexBlockGroupSize, _ = strconv.Atoi(value)
+		case "RAID stride":
+			sb.RAIDStride = parseUint64(value)
+		case "RAID stripe width":
+			sb.RAIDStripeWidth = parseUint64(value)
+		case "Default directory hash":
+			sb.HashAlgorithm = value
+		case "Directory Hash Seed":
+			sb.HashSeed = value
+		case "Filesystem created":
+			sb.Created = parseTime(value)
+		case "Last mount time":
+			sb.LastMounted = parseTime(value)
+		case "Last write time":
+			sb.LastWritten = parseTime(value)
+		case "Last checked":
+			sb.LastChecked = parseTime(value)
+		case "Mount count":
+			sb.MountCount, _ = strconv.Atoi(value)
+		case "Maximum mount count":
+			sb.MaxMountCount, _ = strconv.Atoi(value)
+		case "Check interval":
+			sb.CheckInterval = time.Duration(parseUint64(firstField(value))) * time.Second
+		case "FS Error count":
+			sb.ErrorCount, _ = strconv.Atoi(value)
+		case "First error time":
+			sb.FirstErrorTime = parseTime(value)
+		case "Last error time":
+			sb.LastErrorTime = parseTime(value)
+		case "MMP block number":
+			sb.MMPBlock = parseUint64(value)
+		case "MMP update interval":
+			sb.MMPUpdateInterval = time.Duration(parseUint64(value)) * time.Second
+		case "User quota inode":
+			sb.UserQuotaInode = parseUint64(value)
+		case "Group quota inode":
+			sb.GroupQuotaInode = parseUint64(value)
+		case "Project quota inode":
+			sb.ProjectQuotaInode = parseUint64(value)
+		case "Journal inode":
+			sb.JournalInode = parseUint64(value)
+		case "Journal UUID":
+			sb.JournalUUID = value
+		case "Journal features":
+			if value != "(none)" {
+				sb.JournalFeatures = parseList(value)
+			}
+		case "Total journal blocks":
+			sb.JournalBlocks = parseUint64(value)
+		case "Journal sequence":
+			sb.JournalSequence = parseHexUint32(strings.TrimPrefix(value, "0x"))
+		case "Journal start":
+			sb.JournalStart = parseUint32(value)
+		case "Checksum type":
+			sb.ChecksumType = value
+		case "Checksum":
+			sb.Checksum = parseHexUint32(strings.TrimPrefix(value, "0x"))
+		case "Checksum seed":
+			sb.ChecksumSeed = parseHexUint32(strings.TrimPrefix(value, "0x"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if sb.BlockCount == 0 {
+		return nil, fmt.Errorf("unexpected dumpe2fs output")
+	}
+
+	return &sb, nil
+}
+
+// Range is an inclusive range of block or inode numbers.
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// BlockGroup describes a single block group of a filesystem.
+type BlockGroup struct {
+	// Number of the block group.
+	Number int `json:"number"`
+	// Blocks spanned by the block group.
+	Blocks Range `json:"blocks"`
+	// Checksum of the group descriptor (if checksums are enabled).
+	Checksum uint32 `json:"checksum,omitempty"`
+	// Flags set on the group descriptor (eg. INODE_UNINIT).
+	Flags []string `json:"flags,omitempty"`
+	// Superblock is the location of the superblock (or backup superblock)
+	// stored in the group, if any.
+	Superblock *uint64 `json:"superblock,omitempty"`
+	// BackupSuperblock is true if the group contains a backup superblock.
+	BackupSuperblock bool `json:"backupSuperblock"`
+	// GroupDescriptors are the blocks holding the group descriptor table (if
+	// stored in the group).
+	GroupDescriptors *Range `json:"groupDescriptors,omitempty"`
+	// ReservedGDTBlocks are the blocks reserved for growing the group
+	// descriptor table (if stored in the group).
+	ReservedGDTBlocks *Range `json:"reservedGDTBlocks,omitempty"`
+	// BlockBitmap is the location of the block bitmap.
+	BlockBitmap uint64 `json:"blockBitmap"`
+	// BlockBitmapChecksum is the checksum of the block bitmap.
+	BlockBitmapChecksum uint32 `json:"blockBitmapChecksum,omitempty"`
+	// InodeBitmap is the location of the inode bitmap.
+	InodeBitmap uint64 `json:"inodeBitmap"`
+	// InodeBitmapChecksum is the checksum of the inode bitmap.
+	InodeBitmapChecksum uint32 `json:"inodeBitmapChecksum,omitempty"`
+	// InodeTable are the blocks holding the inode table.
+	InodeTable Range `json:"inodeTable"`
+	// FreeBlockCount is the number of free blocks in the group.
+	FreeBlockCount uint64 `json:"freeBlockCount"`
+	// FreeInodeCount is the number of free inodes in the group.
+	FreeInodeCount uint64 `json:"freeInodeCount"`
+	// DirectoryCount is the number of directories in the group.
+	DirectoryCount uint64 `json:"directoryCount"`
+	// UnusedInodeCount is the number of never used inodes in the group.
+	UnusedInodeCount uint64 `json:"unusedInodeCount,omitempty"`
+	// FreeBlocks are the ranges of free blocks in the group.
+	FreeBlocks []Range `json:"freeBlocks,omitempty"`
+	// FreeInodes are the ranges of free inodes in the group.
+	FreeInodes []Range `json:"freeInodes,omitempty"`
+}
+
+// ListBlockGroups returns the block groups of an ext4 filesystem.
+func (c *Client) ListBlockGroups(ctx context.Context, device string) (_ []BlockGroup, err error) {
+	ctx, span := c.startSpan(ctx, "ListBlockGroups", device)
+	defer endSpan(span, &err)
+
+	out, err := c.run(ctx, "dumpe2fs", device)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseBlockGroups(out)
+}
+
+// ListBadBlocks returns the bad blocks recorded in an ext4 filesystem.
+func (c *Client) ListBadBlocks(ctx context.Context, device string) (_ []uint64, err error) {
+	ctx, span := c.startSpan(ctx, "ListBadBlocks", device)
+	defer endSpan(span, &err)
+
+	out, err := c.run(ctx, "dumpe2fs", "-b", device)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []uint64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		block, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected dumpe2fs output: %q", line)
+		}
+
+		blocks = append(blocks, block)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+var (
+	dumpe2fsGroupRegexp      = regexp.MustCompile(`^Group (\d+): \(Blocks (\d+)-(\d+)\)(?: csum 0x([0-9a-fA-F]+))?(?: \[(.*)\])?`)
+	dumpe2fsSuperblockRegexp = regexp.MustCompile(`^(Primary|Backup) superblock at (\d+)$`)
+	dumpe2fsLocationRegexp   = regexp.MustCompile(`^(Group descriptors|Reserved GDT blocks|Block bitmap|Inode bitmap|Inode table) at (\d+)(?:-(\d+))?`)
+	dumpe2fsChecksumRegexp   = regexp.MustCompile(`^csum 0x([0-9a-fA-F]+)$`)
+	dumpe2fsCountRegexp      = regexp.MustCompile(`^(\d+) (free blocks|free inodes|directories|unused inodes)$`)
+)
+
+// ParseBlockGroups parses the block group descriptors output by dumpe2fs.
+func ParseBlockGroups(out []byte) ([]BlockGroup, error) {
+	var groups []BlockGroup
+	var bg *BlockGroup
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := dumpe2fsGroupRegexp.FindStringSubmatch(line); m != nil {
+			number, _ := strconv.Atoi(m[1])
+			groups = append(groups, BlockGroup{
+				Number: number,
+				Blocks: Range{Start: parseUint64(m[2]), End: parseUint64(m[3])},
+			})
+			bg = &groups[len(groups)-1]
+
+			if m[4] != "" {
+				bg.Checksum = parseHexUint32(m[4])
+			}
+
+			if m[5] != "" {
+				bg.Flags = strings.Split(m[5], ", ")
+			}
+
+			continue
+		}
+
+		if bg == nil {
+			continue
+		}
+
+		if v, ok := strings.CutPrefix(line, "Free blocks:"); ok {
+			bg.FreeBlocks = parseRanges(v)
+			continue
+		} else if v, ok := strings.CutPrefix(line, "Free inodes:"); ok {
+			bg.FreeInodes = parseRanges(v)
+			continue
+		}
+
+		// The remaining lines are comma separated lists of items, where a
+		// checksum item refers to the preceding bitmap.
+		var lastItem string
+		for _, item := range strings.Split(line, ", ") {
+			if m := dumpe2fsSuperblockRegexp.FindStringSubmatch(item); m != nil {
+				block := parseUint64(m[2])
+				bg.Superblock = &block
+				bg.BackupSuperblock = m[1] == "Backup"
+			} else if m := dumpe2fsLocationRegexp.FindStringSubmatch(item); m != nil {
+				r := Range{Start: parseUint64(m[2]), End: parseUint64(m[2])}
+				if m[3] != "" {
+					r.End = parseUint64(m[3])
+				}
+
+				switch m[1] {
+				case "Group descriptors":
+					bg.GroupDescriptors = &r
+				case "Reserved GDT blocks":
+					bg.ReservedGDTBlocks = &r
+				case "Block bitmap":
+					bg.BlockBitmap = r.Start
+				case "Inode bitmap":
+					bg.InodeBitmap = r.Start
+				case "Inode table":
+					bg.InodeTable = r
+				}
+
+				lastItem = m[1]
+			} else if m := dumpe2fsChecksumRegexp.FindStringSubmatch(item); m != nil {
+				switch lastItem {
+				case "Block bitmap":
+					bg.BlockBitmapChecksum = parseHexUint32(m[1])
+				case "Inode bitmap":
+					bg.InodeBitmapChecksum = parseHexUint32(m[1])
+				}
+			} else if m := dumpe2fsCountRegexp.FindStringSubmatch(item); m != nil {
+				count := parseUint64(m[1])
+
+				switch m[2] {
+				case "free blocks":
+					bg.FreeBlockCount = count
+				case "free inodes":
+					bg.FreeInodeCount = count
+				case "directories":
+					bg.DirectoryCount = count
+				case "unused inodes":
+					bg.UnusedInodeCount = count
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("unexpected dumpe2fs output")
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,133 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSuperblock(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	fs, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+		Label:  "test",
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Equal(t, "test", sb.Label)
+	require.Equal(t, fs.UUID, sb.UUID)
+	require.Equal(t, uint16(0xEF53), sb.Magic)
+	require.Equal(t, "clean", sb.State)
+	require.Contains(t, sb.Features, "extent")
+	require.Contains(t, sb.Features, "has_journal")
+	require.Equal(t, fs.BlockCount, sb.BlockCount)
+	require.Equal(t, fs.InodeCount, sb.InodeCount)
+	require.Equal(t, fs.BlockSize, sb.BlockSize)
+	require.Equal(t, fs.BlocksPerGroup, sb.BlocksPerGroup)
+	require.NotZero(t, sb.FreeBlocks)
+	require.NotZero(t, sb.InodeSize)
+	require.False(t, sb.Created.IsZero())
+	require.True(t, sb.LastMounted.IsZero())
+	require.Equal(t, uint64(8), sb.JournalInode)
+}
+
+func TestListBlockGroups(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	groups, err := c.ListBlockGroups(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Len(t, groups, 8)
+
+	require.Equal(t, 0, groups[0].Number)
+	require.Equal(t, ext4.Range{Start: 1, End: 8192}, groups[0].Blocks)
+	require.NotNil(t, groups[0].Superblock)
+	require.Equal(t, uint64(1), *groups[0].Superblock)
+	require.False(t, groups[0].BackupSuperblock)
+	require.NotNil(t, groups[0].GroupDescriptors)
+	require.NotZero(t, groups[0].BlockBitmap)
+	require.NotZero(t, groups[0].InodeBitmap)
+	require.NotZero(t, groups[0].InodeTable.Start)
+
+	require.NotNil(t, groups[1].Superblock)
+	require.Equal(t, uint64(8193), *groups[1].Superblock)
+	require.True(t, groups[1].BackupSuperblock)
+
+	require.Nil(t, groups[2].Superblock)
+
+	for _, bg := range groups {
+		var freeBlocks uint64
+		for _, r := range bg.FreeBlocks {
+			freeBlocks += r.End - r.Start + 1
+		}
+		require.Equal(t, bg.FreeBlockCount, freeBlocks, "group %d free block count mismatch", bg.Number)
+
+		var freeInodes uint64
+		for _, r := range bg.FreeInodes {
+			freeInodes += r.End - r.Start + 1
+		}
+		require.Equal(t, bg.FreeInodeCount, freeInodes, "group %d free inode count mismatch", bg.Number)
+	}
+}
+
+func TestListBadBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	badBlocks, err := c.ListBadBlocks(ctx, imagePath)
+	require.NoError(t, err)
+	require.Empty(t, badBlocks)
+
+	t.Log("Recording bad blocks")
+
+	badBlocksFile := filepath.Join(t.TempDir(), "badblocks")
+	err = os.WriteFile(badBlocksFile, []byte("5000\n5001\n"), 0o644)
+	require.NoError(t, err)
+
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device:              imagePath,
+		AppendBadBlocksFile: badBlocksFile,
+	})
+	require.NoError(t, err)
+
+	badBlocks, err = c.ListBadBlocks(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{5000, 5001}, badBlocks)
+}
@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandError is returned when an external command fails.
+type CommandError struct {
+	// Program is the name of the tool that failed, eg. "e2fsck".
+	Program string
+	// Argv is the full command line that was executed.
+	Argv []string
+	// ExitCode of the command (or -1 if it did not run to completion).
+	ExitCode int
+	// Stderr is the captured standard error of the command.
+	Stderr string
+	// Err is the underlying error returned by the executor.
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	stderr := strings.TrimSpace(e.Stderr)
+	if stderr == "" {
+		return fmt.Sprintf("%s: %v", e.Program, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %v: %s", e.Program, e.Err, stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
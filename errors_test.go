@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandError(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	devicePath := filepath.Join(t.TempDir(), "missing.img")
+
+	_, err := c.ReadSuperblock(ctx, devicePath)
+	require.Error(t, err)
+
+	var cmdErr *ext4.CommandError
+	require.True(t, errors.As(err, &cmdErr), "expected command error")
+
+	require.Equal(t, "dumpe2fs", cmdErr.Program)
+	require.Equal(t, "dumpe2fs", filepath.Base(cmdErr.Argv[0]))
+	require.Equal(t, []string{"-h", devicePath}, cmdErr.Argv[1:])
+	require.Equal(t, 2, cmdErr.ExitCode)
+	require.Contains(t, cmdErr.Stderr, "No such file or directory")
+
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(err, &exitErr), "expected underlying exit error")
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func setChroot(cmd *exec.Cmd, dir string) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = dir
+	cmd.Dir = "/"
+
+	return nil
+}
+
+func setCgroup(cmd *exec.Cmd, cgroup *os.File) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+
+	return nil
+}
+
+// setProcessGroup runs the command in its own process group, which is
+// signalled on cancellation. The returned function must be called once the
+// command has been waited for, after which the group is no longer signalled
+// (its ID may since have been reused).
+func setProcessGroup(cmd *exec.Cmd, gracePeriod time.Duration) func() {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	var mu sync.Mutex
+	var done bool
+	var killTimer *time.Timer
+
+	signalGroup := func(sig syscall.Signal) error {
+		err := syscall.Kill(-cmd.Process.Pid, sig)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+
+	cmd.Cancel = func() error {
+		if gracePeriod <= 0 {
+			return signalGroup(syscall.SIGKILL)
+		}
+
+		// Kill any stragglers once the grace period has elapsed, even if the
+		// command itself has already exited (the group can't be reused while
+		// they remain), but not once the command has been waited for.
+		mu.Lock()
+		if !done {
+			killTimer = time.AfterFunc(gracePeriod, func() {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if !done {
+					_ = signalGroup(syscall.SIGKILL)
+				}
+			})
+		}
+		mu.Unlock()
+
+		return signalGroup(syscall.SIGTERM)
+	}
+	// Don't wait indefinitely for orphaned helpers to close the output pipes.
+	cmd.WaitDelay = gracePeriod + time.Second
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		done = true
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}
+}
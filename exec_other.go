@@ -0,0 +1,49 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func setChroot(_ *exec.Cmd, _ string) error {
+	return errors.New("chroot is not supported on this platform")
+}
+
+func setCgroup(_ *exec.Cmd, _ *os.File) error {
+	return errors.New("cgroups are not supported on this platform")
+}
+
+// setProcessGroup is not supported on this platform, so only the command
+// itself is terminated on cancellation.
+func setProcessGroup(cmd *exec.Cmd, gracePeriod time.Duration) func() {
+	if gracePeriod > 0 {
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(os.Interrupt)
+		}
+		// The command is killed once the delay elapses.
+		cmd.WaitDelay = gracePeriod
+	}
+
+	return func() {}
+}
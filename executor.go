@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Command describes an external command to execute.
+type Command struct {
+	// Path of the binary to execute (as returned by Executor.LookPath).
+	Path string
+	// Args are the arguments passed to the binary (excluding the binary itself).
+	Args []string
+	// Env holds additional environment variables ("key=value") for the command.
+	Env []string
+	// Stdin is the command's standard input (may be nil).
+	Stdin io.Reader
+	// Stdout is the command's standard output (may be nil).
+	Stdout io.Writer
+	// Stderr is the command's standard error (may be nil).
+	Stderr io.Writer
+	// ExtraFiles are additional open files inherited by the command (as file
+	// descriptors 3 onwards). Not all executors support passing files.
+	ExtraFiles []*os.File
+}
+
+// ErrExtraFilesUnsupported is returned by executors that cannot pass
+// additional open files to commands.
+var ErrExtraFilesUnsupported = errors.New("executor does not support passing extra files")
+
+// Executor runs external commands on behalf of the client. Executors should
+// return an *exec.ExitError (or wrap one) when a command exits unsuccessfully
+// so callers can inspect its exit code.
+type Executor interface {
+	// LookPath resolves the path of the named binary.
+	LookPath(name string) (string, error)
+	// Run executes the command, blocking until it exits.
+	Run(ctx context.Context, cmd *Command) error
+}
+
+// LocalExecutor runs commands on the local host.
+type LocalExecutor struct {
+	// SearchPath are the directories searched (in order) for binaries.
+	SearchPath []string
+	// Chroot is an optional directory to chroot into before executing commands.
+	Chroot string
+	// Cgroup is the path of an optional cgroup v2 directory (eg.
+	// /sys/fs/cgroup/e2fsprogs) that commands are placed into, so that their
+	// resource usage can be limited. Linux only.
+	Cgroup string
+	// GracePeriod is how long to wait after asking a command to terminate
+	// (with SIGTERM) when its context is cancelled, before forcibly killing it.
+	// If zero, commands are killed immediately.
+	GracePeriod time.Duration
+}
+
+func (e *LocalExecutor) LookPath(name string) (string, error) {
+	for _, dir := range e.SearchPath {
+		if dir == "" {
+			dir = "."
+		}
+		cmdPath := filepath.Join(filepath.Clean(dir), name)
+		if _, err := os.Stat(filepath.Join(e.Chroot, cmdPath)); err == nil {
+			return cmdPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("command not found: %s: %w", name, os.ErrNotExist)
+}
+
+func (e *LocalExecutor) Run(ctx context.Context, cmd *Command) error {
+	execCmd := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
+	if len(cmd.Env) > 0 {
+		execCmd.Env = append(os.Environ(), cmd.Env...)
+	}
+	if e.Chroot != "" {
+		if err := setChroot(execCmd, e.Chroot); err != nil {
+			return err
+		}
+	}
+
+	if e.Cgroup != "" {
+		cgroup, err := os.Open(e.Cgroup)
+		if err != nil {
+			return fmt.Errorf("failed to open cgroup: %w", err)
+		}
+		defer cgroup.Close()
+
+		if err := setCgroup(execCmd, cgroup); err != nil {
+			return err
+		}
+	}
+
+	// Run commands in their own process group, so that any helpers they spawn
+	// (eg. e2fsck running badblocks) are also terminated on cancellation.
+	stopSignalling := setProcessGroup(execCmd, e.GracePeriod)
+	defer stopSignalling()
+
+	execCmd.Stdin = cmd.Stdin
+	execCmd.Stdout = cmd.Stdout
+	execCmd.Stderr = cmd.Stderr
+	execCmd.ExtraFiles = cmd.ExtraFiles
+
+	return execCmd.Run()
+}
@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalExecutorCancellation(t *testing.T) {
+	dir := t.TempDir()
+	pidPath := filepath.Join(dir, "pid")
+	termPath := filepath.Join(dir, "terminated")
+
+	// Spawns a helper process, and records whether it was asked to terminate.
+	script := "trap 'echo yes > " + termPath + "; exit 1' TERM\n" +
+		"sleep 30 &\n" +
+		"echo $! > " + pidPath + "\n" +
+		"wait\n"
+
+	for _, gracePeriod := range []time.Duration{0, 5 * time.Second} {
+		t.Logf("Cancelling with a grace period of %s", gracePeriod)
+
+		require.NoError(t, os.RemoveAll(termPath))
+
+		e := &ext4.LocalExecutor{GracePeriod: gracePeriod}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		start := time.Now()
+		err := e.Run(ctx, &ext4.Command{
+			Path: "/bin/sh",
+			Args: []string{"-c", script},
+		})
+		cancel()
+		require.Error(t, err)
+		require.Less(t, time.Since(start), 5*time.Second)
+
+		pid, err := os.ReadFile(pidPath)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return !isRunning(t, strings.TrimSpace(string(pid)))
+		}, 5*time.Second, 10*time.Millisecond, "helper process was not killed")
+
+		_, err = os.Stat(termPath)
+		if gracePeriod > 0 {
+			require.NoError(t, err, "expected process to be terminated gracefully")
+		} else {
+			require.ErrorIs(t, err, os.ErrNotExist)
+		}
+	}
+}
+
+// isRunning returns true if the process exists, and is not a zombie.
+func isRunning(t *testing.T, pid string) bool {
+	_, err := strconv.Atoi(pid)
+	require.NoError(t, err)
+
+	stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return false
+	}
+
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
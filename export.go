@@ -0,0 +1,375 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportTar writes the contents of an unmounted ext4 filesystem to w as a tar
+// stream, preserving ownership, permissions, modification times, extended
+// attributes, symbolic and hard links, and device nodes. It is the inverse of
+// CreateFilesystemFromTar. Sockets can't be archived, so are skipped (with a
+// warning logged). File contents are staged in a temporary directory on the
+// local host, so commands must be run locally too (ie. with the local
+// executor).
+func (c *Client) ExportTar(ctx context.Context, device string, w io.Writer) (err error) {
+	ctx, span := c.startSpan(ctx, "ExportTar", device)
+	defer endSpan(span, &err)
+
+	if _, local := c.executor.(*LocalExecutor); !local {
+		return invalidOption("exporting a tar stream is only supported when commands are run locally")
+	}
+
+	entries, err := c.listTree(ctx, device)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	inodes := make(map[uint64]*inodeMetadata)
+	var statRequests []string
+	for _, entry := range entries {
+		if _, ok := inodes[entry.inode]; !ok {
+			inodes[entry.inode] = &inodeMetadata{}
+			statRequests = append(statRequests, debugfsRequest("stat", inodeSpec(entry.inode)))
+		}
+	}
+
+	stats, err := c.debugfsSections(ctx, device, statRequests...)
+	if err != nil {
+		return fmt.Errorf("failed to stat files: %w", err)
+	}
+	for i, out := range stats {
+		ino := parseUint64(strings.Trim(strings.Fields(statRequests[i])[1], "<>"))
+		*inodes[ino] = parseInodeMetadata(out)
+	}
+
+	stagingDir, err := os.MkdirTemp("", "ext4-export-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	// Dump the contents of regular files (and slow symlinks), and the values
+	// of extended attributes, into the staging directory.
+	var dumpRequests []string
+	dumped := make(map[uint64]bool)
+	for _, entry := range entries {
+		md := inodes[entry.inode]
+		ino := inodeSpec(entry.inode)
+
+		if dumped[entry.inode] {
+			continue
+		}
+		dumped[entry.inode] = true
+
+		if entry.mode&inodeModeTypeMask == inodeModeRegular || (entry.mode&inodeModeTypeMask == inodeModeSymlink && !md.fastLink) {
+			dumpRequests = append(dumpRequests, debugfsRequest("dump", ino, filepath.Join(stagingDir, strconv.FormatUint(entry.inode, 10))))
+		}
+
+		for i, name := range md.xattrs {
+			dumpRequests = append(dumpRequests, debugfsRequest("ea_get", "-f", xattrValuePath(stagingDir, entry.inode, i), ino, name))
+		}
+	}
+
+	if len(dumpRequests) > 0 {
+		if _, err := c.debugfs(ctx, device, false, dumpRequests...); err != nil {
+			return fmt.Errorf("failed to dump files: %w", err)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	linked := make(map[uint64]string)
+	for _, entry := range entries {
+		// Sockets can't be represented in a tar archive (and are only
+		// meaningful while bound by a process anyway).
+		if entry.mode&inodeModeTypeMask == inodeModeSocket {
+			if c.logger != nil {
+				c.logger.Warn("Skipping socket", slog.String("device", device), slog.String("path", entry.path))
+			}
+			continue
+		}
+
+		hdr, err := tarHeader(entry, inodes[entry.inode], stagingDir, linked)
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if err := copyStagedFile(tw, filepath.Join(stagingDir, strconv.FormatUint(entry.inode, 10))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// inodeModeTypeMask masks the file type bits of an ext4 inode mode.
+const inodeModeTypeMask = 0o170000
+
+// treeEntry is a file listed in a filesystem.
+type treeEntry struct {
+	path  string
+	inode uint64
+	mode  uint32
+	uid   int
+	gid   int
+	size  int64
+}
+
+// listTree lists every file in a filesystem, parents before their children,
+// using one debugfs invocation for each level of the directory tree.
+func (c *Client) listTree(ctx context.Context, device string) ([]treeEntry, error) {
+	root := treeEntry{path: "/", inode: 2, mode: inodeModeDir}
+	entries := []treeEntry{root}
+	dirs := []string{"/"}
+	for len(dirs) > 0 {
+		requests := make([]string, len(dirs))
+		for i, dir := range dirs {
+			requests[i] = debugfsRequest("ls", "-p", dir)
+		}
+
+		sections, err := c.debugfsSections(ctx, device, requests...)
+		if err != nil {
+			return nil, err
+		}
+
+		var nextDirs []string
+		for i, out := range sections {
+			for _, entry := range parseDirectoryListing(dirs[i], out) {
+				if entry.path == "/" {
+					// Take the metadata of the root directory from its listing.
+					entries[0] = entry
+					continue
+				}
+
+				entries = append(entries, entry)
+				if entry.mode&inodeModeTypeMask == inodeModeDir {
+					nextDirs = append(nextDirs, entry.path)
+				}
+			}
+		}
+		dirs = nextDirs
+	}
+
+	return entries, nil
+}
+
+// parseDirectoryListing parses the output of debugfs "ls -p", where each
+// entry is of the form "/inode/mode/uid/gid/name/size/".
+func parseDirectoryListing(dir, out string) []treeEntry {
+	var entries []treeEntry
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "/")
+		// Unused directory entries (eg. in lost+found) have an inode of zero.
+		if len(fields) != 8 || fields[1] == "0" || fields[5] == ".." || (fields[5] == "." && dir != "/") {
+			continue
+		}
+
+		mode, err := strconv.ParseUint(fields[2], 8, 32)
+		if err != nil {
+			continue
+		}
+
+		uid, _ := strconv.Atoi(fields[3])
+		gid, _ := strconv.Atoi(fields[4])
+		size, _ := strconv.ParseInt(fields[6], 10, 64)
+
+		entryPath := path.Join(dir, fields[5])
+		entries = append(entries, treeEntry{
+			path:  entryPath,
+			inode: parseUint64(fields[1]),
+			mode:  uint32(mode),
+			uid:   uid,
+			gid:   gid,
+			size:  size,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	return entries
+}
+
+// inodeMetadata is the metadata of an inode not included in directory
+// listings.
+type inodeMetadata struct {
+	modTime  time.Time
+	devMajor int64
+	devMinor int64
+	fastLink bool
+	linkDest string
+	xattrs   []string
+}
+
+var (
+	statMtimeRegexp    = regexp.MustCompile(`(?m)^\s*mtime: 0x([0-9a-f]+)`)
+	statDeviceRegexp   = regexp.MustCompile(`Device major/minor number: (\d+):(\d+)`)
+	statFastLinkRegexp = regexp.MustCompile(`(?m)^Fast link dest: "(.*)"$`)
+	statXattrRegexp    = regexp.MustCompile(`^  (\S+) \(\d+\)`)
+)
+
+// parseInodeMetadata parses the output of debugfs "stat".
+func parseInodeMetadata(out string) inodeMetadata {
+	var md inodeMetadata
+	if m := statMtimeRegexp.FindStringSubmatch(out); m != nil {
+		secs, _ := strconv.ParseInt(m[1], 16, 64)
+		md.modTime = time.Unix(secs, 0)
+	}
+	if m := statDeviceRegexp.FindStringSubmatch(out); m != nil {
+		md.devMajor, _ = strconv.ParseInt(m[1], 10, 64)
+		md.devMinor, _ = strconv.ParseInt(m[2], 10, 64)
+	}
+	if m := statFastLinkRegexp.FindStringSubmatch(out); m != nil {
+		md.fastLink = true
+		md.linkDest = m[1]
+	}
+
+	var inXattrs bool
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "Extended attributes:" {
+			inXattrs = true
+			continue
+		}
+
+		if inXattrs {
+			m := statXattrRegexp.FindStringSubmatch(line)
+			if m == nil {
+				inXattrs = false
+				continue
+			}
+			md.xattrs = append(md.xattrs, m[1])
+		}
+	}
+
+	return md
+}
+
+// tarHeader returns the tar header describing a file. The first path of each
+// hard linked inode is recorded in linked.
+func tarHeader(entry treeEntry, md *inodeMetadata, stagingDir string, linked map[uint64]string) (*tar.Header, error) {
+	name := strings.TrimPrefix(entry.path, "/")
+	if entry.path == "/" {
+		name = "."
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(entry.mode & 0o7777),
+		Uid:     entry.uid,
+		Gid:     entry.gid,
+		ModTime: md.modTime,
+		Format:  tar.FormatPAX,
+	}
+
+	if entry.mode&inodeModeTypeMask != inodeModeDir {
+		if target, ok := linked[entry.inode]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = target
+			return hdr, nil
+		}
+		linked[entry.inode] = name
+	}
+
+	for i, xattr := range md.xattrs {
+		value, err := os.ReadFile(xattrValuePath(stagingDir, entry.inode, i))
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+xattr] = string(value)
+	}
+
+	switch entry.mode & inodeModeTypeMask {
+	case inodeModeDir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case inodeModeRegular:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = entry.size
+	case inodeModeSymlink:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = md.linkDest
+		if !md.fastLink {
+			target, err := os.ReadFile(filepath.Join(stagingDir, strconv.FormatUint(entry.inode, 10)))
+			if err != nil {
+				return nil, err
+			}
+			hdr.Linkname = string(bytes.TrimRight(target, "\x00"))
+		}
+	case inodeModeChar, inodeModeBlock:
+		hdr.Typeflag = tar.TypeChar
+		if entry.mode&inodeModeTypeMask == inodeModeBlock {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = md.devMajor
+		hdr.Devminor = md.devMinor
+	case inodeModeFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type %o", entry.path, entry.mode&inodeModeTypeMask)
+	}
+
+	return hdr, nil
+}
+
+func copyStagedFile(w io.Writer, stagedPath string) error {
+	f, err := os.Open(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func inodeSpec(ino uint64) string {
+	return "<" + strconv.FormatUint(ino, 10) + ">"
+}
+
+func xattrValuePath(stagingDir string, ino uint64, i int) string {
+	return filepath.Join(stagingDir, fmt.Sprintf("%d.xattr.%d", ino, i))
+}
@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportTar(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	_, err := c.CreateFilesystemFromTar(ctx, imagePath, bytes.NewReader(testTar(t)), ext4.CreateOptions{})
+	require.NoError(t, err)
+
+	// A symlink too long to be stored inline in the inode.
+	longTarget := strings.Repeat("x", 100)
+	require.NoError(t, c.SymlinkInImage(ctx, imagePath, longTarget, "/long"))
+
+	var buf bytes.Buffer
+	require.NoError(t, c.ExportTar(ctx, imagePath, &buf))
+
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = string(data)
+	}
+
+	require.Contains(t, headers, "./")
+	require.Contains(t, headers, "lost+found/")
+
+	hosts := headers["etc/hosts"]
+	require.NotNil(t, hosts)
+	require.Equal(t, byte(tar.TypeReg), hosts.Typeflag)
+	require.Equal(t, int64(0o640), hosts.Mode)
+	require.Equal(t, 1000, hosts.Uid)
+	require.Equal(t, 1001, hosts.Gid)
+	require.True(t, hosts.ModTime.Equal(time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)))
+	require.Equal(t, "layer", hosts.PAXRecords["SCHILY.xattr.user.origin"])
+	require.Equal(t, "127.0.0.1 localhost\n", contents["etc/hosts"])
+
+	require.Equal(t, byte(tar.TypeLink), headers["etc/hosts.bak"].Typeflag)
+	require.Equal(t, "etc/hosts", headers["etc/hosts.bak"].Linkname)
+
+	require.Equal(t, byte(tar.TypeSymlink), headers["hosts"].Typeflag)
+	require.Equal(t, "etc/hosts", headers["hosts"].Linkname)
+	require.Equal(t, longTarget, headers["long"].Linkname)
+
+	null := headers["dev/null"]
+	require.Equal(t, byte(tar.TypeChar), null.Typeflag)
+	require.Equal(t, int64(1), null.Devmajor)
+	require.Equal(t, int64(3), null.Devminor)
+	require.Equal(t, int64(0o666), null.Mode)
+
+	require.Equal(t, byte(tar.TypeFifo), headers["run/fifo"].Typeflag)
+
+	t.Log("Skipping sockets")
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "hello.txt"), []byte("Hello, world!"), 0o644))
+
+	l, err := net.Listen("unix", filepath.Join(rootDir, "app.sock"))
+	if err != nil {
+		t.Skipf("unable to create socket: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	var logs bytes.Buffer
+	c = ext4.NewClient(ext4.WithLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))))
+
+	imagePath = filepath.Join(t.TempDir(), "socket.img")
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        imagePath,
+		Size:          32 * ext4.MiB,
+		RootDirectory: rootDir,
+	})
+	require.NoError(t, err)
+
+	buf.Reset()
+	require.NoError(t, c.ExportTar(ctx, imagePath, &buf))
+
+	var names []string
+	tr = tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		names = append(names, hdr.Name)
+	}
+
+	require.Contains(t, names, "hello.txt")
+	require.NotContains(t, names, "app.sock")
+	require.Contains(t, logs.String(), "path=/app.sock")
+}
+
+func TestExportTarRemote(t *testing.T) {
+	ctx := context.Background()
+
+	// File contents are staged on the local host, not the remote one.
+	e := &ext4test.RecordingExecutor{}
+	c := ext4.NewClient(ext4.WithExecutor(e))
+
+	err := c.ExportTar(ctx, "/dev/sdb", io.Discard)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+	require.Empty(t, e.Argv())
+}
@@ -20,76 +20,289 @@ package ext4
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/dpeckett/args"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type Client struct {
-	path string
+	searchPath    []string
+	toolPaths     map[string]string
+	logger        *slog.Logger
+	env           map[string]string
+	chroot        string
+	cgroup        string
+	executor      Executor
+	dryRun        bool
+	hooks         []func(CommandEvent)
+	stdout        io.Writer
+	stderr        io.Writer
+	onLine        func(OutputStream, string)
+	retries       int
+	backoff       time.Duration
+	ioPriority    *ioPriority
+	cpuPriority   *int
+	busyboxCompat bool
+	busyboxMu     sync.Mutex
+	busybox       map[string]bool
+	deviceLocks   deviceLocks
+	flockDevices  bool
+	gracePeriod   time.Duration
+	tracer        trace.Tracer
+	metrics       *metrics
+	undoDir       string
+	// optionErr is an error applying the client options, returned by every
+	// command.
+	optionErr error
 }
 
 // Construct a new e2fsprogs client.
 func NewClient(opts ...ClientOption) *Client {
 	c := &Client{
-		path: fmt.Sprintf("PATH=%s:/sbin:/usr/sbin", os.Getenv("PATH")),
+		searchPath: append(filepath.SplitList(os.Getenv("PATH")), "/sbin", "/usr/sbin"),
+		toolPaths:  make(map[string]string),
 	}
 
 	for _, opt := range opts {
 		opt(c)
 	}
 
+	if c.tracer == nil {
+		c.tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
+
+	if c.executor == nil {
+		c.executor = &LocalExecutor{
+			SearchPath:  c.searchPath,
+			Chroot:      c.chroot,
+			Cgroup:      c.cgroup,
+			GracePeriod: c.gracePeriod,
+		}
+	}
+
 	return c
 }
 
 // CreateOptions provides options for creating an ext4 filesystem.
 type CreateOptions struct {
-	Device                   string `arg:"0"` // Device where the filesystem will be created.
-	Size                     string `arg:"1"` // Optional size of the filesystem.
-	CheckForBadBlocks        bool   `arg:"c"` // Check for bad blocks before creating the filesystem.
-	BlockSize                *int   `arg:"b"` // Block size in bytes (supported: 1024, 2048 and 4096 bytes).
-	ClusterSize              *int   `arg:"C"` // Cluster size in bytes for filesystems using the bigalloc feature (supported: [2048, 256M]).
-	BytesPerInode            *int   `arg:"i"` // Bytes/inode ratio, generally shouldn't be smaller than the block size.
-	InodeSize                *int   `arg:"I"` // The size of each inode in bytes.
-	JournalOptions           string `arg:"J"` // Journal options, comma separated list.
-	NumberOfGroups           *int   `arg:"G"` // The number of block groups packed into a flex_bg group.
-	NumberOfInodes           *int   `arg:"N"` // Override the default number of reserved inodes.
-	RootDirectory            string `arg:"d"` // Copy directory contents into the filesystem.
-	ReservedBlocksPercentage *int   `arg:"m"` // Percentage of blocks reserved for the super-user.
-	CreatorOS                string `arg:"o"` // Override creator os.
-	BlocksPerGroup           *int   `arg:"g"` // The number of blocks in each block group.
-	Label                    string `arg:"L"` // Volume label (max length 16 bytes).
-	LastMountedDirectory     string `arg:"M"` // Directory where the filesystem was last mounted.
-	Features                 string `arg:"O"` // Filesystem features/options, comma separated list.
-	FilesystemRevision       *int   `arg:"r"` // Revision level for the filesystem.
-	ExtendedOptions          string `arg:"E"` // Extended options, comma separated list.
-	UsageType                string `arg:"T"` // Filesystem usage type (supported: floppy, small, default).
-	UUID                     string `arg:"U"` // UUID for the filesystem.
-	ErrorBehavior            string `arg:"e"` // Kernel behavior when errors are detected (supported: continue, remount-ro, panic).
-	UndoFile                 string `arg:"z"` // Before overwriting blocks, backup the contents.
-	Journal                  bool   `arg:"j"` // Create an ext3 journal.
-	DryRun                   bool   `arg:"n"` // Dry run (don't actually create the filesystem).
-	DirectIO                 bool   `arg:"D"` // Use direct I/O when writing to the disk.
-	Force                    bool   `arg:"F"` // Force filesystem creation on any device.
-	WriteSuperblocks         bool   `arg:"S"` // Write superblock and group descriptors only.
-}
-
-// Create an ext4 filesystem.
-func (c *Client) CreateFilesystem(ctx context.Context, opts CreateOptions) error {
-	cmdArgs := []string{"-q", "-t", "ext4"}
-	cmdArgs = append(cmdArgs, args.Marshal(opts)...)
-
-	_, err := c.run(ctx, "mke2fs", cmdArgs...)
-	return err
+	Device                   string          `arg:"0"` // Device where the filesystem will be created.
+	Size                     Size            `arg:"1"` // Optional size of the filesystem in bytes.
+	CheckForBadBlocks        bool            `arg:"c"` // Check for bad blocks before creating the filesystem.
+	BlockSize                *int            `arg:"b"` // Block size in bytes (supported: 1024, 2048 and 4096 bytes).
+	ClusterSize              *int            `arg:"C"` // Cluster size in bytes for filesystems using the bigalloc feature (supported: [2048, 256M]).
+	BytesPerInode            *int            `arg:"i"` // Bytes/inode ratio, generally shouldn't be smaller than the block size.
+	InodeSize                *int            `arg:"I"` // The size of each inode in bytes.
+	JournalOptions           JournalOptions  `arg:"J"` // Journal options.
+	NumberOfGroups           *int            `arg:"G"` // The number of block groups packed into a flex_bg group.
+	NumberOfInodes           *int            `arg:"N"` // Override the default number of reserved inodes.
+	RootDirectory            string          `arg:"d"` // Copy directory contents into the filesystem.
+	ReservedBlocksPercentage *int            `arg:"m"` // Percentage of blocks reserved for the super-user.
+	CreatorOS                CreatorOS       `arg:"o"` // Override creator os.
+	BlocksPerGroup           *int            `arg:"g"` // The number of blocks in each block group.
+	Label                    string          `arg:"L"` // Volume label (max length 16 bytes, see LabelPolicy).
+	LastMountedDirectory     string          `arg:"M"` // Directory where the filesystem was last mounted.
+	Features                 string          `arg:"O"` // Filesystem features/options, comma separated list.
+	FilesystemRevision       *int            `arg:"r"` // Revision level for the filesystem.
+	ExtendedOptions          ExtendedOptions `arg:"E"` // Extended options.
+	UsageType                UsageType       `arg:"T"` // Filesystem usage type.
+	UUID                     UUID            `arg:"U"` // UUID for the filesystem.
+	ErrorBehavior            ErrorBehavior   `arg:"e"` // Kernel behavior when errors are detected.
+	UndoFile                 string          `arg:"z"` // Before overwriting blocks, backup the contents.
+	Journal                  bool            `arg:"j"` // Create an ext3 journal.
+	DryRun                   bool            `arg:"n"` // Dry run (don't actually create the filesystem).
+	DirectIO                 bool            `arg:"D"` // Use direct I/O when writing to the disk.
+	Force                    bool            `arg:"F"` // Force filesystem creation on any device.
+	WriteSuperblocks         bool            `arg:"S"` // Write superblock and group descriptors only.
+	// Type of filesystem to create (by default Ext4).
+	Type FilesystemType
+	// FeatureSet are features to enable or disable, in addition to Features.
+	FeatureSet FeatureSet
+	// LabelPolicy controls what happens to labels longer than 16 bytes (by
+	// default they are rejected).
+	LabelPolicy LabelPolicy
+	// Populate, if set, controls the ownership, permissions, and selection of
+	// the files copied from RootDirectory. It's only supported with the local
+	// executor.
+	Populate *PopulateOptions
+	// Wipe, if set, wipes the device (see WipeDevice) before the filesystem is
+	// created.
+	Wipe *WipeOptions
+	// Quotas are the types of quota to enable (using the quota feature).
+	Quotas []QuotaType
+	// Encryption enables the encrypt feature, so that directories can be
+	// encrypted with fscrypt.
+	Encryption bool
+	// Verity enables the verity feature, so that fs-verity can be enabled on
+	// files.
+	Verity bool
+	// Casefold, if set, enables the casefold feature, so that directories can
+	// be made case-insensitive.
+	Casefold *CasefoldOptions
+	// InlineData enables the inline_data feature, which stores the contents of
+	// small files and directories in their inodes, saving space (and a block
+	// read) for images with many small files. Requires inodes of at least 256
+	// bytes (the default).
+	InlineData bool
+	// ChecksumSeed enables the metadata_csum_seed feature, so that the UUID
+	// can later be changed without rewriting every metadata checksum.
+	ChecksumSeed bool
+	// Bigalloc, if set, enables the bigalloc feature with the configured
+	// cluster size (rather than setting Features and ClusterSize directly).
+	Bigalloc *BigallocOptions
+	// RAIDGeometry, if set, derives the stride and stripe width extended
+	// options from the layout of the underlying RAID array. If no block size
+	// is given, 4096 byte blocks are used.
+	RAIDGeometry *RAIDGeometry
+	// DetectRAIDGeometry reads the RAID geometry of the device (see
+	// ReadRAIDGeometry) on the local host (within the chroot, if configured),
+	// and applies it as with RAIDGeometry.
+	DetectRAIDGeometry bool
+	// Config, if set, replaces the host's mke2fs.conf (see
+	// DefaultMke2fsConfig), so that the defaults don't depend on the
+	// distribution. It is written to a temporary file on the local host
+	// (within the chroot, if configured), so isn't supported by remote
+	// executors.
+	Config *Mke2fsConfig
+}
+
+// Create an ext4 filesystem, returning the geometry of the new filesystem.
+func (c *Client) CreateFilesystem(ctx context.Context, opts CreateOptions) (_ *CreatedFilesystem, err error) {
+	ctx, span := c.startSpan(ctx, "CreateFilesystem", opts.Device)
+	defer endSpan(span, &err)
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	// The root directory is staged, and walked, on the local host.
+	if opts.Populate != nil && opts.RootDirectory != "" {
+		if _, local := c.executor.(*LocalExecutor); !local {
+			return nil, invalidOption("populate options are only supported when commands are run locally")
+		}
+	}
+
+	unlock, err := c.lockDevice(ctx, opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return c.createFilesystem(ctx, opts)
+}
+
+// createFilesystem creates the filesystem, the caller must hold the device
+// lock.
+func (c *Client) createFilesystem(ctx context.Context, opts CreateOptions) (*CreatedFilesystem, error) {
+	if opts.Wipe != nil {
+		if err := c.wipeDevice(ctx, opts.Device, *opts.Wipe); err != nil {
+			return nil, err
+		}
+	}
+
+	// Wiping the device leaves nothing worth undoing.
+	if opts.Wipe == nil {
+		var err error
+		opts.UndoFile, err = c.autoUndoFile(opts.Device, opts.UndoFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DetectRAIDGeometry {
+		geometry, err := ReadRAIDGeometry(filepath.Join(c.chroot, opts.Device))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RAID geometry: %w", err)
+		}
+		// Some devices (eg. SSDs) report an optimal I/O size that isn't a
+		// stripe, with a minimum smaller than a block, which mke2fs ignores too.
+		if geometry != nil {
+			if _, _, err := geometry.Stride(opts.raidBlockSize()); err == nil {
+				opts.RAIDGeometry = geometry
+			} else if c.logger != nil {
+				c.logger.Debug("Ignoring RAID geometry", slog.String("device", opts.Device), slog.Any("error", err))
+			}
+		}
+	}
+
+	if opts.Bigalloc != nil && c.logger != nil {
+		blockSize := 0
+		if opts.BlockSize != nil {
+			blockSize = *opts.BlockSize
+		}
+		for _, caveat := range opts.Bigalloc.caveats(blockSize) {
+			c.logger.Warn(caveat, slog.String("device", opts.Device))
+		}
+	}
+
+	// Excluded files are left out of a staged copy of the root directory,
+	// rather than removed after mke2fs has copied them.
+	rootDir := opts.RootDirectory
+	var populateRequests []string
+	if opts.Populate != nil && len(opts.Populate.Exclude) > 0 && rootDir != "" {
+		stagingDir, requests, err := c.stageRootDirectory(rootDir, opts.Populate.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(stagingDir)
+
+		opts.RootDirectory = stagingDir
+		populateRequests = requests
+	}
+
+	var runOpts runOptions
+	if opts.Config != nil {
+		configPath, remove, err := c.writeMke2fsConfig(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		defer remove()
+
+		runOpts.env = []string{mke2fsConfigEnv + "=" + configPath}
+	}
+
+	out, _, err := c.runWithOptions(ctx, runOpts, "mke2fs", opts.Args()...)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := ParseCreatedFilesystem(out)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Populate != nil {
+		if err := c.populate(ctx, opts.Device, rootDir, *opts.Populate, populateRequests); err != nil {
+			return nil, fmt.Errorf("failed to populate filesystem: %w", err)
+		}
+	}
+
+	return fs, nil
+}
+
+// Args returns the arguments of mke2fs for the options. Options that are
+// resolved when the filesystem is created (eg. DetectRAIDGeometry, or an
+// automatic undo file) aren't reflected.
+func (opts CreateOptions) Args() []string {
+	cmdArgs := []string{"-v", "-t", string(opts.fsType())}
+
+	return append(cmdArgs, args.Marshal(opts.withFeatures())...)
 }
 
 // ResizeOptions provides options for resizing an ext4 filesystem.
 type ResizeOptions struct {
 	Device       string `arg:"0"` // Device containing the filesystem to resize.
-	Size         string `arg:"1"` // Optional size of the filesystem.
+	Size         Size   `arg:"1"` // Optional size of the filesystem in bytes.
 	Force        bool   `arg:"f"` // Skip safety checks.
 	Flush        bool   `arg:"F"` // Flush the device's buffer cache.
 	Shrink       bool   `arg:"M"` // Shrink the filesystem to the minimum size.
@@ -97,12 +310,109 @@ type ResizeOptions struct {
 	Disable64Bit bool   `arg:"s"` // Disable 64-bit feature.
 	RAIDStride   *int   `arg:"S"` // RAID stride size in filesystem blocks.
 	UndoFile     string `arg:"z"` // Before overwriting blocks, backup the contents.
+	// Progress, if set, is called periodically with the completion status of
+	// each pass of an offline resize.
+	Progress func(pass int, cur, max float64)
+	// Check, if set, forcibly checks (and preens) the filesystem before an
+	// offline resize, as resize2fs requires. If problems remain, the resize is
+	// abandoned and a *CheckError is returned.
+	Check bool
 }
 
 // Resize an ext4 filesystem.
-func (c *Client) ResizeFilesystem(ctx context.Context, opts ResizeOptions) error {
-	_, err := c.run(ctx, "resize2fs", args.Marshal(opts)...)
-	return err
+func (c *Client) ResizeFilesystem(ctx context.Context, opts ResizeOptions) (_ *ResizeResult, err error) {
+	ctx, span := c.startSpan(ctx, "ResizeFilesystem", opts.Device)
+	defer endSpan(span, &err)
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := c.lockDevice(ctx, opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return c.resizeFilesystem(ctx, opts)
+}
+
+// resizeFilesystem resizes the filesystem, the caller must hold the device
+// lock.
+func (c *Client) resizeFilesystem(ctx context.Context, opts ResizeOptions) (*ResizeResult, error) {
+	sb, err := c.VerifyExt4(ctx, opts.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	// resize2fs grows mounted filesystems online, but the kernel is unable to
+	// shrink them, so catch that early with a more helpful error.
+	mountPoint, err := c.mountPoint(opts.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	if mountPoint != "" {
+		shrink := opts.Shrink
+		if opts.Size != 0 {
+			shrink = opts.Size.blocks(sb.BlockSize) < sb.BlockCount
+		}
+
+		if shrink {
+			return nil, fmt.Errorf("%w: %s is mounted at %s, unmount it first", ErrShrinkMounted, opts.Device, mountPoint)
+		}
+	}
+
+	var check *CheckResult
+	if opts.Check && mountPoint == "" {
+		check, err = c.checkFilesystem(ctx, CheckOptions{Device: opts.Device, Force: true, Preen: true})
+		if err != nil {
+			return nil, fmt.Errorf("filesystem check before resize failed: %w", err)
+		}
+	}
+
+	// Online resizes can't be undone.
+	if mountPoint == "" {
+		opts.UndoFile, err = c.autoUndoFile(opts.Device, opts.UndoFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the final size is parsed from the output.
+	runOpts := runOptions{tailOutput: true}
+	if opts.Progress != nil {
+		runOpts.stdout = &resizeProgressWriter{progress: opts.Progress}
+	}
+
+	// Some messages (eg. when there's nothing to do) are reported on stderr.
+	out, errOut, err := c.runWithOptions(ctx, runOpts, "resize2fs", opts.Args()...)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ParseResizeResult(append(out, errOut...))
+	if err != nil {
+		return nil, err
+	}
+	result.OldBlockCount = sb.BlockCount
+	result.Check = check
+	if mountPoint != "" {
+		result.Online = true
+	}
+
+	return result, nil
+}
+
+// Args returns the arguments of resize2fs for the options. An automatic undo
+// file isn't reflected.
+func (opts ResizeOptions) Args() []string {
+	var cmdArgs []string
+	if opts.Progress != nil {
+		cmdArgs = append(cmdArgs, "-p")
+	}
+
+	return append(cmdArgs, args.Marshal(opts)...)
 }
 
 // CheckOptions provides options for checking an ext4 filesystem.
@@ -122,49 +432,352 @@ type CheckOptions struct {
 	ExternalJournal     string `arg:"j"` // External journal for the filesystem.
 	ExtendedOptions     string `arg:"E"` // Extended options, comma separated list.
 	UndoFile            string `arg:"z"` // Before overwriting blocks, backup the contents.
+	// Progress, if set, is called periodically with the completion status of
+	// each pass. Not supported by all executors.
+	Progress func(pass int, cur, max float64)
 }
 
-// Check an ext4 filesystem.
-func (c *Client) CheckFilesystem(ctx context.Context, opts CheckOptions) error {
+// Check an ext4 filesystem. If problems were found but left uncorrected, or
+// e2fsck failed to run, a *CheckError is returned alongside the result.
+func (c *Client) CheckFilesystem(ctx context.Context, opts CheckOptions) (_ *CheckResult, err error) {
+	ctx, span := c.startSpan(ctx, "CheckFilesystem", opts.Device)
+	defer endSpan(span, &err)
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := c.lockDevice(ctx, opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return c.checkFilesystem(ctx, opts)
+}
+
+// checkFilesystem checks the filesystem, the caller must hold the device
+// lock.
+func (c *Client) checkFilesystem(ctx context.Context, opts CheckOptions) (*CheckResult, error) {
+	if !opts.NoFix {
+		var err error
+		opts.UndoFile, err = c.autoUndoFile(opts.Device, opts.UndoFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var extraFiles []*os.File
+	var progressDone chan struct{}
+	if opts.Progress != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create progress pipe: %w", err)
+		}
+		defer r.Close()
+
+		// The write end of the pipe is passed to e2fsck as fd 3.
+		extraFiles = []*os.File{w}
+
+		progressDone = make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			readCheckProgress(r, opts.Progress)
+		}()
+	}
+	result := &CheckResult{}
+
+	out, _, err := c.runWithOptions(ctx, runOptions{extraFiles: extraFiles, tailOutput: true}, "e2fsck", opts.Args()...)
+	if opts.Progress != nil {
+		_ = extraFiles[0].Close()
+		<-progressDone
+	}
+	result.Problems = ParseCheckProblems(out)
+	if err != nil {
+		code := exitCode(err)
+		if code < 0 {
+			return nil, err
+		}
+
+		result.Status = CheckStatus(code)
+	}
+
+	if !result.Status.OK() {
+		return result, &CheckError{Status: result.Status, Problems: result.Problems, Err: err}
+	}
+
+	return result, nil
+}
+
+// Args returns the arguments of e2fsck for the options. Progress is reported
+// on fd 3 (the first extra file of the command), and an automatic undo file
+// isn't reflected.
+func (opts CheckOptions) Args() []string {
 	var cmdArgs []string
 	if !opts.Preen && !opts.NoFix {
 		cmdArgs = []string{"-y"}
 	}
-	cmdArgs = append(cmdArgs, args.Marshal(opts)...)
-	_, err := c.run(ctx, "e2fsck", cmdArgs...)
-	return err
+	if opts.Progress != nil {
+		cmdArgs = append(cmdArgs, "-C", "3")
+	}
+
+	return append(cmdArgs, args.Marshal(opts)...)
 }
 
 func (c *Client) run(ctx context.Context, cmdName string, cmdArgs ...string) ([]byte, error) {
-	cmdPath, err := c.findExecutable(cmdName)
+	out, _, err := c.runWithInput(ctx, nil, cmdName, cmdArgs...)
+	return out, err
+}
+
+// runWithInput runs the named command with the provided stdin (which may be nil)
+// and returns both its stdout and stderr. Any output captured is returned even
+// if the command fails.
+func (c *Client) runWithInput(ctx context.Context, stdin io.Reader, cmdName string, cmdArgs ...string) ([]byte, []byte, error) {
+	return c.runWithOptions(ctx, runOptions{stdin: stdin}, cmdName, cmdArgs...)
+}
+
+// runOptions describes how to wire up the standard streams of a command.
+type runOptions struct {
+	// stdin, if set, is used as the standard input of the command.
+	stdin io.Reader
+	// stdout, if set, additionally receives the standard output of the
+	// command as it is produced.
+	stdout io.Writer
+	// tailOutput marks that only the end of the standard output is needed,
+	// so when it's streamed to the caller the rest needn't be kept.
+	tailOutput bool
+	// extraFiles are passed to the command as file descriptors 3 onwards.
+	extraFiles []*os.File
+	// env are additional environment variables ("key=value") for the
+	// command, overriding those of the client.
+	env []string
+	// path, if set, is the path of the binary (rather than finding it).
+	path string
+	// sensitiveStdin omits the standard input from dry-run errors.
+	sensitiveStdin bool
+	// readOnly marks the command as safe to run in dry-run mode.
+	readOnly bool
+}
+
+// runWithOptions is like runWithInput but allows for finer control over the
+// standard streams and file descriptors of the command.
+func (c *Client) runWithOptions(ctx context.Context, opts runOptions, cmdName string, cmdArgs ...string) ([]byte, []byte, error) {
+	if c.optionErr != nil {
+		return nil, nil, c.optionErr
+	}
+
+	stdin := opts.stdin
+
+	cmdPath := opts.path
+	if cmdPath == "" {
+		var err error
+		cmdPath, err = c.findExecutable(cmdName)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if c.busyboxCompat {
+		isBusyBox, err := c.isBusyBox(ctx, cmdPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if isBusyBox {
+			cmdArgs, err = busyboxArgs(cmdName, cmdArgs)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	readOnly := opts.readOnly || isReadOnly(cmdName, cmdArgs)
+
+	cmdPath, cmdArgs, err := c.withPriority(cmdPath, cmdArgs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	cmd := exec.CommandContext(ctx, cmdPath, cmdArgs...)
+	if c.dryRun && !readOnly {
+		dryRunErr := &DryRunError{
+			Argv: append([]string{cmdPath}, cmdArgs...),
+			Env:  append(c.environ(), opts.env...),
+		}
+		if stdin != nil && !opts.sensitiveStdin {
+			input, err := io.ReadAll(stdin)
+			if err != nil {
+				return nil, nil, err
+			}
+			dryRunErr.Stdin = string(input)
+		}
 
-	var out bytes.Buffer
-	var errOut bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &errOut
+		return nil, nil, dryRunErr
+	}
 
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("%w: %s", err, errOut.String())
+	if stdin != nil && c.retries > 1 {
+		// Buffer the input so that it can be replayed on each attempt.
+		input, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, nil, err
+		}
+		stdin = bytes.NewReader(input)
 	}
 
-	return out.Bytes(), nil
-}
+	for attempt := 1; ; attempt++ {
+		out, errOut, err := c.runOnce(ctx, opts, stdin, cmdName, cmdPath, cmdArgs)
+		if err == nil {
+			return out, errOut, nil
+		}
 
-func (c *Client) findExecutable(cmdName string) (string, error) {
-	for _, dir := range filepath.SplitList(c.path) {
-		if dir == "" {
-			dir = "."
+		if attempt >= c.retries || !isTransientError(errOut) {
+			return out, errOut, &CommandError{
+				Program:  cmdName,
+				Argv:     append([]string{cmdPath}, cmdArgs...),
+				ExitCode: exitCode(err),
+				Stderr:   string(errOut),
+				Err:      err,
+			}
 		}
-		cmdPath := filepath.Join(filepath.Clean(dir), cmdName)
-		if _, err := os.Stat(cmdPath); err == nil {
-			return cmdPath, nil
+
+		delay := c.retryDelay(attempt)
+		if c.logger != nil {
+			c.logger.Debug("Retrying command after transient error",
+				slog.String("path", cmdPath),
+				slog.Int("attempt", attempt),
+				slog.Duration("delay", delay))
 		}
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return out, errOut, err
+		}
+
+		if seeker, ok := stdin.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// runOnce executes a single attempt of a command and returns its raw output.
+func (c *Client) runOnce(ctx context.Context, opts runOptions, stdin io.Reader, cmdName, cmdPath string, cmdArgs []string) ([]byte, []byte, error) {
+	// Once output is streamed to the caller, only keep the tail of it (which
+	// is enough for error messages and trailing summaries).
+	out, errOut := &tailBuffer{}, &tailBuffer{}
+	if opts.tailOutput && (c.stdout != nil || c.onLine != nil || opts.stdout != nil) {
+		out.limit = maxRetainedOutput
+	}
+	if c.stderr != nil || c.onLine != nil {
+		errOut.limit = maxRetainedOutput
+	}
+
+	var outWriter io.Writer = out
+	if opts.stdout != nil {
+		outWriter = io.MultiWriter(out, opts.stdout)
+	}
+	stdoutWriter, stderrWriter, flush := c.outputWriters(outWriter, errOut)
+	cmd := &Command{
+		Path:       cmdPath,
+		Args:       cmdArgs,
+		Env:        append(c.environ(), opts.env...),
+		Stdin:      stdin,
+		Stdout:     stdoutWriter,
+		Stderr:     stderrWriter,
+		ExtraFiles: opts.extraFiles,
+	}
+
+	ctx, span := c.startCommandSpan(ctx, cmdName, cmd)
+	c.fireHooks(CommandEvent{
+		Phase: CommandStarted,
+		Path:  cmd.Path,
+		Args:  cmd.Args,
+	})
+
+	start := time.Now()
+	err := c.executor.Run(ctx, cmd)
+	duration := time.Since(start)
+	flush()
+	endCommandSpan(span, err)
+	c.metrics.observe(cmdName, duration, err)
+
+	c.logCommand(cmd, duration, err)
+	c.fireHooks(CommandEvent{
+		Phase:    CommandFinished,
+		Path:     cmd.Path,
+		Args:     cmd.Args,
+		Duration: duration,
+		ExitCode: exitCode(err),
+		Stdout:   truncateOutput(out.Bytes()),
+		Stderr:   truncateOutput(errOut.Bytes()),
+		Err:      err,
+	})
+
+	return out.Bytes(), errOut.Bytes(), err
+}
+
+// environ returns the caller provided environment variables for child
+// processes, in "key=value" form.
+func (c *Client) environ() []string {
+	if len(c.env) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.env))
+	for key := range c.env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, key+"="+c.env[key])
+	}
+
+	return env
+}
+
+func (c *Client) logCommand(cmd *Command, duration time.Duration, err error) {
+	if c.logger == nil {
+		return
+	}
+
+	attrs := []any{
+		slog.String("path", cmd.Path),
+		slog.Any("args", cmd.Args),
+		slog.Duration("duration", duration),
+		slog.Int("exitCode", exitCode(err)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+
+	c.logger.Debug("Executed command", attrs...)
+}
+
+func (c *Client) findExecutable(cmdName string) (string, error) {
+	if cmdPath, ok := c.toolPaths[cmdName]; ok {
+		return cmdPath, nil
+	}
+
+	return c.executor.LookPath(cmdName)
+}
+
+// exitCode returns the exit code of a command given the error returned by
+// an Executor (or -1 if the command did not run to completion).
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.ExitCode
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
 	}
 
-	return "", fmt.Errorf("command not found: %w", os.ErrNotExist)
+	return -1
 }
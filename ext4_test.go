@@ -19,7 +19,6 @@ package ext4_test
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -28,41 +27,29 @@ import (
 	"testing"
 
 	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/dpeckett/ext4/nbd"
 	"github.com/stretchr/testify/require"
 )
 
 func TestClient(t *testing.T) {
-	err := loadNBDModule()
-	require.NoError(t, err)
+	ctx := context.Background()
 
 	t.Log("Creating virtual block device")
 
-	imagePath := filepath.Join(t.TempDir(), ".qcow2")
-	err = createImage(imagePath)
-	require.NoError(t, err)
-
-	devPath, err := attachNBDDevice(imagePath)
-	require.NoError(t, err)
-
-	t.Cleanup(func() {
-		t.Log("Detaching virtual block device")
-
-		err := detachNBDDevice(devPath)
-		require.NoError(t, err)
-	})
+	devPath := ext4test.NewNBDDevice(t, nbd.FormatQCOW2)
 
 	t.Log("Creating ext4 filesystem")
 
-	ctx := context.Background()
-
 	c := ext4.NewClient()
 
-	err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+	fs, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
 		Device: devPath,
-		Size:   "100M",
+		Size:   100 * ext4.MiB,
 		Label:  t.Name(),
 	})
 	require.NoError(t, err, "failed to create ext4 filesystem")
+	require.NotEmpty(t, fs.UUID, "missing filesystem UUID")
 
 	t.Log("Verifying filesystem label")
 
@@ -75,13 +62,13 @@ func TestClient(t *testing.T) {
 	t.Log("Mounting ext4 filesystem")
 
 	mountPath := t.TempDir()
-	err = exec.Command("mount", devPath, mountPath).Run()
+	err = c.Mount(ctx, devPath, mountPath, ext4.MountOptions{})
 	require.NoError(t, err, "failed to mount ext4 filesystem")
 
 	t.Cleanup(func() {
 		t.Log("Unmounting ext4 filesystem (if necessary)")
 
-		_ = exec.Command("umount", mountPath).Run()
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{})
 	})
 
 	t.Log("Verifying filesystem size")
@@ -109,34 +96,36 @@ func TestClient(t *testing.T) {
 
 	t.Log("Unmounting ext4 filesystem")
 
-	err = exec.Command("umount", mountPath).Run()
+	err = c.Unmount(ctx, mountPath, ext4.UnmountOptions{})
 	require.NoError(t, err, "failed to unmount ext4 filesystem")
 
 	t.Log("Resizing ext4 filesystem")
 
-	err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+	resizeResult, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
 		Device: devPath,
-		Size:   "500M",
+		Size:   500 * ext4.MiB,
 	})
 	require.NoError(t, err, "failed to resize ext4 filesystem")
+	require.Greater(t, resizeResult.NewBlockCount, resizeResult.OldBlockCount, "filesystem did not grow")
 
 	t.Log("Checking ext4 filesystem")
 
-	err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
 		Device: devPath,
 		Force:  true,
 	})
 	require.NoError(t, err, "failed to check ext4 filesystem")
+	require.True(t, result.Status.OK(), "unexpected check status")
 
 	t.Log("Mounting ext4 filesystem")
 
-	err = exec.Command("mount", devPath, mountPath).Run()
+	err = c.Mount(ctx, devPath, mountPath, ext4.MountOptions{})
 	require.NoError(t, err, "failed to mount ext4 filesystem")
 
 	t.Cleanup(func() {
 		t.Log("Unmounting ext4 filesystem (if necessary)")
 
-		_ = exec.Command("umount", mountPath).Run()
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{})
 	})
 
 	t.Log("Verifying resized filesystem size")
@@ -150,31 +139,3 @@ func TestClient(t *testing.T) {
 
 	require.InEpsilon(t, 1.0, float32(size)/500000000.0, 0.25, "unexpected filesystem size")
 }
-
-func loadNBDModule() error {
-	cmd := exec.Command("/sbin/modprobe", "nbd")
-	return cmd.Run()
-}
-
-func createImage(imagePath string) error {
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", imagePath, "1G")
-	return cmd.Run()
-}
-
-func attachNBDDevice(imagePath string) (string, error) {
-	for i := 0; i < 16; i++ {
-		devPath := fmt.Sprintf("/dev/nbd%d", i)
-		cmd := exec.Command("qemu-nbd", "-c", devPath, imagePath)
-		err := cmd.Run()
-		if err == nil {
-			return devPath, nil
-		}
-	}
-
-	return "", fmt.Errorf("no free nbd device found")
-}
-
-func detachNBDDevice(devPath string) error {
-	cmd := exec.Command("qemu-nbd", "-d", devPath)
-	return cmd.Run()
-}
@@ -0,0 +1,402 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dpeckett/ext4"
+)
+
+// maxExtentLength is the maximum length of an (initialized) extent.
+const maxExtentLength = 32768
+
+// groupStart returns the first block of a block group.
+func (fsys *FS) groupStart(group uint64) uint64 {
+	return fsys.sb.FirstBlock + group*fsys.sb.BlocksPerGroup
+}
+
+// groupBlocks returns the number of blocks in a block group (the last may be
+// smaller than the rest).
+func (fsys *FS) groupBlocks(group uint64) uint64 {
+	return min(fsys.sb.BlocksPerGroup, fsys.sb.BlockCount-fsys.groupStart(group))
+}
+
+// blockGroup returns the block group of a block.
+func (fsys *FS) blockGroup(block uint64) uint64 {
+	return (block - fsys.sb.FirstBlock) / fsys.sb.BlocksPerGroup
+}
+
+// inodeGroup returns the block group of an inode.
+func (fsys *FS) inodeGroup(number uint32) uint64 {
+	return uint64(number-1) / fsys.sb.InodesPerGroup
+}
+
+// uninitGroups returns true if block groups may be uninitialized (the group
+// descriptors are checksummed).
+func (fsys *FS) uninitGroups() bool {
+	return fsys.sb.HasFeature(ext4.MetadataCsum) || fsys.sb.HasFeature(ext4.UninitBG)
+}
+
+// readBlockBitmap reads the block bitmap of a group (initializing it, if the
+// group is uninitialized).
+func (fsys *FS) readBlockBitmap(group uint64) ([]byte, error) {
+	desc := fsys.descs[group]
+	bitmap := make([]byte, fsys.blockSize)
+	if fsys.uninitGroups() && desc.flags()&groupBlockUninit != 0 {
+		fsys.initBlockBitmap(group, bitmap)
+		return bitmap, nil
+	}
+
+	if _, err := fsys.r.ReadAt(bitmap, int64(desc.block(descBlockBitmap))*fsys.blockSize); err != nil {
+		return nil, fmt.Errorf("failed to read block bitmap of group %d: %w", group, err)
+	}
+
+	return bitmap, nil
+}
+
+// initBlockBitmap marks the metadata blocks stored in an uninitialized block
+// group (the superblock and group descriptors, and the bitmaps and inode
+// tables of any group, with flex_bg).
+func (fsys *FS) initBlockBitmap(group uint64, bitmap []byte) {
+	start, blocks := fsys.groupStart(group), fsys.groupBlocks(group)
+	mark := func(block, count uint64) {
+		if first, last := max(block, start), min(block+count, start+blocks); first < last {
+			setBits(bitmap, first-start, last-start)
+		}
+	}
+
+	descPerBlock := uint64(fsys.blockSize) / uint64(fsys.descSize)
+	metaBG := fsys.sb.HasFeature(ext4.MetaBG)
+
+	if fsys.superGroups[group] {
+		gdtBlocks := (fsys.groupCount() + descPerBlock - 1) / descPerBlock
+		if metaBG {
+			gdtBlocks = fsys.sb.FirstMetaBlockGroup
+		}
+		mark(start, 1+gdtBlocks+fsys.sb.ReservedGDTBlocks)
+	}
+
+	// With meta_bg, the descriptors are stored in the first, second and last
+	// groups of each meta group.
+	if index := group % descPerBlock; metaBG && group/descPerBlock >= fsys.sb.FirstMetaBlockGroup && (index <= 1 || index == descPerBlock-1) {
+		block := start
+		if fsys.superGroups[group] {
+			block++
+		}
+		mark(block, 1)
+	}
+
+	inodeTableBlocks := (fsys.sb.InodesPerGroup*uint64(fsys.sb.InodeSize) + uint64(fsys.blockSize) - 1) / uint64(fsys.blockSize)
+	for _, desc := range fsys.descs {
+		mark(desc.block(descBlockBitmap), 1)
+		mark(desc.block(descInodeBitmap), 1)
+		mark(desc.block(descInodeTable), inodeTableBlocks)
+	}
+
+	// Bits past the end of the group are set.
+	setBits(bitmap, blocks, uint64(len(bitmap))*8)
+}
+
+// readInodeBitmap reads the inode bitmap of a group (initializing it, if the
+// group is uninitialized).
+func (fsys *FS) readInodeBitmap(group uint64) ([]byte, error) {
+	desc := fsys.descs[group]
+	bitmap := make([]byte, fsys.blockSize)
+	if fsys.uninitGroups() && desc.flags()&groupInodeUninit != 0 {
+		setBits(bitmap, fsys.sb.InodesPerGroup, uint64(len(bitmap))*8)
+		return bitmap, nil
+	}
+
+	if _, err := fsys.r.ReadAt(bitmap, int64(desc.block(descInodeBitmap))*fsys.blockSize); err != nil {
+		return nil, fmt.Errorf("failed to read inode bitmap of group %d: %w", group, err)
+	}
+
+	return bitmap, nil
+}
+
+// blockBitmap returns the (cached) block bitmap of a group, marking it
+// initialized.
+func (w *Writer) blockBitmap(group uint64) ([]byte, error) {
+	if bitmap, ok := w.blockBitmaps[group]; ok {
+		return bitmap, nil
+	}
+
+	bitmap, err := w.readBlockBitmap(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc := w.descs[group]; w.uninitGroups() && desc.flags()&groupBlockUninit != 0 {
+		desc.setFlags(desc.flags() &^ groupBlockUninit)
+		w.dirty[group] = true
+	}
+
+	w.blockBitmaps[group] = bitmap
+	return bitmap, nil
+}
+
+// inodeBitmap returns the (cached) inode bitmap of a group, marking it
+// initialized.
+func (w *Writer) inodeBitmap(group uint64) ([]byte, error) {
+	if bitmap, ok := w.inodeBitmaps[group]; ok {
+		return bitmap, nil
+	}
+
+	bitmap, err := w.readInodeBitmap(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc := w.descs[group]; w.uninitGroups() && desc.flags()&groupInodeUninit != 0 {
+		desc.setFlags(desc.flags() &^ groupInodeUninit)
+		w.dirty[group] = true
+	}
+
+	w.inodeBitmaps[group] = bitmap
+	return bitmap, nil
+}
+
+// allocBlocks allocates n blocks, preferably in the block group of goal,
+// returning the runs of contiguous blocks allocated (as extents, without
+// their logical block numbers).
+func (w *Writer) allocBlocks(goal, n uint64) ([]extent, error) {
+	groups := w.groupCount()
+	first := uint64(0)
+	if goal >= w.sb.FirstBlock && goal < w.sb.BlockCount {
+		first = w.blockGroup(goal)
+	}
+
+	var runs []extent
+	for i := uint64(0); i < groups && n > 0; i++ {
+		group := (first + i) % groups
+
+		desc := w.descs[group]
+		if desc.count(descFreeBlocks) == 0 {
+			continue
+		}
+
+		bitmap, err := w.blockBitmap(group)
+		if err != nil {
+			return nil, err
+		}
+
+		start, allocated := w.groupStart(group), uint32(0)
+		for bit := uint64(0); bit < w.groupBlocks(group) && n > 0; bit++ {
+			if bitmap[bit/8]&(1<<(bit%8)) != 0 {
+				continue
+			}
+			setBits(bitmap, bit, bit+1)
+			allocated++
+			n--
+
+			block := start + bit
+			if last := len(runs) - 1; last >= 0 && runs[last].physical+uint64(runs[last].length) == block && runs[last].length < maxExtentLength {
+				runs[last].length++
+			} else {
+				runs = append(runs, extent{physical: block, length: 1})
+			}
+		}
+
+		if allocated > 0 {
+			desc.setCount(descFreeBlocks, desc.count(descFreeBlocks)-allocated)
+			w.addFreeBlocks(-int64(allocated))
+			w.dirty[group] = true
+		}
+	}
+
+	if n > 0 {
+		for _, run := range runs {
+			if err := w.freeBlocks(run.physical, uint64(run.length)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrNoSpace
+	}
+
+	return runs, nil
+}
+
+// freeBlocks releases a run of blocks.
+func (w *Writer) freeBlocks(block, count uint64) error {
+	for ; count > 0; block, count = block+1, count-1 {
+		if block < w.sb.FirstBlock || block >= w.sb.BlockCount {
+			return fmt.Errorf("invalid block %d", block)
+		}
+
+		group := w.blockGroup(block)
+		bitmap, err := w.blockBitmap(group)
+		if err != nil {
+			return err
+		}
+
+		bit := block - w.groupStart(group)
+		if bitmap[bit/8]&(1<<(bit%8)) == 0 {
+			continue
+		}
+		bitmap[bit/8] &^= 1 << (bit % 8)
+
+		desc := w.descs[group]
+		desc.setCount(descFreeBlocks, desc.count(descFreeBlocks)+1)
+		w.addFreeBlocks(1)
+		w.dirty[group] = true
+	}
+
+	return nil
+}
+
+// allocInode allocates an inode, preferably in the given block group.
+func (w *Writer) allocInode(goal uint64, dir bool) (uint32, error) {
+	groups := w.groupCount()
+	inodesPerGroup := w.sb.InodesPerGroup
+
+	for i := uint64(0); i < groups; i++ {
+		group := (goal + i) % groups
+
+		desc := w.descs[group]
+		if desc.count(descFreeInodes) == 0 {
+			continue
+		}
+
+		bitmap, err := w.inodeBitmap(group)
+		if err != nil {
+			return 0, err
+		}
+
+		for bit := uint64(0); bit < inodesPerGroup; bit++ {
+			number := group*inodesPerGroup + bit + 1
+			if bitmap[bit/8]&(1<<(bit%8)) != 0 || number < w.sb.FirstInode {
+				continue
+			}
+			setBits(bitmap, bit, bit+1)
+
+			desc.setCount(descFreeInodes, desc.count(descFreeInodes)-1)
+			if dir {
+				desc.setCount(descUsedDirs, desc.count(descUsedDirs)+1)
+			}
+			// The inode table is only initialized up to the last inode used.
+			if unused := uint64(desc.count(descItableUnused)); w.uninitGroups() && bit >= inodesPerGroup-unused {
+				desc.setCount(descItableUnused, uint32(inodesPerGroup-bit-1))
+			}
+			w.addFreeInodes(-1)
+			w.dirty[group] = true
+
+			return uint32(number), nil
+		}
+	}
+
+	return 0, ErrNoSpace
+}
+
+// freeInode releases an inode.
+func (w *Writer) freeInode(number uint32, dir bool) error {
+	group := w.inodeGroup(number)
+	bitmap, err := w.inodeBitmap(group)
+	if err != nil {
+		return err
+	}
+
+	bit := uint64(number-1) % w.sb.InodesPerGroup
+	bitmap[bit/8] &^= 1 << (bit % 8)
+
+	desc := w.descs[group]
+	desc.setCount(descFreeInodes, desc.count(descFreeInodes)+1)
+	if dir {
+		desc.setCount(descUsedDirs, desc.count(descUsedDirs)-1)
+	}
+	w.addFreeInodes(1)
+	w.dirty[group] = true
+
+	return nil
+}
+
+// addFreeBlocks adjusts the free block count of the superblock.
+func (w *Writer) addFreeBlocks(delta int64) {
+	le := binary.LittleEndian
+
+	free := uint64(le.Uint32(w.rawSB[0xC:]))
+	if w.sb.HasFeature(ext4.Has64Bit) {
+		free |= uint64(le.Uint32(w.rawSB[0x158:])) << 32
+	}
+	free = uint64(int64(free) + delta)
+
+	le.PutUint32(w.rawSB[0xC:], uint32(free))
+	if w.sb.HasFeature(ext4.Has64Bit) {
+		le.PutUint32(w.rawSB[0x158:], uint32(free>>32))
+	}
+	w.sb.FreeBlocks = free
+}
+
+// addFreeInodes adjusts the free inode count of the superblock.
+func (w *Writer) addFreeInodes(delta int64) {
+	le := binary.LittleEndian
+
+	free := uint32(int64(le.Uint32(w.rawSB[0x10:])) + delta)
+	le.PutUint32(w.rawSB[0x10:], free)
+	w.sb.FreeInodes = uint64(free)
+}
+
+// flush writes the modified bitmaps and group descriptors, and the
+// superblock.
+func (w *Writer) flush() error {
+	for group := range w.dirty {
+		desc := w.descs[group]
+
+		if bitmap, ok := w.blockBitmaps[group]; ok {
+			if _, err := w.w.WriteAt(bitmap, int64(desc.block(descBlockBitmap))*w.blockSize); err != nil {
+				return fmt.Errorf("failed to write block bitmap of group %d: %w", group, err)
+			}
+			if w.metadataCsum {
+				desc.setCount(descBlockBitmapCsum, crc32c(w.seed, bitmap[:w.sb.BlocksPerGroup/8]))
+			}
+		}
+
+		if bitmap, ok := w.inodeBitmaps[group]; ok {
+			if _, err := w.w.WriteAt(bitmap, int64(desc.block(descInodeBitmap))*w.blockSize); err != nil {
+				return fmt.Errorf("failed to write inode bitmap of group %d: %w", group, err)
+			}
+			if w.metadataCsum {
+				desc.setCount(descInodeBitmapCsum, crc32c(w.seed, bitmap[:w.sb.InodesPerGroup/8]))
+			}
+		}
+
+		switch {
+		case w.metadataCsum:
+			setGroupDescriptorChecksum(desc, w.seed, uint32(group))
+		case w.gdtCsum:
+			setGroupDescriptorCrc16(desc, [16]byte(w.rawSB[0x68:0x78]), uint32(group))
+		}
+
+		if _, err := w.w.WriteAt(desc, w.descOffsets[group]); err != nil {
+			return fmt.Errorf("failed to write group descriptor %d: %w", group, err)
+		}
+
+		delete(w.dirty, group)
+	}
+
+	binary.LittleEndian.PutUint32(w.rawSB[0x30:], uint32(w.now().Unix()))
+	if w.metadataCsum {
+		setSuperblockChecksum(w.rawSB)
+	}
+	if _, err := w.w.WriteAt(w.rawSB, superblockOffset); err != nil {
+		return fmt.Errorf("failed to write superblock: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// directBlocks is the number of blocks mapped directly by i_block.
+	directBlocks = 12
+	// maxCachedIndirectBlocks bounds the number of indirect blocks kept in
+	// memory while reading a file.
+	maxCachedIndirectBlocks = 64
+)
+
+// blockMapReader reads the contents of a file stored with the legacy (ext2
+// and ext3) block map: twelve direct blocks, followed by single, double and
+// triple indirect blocks.
+type blockMapReader struct {
+	fsys *FS
+	size int64
+	// block is the i_block field of the inode.
+	block [15]uint32
+
+	mu sync.Mutex
+	// indirect caches recently read indirect blocks.
+	indirect map[uint32][]uint32
+}
+
+// blockMapReader returns a reader of a block mapped file.
+func (fsys *FS) blockMapReader(ino *Inode) *blockMapReader {
+	r := &blockMapReader{
+		fsys:     fsys,
+		size:     int64(ino.Size),
+		indirect: make(map[uint32][]uint32),
+	}
+	for i := range r.block {
+		r.block[i] = binary.LittleEndian.Uint32(ino.block[i*4:])
+	}
+
+	return r
+}
+
+// physical returns the physical block of a logical block of the file (zero
+// if it is a hole).
+func (r *blockMapReader) physical(logical uint64) (uint64, error) {
+	if logical < directBlocks {
+		return uint64(r.block[logical]), nil
+	}
+	logical -= directBlocks
+
+	perBlock := uint64(r.fsys.blockSize / 4)
+	for level, span := 1, perBlock; level <= 3; level, span = level+1, span*perBlock {
+		if logical >= span {
+			logical -= span
+			continue
+		}
+
+		// Walk down the indirect blocks, from the top level.
+		block := r.block[directBlocks+level-1]
+		for span /= perBlock; block != 0; span /= perBlock {
+			entries, err := r.readIndirect(block)
+			if err != nil {
+				return 0, err
+			}
+
+			block = entries[logical/span]
+			logical %= span
+			if span == 1 {
+				break
+			}
+		}
+
+		return uint64(block), nil
+	}
+
+	return 0, fmt.Errorf("block %d is beyond the block map", logical)
+}
+
+// readIndirect returns the entries of an indirect block.
+func (r *blockMapReader) readIndirect(block uint32) ([]uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entries, ok := r.indirect[block]; ok {
+		return entries, nil
+	}
+
+	buf := make([]byte, r.fsys.blockSize)
+	if _, err := r.fsys.r.ReadAt(buf, int64(block)*r.fsys.blockSize); err != nil {
+		return nil, fmt.Errorf("failed to read indirect block %d: %w", block, err)
+	}
+
+	entries := make([]uint32, len(buf)/4)
+	for i := range entries {
+		entries[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+
+	if len(r.indirect) >= maxCachedIndirectBlocks {
+		clear(r.indirect)
+	}
+	r.indirect[block] = entries
+
+	return entries, nil
+}
+
+// ReadAt implements io.ReaderAt. Holes read as zeros.
+func (r *blockMapReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		length := r.fsys.blockSize - pos%r.fsys.blockSize
+		if length > int64(len(p)-n) {
+			length = int64(len(p) - n)
+		}
+
+		block, err := r.physical(uint64(pos / r.fsys.blockSize))
+		if err != nil {
+			return n, err
+		}
+
+		if block == 0 {
+			clear(p[n : n+int(length)])
+		} else if _, err := r.fsys.r.ReadAt(p[n:n+int(length)], int64(block)*r.fsys.blockSize+pos%r.fsys.blockSize); err != nil {
+			return n, fmt.Errorf("failed to read block %d: %w", block, err)
+		}
+		n += int(length)
+	}
+
+	return n, eof
+}
+
+// blocks returns all the blocks of the file: its data blocks, and the
+// indirect blocks mapping them.
+func (r *blockMapReader) blocks() ([]uint64, error) {
+	var blocks []uint64
+	for _, block := range r.block[:directBlocks] {
+		if block != 0 {
+			blocks = append(blocks, uint64(block))
+		}
+	}
+
+	var walk func(block uint32, level int) error
+	walk = func(block uint32, level int) error {
+		if block == 0 {
+			return nil
+		}
+		blocks = append(blocks, uint64(block))
+
+		entries, err := r.readIndirect(block)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if level == 1 {
+				if entry != 0 {
+					blocks = append(blocks, uint64(entry))
+				}
+			} else if err := walk(entry, level-1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for level := 1; level <= 3; level++ {
+		if err := walk(r.block[directBlocks+level-1], level); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
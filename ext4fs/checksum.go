@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// crc32cTable is the table of the CRC32C (Castagnoli) checksums used for ext4
+// metadata.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c continues a metadata checksum. Unlike crc32.Update, the checksum
+// isn't inverted before or after (as in the kernel).
+func crc32c(crc uint32, p []byte) uint32 {
+	return ^crc32.Update(^crc, crc32cTable, p)
+}
+
+// crc32cUint32 continues a metadata checksum with a little endian integer.
+func crc32cUint32(crc, v uint32) uint32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return crc32c(crc, buf[:])
+}
+
+// checksumSeed returns the seed of the metadata checksums of a filesystem,
+// derived from its UUID.
+func checksumSeed(uuid [16]byte) uint32 {
+	return crc32c(^uint32(0), uuid[:])
+}
+
+// superblockChecksumSeed returns the seed of the metadata checksums of a
+// filesystem, given its on-disk superblock (the seed is stored in the
+// superblock with the metadata_csum_seed feature, so the UUID can change).
+func superblockChecksumSeed(sb []byte) uint32 {
+	if binary.LittleEndian.Uint32(sb[0x60:])&0x2000 != 0 { // metadata_csum_seed
+		return binary.LittleEndian.Uint32(sb[0x270:])
+	}
+
+	return checksumSeed([16]byte(sb[0x68:0x78]))
+}
+
+// inodeChecksumSeed returns the seed of the checksums of the metadata of an
+// inode (eg. its directory blocks).
+func inodeChecksumSeed(seed, number, generation uint32) uint32 {
+	return crc32cUint32(crc32cUint32(seed, number), generation)
+}
+
+// setInodeChecksum stores the checksum of an on-disk inode.
+func setInodeChecksum(buf []byte, seed, number uint32) {
+	le := binary.LittleEndian
+
+	// The checksum covers the inode, with the checksum fields zeroed.
+	le.PutUint16(buf[0x7C:], 0)
+	hasHi := len(buf) > goodOldInodeSize && le.Uint16(buf[0x80:]) >= 4
+	if hasHi {
+		le.PutUint16(buf[0x82:], 0)
+	}
+
+	crc := crc32c(inodeChecksumSeed(seed, number, le.Uint32(buf[0x64:])), buf)
+
+	le.PutUint16(buf[0x7C:], uint16(crc))
+	if hasHi {
+		le.PutUint16(buf[0x82:], uint16(crc>>16))
+	}
+}
+
+// setGroupDescriptorChecksum stores the checksum of an on-disk group
+// descriptor.
+func setGroupDescriptorChecksum(desc []byte, seed, group uint32) {
+	binary.LittleEndian.PutUint16(desc[0x1E:], 0)
+	crc := crc32c(crc32cUint32(seed, group), desc)
+	binary.LittleEndian.PutUint16(desc[0x1E:], uint16(crc))
+}
+
+// setGroupDescriptorCrc16 stores the CRC16 checksum of an on-disk group
+// descriptor (with the uninit_bg feature, but not metadata_csum).
+func setGroupDescriptorCrc16(desc []byte, uuid [16]byte, group uint32) {
+	var groupBuf [4]byte
+	binary.LittleEndian.PutUint32(groupBuf[:], group)
+
+	crc := crc16(crc16(^uint16(0), uuid[:]), groupBuf[:])
+	crc = crc16(crc, desc[:0x1E])
+	if len(desc) > 0x20 {
+		crc = crc16(crc, desc[0x20:])
+	}
+	binary.LittleEndian.PutUint16(desc[0x1E:], crc)
+}
+
+// setSuperblockChecksum stores the checksum of an on-disk superblock.
+func setSuperblockChecksum(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[0x3FC:], crc32c(^uint32(0), buf[:0x3FC]))
+}
+
+// crc16 continues a CRC16 (ANSI) checksum, as used for the group descriptors
+// of filesystems with the uninit_bg feature (but not metadata_csum).
+func crc16(crc uint16, p []byte) uint16 {
+	for _, b := range p {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc64"
+
+	"github.com/dpeckett/ext4"
+)
+
+// deltaChunkBlocks is the number of blocks read at a time when comparing
+// images.
+const deltaChunkBlocks = 256
+
+// ErrBlockSizeMismatch is returned when comparing images (or snapshots) with
+// different block sizes.
+var ErrBlockSizeMismatch = errors.New("block sizes do not match")
+
+// crc64Table is the table of the CRC-64 (ECMA) digests of blocks in
+// snapshots.
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// Delta is the difference between two versions of an image, at the block
+// level.
+type Delta struct {
+	// BlockSize is the size of the blocks (in bytes).
+	BlockSize int `json:"blockSize"`
+	// BlockCount is the number of blocks of the new version (which may have
+	// been resized).
+	BlockCount uint64 `json:"blockCount"`
+	// Changed are the ranges of blocks allocated in the new version that
+	// differ from the previous version, or that weren't allocated in it.
+	// Copying these blocks over the previous version produces an image with
+	// the same allocated blocks as the new version.
+	Changed []ext4.Range `json:"changed"`
+	// Freed are the ranges of blocks allocated in the previous version, but
+	// free in the new version (eg. to discard them). Blocks beyond the end of
+	// the new version aren't included.
+	Freed []ext4.Range `json:"freed"`
+}
+
+// ChangedBlocks returns the number of changed blocks.
+func (d *Delta) ChangedBlocks() uint64 {
+	return countBlocks(d.Changed)
+}
+
+// Snapshot is the allocation map of an image, with a digest of the contents
+// of each allocated block, so the blocks changed since can be found later
+// without keeping a copy of the image (see FS.DeltaSince).
+type Snapshot struct {
+	// BlockSize is the size of the blocks (in bytes).
+	BlockSize int `json:"blockSize"`
+	// BlockCount is the number of blocks of the image.
+	BlockCount uint64 `json:"blockCount"`
+	// Ranges are the ranges of allocated blocks (see FS.AllocationMap).
+	Ranges []ext4.Range `json:"ranges"`
+	// Digests are the CRC-64 (ECMA) digests of the allocated blocks, in the
+	// order of Ranges.
+	Digests []uint64 `json:"digests"`
+}
+
+// Snapshot returns the allocation map of the filesystem, with a digest of
+// each allocated block. This reads every allocated block.
+func (fsys *FS) Snapshot() (*Snapshot, error) {
+	ranges, err := fsys.AllocationMap()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		BlockSize:  fsys.sb.BlockSize,
+		BlockCount: fsys.sb.BlockCount,
+		Ranges:     ranges,
+		Digests:    make([]uint64, 0, countBlocks(ranges)),
+	}
+
+	err = fsys.readBlocks(ranges, func(_ uint64, data []byte) error {
+		for off := 0; off < len(data); off += int(fsys.blockSize) {
+			snap.Digests = append(snap.Digests, crc64.Checksum(data[off:off+int(fsys.blockSize)], crc64Table))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// Delta compares the filesystem with a previous version of it (eg. the image
+// it was copied from, before being modified), returning the blocks that have
+// changed. Only blocks allocated in either version are compared.
+func (fsys *FS) Delta(prev *FS) (*Delta, error) {
+	if prev.sb.BlockSize != fsys.sb.BlockSize {
+		return nil, fmt.Errorf("%w: %d and %d", ErrBlockSizeMismatch, prev.sb.BlockSize, fsys.sb.BlockSize)
+	}
+
+	prevRanges, err := prev.AllocationMap()
+	if err != nil {
+		return nil, err
+	}
+
+	prevData := make([]byte, deltaChunkBlocks*fsys.blockSize)
+	return fsys.delta(prevRanges, func(start uint64, data []byte) (func(i int, block []byte) bool, error) {
+		// Read the same blocks of the previous version (up to its end).
+		n := min(uint64(len(data))/uint64(fsys.blockSize), prev.sb.BlockCount-min(start, prev.sb.BlockCount))
+		if n > 0 {
+			if _, err := prev.r.ReadAt(prevData[:n*uint64(fsys.blockSize)], int64(start)*fsys.blockSize); err != nil {
+				return nil, fmt.Errorf("failed to read blocks %d-%d: %w", start, start+n-1, err)
+			}
+		}
+
+		return func(i int, block []byte) bool {
+			off := i * int(fsys.blockSize)
+			return bytes.Equal(block, prevData[off:off+int(fsys.blockSize)])
+		}, nil
+	})
+}
+
+// DeltaSince compares the filesystem with a snapshot of a previous version of
+// it, returning the blocks that have changed. Blocks are compared by their
+// digests.
+func (fsys *FS) DeltaSince(snap *Snapshot) (*Delta, error) {
+	if snap.BlockSize != fsys.sb.BlockSize {
+		return nil, fmt.Errorf("%w: %d and %d", ErrBlockSizeMismatch, snap.BlockSize, fsys.sb.BlockSize)
+	}
+
+	if blocks := countBlocks(snap.Ranges); uint64(len(snap.Digests)) != blocks {
+		return nil, fmt.Errorf("invalid snapshot: %d digests for %d blocks", len(snap.Digests), blocks)
+	}
+
+	prev := rangeCursor{ranges: snap.Ranges}
+	return fsys.delta(snap.Ranges, func(start uint64, _ []byte) (func(i int, block []byte) bool, error) {
+		return func(i int, block []byte) bool {
+			index, ok := prev.find(start + uint64(i))
+			return ok && snap.Digests[index] == crc64.Checksum(block, crc64Table)
+		}, nil
+	})
+}
+
+// delta compares the allocated blocks of the filesystem with those of a
+// previous version, given the ranges of blocks allocated in it. For each chunk
+// of blocks read, compare is called to return a function reporting whether a
+// block (allocated in both versions) is unchanged.
+func (fsys *FS) delta(prevRanges []ext4.Range, compare func(start uint64, data []byte) (func(i int, block []byte) bool, error)) (*Delta, error) {
+	ranges, err := fsys.AllocationMap()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Delta{
+		BlockSize:  fsys.sb.BlockSize,
+		BlockCount: fsys.sb.BlockCount,
+	}
+
+	prev := rangeCursor{ranges: prevRanges}
+	err = fsys.readBlocks(ranges, func(start uint64, data []byte) error {
+		unchanged, err := compare(start, data)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(data)/int(fsys.blockSize); i++ {
+			block := start + uint64(i)
+			if _, ok := prev.find(block); ok && unchanged(i, data[i*int(fsys.blockSize):(i+1)*int(fsys.blockSize)]) {
+				continue
+			}
+			d.Changed = appendBlock(d.Changed, block)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks allocated in the previous version, but not in this one.
+	cur := rangeCursor{ranges: ranges}
+	for _, r := range prevRanges {
+		for block := r.Start; block <= r.End && block < fsys.sb.BlockCount; block++ {
+			if _, ok := cur.find(block); !ok {
+				d.Freed = appendBlock(d.Freed, block)
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// readBlocks calls fn with the contents of the given ranges of blocks, in
+// chunks of up to deltaChunkBlocks blocks. The data is only valid until fn
+// returns.
+func (fsys *FS) readBlocks(ranges []ext4.Range, fn func(start uint64, data []byte) error) error {
+	buf := make([]byte, deltaChunkBlocks*fsys.blockSize)
+	for _, r := range ranges {
+		for start := r.Start; start <= r.End; start += deltaChunkBlocks {
+			n := min(r.End-start+1, deltaChunkBlocks)
+
+			data := buf[:n*uint64(fsys.blockSize)]
+			if _, err := fsys.r.ReadAt(data, int64(start)*fsys.blockSize); err != nil {
+				return fmt.Errorf("failed to read blocks %d-%d: %w", start, start+n-1, err)
+			}
+
+			if err := fn(start, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rangeCursor looks up blocks, in ascending order, in an ordered list of
+// ranges.
+type rangeCursor struct {
+	ranges []ext4.Range
+	// i is the current range.
+	i int
+	// index is the number of blocks in the ranges before the current one.
+	index uint64
+}
+
+// find returns the index of a block among the blocks of the ranges, and
+// whether it's in any of them. Blocks must be looked up in ascending order.
+func (c *rangeCursor) find(block uint64) (uint64, bool) {
+	for c.i < len(c.ranges) && c.ranges[c.i].End < block {
+		c.index += c.ranges[c.i].End - c.ranges[c.i].Start + 1
+		c.i++
+	}
+
+	if c.i < len(c.ranges) && c.ranges[c.i].Start <= block {
+		return c.index + block - c.ranges[c.i].Start, true
+	}
+
+	return 0, false
+}
+
+// countBlocks returns the number of blocks in a list of ranges.
+func countBlocks(ranges []ext4.Range) uint64 {
+	var n uint64
+	for _, r := range ranges {
+		n += r.End - r.Start + 1
+	}
+
+	return n
+}
@@ -0,0 +1,370 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/dpeckett/ext4"
+)
+
+// dirTailSize is the size of the entry at the end of each directory block
+// that holds its checksum (with the metadata_csum feature).
+const dirTailSize = 12
+
+// dirTailFileType marks the entry holding the checksum of a directory block.
+const dirTailFileType = 0xDE
+
+// fileTypes maps the file type stored in directory entries to the type bits
+// of an fs.FileMode.
+var fileTypes = map[uint8]fs.FileMode{
+	1: 0,
+	2: fs.ModeDir,
+	3: fs.ModeDevice | fs.ModeCharDevice,
+	4: fs.ModeDevice,
+	5: fs.ModeNamedPipe,
+	6: fs.ModeSocket,
+	7: fs.ModeSymlink,
+}
+
+// fileType returns the type stored in the directory entries of an inode with
+// the given mode.
+func fileType(mode uint16) uint8 {
+	switch mode & typeMask {
+	case typeRegular:
+		return 1
+	case typeDir:
+		return 2
+	case typeChar:
+		return 3
+	case typeBlock:
+		return 4
+	case typeFIFO:
+		return 5
+	case typeSocket:
+		return 6
+	case typeSymlink:
+		return 7
+	default:
+		return 0
+	}
+}
+
+// dirEntry is an entry of a directory. It implements fs.DirEntry.
+type dirEntry struct {
+	fsys  *FS
+	name  string
+	inode uint32
+	// fileType is the type stored in the entry (zero if unknown, eg. without
+	// the filetype feature).
+	fileType uint8
+}
+
+func (e *dirEntry) Name() string {
+	return e.name
+}
+
+func (e *dirEntry) IsDir() bool {
+	return e.Type().IsDir()
+}
+
+func (e *dirEntry) Type() fs.FileMode {
+	if mode, ok := fileTypes[e.fileType]; ok {
+		return mode
+	}
+
+	info, err := e.Info()
+	if err != nil {
+		return fs.ModeIrregular
+	}
+
+	return info.Mode().Type()
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	ino, err := e.fsys.inode(e.inode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: e.name, inode: ino}, nil
+}
+
+func (e *dirEntry) String() string {
+	return fs.FormatDirEntry(e)
+}
+
+// readDir returns the entries of a directory, in the order they are stored
+// (excluding "." and "..").
+func (fsys *FS) readDir(dirIno *Inode) ([]dirEntry, error) {
+	raw, err := fsys.readDirRaw(dirIno)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := raw[:0]
+	for _, entry := range raw {
+		if entry.name != "." && entry.name != ".." {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// readDirRaw returns all the entries of a directory, including "." and "..".
+// Indexed (htree) directories are read linearly: their index nodes are
+// hidden in entries that span unused space. Blocks are read one at a time, so
+// that a corrupt size can't exhaust memory.
+func (fsys *FS) readDirRaw(dirIno *Inode) ([]dirEntry, error) {
+	if dirIno.Size > uint64(fsys.size()) {
+		return nil, fmt.Errorf("%w: directory %d: size %d exceeds the filesystem", ErrCorrupt, dirIno.Number, dirIno.Size)
+	}
+
+	r, err := fsys.contents(dirIno)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inline directories are already in memory.
+	if data, ok := r.(bytesReaderAt); ok {
+		return fsys.parseInlineDir(dirIno, data)
+	}
+
+	var entries []dirEntry
+	block := make([]byte, fsys.blockSize)
+	for off := int64(0); off < int64(dirIno.Size); off += fsys.blockSize {
+		data := block
+		if remaining := int64(dirIno.Size) - off; remaining < int64(len(data)) {
+			data = data[:remaining]
+		}
+
+		if _, err := r.ReadAt(data, off); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if entries, err = fsys.parseDirBlock(entries, data); err != nil {
+			return nil, fmt.Errorf("directory %d: %w", dirIno.Number, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// parseInlineDir parses a directory stored in its inode: the inode number of
+// the parent, followed by the entries.
+func (fsys *FS) parseInlineDir(dirIno *Inode, data []byte) ([]dirEntry, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("directory %d: truncated inline directory", dirIno.Number)
+	}
+
+	entries := []dirEntry{
+		{fsys: fsys, name: ".", inode: dirIno.Number, fileType: 2},
+		{fsys: fsys, name: "..", inode: binary.LittleEndian.Uint32(data), fileType: 2},
+	}
+
+	// The entries in i_block, and in the system.data extended attribute, are
+	// parsed separately (an entry can't span them).
+	blockEnd := len(dirIno.block)
+	if blockEnd > len(data) {
+		blockEnd = len(data)
+	}
+
+	var err error
+	for _, region := range [][]byte{data[4:blockEnd], data[blockEnd:]} {
+		if entries, err = fsys.parseDirBlock(entries, region); err != nil {
+			return nil, fmt.Errorf("directory %d: %w", dirIno.Number, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// parseDirBlock appends the entries of a block of a directory.
+func (fsys *FS) parseDirBlock(entries []dirEntry, block []byte) ([]dirEntry, error) {
+	le := binary.LittleEndian
+	hasFileType := fsys.sb.HasFeature(ext4.Filetype)
+
+	for off := 0; off+8 <= len(block); {
+		entry := block[off:]
+
+		recLen := getRecLen(entry, fsys.blockSize)
+		if recLen < 8 || recLen > len(entry) {
+			return nil, fmt.Errorf("%w: directory entry length %d", ErrCorrupt, recLen)
+		}
+
+		nameLen := int(entry[0x6])
+		var fileType uint8
+		if hasFileType {
+			fileType = entry[0x7]
+		} else {
+			nameLen |= int(entry[0x7]) << 8
+		}
+		if 8+nameLen > recLen {
+			return nil, fmt.Errorf("%w: directory entry name length %d", ErrCorrupt, nameLen)
+		}
+
+		// Unused space (and checksums) are stored in entries with an inode
+		// number of zero.
+		if number := le.Uint32(entry); number != 0 {
+			entries = append(entries, dirEntry{
+				fsys:     fsys,
+				name:     string(entry[8 : 8+nameLen]),
+				inode:    number,
+				fileType: fileType,
+			})
+		}
+
+		off += recLen
+	}
+
+	return entries, nil
+}
+
+// recLen returns the length of the record of a directory entry with a name
+// of the given length.
+func recLen(nameLen int) int {
+	return (8 + nameLen + 3) &^ 3
+}
+
+// getRecLen returns the record length of a directory entry, in a block of
+// the given size.
+func getRecLen(entry []byte, blockSize int64) int {
+	recLen := int(binary.LittleEndian.Uint16(entry[0x4:]))
+	// Record lengths of 64KiB blocks don't fit in 16 bits.
+	if blockSize >= 65536 && (recLen == 65535 || recLen == 0) {
+		return int(blockSize)
+	} else if blockSize >= 65536 {
+		return recLen&65532 | (recLen&3)<<16
+	}
+
+	return recLen
+}
+
+// putRecLen stores the record length of a directory entry (lengths of 64KiB
+// don't fit in 16 bits).
+func putRecLen(entry []byte, length int) {
+	if length == 65536 {
+		binary.LittleEndian.PutUint16(entry[0x4:], 65535)
+		return
+	}
+	binary.LittleEndian.PutUint16(entry[0x4:], uint16(length&65532|(length>>16)&3))
+}
+
+// encodeDirBlock stores directory entries in a block, the last of them
+// spanning the rest of the block (before the checksum tail, if tail is set).
+// Returns false if the entries don't fit.
+func encodeDirBlock(block []byte, entries []dirEntry, hasFileType, tail bool) bool {
+	le := binary.LittleEndian
+
+	end := len(block)
+	if tail {
+		end -= dirTailSize
+	}
+
+	clear(block)
+	off := 0
+	for i, e := range entries {
+		length := recLen(len(e.name))
+		if i == len(entries)-1 {
+			length = end - off
+		}
+		if off+recLen(len(e.name)) > end || len(e.name) > 255 {
+			return false
+		}
+
+		entry := block[off:]
+		le.PutUint32(entry, e.inode)
+		putRecLen(entry, length)
+		entry[0x6] = uint8(len(e.name))
+		if hasFileType {
+			entry[0x7] = e.fileType
+		}
+		copy(entry[8:], e.name)
+
+		off += length
+	}
+	if len(entries) == 0 {
+		// An empty block is a single unused entry.
+		putRecLen(block, end)
+	}
+
+	if tail {
+		putRecLen(block[end:], dirTailSize)
+		block[end+0x7] = dirTailFileType
+	}
+
+	return true
+}
+
+// hasDirTail returns true if a directory block ends with a checksum tail.
+func hasDirTail(block []byte) bool {
+	tail := block[len(block)-dirTailSize:]
+	return binary.LittleEndian.Uint32(tail) == 0 && binary.LittleEndian.Uint16(tail[0x4:]) == dirTailSize &&
+		tail[0x6] == 0 && tail[0x7] == dirTailFileType
+}
+
+// setDirBlockChecksum stores the checksum of a directory block in its tail,
+// given the checksum seed of the directory inode.
+func setDirBlockChecksum(block []byte, inodeSeed uint32) {
+	end := len(block) - dirTailSize
+	binary.LittleEndian.PutUint32(block[end+0x8:], crc32c(inodeSeed, block[:end]))
+}
+
+// dir is an open directory. It implements fs.ReadDirFile.
+type dir struct {
+	info    *fileInfo
+	entries []dirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory (or all the remaining
+// entries, if n <= 0), in the order they are stored.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := len(d.entries) - d.offset
+	if n > 0 && remaining == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > remaining {
+		n = remaining
+	}
+
+	dirEntries := make([]fs.DirEntry, n)
+	for i := range dirEntries {
+		dirEntries[i] = &d.entries[d.offset+i]
+	}
+	d.offset += n
+
+	return dirEntries, nil
+}
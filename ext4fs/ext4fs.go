@@ -0,0 +1,476 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ext4fs reads ext2, ext3 and ext4 filesystem images natively, so
+// that Go programs can walk, glob and read their files with the standard
+// io/fs interfaces, without mounting the image or running e2fsprogs.
+//
+// The filesystem is read as is: transactions still in the journal (if the
+// filesystem wasn't cleanly unmounted) are not replayed. Use JournalState to
+// detect filesystems whose journal needs recovery, and PreCheck to quickly
+// detect filesystems that need a full check with e2fsck.
+//
+// Basic filesystems can also be created natively, with Format (this is
+// experimental), files can be added to (or replaced in) existing
+// filesystems with a Writer, and unmounted filesystems can be resized with
+// Resize.
+//
+// The blocks changed between two versions of an image can be found with
+// Delta (or DeltaSince, given a Snapshot of the previous version), eg. to
+// upload or replicate images incrementally.
+package ext4fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/ext4"
+)
+
+// rootInode is the inode number of the root directory.
+const rootInode = 2
+
+// maxSymlinks is the maximum number of symbolic links followed when resolving
+// a path (as with Linux).
+const maxSymlinks = 40
+
+// unsupportedFeatures are incompatible features that change the layout of the
+// filesystem in ways this package doesn't understand.
+var unsupportedFeatures = []string{"compression", "journal_dev", "dirdata"}
+
+var (
+	// ErrUnsupported is returned when a filesystem (or file) uses a feature
+	// that can't be read by this package.
+	ErrUnsupported = errors.New("unsupported filesystem feature")
+	// ErrEncrypted is returned when reading an encrypted file or directory.
+	ErrEncrypted = errors.New("file is encrypted")
+	// ErrCorrupt is returned when the metadata of a file (eg. its size, or a
+	// directory entry) is inconsistent.
+	ErrCorrupt = errors.New("corrupt filesystem metadata")
+	// errNotDir is returned when a path component isn't a directory.
+	errNotDir = errors.New("not a directory")
+)
+
+// FS is a read-only ext4 filesystem. It implements fs.FS, fs.ReadDirFS,
+// fs.ReadFileFS and fs.StatFS, and is safe for concurrent use (provided the
+// underlying reader is).
+type FS struct {
+	r         io.ReaderAt
+	sb        *ext4.SuperblockInfo
+	blockSize int64
+	// descs are the group descriptors.
+	descs []groupDesc
+	// descSize is the size of the group descriptors.
+	descSize int
+	// descOffsets are the locations of the group descriptors (in bytes).
+	descOffsets []int64
+	// superGroups are the block groups holding a copy of the superblock.
+	superGroups map[uint64]bool
+}
+
+// Open opens the filesystem stored in r (eg. an *os.File of a device or image
+// file).
+func Open(r io.ReaderAt) (*FS, error) {
+	sb, err := ext4.ReadSuperblockFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, feature := range sb.Features {
+		if slices.Contains(unsupportedFeatures, feature) || strings.HasPrefix(feature, "FEATURE_I") {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupported, feature)
+		}
+	}
+
+	// Make sure the filesystem fits in r, before allocating anything sized
+	// by the superblock.
+	if sb.BlockCount > math.MaxInt64/uint64(sb.BlockSize) {
+		return nil, fmt.Errorf("%w: invalid block count %d", ext4.ErrCorruptSuperblock, sb.BlockCount)
+	}
+	if _, err := r.ReadAt(make([]byte, 1), int64(sb.BlockCount)*int64(sb.BlockSize)-1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %d blocks don't fit in the image", ext4.ErrCorruptSuperblock, sb.BlockCount)
+		}
+		return nil, fmt.Errorf("failed to read last block: %w", err)
+	}
+
+	fsys := &FS{
+		r:         r,
+		sb:        sb,
+		blockSize: int64(sb.BlockSize),
+	}
+
+	if err := fsys.readGroupDescriptors(); err != nil {
+		return nil, err
+	}
+
+	return fsys, nil
+}
+
+// Superblock returns the superblock of the filesystem (see
+// ext4.ReadSuperblockFrom).
+func (fsys *FS) Superblock() ext4.SuperblockInfo {
+	return *fsys.sb
+}
+
+// groupCount returns the number of block groups.
+func (fsys *FS) groupCount() uint64 {
+	return (fsys.sb.BlockCount - fsys.sb.FirstBlock + fsys.sb.BlocksPerGroup - 1) / fsys.sb.BlocksPerGroup
+}
+
+// readGroupDescriptors reads the group descriptors.
+func (fsys *FS) readGroupDescriptors() error {
+	descSize := 32
+	if fsys.sb.HasFeature(ext4.Has64Bit) {
+		descSize = fsys.sb.DescriptorSize
+	}
+	if descSize < 32 || int64(descSize) > fsys.blockSize {
+		return fmt.Errorf("%w: invalid group descriptor size %d", ext4.ErrCorruptSuperblock, descSize)
+	}
+	descPerBlock := uint64(fsys.blockSize) / uint64(descSize)
+
+	// Groups holding a superblock (their descriptors follow it, with
+	// meta_bg).
+	superGroups := map[uint64]bool{0: true}
+	for _, block := range fsys.sb.BackupSuperblocks() {
+		superGroups[(block-fsys.sb.FirstBlock)/fsys.sb.BlocksPerGroup] = true
+	}
+
+	groups := fsys.groupCount()
+	fsys.descs = make([]groupDesc, groups)
+	fsys.descSize = descSize
+	fsys.descOffsets = make([]int64, groups)
+	fsys.superGroups = superGroups
+
+	for group := uint64(0); group < groups; group++ {
+		// Without meta_bg, the descriptors are stored contiguously after the
+		// primary superblock.
+		block := fsys.sb.FirstBlock + 1 + group/descPerBlock
+		if metaGroup := group / descPerBlock; fsys.sb.HasFeature(ext4.MetaBG) && metaGroup >= fsys.sb.FirstMetaBlockGroup {
+			// With meta_bg, each group of descriptors is stored in the first
+			// block group it describes.
+			first := metaGroup * descPerBlock
+			block = fsys.sb.FirstBlock + first*fsys.sb.BlocksPerGroup
+			if superGroups[first] {
+				block++
+			}
+		}
+
+		offset := int64(block)*fsys.blockSize + int64(group%descPerBlock)*int64(descSize)
+		fsys.descOffsets[group] = offset
+		fsys.descs[group] = make(groupDesc, descSize)
+		if _, err := fsys.r.ReadAt(fsys.descs[group], offset); err != nil {
+			return fmt.Errorf("failed to read group descriptor %d: %w", group, err)
+		}
+	}
+
+	return nil
+}
+
+// Open opens the named file (following symbolic links).
+func (fsys *FS) Open(name string) (fs.File, error) {
+	ino, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return fsys.openInode(path.Base(name), ino)
+}
+
+// openInode returns an open file (or directory) for an inode.
+func (fsys *FS) openInode(name string, ino *Inode) (fs.File, error) {
+	info := &fileInfo{name: name, inode: ino}
+
+	if ino.IsDir() {
+		entries, err := fsys.readDir(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &dir{info: info, entries: entries}, nil
+	}
+
+	r, err := fsys.contents(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &File{info: info, SectionReader: io.NewSectionReader(r, 0, int64(ino.Size))}, nil
+}
+
+// OpenInode opens the contents of a file (or symbolic link) by its inode (eg.
+// as passed to a WalkFunc), without resolving its path.
+func (fsys *FS) OpenInode(ino *Inode) (*File, error) {
+	name := fmt.Sprintf("<inode %d>", ino.Number)
+	if ino.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+
+	f, err := fsys.openInode(name, ino)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.(*File), nil
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ino, err := fsys.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !ino.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+
+	entries, err := fsys.readDir(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i := range entries {
+		dirEntries[i] = &entries[i]
+	}
+	slices.SortFunc(dirEntries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return dirEntries, nil
+}
+
+// ReadFile reads the contents of the named file.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	ino, err := fsys.lookup("readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if ino.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	// The size is only trusted as far as it's plausible, before allocating a
+	// buffer for the contents.
+	if ino.Size > uint64(fsys.size()) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fmt.Errorf("%w: size %d exceeds the filesystem", ErrCorrupt, ino.Size)}
+	}
+
+	r, err := fsys.contents(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+
+	data := make([]byte, ino.Size)
+	if _, err := r.ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+
+	return data, nil
+}
+
+// Stat returns information about the named file (following symbolic links).
+// The Sys method of the returned fs.FileInfo returns its *Inode.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	ino, err := fsys.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), inode: ino}, nil
+}
+
+// Lstat is like Stat, but doesn't follow a symbolic link at the end of the
+// path.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	ino, err := fsys.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{name: path.Base(name), inode: ino}, nil
+}
+
+// ReadLink returns the target of the named symbolic link.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	ino, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if ino.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := fsys.readLink(ino)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+// lookup resolves a path to its inode. Symbolic links are followed, except
+// for the last element of the path, unless follow is set. Absolute link
+// targets are resolved relative to the root of the filesystem.
+func (fsys *FS) lookup(op, name string, follow bool) (*Inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	cur, err := fsys.inode(rootInode)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	var elems []string
+	if name != "." {
+		elems = strings.Split(name, "/")
+	}
+
+	links := 0
+	for len(elems) > 0 {
+		elem := elems[0]
+		elems = elems[1:]
+
+		if !cur.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errNotDir}
+		}
+
+		number, err := fsys.findEntry(cur, elem)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		next, err := fsys.inode(number)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		if next.Mode()&fs.ModeSymlink == 0 || (len(elems) == 0 && !follow) {
+			cur = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+
+		target, err := fsys.readLink(next)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		if strings.HasPrefix(target, "/") {
+			if cur, err = fsys.inode(rootInode); err != nil {
+				return nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+		}
+
+		var targetElems []string
+		for _, elem := range strings.Split(target, "/") {
+			if elem != "" && elem != "." {
+				targetElems = append(targetElems, elem)
+			}
+		}
+		elems = append(targetElems, elems...)
+	}
+
+	return cur, nil
+}
+
+// findEntry returns the inode number of the named entry of a directory.
+func (fsys *FS) findEntry(dirIno *Inode, name string) (uint32, error) {
+	entries, err := fsys.readDirRaw(dirIno)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if entry.name == name {
+			return entry.inode, nil
+		}
+	}
+
+	// Casefolded directories match names case-insensitively.
+	if dirIno.Flags&flagCasefold != 0 {
+		for _, entry := range entries {
+			if strings.EqualFold(entry.name, name) {
+				return entry.inode, nil
+			}
+		}
+	}
+
+	return 0, fs.ErrNotExist
+}
+
+// size returns the size of the filesystem (in bytes), which Open checks fits
+// in an int64.
+func (fsys *FS) size() int64 {
+	return int64(fsys.sb.BlockCount) * fsys.blockSize
+}
+
+// readLink returns the target of a symbolic link.
+func (fsys *FS) readLink(ino *Inode) (string, error) {
+	// Short targets are stored in the inode itself.
+	if ino.Size < uint64(len(ino.block)) && ino.Flags&(flagExtents|flagInlineData) == 0 {
+		return string(ino.block[:ino.Size]), nil
+	}
+
+	// Targets are limited to a single block.
+	if ino.Size > uint64(fsys.blockSize) {
+		return "", fmt.Errorf("%w: inode %d: symbolic link target of %d bytes", ErrCorrupt, ino.Number, ino.Size)
+	}
+
+	r, err := fsys.contents(ino)
+	if err != nil {
+		return "", err
+	}
+
+	target := make([]byte, ino.Size)
+	if _, err := r.ReadAt(target, 0); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+// File is an open regular file (or other non-directory). Besides fs.File, it
+// implements io.ReaderAt and io.Seeker, so that files can be streamed out of
+// (or randomly accessed within) an image. Holes in sparse files read as zeros.
+type File struct {
+	*io.SectionReader
+	info *fileInfo
+}
+
+// Stat returns information about the file. The Sys method of the returned
+// fs.FileInfo returns its *Inode.
+func (f *File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Close closes the file (this is a no-op, the underlying reader is owned by
+// the caller of Open).
+func (f *File) Close() error {
+	return nil
+}
@@ -0,0 +1,1035 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4fs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	blockSize := 4096
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4":        {},
+		"ext2":        {Type: ext4.Ext2},
+		"inline_data": {InlineData: true},
+		"meta_bg":     {FeatureSet: ext4.FeatureSet{ext4.MetaBG: true, ext4.ResizeInode: false}},
+		"4k_blocks":   {BlockSize: &blockSize},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.Device = filepath.Join(t.TempDir(), "ext4.img")
+			opts.Size = 64 * ext4.MiB
+			opts.RootDirectory = rootDir
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			fsys := openImage(t, opts.Device)
+
+			require.NoError(t, fstest.TestFS(fsys, "hello.txt", "empty", "dir/nested/deep.txt", "big.bin", "sparse.bin"))
+
+			// The contents match the source tree.
+			err = fs.WalkDir(os.DirFS(rootDir), ".", func(path string, d fs.DirEntry, err error) error {
+				require.NoError(t, err)
+
+				info, err := fsys.Lstat(path)
+				require.NoError(t, err)
+				require.Equal(t, d.Type(), info.Mode().Type(), path)
+
+				switch {
+				case d.Type().IsRegular():
+					expected, err := os.ReadFile(filepath.Join(rootDir, path))
+					require.NoError(t, err)
+
+					data, err := fs.ReadFile(fsys, path)
+					require.NoError(t, err)
+					require.True(t, bytes.Equal(expected, data), path)
+				case d.Type()&fs.ModeSymlink != 0:
+					expected, err := os.Readlink(filepath.Join(rootDir, path))
+					require.NoError(t, err)
+
+					target, err := fsys.ReadLink(path)
+					require.NoError(t, err)
+					require.Equal(t, expected, target)
+				}
+
+				return nil
+			})
+			require.NoError(t, err)
+
+			t.Log("Following symbolic links")
+
+			data, err := fsys.ReadFile("link")
+			require.NoError(t, err)
+			require.Equal(t, "Hello, world!\n", string(data))
+
+			data, err = fsys.ReadFile("dir/long-link/deep.txt")
+			require.NoError(t, err)
+			require.Equal(t, "deep\n", string(data))
+
+			info, err := fsys.Stat("dir/absolute-link")
+			require.NoError(t, err)
+			require.True(t, info.IsDir())
+
+			matches, err := fs.Glob(fsys, "dir/*/*.txt")
+			require.NoError(t, err)
+			require.Equal(t, []string{"dir/absolute-link/deep.txt", "dir/long-link/deep.txt", "dir/nested/deep.txt"}, matches)
+
+			t.Log("Reading inode metadata")
+
+			info, err = fsys.Stat("hello.txt")
+			require.NoError(t, err)
+			require.Equal(t, fs.FileMode(0o640), info.Mode())
+
+			ino, ok := info.Sys().(*ext4fs.Inode)
+			require.True(t, ok)
+			require.Equal(t, uint32(os.Getuid()), ino.UID)
+			require.EqualValues(t, 1, ino.Links)
+
+			_, err = fsys.Open("missing")
+			require.ErrorIs(t, err, fs.ErrNotExist)
+
+			_, err = fsys.Open("/hello.txt")
+			require.ErrorIs(t, err, fs.ErrInvalid)
+
+			_, err = fsys.Open("hello.txt/child")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	expected, err := os.ReadFile(filepath.Join(rootDir, "sparse.bin"))
+	require.NoError(t, err)
+
+	for _, typ := range []ext4.FilesystemType{ext4.Ext2, ext4.Ext4} {
+		t.Run(string(typ), func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "ext4.img")
+			_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+				Device:        imagePath,
+				Size:          64 * ext4.MiB,
+				Type:          typ,
+				RootDirectory: rootDir,
+			})
+			require.NoError(t, err)
+
+			fsys := openImage(t, imagePath)
+
+			f, err := fsys.Open("sparse.bin")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			file, ok := f.(*ext4fs.File)
+			require.True(t, ok)
+
+			buf := make([]byte, 3)
+			_, err = file.ReadAt(buf, 4<<20)
+			require.NoError(t, err)
+			require.Equal(t, "end", string(buf))
+
+			// The hole reads as zeros.
+			_, err = file.ReadAt(buf, 1<<20)
+			require.NoError(t, err)
+			require.Equal(t, make([]byte, 3), buf)
+
+			_, err = file.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+
+			var data bytes.Buffer
+			_, err = io.Copy(&data, file)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(expected, data.Bytes()))
+
+			info, err := file.Stat()
+			require.NoError(t, err)
+
+			// Only the written blocks are allocated.
+			ino := info.Sys().(*ext4fs.Inode)
+			require.Less(t, ino.Blocks*512, uint64(1<<20))
+
+			t.Log("Opening files by inode")
+
+			err = fsys.Walk(func(path string, ino *ext4fs.Inode, err error) error {
+				require.NoError(t, err)
+
+				if !ino.Mode().IsRegular() {
+					return nil
+				}
+
+				f, err := fsys.OpenInode(ino)
+				require.NoError(t, err)
+
+				data, err := io.ReadAll(f)
+				require.NoError(t, err)
+				require.Len(t, data, int(ino.Size), path)
+
+				return f.Close()
+			})
+			require.NoError(t, err)
+
+			_, err = fsys.OpenInode(ino)
+			require.NoError(t, err)
+
+			root, err := fsys.Stat(".")
+			require.NoError(t, err)
+
+			_, err = fsys.OpenInode(root.Sys().(*ext4fs.Inode))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        imagePath,
+		Size:          64 * ext4.MiB,
+		RootDirectory: rootDir,
+	})
+	require.NoError(t, err)
+
+	// Index the directories with hashed B-trees.
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device:              imagePath,
+		Force:               true,
+		Preen:               true,
+		OptimizeDirectories: true,
+	})
+	require.NoError(t, err)
+
+	fsys := openImage(t, imagePath)
+
+	var expected []string
+	err = fs.WalkDir(os.DirFS(rootDir), ".", func(path string, d fs.DirEntry, err error) error {
+		expected = append(expected, path)
+		return err
+	})
+	require.NoError(t, err)
+
+	inodes := make(map[string]*ext4fs.Inode)
+	var paths []string
+	err = fsys.Walk(func(path string, ino *ext4fs.Inode, err error) error {
+		require.NoError(t, err)
+
+		paths = append(paths, path)
+		inodes[path] = ino
+
+		// Skip the contents of lost+found, which isn't in the source tree.
+		if path == "lost+found" {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	expected = append(expected, "lost+found")
+	slices.Sort(expected)
+	slices.Sort(paths)
+	require.Equal(t, expected, paths)
+
+	require.True(t, inodes["many"].IsIndexed())
+	require.False(t, inodes["dir"].IsIndexed())
+	require.EqualValues(t, 2, inodes["."].Number)
+	require.NotZero(t, inodes["big.bin"].Blocks)
+
+	t.Log("Stopping the walk early")
+
+	var visited int
+	err = fsys.Walk(func(path string, ino *ext4fs.Inode, err error) error {
+		visited++
+		return fs.SkipAll
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, visited)
+}
+
+func TestOpenNotExt4(t *testing.T) {
+	_, err := ext4fs.Open(bytes.NewReader(make([]byte, 1<<20)))
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+}
+
+// createTestTree creates a directory tree to populate test images with.
+func TestFormat(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	for name, tc := range map[string]struct {
+		size ext4.Size
+		opts ext4fs.FormatOptions
+	}{
+		"4k_blocks":  {size: 64 * ext4.MiB},
+		"1k_blocks":  {size: 64 * ext4.MiB, opts: ext4fs.FormatOptions{BlockSize: 1024}},
+		"2k_blocks":  {size: 64 * ext4.MiB, opts: ext4fs.FormatOptions{BlockSize: 2048}},
+		"tiny":       {size: 2 * ext4.MiB},
+		"many_group": {size: 1 * ext4.GiB, opts: ext4fs.FormatOptions{BlockSize: 1024}},
+		"odd_size":   {size: 300*ext4.MiB + 12345},
+	} {
+		t.Run(name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+			opts := tc.opts
+			opts.Label = "native"
+			opts.RootOwner = &ext4.RootOwner{UID: 1000, GID: 1000}
+
+			sb, err := ext4fs.FormatFile(imagePath, int64(tc.size), opts)
+			require.NoError(t, err)
+			require.Equal(t, "native", sb.Label)
+
+			result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+			require.NoError(t, err)
+			require.True(t, result.Status.OK(), result.Problems)
+
+			expected, err := c.ReadSuperblock(ctx, imagePath)
+			require.NoError(t, err)
+			require.Empty(t, ext4.Diff(*expected, *sb))
+
+			for _, feature := range []ext4.Feature{ext4.Extent, ext4.Has64Bit, ext4.MetadataCsum} {
+				require.True(t, sb.HasFeature(feature), feature)
+			}
+
+			fsys := openImage(t, imagePath)
+
+			entries, err := fsys.ReadDir(".")
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			require.Equal(t, "lost+found", entries[0].Name())
+			require.True(t, entries[0].IsDir())
+
+			info, err := fsys.Stat(".")
+			require.NoError(t, err)
+			require.Equal(t, uint32(1000), info.Sys().(*ext4fs.Inode).UID)
+		})
+	}
+
+	t.Log("Formatting with invalid options")
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := ext4fs.FormatFile(imagePath, int64(64*ext4.MiB), ext4fs.FormatOptions{BlockSize: 8192})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = ext4fs.FormatFile(imagePath, int64(64*ext4.MiB), ext4fs.FormatOptions{Label: "a-very-long-volume-label"})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = ext4fs.FormatFile(imagePath, 16*1024, ext4fs.FormatOptions{})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	blockSize := 1024
+
+	for name, opts := range map[string]*ext4.CreateOptions{
+		"ext4":             {},
+		"1k_blocks":        {BlockSize: &blockSize},
+		"no_metadata_csum": {FeatureSet: ext4.FeatureSet{ext4.MetadataCsum: false, ext4.UninitBG: true}},
+		"native":           nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+			if opts != nil {
+				opts.Device = imagePath
+				opts.Size = 128 * ext4.MiB
+				opts.RootDirectory = rootDir
+
+				_, err := c.CreateFilesystem(ctx, *opts)
+				require.NoError(t, err)
+			} else {
+				_, err := ext4fs.FormatFile(imagePath, int64(128*ext4.MiB), ext4fs.FormatOptions{BlockSize: 1024})
+				require.NoError(t, err)
+			}
+
+			f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+			require.NoError(t, err)
+
+			w, err := ext4fs.OpenWriter(f, ext4fs.WriterOptions{})
+			require.NoError(t, err)
+
+			big := make([]byte, 48<<20)
+			for i := range big {
+				big[i] = byte(i * 7)
+			}
+
+			require.NoError(t, w.WriteFile("hello.txt", []byte("Goodbye, world!\n"), 0o600))
+			require.NoError(t, w.MkdirAll("a/b/c", 0o755))
+			require.NoError(t, w.WriteFile("a/b/c/big.bin", big, 0o644))
+			require.NoError(t, w.Symlink("../hello.txt", "a/short-link"))
+			require.NoError(t, w.Symlink(strings.Repeat("x/", 50)+"target", "a/long-link"))
+			require.NoError(t, w.Chown("a/b", 1000, 1000))
+
+			// Enough entries to grow the directory.
+			for i := 0; i < 200; i++ {
+				require.NoError(t, w.WriteFile(fmt.Sprintf("a/file-with-a-long-name-%03d", i), []byte(strconv.Itoa(i)), 0o644))
+			}
+
+			t.Log("Replacing files")
+
+			require.NoError(t, w.WriteFile("a/file-with-a-long-name-000", []byte("replaced"), 0o644))
+			require.NoError(t, w.Symlink("hello.txt", "a/file-with-a-long-name-001"))
+
+			t.Log("Invalid operations")
+
+			err = w.Mkdir("a/b", 0o755)
+			require.ErrorIs(t, err, fs.ErrExist)
+
+			err = w.WriteFile("a/b", nil, 0o644)
+			require.Error(t, err)
+
+			err = w.WriteFile("missing/file", nil, 0o644)
+			require.ErrorIs(t, err, fs.ErrNotExist)
+
+			err = w.WriteFile("too-big.bin", make([]byte, 256<<20), 0o644)
+			require.ErrorIs(t, err, ext4fs.ErrNoSpace)
+
+			require.NoError(t, f.Close())
+
+			result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+			require.NoError(t, err)
+			require.True(t, result.Status.OK(), result.Problems)
+
+			fsys := openImage(t, imagePath)
+
+			preCheck, err := fsys.PreCheck()
+			require.NoError(t, err)
+			require.Empty(t, preCheck.Problems)
+
+			data, err := fsys.ReadFile("hello.txt")
+			require.NoError(t, err)
+			require.Equal(t, "Goodbye, world!\n", string(data))
+
+			data, err = fsys.ReadFile("a/b/c/big.bin")
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(big, data))
+
+			data, err = fsys.ReadFile("a/short-link")
+			require.NoError(t, err)
+			require.Equal(t, "Goodbye, world!\n", string(data))
+
+			target, err := fsys.ReadLink("a/long-link")
+			require.NoError(t, err)
+			require.Equal(t, strings.Repeat("x/", 50)+"target", target)
+
+			data, err = fsys.ReadFile("a/file-with-a-long-name-000")
+			require.NoError(t, err)
+			require.Equal(t, "replaced", string(data))
+
+			data, err = fsys.ReadFile("a/file-with-a-long-name-199")
+			require.NoError(t, err)
+			require.Equal(t, "199", string(data))
+
+			entries, err := fsys.ReadDir("a")
+			require.NoError(t, err)
+			require.Len(t, entries, 203)
+
+			info, err := fsys.Lstat("a/file-with-a-long-name-001")
+			require.NoError(t, err)
+			require.Equal(t, fs.ModeSymlink, info.Mode().Type())
+
+			info, err = fsys.Stat("a/b")
+			require.NoError(t, err)
+			require.True(t, info.IsDir())
+			require.Equal(t, fs.FileMode(0o755), info.Mode().Perm())
+			require.Equal(t, uint32(1000), info.Sys().(*ext4fs.Inode).UID)
+		})
+	}
+}
+
+func TestJournalState(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Size: 64 * ext4.MiB})
+	require.NoError(t, err)
+
+	state, err := openImage(t, imagePath).JournalState()
+	require.NoError(t, err)
+	require.False(t, state.NeedsRecovery())
+
+	expected, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, expected.JournalBlocks, uint64(state.Blocks))
+	require.Equal(t, expected.JournalSequence, state.Sequence)
+	require.Zero(t, state.Start)
+
+	t.Log("Writing transactions to the journal")
+
+	blockData := filepath.Join(t.TempDir(), "blocks")
+	require.NoError(t, os.WriteFile(blockData, make([]byte, 8192), 0o644))
+
+	cmd := exec.Command("debugfs", "-w", "-f", "-", imagePath)
+	cmd.Stdin = strings.NewReader(strings.Join([]string{
+		"jo",
+		"jw -b 300,301 " + blockData,
+		"jc",
+	}, "\n"))
+	require.NoError(t, cmd.Run())
+
+	state, err = openImage(t, imagePath).JournalState()
+	require.NoError(t, err)
+	require.True(t, state.NeedsRecovery())
+
+	expected, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, expected.JournalStart, state.Start)
+	require.Equal(t, expected.JournalSequence, state.Sequence)
+	require.ElementsMatch(t, expected.JournalFeatures, state.Features)
+
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	_, err = ext4fs.OpenWriter(f, ext4fs.WriterOptions{})
+	require.ErrorIs(t, err, ext4fs.ErrUnsupported)
+
+	t.Log("Replaying the journal")
+
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Preen: true})
+	require.NoError(t, err)
+
+	state, err = openImage(t, imagePath).JournalState()
+	require.NoError(t, err)
+	require.False(t, state.NeedsRecovery())
+
+	t.Log("Filesystem without a journal")
+
+	imagePath = filepath.Join(t.TempDir(), "ext2.img")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Size: 64 * ext4.MiB, Type: ext4.Ext2})
+	require.NoError(t, err)
+
+	_, err = openImage(t, imagePath).JournalState()
+	require.ErrorIs(t, err, ext4fs.ErrNoJournal)
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	blockSize := 1024
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4":             {},
+		"1k_blocks":        {BlockSize: &blockSize},
+		"no_metadata_csum": {FeatureSet: ext4.FeatureSet{ext4.MetadataCsum: false, ext4.UninitBG: true}},
+		"ext2":             {Type: ext4.Ext2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.Device = filepath.Join(t.TempDir(), "ext4.img")
+			opts.Size = 256 * ext4.MiB
+			opts.RootDirectory = rootDir
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			sb, err := c.ReadSuperblock(ctx, opts.Device)
+			require.NoError(t, err)
+
+			expected, err := c.ListBlockGroups(ctx, opts.Device)
+			require.NoError(t, err)
+
+			fsys := openImage(t, opts.Device)
+
+			groups, err := fsys.GroupUsage()
+			require.NoError(t, err)
+			require.Len(t, groups, len(expected))
+
+			for i, group := range groups {
+				require.Equal(t, expected[i].Blocks, group.Blocks, i)
+				require.Equal(t, expected[i].FreeBlockCount, group.FreeBlocks, i)
+				require.Equal(t, expected[i].FreeInodeCount, group.FreeInodes, i)
+			}
+
+			free, err := fsys.FreeBlocks()
+			require.NoError(t, err)
+			require.Equal(t, sb.FreeBlocks, free)
+
+			used, err := fsys.UsedBlocks()
+			require.NoError(t, err)
+			require.Equal(t, sb.BlockCount-sb.FreeBlocks, used)
+
+			freeInodes, err := fsys.FreeInodes()
+			require.NoError(t, err)
+			require.Equal(t, sb.FreeInodes, freeInodes)
+
+			// The allocation map is the complement of the free blocks.
+			var allocated []ext4.Range
+			next := uint64(0)
+			for _, group := range expected {
+				for _, r := range group.FreeBlocks {
+					if r.Start > next {
+						if last := len(allocated) - 1; last >= 0 && allocated[last].End+1 == next {
+							allocated[last].End = r.Start - 1
+						} else {
+							allocated = append(allocated, ext4.Range{Start: next, End: r.Start - 1})
+						}
+					}
+					next = r.End + 1
+				}
+			}
+			if next < sb.BlockCount {
+				if last := len(allocated) - 1; last >= 0 && allocated[last].End+1 == next {
+					allocated[last].End = sb.BlockCount - 1
+				} else {
+					allocated = append(allocated, ext4.Range{Start: next, End: sb.BlockCount - 1})
+				}
+			}
+
+			ranges, err := fsys.AllocationMap()
+			require.NoError(t, err)
+			require.Equal(t, allocated, ranges)
+		})
+	}
+}
+
+func TestPreCheck(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	blockSize := 1024
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4":             {},
+		"1k_blocks":        {BlockSize: &blockSize},
+		"no_metadata_csum": {FeatureSet: ext4.FeatureSet{ext4.MetadataCsum: false, ext4.UninitBG: true}},
+		"ext2":             {Type: ext4.Ext2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.Device = filepath.Join(t.TempDir(), "ext4.img")
+			opts.Size = 256 * ext4.MiB
+			opts.RootDirectory = rootDir
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			result, err := openImage(t, opts.Device).PreCheck()
+			require.NoError(t, err)
+			require.False(t, result.NeedsCheck, result.Problems)
+			require.Empty(t, result.Problems)
+		})
+	}
+
+	for name, tc := range map[string]struct {
+		request string
+		problem string
+		// consistent is true if the filesystem is still consistent (so
+		// e2fsck -n reports no errors), but should be checked anyway.
+		consistent bool
+	}{
+		"not_clean":           {"ssv state 0", "not cleanly unmounted", true},
+		"group_free_blocks":   {"set_bg 1 free_blocks_count 5", "Free blocks count wrong for group #1", false},
+		"group_free_inodes":   {"set_bg 0 free_inodes_count 5", "Free inodes count wrong for group #0", false},
+		"group_checksum":      {"set_bg 1 checksum 0x1234", "descriptor checksums are invalid (group 1)", false},
+		"inode_mode":          {"sif /hello.txt mode 0170640", "has invalid mode", false},
+		"inode_links":         {"sif /hello.txt links_count 0", "is in use, but has a zero link count", false},
+		"inode_checksum":      {"sif /hello.txt checksum 0x1234", "checksum does not match inode", false},
+		"inode_extent_header": {"sif /hello.txt block[0] 0", "has corrupt extent header", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+			_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Size: 64 * ext4.MiB, RootDirectory: rootDir})
+			require.NoError(t, err)
+
+			out, err := exec.Command("debugfs", "-w", "-R", tc.request, imagePath).CombinedOutput()
+			require.NoError(t, err, string(out))
+
+			result, err := openImage(t, imagePath).PreCheck()
+			require.NoError(t, err)
+			require.True(t, result.NeedsCheck)
+
+			var descriptions []string
+			for _, problem := range result.Problems {
+				descriptions = append(descriptions, problem.Description)
+			}
+			require.Condition(t, func() bool {
+				return slices.ContainsFunc(descriptions, func(description string) bool {
+					return strings.Contains(description, tc.problem)
+				})
+			}, descriptions)
+
+			if tc.consistent {
+				return
+			}
+
+			// e2fsck agrees the filesystem needs repair.
+			_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+			var checkErr *ext4.CheckError
+			require.ErrorAs(t, err, &checkErr)
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	blockSize, largeBlockSize := 1024, 4096
+
+	for name, tc := range map[string]struct {
+		opts ext4.CreateOptions
+		size ext4.Size
+	}{
+		"ext4":             {size: 1 * ext4.GiB},
+		"1k_blocks":        {opts: ext4.CreateOptions{BlockSize: &blockSize}, size: 100 * ext4.MiB},
+		"4k_blocks":        {opts: ext4.CreateOptions{BlockSize: &largeBlockSize}, size: 1 * ext4.GiB},
+		"no_metadata_csum": {opts: ext4.CreateOptions{FeatureSet: ext4.FeatureSet{ext4.MetadataCsum: false, ext4.UninitBG: true}}, size: 1 * ext4.GiB},
+		"ext2":             {opts: ext4.CreateOptions{Type: ext4.Ext2}, size: 1 * ext4.GiB},
+		"no_flex_bg":       {opts: ext4.CreateOptions{FeatureSet: ext4.FeatureSet{ext4.FlexBG: false}}, size: 1 * ext4.GiB},
+	} {
+		t.Run(name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+			opts := tc.opts
+			opts.Device = imagePath
+			opts.Size = 64 * ext4.MiB
+			opts.RootDirectory = rootDir
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			original, err := c.ReadSuperblock(ctx, imagePath)
+			require.NoError(t, err)
+
+			check := func(blockCount uint64) {
+				t.Helper()
+
+				result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+				require.NoError(t, err)
+				require.True(t, result.Status.OK(), result.Problems)
+
+				sb, err := c.ReadSuperblock(ctx, imagePath)
+				require.NoError(t, err)
+				require.Equal(t, blockCount, sb.BlockCount)
+
+				fsys := openImage(t, imagePath)
+
+				free, err := fsys.FreeBlocks()
+				require.NoError(t, err)
+				require.Equal(t, sb.FreeBlocks, free)
+
+				data, err := fsys.ReadFile("hello.txt")
+				require.NoError(t, err)
+				require.Equal(t, "Hello, world!\n", string(data))
+			}
+
+			t.Log("Growing the filesystem")
+
+			result, err := ext4fs.ResizeFile(imagePath, int64(tc.size))
+			require.NoError(t, err)
+			require.Equal(t, original.BlockCount, result.OldBlockCount)
+			require.Equal(t, uint64(tc.size)/uint64(original.BlockSize), result.NewBlockCount)
+			require.Equal(t, original.BlockSize, result.BlockSize)
+
+			check(result.NewBlockCount)
+
+			info, err := os.Stat(imagePath)
+			require.NoError(t, err)
+			require.Equal(t, int64(tc.size), info.Size())
+
+			t.Log("Shrinking the filesystem")
+
+			result, err = ext4fs.ResizeFile(imagePath, int64(64*ext4.MiB))
+			require.NoError(t, err)
+			require.Equal(t, original.BlockCount, result.NewBlockCount)
+
+			check(original.BlockCount)
+
+			t.Log("Shrinking the filesystem below the space in use")
+
+			// The last block of big.bin (1MiB).
+			out, err := exec.Command("debugfs", "-R", fmt.Sprintf("bmap /big.bin %d", (1<<20)/original.BlockSize-1), imagePath).Output()
+			require.NoError(t, err)
+			block, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+			require.NoError(t, err)
+
+			_, err = ext4fs.ResizeFile(imagePath, (block+1)*int64(original.BlockSize))
+			require.ErrorIs(t, err, ext4fs.ErrShrinkInUse)
+
+			check(original.BlockCount)
+		})
+	}
+
+	t.Run("too many groups", func(t *testing.T) {
+		imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+		_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Size: 64 * ext4.MiB, BlockSize: &blockSize})
+		require.NoError(t, err)
+
+		_, err = ext4fs.ResizeFile(imagePath, int64(64*ext4.GiB))
+		require.ErrorIs(t, err, ext4fs.ErrUnsupported)
+
+		info, err := os.Stat(imagePath)
+		require.NoError(t, err)
+		require.Equal(t, int64(64*ext4.MiB), info.Size())
+	})
+
+	t.Run("needs check", func(t *testing.T) {
+		imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+		_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Size: 64 * ext4.MiB})
+		require.NoError(t, err)
+
+		require.NoError(t, exec.Command("debugfs", "-w", "-R", "ssv state 0", imagePath).Run())
+
+		_, err = ext4fs.ResizeFile(imagePath, int64(128*ext4.MiB))
+		require.ErrorIs(t, err, ext4fs.ErrNeedsCheck)
+	})
+}
+
+func TestDelta(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	blockSize := 4096
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4":      {},
+		"4k_blocks": {BlockSize: &blockSize},
+	} {
+		t.Run(name, func(t *testing.T) {
+			prevPath := filepath.Join(t.TempDir(), "prev.img")
+
+			opts.Device = prevPath
+			opts.Size = 64 * ext4.MiB
+			opts.RootDirectory = rootDir
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			prev := openImage(t, prevPath)
+
+			snap, err := prev.Snapshot()
+			require.NoError(t, err)
+
+			d, err := prev.Delta(prev)
+			require.NoError(t, err)
+			require.Empty(t, d.Changed)
+			require.Empty(t, d.Freed)
+
+			t.Log("Modifying a copy of the image")
+
+			imagePath := filepath.Join(t.TempDir(), "ext4.img")
+			copyFile(t, prevPath, imagePath)
+
+			f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+			require.NoError(t, err)
+
+			w, err := ext4fs.OpenWriter(f, ext4fs.WriterOptions{})
+			require.NoError(t, err)
+
+			data := make([]byte, 4<<20)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+
+			require.NoError(t, w.WriteFile("new.bin", data, 0o644))
+			require.NoError(t, w.WriteFile("big.bin", []byte("small\n"), 0o644))
+			require.NoError(t, f.Close())
+
+			_, err = ext4fs.ResizeFile(imagePath, int64(96*ext4.MiB))
+			require.NoError(t, err)
+
+			fsys := openImage(t, imagePath)
+
+			d, err = fsys.Delta(prev)
+			require.NoError(t, err)
+			require.Equal(t, fsys.Superblock().BlockCount, d.BlockCount)
+			require.NotEmpty(t, d.Freed)
+			require.Less(t, d.ChangedBlocks(), fsys.Superblock().BlockCount-fsys.Superblock().FreeBlocks)
+
+			since, err := fsys.DeltaSince(snap)
+			require.NoError(t, err)
+			require.Equal(t, d, since)
+
+			t.Log("Applying the delta")
+
+			appliedPath := filepath.Join(t.TempDir(), "applied.img")
+			copyFile(t, prevPath, appliedPath)
+
+			src, err := os.Open(imagePath)
+			require.NoError(t, err)
+			defer src.Close()
+
+			dst, err := os.OpenFile(appliedPath, os.O_RDWR, 0)
+			require.NoError(t, err)
+
+			require.NoError(t, dst.Truncate(int64(d.BlockCount)*int64(d.BlockSize)))
+			for _, r := range d.Changed {
+				off := int64(r.Start) * int64(d.BlockSize)
+				_, err := io.Copy(io.NewOffsetWriter(dst, off), io.NewSectionReader(src, off, int64(r.End-r.Start+1)*int64(d.BlockSize)))
+				require.NoError(t, err)
+			}
+			require.NoError(t, dst.Close())
+
+			result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: appliedPath, Force: true, NoFix: true})
+			require.NoError(t, err)
+			require.True(t, result.Status.OK(), result.Problems)
+
+			applied := openImage(t, appliedPath)
+
+			readData, err := applied.ReadFile("new.bin")
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, readData))
+
+			readData, err = applied.ReadFile("big.bin")
+			require.NoError(t, err)
+			require.Equal(t, "small\n", string(readData))
+
+			d, err = applied.Delta(fsys)
+			require.NoError(t, err)
+			require.Empty(t, d.Changed)
+			require.Empty(t, d.Freed)
+		})
+	}
+
+	t.Run("block size mismatch", func(t *testing.T) {
+		prevPath := filepath.Join(t.TempDir(), "prev.img")
+		_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: prevPath, Size: 64 * ext4.MiB})
+		require.NoError(t, err)
+
+		imagePath := filepath.Join(t.TempDir(), "ext4.img")
+		_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Size: 64 * ext4.MiB, BlockSize: &blockSize})
+		require.NoError(t, err)
+
+		snap, err := openImage(t, prevPath).Snapshot()
+		require.NoError(t, err)
+
+		_, err = openImage(t, imagePath).Delta(openImage(t, prevPath))
+		require.ErrorIs(t, err, ext4fs.ErrBlockSizeMismatch)
+
+		_, err = openImage(t, imagePath).DeltaSince(snap)
+		require.ErrorIs(t, err, ext4fs.ErrBlockSizeMismatch)
+	})
+}
+
+func createTestTree(t *testing.T) string {
+	rootDir := t.TempDir()
+
+	writeFile := func(name string, data []byte, perm os.FileMode) {
+		path := filepath.Join(rootDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, data, perm))
+		require.NoError(t, os.Chmod(path, perm))
+	}
+
+	writeFile("hello.txt", []byte("Hello, world!\n"), 0o640)
+	writeFile("empty", nil, 0o644)
+	writeFile("dir/nested/deep.txt", []byte("deep\n"), 0o644)
+	writeFile("big.bin", bytes.Repeat([]byte("0123456789abcdef"), 64<<10), 0o644)
+
+	f, err := os.Create(filepath.Join(rootDir, "sparse.bin"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("start"), 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("end"), 4<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for i := 0; i < 100; i++ {
+		writeFile(filepath.Join("many", strings.Repeat("x", i%50)+string(rune('a'+i%26))+string(rune('0'+i/26))), nil, 0o644)
+	}
+
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(rootDir, "link")))
+	require.NoError(t, os.Symlink(strings.Repeat("./", 40)+"nested", filepath.Join(rootDir, "dir", "long-link")))
+	require.NoError(t, os.Symlink("/dir/nested", filepath.Join(rootDir, "dir", "absolute-link")))
+
+	return rootDir
+}
+
+// openImage opens an image file with ext4fs.
+func openImage(t *testing.T, imagePath string) *ext4fs.FS {
+	f, err := os.Open(imagePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := ext4fs.Open(f)
+	require.NoError(t, err)
+
+	return fsys
+}
+
+// copyFile copies a file (eg. an image).
+func copyFile(t *testing.T, src, dst string) {
+	data, err := os.ReadFile(src)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(dst, data, 0o644))
+}
@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// extentMagic marks the header of each node of an extent tree.
+	extentMagic = 0xF30A
+	// maxExtentDepth is the maximum depth of an extent tree.
+	maxExtentDepth = 5
+	// uninitExtentLength is added to the length of extents that have been
+	// allocated but not written (they read as zeros).
+	uninitExtentLength = 32768
+)
+
+// extent maps a run of logical blocks of a file to physical blocks.
+type extent struct {
+	logical  uint32
+	physical uint64
+	length   uint32
+	// uninit extents are allocated, but read as zeros.
+	uninit bool
+}
+
+// extentReader reads the contents of a file stored in an extent tree.
+type extentReader struct {
+	fsys    *FS
+	size    int64
+	extents []extent
+	// nodes are the blocks of the extent tree (outside of the inode).
+	nodes []uint64
+}
+
+// extentReader reads the extent tree of an inode.
+func (fsys *FS) extentReader(ino *Inode) (*extentReader, error) {
+	r := &extentReader{fsys: fsys, size: int64(ino.Size)}
+	if err := r.readNode(ino.block[:], maxExtentDepth); err != nil {
+		return nil, fmt.Errorf("inode %d: %w", ino.Number, err)
+	}
+
+	sort.Slice(r.extents, func(i, j int) bool {
+		return r.extents[i].logical < r.extents[j].logical
+	})
+
+	return r, nil
+}
+
+// readNode appends the extents of a node of the extent tree (and its
+// children).
+func (r *extentReader) readNode(node []byte, maxDepth int) error {
+	le := binary.LittleEndian
+
+	if len(node) < 12 || le.Uint16(node) != extentMagic {
+		return fmt.Errorf("bad extent header")
+	}
+
+	entries := int(le.Uint16(node[0x2:]))
+	depth := int(le.Uint16(node[0x6:]))
+	if depth > maxDepth || 12+entries*12 > len(node) {
+		return fmt.Errorf("corrupt extent tree")
+	}
+
+	for i := 0; i < entries; i++ {
+		entry := node[12+i*12:]
+
+		if depth == 0 {
+			length := uint32(le.Uint16(entry[0x4:]))
+			e := extent{
+				logical:  le.Uint32(entry),
+				physical: uint64(le.Uint16(entry[0x6:]))<<32 | uint64(le.Uint32(entry[0x8:])),
+				length:   length,
+			}
+			if length > uninitExtentLength {
+				e.length -= uninitExtentLength
+				e.uninit = true
+			}
+			r.extents = append(r.extents, e)
+			continue
+		}
+
+		child := uint64(le.Uint32(entry[0x4:])) | uint64(le.Uint16(entry[0x8:]))<<32
+		r.nodes = append(r.nodes, child)
+
+		buf := make([]byte, r.fsys.blockSize)
+		if _, err := r.fsys.r.ReadAt(buf, int64(child)*r.fsys.blockSize); err != nil {
+			return fmt.Errorf("failed to read extent tree block %d: %w", child, err)
+		}
+
+		if err := r.readNode(buf, depth-1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt. Holes (and uninitialized extents) read as
+// zeros.
+func (r *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if remaining := r.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		block := uint32(pos / r.fsys.blockSize)
+		blockOffset := pos % r.fsys.blockSize
+
+		// Find the last extent starting at or before the block.
+		i := sort.Search(len(r.extents), func(i int) bool {
+			return r.extents[i].logical > block
+		}) - 1
+
+		if i < 0 || block >= r.extents[i].logical+r.extents[i].length || r.extents[i].uninit {
+			// Zero fill until the next extent.
+			end := int64(len(p))
+			if i+1 < len(r.extents) {
+				if next := int64(r.extents[i+1].logical)*r.fsys.blockSize - off; next < end {
+					end = next
+				}
+			}
+			if i >= 0 && r.extents[i].uninit && block < r.extents[i].logical+r.extents[i].length {
+				if extentEnd := int64(r.extents[i].logical+r.extents[i].length)*r.fsys.blockSize - off; extentEnd < end {
+					end = extentEnd
+				}
+			}
+
+			clear(p[n:end])
+			n = int(end)
+			continue
+		}
+
+		e := r.extents[i]
+		physical := int64(e.physical+uint64(block-e.logical))*r.fsys.blockSize + blockOffset
+		length := int64(e.logical+e.length)*r.fsys.blockSize - pos
+		if length > int64(len(p)-n) {
+			length = int64(len(p) - n)
+		}
+
+		if _, err := r.fsys.r.ReadAt(p[n:n+int(length)], physical); err != nil {
+			return n, fmt.Errorf("failed to read block %d: %w", e.physical+uint64(block-e.logical), err)
+		}
+		n += int(length)
+	}
+
+	return n, eof
+}
+
+// encodeExtentLeaf stores extents in a leaf node of an extent tree (eg. the
+// i_block field of an inode, which has room for four). Returns false if the
+// extents don't fit.
+func encodeExtentLeaf(node []byte, extents []extent) bool {
+	le := binary.LittleEndian
+
+	maxEntries := (len(node) - 12) / 12
+	if len(extents) > maxEntries {
+		return false
+	}
+
+	clear(node)
+	le.PutUint16(node[0x0:], extentMagic)
+	le.PutUint16(node[0x2:], uint16(len(extents)))
+	le.PutUint16(node[0x4:], uint16(maxEntries))
+
+	for i, e := range extents {
+		entry := node[12+i*12:]
+
+		length := e.length
+		if e.uninit {
+			length += uninitExtentLength
+		}
+
+		le.PutUint32(entry[0x0:], e.logical)
+		le.PutUint16(entry[0x4:], uint16(length))
+		le.PutUint16(entry[0x6:], uint16(e.physical>>32))
+		le.PutUint32(entry[0x8:], uint32(e.physical))
+	}
+
+	return true
+}
+
+// encodeExtentIndex stores the children of an index node of an extent tree
+// (as extents, of which only the logical and physical block numbers are
+// used). Returns false if the children don't fit.
+func encodeExtentIndex(node []byte, depth int, children []extent) bool {
+	le := binary.LittleEndian
+
+	maxEntries := (len(node) - 12) / 12
+	if len(children) > maxEntries {
+		return false
+	}
+
+	clear(node)
+	le.PutUint16(node[0x0:], extentMagic)
+	le.PutUint16(node[0x2:], uint16(len(children)))
+	le.PutUint16(node[0x4:], uint16(maxEntries))
+	le.PutUint16(node[0x6:], uint16(depth))
+
+	for i, child := range children {
+		entry := node[12+i*12:]
+		le.PutUint32(entry[0x0:], child.logical)
+		le.PutUint32(entry[0x4:], uint32(child.physical))
+		le.PutUint16(entry[0x8:], uint16(child.physical>>32))
+	}
+
+	return true
+}
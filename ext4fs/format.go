@@ -0,0 +1,591 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/internal/randuuid"
+)
+
+const (
+	// superblockOffset is where the primary superblock begins.
+	superblockOffset = 1024
+	// superblockSize is the size of the on-disk superblock.
+	superblockSize = 1024
+	// defaultBlockSize is the block size of new filesystems.
+	defaultBlockSize = 4096
+	// defaultBytesPerInode is the bytes/inode ratio of new filesystems.
+	defaultBytesPerInode = 16384
+	// defaultReservedBlocksPercentage is the percentage of blocks of new
+	// filesystems reserved for the super-user.
+	defaultReservedBlocksPercentage = 5
+	// formatInodeSize is the size of the inodes of new filesystems.
+	formatInodeSize = 256
+	// groupDescriptorSize is the size of the group descriptors of new
+	// (64bit) filesystems.
+	groupDescriptorSize = 64
+	// firstInode is the first inode that isn't reserved (lost+found).
+	firstInode = 11
+	// lostAndFoundSize is the minimum size of the lost+found directory, so
+	// that e2fsck needn't allocate blocks to reconnect files.
+	lostAndFoundSize = 16384
+	// minLastGroupBlocks is the minimum number of data blocks in the last
+	// block group (smaller groups are dropped, as by mke2fs).
+	minLastGroupBlocks = 50
+)
+
+// Feature flags of new filesystems.
+const (
+	formatCompat   = 0x0008 | 0x0020                            // ext_attr, dir_index
+	formatIncompat = 0x0002 | 0x0040 | 0x0080                   // filetype, extent, 64bit
+	formatROCompat = 0x0001 | 0x0002 | 0x0020 | 0x0040 | 0x0400 // sparse_super, large_file, dir_nlink, extra_isize, metadata_csum
+)
+
+// FormatOptions are the options of Format.
+type FormatOptions struct {
+	// BlockSize in bytes (supported: 1024, 2048 and 4096 bytes, by default
+	// 4096).
+	BlockSize int
+	// BytesPerInode is the bytes/inode ratio (by default 16384).
+	BytesPerInode int
+	// ReservedBlocksPercentage of blocks reserved for the super-user (by
+	// default 5).
+	ReservedBlocksPercentage *int
+	// Label is the volume label (max length 16 bytes, see LabelPolicy).
+	Label string
+	// LabelPolicy controls what happens to labels longer than 16 bytes (by
+	// default they are rejected).
+	LabelPolicy ext4.LabelPolicy
+	// UUID of the filesystem (by default a random UUID).
+	UUID ext4.UUID
+	// RootOwner, if set, is the owner of the root directory (by default
+	// root).
+	RootOwner *ext4.RootOwner
+	// Time, if set, is used for the timestamps of the filesystem instead of
+	// the current time (eg. for reproducible images).
+	Time time.Time
+}
+
+// Validate checks the options for obvious mistakes.
+func (opts FormatOptions) Validate() error {
+	switch opts.BlockSize {
+	case 0, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("%w: unsupported block size %d", ext4.ErrInvalidOptions, opts.BlockSize)
+	}
+
+	if opts.BytesPerInode != 0 && (opts.BytesPerInode < 1024 || opts.BytesPerInode > 64*1024*1024) {
+		return fmt.Errorf("%w: bytes/inode ratio %d is out of range", ext4.ErrInvalidOptions, opts.BytesPerInode)
+	}
+
+	if p := opts.ReservedBlocksPercentage; p != nil && (*p < 0 || *p > 50) {
+		return fmt.Errorf("%w: reserved blocks percentage %d is out of range", ext4.ErrInvalidOptions, *p)
+	}
+
+	if opts.UUID == ext4.TimeUUID {
+		return fmt.Errorf("%w: time-based UUIDs can only be generated by mke2fs", ext4.ErrInvalidOptions)
+	}
+
+	return opts.UUID.Validate()
+}
+
+// geometry is the layout of a new filesystem.
+type geometry struct {
+	blockSize      int64
+	firstDataBlock uint64
+	blockCount     uint64
+	blocksPerGroup uint64
+	groupCount     uint64
+	inodesPerGroup uint64
+	// gdtBlocks is the number of blocks of group descriptors.
+	gdtBlocks uint64
+	// inodeTableBlocks is the number of blocks of each inode table.
+	inodeTableBlocks uint64
+}
+
+// newGeometry lays out a filesystem of the given size.
+func newGeometry(size int64, blockSize, bytesPerInode int) (*geometry, error) {
+	g := &geometry{
+		blockSize:      int64(blockSize),
+		blockCount:     uint64(size / int64(blockSize)),
+		blocksPerGroup: 8 * uint64(blockSize),
+	}
+	if blockSize == 1024 {
+		g.firstDataBlock = 1
+	}
+
+	inodesPerBlock := uint64(blockSize / formatInodeSize)
+	inodeAlign := max(inodesPerBlock, 8)
+
+	for {
+		if g.blockCount <= g.firstDataBlock {
+			return nil, fmt.Errorf("%w: filesystem size %d is too small", ext4.ErrInvalidOptions, size)
+		}
+
+		g.groupCount = (g.blockCount - g.firstDataBlock + g.blocksPerGroup - 1) / g.blocksPerGroup
+		g.gdtBlocks = (g.groupCount*groupDescriptorSize + uint64(blockSize) - 1) / uint64(blockSize)
+
+		inodes := g.blockCount * uint64(blockSize) / uint64(bytesPerInode)
+		g.inodesPerGroup = (inodes + g.groupCount - 1) / g.groupCount
+		g.inodesPerGroup = max((g.inodesPerGroup+inodeAlign-1)/inodeAlign*inodeAlign, 2*inodeAlign)
+		g.inodesPerGroup = min(g.inodesPerGroup, g.blocksPerGroup, (1<<32-1)/g.groupCount/inodeAlign*inodeAlign)
+		g.inodeTableBlocks = g.inodesPerGroup / inodesPerBlock
+
+		if g.overhead(0) >= g.blocksPerGroup {
+			return nil, fmt.Errorf("%w: filesystem size %d is too large", ext4.ErrInvalidOptions, size)
+		}
+
+		// Drop the last group if there's hardly any room for data in it.
+		last := g.groupCount - 1
+		if last > 0 && g.groupBlocks(last) < g.overhead(last)+minLastGroupBlocks {
+			g.blockCount = g.groupStart(last)
+			continue
+		}
+
+		if g.groupBlocks(0) < g.overhead(0)+1+g.lostAndFoundBlocks() {
+			return nil, fmt.Errorf("%w: filesystem size %d is too small", ext4.ErrInvalidOptions, size)
+		}
+
+		return g, nil
+	}
+}
+
+// groupStart returns the first block of a block group.
+func (g *geometry) groupStart(group uint64) uint64 {
+	return g.firstDataBlock + group*g.blocksPerGroup
+}
+
+// groupBlocks returns the number of blocks in a block group (the last may be
+// smaller than the rest).
+func (g *geometry) groupBlocks(group uint64) uint64 {
+	return min(g.blocksPerGroup, g.blockCount-g.groupStart(group))
+}
+
+// hasSuperblock returns true if a block group holds a backup of the
+// superblock and group descriptors (with the sparse_super feature, groups 0
+// and 1, and powers of 3, 5 and 7).
+func hasSuperblock(group uint64) bool {
+	if group <= 1 {
+		return true
+	}
+
+	for _, base := range []uint64{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// superblockBlocks returns the number of blocks used by the superblock and
+// group descriptors in a block group.
+func (g *geometry) superblockBlocks(group uint64) uint64 {
+	if !hasSuperblock(group) {
+		return 0
+	}
+
+	return 1 + g.gdtBlocks
+}
+
+// overhead returns the number of metadata blocks in a block group: the
+// superblock and group descriptors (if any), bitmaps and inode table.
+func (g *geometry) overhead(group uint64) uint64 {
+	return g.superblockBlocks(group) + 2 + g.inodeTableBlocks
+}
+
+// lostAndFoundBlocks returns the number of blocks of the lost+found
+// directory.
+func (g *geometry) lostAndFoundBlocks() uint64 {
+	return max(uint64(lostAndFoundSize/g.blockSize), 1)
+}
+
+// FormatFile creates an ext4 filesystem in a file or device on the local host
+// (see Format). If size is zero, the filesystem fills the existing file or
+// device, otherwise the file is created (or truncated) to the size. Returns
+// the superblock of the new filesystem.
+func FormatFile(path string, size int64, opts FormatOptions) (*ext4.SuperblockInfo, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if size == 0 {
+		if size, err = f.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	} else if err := f.Truncate(size); err != nil {
+		return nil, err
+	}
+
+	if err := Format(f, size, opts); err != nil {
+		return nil, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	sb, err := ext4.ReadSuperblockFrom(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return sb, f.Close()
+}
+
+// Format creates an ext4 filesystem of the given size in w (eg. an *os.File
+// of a device or image file), without running mke2fs (eg. in minimal
+// containers, or on other operating systems).
+//
+// This is experimental: the filesystem has a fixed set of features (extent,
+// 64bit, metadata_csum, dir_index, filetype, sparse_super, large_file,
+// dir_nlink, extra_isize and ext_attr) and no journal (use mke2fs, or add one
+// with tune2fs, for a general purpose filesystem). It requires Linux 3.5 or
+// later. As with the lazy_itable_init option of mke2fs, only the metadata in
+// use is written: the kernel zeroes the rest of the inode tables when the
+// filesystem is first mounted.
+func Format(w io.WriterAt, size int64, opts FormatOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	label, err := opts.LabelPolicy.Apply(opts.Label)
+	if err != nil {
+		return err
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	bytesPerInode := opts.BytesPerInode
+	if bytesPerInode == 0 {
+		bytesPerInode = defaultBytesPerInode
+	}
+	reservedPercentage := defaultReservedBlocksPercentage
+	if opts.ReservedBlocksPercentage != nil {
+		reservedPercentage = *opts.ReservedBlocksPercentage
+	}
+
+	g, err := newGeometry(size, blockSize, bytesPerInode)
+	if err != nil {
+		return err
+	}
+
+	var uuid [16]byte
+	switch opts.UUID {
+	case "", ext4.RandomUUID:
+		if uuid, err = randuuid.New(); err != nil {
+			return err
+		}
+	default:
+		if uuid, err = opts.UUID.Bytes(); err != nil {
+			return err
+		}
+	}
+
+	var hashSeed [16]byte
+	if _, err := rand.Read(hashSeed[:]); err != nil {
+		return err
+	}
+
+	now := opts.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	f := &formatter{
+		w:    w,
+		g:    g,
+		seed: checksumSeed(uuid),
+		now:  now,
+	}
+
+	// The root directory and lost+found are stored after the metadata of the
+	// first block group.
+	rootBlock := g.groupStart(0) + g.overhead(0)
+	lostAndFoundBlock := rootBlock + 1
+	dataBlocks := 1 + g.lostAndFoundBlocks()
+
+	if err := f.writeDirectories(rootBlock, lostAndFoundBlock, opts.RootOwner); err != nil {
+		return err
+	}
+
+	gdt, freeBlocks, err := f.writeBitmaps(dataBlocks)
+	if err != nil {
+		return err
+	}
+
+	sb := f.superblock(uuid, hashSeed, label, freeBlocks, g.blockCount*uint64(reservedPercentage)/100)
+
+	// Wipe any signatures before the primary superblock (eg. of a previous
+	// filesystem).
+	if _, err := w.WriteAt(make([]byte, superblockOffset), 0); err != nil {
+		return fmt.Errorf("failed to write boot block: %w", err)
+	}
+
+	for group := uint64(0); group < g.groupCount; group++ {
+		if !hasSuperblock(group) {
+			continue
+		}
+
+		offset := int64(g.groupStart(group)) * g.blockSize
+		if group == 0 {
+			offset = superblockOffset
+		}
+
+		binary.LittleEndian.PutUint16(sb[0x5A:], uint16(group))
+		setSuperblockChecksum(sb)
+
+		if _, err := w.WriteAt(sb, offset); err != nil {
+			return fmt.Errorf("failed to write superblock: %w", err)
+		}
+		if _, err := w.WriteAt(gdt, int64(g.groupStart(group)+1)*g.blockSize); err != nil {
+			return fmt.Errorf("failed to write group descriptors: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// formatter writes the metadata of a new filesystem.
+type formatter struct {
+	w    io.WriterAt
+	g    *geometry
+	seed uint32
+	now  time.Time
+}
+
+// writeBlock writes a block of the filesystem.
+func (f *formatter) writeBlock(block uint64, buf []byte) error {
+	if _, err := f.w.WriteAt(buf, int64(block)*f.g.blockSize); err != nil {
+		return fmt.Errorf("failed to write block %d: %w", block, err)
+	}
+
+	return nil
+}
+
+// writeDirectories writes the inodes and contents of the root and lost+found
+// directories, in the first block group. The other reserved inodes are left
+// zeroed.
+func (f *formatter) writeDirectories(rootBlock, lostAndFoundBlock uint64, owner *ext4.RootOwner) error {
+	g := f.g
+
+	root := &Inode{
+		Number:  rootInode,
+		RawMode: typeDir | 0o755,
+		Links:   3,
+	}
+	if owner != nil {
+		root.UID, root.GID = owner.UID, owner.GID
+	}
+	lostAndFound := &Inode{
+		Number:  firstInode,
+		RawMode: typeDir | 0o700,
+		Links:   2,
+	}
+
+	block := make([]byte, g.blockSize)
+	encodeDirBlock(block, []dirEntry{
+		{name: ".", inode: rootInode, fileType: 2},
+		{name: "..", inode: rootInode, fileType: 2},
+		{name: "lost+found", inode: firstInode, fileType: 2},
+	}, true, true)
+	setDirBlockChecksum(block, inodeChecksumSeed(f.seed, rootInode, 0))
+	if err := f.writeBlock(rootBlock, block); err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < g.lostAndFoundBlocks(); i++ {
+		var entries []dirEntry
+		if i == 0 {
+			entries = []dirEntry{
+				{name: ".", inode: firstInode, fileType: 2},
+				{name: "..", inode: rootInode, fileType: 2},
+			}
+		}
+		encodeDirBlock(block, entries, true, true)
+		setDirBlockChecksum(block, inodeChecksumSeed(f.seed, firstInode, 0))
+		if err := f.writeBlock(lostAndFoundBlock+i, block); err != nil {
+			return err
+		}
+	}
+
+	// The inode table blocks holding the reserved inodes.
+	table := make([]byte, (firstInode*formatInodeSize+g.blockSize-1)/g.blockSize*g.blockSize)
+	for _, dir := range []struct {
+		ino    *Inode
+		block  uint64
+		blocks uint64
+	}{
+		{root, rootBlock, 1},
+		{lostAndFound, lostAndFoundBlock, g.lostAndFoundBlocks()},
+	} {
+		ino := dir.ino
+		ino.Size = dir.blocks * uint64(g.blockSize)
+		ino.Blocks = ino.Size / 512
+		ino.Flags = flagExtents
+		ino.AccessTime, ino.ChangeTime, ino.ModifyTime, ino.CreateTime = f.now, f.now, f.now, f.now
+		encodeExtentLeaf(ino.block[:], []extent{{physical: dir.block, length: uint32(dir.blocks)}})
+
+		buf := table[(ino.Number-1)*formatInodeSize : ino.Number*formatInodeSize]
+		ino.encode(buf)
+		setInodeChecksum(buf, f.seed, ino.Number)
+	}
+
+	inodeTable := g.groupStart(0) + g.superblockBlocks(0) + 2
+	if _, err := f.w.WriteAt(table, int64(inodeTable)*g.blockSize); err != nil {
+		return fmt.Errorf("failed to write inode table: %w", err)
+	}
+
+	return nil
+}
+
+// writeBitmaps writes the block and inode bitmaps of each block group, given
+// the number of data blocks used in the first group. Returns the group
+// descriptors (padded to whole blocks), and the number of free blocks.
+func (f *formatter) writeBitmaps(dataBlocks uint64) ([]byte, uint64, error) {
+	g := f.g
+
+	gdt := make([]byte, g.gdtBlocks*uint64(g.blockSize))
+	blockBitmap := make([]byte, g.blockSize)
+	inodeBitmap := make([]byte, g.blockSize)
+
+	var freeBlocks uint64
+	for group := uint64(0); group < g.groupCount; group++ {
+		used := g.overhead(group)
+		usedInodes, usedDirs := uint64(0), uint64(0)
+		if group == 0 {
+			used += dataBlocks
+			usedInodes, usedDirs = firstInode, 2
+		}
+
+		// Bits past the end of the group are set.
+		clear(blockBitmap)
+		setBits(blockBitmap, 0, used)
+		setBits(blockBitmap, g.groupBlocks(group), uint64(len(blockBitmap))*8)
+
+		clear(inodeBitmap)
+		setBits(inodeBitmap, 0, usedInodes)
+		setBits(inodeBitmap, g.inodesPerGroup, uint64(len(inodeBitmap))*8)
+
+		bitmaps := g.groupStart(group) + g.superblockBlocks(group)
+		if err := f.writeBlock(bitmaps, blockBitmap); err != nil {
+			return nil, 0, err
+		}
+		if err := f.writeBlock(bitmaps+1, inodeBitmap); err != nil {
+			return nil, 0, err
+		}
+
+		free := g.groupBlocks(group) - used
+		freeInodes := g.inodesPerGroup - usedInodes
+		blockBitmapCsum := crc32c(f.seed, blockBitmap[:g.blocksPerGroup/8])
+		inodeBitmapCsum := crc32c(f.seed, inodeBitmap[:g.inodesPerGroup/8])
+
+		desc := groupDesc(gdt[group*groupDescriptorSize : (group+1)*groupDescriptorSize])
+		desc.setBlock(descBlockBitmap, bitmaps)
+		desc.setBlock(descInodeBitmap, bitmaps+1)
+		desc.setBlock(descInodeTable, bitmaps+2)
+		desc.setCount(descFreeBlocks, uint32(free))
+		desc.setCount(descFreeInodes, uint32(freeInodes))
+		desc.setCount(descUsedDirs, uint32(usedDirs))
+		desc.setCount(descBlockBitmapCsum, blockBitmapCsum)
+		desc.setCount(descInodeBitmapCsum, inodeBitmapCsum)
+		desc.setCount(descItableUnused, uint32(freeInodes))
+		setGroupDescriptorChecksum(desc, f.seed, uint32(group))
+
+		freeBlocks += free
+	}
+
+	return gdt, freeBlocks, nil
+}
+
+// setBits sets the bits [start, end) of a bitmap.
+func setBits(bitmap []byte, start, end uint64) {
+	for i := start; i < end; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+}
+
+// superblock returns the primary superblock of the filesystem (without its
+// checksum).
+func (f *formatter) superblock(uuid, hashSeed [16]byte, label string, freeBlocks, reservedBlocks uint64) []byte {
+	le := binary.LittleEndian
+	g := f.g
+
+	logBlockSize := uint32(0)
+	for 1024<<logBlockSize < g.blockSize {
+		logBlockSize++
+	}
+	now := uint32(f.now.Unix())
+	freeInodes := g.inodesPerGroup*g.groupCount - firstInode
+
+	sb := make([]byte, superblockSize)
+	le.PutUint32(sb[0x0:], uint32(g.inodesPerGroup*g.groupCount))
+	le.PutUint32(sb[0x4:], uint32(g.blockCount))
+	le.PutUint32(sb[0x8:], uint32(reservedBlocks))
+	le.PutUint32(sb[0xC:], uint32(freeBlocks))
+	le.PutUint32(sb[0x10:], uint32(freeInodes))
+	le.PutUint32(sb[0x14:], uint32(g.firstDataBlock))
+	le.PutUint32(sb[0x18:], logBlockSize)
+	le.PutUint32(sb[0x1C:], logBlockSize)
+	le.PutUint32(sb[0x20:], uint32(g.blocksPerGroup))
+	le.PutUint32(sb[0x24:], uint32(g.blocksPerGroup))
+	le.PutUint32(sb[0x28:], uint32(g.inodesPerGroup))
+	le.PutUint32(sb[0x30:], now)        // write time
+	le.PutUint16(sb[0x36:], 0xFFFF)     // max mount count
+	le.PutUint16(sb[0x38:], 0xEF53)     // magic
+	le.PutUint16(sb[0x3A:], 1)          // state: clean
+	le.PutUint16(sb[0x3C:], 1)          // errors: continue
+	le.PutUint32(sb[0x40:], now)        // last check
+	le.PutUint32(sb[0x4C:], 1)          // revision: dynamic
+	le.PutUint32(sb[0x54:], firstInode) // first inode
+	le.PutUint16(sb[0x58:], formatInodeSize)
+	le.PutUint32(sb[0x5C:], formatCompat)
+	le.PutUint32(sb[0x60:], formatIncompat)
+	le.PutUint32(sb[0x64:], formatROCompat)
+	copy(sb[0x68:0x78], uuid[:])
+	copy(sb[0x78:0x88], label)
+	copy(sb[0xEC:0xFC], hashSeed[:])
+	sb[0xFC] = 1 // default hash: half_md4
+	le.PutUint16(sb[0xFE:], groupDescriptorSize)
+	le.PutUint32(sb[0x100:], 0x0004|0x0008) // default mount options: user_xattr, acl
+	le.PutUint32(sb[0x108:], now)           // creation time
+	le.PutUint32(sb[0x150:], uint32(g.blockCount>>32))
+	le.PutUint32(sb[0x154:], uint32(reservedBlocks>>32))
+	le.PutUint32(sb[0x158:], uint32(freeBlocks>>32))
+	le.PutUint16(sb[0x15C:], extraInodeSize) // min extra inode size
+	le.PutUint16(sb[0x15E:], extraInodeSize) // wanted extra inode size
+	le.PutUint32(sb[0x160:], 0x1)            // flags: signed directory hash
+	sb[0x175] = 1                            // checksum type: crc32c
+
+	return sb
+}
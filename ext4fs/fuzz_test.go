@@ -0,0 +1,191 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4fs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenCorrupt(t *testing.T) {
+	image := formatImage(t)
+
+	t.Log("Setting the high word of the block count")
+
+	corrupt := bytes.Clone(image)
+	binary.LittleEndian.PutUint32(corrupt[1024+0x150:], 1)
+	clearMetadataCsum(corrupt)
+
+	_, err := ext4fs.Open(bytes.NewReader(corrupt))
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+
+	t.Log("Setting the block count below the first data block")
+
+	corrupt = bytes.Clone(image)
+	binary.LittleEndian.PutUint32(corrupt[1024+0x4:], 0)
+	clearMetadataCsum(corrupt)
+
+	_, err = ext4fs.Open(bytes.NewReader(corrupt))
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+
+	t.Log("Truncating the image")
+
+	_, err = ext4fs.Open(bytes.NewReader(image[:len(image)/2]))
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+}
+
+func FuzzOpen(f *testing.F) {
+	image := formatImage(f)
+	f.Add(image)
+
+	corrupt := bytes.Clone(image)
+	binary.LittleEndian.PutUint32(corrupt[1024+0x150:], 1)
+	clearMetadataCsum(corrupt)
+	f.Add(corrupt)
+
+	f.Fuzz(func(t *testing.T, image []byte) {
+		fsys, err := ext4fs.Open(bytes.NewReader(image))
+		if err != nil {
+			return
+		}
+
+		require.NotZero(t, fsys.Superblock().BlockCount)
+	})
+}
+
+func TestWalkCorrupt(t *testing.T) {
+	hostPath := filepath.Join(t.TempDir(), "hello.txt")
+	require.NoError(t, os.WriteFile(hostPath, []byte("hello"), 0o644))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(imagePath, formatImage(t), 0o644))
+
+	// Sizes far larger than the filesystem.
+	cmd := exec.Command("debugfs", "-w", "-f", "-", imagePath)
+	cmd.Stdin = strings.NewReader(strings.Join([]string{
+		"write " + hostPath + " hello.txt",
+		"symlink link hello.txt",
+		"sif /hello.txt size 0x7fffffffffff",
+		"sif /link size 0x7fffffffffff",
+		"sif /lost+found size 0x7fffffffffff",
+	}, "\n") + "\n")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	image, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	fsys, err := ext4fs.Open(bytes.NewReader(image))
+	require.NoError(t, err)
+
+	_, err = fsys.ReadFile("hello.txt")
+	require.ErrorIs(t, err, ext4fs.ErrCorrupt)
+
+	_, err = fsys.ReadLink("link")
+	require.ErrorIs(t, err, ext4fs.ErrCorrupt)
+
+	var walkErr error
+	err = fsys.Walk(func(path string, ino *ext4fs.Inode, err error) error {
+		if path == "lost+found" && err != nil {
+			walkErr = err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, walkErr, ext4fs.ErrCorrupt)
+}
+
+func TestWalkCycle(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(imagePath, formatImage(t), 0o644))
+
+	// Point lost+found back at the root directory.
+	cmd := exec.Command("debugfs", "-w", "-f", "-", imagePath)
+	cmd.Stdin = strings.NewReader("unlink lost+found\nln <2> lost+found\n")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	image, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	fsys, err := ext4fs.Open(bytes.NewReader(image))
+	require.NoError(t, err)
+
+	var paths []string
+	var walkErr error
+	err = fsys.Walk(func(path string, ino *ext4fs.Inode, err error) error {
+		paths = append(paths, path)
+		if err != nil {
+			walkErr = err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{".", "lost+found"}, paths)
+	require.ErrorIs(t, walkErr, ext4fs.ErrCorrupt)
+}
+
+func FuzzWalk(f *testing.F) {
+	f.Add(formatImage(f))
+
+	f.Fuzz(func(t *testing.T, image []byte) {
+		fsys, err := ext4fs.Open(bytes.NewReader(image))
+		if err != nil {
+			return
+		}
+
+		_ = fsys.Walk(func(path string, ino *ext4fs.Inode, err error) error {
+			if err == nil && !ino.IsDir() {
+				_, _ = fsys.ReadFile(path)
+			}
+			return nil
+		})
+	})
+}
+
+// formatImage returns a small (1KiB block) filesystem image, for corrupting.
+func formatImage(t testing.TB) []byte {
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := ext4fs.FormatFile(imagePath, 64*1024, ext4fs.FormatOptions{
+		BlockSize: 1024,
+		Time:      time.Unix(0, 0),
+	})
+	require.NoError(t, err)
+
+	image, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	return image
+}
+
+// clearMetadataCsum disables the metadata_csum feature of an image, so that
+// changes to its superblock aren't caught by the checksum.
+func clearMetadataCsum(image []byte) {
+	roCompat := binary.LittleEndian.Uint32(image[1024+0x64:])
+	binary.LittleEndian.PutUint32(image[1024+0x64:], roCompat&^0x400)
+}
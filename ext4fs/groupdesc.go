@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import "encoding/binary"
+
+// Block group flags.
+const (
+	// groupInodeUninit marks a group whose inode bitmap hasn't been
+	// initialized (it is all zeroes).
+	groupInodeUninit = 0x1
+	// groupBlockUninit marks a group whose block bitmap hasn't been
+	// initialized (only its metadata blocks are in use).
+	groupBlockUninit = 0x2
+)
+
+// Fields of a group descriptor, as the offsets of their low and high halves
+// (the high halves are only stored in 64 byte descriptors).
+var (
+	descBlockBitmap     = [2]int{0x0, 0x20}
+	descInodeBitmap     = [2]int{0x4, 0x24}
+	descInodeTable      = [2]int{0x8, 0x28}
+	descFreeBlocks      = [2]int{0xC, 0x2C}
+	descFreeInodes      = [2]int{0xE, 0x2E}
+	descUsedDirs        = [2]int{0x10, 0x30}
+	descBlockBitmapCsum = [2]int{0x18, 0x38}
+	descInodeBitmapCsum = [2]int{0x1A, 0x3A}
+	descItableUnused    = [2]int{0x1C, 0x32}
+)
+
+// groupDesc is an on-disk group descriptor (of 32 or 64 bytes).
+type groupDesc []byte
+
+// block returns a 64-bit block number field.
+func (d groupDesc) block(field [2]int) uint64 {
+	v := uint64(binary.LittleEndian.Uint32(d[field[0]:]))
+	if len(d) >= 64 {
+		v |= uint64(binary.LittleEndian.Uint32(d[field[1]:])) << 32
+	}
+
+	return v
+}
+
+// setBlock stores a 64-bit block number field.
+func (d groupDesc) setBlock(field [2]int, v uint64) {
+	binary.LittleEndian.PutUint32(d[field[0]:], uint32(v))
+	if len(d) >= 64 {
+		binary.LittleEndian.PutUint32(d[field[1]:], uint32(v>>32))
+	}
+}
+
+// count returns a 32-bit count (or checksum) field.
+func (d groupDesc) count(field [2]int) uint32 {
+	v := uint32(binary.LittleEndian.Uint16(d[field[0]:]))
+	if len(d) >= 64 {
+		v |= uint32(binary.LittleEndian.Uint16(d[field[1]:])) << 16
+	}
+
+	return v
+}
+
+// setCount stores a 32-bit count (or checksum) field.
+func (d groupDesc) setCount(field [2]int, v uint32) {
+	binary.LittleEndian.PutUint16(d[field[0]:], uint16(v))
+	if len(d) >= 64 {
+		binary.LittleEndian.PutUint16(d[field[1]:], uint16(v>>16))
+	}
+}
+
+// flags returns the block group flags.
+func (d groupDesc) flags() uint16 {
+	return binary.LittleEndian.Uint16(d[0x12:])
+}
+
+// setFlags stores the block group flags.
+func (d groupDesc) setFlags(flags uint16) {
+	binary.LittleEndian.PutUint16(d[0x12:], flags)
+}
@@ -0,0 +1,372 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/dpeckett/ext4"
+)
+
+// Inode flags.
+const (
+	flagIndex      = 0x1000
+	flagEncrypt    = 0x800
+	flagHugeFile   = 0x40000
+	flagExtents    = 0x80000
+	flagInlineData = 0x10000000
+	flagCasefold   = 0x40000000
+)
+
+// File types, stored in the top bits of the mode.
+const (
+	typeMask    = 0xF000
+	typeFIFO    = 0x1000
+	typeChar    = 0x2000
+	typeDir     = 0x4000
+	typeBlock   = 0x6000
+	typeRegular = 0x8000
+	typeSymlink = 0xA000
+	typeSocket  = 0xC000
+)
+
+// goodOldInodeSize is the size of the inodes of revision 0 filesystems, and
+// of the fixed part of larger inodes.
+const goodOldInodeSize = 128
+
+// extraInodeSize is the size of the extra fields of the inodes written by
+// this package (timestamps with nanoseconds, creation time and project ID).
+const extraInodeSize = 32
+
+// Inode is the metadata of a file, as stored in its inode. It is returned by
+// the Sys method of the fs.FileInfo of files.
+type Inode struct {
+	// Number of the inode.
+	Number uint32
+	// RawMode is the file type and permission bits, as stored on disk (see
+	// Mode for the fs.FileMode equivalent).
+	RawMode uint16
+	// UID is the user ID of the owner.
+	UID uint32
+	// GID is the group ID of the owner.
+	GID uint32
+	// Size of the file in bytes.
+	Size uint64
+	// Links is the number of hard links to the inode.
+	Links uint16
+	// Blocks is the number of 512 byte sectors allocated to the file
+	// (including metadata, such as extent tree and extended attribute blocks).
+	Blocks uint64
+	// Flags of the inode (see chattr(1)).
+	Flags uint32
+	// Generation number of the inode (used by NFS file handles).
+	Generation uint32
+	// ProjectID is the project the file belongs to, for project quotas.
+	ProjectID uint32
+	// XattrBlock is the block holding the extended attributes that don't fit
+	// in the inode (zero if none).
+	XattrBlock uint64
+	// DeviceMajor and DeviceMinor are the device numbers of block and
+	// character devices.
+	DeviceMajor uint32
+	DeviceMinor uint32
+	// AccessTime is when the file was last accessed.
+	AccessTime time.Time
+	// ModifyTime is when the contents of the file last changed.
+	ModifyTime time.Time
+	// ChangeTime is when the inode last changed.
+	ChangeTime time.Time
+	// CreateTime is when the file was created (zero if not recorded).
+	CreateTime time.Time
+
+	// block is the i_block field: the block map, extent tree root, inline
+	// data or fast symlink target.
+	block [60]byte
+	// xattrs are the extended attributes stored in the inode (after the
+	// magic number).
+	xattrs []byte
+}
+
+// Mode returns the file type and permission bits as an fs.FileMode.
+func (ino *Inode) Mode() fs.FileMode {
+	mode := fs.FileMode(ino.RawMode & 0o777)
+	if ino.RawMode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if ino.RawMode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if ino.RawMode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch ino.RawMode & typeMask {
+	case typeFIFO:
+		mode |= fs.ModeNamedPipe
+	case typeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case typeDir:
+		mode |= fs.ModeDir
+	case typeBlock:
+		mode |= fs.ModeDevice
+	case typeSymlink:
+		mode |= fs.ModeSymlink
+	case typeSocket:
+		mode |= fs.ModeSocket
+	case typeRegular:
+	default:
+		mode |= fs.ModeIrregular
+	}
+
+	return mode
+}
+
+// IsDir returns true if the inode is a directory.
+func (ino *Inode) IsDir() bool {
+	return ino.RawMode&typeMask == typeDir
+}
+
+// IsIndexed returns true if the inode is a directory indexed with a hashed
+// B-tree (htree), for fast lookups in large directories.
+func (ino *Inode) IsIndexed() bool {
+	return ino.IsDir() && ino.Flags&flagIndex != 0
+}
+
+// inode reads an inode from the inode table.
+func (fsys *FS) inode(number uint32) (*Inode, error) {
+	if number == 0 || uint64(number) > fsys.sb.InodeCount {
+		return nil, fmt.Errorf("invalid inode number %d", number)
+	}
+
+	buf := make([]byte, fsys.sb.InodeSize)
+	if _, err := fsys.r.ReadAt(buf, fsys.inodeOffset(number)); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", number, err)
+	}
+
+	ino, err := decodeInode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %w", number, err)
+	}
+	ino.Number = number
+
+	// Huge files count their allocation in filesystem blocks.
+	if ino.Flags&flagHugeFile != 0 && fsys.sb.HasFeature(ext4.HugeFile) {
+		ino.Blocks *= uint64(fsys.blockSize / 512)
+	}
+
+	return ino, nil
+}
+
+// inodeOffset returns the location of an inode in the inode table (in
+// bytes).
+func (fsys *FS) inodeOffset(number uint32) int64 {
+	group := uint64(number-1) / fsys.sb.InodesPerGroup
+	index := uint64(number-1) % fsys.sb.InodesPerGroup
+
+	return int64(fsys.descs[group].block(descInodeTable))*fsys.blockSize + int64(index)*int64(fsys.sb.InodeSize)
+}
+
+// decodeInode parses an on-disk inode.
+func decodeInode(buf []byte) (*Inode, error) {
+	le := binary.LittleEndian
+
+	ino := &Inode{
+		RawMode: le.Uint16(buf[0x0:]),
+		UID:     uint32(le.Uint16(buf[0x2:])) | uint32(le.Uint16(buf[0x78:]))<<16,
+		GID:     uint32(le.Uint16(buf[0x18:])) | uint32(le.Uint16(buf[0x7A:]))<<16,
+		Size:    uint64(le.Uint32(buf[0x4:])) | uint64(le.Uint32(buf[0x6C:]))<<32,
+		Links:   le.Uint16(buf[0x1A:]),
+		Blocks:  uint64(le.Uint32(buf[0x1C:])) | uint64(le.Uint16(buf[0x74:]))<<32,
+		Flags:   le.Uint32(buf[0x20:]),
+
+		Generation: le.Uint32(buf[0x64:]),
+		XattrBlock: uint64(le.Uint32(buf[0x68:])) | uint64(le.Uint16(buf[0x76:]))<<32,
+	}
+	copy(ino.block[:], buf[0x28:0x64])
+
+	if typ := ino.RawMode & typeMask; typ == typeChar || typ == typeBlock {
+		// Device numbers are stored in the old 16-bit encoding if possible,
+		// otherwise in the new encoding (in the second word).
+		if dev := le.Uint32(ino.block[0:]); dev != 0 {
+			ino.DeviceMajor, ino.DeviceMinor = (dev>>8)&0xff, dev&0xff
+		} else {
+			dev := le.Uint32(ino.block[4:])
+			ino.DeviceMajor, ino.DeviceMinor = (dev&0xfff00)>>8, (dev&0xff)|((dev>>12)&0xfff00)
+		}
+	}
+
+	// The nanoseconds (and epoch bits) of the timestamps, and the creation
+	// time, are stored in the extra space of large inodes.
+	var extraSize int
+	if len(buf) > goodOldInodeSize {
+		extraSize = int(le.Uint16(buf[0x80:]))
+		if goodOldInodeSize+extraSize > len(buf) {
+			return nil, fmt.Errorf("invalid extra inode size %d", extraSize)
+		}
+	}
+	timestamp := func(off, extraOff int) time.Time {
+		secs := int64(int32(le.Uint32(buf[off:])))
+		if extraOff+4 > goodOldInodeSize+extraSize {
+			return time.Unix(secs, 0)
+		}
+
+		extra := le.Uint32(buf[extraOff:])
+		return time.Unix(secs+int64(extra&0x3)<<32, int64(extra>>2))
+	}
+
+	ino.AccessTime = timestamp(0x8, 0x8C)
+	ino.ChangeTime = timestamp(0xC, 0x84)
+	ino.ModifyTime = timestamp(0x10, 0x88)
+	if goodOldInodeSize+extraSize >= 0x98 {
+		ino.CreateTime = timestamp(0x90, 0x94)
+	}
+	if goodOldInodeSize+extraSize >= 0xA0 {
+		ino.ProjectID = le.Uint32(buf[0x9C:])
+	}
+
+	if xattrs := buf[goodOldInodeSize+extraSize:]; len(xattrs) >= 4 && le.Uint32(xattrs) == xattrMagic {
+		ino.xattrs = xattrs[4:]
+	}
+
+	return ino, nil
+}
+
+// encode stores the inode in buf (an on-disk inode, of the inode size of the
+// filesystem), leaving any extended attributes stored in the inode as they
+// are. Inodes with the huge_file flag aren't supported.
+func (ino *Inode) encode(buf []byte) {
+	le := binary.LittleEndian
+
+	le.PutUint16(buf[0x0:], ino.RawMode)
+	le.PutUint16(buf[0x2:], uint16(ino.UID))
+	le.PutUint32(buf[0x4:], uint32(ino.Size))
+	le.PutUint32(buf[0x14:], 0)
+	le.PutUint16(buf[0x18:], uint16(ino.GID))
+	le.PutUint16(buf[0x1A:], ino.Links)
+	le.PutUint32(buf[0x1C:], uint32(ino.Blocks))
+	le.PutUint32(buf[0x20:], ino.Flags)
+	copy(buf[0x28:0x64], ino.block[:])
+	le.PutUint32(buf[0x64:], ino.Generation)
+	le.PutUint32(buf[0x68:], uint32(ino.XattrBlock))
+	le.PutUint32(buf[0x6C:], uint32(ino.Size>>32))
+	le.PutUint16(buf[0x74:], uint16(ino.Blocks>>32))
+	le.PutUint16(buf[0x76:], uint16(ino.XattrBlock>>32))
+	le.PutUint16(buf[0x78:], uint16(ino.UID>>16))
+	le.PutUint16(buf[0x7A:], uint16(ino.GID>>16))
+
+	// New inodes get the standard extra fields, existing inodes keep theirs
+	// (extended attributes may follow them).
+	var extraSize int
+	if len(buf) > goodOldInodeSize {
+		extraSize = int(le.Uint16(buf[0x80:]))
+		if extraSize == 0 {
+			extraSize = extraInodeSize
+			le.PutUint16(buf[0x80:], uint16(extraSize))
+		}
+	}
+	timestamp := func(off, extraOff int, t time.Time) {
+		if t.IsZero() {
+			le.PutUint32(buf[off:], 0)
+			if extraOff+4 <= goodOldInodeSize+extraSize {
+				le.PutUint32(buf[extraOff:], 0)
+			}
+			return
+		}
+
+		secs := t.Unix()
+		le.PutUint32(buf[off:], uint32(secs))
+		if extraOff+4 <= goodOldInodeSize+extraSize {
+			epoch := uint32((secs-int64(int32(secs)))>>32) & 0x3
+			le.PutUint32(buf[extraOff:], epoch|uint32(t.Nanosecond())<<2)
+		}
+	}
+
+	timestamp(0x8, 0x8C, ino.AccessTime)
+	timestamp(0xC, 0x84, ino.ChangeTime)
+	timestamp(0x10, 0x88, ino.ModifyTime)
+	if goodOldInodeSize+extraSize >= 0x98 {
+		timestamp(0x90, 0x94, ino.CreateTime)
+	}
+	if goodOldInodeSize+extraSize >= 0xA0 {
+		le.PutUint32(buf[0x9C:], ino.ProjectID)
+	}
+}
+
+// contents returns a reader of the contents of a file (or directory).
+func (fsys *FS) contents(ino *Inode) (io.ReaderAt, error) {
+	if ino.Flags&flagEncrypt != 0 {
+		return nil, ErrEncrypted
+	}
+
+	switch {
+	case ino.Flags&flagInlineData != 0:
+		return inlineData(ino), nil
+	case ino.Flags&flagExtents != 0:
+		return fsys.extentReader(ino)
+	default:
+		return fsys.blockMapReader(ino), nil
+	}
+}
+
+// inlineData returns the contents of a file stored in its inode (with the
+// inline_data feature): the first 60 bytes in i_block, and the rest in the
+// system.data extended attribute.
+func inlineData(ino *Inode) io.ReaderAt {
+	data := append([]byte(nil), ino.block[:]...)
+	if value, ok := ino.xattr(xattrIndexSystem, "data"); ok {
+		data = append(data, value...)
+	}
+	if uint64(len(data)) > ino.Size {
+		data = data[:ino.Size]
+	}
+
+	return bytesReaderAt(data)
+}
+
+// bytesReaderAt reads from an in-memory buffer.
+type bytesReaderAt []byte
+
+func (b bytesReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// fileInfo implements fs.FileInfo for an inode.
+type fileInfo struct {
+	name  string
+	inode *Inode
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.inode.Size) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.inode.Mode() }
+func (fi *fileInfo) ModTime() time.Time { return fi.inode.ModifyTime }
+func (fi *fileInfo) IsDir() bool        { return fi.inode.IsDir() }
+func (fi *fileInfo) Sys() any           { return fi.inode }
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/dpeckett/ext4"
+)
+
+const (
+	// journalMagic marks the header of each block of the journal.
+	journalMagic = 0xC03B3998
+	// journalSuperblockSize is the size of the journal superblock.
+	journalSuperblockSize = 1024
+	// Block types of the journal superblock (version 1 has no features).
+	journalSuperblockV1 = 3
+	journalSuperblockV2 = 4
+)
+
+// incompatRecover is the needs_recovery incompatible feature flag.
+const incompatRecover = 0x4
+
+// journalFeatureNames are the names of the journal feature flags (as
+// reported by dumpe2fs), by compat, incompat and ro_compat field.
+var journalFeatureNames = [3]map[uint32]string{
+	{0x1: "journal_checksum"},
+	{
+		0x1:  "journal_incompat_revoke",
+		0x2:  "journal_64bit",
+		0x4:  "journal_async_commit",
+		0x8:  "journal_checksum_v2",
+		0x10: "journal_checksum_v3",
+	},
+	{},
+}
+
+// ErrNoJournal is returned when reading the journal of a filesystem without
+// one.
+var ErrNoJournal = errors.New("filesystem has no journal")
+
+// JournalState is the state of the journal of a filesystem, as recorded in
+// the journal superblock.
+type JournalState struct {
+	// External is true if the journal is stored on a separate device (its
+	// superblock isn't read, so only RecoveryFlag is reported).
+	External bool `json:"external"`
+	// RecoveryFlag is true if the needs_recovery feature is set (the
+	// filesystem wasn't cleanly unmounted, or is mounted).
+	RecoveryFlag bool `json:"recoveryFlag"`
+	// Features enabled on the journal (as reported by dumpe2fs).
+	Features []string `json:"features,omitempty"`
+	// Blocks is the size of the journal in blocks.
+	Blocks uint32 `json:"blocks,omitempty"`
+	// Sequence is the sequence number of the first transaction expected in
+	// the log.
+	Sequence uint32 `json:"sequence,omitempty"`
+	// Start is the block where the log begins (zero if the journal is
+	// empty).
+	Start uint32 `json:"start,omitempty"`
+	// Errno is the error recorded when the journal was aborted (zero if
+	// none).
+	Errno int32 `json:"errno,omitempty"`
+}
+
+// NeedsRecovery returns true if the journal may hold transactions that
+// haven't been written to the filesystem (so that until the journal is
+// replayed, eg. by e2fsck or by mounting the filesystem, its metadata may be
+// inconsistent).
+func (s *JournalState) NeedsRecovery() bool {
+	return s.RecoveryFlag || s.Start != 0
+}
+
+// JournalState reads the state of the journal, without replaying it. Returns
+// ErrNoJournal if the filesystem has no journal.
+func (fsys *FS) JournalState() (*JournalState, error) {
+	if !fsys.sb.HasFeature(ext4.HasJournal) {
+		return nil, ErrNoJournal
+	}
+
+	var incompat [4]byte
+	if _, err := fsys.r.ReadAt(incompat[:], superblockOffset+0x60); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	state := &JournalState{
+		RecoveryFlag: binary.LittleEndian.Uint32(incompat[:])&incompatRecover != 0,
+	}
+	if fsys.sb.JournalInode == 0 {
+		state.External = true
+		return state, nil
+	}
+
+	ino, err := fsys.inode(uint32(fsys.sb.JournalInode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal inode: %w", err)
+	}
+
+	r, err := fsys.contents(ino)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	buf := make([]byte, journalSuperblockSize)
+	if _, err := r.ReadAt(buf, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read journal superblock: %w", err)
+	}
+
+	if err := state.decode(buf); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// decode parses a journal superblock (the fields of which are big endian).
+func (s *JournalState) decode(buf []byte) error {
+	be := binary.BigEndian
+
+	if be.Uint32(buf[0x0:]) != journalMagic {
+		return fmt.Errorf("%w: bad journal superblock magic", ext4.ErrCorruptSuperblock)
+	}
+
+	blockType := be.Uint32(buf[0x4:])
+	if blockType != journalSuperblockV1 && blockType != journalSuperblockV2 {
+		return fmt.Errorf("%w: unknown journal superblock type %d", ext4.ErrCorruptSuperblock, blockType)
+	}
+
+	s.Blocks = be.Uint32(buf[0x10:])
+	s.Sequence = be.Uint32(buf[0x18:])
+	s.Start = be.Uint32(buf[0x1C:])
+	s.Errno = int32(be.Uint32(buf[0x20:]))
+
+	if blockType == journalSuperblockV2 {
+		for kind, prefix := range []string{"FEATURE_C", "FEATURE_I", "FEATURE_R"} {
+			flags := be.Uint32(buf[0x24+4*kind:])
+			for bit := 0; bit < 32; bit++ {
+				mask := uint32(1) << bit
+				if flags&mask == 0 {
+					continue
+				}
+
+				name, ok := journalFeatureNames[kind][mask]
+				if !ok {
+					name = prefix + strconv.Itoa(bit)
+				}
+				s.Features = append(s.Features, name)
+			}
+		}
+	}
+
+	return nil
+}
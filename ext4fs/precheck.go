@@ -0,0 +1,456 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dpeckett/ext4"
+)
+
+// maxPreCheckProblems is the number of problems after which PreCheck stops
+// looking for more (a full check is warranted either way).
+const maxPreCheckProblems = 100
+
+// errTooManyProblems stops a pre-check once maxPreCheckProblems is reached.
+var errTooManyProblems = errors.New("too many problems")
+
+// PreCheckResult is the result of a pre-check.
+type PreCheckResult struct {
+	// NeedsCheck is true if the filesystem should be checked (and repaired)
+	// with e2fsck before it is used.
+	NeedsCheck bool `json:"needsCheck"`
+	// Problems found, in the order they were found. The Pass of each problem
+	// is that of the e2fsck pass that would report it (zero for the
+	// superblock, 1 for inodes and 5 for the group summary).
+	Problems []ext4.Problem `json:"problems,omitempty"`
+	// Truncated is true if the pre-check stopped early, after finding too
+	// many problems.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// PreCheck quickly checks the consistency of the filesystem: the superblock
+// against the group descriptors, the group descriptors against the bitmaps,
+// the checksums of this metadata, and the inodes in use for obvious
+// corruption. It reads the metadata of the filesystem, but not the contents
+// of files or directories, so it runs in seconds (eg. as a boot-time gate to
+// decide whether to run a full check).
+//
+// It is not a substitute for e2fsck: a filesystem can pass the pre-check and
+// still be inconsistent (eg. blocks claimed by more than one file, or broken
+// directories), but a filesystem that fails it certainly needs a full check.
+func (fsys *FS) PreCheck() (*PreCheckResult, error) {
+	// Bitmaps of clusters aren't supported.
+	if fsys.sb.HasFeature(ext4.Bigalloc) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, ext4.Bigalloc)
+	}
+
+	rawSB := make([]byte, superblockSize)
+	if _, err := fsys.r.ReadAt(rawSB, superblockOffset); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	c := &preChecker{
+		fsys:         fsys,
+		rawSB:        rawSB,
+		metadataCsum: fsys.sb.HasFeature(ext4.MetadataCsum),
+		result:       &PreCheckResult{},
+	}
+	if c.metadataCsum {
+		c.seed = superblockChecksumSeed(rawSB)
+	}
+
+	err := c.checkSuperblock()
+	if err == nil {
+		err = c.checkGroups()
+	}
+	if err != nil && !errors.Is(err, errTooManyProblems) {
+		return nil, err
+	}
+
+	c.result.NeedsCheck = len(c.result.Problems) > 0
+	c.result.Truncated = errors.Is(err, errTooManyProblems)
+
+	return c.result, nil
+}
+
+// preChecker holds the state of a pre-check.
+type preChecker struct {
+	fsys         *FS
+	rawSB        []byte
+	metadataCsum bool
+	seed         uint32
+	result       *PreCheckResult
+}
+
+// problem records a problem, returning errTooManyProblems once enough have
+// been found.
+func (c *preChecker) problem(pass int, inode, block uint64, format string, args ...any) error {
+	c.result.Problems = append(c.result.Problems, ext4.Problem{
+		Pass:        pass,
+		Inode:       inode,
+		Block:       block,
+		Description: fmt.Sprintf(format, args...),
+	})
+	if len(c.result.Problems) >= maxPreCheckProblems {
+		return errTooManyProblems
+	}
+
+	return nil
+}
+
+// checkSuperblock checks the superblock, and the state of the journal.
+func (c *preChecker) checkSuperblock() error {
+	fsys, sb := c.fsys, c.fsys.sb
+	le := binary.LittleEndian
+
+	if c.metadataCsum {
+		buf := bytes.Clone(c.rawSB)
+		setSuperblockChecksum(buf)
+		if !bytes.Equal(buf[0x3FC:], c.rawSB[0x3FC:]) {
+			if err := c.problem(0, 0, 0, "Superblock checksum does not match superblock"); err != nil {
+				return err
+			}
+		}
+	}
+
+	state := le.Uint16(c.rawSB[0x3A:])
+	if state&0x1 == 0 {
+		if err := c.problem(0, 0, 0, "Filesystem was not cleanly unmounted"); err != nil {
+			return err
+		}
+	}
+	if state&0x2 != 0 {
+		if err := c.problem(0, 0, 0, "Filesystem contains errors"); err != nil {
+			return err
+		}
+	}
+
+	want := uint64(0)
+	if sb.BlockSize == 1024 {
+		want = 1
+	}
+	if sb.FirstBlock != want {
+		if err := c.problem(0, 0, 0, "Superblock first_data_block = %d, should have been %d", sb.FirstBlock, want); err != nil {
+			return err
+		}
+	}
+
+	if want := sb.InodesPerGroup * fsys.groupCount(); sb.InodeCount != want {
+		if err := c.problem(0, 0, 0, "Inode count in superblock is %d, should be %d", sb.InodeCount, want); err != nil {
+			return err
+		}
+	}
+
+	// The free counts of the superblock aren't kept up to date while the
+	// filesystem is mounted (e2fsck silently corrects them), so they're only
+	// checked for being out of range.
+	if sb.FreeBlocks > sb.BlockCount {
+		if err := c.problem(0, 0, 0, "Free blocks count in superblock (%d) exceeds the block count (%d)", sb.FreeBlocks, sb.BlockCount); err != nil {
+			return err
+		}
+	}
+	if sb.FreeInodes > sb.InodeCount {
+		if err := c.problem(0, 0, 0, "Free inodes count in superblock (%d) exceeds the inode count (%d)", sb.FreeInodes, sb.InodeCount); err != nil {
+			return err
+		}
+	}
+
+	journal, err := fsys.JournalState()
+	switch {
+	case errors.Is(err, ErrNoJournal):
+	case err != nil:
+		if err := c.problem(0, sb.JournalInode, 0, "Journal superblock is corrupt: %v", err); err != nil {
+			return err
+		}
+	case journal.NeedsRecovery():
+		if err := c.problem(0, 0, 0, "Journal needs recovery"); err != nil {
+			return err
+		}
+	case journal.Errno != 0:
+		if err := c.problem(0, 0, 0, "Journal was aborted (error %d)", journal.Errno); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkGroups checks each block group: its descriptor, its bitmaps and the
+// inodes it holds.
+func (c *preChecker) checkGroups() error {
+	fsys, sb := c.fsys, c.fsys.sb
+	gdtCsum := !c.metadataCsum && sb.HasFeature(ext4.UninitBG)
+	inodeTableBlocks := (sb.InodesPerGroup*uint64(sb.InodeSize) + uint64(fsys.blockSize) - 1) / uint64(fsys.blockSize)
+
+	for group := uint64(0); group < fsys.groupCount(); group++ {
+		desc := fsys.descs[group]
+
+		if c.metadataCsum || gdtCsum {
+			buf := bytes.Clone(desc)
+			if c.metadataCsum {
+				setGroupDescriptorChecksum(buf, c.seed, uint32(group))
+			} else {
+				setGroupDescriptorCrc16(buf, [16]byte(c.rawSB[0x68:0x78]), uint32(group))
+			}
+			if !bytes.Equal(buf[0x1E:0x20], desc[0x1E:0x20]) {
+				if err := c.problem(0, 0, 0, "One or more block group descriptor checksums are invalid (group %d)", group); err != nil {
+					return err
+				}
+			}
+		}
+
+		// The metadata of the group must be within the filesystem, or its
+		// bitmaps can't be read.
+		valid := true
+		for _, field := range []struct {
+			name   string
+			block  uint64
+			blocks uint64
+		}{
+			{"block bitmap", desc.block(descBlockBitmap), 1},
+			{"inode bitmap", desc.block(descInodeBitmap), 1},
+			{"inode table", desc.block(descInodeTable), inodeTableBlocks},
+		} {
+			if field.block < sb.FirstBlock || field.block+field.blocks > sb.BlockCount {
+				valid = false
+				if err := c.problem(0, 0, field.block, "Group descriptor %d has %s at block %d, which is not in the filesystem", group, field.name, field.block); err != nil {
+					return err
+				}
+			}
+		}
+		if !valid {
+			continue
+		}
+
+		if err := c.checkGroup(group); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkGroup checks the counts and checksums of a group descriptor against
+// the bitmaps, and the inodes in use in the group.
+func (c *preChecker) checkGroup(group uint64) error {
+	fsys, sb := c.fsys, c.fsys.sb
+	desc := fsys.descs[group]
+	blocks := fsys.groupBlocks(group)
+
+	blockBitmap, err := fsys.readBlockBitmap(group)
+	if err != nil {
+		return err
+	}
+
+	inodeBitmap, err := fsys.readInodeBitmap(group)
+	if err != nil {
+		return err
+	}
+
+	uninit := desc.flags()
+	if !fsys.uninitGroups() {
+		uninit = 0
+	}
+
+	if c.metadataCsum {
+		if uninit&groupBlockUninit == 0 && desc.count(descBlockBitmapCsum) != c.bitmapChecksum(desc, blockBitmap[:sb.BlocksPerGroup/8]) {
+			if err := c.problem(5, 0, desc.block(descBlockBitmap), "Block bitmap checksum of group %d does not match bitmap", group); err != nil {
+				return err
+			}
+		}
+		if uninit&groupInodeUninit == 0 && desc.count(descInodeBitmapCsum) != c.bitmapChecksum(desc, inodeBitmap[:sb.InodesPerGroup/8]) {
+			if err := c.problem(5, 0, desc.block(descInodeBitmap), "Inode bitmap checksum of group %d does not match bitmap", group); err != nil {
+				return err
+			}
+		}
+	}
+
+	if free, counted := uint64(desc.count(descFreeBlocks)), blocks-countBits(blockBitmap, blocks); free != counted {
+		if err := c.problem(5, 0, 0, "Free blocks count wrong for group #%d (%d, counted=%d)", group, free, counted); err != nil {
+			return err
+		}
+	}
+
+	if free, counted := uint64(desc.count(descFreeInodes)), sb.InodesPerGroup-countBits(inodeBitmap, sb.InodesPerGroup); free != counted {
+		if err := c.problem(5, 0, 0, "Free inodes count wrong for group #%d (%d, counted=%d)", group, free, counted); err != nil {
+			return err
+		}
+	}
+
+	if uninit&groupInodeUninit != 0 {
+		return nil
+	}
+
+	// The inodes past the last one in use (as recorded in the descriptor)
+	// aren't initialized, so only the start of the inode table is read.
+	used := sb.InodesPerGroup
+	if fsys.uninitGroups() {
+		unused := uint64(desc.count(descItableUnused))
+		if unused > sb.InodesPerGroup {
+			return c.problem(5, 0, 0, "Group descriptor %d has invalid unused inodes count %d", group, unused)
+		}
+		used -= unused
+	}
+
+	for index := used; index < sb.InodesPerGroup; index++ {
+		if inodeBitmap[index/8]&(1<<(index%8)) != 0 {
+			number := group*sb.InodesPerGroup + index + 1
+			if err := c.problem(5, number, 0, "Inode %d is in use, but group %d's unused inodes count is %d", number, group, sb.InodesPerGroup-used); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	table := make([]byte, used*uint64(sb.InodeSize))
+	if _, err := fsys.r.ReadAt(table, int64(desc.block(descInodeTable))*fsys.blockSize); err != nil {
+		return fmt.Errorf("failed to read inode table of group %d: %w", group, err)
+	}
+
+	var dirs uint64
+	for index := uint64(0); index < used; index++ {
+		if inodeBitmap[index/8]&(1<<(index%8)) == 0 {
+			continue
+		}
+
+		number := group*sb.InodesPerGroup + index + 1
+		buf := table[index*uint64(sb.InodeSize):][:sb.InodeSize]
+		if binary.LittleEndian.Uint16(buf)&typeMask == typeDir {
+			dirs++
+		}
+
+		// Reserved inodes (other than the root directory and the journal)
+		// have special formats.
+		if number < sb.FirstInode && number != rootInode && number != sb.JournalInode {
+			continue
+		}
+
+		if err := c.checkInode(uint32(number), buf); err != nil {
+			return err
+		}
+	}
+
+	if counted := uint64(desc.count(descUsedDirs)); dirs != counted {
+		if err := c.problem(5, 0, 0, "Directories count wrong for group #%d (%d, counted=%d)", group, counted, dirs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bitmapChecksum returns the checksum of a bitmap, truncated to the size of
+// the checksum fields of a group descriptor.
+func (c *preChecker) bitmapChecksum(desc groupDesc, bitmap []byte) uint32 {
+	crc := crc32c(c.seed, bitmap)
+	if len(desc) < 64 {
+		crc &= 0xFFFF
+	}
+
+	return crc
+}
+
+// checkInode checks an inode in use for obvious corruption.
+func (c *preChecker) checkInode(number uint32, buf []byte) error {
+	sb := c.fsys.sb
+	le := binary.LittleEndian
+
+	if c.metadataCsum {
+		want := bytes.Clone(buf)
+		setInodeChecksum(want, c.seed, number)
+		if !bytes.Equal(want, buf) {
+			return c.problem(1, uint64(number), 0, "Inode %d passes checks, but checksum does not match inode", number)
+		}
+	}
+
+	ino, err := decodeInode(buf)
+	if err != nil {
+		return c.problem(1, uint64(number), 0, "Inode %d is corrupt: %v", number, err)
+	}
+
+	typ := ino.RawMode & typeMask
+	switch typ {
+	case typeFIFO, typeChar, typeDir, typeBlock, typeRegular, typeSymlink, typeSocket:
+	default:
+		return c.problem(1, uint64(number), 0, "Inode %d has invalid mode (0%o)", number, ino.RawMode)
+	}
+
+	if number == rootInode && typ != typeDir {
+		return c.problem(1, uint64(number), 0, "Root inode is not a directory")
+	}
+
+	if ino.Links == 0 {
+		return c.problem(1, uint64(number), 0, "Inode %d is in use, but has a zero link count", number)
+	}
+
+	if typ == typeDir && ino.Size == 0 {
+		return c.problem(1, uint64(number), 0, "Inode %d is a zero-length directory", number)
+	}
+
+	// Check the blocks referenced by the inode itself (not the blocks of its
+	// extent tree or indirect blocks).
+	inFS := func(block, count uint64) bool {
+		return block >= sb.FirstBlock && block+count <= sb.BlockCount
+	}
+
+	if ino.XattrBlock != 0 && !inFS(ino.XattrBlock, 1) {
+		return c.problem(1, uint64(number), ino.XattrBlock, "Inode %d has a bad extended attribute block %d", number, ino.XattrBlock)
+	}
+
+	switch {
+	case ino.Flags&flagInlineData != 0:
+	case typ == typeChar || typ == typeBlock || typ == typeFIFO || typ == typeSocket:
+	case typ == typeSymlink && ino.Flags&flagExtents == 0 && ino.Size < uint64(len(ino.block)):
+		// Fast symlinks store their target in the inode.
+	case ino.Flags&flagExtents != 0:
+		node := ino.block[:]
+		entries := int(le.Uint16(node[0x2:]))
+		depth := int(le.Uint16(node[0x6:]))
+		if le.Uint16(node) != extentMagic || entries > int(le.Uint16(node[0x4:])) || 12+entries*12 > len(node) || depth > maxExtentDepth {
+			return c.problem(1, uint64(number), 0, "Inode %d has corrupt extent header", number)
+		}
+
+		for i := 0; i < entries; i++ {
+			entry := node[12+i*12:]
+
+			block, count := uint64(le.Uint32(entry[0x4:]))|uint64(le.Uint16(entry[0x8:]))<<32, uint64(1)
+			if depth == 0 {
+				block = uint64(le.Uint16(entry[0x6:]))<<32 | uint64(le.Uint32(entry[0x8:]))
+				if count = uint64(le.Uint16(entry[0x4:])); count > uninitExtentLength {
+					count -= uninitExtentLength
+				}
+			}
+
+			if !inFS(block, count) {
+				return c.problem(1, uint64(number), block, "Inode %d has an invalid extent (physical block %d, len %d)", number, block, count)
+			}
+		}
+	default:
+		for i := 0; i < len(ino.block)/4; i++ {
+			if block := uint64(le.Uint32(ino.block[i*4:])); block != 0 && !inFS(block, 1) {
+				return c.problem(1, uint64(number), block, "Inode %d has illegal block %d", number, block)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,589 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dpeckett/ext4"
+)
+
+// resizeInode is the inode number of the resize inode, which reserves the
+// blocks the group descriptors can grow into.
+const resizeInode = 7
+
+// resizeUnsupportedFeatures are features that change the layout of the
+// group descriptors and backup superblocks in ways Resize can't maintain.
+var resizeUnsupportedFeatures = []ext4.Feature{ext4.MetaBG, ext4.SparseSuper2}
+
+var (
+	// ErrNeedsCheck is returned when a filesystem must be checked with e2fsck
+	// before it can be resized (see PreCheck).
+	ErrNeedsCheck = errors.New("filesystem needs to be checked")
+	// ErrShrinkInUse is returned when shrinking a filesystem would remove
+	// blocks or inodes that are in use (they aren't moved).
+	ErrShrinkInUse = errors.New("blocks or inodes to be removed are in use")
+)
+
+// ResizeFile resizes the filesystem in an (unmounted) image file to the given
+// size in bytes (see Resize), growing or truncating the file to match. If
+// size is zero, the filesystem is grown to fill the file.
+func ResizeFile(path string, size int64) (*ext4.ResizeResult, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fileSize := info.Size()
+	if size == 0 {
+		size = fileSize
+	}
+
+	if size > fileSize {
+		if err := f.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := Resize(f, size)
+	if err != nil {
+		if size > fileSize {
+			_ = f.Truncate(fileSize)
+		}
+		return nil, err
+	}
+
+	if size < fileSize {
+		if err := f.Truncate(size); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	return result, f.Close()
+}
+
+// Resize grows or shrinks the (unmounted) filesystem stored in rw to the
+// given size in bytes, without running resize2fs (eg. in image pipelines on
+// other operating systems). When growing, rw must already be at least size
+// bytes long. As with resize2fs, the last block group is dropped if there's
+// hardly any room for data in it, so the filesystem may be slightly smaller
+// than requested.
+//
+// Resizing is conservative: the filesystem must pass PreCheck (otherwise
+// ErrNeedsCheck is returned), it can only grow as far as the group
+// descriptor blocks reserved by the resize inode allow, and it can only
+// shrink by removing free space at its end (otherwise ErrShrinkInUse is
+// returned), as files aren't moved. Filesystems with the meta_bg or
+// sparse_super2 features, or with features the Writer can't maintain, aren't
+// supported.
+func Resize(rw ReadWriterAt, size int64) (*ext4.ResizeResult, error) {
+	w, err := openWriter(rw, WriterOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, feature := range resizeUnsupportedFeatures {
+		if w.sb.HasFeature(feature) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupported, feature)
+		}
+	}
+
+	check, err := w.PreCheck()
+	if err != nil {
+		return nil, err
+	}
+	if check.NeedsCheck {
+		return nil, fmt.Errorf("%w: %s", ErrNeedsCheck, check.Problems[0].Description)
+	}
+
+	r := &resizer{
+		Writer:           w,
+		inodeTableBlocks: (w.sb.InodesPerGroup*uint64(w.sb.InodeSize) + uint64(w.blockSize) - 1) / uint64(w.blockSize),
+	}
+	r.descBlocks = r.descBlocksFor(w.groupCount())
+
+	result := &ext4.ResizeResult{
+		OldBlockCount: w.sb.BlockCount,
+		BlockSize:     w.sb.BlockSize,
+	}
+
+	blocks, err := r.blockCount(size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case blocks > w.sb.BlockCount:
+		err = r.grow(blocks)
+	case blocks < w.sb.BlockCount:
+		err = r.shrink(blocks)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.NewBlockCount = w.sb.BlockCount
+
+	return result, nil
+}
+
+// resizer resizes a filesystem.
+type resizer struct {
+	*Writer
+	// descBlocks is the number of blocks of group descriptors (they are
+	// followed by the reserved group descriptor blocks).
+	descBlocks uint64
+	// inodeTableBlocks is the number of blocks of each inode table.
+	inodeTableBlocks uint64
+}
+
+// descBlocksFor returns the number of blocks of group descriptors of a
+// filesystem with the given number of block groups.
+func (r *resizer) descBlocksFor(groups uint64) uint64 {
+	descPerBlock := uint64(r.blockSize) / uint64(r.descSize)
+	return (groups + descPerBlock - 1) / descPerBlock
+}
+
+// hasSuperblock returns true if a block group holds a backup of the
+// superblock and group descriptors.
+func (r *resizer) hasSuperblock(group uint64) bool {
+	return group == 0 || !r.sb.HasFeature(ext4.SparseSuper) || hasSuperblock(group)
+}
+
+// gdtBlocks returns the number of blocks of group descriptors, and reserved
+// group descriptor blocks, following each superblock. Resizing moves blocks
+// between the two, but doesn't change their total.
+func (r *resizer) gdtBlocks() uint64 {
+	return r.descBlocks + r.sb.ReservedGDTBlocks
+}
+
+// overhead returns the number of metadata blocks of a block group, if its
+// bitmaps and inode table are stored in the group.
+func (r *resizer) overhead(group uint64) uint64 {
+	overhead := 2 + r.inodeTableBlocks
+	if r.hasSuperblock(group) {
+		overhead += 1 + r.gdtBlocks()
+	}
+
+	return overhead
+}
+
+// blockCount returns the block count of the resized filesystem.
+func (r *resizer) blockCount(size int64) (uint64, error) {
+	if size <= 0 {
+		return 0, fmt.Errorf("%w: invalid filesystem size %d", ext4.ErrInvalidOptions, size)
+	}
+
+	blocks := uint64(size / r.blockSize)
+	if !r.sb.HasFeature(ext4.Has64Bit) && blocks > 1<<32-1 {
+		return 0, fmt.Errorf("%w: filesystem size %d is too large without the 64bit feature", ext4.ErrInvalidOptions, size)
+	}
+
+	for {
+		if blocks <= r.sb.FirstBlock {
+			return 0, fmt.Errorf("%w: filesystem size %d is too small", ext4.ErrInvalidOptions, size)
+		}
+		groups := (blocks - r.sb.FirstBlock + r.sb.BlocksPerGroup - 1) / r.sb.BlocksPerGroup
+
+		// Drop the last group if there's hardly any room for data in it.
+		last := groups - 1
+		start := r.sb.FirstBlock + last*r.sb.BlocksPerGroup
+		if blocks-start < r.overhead(last)+minLastGroupBlocks {
+			if last == 0 {
+				return 0, fmt.Errorf("%w: filesystem size %d is too small", ext4.ErrInvalidOptions, size)
+			}
+			blocks = start
+			continue
+		}
+
+		if r.descBlocksFor(groups) > r.gdtBlocks() {
+			return 0, fmt.Errorf("%w: %d block groups need more group descriptor blocks than are reserved", ErrUnsupported, groups)
+		}
+
+		if groups*r.sb.InodesPerGroup > 1<<32-1 {
+			return 0, fmt.Errorf("%w: filesystem size %d has too many inodes", ext4.ErrInvalidOptions, size)
+		}
+
+		return blocks, nil
+	}
+}
+
+// grow adds blocks (and block groups) to the end of the filesystem.
+func (r *resizer) grow(blocks uint64) error {
+	oldGroups := r.groupCount()
+
+	// The bitmap of the last group is initialized before its size changes.
+	last := oldGroups - 1
+	lastBlocks := r.groupBlocks(last)
+	bitmap, err := r.blockBitmap(last)
+	if err != nil {
+		return err
+	}
+
+	// Any group descriptor blocks needed are taken from the reserved blocks
+	// that follow them (they are already allocated, in each group holding a
+	// superblock).
+	r.setBlockCount(blocks, r.gdtBlocks())
+
+	// The last group is extended to its full size (or the new end of the
+	// filesystem).
+	if newLastBlocks := r.groupBlocks(last); newLastBlocks > lastBlocks {
+		clearBits(bitmap, lastBlocks, newLastBlocks)
+		desc := r.descs[last]
+		desc.setCount(descFreeBlocks, desc.count(descFreeBlocks)+uint32(newLastBlocks-lastBlocks))
+		r.dirty[last] = true
+	}
+
+	for group := oldGroups; group < r.groupCount(); group++ {
+		if err := r.addGroup(group); err != nil {
+			return err
+		}
+	}
+
+	if err := r.writeResizeInode(); err != nil {
+		return err
+	}
+
+	return r.finish()
+}
+
+// addGroup adds a new, empty block group, with its bitmaps and inode table
+// stored at its start (after the backup superblock and group descriptors, if
+// any).
+func (r *resizer) addGroup(group uint64) error {
+	start, blocks := r.groupStart(group), r.groupBlocks(group)
+	metadata := start + r.overhead(group) - 2 - r.inodeTableBlocks
+
+	desc := make(groupDesc, r.descSize)
+	desc.setBlock(descBlockBitmap, metadata)
+	desc.setBlock(descInodeBitmap, metadata+1)
+	desc.setBlock(descInodeTable, metadata+2)
+	desc.setCount(descFreeBlocks, uint32(blocks-r.overhead(group)))
+	desc.setCount(descFreeInodes, uint32(r.sb.InodesPerGroup))
+
+	blockBitmap := make([]byte, r.blockSize)
+	setBits(blockBitmap, 0, r.overhead(group))
+	setBits(blockBitmap, blocks, uint64(len(blockBitmap))*8)
+
+	inodeBitmap := make([]byte, r.blockSize)
+	setBits(inodeBitmap, r.sb.InodesPerGroup, uint64(len(inodeBitmap))*8)
+
+	// The inode tables of uninitialized groups are zeroed by the kernel when
+	// the filesystem is first mounted (as with the lazy_itable_init option of
+	// mke2fs), otherwise they're zeroed now.
+	if r.uninitGroups() {
+		desc.setFlags(groupInodeUninit)
+		desc.setCount(descItableUnused, uint32(r.sb.InodesPerGroup))
+	} else if err := r.zeroBlocks(metadata+2, r.inodeTableBlocks); err != nil {
+		return err
+	}
+
+	descPerBlock := uint64(r.blockSize) / uint64(r.descSize)
+	offset := int64(r.sb.FirstBlock+1+group/descPerBlock)*r.blockSize + int64(group%descPerBlock)*int64(r.descSize)
+
+	r.descs = append(r.descs, desc)
+	r.descOffsets = append(r.descOffsets, offset)
+	r.blockBitmaps[group] = blockBitmap
+	r.inodeBitmaps[group] = inodeBitmap
+	r.dirty[group] = true
+
+	return nil
+}
+
+// shrink removes blocks (and block groups) from the end of the filesystem,
+// provided they're free.
+func (r *resizer) shrink(blocks uint64) error {
+	oldGroups := r.groupCount()
+	groups := (blocks - r.sb.FirstBlock + r.sb.BlocksPerGroup - 1) / r.sb.BlocksPerGroup
+
+	// The metadata of the groups removed is removed with them.
+	removed := func(block uint64) bool {
+		for group := groups; group < oldGroups; group++ {
+			desc := r.descs[group]
+			switch start := r.groupStart(group); {
+			case r.hasSuperblock(group) && block >= start && block <= start+r.gdtBlocks(),
+				block == desc.block(descBlockBitmap),
+				block == desc.block(descInodeBitmap),
+				block >= desc.block(descInodeTable) && block < desc.block(descInodeTable)+r.inodeTableBlocks:
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for group := groups; group < oldGroups; group++ {
+		inodeBitmap, err := r.readInodeBitmap(group)
+		if err != nil {
+			return err
+		}
+		if countBits(inodeBitmap, r.sb.InodesPerGroup) != 0 {
+			return fmt.Errorf("%w: block group %d has inodes in use", ErrShrinkInUse, group)
+		}
+
+		blockBitmap, err := r.readBlockBitmap(group)
+		if err != nil {
+			return err
+		}
+		start := r.groupStart(group)
+		for bit := uint64(0); bit < r.groupBlocks(group); bit++ {
+			if blockBitmap[bit/8]&(1<<(bit%8)) != 0 && !removed(start+bit) {
+				return fmt.Errorf("%w: block %d", ErrShrinkInUse, start+bit)
+			}
+		}
+	}
+
+	last := groups - 1
+	lastStart, lastBlocks := r.groupStart(last), r.groupBlocks(last)
+	bitmap, err := r.blockBitmap(last)
+	if err != nil {
+		return err
+	}
+	newLastBlocks := min(lastBlocks, blocks-lastStart)
+	for bit := newLastBlocks; bit < lastBlocks; bit++ {
+		if bitmap[bit/8]&(1<<(bit%8)) != 0 {
+			return fmt.Errorf("%w: block %d", ErrShrinkInUse, lastStart+bit)
+		}
+	}
+
+	// Release the metadata of the groups removed that is stored in the
+	// groups kept (with flex_bg).
+	for group := groups; group < oldGroups; group++ {
+		desc := r.descs[group]
+		for _, run := range []struct{ block, count uint64 }{
+			{desc.block(descBlockBitmap), 1},
+			{desc.block(descInodeBitmap), 1},
+			{desc.block(descInodeTable), r.inodeTableBlocks},
+		} {
+			for block := run.block; block < min(run.block+run.count, blocks); block++ {
+				if err := r.freeBlocks(block, 1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Group descriptor blocks no longer needed are returned to the reserve
+	// of the resize inode (as by resize2fs), or released if it's full.
+	descBlocks := r.descBlocksFor(groups)
+	gdtBlocks := r.gdtBlocks()
+	if !r.sb.HasFeature(ext4.ResizeInode) {
+		gdtBlocks = descBlocks
+	}
+	gdtBlocks = min(gdtBlocks, descBlocks+uint64(r.blockSize)/4)
+	if excess := r.gdtBlocks() - gdtBlocks; excess > 0 {
+		for group := uint64(0); group < groups; group++ {
+			if r.hasSuperblock(group) {
+				if err := r.freeBlocks(r.groupStart(group)+1+gdtBlocks, excess); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	r.setBlockCount(blocks, gdtBlocks)
+
+	setBits(bitmap, newLastBlocks, uint64(len(bitmap))*8)
+	desc := r.descs[last]
+	desc.setCount(descFreeBlocks, desc.count(descFreeBlocks)-uint32(lastBlocks-newLastBlocks))
+	r.dirty[last] = true
+
+	r.descs = r.descs[:groups]
+	r.descOffsets = r.descOffsets[:groups]
+	for group := groups; group < oldGroups; group++ {
+		delete(r.blockBitmaps, group)
+		delete(r.inodeBitmaps, group)
+		delete(r.dirty, group)
+	}
+
+	if err := r.writeResizeInode(); err != nil {
+		return err
+	}
+
+	return r.finish()
+}
+
+// setBlockCount updates the block count of the superblock, and the counts
+// that depend on it (the reserved block count is scaled, as by resize2fs).
+// gdtBlocks is the number of blocks of group descriptors and reserved group
+// descriptor blocks following each superblock.
+func (r *resizer) setBlockCount(blocks, gdtBlocks uint64) {
+	le := binary.LittleEndian
+	has64Bit := r.sb.HasFeature(ext4.Has64Bit)
+
+	reserved := uint64(float64(r.sb.ReservedBlockCount) * float64(blocks) / float64(r.sb.BlockCount))
+
+	r.sb.BlockCount = blocks
+	r.sb.ReservedBlockCount = reserved
+	r.sb.InodeCount = r.groupCount() * r.sb.InodesPerGroup
+	r.descBlocks = r.descBlocksFor(r.groupCount())
+	r.sb.ReservedGDTBlocks = gdtBlocks - r.descBlocks
+
+	le.PutUint32(r.rawSB[0x0:], uint32(r.sb.InodeCount))
+	le.PutUint32(r.rawSB[0x4:], uint32(blocks))
+	le.PutUint32(r.rawSB[0x8:], uint32(reserved))
+	le.PutUint16(r.rawSB[0xCE:], uint16(r.sb.ReservedGDTBlocks))
+	if has64Bit {
+		le.PutUint32(r.rawSB[0x150:], uint32(blocks>>32))
+		le.PutUint32(r.rawSB[0x154:], uint32(reserved>>32))
+	}
+
+	r.superGroups = map[uint64]bool{0: true}
+	for _, block := range r.sb.BackupSuperblocks() {
+		r.superGroups[(block-r.sb.FirstBlock)/r.sb.BlocksPerGroup] = true
+	}
+}
+
+// writeResizeInode rewrites the resize inode (as mke2fs creates it), for the
+// reserved group descriptor blocks and backup superblocks of the resized
+// filesystem. Its double indirect block lists the reserved blocks following
+// the primary group descriptors, each of which lists its backups in the
+// other groups holding a superblock.
+func (r *resizer) writeResizeInode() error {
+	if !r.sb.HasFeature(ext4.ResizeInode) {
+		return nil
+	}
+
+	le := binary.LittleEndian
+	perBlock := uint64(r.blockSize) / 4
+
+	ino, err := r.inode(resizeInode)
+	if err != nil {
+		return err
+	}
+
+	dind := uint64(le.Uint32(ino.block[13*4:]))
+	if dind == 0 {
+		return fmt.Errorf("%w: resize inode without a double indirect block", ErrUnsupported)
+	}
+
+	var backups []uint64
+	for group := uint64(1); group < r.groupCount(); group++ {
+		if r.superGroups[group] {
+			backups = append(backups, group)
+		}
+	}
+	if uint64(len(backups)) > perBlock {
+		return fmt.Errorf("%w: too many backup superblocks for the resize inode", ErrUnsupported)
+	}
+
+	dindBuf := make([]byte, r.blockSize)
+	for i := uint64(0); i < r.sb.ReservedGDTBlocks; i++ {
+		block := r.sb.FirstBlock + 1 + r.descBlocks + i
+		le.PutUint32(dindBuf[(r.descBlocks+i)%perBlock*4:], uint32(block))
+
+		indBuf := make([]byte, r.blockSize)
+		for j, group := range backups {
+			le.PutUint32(indBuf[j*4:], uint32(block+group*r.sb.BlocksPerGroup))
+		}
+		if _, err := r.w.WriteAt(indBuf, int64(block)*r.blockSize); err != nil {
+			return fmt.Errorf("failed to write reserved group descriptor block %d: %w", block, err)
+		}
+	}
+
+	if _, err := r.w.WriteAt(dindBuf, int64(dind)*r.blockSize); err != nil {
+		return fmt.Errorf("failed to write block %d of the resize inode: %w", dind, err)
+	}
+
+	ino.Blocks = (1 + r.sb.ReservedGDTBlocks*uint64(1+len(backups))) * uint64(r.blockSize/512)
+
+	return r.writeInode(ino, false)
+}
+
+// finish updates the free counts of the superblock, and writes the bitmaps,
+// group descriptors and superblock (and their backups).
+func (r *resizer) finish() error {
+	var freeBlocks, freeInodes uint64
+	for _, desc := range r.descs {
+		freeBlocks += uint64(desc.count(descFreeBlocks))
+		freeInodes += uint64(desc.count(descFreeInodes))
+	}
+	r.addFreeBlocks(int64(freeBlocks - r.sb.FreeBlocks))
+	r.addFreeInodes(int64(freeInodes - r.sb.FreeInodes))
+
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	// The group descriptor blocks are written whole, clearing the
+	// descriptors of any groups removed.
+	gdt := make([]byte, r.descBlocks*uint64(r.blockSize))
+	for group, desc := range r.descs {
+		copy(gdt[group*r.descSize:], desc)
+	}
+
+	if _, err := r.w.WriteAt(gdt, int64(r.sb.FirstBlock+1)*r.blockSize); err != nil {
+		return fmt.Errorf("failed to write group descriptors: %w", err)
+	}
+
+	for group := uint64(1); group < r.groupCount(); group++ {
+		if !r.superGroups[group] {
+			continue
+		}
+		start := int64(r.groupStart(group)) * r.blockSize
+
+		sb := bytes.Clone(r.rawSB)
+		binary.LittleEndian.PutUint16(sb[0x5A:], uint16(group))
+		if r.metadataCsum {
+			setSuperblockChecksum(sb)
+		}
+
+		if _, err := r.w.WriteAt(sb, start); err != nil {
+			return fmt.Errorf("failed to write backup superblock of group %d: %w", group, err)
+		}
+		if _, err := r.w.WriteAt(gdt, start+r.blockSize); err != nil {
+			return fmt.Errorf("failed to write backup group descriptors of group %d: %w", group, err)
+		}
+	}
+
+	return nil
+}
+
+// zeroBlocks writes zeros to a run of blocks.
+func (r *resizer) zeroBlocks(block, count uint64) error {
+	zeros := make([]byte, min(count, 256)*uint64(r.blockSize))
+	for count > 0 {
+		n := min(count, uint64(len(zeros))/uint64(r.blockSize))
+		if _, err := r.w.WriteAt(zeros[:n*uint64(r.blockSize)], int64(block)*r.blockSize); err != nil {
+			return fmt.Errorf("failed to zero block %d: %w", block, err)
+		}
+		block, count = block+n, count-n
+	}
+
+	return nil
+}
+
+// clearBits clears the bits [start, end) of a bitmap.
+func clearBits(bitmap []byte, start, end uint64) {
+	for bit := start; bit < end; bit++ {
+		bitmap[bit/8] &^= 1 << (bit % 8)
+	}
+}
@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/dpeckett/ext4"
+)
+
+// GroupUsage is the allocation of a block group, counted from its bitmaps.
+type GroupUsage struct {
+	// Number of the block group.
+	Number uint64 `json:"number"`
+	// Blocks spanned by the block group.
+	Blocks ext4.Range `json:"blocks"`
+	// FreeBlocks is the number of free blocks in the group.
+	FreeBlocks uint64 `json:"freeBlocks"`
+	// FreeInodes is the number of free inodes in the group.
+	FreeInodes uint64 `json:"freeInodes"`
+}
+
+// GroupUsage counts the free blocks and inodes of each block group from the
+// block and inode bitmaps, rather than trusting the counts stored in the
+// group descriptors (as dumpe2fs reports them). Blocks allocated by
+// transactions still in the journal are counted as free (see JournalState).
+func (fsys *FS) GroupUsage() ([]GroupUsage, error) {
+	groups := make([]GroupUsage, fsys.groupCount())
+	err := fsys.scanBitmaps(func(group uint64, blockBitmap, inodeBitmap []byte) error {
+		start := fsys.groupStart(group)
+		groups[group] = GroupUsage{
+			Number:     group,
+			Blocks:     ext4.Range{Start: start, End: start + fsys.groupBlocks(group) - 1},
+			FreeBlocks: fsys.groupBlocks(group) - countBits(blockBitmap, fsys.groupBlocks(group)),
+			FreeInodes: fsys.sb.InodesPerGroup - countBits(inodeBitmap, fsys.sb.InodesPerGroup),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// FreeBlocks returns the number of free blocks, counted from the block
+// bitmaps.
+func (fsys *FS) FreeBlocks() (uint64, error) {
+	groups, err := fsys.GroupUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	for _, group := range groups {
+		free += group.FreeBlocks
+	}
+
+	return free, nil
+}
+
+// UsedBlocks returns the number of allocated blocks, counted from the block
+// bitmaps (including any blocks before the first block group, eg. the boot
+// block of filesystems with 1KiB blocks).
+func (fsys *FS) UsedBlocks() (uint64, error) {
+	free, err := fsys.FreeBlocks()
+	if err != nil {
+		return 0, err
+	}
+
+	return fsys.sb.BlockCount - free, nil
+}
+
+// FreeInodes returns the number of free inodes, counted from the inode
+// bitmaps.
+func (fsys *FS) FreeInodes() (uint64, error) {
+	groups, err := fsys.GroupUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	for _, group := range groups {
+		free += group.FreeInodes
+	}
+
+	return free, nil
+}
+
+// AllocationMap returns the ranges of allocated blocks (in order, and merged
+// across block groups), eg. to copy or upload only the blocks of an image
+// that are in use. Blocks before the first block group are included, as they
+// hold the boot block (and primary superblock).
+func (fsys *FS) AllocationMap() ([]ext4.Range, error) {
+	var ranges []ext4.Range
+	for block := uint64(0); block < fsys.sb.FirstBlock; block++ {
+		ranges = appendBlock(ranges, block)
+	}
+
+	err := fsys.scanBitmaps(func(group uint64, blockBitmap, _ []byte) error {
+		start := fsys.groupStart(group)
+		for bit := uint64(0); bit < fsys.groupBlocks(group); bit++ {
+			if blockBitmap[bit/8]&(1<<(bit%8)) != 0 {
+				ranges = appendBlock(ranges, start+bit)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
+
+// scanBitmaps calls fn with the block and inode bitmaps of each block group.
+func (fsys *FS) scanBitmaps(fn func(group uint64, blockBitmap, inodeBitmap []byte) error) error {
+	// Bitmaps of clusters aren't supported.
+	if fsys.sb.HasFeature(ext4.Bigalloc) {
+		return fmt.Errorf("%w: %s", ErrUnsupported, ext4.Bigalloc)
+	}
+
+	for group := uint64(0); group < fsys.groupCount(); group++ {
+		blockBitmap, err := fsys.readBlockBitmap(group)
+		if err != nil {
+			return err
+		}
+
+		inodeBitmap, err := fsys.readInodeBitmap(group)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(group, blockBitmap, inodeBitmap); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countBits returns the number of bits set in the first n bits of a bitmap.
+func countBits(bitmap []byte, n uint64) uint64 {
+	var count int
+	for _, b := range bitmap[:n/8] {
+		count += bits.OnesCount8(b)
+	}
+	if rest := n % 8; rest != 0 {
+		count += bits.OnesCount8(bitmap[n/8] & (1<<rest - 1))
+	}
+
+	return uint64(count)
+}
+
+// appendBlock appends a block to an ordered list of ranges, extending the
+// last range if the block follows it.
+func appendBlock(ranges []ext4.Range, block uint64) []ext4.Range {
+	if last := len(ranges) - 1; last >= 0 && ranges[last].End+1 == block {
+		ranges[last].End = block
+		return ranges
+	}
+
+	return append(ranges, ext4.Range{Start: block, End: block})
+}
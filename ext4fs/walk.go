@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// WalkFunc is called by Walk for each file, with its path (relative to the
+// root of the filesystem, which is ".") and inode.
+//
+// As with fs.WalkDirFunc, returning fs.SkipDir from a directory skips its
+// contents, and fs.SkipAll stops the walk. If a directory can't be read, the
+// function is called a second time for it with the error. If the inode of an
+// entry can't be read, the function is called with a nil inode and the error.
+// If an entry refers to a directory that has already been visited (eg. one
+// containing it, which would otherwise be walked forever), the function is
+// called with its inode and an error wrapping ErrCorrupt, and the directory
+// isn't walked again.
+type WalkFunc func(path string, ino *Inode, err error) error
+
+// Walk walks the directory tree of the filesystem, calling fn for each file
+// (including the root directory), in lexical order within each directory.
+// Symbolic links aren't followed. Files with multiple hard links are visited
+// once per link.
+func (fsys *FS) Walk(fn WalkFunc) error {
+	root, err := fsys.inode(rootInode)
+	if err != nil {
+		err = fn(".", nil, err)
+	} else {
+		err = fsys.walk(".", root, map[uint32]bool{}, fn)
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+
+	return err
+}
+
+// walk walks a directory tree, visited holds the inode numbers of the
+// directories walked so far (directories only have a single link, besides
+// "." and "..", unless the filesystem is corrupt).
+func (fsys *FS) walk(name string, ino *Inode, visited map[uint32]bool, fn WalkFunc) error {
+	if ino.IsDir() {
+		visited[ino.Number] = true
+	}
+
+	if err := fn(name, ino, nil); err != nil || !ino.IsDir() {
+		if errors.Is(err, fs.SkipDir) && ino.IsDir() {
+			// Successfully skipped the directory.
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.readDir(ino)
+	if err != nil {
+		// Give the function a chance to handle the error.
+		if err := fn(name, ino, err); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, entry := range entries {
+		childName := path.Join(name, entry.name)
+
+		child, err := fsys.inode(entry.inode)
+		if err != nil {
+			if err := fn(childName, nil, err); err != nil {
+				if errors.Is(err, fs.SkipDir) {
+					break
+				}
+				return err
+			}
+			continue
+		}
+
+		if child.IsDir() && visited[child.Number] {
+			err := fmt.Errorf("%w: directory %d is linked more than once", ErrCorrupt, child.Number)
+			// The directory isn't walked again anyway.
+			if err := fn(childName, child, err); err != nil && !errors.Is(err, fs.SkipDir) {
+				return err
+			}
+			continue
+		}
+
+		if err := fsys.walk(childName, child, visited, fn); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,970 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/ext4"
+)
+
+const (
+	// maxNameLen is the maximum length of a file name.
+	maxNameLen = 255
+	// maxLinks is the maximum number of hard links to an inode (with the
+	// dir_nlink feature, directories with more subdirectories have a link
+	// count of one).
+	maxLinks = 65000
+	// maxExtentLeaves is the maximum number of leaf blocks of the extent
+	// trees written by this package (which are at most one level deep).
+	maxExtentLeaves = 4
+)
+
+// writerUnsupportedFeatures are features that the Writer can't maintain
+// (in addition to those that can't be read at all).
+var writerUnsupportedFeatures = []string{
+	string(ext4.Bigalloc), string(ext4.Quota), string(ext4.EAInode),
+	"needs_recovery", "orphan_present", "read-only", "shared_blocks",
+}
+
+var (
+	// ErrNoSpace is returned when there aren't enough free blocks or inodes
+	// left in the filesystem.
+	ErrNoSpace = errors.New("no space left on device")
+	// errIsDir is returned when a directory would be replaced by a file.
+	errIsDir = errors.New("is a directory")
+)
+
+// ReadWriterAt is the storage of a filesystem opened for writing (eg. an
+// *os.File of a device or image file opened with os.O_RDWR).
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// WriterOptions are the options of OpenWriter.
+type WriterOptions struct {
+	// Time, if set, is used for the timestamps of the files written (and of
+	// the filesystem) instead of the current time (eg. for reproducible
+	// images).
+	Time time.Time
+}
+
+// Writer adds and replaces files in an existing (unmounted) filesystem, eg.
+// to tweak an image after it is built, without mounting it or running
+// debugfs. It embeds the FS of the filesystem, so that files can also be read.
+//
+// Each change is written to the filesystem (blocks, inodes, bitmaps, group
+// descriptors and superblock, with their checksums) before the method making
+// it returns. Changes are not journaled, and directories indexed with hashed
+// B-trees (htree) or stored inline can't be modified. A Writer isn't safe for
+// concurrent use.
+type Writer struct {
+	*FS
+	w    io.WriterAt
+	opts WriterOptions
+	// rawSB is the primary superblock, as stored on disk.
+	rawSB []byte
+	// blockBitmaps and inodeBitmaps are the bitmaps of the block groups that
+	// have been loaded.
+	blockBitmaps map[uint64][]byte
+	inodeBitmaps map[uint64][]byte
+	// dirty are the block groups whose descriptors (and bitmaps) need to be
+	// written.
+	dirty map[uint64]bool
+	// seed is the seed of the metadata checksums.
+	seed         uint32
+	metadataCsum bool
+	// gdtCsum is true if the group descriptors are checksummed with CRC16
+	// (with the uninit_bg feature, and without metadata_csum).
+	gdtCsum     bool
+	hasFileType bool
+}
+
+// OpenWriter opens the filesystem stored in rw for writing.
+func OpenWriter(rw ReadWriterAt, opts WriterOptions) (*Writer, error) {
+	w, err := openWriter(rw, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !w.sb.HasFeature(ext4.Extent) {
+		return nil, fmt.Errorf("%w: filesystem without the extent feature", ErrUnsupported)
+	}
+
+	return w, nil
+}
+
+// openWriter opens the filesystem stored in rw for writing its metadata
+// (files can only be written to filesystems with the extent feature).
+func openWriter(rw ReadWriterAt, opts WriterOptions) (*Writer, error) {
+	fsys, err := Open(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, feature := range fsys.sb.Features {
+		if slices.Contains(writerUnsupportedFeatures, feature) || strings.HasPrefix(feature, "FEATURE_R") {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupported, feature)
+		}
+	}
+
+	// Changes would be lost (or corrupt the filesystem) when the journal is
+	// replayed.
+	if journal, err := fsys.JournalState(); err == nil && journal.NeedsRecovery() {
+		return nil, fmt.Errorf("%w: journal needs recovery", ErrUnsupported)
+	} else if err != nil && !errors.Is(err, ErrNoJournal) {
+		return nil, err
+	}
+
+	w := &Writer{
+		FS:           fsys,
+		w:            rw,
+		opts:         opts,
+		metadataCsum: fsys.sb.HasFeature(ext4.MetadataCsum),
+		hasFileType:  fsys.sb.HasFeature(ext4.Filetype),
+	}
+	w.gdtCsum = !w.metadataCsum && fsys.sb.HasFeature(ext4.UninitBG)
+
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+
+	if w.metadataCsum {
+		w.seed = superblockChecksumSeed(w.rawSB)
+	}
+
+	return w, nil
+}
+
+// load reads the superblock and group descriptors (replacing those read by
+// the FS), discarding any changes that haven't been written.
+func (w *Writer) load() error {
+	rawSB := make([]byte, superblockSize)
+	if _, err := w.r.ReadAt(rawSB, superblockOffset); err != nil {
+		return fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	sb, err := ext4.ReadSuperblockFrom(w.r)
+	if err != nil {
+		return err
+	}
+
+	descs := make([]groupDesc, len(w.descOffsets))
+	for group, offset := range w.descOffsets {
+		descs[group] = make(groupDesc, w.descSize)
+		if _, err := w.r.ReadAt(descs[group], offset); err != nil {
+			return fmt.Errorf("failed to read group descriptor %d: %w", group, err)
+		}
+	}
+
+	*w.sb = *sb
+	w.rawSB = rawSB
+	w.descs = descs
+	w.blockBitmaps = make(map[uint64][]byte)
+	w.inodeBitmaps = make(map[uint64][]byte)
+	w.dirty = make(map[uint64]bool)
+
+	return nil
+}
+
+// commit writes the changes made by an operation, or discards them if it
+// failed.
+func (w *Writer) commit(err error) error {
+	if err != nil {
+		if loadErr := w.load(); loadErr != nil {
+			return errors.Join(err, loadErr)
+		}
+		return err
+	}
+
+	return w.flush()
+}
+
+// now returns the time of changes.
+func (w *Writer) now() time.Time {
+	if !w.opts.Time.IsZero() {
+		return w.opts.Time
+	}
+
+	return time.Now()
+}
+
+// WriteFile writes data to the named file, creating it (with the permissions
+// perm) if it doesn't exist, or replacing it (with a new inode) if it does.
+// The parent directory must exist.
+func (w *Writer) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return w.create("writefile", name, typeRegular|rawPerm(perm), func(ino *Inode) error {
+		return w.writeData(ino, data)
+	})
+}
+
+// Symlink creates the named symbolic link to target, replacing any existing
+// file (but not directory) of that name. The parent directory must exist.
+func (w *Writer) Symlink(target, name string) error {
+	return w.create("symlink", name, typeSymlink|0o777, func(ino *Inode) error {
+		// Short targets are stored in the inode itself.
+		if len(target) < len(ino.block) {
+			ino.Flags &^= flagExtents
+			ino.Size = uint64(len(target))
+			ino.block = [60]byte{}
+			copy(ino.block[:], target)
+			return nil
+		}
+
+		return w.writeData(ino, []byte(target))
+	})
+}
+
+// Mkdir creates the named directory, with the permissions perm. The parent
+// directory must exist.
+func (w *Writer) Mkdir(name string, perm fs.FileMode) error {
+	parent, base, err := w.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.findEntry(parent, base); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if err := w.commit(w.mkdir(parent, base, perm)); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// mkdir creates a directory in parent.
+func (w *Writer) mkdir(parent *Inode, name string, perm fs.FileMode) error {
+	if parent.Links >= maxLinks-1 && !w.sb.HasFeature(ext4.DirNlink) {
+		return errors.New("too many links")
+	}
+
+	ino, err := w.newInode(parent, typeDir|rawPerm(perm))
+	if err != nil {
+		return err
+	}
+	ino.Links = 2
+	ino.Flags |= parent.Flags & flagCasefold
+
+	runs, err := w.allocBlocks(w.groupStart(w.inodeGroup(ino.Number)), 1)
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, w.blockSize)
+	encodeDirBlock(block, []dirEntry{
+		{name: ".", inode: ino.Number, fileType: 2},
+		{name: "..", inode: parent.Number, fileType: 2},
+	}, w.hasFileType, w.metadataCsum)
+	if err := w.writeDirBlock(ino, runs[0].physical, block); err != nil {
+		return err
+	}
+
+	ino.Size = uint64(w.blockSize)
+	ino.Blocks = uint64(w.blockSize / 512)
+	encodeExtentLeaf(ino.block[:], runs)
+
+	if err := w.writeInode(ino, true); err != nil {
+		return err
+	}
+
+	if err := w.addEntry(parent, name, ino); err != nil {
+		return err
+	}
+
+	// With dir_nlink, the link count of directories with too many
+	// subdirectories is one (unknown).
+	if parent.Links > 1 {
+		parent.Links++
+		if parent.Links >= maxLinks {
+			parent.Links = 1
+		}
+	}
+	parent.ModifyTime, parent.ChangeTime = ino.ModifyTime, ino.ChangeTime
+
+	return w.writeInode(parent, false)
+}
+
+// MkdirAll creates the named directory, and any missing parents, with the
+// permissions perm.
+func (w *Writer) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+
+	elems := strings.Split(name, "/")
+	for i := range elems {
+		dir := path.Join(elems[:i+1]...)
+
+		ino, err := w.lookup("mkdir", dir, true)
+		if err == nil {
+			if !ino.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+			}
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		if err := w.Mkdir(dir, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Chown changes the owner of the named file (following symbolic links). A
+// uid or gid of -1 is left unchanged.
+func (w *Writer) Chown(name string, uid, gid int) error {
+	ino, err := w.lookup("chown", name, true)
+	if err != nil {
+		return err
+	}
+
+	if uid != -1 {
+		ino.UID = uint32(uid)
+	}
+	if gid != -1 {
+		ino.GID = uint32(gid)
+	}
+	ino.ChangeTime = w.now()
+
+	if err := w.commit(w.writeInode(ino, false)); err != nil {
+		return &fs.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// create creates (or replaces) the named non-directory, with a new inode
+// initialized by init.
+func (w *Writer) create(op, name string, mode uint16, init func(ino *Inode) error) error {
+	parent, base, err := w.parent(op, name)
+	if err != nil {
+		return err
+	}
+
+	var old *Inode
+	if number, err := w.findEntry(parent, base); err == nil {
+		if old, err = w.inode(number); err != nil {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if old.IsDir() {
+			return &fs.PathError{Op: op, Path: name, Err: errIsDir}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	err = func() error {
+		ino, err := w.newInode(parent, mode)
+		if err != nil {
+			return err
+		}
+
+		if err := init(ino); err != nil {
+			return err
+		}
+
+		if err := w.writeInode(ino, true); err != nil {
+			return err
+		}
+
+		if old != nil {
+			if err := w.setEntry(parent, base, ino); err != nil {
+				return err
+			}
+			if err := w.unlink(old); err != nil {
+				return err
+			}
+		} else if err := w.addEntry(parent, base, ino); err != nil {
+			return err
+		}
+
+		parent.ModifyTime, parent.ChangeTime = ino.ModifyTime, ino.ChangeTime
+		return w.writeInode(parent, false)
+	}()
+	if err := w.commit(err); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// parent returns the (modifiable) parent directory of a path, and the last
+// element of the path.
+func (w *Writer) parent(op, name string) (*Inode, string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	base := path.Base(name)
+	if len(base) > maxNameLen {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errors.New("file name too long")}
+	}
+
+	parent, err := w.lookup(op, path.Dir(name), true)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			pathErr.Path = name
+		}
+		return nil, "", err
+	}
+
+	switch {
+	case !parent.IsDir():
+		err = errNotDir
+	case parent.Flags&flagEncrypt != 0:
+		err = ErrEncrypted
+	case parent.IsIndexed():
+		err = fmt.Errorf("%w: indexed directory", ErrUnsupported)
+	case parent.Flags&flagInlineData != 0:
+		err = fmt.Errorf("%w: inline directory", ErrUnsupported)
+	}
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return parent, base, nil
+}
+
+// rawPerm returns the permission bits of an inode mode.
+func rawPerm(perm fs.FileMode) uint16 {
+	raw := uint16(perm.Perm())
+	if perm&fs.ModeSetuid != 0 {
+		raw |= 0o4000
+	}
+	if perm&fs.ModeSetgid != 0 {
+		raw |= 0o2000
+	}
+	if perm&fs.ModeSticky != 0 {
+		raw |= 0o1000
+	}
+
+	return raw
+}
+
+// newInode allocates an inode (near its parent directory).
+func (w *Writer) newInode(parent *Inode, mode uint16) (*Inode, error) {
+	number, err := w.allocInode(w.inodeGroup(parent.Number), mode&typeMask == typeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var generation [4]byte
+	if _, err := rand.Read(generation[:]); err != nil {
+		return nil, err
+	}
+
+	now := w.now()
+	ino := &Inode{
+		Number:     number,
+		RawMode:    mode,
+		Links:      1,
+		Flags:      flagExtents,
+		Generation: binary.LittleEndian.Uint32(generation[:]),
+		AccessTime: now,
+		ModifyTime: now,
+		ChangeTime: now,
+		CreateTime: now,
+	}
+	encodeExtentLeaf(ino.block[:], nil)
+
+	return ino, nil
+}
+
+// writeInode writes an inode to the inode table. A fresh inode replaces
+// whatever was stored, otherwise the fields not decoded (eg. extended
+// attributes) are kept.
+func (w *Writer) writeInode(ino *Inode, fresh bool) error {
+	buf := make([]byte, w.sb.InodeSize)
+	offset := w.inodeOffset(ino.Number)
+	if !fresh {
+		if _, err := w.r.ReadAt(buf, offset); err != nil {
+			return fmt.Errorf("failed to read inode %d: %w", ino.Number, err)
+		}
+	}
+
+	encoded := *ino
+	// Huge files count their allocation in filesystem blocks.
+	if ino.Flags&flagHugeFile != 0 && w.sb.HasFeature(ext4.HugeFile) {
+		encoded.Blocks /= uint64(w.blockSize / 512)
+	}
+	encoded.encode(buf)
+
+	if ino.Links == 0 {
+		binary.LittleEndian.PutUint32(buf[0x14:], uint32(ino.ChangeTime.Unix()))
+	}
+	if w.metadataCsum {
+		setInodeChecksum(buf, w.seed, ino.Number)
+	}
+
+	if _, err := w.w.WriteAt(buf, offset); err != nil {
+		return fmt.Errorf("failed to write inode %d: %w", ino.Number, err)
+	}
+
+	return nil
+}
+
+// writeData allocates blocks for the contents of a new file, and writes
+// them.
+func (w *Writer) writeData(ino *Inode, data []byte) error {
+	count := (uint64(len(data)) + uint64(w.blockSize) - 1) / uint64(w.blockSize)
+
+	var extents []extent
+	if count > 0 {
+		var err error
+		if extents, err = w.allocBlocks(w.groupStart(w.inodeGroup(ino.Number)), count); err != nil {
+			return err
+		}
+	}
+
+	var logical uint32
+	for i := range extents {
+		e := &extents[i]
+		e.logical = logical
+		logical += e.length
+
+		start := int64(e.logical) * w.blockSize
+		end := min(start+int64(e.length)*w.blockSize, int64(len(data)))
+		if _, err := w.w.WriteAt(data[start:end], int64(e.physical)*w.blockSize); err != nil {
+			return fmt.Errorf("failed to write block %d: %w", e.physical, err)
+		}
+
+		// Zero the rest of the last block.
+		if padding := start + int64(e.length)*w.blockSize - end; padding > 0 {
+			if _, err := w.w.WriteAt(make([]byte, padding), int64(e.physical)*w.blockSize+end-start); err != nil {
+				return fmt.Errorf("failed to write block %d: %w", e.physical+uint64(e.length)-1, err)
+			}
+		}
+	}
+
+	nodes, err := w.setExtents(ino, extents)
+	if err != nil {
+		return err
+	}
+
+	ino.Size = uint64(len(data))
+	ino.Blocks = (count + nodes) * uint64(w.blockSize/512)
+
+	return nil
+}
+
+// setExtents stores the extent tree of an inode, in the inode if possible,
+// otherwise in newly allocated leaf blocks. Returns the number of blocks
+// allocated.
+func (w *Writer) setExtents(ino *Inode, extents []extent) (uint64, error) {
+	if encodeExtentLeaf(ino.block[:], extents) {
+		return 0, nil
+	}
+
+	perLeaf := int(w.blockSize-12) / 12
+	leaves := (len(extents) + perLeaf - 1) / perLeaf
+	if leaves > maxExtentLeaves {
+		return 0, fmt.Errorf("%w: file is too fragmented", ErrUnsupported)
+	}
+
+	runs, err := w.allocBlocks(extents[0].physical, uint64(leaves))
+	if err != nil {
+		return 0, err
+	}
+
+	var children []extent
+	for _, run := range runs {
+		for i := uint32(0); i < run.length; i++ {
+			children = append(children, extent{physical: run.physical + uint64(i)})
+		}
+	}
+
+	block := make([]byte, w.blockSize)
+	for i := range children {
+		leaf := extents[i*perLeaf : min((i+1)*perLeaf, len(extents))]
+		children[i].logical = leaf[0].logical
+
+		encodeExtentLeaf(block, leaf)
+		if w.metadataCsum {
+			end := 12 + 12*perLeaf
+			seed := inodeChecksumSeed(w.seed, ino.Number, ino.Generation)
+			binary.LittleEndian.PutUint32(block[end:], crc32c(seed, block[:end]))
+		}
+
+		if _, err := w.w.WriteAt(block, int64(children[i].physical)*w.blockSize); err != nil {
+			return 0, fmt.Errorf("failed to write extent tree block %d: %w", children[i].physical, err)
+		}
+	}
+
+	encodeExtentIndex(ino.block[:], 1, children)
+
+	return uint64(leaves), nil
+}
+
+// fileBlocks returns the physical block of each logical block of a file (zero
+// for holes).
+func (w *Writer) fileBlocks(ino *Inode) ([]uint64, error) {
+	blocks := make([]uint64, (ino.Size+uint64(w.blockSize)-1)/uint64(w.blockSize))
+
+	if ino.Flags&flagExtents != 0 {
+		r, err := w.extentReader(ino)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range r.extents {
+			for i := uint32(0); i < e.length && uint64(e.logical+i) < uint64(len(blocks)); i++ {
+				blocks[e.logical+i] = e.physical + uint64(i)
+			}
+		}
+
+		return blocks, nil
+	}
+
+	r := w.blockMapReader(ino)
+	for i := range blocks {
+		var err error
+		if blocks[i], err = r.physical(uint64(i)); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+// readDirBlocks calls fn with each block of a directory, writing the block
+// back if fn modified it. Stops when fn returns done.
+func (w *Writer) readDirBlocks(dirIno *Inode, fn func(block []byte) (modified, done bool, err error)) error {
+	blocks, err := w.fileBlocks(dirIno)
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, w.blockSize)
+	for _, physical := range blocks {
+		if physical == 0 {
+			continue
+		}
+
+		if _, err := w.r.ReadAt(block, int64(physical)*w.blockSize); err != nil {
+			return fmt.Errorf("failed to read directory block %d: %w", physical, err)
+		}
+
+		modified, done, err := fn(block)
+		if err != nil {
+			return fmt.Errorf("directory %d: %w", dirIno.Number, err)
+		}
+
+		if modified {
+			if err := w.writeDirBlock(dirIno, physical, block); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// writeDirBlock writes a block of a directory (updating its checksum).
+func (w *Writer) writeDirBlock(dirIno *Inode, physical uint64, block []byte) error {
+	if w.metadataCsum && hasDirTail(block) {
+		setDirBlockChecksum(block, inodeChecksumSeed(w.seed, dirIno.Number, dirIno.Generation))
+	}
+
+	if _, err := w.w.WriteAt(block, int64(physical)*w.blockSize); err != nil {
+		return fmt.Errorf("failed to write directory block %d: %w", physical, err)
+	}
+
+	return nil
+}
+
+// addEntry adds an entry for an inode to a directory, in the first unused
+// space large enough, or in a new block appended to the directory.
+func (w *Writer) addEntry(dirIno *Inode, name string, ino *Inode) error {
+	le := binary.LittleEndian
+	needed := recLen(len(name))
+
+	putEntry := func(entry []byte, length int) {
+		clear(entry[:needed])
+		le.PutUint32(entry, ino.Number)
+		putRecLen(entry, length)
+		entry[0x6] = uint8(len(name))
+		if w.hasFileType {
+			entry[0x7] = fileType(ino.RawMode)
+		}
+		copy(entry[8:], name)
+	}
+
+	var added bool
+	err := w.readDirBlocks(dirIno, func(block []byte) (bool, bool, error) {
+		end := len(block)
+		if hasDirTail(block) {
+			end -= dirTailSize
+		}
+
+		for off := 0; off+8 <= end; {
+			entry := block[off:]
+			length := getRecLen(entry, w.blockSize)
+			if length < 8 || off+length > end {
+				return false, false, fmt.Errorf("corrupt directory entry")
+			}
+
+			// The space after the name of the entry (or all of it, if it is
+			// unused).
+			used := 0
+			if le.Uint32(entry) != 0 {
+				nameLen := int(entry[0x6])
+				if !w.hasFileType {
+					nameLen |= int(entry[0x7]) << 8
+				}
+				used = recLen(nameLen)
+			}
+
+			if length-used >= needed {
+				if used > 0 {
+					putRecLen(entry, used)
+				}
+				putEntry(entry[used:], length-used)
+				added = true
+				return true, true, nil
+			}
+
+			off += length
+		}
+
+		return false, false, nil
+	})
+	if err != nil || added {
+		return err
+	}
+
+	// Append a block to the directory (after its last block, if possible).
+	blocks, err := w.fileBlocks(dirIno)
+	if err != nil {
+		return err
+	}
+
+	goal := w.groupStart(w.inodeGroup(dirIno.Number))
+	if len(blocks) > 0 && blocks[len(blocks)-1] != 0 {
+		goal = blocks[len(blocks)-1] + 1
+	}
+
+	runs, err := w.allocBlocks(goal, 1)
+	if err != nil {
+		return err
+	}
+	physical := runs[0].physical
+
+	block := make([]byte, w.blockSize)
+	encodeDirBlock(block, nil, w.hasFileType, w.metadataCsum)
+	putEntry(block, getRecLen(block, w.blockSize))
+	if err := w.writeDirBlock(dirIno, physical, block); err != nil {
+		return err
+	}
+
+	return w.appendBlock(dirIno, uint32(len(blocks)), physical)
+}
+
+// appendBlock maps the next logical block of a file (eg. a directory) to a
+// physical block.
+func (w *Writer) appendBlock(ino *Inode, logical uint32, physical uint64) error {
+	if ino.Flags&flagExtents == 0 {
+		if logical >= directBlocks {
+			return fmt.Errorf("%w: large block mapped directory", ErrUnsupported)
+		}
+		binary.LittleEndian.PutUint32(ino.block[logical*4:], uint32(physical))
+	} else {
+		r, err := w.extentReader(ino)
+		if err != nil {
+			return err
+		}
+
+		extents := r.extents
+		if last := len(extents) - 1; last >= 0 && !extents[last].uninit &&
+			extents[last].logical+extents[last].length == logical &&
+			extents[last].physical+uint64(extents[last].length) == physical &&
+			extents[last].length < maxExtentLength {
+			extents[last].length++
+		} else {
+			extents = append(extents, extent{logical: logical, physical: physical, length: 1})
+		}
+
+		// The extent tree is rebuilt.
+		for _, node := range r.nodes {
+			if err := w.freeBlocks(node, 1); err != nil {
+				return err
+			}
+		}
+		nodes, err := w.setExtents(ino, extents)
+		if err != nil {
+			return err
+		}
+		ino.Blocks = ino.Blocks - uint64(len(r.nodes))*uint64(w.blockSize/512) + nodes*uint64(w.blockSize/512)
+	}
+
+	ino.Size = uint64(logical+1) * uint64(w.blockSize)
+	ino.Blocks += uint64(w.blockSize / 512)
+
+	return nil
+}
+
+// setEntry points the named entry of a directory to another inode.
+func (w *Writer) setEntry(dirIno *Inode, name string, ino *Inode) error {
+	le := binary.LittleEndian
+
+	var found bool
+	err := w.readDirBlocks(dirIno, func(block []byte) (bool, bool, error) {
+		for off := 0; off+8 <= len(block); {
+			entry := block[off:]
+			length := getRecLen(entry, w.blockSize)
+			if length < 8 || off+length > len(block) {
+				return false, false, fmt.Errorf("corrupt directory entry")
+			}
+
+			nameLen := int(entry[0x6])
+			if !w.hasFileType {
+				nameLen |= int(entry[0x7]) << 8
+			}
+
+			if le.Uint32(entry) != 0 && 8+nameLen <= length {
+				entryName := string(entry[8 : 8+nameLen])
+				if entryName == name || (dirIno.Flags&flagCasefold != 0 && strings.EqualFold(entryName, name)) {
+					le.PutUint32(entry, ino.Number)
+					if w.hasFileType {
+						entry[0x7] = fileType(ino.RawMode)
+					}
+					found = true
+					return true, true, nil
+				}
+			}
+
+			off += length
+		}
+
+		return false, false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fs.ErrNotExist
+	}
+
+	return nil
+}
+
+// unlink removes a link to an inode, releasing it (and its blocks) when no
+// links are left.
+func (w *Writer) unlink(ino *Inode) error {
+	ino.ChangeTime = w.now()
+	if ino.Links > 1 {
+		ino.Links--
+		return w.writeInode(ino, false)
+	}
+
+	// Fast symbolic links, devices, etc. have no blocks.
+	typ := ino.RawMode & typeMask
+	fastSymlink := typ == typeSymlink && ino.Size < uint64(len(ino.block)) && ino.Flags&flagExtents == 0
+	if ino.Flags&flagInlineData == 0 && (typ == typeRegular || typ == typeDir || (typ == typeSymlink && !fastSymlink)) {
+		var blocks []uint64
+		if ino.Flags&flagExtents != 0 {
+			r, err := w.extentReader(ino)
+			if err != nil {
+				return err
+			}
+
+			for _, e := range r.extents {
+				if err := w.freeBlocks(e.physical, uint64(e.length)); err != nil {
+					return err
+				}
+			}
+			blocks = r.nodes
+		} else {
+			var err error
+			if blocks, err = w.blockMapReader(ino).blocks(); err != nil {
+				return err
+			}
+		}
+
+		for _, block := range blocks {
+			if err := w.freeBlocks(block, 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ino.XattrBlock != 0 {
+		if err := w.releaseXattrBlock(ino.XattrBlock); err != nil {
+			return err
+		}
+	}
+
+	if err := w.freeInode(ino.Number, ino.IsDir()); err != nil {
+		return err
+	}
+
+	ino.Links = 0
+	return w.writeInode(ino, false)
+}
+
+// releaseXattrBlock drops a reference to an extended attribute block
+// (which may be shared by several inodes), freeing it if it was the last.
+func (w *Writer) releaseXattrBlock(block uint64) error {
+	le := binary.LittleEndian
+
+	buf := make([]byte, w.blockSize)
+	if _, err := w.r.ReadAt(buf, int64(block)*w.blockSize); err != nil {
+		return fmt.Errorf("failed to read extended attribute block %d: %w", block, err)
+	}
+
+	refcount := le.Uint32(buf[0x4:])
+	if refcount <= 1 {
+		return w.freeBlocks(block, 1)
+	}
+	le.PutUint32(buf[0x4:], refcount-1)
+
+	if w.metadataCsum {
+		le.PutUint32(buf[0x10:], 0)
+		crc := crc32c(w.seed, le.AppendUint64(nil, block))
+		le.PutUint32(buf[0x10:], crc32c(crc, buf))
+	}
+
+	if _, err := w.w.WriteAt(buf, int64(block)*w.blockSize); err != nil {
+		return fmt.Errorf("failed to write extended attribute block %d: %w", block, err)
+	}
+
+	return nil
+}
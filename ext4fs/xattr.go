@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// xattrMagic marks the start of the extended attributes stored in an
+	// inode, or in an extended attribute block.
+	xattrMagic = 0xEA020000
+	// xattrBlockHeaderSize is the size of the header of an extended
+	// attribute block.
+	xattrBlockHeaderSize = 32
+	// xattrEntrySize is the size of an extended attribute entry, excluding
+	// its name.
+	xattrEntrySize = 16
+	// xattrIndexSystem is the name index of "system." extended attributes.
+	xattrIndexSystem = 7
+)
+
+// xattrPrefixes are the prefixes of extended attribute names, by their name
+// index.
+var xattrPrefixes = map[uint8]string{
+	1: "user.",
+	2: "system.posix_acl_access",
+	3: "system.posix_acl_default",
+	4: "trusted.",
+	6: "security.",
+	7: "system.",
+	8: "system.richacl",
+}
+
+// xattrEntry is an extended attribute entry.
+type xattrEntry struct {
+	index uint8
+	name  string
+	value []byte
+	// valueInode is the inode holding the value (with the ea_inode feature),
+	// or zero if the value is stored inline.
+	valueInode uint32
+	valueSize  uint32
+}
+
+// parseXattrEntries parses the extended attribute entries at the start of
+// entries, whose values are at offsets relative to the start of values.
+func parseXattrEntries(entries, values []byte) ([]xattrEntry, error) {
+	le := binary.LittleEndian
+
+	var parsed []xattrEntry
+	for off := 0; off+4 <= len(entries); {
+		entry := entries[off:]
+		// Entries end with four zero bytes.
+		if le.Uint32(entry) == 0 {
+			break
+		}
+
+		nameLen := int(entry[0])
+		if xattrEntrySize+nameLen > len(entry) {
+			return nil, fmt.Errorf("corrupt extended attribute entry")
+		}
+
+		e := xattrEntry{
+			index:      entry[1],
+			name:       string(entry[xattrEntrySize : xattrEntrySize+nameLen]),
+			valueInode: le.Uint32(entry[0x4:]),
+			valueSize:  le.Uint32(entry[0x8:]),
+		}
+		if e.valueInode == 0 {
+			valueOffset := int(le.Uint16(entry[0x2:]))
+			if valueOffset+int(e.valueSize) > len(values) {
+				return nil, fmt.Errorf("corrupt extended attribute entry")
+			}
+			e.value = values[valueOffset : valueOffset+int(e.valueSize)]
+		}
+		parsed = append(parsed, e)
+
+		off += (xattrEntrySize + nameLen + 3) &^ 3
+	}
+
+	return parsed, nil
+}
+
+// xattr returns the value of an extended attribute stored in the inode (by
+// its name index and suffix, eg. 7 and "data" for system.data).
+func (ino *Inode) xattr(index uint8, name string) ([]byte, bool) {
+	// In the inode, value offsets are relative to the first entry.
+	entries, err := parseXattrEntries(ino.xattrs, ino.xattrs)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, e := range entries {
+		if e.index == index && e.name == name && e.valueInode == 0 {
+			return e.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Xattrs returns the extended attributes of a file (eg. its SELinux label or
+// file capabilities), by their full name (eg. "security.capability"), both
+// those stored in the inode and in a separate block.
+func (fsys *FS) Xattrs(ino *Inode) (map[string][]byte, error) {
+	entries, err := parseXattrEntries(ino.xattrs, ino.xattrs)
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %w", ino.Number, err)
+	}
+
+	if ino.XattrBlock != 0 {
+		block := make([]byte, fsys.blockSize)
+		if _, err := fsys.r.ReadAt(block, int64(ino.XattrBlock)*fsys.blockSize); err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute block %d: %w", ino.XattrBlock, err)
+		}
+		if binary.LittleEndian.Uint32(block) != xattrMagic {
+			return nil, fmt.Errorf("inode %d: bad extended attribute block", ino.Number)
+		}
+
+		// In a block, value offsets are relative to the start of the block.
+		blockEntries, err := parseXattrEntries(block[xattrBlockHeaderSize:], block)
+		if err != nil {
+			return nil, fmt.Errorf("inode %d: %w", ino.Number, err)
+		}
+		entries = append(entries, blockEntries...)
+	}
+
+	xattrs := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		prefix, ok := xattrPrefixes[e.index]
+		if !ok {
+			continue
+		}
+
+		value := e.value
+		if e.valueInode != 0 {
+			if value, err = fsys.readXattrInode(e.valueInode, e.valueSize); err != nil {
+				return nil, err
+			}
+		}
+
+		xattrs[prefix+e.name] = append([]byte(nil), value...)
+	}
+
+	return xattrs, nil
+}
+
+// readXattrInode reads a large extended attribute value stored in a separate
+// inode (with the ea_inode feature).
+func (fsys *FS) readXattrInode(number, size uint32) ([]byte, error) {
+	ino, err := fsys.inode(number)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := fsys.contents(ino)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	if _, err := r.ReadAt(value, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read extended attribute inode %d: %w", number, err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4fs_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4fs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrs(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := createTestTree(t)
+
+	// Large enough not to fit in the inode.
+	largeValue := bytes.Repeat([]byte("v"), 512)
+	if err := unix.Setxattr(filepath.Join(rootDir, "hello.txt"), "user.small", []byte("value"), 0); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	require.NoError(t, unix.Setxattr(filepath.Join(rootDir, "big.bin"), "user.large", largeValue, 0))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        imagePath,
+		Size:          64 * ext4.MiB,
+		RootDirectory: rootDir,
+	})
+	require.NoError(t, err)
+
+	fsys := openImage(t, imagePath)
+
+	fi, err := fsys.Lstat("hello.txt")
+	require.NoError(t, err)
+
+	xattrs, err := fsys.Xattrs(fi.Sys().(*ext4fs.Inode))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), xattrs["user.small"])
+
+	t.Log("Reading a value stored in an external block")
+
+	fi, err = fsys.Lstat("big.bin")
+	require.NoError(t, err)
+
+	ino := fi.Sys().(*ext4fs.Inode)
+	require.NotZero(t, ino.XattrBlock)
+
+	xattrs, err = fsys.Xattrs(ino)
+	require.NoError(t, err)
+	require.Equal(t, largeValue, xattrs["user.large"])
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+)
+
+// Release is a release of e2fsprogs, packaged in a container image.
+type Release struct {
+	// Version of e2fsprogs (eg. "1.47.0"). If set, the version installed in
+	// the container is checked against it.
+	Version string
+	// Image is the container image.
+	Image string
+	// Install is an optional shell command run in the container before the
+	// test, eg. to install e2fsprogs from the distribution's repositories.
+	Install string
+}
+
+// aptInstall installs e2fsprogs on Debian based images, if it's missing.
+const aptInstall = "command -v mke2fs >/dev/null || (apt-get update -qq && DEBIAN_FRONTEND=noninteractive apt-get install -qq -y e2fsprogs >/dev/null)"
+
+// Releases are the releases of e2fsprogs shipped by long-term supported
+// distributions (and so most likely to be found in the wild), oldest first.
+var Releases = []Release{
+	{Version: "1.45.5", Image: "ubuntu:20.04", Install: aptInstall},
+	{Version: "1.46.2", Image: "debian:bullseye", Install: aptInstall},
+	{Version: "1.46.5", Image: "ubuntu:22.04", Install: aptInstall},
+	{Version: "1.47.0", Image: "debian:bookworm", Install: aptInstall},
+}
+
+// ContainerOptions are options for starting a helper container.
+type ContainerOptions struct {
+	// Runtime is the path of a docker compatible container runtime binary
+	// (defaults to "docker").
+	Runtime string
+	// Dir is a directory on the host that's bind-mounted at the same path in
+	// the container, so that image files can be shared with the test (by
+	// default a temporary directory of the test).
+	Dir string
+}
+
+// Container is a privileged helper container with a known release of
+// e2fsprogs, for running integration tests against it.
+type Container struct {
+	// ID of the container.
+	ID string
+	// Release of e2fsprogs in the container.
+	Release Release
+
+	runtime string
+	dir     string
+}
+
+var mke2fsVersionRegexp = regexp.MustCompile(`mke2fs ([0-9][^\s]*)`)
+
+// NewContainer starts a helper container for a release of e2fsprogs, which is
+// removed when the test completes. The test is skipped if the container
+// runtime isn't available.
+func NewContainer(t testing.TB, release Release, opts ContainerOptions) *Container {
+	t.Helper()
+
+	runtime := opts.Runtime
+	if runtime == "" {
+		runtime = "docker"
+	}
+	skipUnlessCommands(t, runtime)
+
+	ctx := context.Background()
+
+	if _, err := runtimeOutput(ctx, runtime, "info"); err != nil {
+		t.Skipf("container runtime unavailable: %v", err)
+	}
+
+	dir := opts.Dir
+	if dir == "" {
+		dir = t.TempDir()
+	}
+
+	id, err := runtimeOutput(ctx, runtime, "run", "-d", "--rm", "--privileged",
+		"-v", dir+":"+dir, "--entrypoint", "sleep", release.Image, "infinity")
+	if err != nil {
+		t.Fatalf("failed to start %s container: %v", release.Image, err)
+	}
+
+	c := &Container{
+		ID:      strings.TrimSpace(id),
+		Release: release,
+		runtime: runtime,
+		dir:     dir,
+	}
+
+	t.Cleanup(func() {
+		if _, err := runtimeOutput(context.Background(), runtime, "rm", "-f", c.ID); err != nil {
+			t.Errorf("failed to remove container %s: %v", c.ID, err)
+		}
+	})
+
+	if release.Install != "" {
+		if _, err := runtimeOutput(ctx, runtime, "exec", c.ID, "sh", "-c", release.Install); err != nil {
+			t.Fatalf("failed to install e2fsprogs in %s: %v", release.Image, err)
+		}
+	}
+
+	version, err := c.version(ctx)
+	if err != nil {
+		t.Fatalf("failed to determine e2fsprogs version in %s: %v", release.Image, err)
+	}
+
+	if release.Version != "" && version != release.Version {
+		t.Fatalf("expected e2fsprogs %s in %s, found %s", release.Version, release.Image, version)
+	}
+	c.Release.Version = version
+
+	return c
+}
+
+// ForEachRelease runs fn as a subtest (named after the version) with a helper
+// container for each of the releases (by default Releases).
+func ForEachRelease(t *testing.T, releases []Release, fn func(t *testing.T, c *Container)) {
+	t.Helper()
+
+	if releases == nil {
+		releases = Releases
+	}
+
+	for _, release := range releases {
+		release := release
+
+		name := release.Version
+		if name == "" {
+			name = release.Image
+		}
+
+		t.Run(name, func(t *testing.T) {
+			fn(t, NewContainer(t, release, ContainerOptions{}))
+		})
+	}
+}
+
+// Client returns a client that runs commands in the container.
+func (c *Container) Client(opts ...ext4.ClientOption) *ext4.Client {
+	executor := &ext4.ContainerExecutor{
+		Runtime:   c.runtime,
+		Container: c.ID,
+	}
+
+	return ext4.NewClient(append(opts, ext4.WithExecutor(executor))...)
+}
+
+// Dir returns the directory shared between the host and the container.
+func (c *Container) Dir() string {
+	return c.dir
+}
+
+// NewImage creates a new, zeroed (sparse) image file of the given size in
+// the shared directory, returning its path (on both the host and in the
+// container).
+func (c *Container) NewImage(t testing.TB, size int64) string {
+	t.Helper()
+
+	f, err := os.CreateTemp(c.dir, "disk-*.img")
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("failed to size image: %v", err)
+	}
+
+	// The container runs as root, so the image may be owned by another user
+	// (eg. with rootless runtimes).
+	if err := os.Chmod(f.Name(), 0o666); err != nil {
+		t.Fatalf("failed to set image permissions: %v", err)
+	}
+
+	return f.Name()
+}
+
+// version returns the version of e2fsprogs installed in the container.
+func (c *Container) version(ctx context.Context) (string, error) {
+	// mke2fs -V reports its version on stderr.
+	out, err := runtimeOutput(ctx, c.runtime, "exec", c.ID, "sh", "-c", "PATH=$PATH:/sbin:/usr/sbin mke2fs -V 2>&1")
+	if err != nil {
+		return "", err
+	}
+
+	matches := mke2fsVersionRegexp.FindStringSubmatch(out)
+	if matches == nil {
+		return "", fmt.Errorf("unexpected output %q", strings.TrimSpace(out))
+	}
+
+	return matches[1], nil
+}
+
+// runtimeOutput runs the container runtime, returning its output.
+func runtimeOutput(ctx context.Context, runtime string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, runtime, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s %s: %w: %s", runtime, args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s %s: %w", runtime, args[0], err)
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ext4test provides block device fixtures for integration tests, eg.
+// of code that creates, mounts or resizes filesystems with the ext4 package.
+//
+// Devices are backed by (sparse) image files in a temporary directory of the
+// test, and are detached when the test completes. Tests are skipped, rather
+// than failed, when devices can't be attached (eg. when not running as root,
+// or when qemu-nbd or the nbd kernel module isn't available).
+//
+// Helper containers (see NewContainer and ForEachRelease) run integration
+// tests against known releases of e2fsprogs.
+//
+// It also provides a RecordingExecutor, and golden file assertions, for
+// testing the command lines built from options without running them.
+package ext4test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/dpeckett/ext4/nbd"
+)
+
+// DeviceSize is the size of the devices (in bytes). The backing images are
+// sparse, so only the blocks written by a test use disk space.
+const DeviceSize = 1 << 30
+
+// NewLoopDevice attaches a new, zeroed image file to a loop device, returning
+// the path of the device. The device is detached when the test completes.
+func NewLoopDevice(t testing.TB) string {
+	t.Helper()
+
+	skipUnlessRoot(t)
+
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		t.Skipf("loop devices unavailable: %v", err)
+	}
+
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(imagePath)
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	err = f.Truncate(DeviceSize)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("failed to size image: %v", err)
+	}
+
+	device, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Fatalf("failed to attach image: %v", err)
+	}
+	cleanup(t, device, detach)
+
+	return device
+}
+
+// NewNBDDevice creates a new, empty disk image of the given format, and
+// attaches it to a network block device (using qemu-nbd), returning the path
+// of the device. The nbd kernel module is loaded if necessary. The device is
+// detached when the test completes.
+func NewNBDDevice(t testing.TB, format nbd.Format) string {
+	t.Helper()
+
+	skipUnlessRoot(t)
+	skipUnlessCommands(t, "qemu-img", "qemu-nbd")
+
+	ctx := context.Background()
+
+	if err := nbd.LoadModule(ctx); err != nil {
+		t.Skipf("nbd module unavailable: %v", err)
+	}
+
+	imagePath := filepath.Join(t.TempDir(), "disk."+string(format))
+	if err := nbd.CreateImage(ctx, imagePath, format, DeviceSize); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+
+	device, detach, err := nbd.Attach(ctx, imagePath, nbd.Options{Format: format})
+	if err != nil {
+		t.Fatalf("failed to attach image: %v", err)
+	}
+	cleanup(t, device, detach)
+
+	return device
+}
+
+// cleanup detaches a device when the test completes.
+func cleanup(t testing.TB, device string, detach func() error) {
+	t.Cleanup(func() {
+		if err := detach(); err != nil {
+			t.Errorf("failed to detach %s: %v", device, err)
+		}
+	})
+}
+
+// skipUnlessRoot skips the test if block devices can't be attached, as the
+// test isn't running as root (on Linux).
+func skipUnlessRoot(t testing.TB) {
+	t.Helper()
+
+	if runtime.GOOS != "linux" {
+		t.Skipf("block devices are not supported on %s", runtime.GOOS)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("attaching block devices requires root")
+	}
+}
+
+// skipUnlessCommands skips the test if any of the given commands aren't
+// found in $PATH.
+func skipUnlessCommands(t testing.TB, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+}
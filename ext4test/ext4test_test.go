@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4test_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/dpeckett/ext4/nbd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLoopDevice(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	var device string
+	t.Run("attach", func(t *testing.T) {
+		device = ext4test.NewLoopDevice(t)
+
+		_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: device, Size: 64 * ext4.MiB, Label: "loop"})
+		require.NoError(t, err)
+
+		sb, err := c.ReadSuperblock(ctx, device)
+		require.NoError(t, err)
+		require.Equal(t, "loop", sb.Label)
+	})
+
+	if device == "" {
+		t.Skip("no device was attached")
+	}
+
+	t.Log("Verifying the device was detached")
+
+	_, err := c.ReadSuperblock(ctx, device)
+	require.Error(t, err)
+}
+
+func TestNewNBDDevice(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	for _, format := range []nbd.Format{nbd.FormatRaw, nbd.FormatQCOW2} {
+		t.Run(string(format), func(t *testing.T) {
+			device := ext4test.NewNBDDevice(t, format)
+
+			_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: device, Size: 64 * ext4.MiB, Label: "nbd"})
+			require.NoError(t, err)
+
+			sb, err := c.ReadSuperblock(ctx, device)
+			require.NoError(t, err)
+			require.Equal(t, "nbd", sb.Label)
+		})
+	}
+}
+
+func TestRecordingExecutor(t *testing.T) {
+	ctx := context.Background()
+
+	e := &ext4test.RecordingExecutor{Outputs: map[string]string{"dumpe2fs": "Filesystem magic number:  0xEF53\n"}}
+	c := ext4.NewClient(ext4.WithExecutor(e))
+
+	_, _ = c.ReadSuperblock(ctx, "/dev/sdb")
+	_, _ = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: "/dev/sdc", Label: "it's data"})
+
+	require.Equal(t, [][]string{
+		{"dumpe2fs", "-h", "/dev/sdb"},
+		{"mke2fs", "-v", "-t", "ext4", "-L", "it's data", "/dev/sdc"},
+	}, e.Argv())
+
+	require.Equal(t, "dumpe2fs -h /dev/sdb\nmke2fs -v -t ext4 -L 'it'\\''s data' /dev/sdc\n", string(ext4test.FormatArgv(e.Argv())))
+
+	e.Reset()
+	require.Empty(t, e.Argv())
+}
+
+func TestContainer(t *testing.T) {
+	ctx := context.Background()
+
+	// A stand-in for the container runtime that runs commands locally.
+	runtimePath := filepath.Join(t.TempDir(), "docker")
+	err := os.WriteFile(runtimePath, []byte(`#!/bin/sh
+case "$1" in
+run) echo fake ;;
+exec) shift; [ "$1" = -i ] && shift; shift; exec "$@" ;;
+esac
+`), 0o755)
+	require.NoError(t, err)
+
+	container := ext4test.NewContainer(t, ext4test.Release{Image: "local"}, ext4test.ContainerOptions{Runtime: runtimePath})
+	require.Equal(t, "fake", container.ID)
+	require.Regexp(t, `^1\.\d+`, container.Release.Version)
+
+	imagePath := container.NewImage(t, 64<<20)
+	require.Equal(t, container.Dir(), filepath.Dir(imagePath))
+
+	c := container.Client()
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath, Label: "container"})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, "container", sb.Label)
+}
+
+func TestForEachRelease(t *testing.T) {
+	ctx := context.Background()
+
+	ext4test.ForEachRelease(t, nil, func(t *testing.T, container *ext4test.Container) {
+		imagePath := container.NewImage(t, 64<<20)
+
+		_, err := container.Client().CreateFilesystem(ctx, ext4.CreateOptions{Device: imagePath})
+		require.NoError(t, err)
+
+		// Filesystems created by each release should be readable by the host.
+		_, err = ext4.NewClient().VerifyExt4(ctx, imagePath)
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+)
+
+// update rewrites golden files with the actual output, rather than comparing
+// against them (eg. go test ./... -args -ext4test.update).
+var update = flag.Bool("ext4test.update", false, "update golden files")
+
+// RecordingExecutor is an ext4.Executor that records the commands a client
+// runs, without running them. Every command succeeds, writing the output
+// configured for its binary (if any), eg. so that the superblock of a device
+// can be read before it is resized.
+type RecordingExecutor struct {
+	// Outputs are the standard output of each binary (eg. "dumpe2fs").
+	Outputs map[string]string
+
+	mu   sync.Mutex
+	argv [][]string
+}
+
+// LookPath returns the name of the binary, so that the recorded commands
+// don't depend on the host.
+func (e *RecordingExecutor) LookPath(name string) (string, error) {
+	return name, nil
+}
+
+// Run records the command.
+func (e *RecordingExecutor) Run(_ context.Context, cmd *ext4.Command) error {
+	e.mu.Lock()
+	e.argv = append(e.argv, append([]string{cmd.Path}, cmd.Args...))
+	e.mu.Unlock()
+
+	if out, ok := e.Outputs[filepath.Base(cmd.Path)]; ok && cmd.Stdout != nil {
+		if _, err := io.WriteString(cmd.Stdout, out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Argv returns the command lines recorded, in the order they were run.
+func (e *RecordingExecutor) Argv() [][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	argv := make([][]string, len(e.argv))
+	for i, args := range e.argv {
+		argv[i] = slices.Clone(args)
+	}
+
+	return argv
+}
+
+// Reset forgets the commands recorded so far.
+func (e *RecordingExecutor) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.argv = nil
+}
+
+// FormatArgv formats command lines one per line, with the arguments quoted
+// for a POSIX shell where necessary.
+func FormatArgv(argv [][]string) []byte {
+	var buf bytes.Buffer
+	for _, args := range argv {
+		for i, arg := range args {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(shellQuote(arg))
+		}
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+// AssertGolden compares got against the contents of a golden file (relative
+// to the directory of the test, eg. "testdata/create.golden"). When the tests
+// are run with -ext4test.update, the golden file is written instead.
+func AssertGolden(t testing.TB, path string, got []byte) {
+	t.Helper()
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create golden file directory: %v", err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("failed to write golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run the tests with -args -ext4test.update to create it): %v", err)
+	}
+
+	if !bytes.Equal(want, got) {
+		t.Errorf("output does not match %s (run the tests with -args -ext4test.update if the change is expected):\n--- want\n%s+++ got\n%s", path, want, got)
+	}
+}
+
+// AssertGoldenArgv compares command lines (see FormatArgv) against the
+// contents of a golden file, as with AssertGolden.
+func AssertGoldenArgv(t testing.TB, path string, argv [][]string) {
+	t.Helper()
+
+	AssertGolden(t, path, FormatArgv(argv))
+}
+
+// shellQuote quotes an argument for a POSIX shell, if it contains any
+// characters that would otherwise be interpreted.
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=/.,:@%") == "" {
+		return arg
+	}
+
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
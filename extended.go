@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// maxMMPUpdateInterval is the longest multi-mount protection update interval
+// supported by the kernel.
+const maxMMPUpdateInterval = 300
+
+// RootOwner is the owner of the root directory of a new filesystem.
+type RootOwner struct {
+	UID uint32
+	GID uint32
+}
+
+// ExtendedOptions provides the extended options (-E) of mke2fs.
+type ExtendedOptions struct {
+	// Stride is the RAID chunk size in filesystem blocks.
+	Stride int
+	// StripeWidth is the RAID stripe width in filesystem blocks (typically
+	// the stride multiplied by the number of data disks).
+	StripeWidth int
+	// Offset in bytes at which to create the filesystem (eg. the start of a
+	// partition within a disk image).
+	Offset int64
+	// Resize is the maximum number of blocks that the filesystem can be
+	// grown to online (reserving space in the group descriptor table).
+	Resize uint64
+	// LazyItableInit, if set, controls whether the inode tables are left
+	// uninitialized (to be zeroed by the kernel after mounting).
+	LazyItableInit *bool
+	// LazyJournalInit, if set, controls whether the journal is left
+	// uninitialized.
+	LazyJournalInit *bool
+	// PackedMetaBlocks places the allocation bitmaps and inode tables (and
+	// the journal) at the start of the device.
+	PackedMetaBlocks bool
+	// Discard, if set, controls whether the blocks of the device are
+	// discarded before the filesystem is created.
+	Discard *bool
+	// AssumeStoragePrezeroed skips zeroing the inode tables and journal, as
+	// the device is known to read back zeroes.
+	AssumeStoragePrezeroed bool
+	// RootOwner, if set, is the owner of the root directory (by default the
+	// user running mke2fs).
+	RootOwner *RootOwner
+	// HashSeed is the UUID used to seed the hashes of indexed directories.
+	HashSeed string
+	// NumBackupSuperblocks is the number of backup superblocks (0, 1 or 2)
+	// when the sparse_super2 feature is enabled.
+	NumBackupSuperblocks *int
+	// MMPUpdateInterval is the multi-mount protection update interval in
+	// seconds when the mmp feature is enabled.
+	MMPUpdateInterval int
+	// TestFS marks the filesystem as safe for use by the ext4dev driver.
+	TestFS bool
+	// Extra are additional extended options, eg. "orphan_file_size=1M".
+	Extra []string
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts ExtendedOptions) Validate() error {
+	var errs []error
+	if opts.Stride < 0 {
+		errs = append(errs, invalidOption("invalid stride %d", opts.Stride))
+	}
+	if opts.StripeWidth < 0 {
+		errs = append(errs, invalidOption("invalid stripe width %d", opts.StripeWidth))
+	} else if opts.Stride > 0 && opts.StripeWidth%opts.Stride != 0 {
+		errs = append(errs, invalidOption("stripe width %d is not a multiple of the stride %d", opts.StripeWidth, opts.Stride))
+	}
+	if opts.Offset < 0 {
+		errs = append(errs, invalidOption("invalid offset %d", opts.Offset))
+	}
+	if opts.HashSeed != "" && !uuidRegexp.MatchString(opts.HashSeed) {
+		errs = append(errs, invalidOption("malformed hash seed %q", opts.HashSeed))
+	}
+	if opts.NumBackupSuperblocks != nil && (*opts.NumBackupSuperblocks < 0 || *opts.NumBackupSuperblocks > 2) {
+		errs = append(errs, invalidOption("invalid number of backup superblocks %d", *opts.NumBackupSuperblocks))
+	}
+	if opts.MMPUpdateInterval < 0 || opts.MMPUpdateInterval > maxMMPUpdateInterval {
+		errs = append(errs, invalidOption("MMP update interval %d is out of range", opts.MMPUpdateInterval))
+	}
+	for _, option := range opts.Extra {
+		if option == "" || strings.Contains(option, ",") {
+			errs = append(errs, invalidOption("malformed extended option %q", option))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// MarshalArg returns the options in the syntax of the -E option.
+func (opts ExtendedOptions) MarshalArg() string {
+	var options []string
+	if opts.Stride > 0 {
+		options = append(options, "stride="+strconv.Itoa(opts.Stride))
+	}
+	if opts.StripeWidth > 0 {
+		options = append(options, "stripe_width="+strconv.Itoa(opts.StripeWidth))
+	}
+	if opts.Offset > 0 {
+		options = append(options, "offset="+strconv.FormatInt(opts.Offset, 10))
+	}
+	if opts.Resize > 0 {
+		options = append(options, "resize="+strconv.FormatUint(opts.Resize, 10))
+	}
+	if opts.LazyItableInit != nil {
+		options = append(options, "lazy_itable_init="+boolOption(*opts.LazyItableInit))
+	}
+	if opts.LazyJournalInit != nil {
+		options = append(options, "lazy_journal_init="+boolOption(*opts.LazyJournalInit))
+	}
+	if opts.PackedMetaBlocks {
+		options = append(options, "packed_meta_blocks=1")
+	}
+	if opts.Discard != nil {
+		if *opts.Discard {
+			options = append(options, "discard")
+		} else {
+			options = append(options, "nodiscard")
+		}
+	}
+	if opts.AssumeStoragePrezeroed {
+		options = append(options, "assume_storage_prezeroed=1")
+	}
+	if opts.RootOwner != nil {
+		options = append(options, "root_owner="+strconv.FormatUint(uint64(opts.RootOwner.UID), 10)+":"+strconv.FormatUint(uint64(opts.RootOwner.GID), 10))
+	}
+	if opts.HashSeed != "" {
+		options = append(options, "hash_seed="+opts.HashSeed)
+	}
+	if opts.NumBackupSuperblocks != nil {
+		options = append(options, "num_backup_sb="+strconv.Itoa(*opts.NumBackupSuperblocks))
+	}
+	if opts.MMPUpdateInterval > 0 {
+		options = append(options, "mmp_update_interval="+strconv.Itoa(opts.MMPUpdateInterval))
+	}
+	if opts.TestFS {
+		options = append(options, "test_fs")
+	}
+	options = append(options, opts.Extra...)
+
+	return strings.Join(options, ",")
+}
+
+// boolOption formats a boolean extended option.
+func boolOption(v bool) string {
+	if v {
+		return "1"
+	}
+
+	return "0"
+}
+
+// JournalOptions provides the journal options (-J) of mke2fs.
+type JournalOptions struct {
+	// Size of the internal journal in megabytes (by default it's chosen
+	// based on the size of the filesystem).
+	Size int
+	// FastCommitSize is the size of the fast commit area in kilobytes,
+	// appended to the journal when the fast_commit feature is enabled.
+	FastCommitSize int
+	// Location of the internal journal, as a block number or with a unit
+	// suffix (eg. "1G"), or as a percentage of the filesystem (eg. "50%").
+	Location string
+	// Device holding an external journal (created with the journal_dev
+	// feature), as a path, or as LABEL=label or UUID=uuid. External journals
+	// are sized by their device, so the other options don't apply.
+	Device string
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts JournalOptions) Validate() error {
+	var errs []error
+	if opts.Size < 0 {
+		errs = append(errs, invalidOption("invalid journal size %d", opts.Size))
+	}
+	if opts.FastCommitSize < 0 {
+		errs = append(errs, invalidOption("invalid fast commit size %d", opts.FastCommitSize))
+	}
+	if strings.Contains(opts.Location, ",") {
+		errs = append(errs, invalidOption("malformed journal location %q", opts.Location))
+	}
+	if strings.Contains(opts.Device, ",") {
+		errs = append(errs, invalidOption("malformed journal device %q", opts.Device))
+	}
+	if opts.Device != "" && (opts.Size != 0 || opts.FastCommitSize != 0 || opts.Location != "") {
+		errs = append(errs, invalidOption("external journals can't be sized or located"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// MarshalArg returns the options in the syntax of the -J option.
+func (opts JournalOptions) MarshalArg() string {
+	var options []string
+	if opts.Size > 0 {
+		options = append(options, "size="+strconv.Itoa(opts.Size))
+	}
+	if opts.FastCommitSize > 0 {
+		options = append(options, "fast_commit_size="+strconv.Itoa(opts.FastCommitSize))
+	}
+	if opts.Location != "" {
+		options = append(options, "location="+opts.Location)
+	}
+	if opts.Device != "" {
+		options = append(options, "device="+opts.Device)
+	}
+
+	return strings.Join(options, ",")
+}
@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtendedOptions(t *testing.T) {
+	lazy := false
+	discard := false
+	numBackups := 1
+
+	opts := ext4.ExtendedOptions{
+		Stride:               16,
+		StripeWidth:          64,
+		LazyItableInit:       &lazy,
+		Discard:              &discard,
+		RootOwner:            &ext4.RootOwner{UID: 1000, GID: 100},
+		HashSeed:             "c1b9d5a2-f162-11cf-9ece-0020afc76f16",
+		NumBackupSuperblocks: &numBackups,
+		Extra:                []string{"orphan_file_size=1M"},
+	}
+	require.NoError(t, opts.Validate())
+	require.Equal(t, "stride=16,stripe_width=64,lazy_itable_init=0,nodiscard,root_owner=1000:100,hash_seed=c1b9d5a2-f162-11cf-9ece-0020afc76f16,num_backup_sb=1,orphan_file_size=1M", opts.MarshalArg())
+
+	numBackups = 3
+	for name, opts := range map[string]ext4.ExtendedOptions{
+		"stride":       {Stride: -1},
+		"stripe width": {Stride: 16, StripeWidth: 24},
+		"offset":       {Offset: -4096},
+		"hash seed":    {HashSeed: "not-a-uuid"},
+		"backups":      {NumBackupSuperblocks: &numBackups},
+		"mmp interval": {MMPUpdateInterval: 301},
+		"extra":        {Extra: []string{"stride=1,stripe_width=2"}},
+	} {
+		require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+	}
+
+	t.Log("Creating a filesystem with extended options")
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+		ExtendedOptions: ext4.ExtendedOptions{
+			Stride:      16,
+			StripeWidth: 64,
+			HashSeed:    "c1b9d5a2-f162-11cf-9ece-0020afc76f16",
+			RootOwner:   &ext4.RootOwner{UID: 1000, GID: 100},
+		},
+		Quotas: []ext4.QuotaType{ext4.UserQuota},
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), sb.RAIDStride)
+	require.Equal(t, uint64(64), sb.RAIDStripeWidth)
+	require.Contains(t, sb.Features, "quota")
+
+	output, err := exec.Command("debugfs", "-R", "stat /", imagePath).Output()
+	require.NoError(t, err)
+	require.Contains(t, string(output), "User:  1000   Group:   100")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:          imagePath,
+		ExtendedOptions: ext4.ExtendedOptions{HashSeed: "not-a-uuid"},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestJournalOptions(t *testing.T) {
+	opts := ext4.JournalOptions{Size: 16, FastCommitSize: 256, Location: "50%"}
+	require.NoError(t, opts.Validate())
+	require.Equal(t, "size=16,fast_commit_size=256,location=50%", opts.MarshalArg())
+
+	opts = ext4.JournalOptions{Device: "UUID=c1b9d5a2-f162-11cf-9ece-0020afc76f16"}
+	require.NoError(t, opts.Validate())
+	require.Equal(t, "device=UUID=c1b9d5a2-f162-11cf-9ece-0020afc76f16", opts.MarshalArg())
+
+	for name, opts := range map[string]ext4.JournalOptions{
+		"size":        {Size: -1},
+		"fast commit": {FastCommitSize: -1},
+		"location":    {Location: "1G,size=4"},
+		"device":      {Device: "/dev/sdb1,size=4"},
+		"external":    {Device: "/dev/sdb1", Size: 16},
+	} {
+		require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+	}
+
+	t.Log("Creating a filesystem with a sized journal")
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:         imagePath,
+		Size:           64 * ext4.MiB,
+		JournalOptions: ext4.JournalOptions{Size: 8},
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "has_journal")
+	require.Equal(t, uint64(8*1024*1024)/uint64(sb.BlockSize), sb.JournalBlocks)
+}
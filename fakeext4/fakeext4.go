@@ -0,0 +1,1632 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fakeext4 provides a fake, in-memory implementation of
+// ext4.FilesystemManager, so that code provisioning filesystems can be unit
+// tested without root, block devices or e2fsprogs.
+//
+// The fake client records every call, and simulates the filesystems on each
+// device (their superblock, and the files written with the debugfs based
+// methods), along with mounts. Failures can be injected for any method, and
+// the result of filesystem checks can be set for each device.
+package fakeext4
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/partition"
+)
+
+// DefaultDeviceSize is the size of devices (in bytes), unless set with
+// SetDeviceSize.
+const DefaultDeviceSize = 1 << 30
+
+const (
+	// defaultBlockSize is the block size of new filesystems, unless set.
+	defaultBlockSize = 4096
+	// bytesPerInode is the ratio of bytes to inodes of new filesystems.
+	bytesPerInode = 16384
+	// firstInode is the first inode that isn't reserved.
+	firstInode = 11
+)
+
+// errNoFilesystem is wrapped by the *ext4.NotExt4Error returned for devices
+// that haven't been formatted.
+var errNoFilesystem = errors.New("no filesystem")
+
+// Call is a call made to the fake client.
+type Call struct {
+	// Method is the name of the method, eg. "CreateFilesystem".
+	Method string
+	// Device is the device (or image file, or mount point) the call operated
+	// on, if any.
+	Device string
+	// Args are the arguments of the call (excluding the context).
+	Args []any
+}
+
+// checkResult is the simulated result of checking a filesystem.
+type checkResult struct {
+	status   ext4.CheckStatus
+	problems []ext4.Problem
+}
+
+// filesystem is a simulated filesystem.
+type filesystem struct {
+	sb    ext4.SuperblockInfo
+	files fstest.MapFS
+}
+
+// Client is a fake implementation of ext4.FilesystemManager. It is safe for
+// concurrent use.
+type Client struct {
+	mu    sync.Mutex
+	calls []Call
+	// failures are the errors returned by each method.
+	failures map[string]error
+	// onceFailures are the errors returned by the next calls of each method.
+	onceFailures map[string][]error
+	// checks are the results of checking the filesystem on each device.
+	checks map[string]checkResult
+	// sizes are the sizes of devices (in bytes).
+	sizes map[string]int64
+	// filesystems are the filesystems on each device.
+	filesystems map[string]*filesystem
+	// mounts are the devices mounted at each mount point.
+	mounts map[string]string
+	// outputs are the standard output of each command run with RunCommand.
+	outputs map[string][]byte
+}
+
+var _ ext4.FilesystemManager = (*Client)(nil)
+
+// NewClient returns a fake client, with no filesystems.
+func NewClient() *Client {
+	return &Client{
+		failures:     make(map[string]error),
+		onceFailures: make(map[string][]error),
+		checks:       make(map[string]checkResult),
+		sizes:        make(map[string]int64),
+		filesystems:  make(map[string]*filesystem),
+		mounts:       make(map[string]string),
+		outputs:      make(map[string][]byte),
+	}
+}
+
+// Calls returns the calls made to the client, in order.
+func (c *Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.calls)
+}
+
+// CallsTo returns the calls made to the given method, in order.
+func (c *Client) CallsTo(method string) []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var calls []Call
+	for _, call := range c.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// FailOn makes every call of a method (eg. "ResizeFilesystem") return err. A
+// nil err clears the failure.
+func (c *Client) FailOn(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.failures, method)
+		return
+	}
+	c.failures[method] = err
+}
+
+// FailOnce makes the next call of a method return err. Repeated calls queue
+// errors for the following calls.
+func (c *Client) FailOnce(method string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onceFailures[method] = append(c.onceFailures[method], err)
+}
+
+// SetCheckStatus sets the exit status (and problems) of e2fsck for the
+// filesystem on a device. If the status is not OK, CheckFilesystem returns a
+// *ext4.CheckError. Errors reported as corrected are only reported by the
+// next check that is allowed to repair the filesystem.
+func (c *Client) SetCheckStatus(device string, status ext4.CheckStatus, problems ...ext4.Problem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks[device] = checkResult{status: status, problems: problems}
+}
+
+// SetDeviceSize sets the size of a device (in bytes), eg. to simulate a disk
+// that was grown.
+func (c *Client) SetDeviceSize(device string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sizes[device] = size
+}
+
+// SetCommandOutput sets the standard output of a command (eg. "cryptsetup")
+// run with RunCommand.
+func (c *Client) SetCommandOutput(name string, out []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.outputs[name] = out
+}
+
+// AddFilesystem adds an existing filesystem to a device, eg. to simulate a
+// device that was formatted before the test started.
+func (c *Client) AddFilesystem(device string, sb ext4.SuperblockInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.filesystems[device] = &filesystem{sb: sb, files: make(fstest.MapFS)}
+}
+
+// Files returns a copy of the files in the filesystem on a device (or nil if
+// it hasn't been formatted). Symbolic links hold their target as their data.
+func (c *Client) Files(device string) fstest.MapFS {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fsys, ok := c.filesystems[device]
+	if !ok {
+		return nil
+	}
+
+	files := make(fstest.MapFS, len(fsys.files))
+	for name, f := range fsys.files {
+		copied := *f
+		copied.Data = slices.Clone(f.Data)
+		files[name] = &copied
+	}
+
+	return files
+}
+
+// CreateFilesystem simulates creating an ext4 filesystem.
+func (c *Client) CreateFilesystem(_ context.Context, opts ext4.CreateOptions) (*ext4.CreatedFilesystem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("CreateFilesystem", opts.Device, opts); err != nil {
+		return nil, err
+	}
+
+	return c.createFilesystem(opts.Device, c.deviceSize(opts.Device), opts)
+}
+
+// CreateImage simulates creating a sparse image file, and formatting it.
+func (c *Client) CreateImage(_ context.Context, path string, size int64, opts ext4.CreateOptions) (*ext4.CreatedFilesystem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("CreateImage", path, size, opts); err != nil {
+		return nil, err
+	}
+
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: invalid image size %d", ext4.ErrInvalidOptions, size)
+	}
+
+	c.sizes[path] = size
+	opts.Device = path
+
+	return c.createFilesystem(path, size, opts)
+}
+
+// CompactImage simulates shrinking the filesystem in an image file to its
+// minimum size.
+func (c *Client) CompactImage(_ context.Context, imagePath string) (*ext4.ResizeResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("CompactImage", imagePath); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.unmounted(imagePath, ext4.ErrShrinkMounted)
+	if err != nil {
+		return nil, err
+	}
+
+	result := c.resize(imagePath, fsys, minimumBlockCount(&fsys.sb))
+	c.sizes[imagePath] = int64(result.NewBlockCount) * int64(result.BlockSize)
+
+	return result, nil
+}
+
+// SparsifyImage simulates punching holes over the free blocks of an image
+// file, returning the number of bytes deallocated.
+func (c *Client) SparsifyImage(_ context.Context, imagePath string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("SparsifyImage", imagePath); err != nil {
+		return 0, err
+	}
+
+	fsys, err := c.unmounted(imagePath, ext4.ErrSparsifyMounted)
+	if err != nil {
+		return 0, err
+	}
+
+	return fsys.sb.FreeBlocks * uint64(fsys.sb.BlockSize), nil
+}
+
+// CreateFilesystemFromTar simulates creating an ext4 filesystem populated
+// with the contents of a tar stream.
+func (c *Client) CreateFilesystemFromTar(_ context.Context, device string, r io.Reader, opts ext4.CreateOptions) (*ext4.CreatedFilesystem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("CreateFilesystemFromTar", device, opts); err != nil {
+		return nil, err
+	}
+
+	files, err := readTar(r)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Device = device
+	created, err := c.createFilesystem(device, c.deviceSize(device), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsys, ok := c.filesystems[device]; ok {
+		for name, f := range files {
+			fsys.files[name] = f
+		}
+	}
+
+	return created, nil
+}
+
+// CloneFilesystem simulates copying a filesystem, giving the clone a new
+// UUID.
+func (c *Client) CloneFilesystem(_ context.Context, src, dst string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("CloneFilesystem", dst, src); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.filesystem(src)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.unmounted(dst, nil); err != nil && !errors.As(err, new(*ext4.NotExt4Error)) {
+		return nil, err
+	}
+
+	clone := &filesystem{sb: fsys.sb, files: make(fstest.MapFS, len(fsys.files))}
+	clone.sb.UUID = newUUID()
+	clone.sb.Features = slices.Clone(fsys.sb.Features)
+	for name, f := range fsys.files {
+		copied := *f
+		clone.files[name] = &copied
+	}
+
+	c.filesystems[dst] = clone
+	c.sizes[dst] = max(c.deviceSize(dst), int64(fsys.sb.BlockCount)*int64(fsys.sb.BlockSize))
+
+	return superblock(clone), nil
+}
+
+// ConvertToExt4 simulates upgrading an ext2 or ext3 filesystem to ext4.
+func (c *Client) ConvertToExt4(_ context.Context, device string, opts ext4.ConvertOptions) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ConvertToExt4", device, opts); err != nil {
+		return nil, err
+	}
+
+	features := []string{"extent", "flex_bg", "huge_file", "dir_nlink", "extra_isize"}
+	if !opts.NoJournal {
+		features = append(features, "has_journal")
+	}
+
+	return c.setFeatures(device, append(features, opts.Features...), nil)
+}
+
+// EnableQuotas simulates enabling quota tracking.
+func (c *Client) EnableQuotas(_ context.Context, device string, types ...ext4.QuotaType) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("EnableQuotas", device, quotaArgs(types)...); err != nil {
+		return nil, err
+	}
+
+	features := []string{"quota"}
+	if slices.Contains(types, ext4.ProjectQuota) {
+		features = append(features, "project")
+	}
+
+	return c.setFeatures(device, features, nil)
+}
+
+// DisableQuotas simulates disabling quota tracking.
+func (c *Client) DisableQuotas(_ context.Context, device string, types ...ext4.QuotaType) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("DisableQuotas", device, quotaArgs(types)...); err != nil {
+		return nil, err
+	}
+
+	return c.setFeatures(device, nil, []string{"quota"})
+}
+
+// QuotaCheck simulates creating quota files for a mounted filesystem.
+func (c *Client) QuotaCheck(_ context.Context, mountPoint string, types ...ext4.QuotaType) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("QuotaCheck", mountPoint, quotaArgs(types)...); err != nil {
+		return err
+	}
+
+	if _, ok := c.mounts[mountPoint]; !ok {
+		return fmt.Errorf("%s is not a mount point", mountPoint)
+	}
+
+	return nil
+}
+
+// EnableEncryption simulates enabling the encrypt feature.
+func (c *Client) EnableEncryption(_ context.Context, device string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("EnableEncryption", device); err != nil {
+		return nil, err
+	}
+
+	return c.setFeatures(device, []string{"encrypt"}, nil)
+}
+
+// EnableVerity simulates enabling the verity feature.
+func (c *Client) EnableVerity(_ context.Context, device string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("EnableVerity", device); err != nil {
+		return nil, err
+	}
+
+	return c.setFeatures(device, []string{"verity"}, nil)
+}
+
+// RegenerateUUID simulates giving a filesystem a new random UUID.
+func (c *Client) RegenerateUUID(_ context.Context, device string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("RegenerateUUID", device); err != nil {
+		return "", err
+	}
+
+	return c.setUUID(device, ext4.RandomUUID)
+}
+
+// SetUUID simulates setting the UUID of a filesystem.
+func (c *Client) SetUUID(_ context.Context, device string, uuid ext4.UUID) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("SetUUID", device, uuid); err != nil {
+		return "", err
+	}
+
+	if uuid == "" {
+		return "", fmt.Errorf("%w: UUID is required", ext4.ErrInvalidOptions)
+	}
+	if err := uuid.Validate(); err != nil {
+		return "", err
+	}
+
+	return c.setUUID(device, uuid)
+}
+
+// SetLabel simulates setting the volume label of a filesystem.
+func (c *Client) SetLabel(_ context.Context, device, label string, policy ext4.LabelPolicy) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("SetLabel", device, label, policy); err != nil {
+		return "", err
+	}
+
+	label, err := policy.Apply(label)
+	if err != nil {
+		return "", err
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return "", err
+	}
+	fsys.sb.Label = label
+
+	return label, nil
+}
+
+// EnableChecksumSeed simulates enabling the metadata_csum_seed feature.
+func (c *Client) EnableChecksumSeed(_ context.Context, device string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("EnableChecksumSeed", device); err != nil {
+		return nil, err
+	}
+
+	return c.setFeatures(device, []string{"metadata_csum_seed"}, nil)
+}
+
+// DisableChecksumSeed simulates disabling the metadata_csum_seed feature.
+func (c *Client) DisableChecksumSeed(_ context.Context, device string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("DisableChecksumSeed", device); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.unmounted(device, nil); err != nil {
+		return nil, err
+	}
+
+	return c.setFeatures(device, nil, []string{"metadata_csum_seed"})
+}
+
+// ResizeFilesystem simulates resizing a filesystem. Mounted filesystems are
+// grown online, but can't be shrunk.
+func (c *Client) ResizeFilesystem(_ context.Context, opts ext4.ResizeOptions) (*ext4.ResizeResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ResizeFilesystem", opts.Device, opts); err != nil {
+		return nil, err
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.filesystem(opts.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	blockCount := uint64(c.deviceSize(opts.Device)) / uint64(fsys.sb.BlockSize)
+	if opts.Shrink {
+		blockCount = minimumBlockCount(&fsys.sb)
+	} else if opts.Size != 0 {
+		blockCount = uint64(opts.Size) / uint64(fsys.sb.BlockSize)
+	}
+
+	if blockCount < fsys.sb.BlockCount && c.mountPoint(opts.Device) != "" {
+		return nil, fmt.Errorf("%w: %s is mounted at %s, unmount it first", ext4.ErrShrinkMounted, opts.Device, c.mountPoint(opts.Device))
+	}
+
+	var check *ext4.CheckResult
+	if opts.Check && c.mountPoint(opts.Device) == "" {
+		check, err = c.check(ext4.CheckOptions{Device: opts.Device, Force: true, Preen: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.fits(opts.Device, fsys, blockCount); err != nil {
+		return nil, err
+	}
+
+	result := c.resize(opts.Device, fsys, blockCount)
+	result.Check = check
+
+	return result, nil
+}
+
+// GrowToFillDevice simulates growing a filesystem to the size of its device.
+func (c *Client) GrowToFillDevice(_ context.Context, device string) (*ext4.ResizeResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("GrowToFillDevice", device); err != nil {
+		return nil, err
+	}
+
+	return c.growToFillDevice(device)
+}
+
+// GrowPartitionAndFilesystem simulates growing a partition to the end of
+// its disk, and the filesystem on it to fill the partition. The partition
+// (eg. /dev/sda1) is grown to the size of the disk (see SetDeviceSize).
+func (c *Client) GrowPartitionAndFilesystem(_ context.Context, disk string, partitionNumber int) (*ext4.ResizeResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("GrowPartitionAndFilesystem", disk, partitionNumber); err != nil {
+		return nil, err
+	}
+
+	if partitionNumber < 1 {
+		return nil, fmt.Errorf("%w: invalid partition number %d", ext4.ErrInvalidOptions, partitionNumber)
+	}
+
+	device := partition.Path(disk, partitionNumber)
+	if _, err := c.filesystem(device); err != nil {
+		return nil, err
+	}
+
+	c.sizes[device] = c.deviceSize(disk)
+
+	return c.growToFillDevice(device)
+}
+
+// SafeShrink simulates checking a filesystem, then shrinking it to the target
+// size.
+func (c *Client) SafeShrink(_ context.Context, device string, targetSize int64, opts ext4.SafetyOptions) (*ext4.ResizeResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("SafeShrink", device, targetSize, opts); err != nil {
+		return nil, err
+	}
+
+	margin := ext4.DefaultShrinkMargin
+	if opts.Margin != nil {
+		margin = *opts.Margin
+	}
+
+	if device == "" {
+		return nil, fmt.Errorf("%w: device is required", ext4.ErrInvalidOptions)
+	}
+	if targetSize <= 0 {
+		return nil, fmt.Errorf("%w: invalid target size %d", ext4.ErrInvalidOptions, targetSize)
+	}
+	if margin < 0 {
+		return nil, fmt.Errorf("%w: invalid margin %g", ext4.ErrInvalidOptions, margin)
+	}
+
+	fsys, err := c.unmounted(device, ext4.ErrShrinkMounted)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.check(ext4.CheckOptions{Device: device, Force: true}); err != nil {
+		return nil, fmt.Errorf("failed to check filesystem before shrinking: %w", err)
+	}
+
+	blockCount := uint64(targetSize) / uint64(fsys.sb.BlockSize)
+	if blockCount >= fsys.sb.BlockCount {
+		return nil, fmt.Errorf("%w: target size of %d blocks is not smaller than the filesystem (%d blocks)", ext4.ErrInvalidOptions, blockCount, fsys.sb.BlockCount)
+	}
+
+	minBlockCount := minimumBlockCount(&fsys.sb)
+	if required := withMargin(minBlockCount, margin); blockCount < required {
+		return nil, fmt.Errorf("%w: target size of %d blocks is below the minimum of %d blocks (including a %.0f%% margin)",
+			ext4.ErrBelowMinimumSize, blockCount, required, margin*100)
+	}
+
+	return c.resize(device, fsys, blockCount), nil
+}
+
+// EstimateShrink estimates how small a simulated filesystem could be shrunk.
+func (c *Client) EstimateShrink(_ context.Context, device string, opts ext4.ShrinkEstimateOptions) (*ext4.ShrinkEstimate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("EstimateShrink", device, opts); err != nil {
+		return nil, err
+	}
+
+	slack := ext4.DefaultShrinkMargin
+	if opts.Slack != nil {
+		slack = *opts.Slack
+	}
+	if slack < 0 {
+		return nil, fmt.Errorf("%w: invalid slack %g", ext4.ErrInvalidOptions, slack)
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	minBlockCount := minimumBlockCount(&fsys.sb)
+	blockCount := min(withMargin(minBlockCount, slack), fsys.sb.BlockCount)
+
+	return &ext4.ShrinkEstimate{
+		BlockSize:         fsys.sb.BlockSize,
+		BlockCount:        fsys.sb.BlockCount,
+		MinimumBlockCount: minBlockCount,
+		Size:              int64(blockCount) * int64(fsys.sb.BlockSize),
+	}, nil
+}
+
+// WipeDevice simulates destroying the contents of a device (including its
+// filesystem).
+func (c *Client) WipeDevice(_ context.Context, device string, opts ext4.WipeOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("WipeDevice", device, opts); err != nil {
+		return err
+	}
+
+	if device == "" {
+		return fmt.Errorf("%w: device is required", ext4.ErrInvalidOptions)
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if mountPoint := c.mountPoint(device); mountPoint != "" {
+		return fmt.Errorf("%w: %s is mounted at %s", ext4.ErrWipeMounted, device, mountPoint)
+	}
+
+	delete(c.filesystems, device)
+	delete(c.checks, device)
+
+	return nil
+}
+
+// CheckFilesystem simulates checking a filesystem, with the result set by
+// SetCheckStatus (by default, the filesystem is consistent).
+func (c *Client) CheckFilesystem(_ context.Context, opts ext4.CheckOptions) (*ext4.CheckResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("CheckFilesystem", opts.Device, opts); err != nil {
+		return nil, err
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c.check(opts)
+}
+
+// Mount simulates mounting the filesystem on a device at the target
+// directory.
+func (c *Client) Mount(_ context.Context, device, target string, opts ext4.MountOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("Mount", device, target, opts); err != nil {
+		return err
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return err
+	}
+
+	if mounted, ok := c.mounts[target]; ok {
+		return fmt.Errorf("%s is already mounted at %s", mounted, target)
+	}
+	if mountPoint := c.mountPoint(device); mountPoint != "" {
+		return fmt.Errorf("%s is already mounted at %s", device, mountPoint)
+	}
+
+	c.mounts[target] = device
+	fsys.sb.LastMountedOn = target
+	fsys.sb.LastMounted = time.Now()
+	fsys.sb.MountCount++
+
+	return nil
+}
+
+// Unmount simulates unmounting the filesystem mounted at the target
+// directory.
+func (c *Client) Unmount(_ context.Context, target string, opts ext4.UnmountOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("Unmount", target, opts); err != nil {
+		return err
+	}
+
+	if _, ok := c.mounts[target]; !ok {
+		return fmt.Errorf("%s is not mounted", target)
+	}
+	delete(c.mounts, target)
+
+	return nil
+}
+
+// IsMounted returns true if the filesystem on a device is mounted.
+func (c *Client) IsMounted(_ context.Context, device string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("IsMounted", device); err != nil {
+		return false, err
+	}
+
+	return c.mountPoint(device) != "", nil
+}
+
+// Trim simulates discarding the free blocks of a mounted filesystem,
+// returning the number of bytes discarded.
+func (c *Client) Trim(_ context.Context, mountPoint string, opts ext4.TrimOptions) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("Trim", mountPoint, opts); err != nil {
+		return 0, err
+	}
+
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+
+	device, ok := c.mounts[mountPoint]
+	if !ok {
+		return 0, fmt.Errorf("%s is not a mount point", mountPoint)
+	}
+
+	sb := c.filesystems[device].sb
+	return sb.FreeBlocks * uint64(sb.BlockSize), nil
+}
+
+// VerifyExt4 checks that a device has a simulated filesystem, returning its
+// superblock. If it doesn't, a *ext4.NotExt4Error is returned.
+func (c *Client) VerifyExt4(_ context.Context, device string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("VerifyExt4", device); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	return superblock(fsys), nil
+}
+
+// HealthSummary assesses the health of a simulated filesystem, from its
+// state and the result of checking it (see SetCheckStatus).
+func (c *Client) HealthSummary(_ context.Context, device string) (*ext4.FilesystemHealth, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("HealthSummary", device); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	health := &ext4.FilesystemHealth{
+		Verdict:       ext4.Healthy,
+		State:         fsys.sb.State,
+		Mounted:       c.mountPoint(device) != "",
+		ErrorCount:    fsys.sb.ErrorCount,
+		LastErrorTime: fsys.sb.LastErrorTime,
+		LastChecked:   fsys.sb.LastChecked,
+		MountCount:    fsys.sb.MountCount,
+		MaxMountCount: fsys.sb.MaxMountCount,
+	}
+
+	if fsys.sb.ErrorCount > 0 {
+		health.Verdict = ext4.Degraded
+		health.Reasons = append(health.Reasons, fmt.Sprintf("%d filesystem errors recorded", fsys.sb.ErrorCount))
+	}
+
+	if !health.Mounted {
+		result := c.checks[device]
+		health.Check = &ext4.CheckResult{Status: result.status, Problems: result.problems}
+		if result.status&ext4.CheckErrorsCorrected != 0 || !result.status.OK() {
+			health.Verdict = ext4.Corrupt
+			health.Reasons = append(health.Reasons, fmt.Sprintf("consistency check failed (%s)", result.status))
+		}
+	}
+
+	return health, nil
+}
+
+// ReadSuperblock returns the superblock of a simulated filesystem.
+func (c *Client) ReadSuperblock(_ context.Context, device string) (*ext4.SuperblockInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ReadSuperblock", device); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	return superblock(fsys), nil
+}
+
+// ListBlockGroups returns the (simulated) block groups of a filesystem.
+func (c *Client) ListBlockGroups(_ context.Context, device string) ([]ext4.BlockGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ListBlockGroups", device); err != nil {
+		return nil, err
+	}
+
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	sb := fsys.sb
+	var groups []ext4.BlockGroup
+	for start := sb.FirstBlock; start < sb.BlockCount; start += sb.BlocksPerGroup {
+		groups = append(groups, ext4.BlockGroup{
+			Number:         len(groups),
+			Blocks:         ext4.Range{Start: start, End: min(start+sb.BlocksPerGroup, sb.BlockCount) - 1},
+			FreeInodeCount: sb.InodesPerGroup,
+		})
+	}
+
+	return groups, nil
+}
+
+// ListBadBlocks returns no bad blocks.
+func (c *Client) ListBadBlocks(_ context.Context, device string) ([]uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ListBadBlocks", device); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.filesystem(device); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// DumpJournal returns an empty journal.
+func (c *Client) DumpJournal(_ context.Context, device string) (*ext4.Journal, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("DumpJournal", device); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.unmounted(device, nil); err != nil {
+		return nil, err
+	}
+
+	return &ext4.Journal{}, nil
+}
+
+// FindFilesUsingBlocks reports each block as unused by any inode.
+func (c *Client) FindFilesUsingBlocks(_ context.Context, device string, blocks []uint64) ([]ext4.BlockOwner, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("FindFilesUsingBlocks", device, blocks); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.filesystem(device); err != nil {
+		return nil, err
+	}
+
+	owners := make([]ext4.BlockOwner, len(blocks))
+	for i, block := range blocks {
+		owners[i] = ext4.BlockOwner{Block: block}
+	}
+
+	return owners, nil
+}
+
+// ExportTar writes the files of a simulated filesystem to w as a tar stream.
+func (c *Client) ExportTar(_ context.Context, device string, w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ExportTar", device); err != nil {
+		return err
+	}
+
+	fsys, err := c.unmounted(device, nil)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, name := range sortedNames(fsys.files) {
+		f := fsys.files[name]
+
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(f.Mode.Perm()),
+			ModTime: f.ModTime,
+		}
+		switch f.Mode.Type() {
+		case fs.ModeDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case fs.ModeSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(f.Data)
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(f.Data))
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(f.Data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// ExtractDirectory copies a directory tree out of a simulated filesystem
+// onto the host filesystem.
+func (c *Client) ExtractDirectory(_ context.Context, device, srcPath, destDir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("ExtractDirectory", device, srcPath, destDir); err != nil {
+		return err
+	}
+
+	fsys, err := c.unmounted(device, nil)
+	if err != nil {
+		return err
+	}
+
+	src := cleanPath(srcPath)
+	if info, err := fs.Stat(fsys.files, src); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", srcPath)
+	}
+
+	return fs.WalkDir(fsys.files, src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(filepath.FromSlash(src), filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(destDir, rel)
+
+		f := fsys.files[name]
+		switch {
+		case d.IsDir():
+			perm := fs.FileMode(0o755)
+			if f != nil {
+				perm = f.Mode.Perm()
+			}
+			return os.MkdirAll(dest, perm)
+		case d.Type() == fs.ModeSymlink:
+			return os.Symlink(string(f.Data), dest)
+		default:
+			return os.WriteFile(dest, f.Data, f.Mode.Perm())
+		}
+	})
+}
+
+// WriteFileToImage copies a file from the host into a simulated filesystem.
+// The parent directory must already exist, and the destination must not.
+func (c *Client) WriteFileToImage(_ context.Context, device, hostPath, imagePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("WriteFileToImage", device, hostPath, imagePath); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(hostPath)
+	if err != nil {
+		return err
+	}
+
+	return c.create(device, imagePath, &fstest.MapFile{Data: data, Mode: info.Mode().Perm(), ModTime: info.ModTime()})
+}
+
+// MakeDirectoryInImage creates a directory in a simulated filesystem.
+func (c *Client) MakeDirectoryInImage(_ context.Context, device, imagePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("MakeDirectoryInImage", device, imagePath); err != nil {
+		return err
+	}
+
+	return c.create(device, imagePath, &fstest.MapFile{Mode: fs.ModeDir | 0o755, ModTime: time.Now()})
+}
+
+// SymlinkInImage creates a symbolic link in a simulated filesystem.
+func (c *Client) SymlinkInImage(_ context.Context, device, target, imagePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("SymlinkInImage", device, target, imagePath); err != nil {
+		return err
+	}
+
+	return c.create(device, imagePath, &fstest.MapFile{Data: []byte(target), Mode: fs.ModeSymlink | 0o777, ModTime: time.Now()})
+}
+
+// RemoveFromImage removes a file, symbolic link, or empty directory from a
+// simulated filesystem.
+func (c *Client) RemoveFromImage(_ context.Context, device, imagePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("RemoveFromImage", device, imagePath); err != nil {
+		return err
+	}
+
+	fsys, err := c.unmounted(device, nil)
+	if err != nil {
+		return err
+	}
+
+	name := cleanPath(imagePath)
+	f, ok := fsys.files[name]
+	if !ok || name == "." {
+		return &fs.PathError{Op: "remove", Path: imagePath, Err: fs.ErrNotExist}
+	}
+
+	if f.Mode.IsDir() {
+		for other := range fsys.files {
+			if strings.HasPrefix(other, name+"/") {
+				return &fs.PathError{Op: "remove", Path: imagePath, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+
+	delete(fsys.files, name)
+
+	return nil
+}
+
+// RunCommand records the command, returning the output set for it with
+// SetCommandOutput (if any). The command isn't run.
+func (c *Client) RunCommand(_ context.Context, name string, args []string, opts ext4.RunOptions) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.record("RunCommand", "", name, args, opts); err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(c.outputs[name]), nil
+}
+
+// record records a call, returning the failure injected for the method (if
+// any). The caller must hold the lock.
+func (c *Client) record(method, device string, args ...any) error {
+	c.calls = append(c.calls, Call{Method: method, Device: device, Args: args})
+
+	if errs := c.onceFailures[method]; len(errs) > 0 {
+		c.onceFailures[method] = errs[1:]
+		return errs[0]
+	}
+
+	return c.failures[method]
+}
+
+// deviceSize returns the size of a device (in bytes).
+func (c *Client) deviceSize(device string) int64 {
+	if size, ok := c.sizes[device]; ok {
+		return size
+	}
+
+	return DefaultDeviceSize
+}
+
+// mountPoint returns where the filesystem on a device is mounted (or an empty
+// string if it isn't).
+func (c *Client) mountPoint(device string) string {
+	for target, mounted := range c.mounts {
+		if mounted == device {
+			return target
+		}
+	}
+
+	return ""
+}
+
+// filesystem returns the filesystem on a device, or a *ext4.NotExt4Error if
+// it hasn't been formatted.
+func (c *Client) filesystem(device string) (*filesystem, error) {
+	fsys, ok := c.filesystems[device]
+	if !ok {
+		return nil, &ext4.NotExt4Error{Device: device, Err: errNoFilesystem}
+	}
+
+	return fsys, nil
+}
+
+// unmounted returns the filesystem on a device, which must not be mounted.
+// If it is, an error wrapping mountedErr (if set) is returned.
+func (c *Client) unmounted(device string, mountedErr error) (*filesystem, error) {
+	if mountPoint := c.mountPoint(device); mountPoint != "" {
+		if mountedErr != nil {
+			return nil, fmt.Errorf("%w: %s is mounted at %s, unmount it first", mountedErr, device, mountPoint)
+		}
+		return nil, fmt.Errorf("%s is mounted at %s, unmount it first", device, mountPoint)
+	}
+
+	return c.filesystem(device)
+}
+
+// createFilesystem simulates creating a filesystem on a device of the given
+// size.
+func (c *Client) createFilesystem(device string, size int64, opts ext4.CreateOptions) (*ext4.CreatedFilesystem, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if mountPoint := c.mountPoint(device); mountPoint != "" {
+		return nil, fmt.Errorf("%s is mounted at %s; will not make a filesystem here", device, mountPoint)
+	}
+
+	if opts.Size != 0 {
+		if int64(opts.Size) > size {
+			return nil, fmt.Errorf("filesystem larger than apparent device size (%d > %d bytes)", opts.Size, size)
+		}
+		size = int64(opts.Size)
+	}
+
+	fsys := &filesystem{sb: newSuperblock(size, opts), files: make(fstest.MapFS)}
+	if opts.RootDirectory != "" {
+		files, err := readDir(opts.RootDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to populate filesystem: %w", err)
+		}
+		fsys.files = files
+	}
+
+	if !opts.DryRun {
+		c.filesystems[device] = fsys
+		delete(c.checks, device)
+	}
+
+	sb := fsys.sb
+	return &ext4.CreatedFilesystem{
+		UUID:               sb.UUID,
+		Label:              sb.Label,
+		BlockSize:          sb.BlockSize,
+		BlockCount:         sb.BlockCount,
+		InodeCount:         sb.InodeCount,
+		ReservedBlockCount: sb.ReservedBlockCount,
+		FirstDataBlock:     sb.FirstBlock,
+		BlockGroupCount:    int((sb.BlockCount - sb.FirstBlock + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup),
+		BlocksPerGroup:     sb.BlocksPerGroup,
+		InodesPerGroup:     sb.InodesPerGroup,
+		JournalBlocks:      sb.JournalBlocks,
+	}, nil
+}
+
+// check simulates checking a filesystem.
+func (c *Client) check(opts ext4.CheckOptions) (*ext4.CheckResult, error) {
+	fsys, err := c.filesystem(opts.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	result := c.checks[opts.Device]
+	if !opts.NoFix && result.status&ext4.CheckErrorsCorrected != 0 {
+		// Once corrected, the errors are gone.
+		delete(c.checks, opts.Device)
+	}
+
+	if !opts.NoFix {
+		fsys.sb.LastChecked = time.Now()
+		fsys.sb.MountCount = 0
+	}
+
+	checkResult := &ext4.CheckResult{Status: result.status, Problems: slices.Clone(result.problems)}
+	if !result.status.OK() {
+		return checkResult, &ext4.CheckError{
+			Status:   result.status,
+			Problems: checkResult.Problems,
+			Err:      fmt.Errorf("e2fsck exited with status %d", int(result.status)),
+		}
+	}
+
+	return checkResult, nil
+}
+
+// fits returns an error if a filesystem of the given size doesn't fit on its
+// device, or its contents don't fit in the filesystem.
+func (c *Client) fits(device string, fsys *filesystem, blockCount uint64) error {
+	if size := c.deviceSize(device); int64(blockCount)*int64(fsys.sb.BlockSize) > size {
+		return fmt.Errorf("the containing partition (or device) is only %d (%dk) blocks", uint64(size)/uint64(fsys.sb.BlockSize), fsys.sb.BlockSize/1024)
+	}
+
+	if blockCount < minimumBlockCount(&fsys.sb) {
+		return fmt.Errorf("%w: %d blocks requested, but %d blocks are in use", ext4.ErrBelowMinimumSize, blockCount, minimumBlockCount(&fsys.sb))
+	}
+
+	return nil
+}
+
+// resize sets the size of a filesystem.
+func (c *Client) resize(device string, fsys *filesystem, blockCount uint64) *ext4.ResizeResult {
+	result := &ext4.ResizeResult{
+		OldBlockCount: fsys.sb.BlockCount,
+		NewBlockCount: blockCount,
+		BlockSize:     fsys.sb.BlockSize,
+		Online:        c.mountPoint(device) != "",
+	}
+
+	used := fsys.sb.BlockCount - fsys.sb.FreeBlocks
+	fsys.sb.BlockCount = blockCount
+	fsys.sb.FreeBlocks = blockCount - used
+	fsys.sb.ReservedBlockCount = blockCount / 20
+
+	groups := (blockCount - fsys.sb.FirstBlock + fsys.sb.BlocksPerGroup - 1) / fsys.sb.BlocksPerGroup
+	usedInodes := fsys.sb.InodeCount - fsys.sb.FreeInodes
+	fsys.sb.InodeCount = groups * fsys.sb.InodesPerGroup
+	fsys.sb.FreeInodes = fsys.sb.InodeCount - usedInodes
+
+	return result
+}
+
+// growToFillDevice grows a filesystem to the size of its device.
+func (c *Client) growToFillDevice(device string) (*ext4.ResizeResult, error) {
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	blockCount := uint64(c.deviceSize(device)) / uint64(fsys.sb.BlockSize)
+	if blockCount <= fsys.sb.BlockCount {
+		// Already as large as the device.
+		blockCount = fsys.sb.BlockCount
+	}
+
+	return c.resize(device, fsys, blockCount), nil
+}
+
+// setFeatures enables and disables features of a filesystem, returning its
+// superblock.
+func (c *Client) setFeatures(device string, enable, disable []string) (*ext4.SuperblockInfo, error) {
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, feature := range enable {
+		if !slices.Contains(fsys.sb.Features, feature) {
+			fsys.sb.Features = append(fsys.sb.Features, feature)
+		}
+	}
+	fsys.sb.Features = slices.DeleteFunc(fsys.sb.Features, func(feature string) bool {
+		return slices.Contains(disable, feature)
+	})
+
+	return superblock(fsys), nil
+}
+
+// setUUID sets the UUID of a filesystem, returning the new UUID.
+func (c *Client) setUUID(device string, uuid ext4.UUID) (string, error) {
+	fsys, err := c.filesystem(device)
+	if err != nil {
+		return "", err
+	}
+
+	fsys.sb.UUID = resolveUUID(uuid)
+	if slices.Contains(fsys.sb.Features, "metadata_csum") && !slices.Contains(fsys.sb.Features, "metadata_csum_seed") {
+		fsys.sb.Features = append(fsys.sb.Features, "metadata_csum_seed")
+	}
+
+	return fsys.sb.UUID, nil
+}
+
+// create adds a file (or directory, or symbolic link) to a filesystem.
+func (c *Client) create(device, imagePath string, f *fstest.MapFile) error {
+	fsys, err := c.unmounted(device, nil)
+	if err != nil {
+		return err
+	}
+
+	name := cleanPath(imagePath)
+	if _, ok := fsys.files[name]; ok || name == "." {
+		return &fs.PathError{Op: "create", Path: imagePath, Err: fs.ErrExist}
+	}
+
+	if dir := path.Dir(name); dir != "." {
+		if info, err := fs.Stat(fsys.files, dir); err != nil || !info.IsDir() {
+			return &fs.PathError{Op: "create", Path: imagePath, Err: fs.ErrNotExist}
+		}
+	}
+
+	fsys.files[name] = f
+
+	return nil
+}
+
+// newSuperblock returns the superblock of a new filesystem of the given size.
+func newSuperblock(size int64, opts ext4.CreateOptions) ext4.SuperblockInfo {
+	blockSize := defaultBlockSize
+	if opts.BlockSize != nil {
+		blockSize = *opts.BlockSize
+	}
+
+	var features []string
+	switch opts.Type {
+	case ext4.Ext2:
+		features = []string{"ext_attr", "resize_inode", "dir_index", "filetype", "sparse_super", "large_file"}
+	case ext4.Ext3:
+		features = []string{"has_journal", "ext_attr", "resize_inode", "dir_index", "filetype", "sparse_super", "large_file"}
+	default:
+		features = []string{"has_journal", "ext_attr", "resize_inode", "dir_index", "filetype", "extent", "64bit",
+			"flex_bg", "sparse_super", "large_file", "huge_file", "dir_nlink", "extra_isize", "metadata_csum"}
+	}
+
+	featureSet := ext4.ParseFeatureSet(opts.Features)
+	for feature, enabled := range opts.FeatureSet {
+		featureSet[feature] = enabled
+	}
+	for feature, enabled := range featureSet {
+		if enabled && !slices.Contains(features, string(feature)) {
+			features = append(features, string(feature))
+		} else if !enabled {
+			features = slices.DeleteFunc(features, func(f string) bool { return f == string(feature) })
+		}
+	}
+
+	sb := ext4.SuperblockInfo{
+		Label:          opts.Label,
+		UUID:           resolveUUID(opts.UUID),
+		Magic:          0xEF53,
+		Revision:       1,
+		Features:       features,
+		State:          "clean",
+		ErrorBehavior:  "Continue",
+		CreatorOS:      "Linux",
+		BlockSize:      blockSize,
+		BlockCount:     uint64(size) / uint64(blockSize),
+		BlocksPerGroup: uint64(blockSize) * 8,
+		InodeSize:      256,
+		FirstInode:     firstInode,
+		Created:        time.Now(),
+		LastWritten:    time.Now(),
+		LastChecked:    time.Now(),
+		MaxMountCount:  -1,
+	}
+	if blockSize == 1024 {
+		sb.FirstBlock = 1
+	}
+
+	groups := (sb.BlockCount - sb.FirstBlock + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup
+	sb.InodesPerGroup = max(uint64(size)/bytesPerInode/groups, 16)
+	sb.InodeCount = groups * sb.InodesPerGroup
+	sb.FreeInodes = sb.InodeCount - firstInode
+	sb.ReservedBlockCount = sb.BlockCount / 20
+
+	// Metadata takes up a few percent of the filesystem.
+	used := sb.BlockCount / 32
+	if slices.Contains(features, "has_journal") {
+		sb.JournalInode = 8
+		sb.JournalBlocks = min(sb.BlockCount/64, 262144)
+		used += sb.JournalBlocks
+	}
+	sb.FreeBlocks = sb.BlockCount - used
+
+	return sb
+}
+
+// superblock returns a copy of the superblock of a filesystem.
+func superblock(fsys *filesystem) *ext4.SuperblockInfo {
+	sb := fsys.sb
+	sb.Features = slices.Clone(fsys.sb.Features)
+
+	return &sb
+}
+
+// minimumBlockCount returns the minimum size of a filesystem (in blocks).
+func minimumBlockCount(sb *ext4.SuperblockInfo) uint64 {
+	return sb.BlockCount - sb.FreeBlocks
+}
+
+// withMargin adds a margin (as a fraction) to a block count.
+func withMargin(blockCount uint64, margin float64) uint64 {
+	return blockCount + uint64(math.Ceil(float64(blockCount)*margin))
+}
+
+// resolveUUID returns the UUID set by a UUID option.
+func resolveUUID(uuid ext4.UUID) string {
+	switch uuid {
+	case "", ext4.RandomUUID, ext4.TimeUUID:
+		return newUUID()
+	case ext4.ClearUUID:
+		return "00000000-0000-0000-0000-000000000000"
+	default:
+		return string(uuid)
+	}
+}
+
+// newUUID returns a new random (version 4) UUID.
+func newUUID() string {
+	uuid, _ := ext4.NewRandomUUID()
+	return string(uuid)
+}
+
+// quotaArgs returns quota types as call arguments.
+func quotaArgs(types []ext4.QuotaType) []any {
+	args := make([]any, len(types))
+	for i, t := range types {
+		args[i] = t
+	}
+
+	return args
+}
+
+// cleanPath returns the name of a path in an image, as used by fs.FS.
+func cleanPath(p string) string {
+	if name := strings.TrimPrefix(path.Clean("/"+p), "/"); name != "" {
+		return name
+	}
+
+	return "."
+}
+
+// sortedNames returns the names of the files of a filesystem in order, so
+// directories come before their contents.
+func sortedNames(files fstest.MapFS) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// readDir reads a directory tree on the host.
+func readDir(root string) (fstest.MapFS, error) {
+	files := make(fstest.MapFS)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		f := &fstest.MapFile{Mode: info.Mode(), ModTime: info.ModTime()}
+		switch {
+		case d.Type() == fs.ModeSymlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			f.Data = []byte(target)
+		case d.Type().IsRegular():
+			if f.Data, err = os.ReadFile(p); err != nil {
+				return err
+			}
+		}
+		files[filepath.ToSlash(rel)] = f
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// readTar reads the files of a tar stream.
+func readTar(r io.Reader) (fstest.MapFS, error) {
+	files := make(fstest.MapFS)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read tar stream: %w", err)
+		}
+
+		name := cleanPath(hdr.Name)
+		if name == "." {
+			continue
+		}
+
+		f := &fstest.MapFile{Mode: fs.FileMode(hdr.Mode).Perm(), ModTime: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			f.Mode |= fs.ModeDir
+		case tar.TypeSymlink:
+			f.Mode |= fs.ModeSymlink
+			f.Data = []byte(hdr.Linkname)
+		case tar.TypeReg:
+			if f.Data, err = io.ReadAll(tr); err != nil {
+				return nil, fmt.Errorf("failed to read tar stream: %w", err)
+			}
+		default:
+			continue
+		}
+		files[name] = f
+	}
+}
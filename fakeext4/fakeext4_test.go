@@ -0,0 +1,256 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakeext4_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/fakeext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+
+	_, err := c.ReadSuperblock(ctx, "/dev/sdb")
+	var notExt4Err *ext4.NotExt4Error
+	require.ErrorAs(t, err, &notExt4Err)
+
+	created, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: "/dev/sdb", Size: 512 * ext4.MiB, Label: "data"})
+	require.NoError(t, err)
+	require.Equal(t, "data", created.Label)
+	require.Equal(t, uint64(512<<20/4096), created.BlockCount)
+
+	sb, err := c.VerifyExt4(ctx, "/dev/sdb")
+	require.NoError(t, err)
+	require.Equal(t, created.UUID, sb.UUID)
+	require.Contains(t, sb.Features, "metadata_csum")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: "/dev/sdc", Label: "a label that is far too long"})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	t.Log("Mounting and growing the filesystem")
+
+	require.NoError(t, c.Mount(ctx, "/dev/sdb", "/mnt/data", ext4.MountOptions{}))
+
+	mounted, err := c.IsMounted(ctx, "/dev/sdb")
+	require.NoError(t, err)
+	require.True(t, mounted)
+
+	result, err := c.GrowToFillDevice(ctx, "/dev/sdb")
+	require.NoError(t, err)
+	require.True(t, result.Online)
+	require.Equal(t, uint64(fakeext4.DefaultDeviceSize/4096), result.NewBlockCount)
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{Device: "/dev/sdb", Size: 256 * ext4.MiB})
+	require.ErrorIs(t, err, ext4.ErrShrinkMounted)
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{Device: "/dev/sdb", Size: 2 * ext4.GiB})
+	require.Error(t, err)
+
+	require.NoError(t, c.Unmount(ctx, "/mnt/data", ext4.UnmountOptions{}))
+
+	result, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{Device: "/dev/sdb", Size: 256 * ext4.MiB})
+	require.NoError(t, err)
+	require.False(t, result.Online)
+	require.Equal(t, uint64(256<<20/4096), result.NewBlockCount)
+
+	t.Log("Verifying the calls were recorded")
+
+	calls := c.CallsTo("ResizeFilesystem")
+	require.Len(t, calls, 3)
+	require.Equal(t, "/dev/sdb", calls[0].Device)
+	require.Equal(t, ext4.ResizeOptions{Device: "/dev/sdb", Size: 256 * ext4.MiB}, calls[0].Args[0])
+
+	require.Equal(t, "ReadSuperblock", c.Calls()[0].Method)
+}
+
+func TestFailures(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+
+	errBoom := errors.New("boom")
+
+	c.FailOnce("CreateFilesystem", errBoom)
+
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: "/dev/sdb"})
+	require.ErrorIs(t, err, errBoom)
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: "/dev/sdb"})
+	require.NoError(t, err)
+
+	c.FailOn("Mount", errBoom)
+
+	for i := 0; i < 2; i++ {
+		err = c.Mount(ctx, "/dev/sdb", "/mnt", ext4.MountOptions{})
+		require.ErrorIs(t, err, errBoom)
+	}
+
+	c.FailOn("Mount", nil)
+
+	require.NoError(t, c.Mount(ctx, "/dev/sdb", "/mnt", ext4.MountOptions{}))
+	require.Len(t, c.CallsTo("Mount"), 3)
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{Device: "/dev/sdb"})
+	require.NoError(t, err)
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: "/dev/sdb", Force: true})
+	require.NoError(t, err)
+	require.Equal(t, ext4.CheckStatus(0), result.Status)
+
+	t.Log("Correcting errors")
+
+	problem := ext4.Problem{Pass: 5, Description: "Block bitmap differences", Action: "FIXED", Fixed: true}
+	c.SetCheckStatus("/dev/sdb", ext4.CheckErrorsCorrected, problem)
+
+	// A read-only check leaves the errors in place.
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: "/dev/sdb", NoFix: true})
+	require.NoError(t, err)
+	require.Equal(t, ext4.CheckErrorsCorrected, result.Status)
+
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: "/dev/sdb", Preen: true})
+	require.NoError(t, err)
+	require.Equal(t, ext4.CheckErrorsCorrected, result.Status)
+	require.Equal(t, []ext4.Problem{problem}, result.Problems)
+
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: "/dev/sdb", Preen: true})
+	require.NoError(t, err)
+	require.Equal(t, ext4.CheckStatus(0), result.Status)
+
+	t.Log("Leaving errors uncorrected")
+
+	c.SetCheckStatus("/dev/sdb", ext4.CheckErrorsUncorrected)
+
+	result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: "/dev/sdb", Preen: true})
+	var checkErr *ext4.CheckError
+	require.ErrorAs(t, err, &checkErr)
+	require.Equal(t, ext4.CheckErrorsUncorrected, checkErr.Status)
+	require.Equal(t, ext4.CheckErrorsUncorrected, result.Status)
+
+	_, err = c.SafeShrink(ctx, "/dev/sdb", 128<<20, ext4.SafetyOptions{})
+	require.ErrorAs(t, err, &checkErr)
+
+	health, err := c.HealthSummary(ctx, "/dev/sdb")
+	require.NoError(t, err)
+	require.Equal(t, ext4.Corrupt, health.Verdict)
+}
+
+func TestFiles(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "hello.txt"), []byte("Hello, world!\n"), 0o640))
+
+	_, err := c.CreateImage(ctx, "disk.img", 64<<20, ext4.CreateOptions{RootDirectory: rootDir})
+	require.NoError(t, err)
+
+	require.NoError(t, c.MakeDirectoryInImage(ctx, "disk.img", "/etc"))
+	require.NoError(t, c.WriteFileToImage(ctx, "disk.img", filepath.Join(rootDir, "hello.txt"), "/etc/motd"))
+	require.NoError(t, c.SymlinkInImage(ctx, "disk.img", "/etc/motd", "/motd"))
+
+	err = c.WriteFileToImage(ctx, "disk.img", filepath.Join(rootDir, "hello.txt"), "/missing/motd")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = c.MakeDirectoryInImage(ctx, "disk.img", "/etc")
+	require.ErrorIs(t, err, fs.ErrExist)
+
+	err = c.RemoveFromImage(ctx, "disk.img", "/etc")
+	require.Error(t, err)
+
+	files := c.Files("disk.img")
+	require.Len(t, files, 4)
+	require.True(t, files["etc"].Mode.IsDir())
+	require.Equal(t, "Hello, world!\n", string(files["hello.txt"].Data))
+	require.Equal(t, "Hello, world!\n", string(files["etc/motd"].Data))
+	require.Equal(t, fs.FileMode(0o640), files["etc/motd"].Mode)
+	require.Equal(t, fs.ModeSymlink, files["motd"].Mode.Type())
+	require.Equal(t, "/etc/motd", string(files["motd"].Data))
+
+	t.Log("Round tripping through a tar stream")
+
+	var buf bytes.Buffer
+	require.NoError(t, c.ExportTar(ctx, "disk.img", &buf))
+
+	_, err = c.CreateFilesystemFromTar(ctx, "/dev/sdb", &buf, ext4.CreateOptions{})
+	require.NoError(t, err)
+
+	// Tar streams only record modification times to the second.
+	imported := c.Files("/dev/sdb")
+	require.Len(t, imported, len(files))
+	for name, f := range files {
+		require.Contains(t, imported, name)
+		require.Equal(t, f.Mode, imported[name].Mode, name)
+		require.Equal(t, f.Data, imported[name].Data, name)
+		require.WithinDuration(t, f.ModTime, imported[name].ModTime, time.Second, name)
+	}
+
+	require.NoError(t, c.RemoveFromImage(ctx, "/dev/sdb", "/etc/motd"))
+	require.NoError(t, c.RemoveFromImage(ctx, "/dev/sdb", "/etc"))
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, "disk.img", "/etc", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "motd"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!\n", string(data))
+
+	t.Log("Wiping the image")
+
+	require.NoError(t, c.WipeDevice(ctx, "disk.img", ext4.WipeOptions{}))
+	require.Nil(t, c.Files("disk.img"))
+}
+
+func TestBatchRunner(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+
+	errBoom := errors.New("boom")
+	c.FailOnce("CreateFilesystem", errBoom)
+
+	results := ext4.NewBatchRunner(c, ext4.BatchOptions{Parallelism: 1}).
+		CreateFilesystems(ctx, []string{"/dev/sdb", "/dev/sdc"}, ext4.CreateOptions{Label: "data"})
+	require.Len(t, results, 2)
+	require.ErrorIs(t, results[0].Err, errBoom)
+	require.NoError(t, results[1].Err)
+
+	sb, err := c.ReadSuperblock(ctx, "/dev/sdc")
+	require.NoError(t, err)
+	require.Equal(t, "data", sb.Label)
+
+	require.Len(t, c.CallsTo("CreateFilesystem"), 2)
+}
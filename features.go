@@ -0,0 +1,182 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Feature is the name of a filesystem feature, as understood by mke2fs and
+// tune2fs.
+type Feature string
+
+// Features supported by e2fsprogs (see ext4(5)).
+const (
+	Has64Bit         Feature = "64bit"
+	Bigalloc         Feature = "bigalloc"
+	Casefold         Feature = "casefold"
+	DirIndex         Feature = "dir_index"
+	DirNlink         Feature = "dir_nlink"
+	EAInode          Feature = "ea_inode"
+	Encrypt          Feature = "encrypt"
+	ExtAttr          Feature = "ext_attr"
+	Extent           Feature = "extent"
+	ExtraIsize       Feature = "extra_isize"
+	FastCommit       Feature = "fast_commit"
+	Filetype         Feature = "filetype"
+	FlexBG           Feature = "flex_bg"
+	HasJournal       Feature = "has_journal"
+	HugeFile         Feature = "huge_file"
+	InlineData       Feature = "inline_data"
+	LargeDir         Feature = "large_dir"
+	LargeFile        Feature = "large_file"
+	MetaBG           Feature = "meta_bg"
+	MetadataCsum     Feature = "metadata_csum"
+	MetadataCsumSeed Feature = "metadata_csum_seed"
+	MMP              Feature = "mmp"
+	OrphanFile       Feature = "orphan_file"
+	Project          Feature = "project"
+	Quota            Feature = "quota"
+	ResizeInode      Feature = "resize_inode"
+	SparseSuper      Feature = "sparse_super"
+	SparseSuper2     Feature = "sparse_super2"
+	StableInodes     Feature = "stable_inodes"
+	UninitBG         Feature = "uninit_bg"
+	Verity           Feature = "verity"
+)
+
+// FeatureSet is a set of features to enable (true) or disable (false),
+// relative to the defaults (eg. from mke2fs.conf).
+type FeatureSet map[Feature]bool
+
+// ParseFeatureSet parses a comma separated list of features in the syntax of
+// the -O option (eg. "fast_commit,^resize_inode").
+func ParseFeatureSet(s string) FeatureSet {
+	set := make(FeatureSet)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, disabled := strings.CutPrefix(item, "^")
+		set[Feature(name)] = !disabled
+	}
+
+	return set
+}
+
+// Enabled returns true if the set explicitly enables the feature.
+func (s FeatureSet) Enabled(f Feature) bool {
+	enabled, ok := s[f]
+	return ok && enabled
+}
+
+// Disabled returns true if the set explicitly disables the feature.
+func (s FeatureSet) Disabled(f Feature) bool {
+	enabled, ok := s[f]
+	return ok && !enabled
+}
+
+// String returns the set in the syntax of the -O option, with the features in
+// alphabetical order.
+func (s FeatureSet) String() string {
+	items := make([]string, 0, len(s))
+	for f, enabled := range s {
+		if enabled {
+			items = append(items, string(f))
+		} else {
+			items = append(items, "^"+string(f))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return strings.TrimPrefix(items[i], "^") < strings.TrimPrefix(items[j], "^")
+	})
+
+	return strings.Join(items, ",")
+}
+
+// HasFeature returns true if the feature is enabled on the filesystem.
+func (sb *SuperblockInfo) HasFeature(f Feature) bool {
+	return slices.Contains(sb.Features, string(f))
+}
+
+// Validate checks the set for obvious mistakes, before any command is run.
+func (s FeatureSet) Validate() error {
+	for f := range s {
+		if f == "" || strings.ContainsAny(string(f), ",^ \t") {
+			return invalidOption("malformed feature %q", f)
+		}
+	}
+
+	return nil
+}
+
+// EnableEncryption enables the encrypt feature on a filesystem with tune2fs
+// (this is possible while it is mounted), so that directories can be
+// encrypted with fscrypt. The feature can't be disabled again while encrypted
+// files exist. Returns the updated superblock.
+func (c *Client) EnableEncryption(ctx context.Context, device string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "EnableEncryption", device)
+	defer endSpan(span, &err)
+
+	return c.enableFeature(ctx, device, Encrypt)
+}
+
+// EnableVerity enables the verity feature on a filesystem with tune2fs (this
+// is possible while it is mounted), so that fs-verity can be enabled on its
+// files. The feature can't be disabled again while verity files exist.
+// Returns the updated superblock.
+func (c *Client) EnableVerity(ctx context.Context, device string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "EnableVerity", device)
+	defer endSpan(span, &err)
+
+	return c.enableFeature(ctx, device, Verity)
+}
+
+// enableFeature enables a filesystem feature (if it isn't already enabled).
+func (c *Client) enableFeature(ctx context.Context, device string, feature Feature) (*SuperblockInfo, error) {
+	if device == "" {
+		return nil, invalidOption("device is required")
+	}
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+
+	if sb.HasFeature(feature) {
+		return sb, nil
+	}
+
+	if err := c.tune2fs(ctx, device, "-O", string(feature)); err != nil {
+		return nil, fmt.Errorf("failed to enable %s feature: %w", feature, err)
+	}
+
+	return c.ReadSuperblock(ctx, device)
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:     imagePath,
+		Size:       64 * ext4.MiB,
+		Encryption: true,
+		Verity:     true,
+		Quotas:     []ext4.QuotaType{ext4.UserQuota},
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "encrypt")
+	require.Contains(t, sb.Features, "verity")
+	require.Contains(t, sb.Features, "quota")
+
+	t.Log("Enabling encryption on an existing filesystem")
+
+	imagePath = createTestImage(t, c, "")
+
+	sb, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.NotContains(t, sb.Features, "encrypt")
+
+	sb, err = c.EnableEncryption(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "encrypt")
+
+	// Enabling it again is a no-op.
+	_, err = c.EnableEncryption(ctx, imagePath)
+	require.NoError(t, err)
+}
+
+func TestEnableVerity(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	sb, err := c.EnableVerity(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "verity")
+
+	_, err = c.EnableVerity(ctx, "")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestFeatureSet(t *testing.T) {
+	set := ext4.ParseFeatureSet("fast_commit, ^resize_inode,64bit,")
+	require.Equal(t, ext4.FeatureSet{
+		ext4.FastCommit:  true,
+		ext4.ResizeInode: false,
+		ext4.Has64Bit:    true,
+	}, set)
+	require.Equal(t, "64bit,fast_commit,^resize_inode", set.String())
+
+	require.True(t, set.Enabled(ext4.FastCommit))
+	require.False(t, set.Disabled(ext4.FastCommit))
+	require.True(t, set.Disabled(ext4.ResizeInode))
+	require.False(t, set.Enabled(ext4.MetadataCsum))
+	require.False(t, set.Disabled(ext4.MetadataCsum))
+
+	require.NoError(t, set.Validate())
+	require.ErrorIs(t, ext4.FeatureSet{"^huge_file": false}.Validate(), ext4.ErrInvalidOptions)
+
+	t.Log("Creating a filesystem with a feature set")
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:   imagePath,
+		Size:     64 * ext4.MiB,
+		Features: "^huge_file",
+		FeatureSet: ext4.FeatureSet{
+			ext4.FastCommit:  true,
+			ext4.ResizeInode: false,
+		},
+		Encryption: true,
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.True(t, sb.HasFeature(ext4.FastCommit))
+	require.True(t, sb.HasFeature(ext4.Encrypt))
+	require.False(t, sb.HasFeature(ext4.ResizeInode))
+	require.False(t, sb.HasFeature(ext4.HugeFile))
+	require.True(t, sb.HasFeature(ext4.MetadataCsum))
+}
@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fscrypt sets up native (fscrypt) directory encryption on filesystems
+// with the encrypt feature enabled, using the kernel's v2 encryption policies,
+// and keys added to the filesystem keyring. Linux only.
+package fscrypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Mode is an encryption algorithm for file contents or names.
+type Mode uint8
+
+const (
+	// ModeAES256XTS is AES-256 in XTS mode (for contents).
+	ModeAES256XTS Mode = 1
+	// ModeAES256CTS is AES-256 in CBC-CTS mode (for file names).
+	ModeAES256CTS Mode = 4
+	// ModeAES128CBC is AES-128 in CBC-ESSIV mode (for contents).
+	ModeAES128CBC Mode = 5
+	// ModeAES128CTS is AES-128 in CBC-CTS mode (for file names).
+	ModeAES128CTS Mode = 6
+	// ModeAdiantum is Adiantum (for contents and file names), for hardware
+	// without AES acceleration.
+	ModeAdiantum Mode = 9
+	// ModeAES256HCTR2 is AES-256 in HCTR2 mode (for file names).
+	ModeAES256HCTR2 Mode = 10
+)
+
+// KeySize is the size in bytes of the keys generated by GenerateKey. The
+// kernel accepts keys of 16 to 64 bytes.
+const KeySize = 64
+
+// Well known errors.
+var (
+	// ErrNotEncrypted is returned when a directory has no encryption policy.
+	ErrNotEncrypted = errors.New("not encrypted")
+	// ErrKeyBusy is returned when a key was removed, but files protected by it
+	// are still in use (so they remain unlocked until closed).
+	ErrKeyBusy = errors.New("files using the key are still in use")
+	// ErrInvalidKey is returned when a key is too short or too long.
+	ErrInvalidKey = errors.New("invalid key size")
+)
+
+// KeyIdentifier identifies a key in the keyring of a filesystem (it is derived
+// from the key by the kernel).
+type KeyIdentifier [16]byte
+
+func (id KeyIdentifier) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+// KeyStatus is the status of a key in the keyring of a filesystem.
+type KeyStatus int
+
+const (
+	// KeyAbsent keys have not been added (or have been removed).
+	KeyAbsent KeyStatus = 1
+	// KeyPresent keys are available, so protected files are unlocked.
+	KeyPresent KeyStatus = 2
+	// KeyIncompletelyRemoved keys have been removed, but some protected files
+	// are still in use.
+	KeyIncompletelyRemoved KeyStatus = 3
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeyAbsent:
+		return "absent"
+	case KeyPresent:
+		return "present"
+	case KeyIncompletelyRemoved:
+		return "incompletely removed"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(s))
+	}
+}
+
+// Policy is a (v2) encryption policy, applied to a directory and inherited by
+// everything created within it.
+type Policy struct {
+	// ContentsMode encrypts the contents of files.
+	ContentsMode Mode
+	// FilenamesMode encrypts the names of files.
+	FilenamesMode Mode
+	// Padding is the number of bytes that encrypted file names are padded to
+	// a multiple of (4, 8, 16 or 32).
+	Padding int
+	// Key identifies the key protecting the directory.
+	Key KeyIdentifier
+}
+
+// DefaultPolicy returns the recommended policy (AES-256-XTS contents and
+// AES-256-CTS file names) for a key.
+func DefaultPolicy(key KeyIdentifier) Policy {
+	return Policy{
+		ContentsMode:  ModeAES256XTS,
+		FilenamesMode: ModeAES256CTS,
+		Padding:       32,
+		Key:           key,
+	}
+}
+
+// flags returns the policy flags for the padding.
+func (p Policy) flags() (uint8, error) {
+	switch p.Padding {
+	case 4:
+		return 0, nil
+	case 8:
+		return 1, nil
+	case 16:
+		return 2, nil
+	case 0, 32:
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("invalid file name padding %d", p.Padding)
+	}
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// EncryptDirectory adds the key to the keyring of the filesystem mounted at
+// mountPoint, then applies the default policy for that key to dir (which must
+// be an empty directory on that filesystem). The filesystem must have the
+// encrypt feature enabled (see ext4.Client.EnableEncryption).
+func EncryptDirectory(mountPoint, dir string, key []byte) (*Policy, error) {
+	id, err := AddKey(mountPoint, key)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := DefaultPolicy(id)
+	if err := SetPolicy(dir, policy); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
@@ -0,0 +1,173 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fscrypt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// AddKey adds a key to the keyring of the filesystem mounted at mountPoint,
+// unlocking the files it protects. Returns the identifier of the key.
+func AddKey(mountPoint string, key []byte) (KeyIdentifier, error) {
+	if len(key) < 16 || len(key) > unix.FSCRYPT_MAX_KEY_SIZE {
+		return KeyIdentifier{}, fmt.Errorf("%w: %d bytes", ErrInvalidKey, len(key))
+	}
+
+	f, err := os.Open(mountPoint)
+	if err != nil {
+		return KeyIdentifier{}, err
+	}
+	defer f.Close()
+
+	// The raw key immediately follows the argument structure.
+	buf := make([]byte, unsafe.Sizeof(unix.FscryptAddKeyArg{})+uintptr(len(key)))
+	arg := (*unix.FscryptAddKeyArg)(unsafe.Pointer(&buf[0]))
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	arg.Raw_size = uint32(len(key))
+	copy(buf[unsafe.Sizeof(*arg):], key)
+
+	// Don't leave a copy of the key lying around in memory.
+	defer clear(buf)
+
+	if err := ioctl(f, unix.FS_IOC_ADD_ENCRYPTION_KEY, unsafe.Pointer(arg)); err != nil {
+		return KeyIdentifier{}, fmt.Errorf("failed to add key: %w", err)
+	}
+
+	var id KeyIdentifier
+	copy(id[:], arg.Key_spec.U[:])
+
+	return id, nil
+}
+
+// RemoveKey removes a key from the keyring of the filesystem mounted at
+// mountPoint, locking the files it protects. If some of the files are still in
+// use, ErrKeyBusy is returned (and they remain unlocked until closed).
+func RemoveKey(mountPoint string, id KeyIdentifier) error {
+	f, err := os.Open(mountPoint)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var arg unix.FscryptRemoveKeyArg
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	copy(arg.Key_spec.U[:], id[:])
+
+	if err := ioctl(f, unix.FS_IOC_REMOVE_ENCRYPTION_KEY, unsafe.Pointer(&arg)); err != nil {
+		return fmt.Errorf("failed to remove key %s: %w", id, err)
+	}
+
+	if arg.Removal_status_flags&unix.FSCRYPT_KEY_REMOVAL_STATUS_FLAG_FILES_BUSY != 0 {
+		return fmt.Errorf("%w: key %s", ErrKeyBusy, id)
+	}
+
+	return nil
+}
+
+// GetKeyStatus returns the status of a key in the keyring of the filesystem
+// mounted at mountPoint.
+func GetKeyStatus(mountPoint string, id KeyIdentifier) (KeyStatus, error) {
+	f, err := os.Open(mountPoint)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var arg unix.FscryptGetKeyStatusArg
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	copy(arg.Key_spec.U[:], id[:])
+
+	if err := ioctl(f, unix.FS_IOC_GET_ENCRYPTION_KEY_STATUS, unsafe.Pointer(&arg)); err != nil {
+		return 0, fmt.Errorf("failed to get status of key %s: %w", id, err)
+	}
+
+	return KeyStatus(arg.Status), nil
+}
+
+// SetPolicy applies an encryption policy to an empty directory. The key must
+// have been added to the filesystem first (see AddKey).
+func SetPolicy(dir string, policy Policy) error {
+	flags, err := policy.flags()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	arg := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  uint8(policy.ContentsMode),
+		Filenames_encryption_mode: uint8(policy.FilenamesMode),
+		Flags:                     flags,
+		Master_key_identifier:     policy.Key,
+	}
+
+	if err := ioctl(f, unix.FS_IOC_SET_ENCRYPTION_POLICY, unsafe.Pointer(&arg)); err != nil {
+		return fmt.Errorf("failed to set encryption policy on %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// GetPolicy returns the encryption policy of a file or directory. If it isn't
+// encrypted, ErrNotEncrypted is returned.
+func GetPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	arg := unix.FscryptGetPolicyExArg{Size: uint64(len(unix.FscryptGetPolicyExArg{}.Policy))}
+	if err := ioctl(f, unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg)); err != nil {
+		if errors.Is(err, unix.ENODATA) {
+			return nil, fmt.Errorf("%s is %w", path, ErrNotEncrypted)
+		}
+		return nil, fmt.Errorf("failed to get encryption policy of %s: %w", path, err)
+	}
+
+	if arg.Policy[0] != unix.FSCRYPT_POLICY_V2 {
+		return nil, fmt.Errorf("unsupported encryption policy version %d", arg.Policy[0])
+	}
+
+	v2 := (*unix.FscryptPolicyV2)(unsafe.Pointer(&arg.Policy[0]))
+
+	return &Policy{
+		ContentsMode:  Mode(v2.Contents_encryption_mode),
+		FilenamesMode: Mode(v2.Filenames_encryption_mode),
+		Padding:       4 << (v2.Flags & unix.FSCRYPT_POLICY_FLAGS_PAD_MASK),
+		Key:           v2.Master_key_identifier,
+	}, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
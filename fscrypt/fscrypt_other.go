@@ -0,0 +1,42 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fscrypt
+
+import "errors"
+
+func AddKey(_ string, _ []byte) (KeyIdentifier, error) {
+	return KeyIdentifier{}, errors.ErrUnsupported
+}
+
+func RemoveKey(_ string, _ KeyIdentifier) error {
+	return errors.ErrUnsupported
+}
+
+func GetKeyStatus(_ string, _ KeyIdentifier) (KeyStatus, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func SetPolicy(_ string, _ Policy) error {
+	return errors.ErrUnsupported
+}
+
+func GetPolicy(_ string) (*Policy, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fscrypt_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/fscrypt"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDirectory(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	if _, err := os.Stat("/sys/fs/ext4/features/encryption"); err != nil {
+		t.Skip("kernel does not support ext4 encryption")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:     imagePath,
+		Size:       64 * ext4.MiB,
+		Encryption: true,
+	})
+	require.NoError(t, err)
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	mountPath := t.TempDir()
+	require.NoError(t, c.Mount(ctx, devPath, mountPath, ext4.MountOptions{}))
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	key, err := fscrypt.GenerateKey()
+	require.NoError(t, err)
+
+	secretsDir := filepath.Join(mountPath, "secrets")
+	require.NoError(t, os.Mkdir(secretsDir, 0o700))
+
+	policy, err := fscrypt.EncryptDirectory(mountPath, secretsDir, key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(secretsDir, "password.txt"), []byte("hunter2"), 0o600))
+
+	got, err := fscrypt.GetPolicy(filepath.Join(secretsDir, "password.txt"))
+	require.NoError(t, err)
+	require.Equal(t, policy, got)
+	require.Equal(t, fscrypt.DefaultPolicy(policy.Key), *got)
+
+	status, err := fscrypt.GetKeyStatus(mountPath, policy.Key)
+	require.NoError(t, err)
+	require.Equal(t, fscrypt.KeyPresent, status)
+
+	_, err = fscrypt.GetPolicy(mountPath)
+	require.ErrorIs(t, err, fscrypt.ErrNotEncrypted)
+
+	t.Log("Locking the directory")
+
+	require.NoError(t, fscrypt.RemoveKey(mountPath, policy.Key))
+
+	status, err = fscrypt.GetKeyStatus(mountPath, policy.Key)
+	require.NoError(t, err)
+	require.Equal(t, fscrypt.KeyAbsent, status)
+
+	entries, err := os.ReadDir(secretsDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NotEqual(t, "password.txt", entries[0].Name(), "file names should be encrypted")
+
+	t.Log("Unlocking the directory")
+
+	id, err := fscrypt.AddKey(mountPath, key)
+	require.NoError(t, err)
+	require.Equal(t, policy.Key, id)
+
+	data, err := os.ReadFile(filepath.Join(secretsDir, "password.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hunter2", string(data))
+
+	t.Log("Encrypting a directory that isn't empty")
+
+	_, err = fscrypt.EncryptDirectory(mountPath, mountPath, key)
+	require.Error(t, err)
+
+	_, err = fscrypt.AddKey(mountPath, key[:8])
+	require.ErrorIs(t, err, fscrypt.ErrInvalidKey)
+}
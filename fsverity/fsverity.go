@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fsverity enables fs-verity on files (making them read-only, with
+// their contents verified against a Merkle tree on every read), and reads
+// their measurements (the root digest), on filesystems with the verity
+// feature enabled. Linux only.
+package fsverity
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// HashAlgorithm is the hash algorithm used to build the Merkle tree of a file.
+type HashAlgorithm uint32
+
+const (
+	// SHA256 is the default hash algorithm.
+	SHA256 HashAlgorithm = 1
+	// SHA512 produces larger (64 byte) digests.
+	SHA512 HashAlgorithm = 2
+)
+
+func (a HashAlgorithm) String() string {
+	switch a {
+	case SHA256:
+		return "sha256"
+	case SHA512:
+		return "sha512"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint32(a))
+	}
+}
+
+// DefaultBlockSize is the Merkle tree block size, unless configured otherwise
+// (the same as the fsverity utility).
+const DefaultBlockSize = 4096
+
+// maxSaltSize is the maximum size of a salt accepted by the kernel.
+const maxSaltSize = 32
+
+// ErrNotEnabled is returned when measuring a file that doesn't have fs-verity
+// enabled.
+var ErrNotEnabled = errors.New("fs-verity not enabled")
+
+// EnableOptions provides options for enabling fs-verity on a file.
+type EnableOptions struct {
+	// HashAlgorithm used to build the Merkle tree (default SHA256).
+	HashAlgorithm HashAlgorithm
+	// BlockSize of the Merkle tree in bytes (default DefaultBlockSize).
+	BlockSize int
+	// Salt is prepended to every block before it is hashed (up to 32 bytes).
+	Salt []byte
+	// Signature is a PKCS#7 signature of the file's digest, verified by the
+	// kernel against the .fs-verity keyring.
+	Signature []byte
+}
+
+// Validate checks the options for obvious mistakes.
+func (opts EnableOptions) Validate() error {
+	switch opts.HashAlgorithm {
+	case 0, SHA256, SHA512:
+	default:
+		return fmt.Errorf("unsupported hash algorithm %s", opts.HashAlgorithm)
+	}
+	if opts.BlockSize != 0 && (opts.BlockSize < 1024 || opts.BlockSize&(opts.BlockSize-1) != 0) {
+		return fmt.Errorf("invalid block size %d", opts.BlockSize)
+	}
+	if len(opts.Salt) > maxSaltSize {
+		return fmt.Errorf("salt is too long (%d > %d bytes)", len(opts.Salt), maxSaltSize)
+	}
+
+	return nil
+}
+
+// Measurement is the fs-verity digest of a file, which authenticates its
+// entire contents.
+type Measurement struct {
+	// Algorithm is the hash algorithm of the digest.
+	Algorithm HashAlgorithm
+	// Digest of the file.
+	Digest []byte
+}
+
+// String returns the measurement in the format used by the fsverity utility,
+// eg. "sha256:0123...".
+func (m Measurement) String() string {
+	return m.Algorithm.String() + ":" + hex.EncodeToString(m.Digest)
+}
@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsverity
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxDigestSize is the size of the largest supported digest (SHA-512).
+const maxDigestSize = 64
+
+// Enable enables fs-verity on a regular file, making it permanently read-only.
+// The file must not be open for writing. This builds the Merkle tree, so it
+// takes time proportional to the size of the file.
+func Enable(path string, opts EnableOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	hashAlgorithm := opts.HashAlgorithm
+	if hashAlgorithm == 0 {
+		hashAlgorithm = SHA256
+	}
+
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	arg := unix.FsverityEnableArg{
+		Version:        1,
+		Hash_algorithm: uint32(hashAlgorithm),
+		Block_size:     uint32(blockSize),
+		Salt_size:      uint32(len(opts.Salt)),
+		Sig_size:       uint32(len(opts.Signature)),
+	}
+	if len(opts.Salt) > 0 {
+		arg.Salt_ptr = uint64(uintptr(unsafe.Pointer(&opts.Salt[0])))
+	}
+	if len(opts.Signature) > 0 {
+		arg.Sig_ptr = uint64(uintptr(unsafe.Pointer(&opts.Signature[0])))
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_ENABLE_VERITY, uintptr(unsafe.Pointer(&arg)))
+	// The salt and signature are only referenced by address in the argument.
+	runtime.KeepAlive(opts.Salt)
+	runtime.KeepAlive(opts.Signature)
+	if errno != 0 {
+		if errno == unix.EOPNOTSUPP {
+			return fmt.Errorf("failed to enable fs-verity on %s (is the verity feature enabled?): %w", path, errno)
+		}
+		return fmt.Errorf("failed to enable fs-verity on %s: %w", path, errno)
+	}
+
+	return nil
+}
+
+// Measure returns the fs-verity measurement of a file. If fs-verity isn't
+// enabled on it, ErrNotEnabled is returned.
+func Measure(path string) (*Measurement, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The digest immediately follows its header.
+	buf := make([]byte, unsafe.Sizeof(unix.FsverityDigest{})+maxDigestSize)
+	digest := (*unix.FsverityDigest)(unsafe.Pointer(&buf[0]))
+	digest.Size = maxDigestSize
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.FS_IOC_MEASURE_VERITY, uintptr(unsafe.Pointer(digest)))
+	if errno != 0 {
+		if errno == unix.ENODATA {
+			return nil, fmt.Errorf("%s: %w", path, ErrNotEnabled)
+		}
+		return nil, fmt.Errorf("failed to measure %s: %w", path, errno)
+	}
+
+	offset := unsafe.Sizeof(*digest)
+	return &Measurement{
+		Algorithm: HashAlgorithm(digest.Algorithm),
+		Digest:    append([]byte(nil), buf[offset:offset+uintptr(digest.Size)]...),
+	}, nil
+}
+
+// IsEnabled returns true if fs-verity is enabled on a file.
+func IsEnabled(path string) (bool, error) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, 0, &stx); err != nil {
+		return false, &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+
+	// Kernels without fs-verity support don't report the attribute at all.
+	return stx.Attributes&unix.STATX_ATTR_VERITY != 0, nil
+}
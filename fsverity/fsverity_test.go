@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fsverity_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/fsverity"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnableOptionsValidate(t *testing.T) {
+	require.NoError(t, fsverity.EnableOptions{}.Validate())
+	require.NoError(t, fsverity.EnableOptions{
+		HashAlgorithm: fsverity.SHA512,
+		BlockSize:     1024,
+		Salt:          bytes.Repeat([]byte{0xff}, 32),
+	}.Validate())
+
+	require.Error(t, fsverity.EnableOptions{HashAlgorithm: 3}.Validate())
+	require.Error(t, fsverity.EnableOptions{BlockSize: 512}.Validate())
+	require.Error(t, fsverity.EnableOptions{BlockSize: 3000}.Validate())
+	require.Error(t, fsverity.EnableOptions{Salt: make([]byte, 33)}.Validate())
+}
+
+func TestMeasurementString(t *testing.T) {
+	m := fsverity.Measurement{Algorithm: fsverity.SHA256, Digest: []byte{0xde, 0xad, 0xbe, 0xef}}
+	require.Equal(t, "sha256:deadbeef", m.String())
+}
+
+func TestEnable(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	if _, err := os.Stat("/sys/fs/ext4/features/verity"); err != nil {
+		t.Skip("kernel does not support ext4 verity")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+		Verity: true,
+	})
+	require.NoError(t, err)
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	mountPath := t.TempDir()
+	require.NoError(t, c.Mount(ctx, devPath, mountPath, ext4.MountOptions{}))
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	path := filepath.Join(mountPath, "test.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello world"), 0o644))
+
+	enabled, err := fsverity.IsEnabled(path)
+	require.NoError(t, err)
+	require.False(t, enabled)
+
+	_, err = fsverity.Measure(path)
+	require.ErrorIs(t, err, fsverity.ErrNotEnabled)
+
+	require.NoError(t, fsverity.Enable(path, fsverity.EnableOptions{}))
+
+	enabled, err = fsverity.IsEnabled(path)
+	require.NoError(t, err)
+	require.True(t, enabled)
+
+	m, err := fsverity.Measure(path)
+	require.NoError(t, err)
+	require.Equal(t, fsverity.SHA256, m.Algorithm)
+	require.Len(t, m.Digest, 32)
+
+	t.Log("Writing to a verity file")
+
+	_, err = os.OpenFile(path, os.O_WRONLY, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dpeckett/ext4/partition"
+)
+
+// partitionPollInterval is how often the size of a partition is polled while
+// waiting for the kernel to pick up a resized partition.
+const partitionPollInterval = 50 * time.Millisecond
+
+// partitionTimeout is how long to wait for the kernel to pick up a resized
+// partition.
+const partitionTimeout = 10 * time.Second
+
+// GrowToFillDevice resizes an ext4 filesystem to use all of the space
+// available on its underlying block device (or image file), eg. after a cloud
+// disk has been expanded. The device is examined on the local host (within
+// the chroot, if configured). If the filesystem already fills the device, it
+// is left untouched.
+func (c *Client) GrowToFillDevice(ctx context.Context, device string) (_ *ResizeResult, err error) {
+	ctx, span := c.startSpan(ctx, "GrowToFillDevice", device)
+	defer endSpan(span, &err)
+
+	size, err := deviceSize(filepath.Join(c.chroot, device))
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine device size: %w", err)
+	}
+
+	sb, err := c.ReadSuperblock(ctx, device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	if sb.BlockSize <= 0 {
+		return nil, fmt.Errorf("invalid filesystem block size %d", sb.BlockSize)
+	}
+
+	blockCount := uint64(size) / uint64(sb.BlockSize)
+	if blockCount < sb.BlockCount {
+		return nil, fmt.Errorf("device is smaller than the filesystem (%d < %d blocks)", blockCount, sb.BlockCount)
+	}
+
+	if blockCount == sb.BlockCount {
+		return &ResizeResult{
+			OldBlockCount: sb.BlockCount,
+			NewBlockCount: sb.BlockCount,
+			BlockSize:     sb.BlockSize,
+		}, nil
+	}
+
+	return c.ResizeFilesystem(ctx, ResizeOptions{
+		Device: device,
+		Size:   Size(blockCount) * Size(sb.BlockSize),
+	})
+}
+
+// GrowPartitionAndFilesystem expands a partition to the end of the free space
+// after it on disk, informs the kernel of the new size, and then grows the
+// ext4 filesystem on the partition to fill it (online, if it is mounted). This
+// is the equivalent of cloud-init's growpart followed by resize2fs.
+func (c *Client) GrowPartitionAndFilesystem(ctx context.Context, disk string, partitionNumber int) (_ *ResizeResult, err error) {
+	ctx, span := c.startSpan(ctx, "GrowPartitionAndFilesystem", disk)
+	defer endSpan(span, &err)
+
+	if partitionNumber < 1 {
+		return nil, invalidOption("invalid partition number %d", partitionNumber)
+	}
+
+	device := partition.Path(disk, partitionNumber)
+
+	// Make sure there is a filesystem to grow, before touching the partition
+	// table.
+	if _, err := c.VerifyExt4(ctx, device); err != nil {
+		return nil, err
+	}
+
+	// The partition table belongs to the whole disk.
+	unlock, err := c.lockDevice(ctx, disk)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := partition.Resize(filepath.Join(c.chroot, disk), partitionNumber, 0)
+	unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to grow partition %d: %w", partitionNumber, err)
+	}
+
+	if err := waitForDeviceSize(ctx, filepath.Join(c.chroot, device), p.Size); err != nil {
+		return nil, fmt.Errorf("grew partition %d, but the kernel did not pick up the new size: %w", partitionNumber, err)
+	}
+
+	return c.GrowToFillDevice(ctx, device)
+}
+
+// waitForDeviceSize waits for a device to reach the given size in bytes (the
+// device may briefly disappear if the kernel re-reads the partition table).
+func waitForDeviceSize(ctx context.Context, path string, size int64) error {
+	ctx, cancel := context.WithTimeout(ctx, partitionTimeout)
+	defer cancel()
+
+	for {
+		current, err := deviceSize(path)
+		if err == nil && current == size {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("device is %d bytes, expected %d: %w", current, size, ctx.Err())
+		case <-time.After(partitionPollInterval):
+		}
+	}
+}
+
+// deviceSize returns the size in bytes of a block device or regular file.
+func deviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Seeking to the end works for both block devices and regular files.
+	size, err := f.Seek(0, io.SeekEnd)
+	return size, errors.Join(err, f.Close())
+}
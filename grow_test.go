@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/dpeckett/ext4/partition"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrowToFillDevice(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	t.Log("Growing a filesystem that already fills the device")
+
+	result, err := c.GrowToFillDevice(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(65536), result.OldBlockCount)
+	require.Equal(t, uint64(65536), result.NewBlockCount)
+
+	t.Log("Expanding the device")
+
+	require.NoError(t, os.Truncate(imagePath, 96<<20))
+
+	result, err = c.GrowToFillDevice(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(65536), result.OldBlockCount)
+	require.Equal(t, uint64(98304), result.NewBlockCount)
+	require.Equal(t, 1024, result.BlockSize)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(98304), sb.BlockCount)
+
+	t.Log("Shrinking the device")
+
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	_, err = c.GrowToFillDevice(ctx, imagePath)
+	require.Error(t, err)
+}
+
+func TestGrowPartitionAndFilesystem(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("partitioning loop devices requires root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	_, err := partition.Create(imagePath, partition.Table{
+		Type:       partition.GPT,
+		SectorSize: 512,
+		Partitions: []partition.Partition{{Size: 16 << 20, Type: partition.TypeLinuxFilesystem}},
+	})
+	require.NoError(t, err)
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{PartitionScan: true})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	partPath := partition.Path(devPath, 1)
+	if _, err := os.Stat(partPath); err != nil {
+		// The kernel may have been built without partition table support, so
+		// fall back to adding the partition from userspace.
+		_ = exec.Command("partx", "--add", devPath).Run()
+
+		if _, err := os.Stat(partPath); err != nil {
+			t.Skipf("partition device not available: %v", err)
+		}
+	}
+
+	blockSize := 1024
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    partPath,
+		BlockSize: &blockSize,
+	})
+	require.NoError(t, err)
+
+	result, err := c.GrowPartitionAndFilesystem(ctx, devPath, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16384), result.OldBlockCount)
+	require.Greater(t, result.NewBlockCount, uint64(60000))
+
+	table, err := partition.Read(devPath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(table.Partitions[0].Size/1024), result.NewBlockCount)
+
+	t.Log("Growing a partition that already fills the disk")
+
+	result, err = c.GrowPartitionAndFilesystem(ctx, devPath, 1)
+	require.NoError(t, err)
+	require.Equal(t, result.OldBlockCount, result.NewBlockCount)
+
+	t.Log("Growing a partition without a filesystem")
+
+	_, err = c.GrowPartitionAndFilesystem(ctx, devPath, 2)
+	require.Error(t, err)
+}
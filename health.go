@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HealthVerdict is the overall assessment of a filesystem's health.
+type HealthVerdict string
+
+const (
+	// Healthy filesystems are consistent, and require no attention.
+	Healthy HealthVerdict = "healthy"
+	// Degraded filesystems are usable, but require attention (eg. a check is
+	// overdue, or errors were recorded in the past).
+	Degraded HealthVerdict = "degraded"
+	// Corrupt filesystems are inconsistent and need to be repaired.
+	Corrupt HealthVerdict = "corrupt"
+)
+
+// FilesystemHealth summarizes the health of a filesystem.
+type FilesystemHealth struct {
+	// Verdict is the overall assessment.
+	Verdict HealthVerdict `json:"verdict"`
+	// Reasons explain why the filesystem isn't healthy.
+	Reasons []string `json:"reasons,omitempty"`
+	// State of the filesystem (eg. "clean", "not clean", "clean with errors").
+	State string `json:"state"`
+	// Mounted is true if the filesystem is currently mounted (in which case,
+	// the consistency check is skipped).
+	Mounted bool `json:"mounted"`
+	// ErrorCount is the number of filesystem errors recorded by the kernel.
+	ErrorCount int `json:"errorCount,omitempty"`
+	// LastErrorTime is when the most recent recorded error occurred.
+	LastErrorTime time.Time `json:"lastErrorTime"`
+	// LastChecked is when the filesystem was last checked.
+	LastChecked time.Time `json:"lastChecked"`
+	// CheckOverdue is true if the check interval, or maximum mount count, has
+	// been exceeded.
+	CheckOverdue bool `json:"checkOverdue"`
+	// MountCount is the number of mounts since the last check.
+	MountCount int `json:"mountCount"`
+	// MaxMountCount is the number of mounts after which a check is forced
+	// (negative if disabled).
+	MaxMountCount int `json:"maxMountCount"`
+	// MMPEnabled is true if multi-mount protection is enabled.
+	MMPEnabled bool `json:"mmpEnabled"`
+	// MMPInUse is true if multi-mount protection reports the filesystem is in
+	// use (possibly by another host).
+	MMPInUse bool `json:"mmpInUse"`
+	// Check is the result of a read-only consistency check (nil if the
+	// filesystem is mounted).
+	Check *CheckResult `json:"check,omitempty"`
+}
+
+// HealthSummary assesses the health of a filesystem by combining its
+// superblock state, recorded errors, check schedule, multi-mount protection
+// status, and (if it isn't mounted) a forced read-only check. It is intended
+// for monitoring systems, and never modifies the filesystem.
+func (c *Client) HealthSummary(ctx context.Context, device string) (_ *FilesystemHealth, err error) {
+	ctx, span := c.startSpan(ctx, "HealthSummary", device)
+	defer endSpan(span, &err)
+
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint, err := c.mountPoint(device)
+	if err != nil {
+		return nil, err
+	}
+
+	health := &FilesystemHealth{
+		State:         sb.State,
+		Mounted:       mountPoint != "",
+		ErrorCount:    sb.ErrorCount,
+		LastErrorTime: sb.LastErrorTime,
+		LastChecked:   sb.LastChecked,
+		MountCount:    sb.MountCount,
+		MaxMountCount: sb.MaxMountCount,
+		MMPEnabled:    sb.MMPBlock != 0,
+	}
+
+	var corrupt, degraded []string
+
+	if strings.Contains(sb.State, "with errors") {
+		corrupt = append(corrupt, "kernel detected errors")
+	}
+	if sb.ErrorCount > 0 {
+		degraded = append(degraded, fmt.Sprintf("%d errors recorded", sb.ErrorCount))
+	}
+	// Filesystems are (expectedly) marked not clean while mounted.
+	if !health.Mounted && strings.HasPrefix(sb.State, "not clean") {
+		degraded = append(degraded, "not cleanly unmounted")
+	}
+
+	if sb.CheckInterval > 0 && time.Since(sb.LastChecked) > sb.CheckInterval {
+		health.CheckOverdue = true
+	}
+	if sb.MaxMountCount > 0 && sb.MountCount >= sb.MaxMountCount {
+		health.CheckOverdue = true
+	}
+	if health.CheckOverdue {
+		degraded = append(degraded, "check overdue")
+	}
+
+	if health.MMPEnabled {
+		// e2mmpstatus exits with a status of one if the filesystem is in use.
+		if _, err := c.run(ctx, "e2mmpstatus", device); err != nil {
+			if exitCode(err) != 1 {
+				return nil, fmt.Errorf("failed to read multi-mount protection status: %w", err)
+			}
+			health.MMPInUse = true
+		}
+
+		if health.MMPInUse && !health.Mounted {
+			degraded = append(degraded, "multi-mount protection reports the filesystem is in use")
+		}
+	}
+
+	// A check of a mounted filesystem is unreliable (and MMP prevents one).
+	if !health.Mounted && !health.MMPInUse {
+		health.Check, err = c.checkFilesystem(ctx, CheckOptions{Device: device, Force: true, NoFix: true})
+		var checkErr *CheckError
+		if errors.As(err, &checkErr) && checkErr.Status&CheckErrorsUncorrected != 0 {
+			corrupt = append(corrupt, fmt.Sprintf("consistency check failed (%s)", checkErr.Status))
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to check filesystem: %w", err)
+		}
+	}
+
+	switch {
+	case len(corrupt) > 0:
+		health.Verdict = Corrupt
+	case len(degraded) > 0:
+		health.Verdict = Degraded
+	default:
+		health.Verdict = Healthy
+	}
+	health.Reasons = append(corrupt, degraded...)
+
+	return health, nil
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthSummary(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	health, err := c.HealthSummary(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Equal(t, ext4.Healthy, health.Verdict)
+	require.Empty(t, health.Reasons)
+	require.Equal(t, "clean", health.State)
+	require.False(t, health.Mounted)
+	require.NotNil(t, health.Check)
+	require.True(t, health.Check.Status.OK())
+
+	t.Log("Recording an error")
+
+	err = exec.Command("debugfs", "-w", "-R", "ssv error_count 3", imagePath).Run()
+	require.NoError(t, err)
+
+	health, err = c.HealthSummary(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Equal(t, ext4.Degraded, health.Verdict)
+	require.Equal(t, 3, health.ErrorCount)
+	require.Len(t, health.Reasons, 1)
+
+	t.Log("Corrupting the filesystem")
+
+	err = exec.Command("debugfs", "-w", "-R", "mkdir /a", imagePath).Run()
+	require.NoError(t, err)
+	err = exec.Command("debugfs", "-w", "-R", "sif /a links_count 7", imagePath).Run()
+	require.NoError(t, err)
+
+	health, err = c.HealthSummary(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Equal(t, ext4.Corrupt, health.Verdict)
+	require.Len(t, health.Reasons, 2)
+	require.False(t, health.Check.Status.OK())
+}
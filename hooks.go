@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"time"
+)
+
+// CommandPhase identifies when a CommandEvent was fired.
+type CommandPhase int
+
+const (
+	// CommandStarted is fired immediately before a command is executed.
+	CommandStarted CommandPhase = iota
+	// CommandFinished is fired after a command has exited.
+	CommandFinished
+)
+
+func (p CommandPhase) String() string {
+	switch p {
+	case CommandStarted:
+		return "started"
+	case CommandFinished:
+		return "finished"
+	default:
+		return "unknown"
+	}
+}
+
+// maxHookOutput is the maximum number of bytes of output included in a
+// CommandEvent.
+const maxHookOutput = 4096
+
+// CommandEvent describes the execution of an external command.
+type CommandEvent struct {
+	// Phase of execution.
+	Phase CommandPhase
+	// Path of the executed binary.
+	Path string
+	// Args passed to the binary.
+	Args []string
+	// Duration the command ran for (only set once finished).
+	Duration time.Duration
+	// ExitCode of the command (only set once finished, -1 if the command did
+	// not run to completion).
+	ExitCode int
+	// Stdout output of the command (truncated, only set once finished).
+	Stdout string
+	// Stderr output of the command (truncated, only set once finished).
+	Stderr string
+	// Err is the error returned by the command (only set once finished).
+	Err error
+}
+
+func (c *Client) fireHooks(event CommandEvent) {
+	for _, hook := range c.hooks {
+		hook(event)
+	}
+}
+
+func truncateOutput(out []byte) string {
+	if len(out) > maxHookOutput {
+		return string(out[:maxHookOutput]) + "... (truncated)"
+	}
+
+	return string(out)
+}
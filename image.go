@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CreateImage creates a sparse image file of the given size (in bytes) and
+// formats it with an ext4 filesystem, returning its geometry. Set
+// opts.RootDirectory to populate the filesystem from a host directory. No
+// special privileges are required. The image file must not already exist, and
+// is created on the local host (within the chroot, if configured).
+func (c *Client) CreateImage(ctx context.Context, path string, size int64, opts CreateOptions) (_ *CreatedFilesystem, err error) {
+	ctx, span := c.startSpan(ctx, "CreateImage", path)
+	defer endSpan(span, &err)
+
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: invalid image size %d", ErrInvalidOptions, size)
+	}
+
+	opts.Device = path
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	localPath := filepath.Join(c.chroot, path)
+	f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image: %w", err)
+	}
+
+	// Truncating a new file leaves it sparse, so no space is used up front.
+	if err := errors.Join(f.Truncate(size), f.Close()); err != nil {
+		_ = os.Remove(localPath)
+		return nil, fmt.Errorf("failed to size image: %w", err)
+	}
+
+	fs, err := c.CreateFilesystem(ctx, opts)
+	if err != nil {
+		_ = os.Remove(localPath)
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// CompactImage shrinks the filesystem in an unmounted image file to its
+// minimum size (resize2fs -M), then truncates the file to match, so that it is
+// as small as possible (eg. before it is distributed). The filesystem is
+// forcibly checked first, as resize2fs requires. The image file is on the
+// local host (within the chroot, if configured).
+func (c *Client) CompactImage(ctx context.Context, imagePath string) (_ *ResizeResult, err error) {
+	ctx, span := c.startSpan(ctx, "CompactImage", imagePath)
+	defer endSpan(span, &err)
+
+	if imagePath == "" {
+		return nil, invalidOption("image path is required")
+	}
+
+	localPath := filepath.Join(c.chroot, imagePath)
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat image: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, invalidOption("%s is not a regular file", imagePath)
+	}
+
+	unlock, err := c.lockDevice(ctx, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	result, err := c.resizeFilesystem(ctx, ResizeOptions{
+		Device: imagePath,
+		Shrink: true,
+		Check:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	if size := int64(sb.BlockCount) * int64(sb.BlockSize); size < fi.Size() {
+		if err := os.Truncate(localPath, size); err != nil {
+			return nil, fmt.Errorf("failed to truncate image: %w", err)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateImage(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "hello.txt"), []byte("Hello, world!"), 0o644))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	fs, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{
+		RootDirectory: rootDir,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(65536), fs.BlockCount)
+
+	fi, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(64<<20), fi.Size())
+
+	// The image should be sparse.
+	stat := fi.Sys().(*syscall.Stat_t)
+	require.Less(t, stat.Blocks*512, fi.Size())
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, imagePath, "/hello.txt", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
+
+	t.Log("Refusing to overwrite an existing image")
+
+	_, err = c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{})
+	require.ErrorIs(t, err, os.ErrExist)
+
+	t.Log("Cleaning up after failure")
+
+	imagePath = filepath.Join(t.TempDir(), "invalid.img")
+
+	_, err = c.CreateImage(ctx, imagePath, 4096, ext4.CreateOptions{})
+	require.Error(t, err)
+
+	_, err = os.Stat(imagePath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCompactImage(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "hello.txt"), []byte("Hello, world!"), 0o644))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{
+		RootDirectory: rootDir,
+	})
+	require.NoError(t, err)
+
+	result, err := c.CompactImage(ctx, imagePath)
+	require.NoError(t, err)
+	require.Less(t, result.NewBlockCount, result.OldBlockCount)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, result.NewBlockCount, sb.BlockCount)
+
+	fi, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(sb.BlockCount)*int64(sb.BlockSize), fi.Size())
+
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, imagePath, "/hello.txt", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
+
+	t.Log("Compacting a missing image")
+
+	_, err = c.CompactImage(ctx, filepath.Join(t.TempDir(), "missing.img"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
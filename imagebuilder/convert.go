@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagebuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dpeckett/ext4"
+)
+
+// Format is the format of a disk image.
+type Format string
+
+const (
+	// FormatRaw is a raw disk image.
+	FormatRaw Format = "raw"
+	// FormatQCOW2 is a QEMU copy-on-write (version 2) disk image.
+	FormatQCOW2 Format = "qcow2"
+	// FormatVMDK is a VMware virtual disk image.
+	FormatVMDK Format = "vmdk"
+	// FormatVHDX is a Hyper-V virtual disk image.
+	FormatVHDX Format = "vhdx"
+)
+
+// ConvertOptions provides options for converting a disk image.
+type ConvertOptions struct {
+	// SourceFormat is the format of the source image (default FormatRaw).
+	// It's never probed, as that is unsafe for untrusted raw images.
+	SourceFormat Format
+	// Compress compresses the data of the converted image (qcow2 and vmdk
+	// only).
+	Compress bool
+	// Subformat of the converted image, eg. "streamOptimized" for vmdk, or
+	// "fixed" for vhdx.
+	Subformat string
+	// QemuImgPath is the path of the qemu-img binary (by default it's found
+	// in the same way as the e2fsprogs binaries).
+	QemuImgPath string
+}
+
+// Convert converts the disk image at src (eg. a raw ext4 image, or one built
+// with Build) into a new image at dst of the given format, so that it can be
+// used directly by a hypervisor. qemu-img is run with the client, so src and
+// dst are paths on the host of its executor. Unallocated (and zeroed) regions
+// of the source are left sparse. If the conversion fails, dst is removed.
+func Convert(ctx context.Context, c ext4.FilesystemManager, src, dst string, format Format, opts ConvertOptions) error {
+	sourceFormat := opts.SourceFormat
+	if sourceFormat == "" {
+		sourceFormat = FormatRaw
+	}
+
+	var errs []error
+	if src == "" {
+		errs = append(errs, fmt.Errorf("%w: source image is required", ext4.ErrInvalidOptions))
+	}
+	if dst == "" {
+		errs = append(errs, fmt.Errorf("%w: destination image is required", ext4.ErrInvalidOptions))
+	} else if dst == src {
+		errs = append(errs, fmt.Errorf("%w: source and destination images must differ", ext4.ErrInvalidOptions))
+	}
+	if format == "" {
+		errs = append(errs, fmt.Errorf("%w: format is required", ext4.ErrInvalidOptions))
+	}
+	if opts.Compress && format != FormatQCOW2 && format != FormatVMDK {
+		errs = append(errs, fmt.Errorf("%w: compression is not supported by the %s format", ext4.ErrInvalidOptions, format))
+	}
+	if opts.Subformat != "" && format != FormatVMDK && format != FormatVHDX {
+		errs = append(errs, fmt.Errorf("%w: subformats are not supported by the %s format", ext4.ErrInvalidOptions, format))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	args := []string{"convert", "-f", string(sourceFormat), "-O", string(format)}
+	if opts.Compress {
+		args = append(args, "-c")
+	}
+	if opts.Subformat != "" {
+		args = append(args, "-o", "subformat="+opts.Subformat)
+	}
+	args = append(args, src, dst)
+
+	if _, err := c.RunCommand(ctx, "qemu-img", args, ext4.RunOptions{Path: opts.QemuImgPath}); err != nil {
+		// Nothing was written in dry-run mode.
+		if !errors.Is(err, ext4.ErrDryRun) {
+			_, _ = c.RunCommand(ctx, "rm", []string{"-f", "--", dst}, ext4.RunOptions{})
+		}
+		return fmt.Errorf("failed to convert %s: %w", src, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagebuilder_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/fakeext4"
+	"github.com/dpeckett/ext4/imagebuilder"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQemuImg is a stand-in for the qemu-img binary, that records its
+// arguments and copies the source image to the destination (leaving it
+// partially written on failure).
+const fakeQemuImg = `#!/bin/sh
+set -e
+echo "$@" > "$(dirname "$0")/args"
+for arg; do
+	src=$dst
+	dst=$arg
+done
+touch "$dst"
+cp "$src" "$dst"
+`
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	dir := t.TempDir()
+
+	imagePath := filepath.Join(dir, "ext4.img")
+	_, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{Label: "convert"})
+	require.NoError(t, err)
+
+	qemuImgPath := filepath.Join(dir, "qemu-img")
+	require.NoError(t, os.WriteFile(qemuImgPath, []byte(fakeQemuImg), 0o755))
+
+	err = imagebuilder.Convert(ctx, c, imagePath, filepath.Join(dir, "ext4.vmdk"), imagebuilder.FormatVMDK, imagebuilder.ConvertOptions{
+		Compress:    true,
+		Subformat:   "streamOptimized",
+		QemuImgPath: qemuImgPath,
+	})
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "convert -f raw -O vmdk -c -o subformat=streamOptimized "+imagePath+" "+filepath.Join(dir, "ext4.vmdk"), strings.TrimSpace(string(args)))
+
+	t.Log("Converting with invalid options")
+
+	err = imagebuilder.Convert(ctx, c, imagePath, filepath.Join(dir, "ext4.vhdx"), imagebuilder.FormatVHDX, imagebuilder.ConvertOptions{Compress: true})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	err = imagebuilder.Convert(ctx, c, imagePath, imagePath, imagebuilder.FormatQCOW2, imagebuilder.ConvertOptions{})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	t.Log("Cleaning up after failure")
+
+	dst := filepath.Join(dir, "missing.qcow2")
+	err = imagebuilder.Convert(ctx, c, filepath.Join(dir, "missing.img"), dst, imagebuilder.FormatQCOW2, imagebuilder.ConvertOptions{QemuImgPath: qemuImgPath})
+	require.Error(t, err)
+
+	_, err = os.Stat(dst)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not found")
+	}
+
+	t.Log("Round tripping through qcow2")
+
+	qcow2Path := filepath.Join(dir, "ext4.qcow2")
+	require.NoError(t, imagebuilder.Convert(ctx, c, imagePath, qcow2Path, imagebuilder.FormatQCOW2, imagebuilder.ConvertOptions{Compress: true}))
+
+	rawPath := filepath.Join(dir, "roundtrip.img")
+	require.NoError(t, imagebuilder.Convert(ctx, c, qcow2Path, rawPath, imagebuilder.FormatRaw, imagebuilder.ConvertOptions{SourceFormat: imagebuilder.FormatQCOW2}))
+
+	sb, err := c.ReadSuperblock(ctx, rawPath)
+	require.NoError(t, err)
+	require.Equal(t, "convert", sb.Label)
+}
+
+func TestConvertFake(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+
+	err := imagebuilder.Convert(ctx, c, "/images/disk.img", "/images/disk.qcow2", imagebuilder.FormatQCOW2, imagebuilder.ConvertOptions{
+		Compress:    true,
+		QemuImgPath: "/usr/bin/qemu-img",
+	})
+	require.NoError(t, err)
+
+	calls := c.CallsTo("RunCommand")
+	require.Len(t, calls, 1)
+	require.Equal(t, "qemu-img", calls[0].Args[0])
+	require.Equal(t, []string{"convert", "-f", "raw", "-O", "qcow2", "-c", "/images/disk.img", "/images/disk.qcow2"}, calls[0].Args[1])
+	require.Equal(t, "/usr/bin/qemu-img", calls[0].Args[2].(ext4.RunOptions).Path)
+}
@@ -0,0 +1,294 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package imagebuilder builds complete (eg. bootable virtual machine) disk
+// images, with a partition table, an optional EFI system partition, and an
+// ext4 root filesystem populated from a directory or tar stream.
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/partition"
+)
+
+// copyChunkSize is the granularity at which zeroed regions of the root
+// filesystem are skipped when copying it into the disk image.
+const copyChunkSize = 64 << 10
+
+// Options provides options for building a disk image.
+type Options struct {
+	// Size of the disk image in bytes.
+	Size int64
+	// TableType is the type of partition table (default GPT).
+	TableType partition.TableType
+	// EFISize is the size in bytes of the EFI system partition (formatted as
+	// FAT32 using mkfs.fat, and mounted at /boot/efi). If zero, no EFI system
+	// partition is created.
+	EFISize int64
+	// RootDirectory is a host directory copied into the root filesystem.
+	RootDirectory string
+	// RootTar is a tar stream extracted into the root filesystem (mutually
+	// exclusive with RootDirectory).
+	RootTar io.Reader
+	// Root holds additional options for creating the root filesystem (eg. the
+	// label). The device, size, and root directory are set by the builder. If
+	// no UUID (or RandomUUID) is given, a random one is generated.
+	Root ext4.CreateOptions
+	// NoFstab skips generating /etc/fstab in the root filesystem.
+	NoFstab bool
+}
+
+// Image describes a built disk image.
+type Image struct {
+	// Table is the partition table of the image.
+	Table *partition.Table
+	// RootPartition is the number of the root partition.
+	RootPartition int
+	// RootUUID is the UUID of the root filesystem.
+	RootUUID string
+	// EFIPartition is the number of the EFI system partition (zero if there
+	// is none).
+	EFIPartition int
+	// EFIVolumeID is the volume ID of the EFI system partition, as it appears
+	// in /dev/disk/by-uuid (eg. "1234-ABCD").
+	EFIVolumeID string
+}
+
+// Build creates a disk image at path. The client is used to create the root
+// filesystem in a temporary image file on the local host (so it must not use
+// a chroot, or remote executor), which is then copied into the root partition.
+func Build(ctx context.Context, c ext4.FilesystemManager, path string, opts Options) (*Image, error) {
+	if opts.Size <= 0 {
+		return nil, fmt.Errorf("%w: invalid image size %d", ext4.ErrInvalidOptions, opts.Size)
+	}
+	if opts.RootDirectory != "" && opts.RootTar != nil {
+		return nil, fmt.Errorf("%w: root directory and tar are mutually exclusive", ext4.ErrInvalidOptions)
+	}
+	if opts.Root.UUID == ext4.TimeUUID || opts.Root.UUID == ext4.ClearUUID {
+		return nil, fmt.Errorf("%w: the root UUID must be known to generate fstab", ext4.ErrInvalidOptions)
+	}
+
+	tableType := opts.TableType
+	if tableType == "" {
+		tableType = partition.GPT
+	}
+
+	rootType, efiType := partition.TypeLinuxFilesystem, partition.TypeEFISystem
+	if tableType == partition.MBR {
+		rootType, efiType = partition.TypeMBRLinux, partition.TypeMBREFISystem
+	}
+
+	var partitions []partition.Partition
+	if opts.EFISize > 0 {
+		partitions = append(partitions, partition.Partition{Size: opts.EFISize, Type: efiType, Name: "EFI System Partition"})
+	}
+	partitions = append(partitions, partition.Partition{Type: rootType, Name: "root"})
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image: %w", err)
+	}
+	if err := errors.Join(f.Truncate(opts.Size), f.Close()); err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("failed to size image: %w", err)
+	}
+
+	image, err := build(ctx, c, path, tableType, partitions, opts)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	return image, nil
+}
+
+func build(ctx context.Context, c ext4.FilesystemManager, path string, tableType partition.TableType, partitions []partition.Partition, opts Options) (*Image, error) {
+	table, err := partition.Create(path, partition.Table{Type: tableType, Partitions: partitions})
+	if err != nil {
+		return nil, fmt.Errorf("failed to partition image: %w", err)
+	}
+
+	image := &Image{Table: table}
+
+	root := table.Partitions[len(table.Partitions)-1]
+	image.RootPartition = root.Number
+
+	if opts.EFISize > 0 {
+		efi := table.Partitions[0]
+		image.EFIPartition = efi.Number
+
+		image.EFIVolumeID, err = formatEFI(ctx, c, path, efi, table.SectorSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	image.RootUUID = string(opts.Root.UUID)
+	if opts.Root.UUID == "" || opts.Root.UUID == ext4.RandomUUID {
+		uuid, err := ext4.NewRandomUUID()
+		if err != nil {
+			return nil, err
+		}
+		image.RootUUID = string(uuid)
+	}
+
+	if err := buildRoot(ctx, c, path, root, image, opts); err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// buildRoot creates the root filesystem in a temporary image file, and copies
+// it into the root partition.
+func buildRoot(ctx context.Context, c ext4.FilesystemManager, path string, root partition.Partition, image *Image, opts Options) error {
+	tempDir, err := os.MkdirTemp("", "imagebuilder-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rootPath := filepath.Join(tempDir, "root.img")
+
+	createOpts := opts.Root
+	createOpts.Device = rootPath
+	createOpts.Size = ext4.Size(root.Size/1024) * ext4.KiB
+	createOpts.RootDirectory = opts.RootDirectory
+	createOpts.UUID = ext4.UUID(image.RootUUID)
+
+	if opts.RootTar != nil {
+		_, err = c.CreateFilesystemFromTar(ctx, rootPath, opts.RootTar, createOpts)
+	} else {
+		_, err = c.CreateFilesystem(ctx, createOpts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create root filesystem: %w", err)
+	}
+
+	if !opts.NoFstab {
+		if err := writeFstab(ctx, c, rootPath, tempDir, image); err != nil {
+			return err
+		}
+	}
+
+	if err := copySparse(path, rootPath, root.Start); err != nil {
+		return fmt.Errorf("failed to copy root filesystem: %w", err)
+	}
+
+	return nil
+}
+
+// writeFstab generates /etc/fstab, mounting partitions by UUID.
+func writeFstab(ctx context.Context, c ext4.FilesystemManager, rootPath, tempDir string, image *Image) error {
+	var fstab strings.Builder
+	fmt.Fprintf(&fstab, "UUID=%s\t/\text4\tdefaults\t0\t1\n", image.RootUUID)
+	if image.EFIVolumeID != "" {
+		fmt.Fprintf(&fstab, "UUID=%s\t/boot/efi\tvfat\tumask=0077\t0\t2\n", image.EFIVolumeID)
+	}
+
+	fstabPath := filepath.Join(tempDir, "fstab")
+	if err := os.WriteFile(fstabPath, []byte(fstab.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write fstab: %w", err)
+	}
+
+	dirs := []string{"/etc"}
+	if image.EFIVolumeID != "" {
+		dirs = append(dirs, "/boot", "/boot/efi")
+	}
+	for _, dir := range dirs {
+		// The directory may already exist (eg. if it was in the root directory).
+		if err := c.MakeDirectoryInImage(ctx, rootPath, dir); err != nil && !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	// Replace any existing fstab.
+	if err := c.RemoveFromImage(ctx, rootPath, "/etc/fstab"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove existing fstab: %w", err)
+	}
+
+	if err := c.WriteFileToImage(ctx, rootPath, fstabPath, "/etc/fstab"); err != nil {
+		return fmt.Errorf("failed to write fstab: %w", err)
+	}
+
+	return nil
+}
+
+// formatEFI formats the EFI system partition as FAT32, returning its volume
+// ID.
+func formatEFI(ctx context.Context, c ext4.FilesystemManager, path string, efi partition.Partition, sectorSize int) (string, error) {
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	volumeID := fmt.Sprintf("%02X%02X%02X%02X", id[0], id[1], id[2], id[3])
+
+	args := []string{"-F", "32", "-n", "EFI", "-i", volumeID,
+		"-S", strconv.Itoa(sectorSize), "--offset", strconv.FormatInt(efi.Start/int64(sectorSize), 10),
+		path, strconv.FormatInt(efi.Size/1024, 10)}
+	if _, err := c.RunCommand(ctx, "mkfs.fat", args, ext4.RunOptions{}); err != nil {
+		return "", fmt.Errorf("failed to format EFI system partition: %w", err)
+	}
+
+	return volumeID[:4] + "-" + volumeID[4:], nil
+}
+
+// copySparse copies the contents of src into dst at the given offset, skipping
+// zeroed regions (which are already zero in the sparse destination).
+func copySparse(dst, src string, offset int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, copyChunkSize)
+	zero := make([]byte, copyChunkSize)
+	for pos := int64(0); ; pos += copyChunkSize {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := out.WriteAt(buf[:n], offset+pos); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return out.Sync()
+}
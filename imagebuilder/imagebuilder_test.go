@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package imagebuilder_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/imagebuilder"
+	"github.com/dpeckett/ext4/partition"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "etc", "fstab"), []byte("# placeholder\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "hello.txt"), []byte("hello world"), 0o644))
+
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	image, err := imagebuilder.Build(ctx, c, imagePath, imagebuilder.Options{
+		Size:          128 << 20,
+		RootDirectory: rootDir,
+		Root:          ext4.CreateOptions{Label: "rootfs"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, partition.GPT, image.Table.Type)
+	require.Len(t, image.Table.Partitions, 1)
+	require.Equal(t, 1, image.RootPartition)
+	require.Zero(t, image.EFIPartition)
+
+	table, err := partition.Read(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, image.Table, table)
+
+	// e2fsprogs can address a filesystem at an offset within an image.
+	root := table.Partitions[0]
+	rootDevice := fmt.Sprintf("%s?offset=%d", imagePath, root.Start)
+
+	sb, err := c.ReadSuperblock(ctx, rootDevice)
+	require.NoError(t, err)
+	require.Equal(t, image.RootUUID, sb.UUID)
+	require.Equal(t, "rootfs", sb.Label)
+	require.Equal(t, uint64(root.Size)/uint64(sb.BlockSize), sb.BlockCount)
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, rootDevice, "/", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+
+	fstab, err := os.ReadFile(filepath.Join(destDir, "etc", "fstab"))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("UUID=%s\t/\text4\tdefaults\t0\t1\n", image.RootUUID), string(fstab))
+
+	t.Log("Building an image that already exists")
+
+	_, err = imagebuilder.Build(ctx, c, imagePath, imagebuilder.Options{Size: 128 << 20})
+	require.Error(t, err)
+}
+
+func TestBuildFromTar(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0o644, Size: 5}))
+	_, err := tw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	opts := imagebuilder.Options{
+		Size:      128 << 20,
+		TableType: partition.MBR,
+		RootTar:   &buf,
+	}
+	if _, err := exec.LookPath("mkfs.fat"); err == nil {
+		opts.EFISize = 40 << 20
+	}
+
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	image, err := imagebuilder.Build(ctx, c, imagePath, opts)
+	require.NoError(t, err)
+
+	require.Equal(t, partition.MBR, image.Table.Type)
+
+	root := image.Table.Partitions[image.RootPartition-1]
+	require.Equal(t, partition.TypeMBRLinux, root.Type)
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, fmt.Sprintf("%s?offset=%d", imagePath, root.Start), "/", destDir))
+
+	data, err := os.ReadFile(filepath.Join(destDir, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	fstab, err := os.ReadFile(filepath.Join(destDir, "etc", "fstab"))
+	require.NoError(t, err)
+	require.Contains(t, string(fstab), "UUID="+image.RootUUID)
+
+	if opts.EFISize > 0 {
+		require.Equal(t, 1, image.EFIPartition)
+		require.Contains(t, string(fstab), "UUID="+image.EFIVolumeID+"\t/boot/efi\tvfat")
+	}
+}
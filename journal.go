@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Journal describes the contents of a filesystem's journal.
+type Journal struct {
+	// StartBlock is the journal block where the log begins.
+	StartBlock uint32 `json:"startBlock"`
+	// StartSequence is the sequence number of the first transaction.
+	StartSequence uint32 `json:"startSequence"`
+	// Transactions found in the journal, in log order.
+	Transactions []JournalTransaction `json:"transactions,omitempty"`
+	// EndReason describes why the journal scan stopped.
+	EndReason string `json:"endReason,omitempty"`
+}
+
+// JournalTransaction is a single transaction recorded in the journal.
+type JournalTransaction struct {
+	// Sequence number of the transaction.
+	Sequence uint32 `json:"sequence"`
+	// Blocks logged by the transaction.
+	Blocks []LoggedBlock `json:"blocks,omitempty"`
+	// RevokedBlocks are the filesystem blocks revoked by the transaction.
+	RevokedBlocks []uint64 `json:"revokedBlocks,omitempty"`
+	// Committed is true if a commit block was found for the transaction.
+	Committed bool `json:"committed"`
+}
+
+// LoggedBlock is a filesystem block logged in the journal.
+type LoggedBlock struct {
+	// FilesystemBlock is the block number in the filesystem.
+	FilesystemBlock uint64 `json:"filesystemBlock"`
+	// JournalBlock is the block in the journal holding the logged copy.
+	JournalBlock uint32 `json:"journalBlock"`
+	// Flags are the journal block tag flags.
+	Flags uint32 `json:"flags"`
+}
+
+// DumpJournal parses the journal of an unmounted ext4 filesystem.
+func (c *Client) DumpJournal(ctx context.Context, device string) (_ *Journal, err error) {
+	ctx, span := c.startSpan(ctx, "DumpJournal", device)
+	defer endSpan(span, &err)
+
+	out, err := c.debugfs(ctx, device, false, "logdump -a")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLogdump(out)
+}
+
+var (
+	logdumpStartRegexp       = regexp.MustCompile(`^Journal starts at block (\d+), transaction (\d+)$`)
+	logdumpFoundRegexp       = regexp.MustCompile(`^Found expected sequence (\d+), type (\d+) \(.*\) at block (\d+)$`)
+	logdumpLoggedBlockRegexp = regexp.MustCompile(`^FS block (\d+) logged at journal block (\d+) \(flags 0x([0-9a-fA-F]+)\)$`)
+	logdumpRevokeRegexp      = regexp.MustCompile(`^Revoke FS block (\d+)$`)
+	logdumpEndRegexp         = regexp.MustCompile(`end of journal\.$`)
+)
+
+// The jbd2 block type of a commit block.
+const journalCommitBlock = 2
+
+func parseLogdump(out []byte) (*Journal, error) {
+	var journal Journal
+	var foundStart bool
+	var txn *JournalTransaction
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := string(bytes.TrimSpace(scanner.Bytes()))
+
+		if m := logdumpStartRegexp.FindStringSubmatch(line); m != nil {
+			journal.StartBlock = parseUint32(m[1])
+			journal.StartSequence = parseUint32(m[2])
+			foundStart = true
+		} else if m := logdumpFoundRegexp.FindStringSubmatch(line); m != nil {
+			seq := parseUint32(m[1])
+			if txn == nil || txn.Sequence != seq {
+				journal.Transactions = append(journal.Transactions, JournalTransaction{Sequence: seq})
+				txn = &journal.Transactions[len(journal.Transactions)-1]
+			}
+
+			if blockType, _ := strconv.Atoi(m[2]); blockType == journalCommitBlock {
+				txn.Committed = true
+			}
+		} else if m := logdumpLoggedBlockRegexp.FindStringSubmatch(line); m != nil && txn != nil {
+			txn.Blocks = append(txn.Blocks, LoggedBlock{
+				FilesystemBlock: parseUint64(m[1]),
+				JournalBlock:    parseUint32(m[2]),
+				Flags:           parseHexUint32(m[3]),
+			})
+		} else if m := logdumpRevokeRegexp.FindStringSubmatch(line); m != nil && txn != nil {
+			txn.RevokedBlocks = append(txn.RevokedBlocks, parseUint64(m[1]))
+		} else if logdumpEndRegexp.MatchString(line) {
+			journal.EndReason = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !foundStart {
+		return nil, fmt.Errorf("unexpected logdump output")
+	}
+
+	return &journal, nil
+}
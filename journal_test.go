@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpJournal(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	blockData := filepath.Join(t.TempDir(), "blocks")
+	err := os.WriteFile(blockData, make([]byte, 8192), 0o644)
+	require.NoError(t, err)
+
+	t.Log("Writing transactions to the journal")
+
+	cmd := exec.Command("debugfs", "-w", "-f", "-", imagePath)
+	cmd.Stdin = strings.NewReader(strings.Join([]string{
+		"jo",
+		"jw -b 300,301 " + blockData,
+		"jw -r 302,303",
+		"jc",
+	}, "\n"))
+	require.NoError(t, cmd.Run())
+
+	journal, err := c.DumpJournal(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Len(t, journal.Transactions, 2)
+
+	require.Equal(t, journal.StartSequence, journal.Transactions[0].Sequence)
+	require.True(t, journal.Transactions[0].Committed)
+	require.Len(t, journal.Transactions[0].Blocks, 2)
+	require.Equal(t, uint64(300), journal.Transactions[0].Blocks[0].FilesystemBlock)
+	require.Equal(t, uint64(301), journal.Transactions[0].Blocks[1].FilesystemBlock)
+
+	require.True(t, journal.Transactions[1].Committed)
+	require.Equal(t, []uint64{302, 303}, journal.Transactions[1].RevokedBlocks)
+
+	require.Contains(t, journal.EndReason, "end of journal")
+}
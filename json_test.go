@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	requireJSONRoundTrip(t, sb, &ext4.SuperblockInfo{})
+
+	groups, err := c.ListBlockGroups(ctx, imagePath)
+	require.NoError(t, err)
+
+	requireJSONRoundTrip(t, groups, &[]ext4.BlockGroup{})
+
+	result, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   128 * ext4.MiB,
+	})
+	require.NoError(t, err)
+
+	requireJSONRoundTrip(t, result, &ext4.ResizeResult{})
+
+	health, err := c.HealthSummary(ctx, imagePath)
+	require.NoError(t, err)
+
+	requireJSONRoundTrip(t, health, &ext4.FilesystemHealth{})
+
+	requireJSONRoundTrip(t, &ext4.CheckResult{
+		Status: ext4.CheckErrorsCorrected,
+		Problems: []ext4.Problem{{
+			Pass:        4,
+			Inode:       12,
+			Description: "Inode 12 ref count is 7, should be 3.",
+			Action:      "Fix",
+			Fixed:       true,
+		}},
+	}, &ext4.CheckResult{})
+
+	data, err := json.Marshal(sb)
+	require.NoError(t, err)
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(data, &fields))
+	require.Equal(t, sb.UUID, fields["uuid"])
+	require.EqualValues(t, sb.BlockCount, fields["blockCount"])
+}
+
+// requireJSONRoundTrip marshals v, unmarshals it into out, and verifies that
+// re-marshalling produces identical JSON.
+func requireJSONRoundTrip(t *testing.T, v, out any) {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	require.NoError(t, json.Unmarshal(data, out))
+
+	roundTripped, err := json.Marshal(out)
+	require.NoError(t, err)
+
+	require.JSONEq(t, string(data), string(roundTripped))
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"unicode/utf8"
+)
+
+// labelHashLength is the number of hex digits of the hash suffix appended by
+// LabelHashSuffix.
+const labelHashLength = 4
+
+// LabelPolicy controls what happens to volume labels longer than the 16 bytes
+// that fit in the superblock.
+type LabelPolicy int
+
+const (
+	// LabelReject rejects long labels with an error (the default).
+	LabelReject LabelPolicy = iota
+	// LabelTruncate truncates long labels to 16 bytes (without splitting a
+	// UTF-8 character).
+	LabelTruncate
+	// LabelHashSuffix truncates long labels, and replaces their end with a
+	// short hash of the full label, so that distinct long labels (eg. with a
+	// common prefix) are likely to remain distinct.
+	LabelHashSuffix
+)
+
+// Apply returns the label as it will be written to the superblock.
+func (p LabelPolicy) Apply(label string) (string, error) {
+	if len(label) <= maxLabelLength {
+		return label, nil
+	}
+
+	switch p {
+	case LabelReject:
+		return "", invalidOption("label %q exceeds %d bytes", label, maxLabelLength)
+	case LabelTruncate:
+		return truncateLabel(label, maxLabelLength), nil
+	case LabelHashSuffix:
+		sum := sha256.Sum256([]byte(label))
+		suffix := "-" + hex.EncodeToString(sum[:])[:labelHashLength]
+		return truncateLabel(label, maxLabelLength-len(suffix)) + suffix, nil
+	default:
+		return "", invalidOption("unknown label policy %d", int(p))
+	}
+}
+
+// truncateLabel truncates a label to at most n bytes, without splitting a
+// UTF-8 character.
+func truncateLabel(label string, n int) string {
+	for n > 0 && !utf8.RuneStart(label[n]) {
+		n--
+	}
+
+	return label[:n]
+}
+
+// SetLabel sets the volume label of a filesystem (this is possible while it is
+// mounted), returning the label as written after applying the policy.
+func (c *Client) SetLabel(ctx context.Context, device, label string, policy LabelPolicy) (_ string, err error) {
+	ctx, span := c.startSpan(ctx, "SetLabel", device)
+	defer endSpan(span, &err)
+
+	if device == "" {
+		return "", invalidOption("device is required")
+	}
+
+	label, err = policy.Apply(label)
+	if err != nil {
+		return "", err
+	}
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, err := c.run(ctx, "e2label", device, label); err != nil {
+		return "", fmt.Errorf("failed to set label: %w", err)
+	}
+
+	return label, nil
+}
+
+// SetLabelFile sets the volume label of an unmounted filesystem on the local
+// host (in the primary and backup superblocks), without running e2label (eg.
+// in minimal containers that don't have e2fsprogs installed). Returns the
+// label as written after applying the policy.
+func SetLabelFile(device, label string, policy LabelPolicy) (string, error) {
+	label, err := policy.Apply(label)
+	if err != nil {
+		return "", err
+	}
+
+	err = updateSuperblocks(device, func(_ *SuperblockInfo, buf []byte) error {
+		field := buf[0x78:0x88]
+		clear(field)
+		copy(field, label)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to set label: %w", err)
+	}
+
+	return label, nil
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelPolicy(t *testing.T) {
+	for _, policy := range []ext4.LabelPolicy{ext4.LabelReject, ext4.LabelTruncate, ext4.LabelHashSuffix} {
+		label, err := policy.Apply("data")
+		require.NoError(t, err)
+		require.Equal(t, "data", label)
+	}
+
+	_, err := ext4.LabelReject.Apply("a-very-long-volume-label")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	label, err := ext4.LabelTruncate.Apply("a-very-long-volume-label")
+	require.NoError(t, err)
+	require.Equal(t, "a-very-long-volu", label)
+
+	// Multi-byte characters aren't split.
+	label, err = ext4.LabelTruncate.Apply("étiquette-données")
+	require.NoError(t, err)
+	require.Equal(t, "étiquette-donn", label)
+
+	first, err := ext4.LabelHashSuffix.Apply("a-very-long-volume-label-1")
+	require.NoError(t, err)
+	require.Len(t, first, 16)
+	require.Regexp(t, `^a-very-long-[0-9a-f]{4}$`, first)
+
+	second, err := ext4.LabelHashSuffix.Apply("a-very-long-volume-label-2")
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+
+	_, err = ext4.LabelPolicy(42).Apply("a-very-long-volume-label")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestSetLabel(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	fs, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:      imagePath,
+		Size:        64 * ext4.MiB,
+		Label:       "a-very-long-volume-label",
+		LabelPolicy: ext4.LabelTruncate,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "a-very-long-volu", fs.Label)
+
+	label, err := c.SetLabel(ctx, imagePath, "another-long-volume-label", ext4.LabelHashSuffix)
+	require.NoError(t, err)
+	require.Len(t, label, 16)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, label, sb.Label)
+
+	_, err = c.SetLabel(ctx, imagePath, "another-long-volume-label", ext4.LabelReject)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestSetLabelFile(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4": {},
+		"ext2": {Type: ext4.Ext2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.Device = filepath.Join(t.TempDir(), "ext4.img")
+			opts.Size = 64 * ext4.MiB
+			opts.Label = "a-very-long-volume-label"
+			opts.LabelPolicy = ext4.LabelTruncate
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			label, err := ext4.SetLabelFile(opts.Device, "data", ext4.LabelReject)
+			require.NoError(t, err)
+			require.Equal(t, "data", label)
+
+			sb, err := c.ReadSuperblock(ctx, opts.Device)
+			require.NoError(t, err)
+			require.Equal(t, "data", sb.Label)
+
+			result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: opts.Device, Force: true, NoFix: true})
+			require.NoError(t, err)
+			require.True(t, result.Status.OK())
+
+			t.Log("Checking the backup superblocks")
+
+			f, err := os.Open(opts.Device)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			for _, block := range sb.BackupSuperblocks() {
+				backup, err := ext4.ReadBackupSuperblockFrom(f, block, sb.BlockSize)
+				require.NoError(t, err)
+				require.Equal(t, "data", backup.Label)
+			}
+
+			t.Log("Clearing the label")
+
+			_, err = ext4.SetLabelFile(opts.Device, "", ext4.LabelReject)
+			require.NoError(t, err)
+
+			sb, err = ext4.ReadSuperblockFile(opts.Device)
+			require.NoError(t, err)
+			require.Empty(t, sb.Label)
+
+			_, err = ext4.SetLabelFile(opts.Device, "another-long-volume-label", ext4.LabelReject)
+			require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// flockPollInterval is how often an attempt is made to take a contended lock.
+const flockPollInterval = 100 * time.Millisecond
+
+// flockDevice takes an exclusive BSD lock on the device node (the same
+// convention used by udev, see udevadm-lock(1)), returning a function that
+// releases it.
+func flockDevice(ctx context.Context, device string) (func(), error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			_ = f.Close()
+			return nil, err
+		}
+
+		if err := sleepContext(ctx, flockPollInterval); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		// Closing the file releases the lock.
+		_ = f.Close()
+	}, nil
+}
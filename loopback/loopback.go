@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package loopback attaches image files to loop devices, so that they can be
+// used wherever a block device is required (eg. for mounting).
+package loopback
+
+// Options provides options for attaching an image file to a loop device.
+type Options struct {
+	// ReadOnly attaches the image read-only.
+	ReadOnly bool
+	// PartitionScan makes the kernel scan the image for a partition table,
+	// creating a device for each partition (eg. /dev/loop0p1).
+	PartitionScan bool
+	// DirectIO bypasses the page cache of the backing file.
+	DirectIO bool
+	// Offset is the offset in bytes from the start of the image at which the
+	// device starts.
+	Offset uint64
+	// SizeLimit is the maximum size in bytes of the device (zero for the rest
+	// of the image).
+	SizeLimit uint64
+	// BlockSize is the logical block size of the device in bytes (eg. 4096).
+	BlockSize uint32
+}
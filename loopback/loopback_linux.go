@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loopback
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxAttempts is the number of times to retry attaching an image, when a free
+// loop device is claimed by another process before it can be configured.
+const maxAttempts = 10
+
+// Attach attaches the image file at path to a free loop device, returning the
+// path of the device, and a function that detaches it. Requires CAP_SYS_ADMIN.
+func Attach(path string, opts Options) (string, func() error, error) {
+	flags := os.O_RDWR
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+
+	image, err := os.OpenFile(path, flags|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	// The kernel holds its own reference to the image once attached.
+	defer image.Close()
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open loop control device: %w", err)
+	}
+	defer ctl.Close()
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to find free loop device: %w", err)
+		}
+
+		device := fmt.Sprintf("/dev/loop%d", n)
+		err = attach(device, image, opts)
+		if errors.Is(err, unix.EBUSY) {
+			// Lost a race with another process.
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		return device, func() error {
+			return Detach(device)
+		}, nil
+	}
+
+	return "", nil, fmt.Errorf("failed to attach image: no free loop device after %d attempts", maxAttempts)
+}
+
+func attach(device string, image *os.File, opts Options) error {
+	dev, err := os.OpenFile(device, os.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open loop device: %w", err)
+	}
+	defer dev.Close()
+
+	fd := int(dev.Fd())
+	if err := unix.IoctlSetInt(fd, unix.LOOP_SET_FD, int(image.Fd())); err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return err
+		}
+		return fmt.Errorf("failed to attach image to %s: %w", device, err)
+	}
+
+	info := unix.LoopInfo64{
+		Offset:    opts.Offset,
+		Sizelimit: opts.SizeLimit,
+	}
+	if opts.ReadOnly {
+		info.Flags |= unix.LO_FLAGS_READ_ONLY
+	}
+	if opts.PartitionScan {
+		info.Flags |= unix.LO_FLAGS_PARTSCAN
+	}
+	copy(info.File_name[:], image.Name())
+
+	if err := unix.IoctlLoopSetStatus64(fd, &info); err != nil {
+		_ = unix.IoctlSetInt(fd, unix.LOOP_CLR_FD, 0)
+		return fmt.Errorf("failed to configure %s: %w", device, err)
+	}
+
+	if opts.BlockSize != 0 {
+		if err := unix.IoctlSetInt(fd, unix.LOOP_SET_BLOCK_SIZE, int(opts.BlockSize)); err != nil {
+			_ = unix.IoctlSetInt(fd, unix.LOOP_CLR_FD, 0)
+			return fmt.Errorf("failed to set block size of %s: %w", device, err)
+		}
+	}
+
+	if opts.DirectIO {
+		if err := unix.IoctlSetInt(fd, unix.LOOP_SET_DIRECT_IO, 1); err != nil {
+			_ = unix.IoctlSetInt(fd, unix.LOOP_CLR_FD, 0)
+			return fmt.Errorf("failed to enable direct I/O on %s: %w", device, err)
+		}
+	}
+
+	return nil
+}
+
+// Detach detaches the image from a loop device.
+func Detach(device string) error {
+	dev, err := os.OpenFile(device, os.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open loop device: %w", err)
+	}
+	defer dev.Close()
+
+	if err := unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0); err != nil && !errors.Is(err, unix.ENXIO) {
+		return fmt.Errorf("failed to detach %s: %w", device, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loopback
+
+import "errors"
+
+var errUnsupported = errors.New("loop devices are not supported on this platform")
+
+// Attach attaches the image file at path to a free loop device, returning the
+// path of the device, and a function that detaches it.
+func Attach(_ string, _ Options) (string, func() error, error) {
+	return "", nil, errUnsupported
+}
+
+// Detach detaches the image from a loop device.
+func Detach(_ string) error {
+	return errUnsupported
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package loopback_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttach(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("attaching loop devices requires root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{Label: "loopback"})
+	require.NoError(t, err)
+
+	device, detach, err := loopback.Attach(imagePath, loopback.Options{ReadOnly: true})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	sb, err := c.ReadSuperblock(ctx, device)
+	require.NoError(t, err)
+	require.Equal(t, "loopback", sb.Label)
+
+	t.Log("Verifying the device is read-only")
+
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write(make([]byte, 512))
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+
+	t.Log("Detaching the device")
+
+	require.NoError(t, detach())
+
+	_, err = c.ReadSuperblock(ctx, device)
+	require.Error(t, err)
+}
@@ -0,0 +1,393 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package luks sets up dm-crypt/LUKS encrypted volumes using cryptsetup, and
+// provisions ext4 filesystems inside them.
+package luks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dpeckett/ext4"
+)
+
+// mapperDir is where device-mapper exposes mapped devices.
+const mapperDir = "/dev/mapper"
+
+// Version is the version of the LUKS on-disk format.
+type Version string
+
+const (
+	// LUKS1 is the original LUKS format, supported by older bootloaders.
+	LUKS1 Version = "luks1"
+	// LUKS2 is the current LUKS format (the cryptsetup default).
+	LUKS2 Version = "luks2"
+)
+
+// Cipher is a dm-crypt cipher specification (cipher-chainmode-ivmode).
+type Cipher string
+
+const (
+	// CipherAESXTS is AES in XTS mode (the cryptsetup default).
+	CipherAESXTS Cipher = "aes-xts-plain64"
+	// CipherSerpentXTS is Serpent in XTS mode.
+	CipherSerpentXTS Cipher = "serpent-xts-plain64"
+	// CipherTwofishXTS is Twofish in XTS mode.
+	CipherTwofishXTS Cipher = "twofish-xts-plain64"
+	// CipherXChaCha20 is XChaCha20 with AES-Adiantum, for hardware without
+	// AES acceleration.
+	CipherXChaCha20 Cipher = "xchacha20,aes-adiantum-plain64"
+)
+
+// PBKDF is the key derivation function used to turn a key into a key slot
+// encryption key.
+type PBKDF string
+
+const (
+	// PBKDFArgon2id is the memory-hard Argon2id (LUKS2 only).
+	PBKDFArgon2id PBKDF = "argon2id"
+	// PBKDFArgon2i is the memory-hard Argon2i (LUKS2 only).
+	PBKDFArgon2i PBKDF = "argon2i"
+	// PBKDFPBKDF2 is PBKDF2 (the only option for LUKS1).
+	PBKDFPBKDF2 PBKDF = "pbkdf2"
+)
+
+// ErrNoKey is returned when neither a passphrase nor a key file is provided.
+var ErrNoKey = errors.New("no key provided")
+
+// Key is the key used to unlock a LUKS volume. Exactly one of Passphrase or
+// File must be set.
+type Key struct {
+	// Passphrase is passed to cryptsetup on stdin, so that it never appears in
+	// the process arguments. It is used as is (a trailing newline is part of
+	// the key).
+	Passphrase []byte
+	// File is the path of a key file.
+	File string
+}
+
+func (k Key) args() ([]string, error) {
+	switch {
+	case len(k.Passphrase) > 0 && k.File != "":
+		return nil, fmt.Errorf("%w: passphrase and key file are mutually exclusive", ext4.ErrInvalidOptions)
+	case len(k.Passphrase) > 0:
+		return []string{"--key-file", "-"}, nil
+	case k.File != "":
+		return []string{"--key-file", k.File}, nil
+	default:
+		return nil, ErrNoKey
+	}
+}
+
+// FormatOptions provides options for formatting a LUKS volume. Unset fields
+// use the cryptsetup defaults.
+type FormatOptions struct {
+	// Version of the LUKS format.
+	Version Version
+	// Cipher used to encrypt the volume.
+	Cipher Cipher
+	// KeySize is the size of the volume key in bits (eg. 512 for AES-256 in
+	// XTS mode).
+	KeySize int
+	// Hash is the hash algorithm used for key derivation (eg. "sha256").
+	Hash string
+	// PBKDF is the key derivation function.
+	PBKDF PBKDF
+	// IterTime is the time in milliseconds spent on key derivation.
+	IterTime int
+	// SectorSize is the encryption sector size in bytes (LUKS2 only).
+	SectorSize int
+	// Label is the label of the volume (LUKS2 only).
+	Label string
+	// UUID of the volume (random by default).
+	UUID string
+	// CryptsetupPath is the path of the cryptsetup binary (by default it's
+	// found by the client, as with the e2fsprogs binaries).
+	CryptsetupPath string
+}
+
+func (o *FormatOptions) args() ([]string, error) {
+	args := []string{"luksFormat", "--batch-mode"}
+	if o.Version != "" {
+		if o.Version != LUKS1 && o.Version != LUKS2 {
+			return nil, fmt.Errorf("%w: unsupported LUKS version: %s", ext4.ErrInvalidOptions, o.Version)
+		}
+		args = append(args, "--type", string(o.Version))
+	}
+	if o.Version == LUKS1 {
+		if o.PBKDF != "" && o.PBKDF != PBKDFPBKDF2 {
+			return nil, fmt.Errorf("%w: %s is not supported by LUKS1", ext4.ErrInvalidOptions, o.PBKDF)
+		}
+		if o.Label != "" {
+			return nil, fmt.Errorf("%w: labels are not supported by LUKS1", ext4.ErrInvalidOptions)
+		}
+		if o.SectorSize != 0 {
+			return nil, fmt.Errorf("%w: sector size is not supported by LUKS1", ext4.ErrInvalidOptions)
+		}
+	}
+	if o.Cipher != "" {
+		args = append(args, "--cipher", string(o.Cipher))
+	}
+	if o.KeySize < 0 || o.KeySize%8 != 0 {
+		return nil, fmt.Errorf("%w: invalid key size: %d", ext4.ErrInvalidOptions, o.KeySize)
+	} else if o.KeySize > 0 {
+		args = append(args, "--key-size", strconv.Itoa(o.KeySize))
+	}
+	if o.Hash != "" {
+		args = append(args, "--hash", o.Hash)
+	}
+	if o.PBKDF != "" {
+		args = append(args, "--pbkdf", string(o.PBKDF))
+	}
+	if o.IterTime < 0 {
+		return nil, fmt.Errorf("%w: invalid iteration time: %d", ext4.ErrInvalidOptions, o.IterTime)
+	} else if o.IterTime > 0 {
+		args = append(args, "--iter-time", strconv.Itoa(o.IterTime))
+	}
+	if o.SectorSize != 0 {
+		if o.SectorSize < 512 || o.SectorSize > 4096 || o.SectorSize&(o.SectorSize-1) != 0 {
+			return nil, fmt.Errorf("%w: invalid sector size: %d", ext4.ErrInvalidOptions, o.SectorSize)
+		}
+		args = append(args, "--sector-size", strconv.Itoa(o.SectorSize))
+	}
+	if o.Label != "" {
+		args = append(args, "--label", o.Label)
+	}
+	if o.UUID != "" {
+		args = append(args, "--uuid", o.UUID)
+	}
+
+	return args, nil
+}
+
+// OpenOptions provides options for opening a LUKS volume.
+type OpenOptions struct {
+	// ReadOnly maps the volume read-only.
+	ReadOnly bool
+	// AllowDiscards passes discard (TRIM) requests through to the underlying
+	// device. This leaks which blocks are in use.
+	AllowDiscards bool
+	// CryptsetupPath is the path of the cryptsetup binary (by default it's
+	// found by the client, as with the e2fsprogs binaries).
+	CryptsetupPath string
+}
+
+// Format formats device as a LUKS volume, destroying any existing data.
+// cryptsetup is run with the client (eg. with its executor, and subject to
+// dry-run mode).
+func Format(ctx context.Context, c ext4.FilesystemManager, device string, key Key, opts FormatOptions) error {
+	args, err := opts.args()
+	if err != nil {
+		return err
+	}
+
+	keyArgs, err := key.args()
+	if err != nil {
+		return err
+	}
+
+	args = append(append(args, keyArgs...), device)
+	if _, err := run(ctx, c, opts.CryptsetupPath, key, false, args...); err != nil {
+		return fmt.Errorf("failed to format %s: %w", device, err)
+	}
+
+	return nil
+}
+
+// Open unlocks the LUKS volume on device, and maps it to /dev/mapper/<name>.
+// Returns the path of the mapped device, and a function that closes it.
+// Requires CAP_SYS_ADMIN.
+func Open(ctx context.Context, c ext4.FilesystemManager, device, name string, key Key, opts OpenOptions) (string, func() error, error) {
+	if err := validateName(name); err != nil {
+		return "", nil, err
+	}
+
+	keyArgs, err := key.args()
+	if err != nil {
+		return "", nil, err
+	}
+
+	args := append([]string{"open", "--type", "luks"}, keyArgs...)
+	if opts.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	if opts.AllowDiscards {
+		args = append(args, "--allow-discards")
+	}
+	args = append(args, device, name)
+
+	if _, err := run(ctx, c, opts.CryptsetupPath, key, false, args...); err != nil {
+		return "", nil, fmt.Errorf("failed to open %s: %w", device, err)
+	}
+
+	return filepath.Join(mapperDir, name), func() error {
+		return Close(context.Background(), c, name, opts.CryptsetupPath)
+	}, nil
+}
+
+// Close removes the mapping of an open LUKS volume. If cryptsetupPath is empty,
+// cryptsetup is found by the client.
+func Close(ctx context.Context, c ext4.FilesystemManager, name, cryptsetupPath string) error {
+	if _, err := run(ctx, c, cryptsetupPath, Key{}, false, "close", name); err != nil {
+		return fmt.Errorf("failed to close %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// IsLUKS returns true if device holds a LUKS volume. If cryptsetupPath is
+// empty, cryptsetup is found by the client.
+func IsLUKS(ctx context.Context, c ext4.FilesystemManager, device, cryptsetupPath string) (bool, error) {
+	_, err := run(ctx, c, cryptsetupPath, Key{}, true, "isLuks", device)
+	var cmdErr *ext4.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode == 1 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// UUID returns the UUID of the LUKS volume on device (eg. for use in
+// /etc/crypttab). If cryptsetupPath is empty, cryptsetup is found by the
+// client.
+func UUID(ctx context.Context, c ext4.FilesystemManager, device, cryptsetupPath string) (string, error) {
+	out, err := run(ctx, c, cryptsetupPath, Key{}, true, "luksUUID", device)
+	if err != nil {
+		return "", fmt.Errorf("failed to read UUID of %s: %w", device, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ProvisionOptions provides options for provisioning an encrypted ext4
+// filesystem.
+type ProvisionOptions struct {
+	// Name is the device-mapper name of the opened volume.
+	Name string
+	// Key used to unlock the volume.
+	Key Key
+	// Format holds options for formatting the LUKS volume.
+	Format FormatOptions
+	// Open holds options for opening the LUKS volume.
+	Open OpenOptions
+	// Filesystem holds options for creating the ext4 filesystem. The device
+	// is set to the mapped device.
+	Filesystem ext4.CreateOptions
+}
+
+// Volume is a provisioned (and open) encrypted ext4 filesystem.
+type Volume struct {
+	// Device is the path of the mapped (decrypted) device.
+	Device string
+	// UUID is the UUID of the LUKS volume.
+	UUID string
+	// Filesystem describes the ext4 filesystem inside the volume.
+	Filesystem *ext4.CreatedFilesystem
+	// Close closes the mapped device.
+	Close func() error
+}
+
+// Provision formats device as a LUKS volume, opens it, and creates an ext4
+// filesystem inside the mapped device. The volume is left open; the caller
+// is responsible for closing it. On failure the volume is closed. cryptsetup
+// is run with c, as with the ext4 commands.
+func Provision(ctx context.Context, c ext4.FilesystemManager, device string, opts ProvisionOptions) (*Volume, error) {
+	if opts.Filesystem.Device != "" {
+		return nil, fmt.Errorf("%w: filesystem device is set by the provisioner", ext4.ErrInvalidOptions)
+	}
+
+	// Validate everything up front, so that the device isn't formatted only
+	// for opening it to fail.
+	if err := validateName(opts.Name); err != nil {
+		return nil, err
+	}
+	if _, err := opts.Key.args(); err != nil {
+		return nil, err
+	}
+	if _, err := opts.Format.args(); err != nil {
+		return nil, err
+	}
+	fsOpts := opts.Filesystem
+	fsOpts.Device = filepath.Join(mapperDir, opts.Name)
+	if err := fsOpts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.Open.CryptsetupPath == "" {
+		opts.Open.CryptsetupPath = opts.Format.CryptsetupPath
+	}
+
+	if err := Format(ctx, c, device, opts.Key, opts.Format); err != nil {
+		return nil, err
+	}
+
+	uuid, err := UUID(ctx, c, device, opts.Format.CryptsetupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped, closeVolume, err := Open(ctx, c, device, opts.Name, opts.Key, opts.Open)
+	if err != nil {
+		return nil, err
+	}
+
+	fsOpts.Device = mapped
+	fs, err := c.CreateFilesystem(ctx, fsOpts)
+	if err != nil {
+		_ = closeVolume()
+		return nil, fmt.Errorf("failed to create filesystem: %w", err)
+	}
+
+	return &Volume{
+		Device:     mapped,
+		UUID:       uuid,
+		Filesystem: fs,
+		Close:      closeVolume,
+	}, nil
+}
+
+// validateName checks that name is usable as a device-mapper name.
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("%w: invalid mapping name: %q", ext4.ErrInvalidOptions, name)
+	}
+
+	return nil
+}
+
+// run runs cryptsetup with the client, passing the passphrase (if any) on
+// stdin. Read-only commands are still run in dry-run mode.
+func run(ctx context.Context, c ext4.FilesystemManager, cryptsetupPath string, key Key, readOnly bool, args ...string) ([]byte, error) {
+	opts := ext4.RunOptions{
+		Path:     cryptsetupPath,
+		ReadOnly: readOnly,
+	}
+	if len(key.Passphrase) > 0 {
+		opts.Stdin = bytes.NewReader(key.Passphrase)
+		opts.SensitiveStdin = true
+	}
+
+	return c.RunCommand(ctx, "cryptsetup", args, opts)
+}
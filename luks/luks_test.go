@@ -0,0 +1,212 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package luks_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/dpeckett/ext4/fakeext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/dpeckett/ext4/luks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvision(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("device-mapper requires root")
+	}
+
+	if _, err := exec.LookPath("cryptsetup"); err != nil {
+		t.Skip("cryptsetup not found")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "luks.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	key := luks.Key{Passphrase: []byte("correct horse battery staple")}
+
+	vol, err := luks.Provision(ctx, c, devPath, luks.ProvisionOptions{
+		Name: "ext4-test-" + filepath.Base(devPath),
+		Key:  key,
+		Format: luks.FormatOptions{
+			Version: luks.LUKS2,
+			Cipher:  luks.CipherAESXTS,
+			KeySize: 512,
+			PBKDF:   luks.PBKDFPBKDF2,
+			// Keep key derivation fast for tests.
+			IterTime: 10,
+		},
+		Filesystem: ext4.CreateOptions{Label: "secret"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = vol.Close()
+	})
+
+	require.NotEmpty(t, vol.UUID)
+	require.NotEmpty(t, vol.Filesystem.UUID)
+
+	isLUKS, err := luks.IsLUKS(ctx, c, devPath, "")
+	require.NoError(t, err)
+	require.True(t, isLUKS)
+
+	sb, err := c.ReadSuperblock(ctx, vol.Device)
+	require.NoError(t, err)
+	require.Equal(t, "secret", sb.Label)
+
+	require.NoError(t, vol.Close())
+
+	t.Log("Opening with the wrong key")
+
+	_, _, err = luks.Open(ctx, c, devPath, "ext4-test-wrong", luks.Key{Passphrase: []byte("wrong")}, luks.OpenOptions{})
+	require.Error(t, err)
+
+	t.Log("Reopening the volume")
+
+	mapped, closeVolume, err := luks.Open(ctx, c, devPath, "ext4-test-reopen", key, luks.OpenOptions{ReadOnly: true})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = closeVolume()
+	})
+
+	sb, err = c.ReadSuperblock(ctx, mapped)
+	require.NoError(t, err)
+	require.Equal(t, vol.Filesystem.UUID, sb.UUID)
+
+	require.NoError(t, closeVolume())
+}
+
+func TestProvisionInvalidOptions(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	// None of these should get as far as running cryptsetup.
+	device := filepath.Join(t.TempDir(), "missing")
+
+	tests := map[string]luks.ProvisionOptions{
+		"no key": {Name: "test"},
+		"both keys": {
+			Name: "test",
+			Key:  luks.Key{Passphrase: []byte("secret"), File: "/etc/secret.key"},
+		},
+		"bad name": {Name: "../test", Key: luks.Key{Passphrase: []byte("secret")}},
+		"argon2 with luks1": {
+			Name:   "test",
+			Key:    luks.Key{Passphrase: []byte("secret")},
+			Format: luks.FormatOptions{Version: luks.LUKS1, PBKDF: luks.PBKDFArgon2id},
+		},
+		"bad sector size": {
+			Name:   "test",
+			Key:    luks.Key{Passphrase: []byte("secret")},
+			Format: luks.FormatOptions{SectorSize: 1000},
+		},
+		"bad block size": {
+			Name:       "test",
+			Key:        luks.Key{Passphrase: []byte("secret")},
+			Filesystem: ext4.CreateOptions{BlockSize: ptr(3000)},
+		},
+		"device set": {
+			Name:       "test",
+			Key:        luks.Key{Passphrase: []byte("secret")},
+			Filesystem: ext4.CreateOptions{Device: "/dev/sda"},
+		},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := luks.Provision(ctx, c, device, opts)
+			if name == "no key" {
+				require.ErrorIs(t, err, luks.ErrNoKey)
+			} else {
+				require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+			}
+		})
+	}
+}
+
+func TestProvisionDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	e := &ext4test.RecordingExecutor{}
+	c := ext4.NewClient(ext4.WithExecutor(e), ext4.WithDryRun())
+
+	device := filepath.Join(t.TempDir(), "disk.img")
+
+	_, err := luks.Provision(ctx, c, device, luks.ProvisionOptions{
+		Name: "test",
+		Key:  luks.Key{Passphrase: []byte("secret")},
+	})
+
+	var dryRunErr *ext4.DryRunError
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, []string{"cryptsetup", "luksFormat", "--batch-mode", "--key-file", "-", device}, dryRunErr.Argv)
+
+	t.Log("Checking the passphrase isn't reported")
+
+	require.Empty(t, dryRunErr.Stdin)
+	require.Empty(t, e.Argv())
+}
+
+func TestProvisionFake(t *testing.T) {
+	ctx := context.Background()
+
+	c := fakeext4.NewClient()
+	c.SetCommandOutput("cryptsetup", []byte("5c0a2dd4-4a6e-4d3e-8e6f-7a5f0e0c9b11\n"))
+
+	vol, err := luks.Provision(ctx, c, "/dev/sdb", luks.ProvisionOptions{
+		Name:   "data",
+		Key:    luks.Key{File: "/etc/data.key"},
+		Format: luks.FormatOptions{CryptsetupPath: "/sbin/cryptsetup"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/dev/mapper/data", vol.Device)
+	require.Equal(t, "5c0a2dd4-4a6e-4d3e-8e6f-7a5f0e0c9b11", vol.UUID)
+
+	require.NoError(t, vol.Close())
+
+	calls := c.CallsTo("RunCommand")
+	require.Len(t, calls, 4)
+	for i, subcommand := range []string{"luksFormat", "luksUUID", "open", "close"} {
+		require.Equal(t, subcommand, calls[i].Args[1].([]string)[0])
+		require.Equal(t, "/sbin/cryptsetup", calls[i].Args[2].(ext4.RunOptions).Path)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,244 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package lvm creates and extends LVM logical volumes, and provisions ext4
+// filesystems on them.
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dpeckett/ext4"
+)
+
+// nameRegexp matches valid volume group and logical volume names.
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+
+// LVOptions provides options for creating a logical volume.
+type LVOptions struct {
+	// VolumeGroup is the name of the volume group to create the logical volume
+	// in.
+	VolumeGroup string
+	// Name of the logical volume.
+	Name string
+	// Size of the logical volume, with an optional unit suffix (eg. "10G").
+	// Mutually exclusive with Extents.
+	Size string
+	// Extents is the size of the logical volume in extents, or as a percentage
+	// (eg. "100%FREE"). Mutually exclusive with Size.
+	Extents string
+	// Tags are added to the logical volume.
+	Tags []string
+	// LVMPath is the path of the lvm binary (by default it's found by the
+	// client, as with the e2fsprogs binaries).
+	LVMPath string
+}
+
+// Validate checks the options for creating a logical volume.
+func (opts LVOptions) Validate() error {
+	if !validName(opts.VolumeGroup) {
+		return fmt.Errorf("%w: invalid volume group name %q", ext4.ErrInvalidOptions, opts.VolumeGroup)
+	}
+	if !validName(opts.Name) {
+		return fmt.Errorf("%w: invalid logical volume name %q", ext4.ErrInvalidOptions, opts.Name)
+	}
+	if (opts.Size == "") == (opts.Extents == "") {
+		return fmt.Errorf("%w: exactly one of size or extents is required", ext4.ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+// ExtendOptions provides options for extending a logical volume.
+type ExtendOptions struct {
+	// Size to extend the logical volume to, or by with a leading "+", with an
+	// optional unit suffix (eg. "+10G"). Mutually exclusive with Extents.
+	Size string
+	// Extents to extend the logical volume to, or by with a leading "+", or as
+	// a percentage (eg. "+100%FREE"). Mutually exclusive with Size.
+	Extents string
+	// LVMPath is the path of the lvm binary (by default it's found by the
+	// client, as with the e2fsprogs binaries).
+	LVMPath string
+}
+
+// Validate checks the options for extending a logical volume.
+func (opts ExtendOptions) Validate() error {
+	if (opts.Size == "") == (opts.Extents == "") {
+		return fmt.Errorf("%w: exactly one of size or extents is required", ext4.ErrInvalidOptions)
+	}
+	if strings.HasPrefix(opts.Size, "-") || strings.HasPrefix(opts.Extents, "-") {
+		return fmt.Errorf("%w: logical volumes can only be extended", ext4.ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+// CreateLV creates a logical volume, returning the path of its device. lvm is
+// run with the client (eg. with its executor, and subject to dry-run mode).
+func CreateLV(ctx context.Context, c ext4.FilesystemManager, opts LVOptions) (string, error) {
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+
+	// Don't prompt, and wipe any stale signatures left in the extents.
+	args := []string{"lvcreate", "--yes", "--wipesignatures", "y", "--name", opts.Name}
+	if opts.Size != "" {
+		args = append(args, "--size", opts.Size)
+	} else {
+		args = append(args, "--extents", opts.Extents)
+	}
+	for _, tag := range opts.Tags {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, opts.VolumeGroup)
+
+	if _, err := run(ctx, c, opts.LVMPath, false, args...); err != nil {
+		return "", fmt.Errorf("failed to create logical volume %s/%s: %w", opts.VolumeGroup, opts.Name, err)
+	}
+
+	return volumePath(ctx, c, opts.LVMPath, opts.VolumeGroup+"/"+opts.Name)
+}
+
+// RemoveLV removes a logical volume, destroying its contents. If lvmPath
+// is empty, lvm is found by the client.
+func RemoveLV(ctx context.Context, c ext4.FilesystemManager, device, lvmPath string) error {
+	if _, err := run(ctx, c, lvmPath, false, "lvremove", "--yes", device); err != nil {
+		return fmt.Errorf("failed to remove logical volume %s: %w", device, err)
+	}
+
+	return nil
+}
+
+// ProvisionOptions provides options for provisioning an ext4 filesystem on a
+// new logical volume.
+type ProvisionOptions struct {
+	// Volume holds options for creating the logical volume.
+	Volume LVOptions
+	// Filesystem holds options for creating the ext4 filesystem. The device
+	// is set to the logical volume.
+	Filesystem ext4.CreateOptions
+}
+
+// Volume is a provisioned logical volume.
+type Volume struct {
+	// Device is the path of the logical volume.
+	Device string
+	// Filesystem describes the ext4 filesystem on the logical volume.
+	Filesystem *ext4.CreatedFilesystem
+}
+
+// Provision creates a logical volume, and an ext4 filesystem on it. If the
+// filesystem can't be created, the logical volume is removed. lvm is run with
+// c, as with the ext4 commands.
+func Provision(ctx context.Context, c ext4.FilesystemManager, opts ProvisionOptions) (*Volume, error) {
+	if opts.Filesystem.Device != "" {
+		return nil, fmt.Errorf("%w: filesystem device is set by the provisioner", ext4.ErrInvalidOptions)
+	}
+
+	if err := opts.Volume.Validate(); err != nil {
+		return nil, err
+	}
+
+	fsOpts := opts.Filesystem
+	fsOpts.Device = "/dev/" + opts.Volume.VolumeGroup + "/" + opts.Volume.Name
+	if err := fsOpts.Validate(); err != nil {
+		return nil, err
+	}
+
+	device, err := CreateLV(ctx, c, opts.Volume)
+	if err != nil {
+		return nil, err
+	}
+
+	fsOpts.Device = device
+	fs, err := c.CreateFilesystem(ctx, fsOpts)
+	if err != nil {
+		_ = RemoveLV(context.Background(), c, device, opts.Volume.LVMPath)
+		return nil, fmt.Errorf("failed to create filesystem: %w", err)
+	}
+
+	return &Volume{
+		Device:     device,
+		Filesystem: fs,
+	}, nil
+}
+
+// ExtendLVAndFilesystem extends a logical volume, then grows the ext4
+// filesystem on it to fill the new space (online, if it is mounted).
+func ExtendLVAndFilesystem(ctx context.Context, c ext4.FilesystemManager, device string, opts ExtendOptions) (*ext4.ResizeResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Make sure there is a filesystem to grow, before touching the volume.
+	if _, err := c.VerifyExt4(ctx, device); err != nil {
+		return nil, err
+	}
+
+	args := []string{"lvextend"}
+	if opts.Size != "" {
+		args = append(args, "--size", opts.Size)
+	} else {
+		args = append(args, "--extents", opts.Extents)
+	}
+	args = append(args, device)
+
+	if _, err := run(ctx, c, opts.LVMPath, false, args...); err != nil {
+		return nil, fmt.Errorf("failed to extend logical volume %s: %w", device, err)
+	}
+
+	result, err := c.GrowToFillDevice(ctx, device)
+	if err != nil {
+		return nil, fmt.Errorf("extended logical volume %s, but failed to grow filesystem: %w", device, err)
+	}
+
+	return result, nil
+}
+
+// volumePath returns the device path of a logical volume (eg. "vg/lv").
+func volumePath(ctx context.Context, c ext4.FilesystemManager, lvmPath, volume string) (string, error) {
+	out, err := run(ctx, c, lvmPath, true, "lvs", "--noheadings", "--options", "lv_path", volume)
+	if err != nil {
+		return "", fmt.Errorf("failed to find logical volume %s: %w", volume, err)
+	}
+
+	path := strings.TrimSpace(string(out))
+	if path == "" {
+		return "", fmt.Errorf("logical volume %s has no device path", volume)
+	}
+
+	return path, nil
+}
+
+// validName returns true if name is a valid volume group or logical volume
+// name.
+func validName(name string) bool {
+	return nameRegexp.MatchString(name) && name != "." && name != ".." && len(name) <= 127
+}
+
+// run runs an lvm command (eg. lvcreate) with the client, returning its
+// output. Read-only commands are still run in dry-run mode.
+func run(ctx context.Context, c ext4.FilesystemManager, lvmPath string, readOnly bool, args ...string) ([]byte, error) {
+	return c.RunCommand(ctx, "lvm", args, ext4.RunOptions{
+		Path:     lvmPath,
+		ReadOnly: readOnly,
+	})
+}
@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lvm_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/lvm"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLVM is a stand-in for the lvm binary, that backs logical volumes with
+// image files in a directory.
+const fakeLVM = `#!/bin/sh
+set -e
+cmd=$1; shift
+size=
+for arg; do
+	case $prev in
+	--size) size=$arg ;;
+	--name) name=$arg ;;
+	esac
+	prev=$arg
+	last=$arg
+done
+case $cmd in
+lvcreate) truncate -s "$size" "%[1]s/$last-$name" ;;
+lvs) echo "  %[1]s/$(echo "$last" | tr / -)" ;;
+lvextend) truncate -s "$size" "$last" ;;
+lvremove) rm "$last" ;;
+*) exit 3 ;;
+esac
+`
+
+func TestProvision(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	lvDir := t.TempDir()
+	lvmPath := filepath.Join(t.TempDir(), "lvm")
+	require.NoError(t, os.WriteFile(lvmPath, []byte(fmt.Sprintf(fakeLVM, lvDir)), 0o755))
+
+	vol, err := lvm.Provision(ctx, c, lvm.ProvisionOptions{
+		Volume: lvm.LVOptions{
+			VolumeGroup: "vg0",
+			Name:        "data",
+			Size:        "32M",
+			LVMPath:     lvmPath,
+		},
+		Filesystem: ext4.CreateOptions{Label: "data"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(lvDir, "vg0-data"), vol.Device)
+
+	sb, err := c.ReadSuperblock(ctx, vol.Device)
+	require.NoError(t, err)
+	require.Equal(t, "data", sb.Label)
+	require.Equal(t, vol.Filesystem.UUID, sb.UUID)
+
+	t.Log("Extending the logical volume and filesystem")
+
+	result, err := lvm.ExtendLVAndFilesystem(ctx, c, vol.Device, lvm.ExtendOptions{
+		Size:    "+32M",
+		LVMPath: lvmPath,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2*result.OldBlockCount, result.NewBlockCount)
+
+	t.Log("Removing the logical volume")
+
+	require.NoError(t, lvm.RemoveLV(ctx, c, vol.Device, lvmPath))
+	require.NoFileExists(t, vol.Device)
+
+	t.Log("Provisioning a filesystem that can't be created")
+
+	_, err = lvm.Provision(ctx, c, lvm.ProvisionOptions{
+		Volume: lvm.LVOptions{
+			VolumeGroup: "vg0",
+			Name:        "tiny",
+			Size:        "4k",
+			LVMPath:     lvmPath,
+		},
+	})
+	require.Error(t, err)
+	require.NoFileExists(t, filepath.Join(lvDir, "vg0-tiny"), "logical volume not removed")
+}
+
+func TestProvisionDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient(ext4.WithDryRun())
+
+	lvDir := t.TempDir()
+	lvmPath := filepath.Join(t.TempDir(), "lvm")
+	require.NoError(t, os.WriteFile(lvmPath, []byte(fmt.Sprintf(fakeLVM, lvDir)), 0o755))
+
+	_, err := lvm.Provision(ctx, c, lvm.ProvisionOptions{
+		Volume: lvm.LVOptions{
+			VolumeGroup: "vg0",
+			Name:        "data",
+			Size:        "32M",
+			LVMPath:     lvmPath,
+		},
+	})
+
+	var dryRunErr *ext4.DryRunError
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, lvmPath, dryRunErr.Argv[0])
+	require.Equal(t, "lvcreate", dryRunErr.Argv[1])
+	require.NoFileExists(t, filepath.Join(lvDir, "vg0-data"))
+}
+
+func TestInvalidOptions(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	tests := map[string]lvm.LVOptions{
+		"no volume group":    {Name: "data", Size: "1G"},
+		"bad name":           {VolumeGroup: "vg0", Name: "-data", Size: "1G"},
+		"no size":            {VolumeGroup: "vg0", Name: "data"},
+		"size and extents":   {VolumeGroup: "vg0", Name: "data", Size: "1G", Extents: "100%FREE"},
+		"slash in name":      {VolumeGroup: "vg0", Name: "a/b", Size: "1G"},
+		"slash in the group": {VolumeGroup: "vg0/x", Name: "data", Size: "1G"},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := lvm.Provision(ctx, c, lvm.ProvisionOptions{Volume: opts})
+			require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+		})
+	}
+
+	t.Run("shrink", func(t *testing.T) {
+		_, err := lvm.ExtendLVAndFilesystem(ctx, c, "/dev/vg0/data", lvm.ExtendOptions{Size: "-1G"})
+		require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+	})
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"io"
+)
+
+// FilesystemManager is the set of operations provided by a Client. It allows
+// consumers to substitute a fake implementation in their unit tests (eg.
+// fakeext4.Client).
+type FilesystemManager interface {
+	// CreateFilesystem creates an ext4 filesystem.
+	CreateFilesystem(ctx context.Context, opts CreateOptions) (*CreatedFilesystem, error)
+	// CreateImage creates a sparse image file and formats it with an ext4
+	// filesystem.
+	CreateImage(ctx context.Context, path string, size int64, opts CreateOptions) (*CreatedFilesystem, error)
+	// CompactImage shrinks the filesystem in an image file to its minimum
+	// size, and truncates the file to match.
+	CompactImage(ctx context.Context, imagePath string) (*ResizeResult, error)
+	// SparsifyImage punches holes in an image file over the unallocated
+	// blocks of its filesystem.
+	SparsifyImage(ctx context.Context, imagePath string) (uint64, error)
+	// CreateFilesystemFromTar creates an ext4 filesystem populated with the
+	// contents of a tar stream.
+	CreateFilesystemFromTar(ctx context.Context, device string, r io.Reader, opts CreateOptions) (*CreatedFilesystem, error)
+	// CloneFilesystem copies an ext4 filesystem, giving the clone a new UUID.
+	CloneFilesystem(ctx context.Context, src, dst string) (*SuperblockInfo, error)
+	// ConvertToExt4 upgrades an ext2 or ext3 filesystem to ext4.
+	ConvertToExt4(ctx context.Context, device string, opts ConvertOptions) (*SuperblockInfo, error)
+	// EnableQuotas enables quota tracking on an unmounted filesystem.
+	EnableQuotas(ctx context.Context, device string, types ...QuotaType) (*SuperblockInfo, error)
+	// DisableQuotas disables quota tracking on an unmounted filesystem.
+	DisableQuotas(ctx context.Context, device string, types ...QuotaType) (*SuperblockInfo, error)
+	// QuotaCheck creates quota files for a mounted filesystem using legacy
+	// quota files.
+	QuotaCheck(ctx context.Context, mountPoint string, types ...QuotaType) error
+	// EnableEncryption enables the encrypt feature, for use with fscrypt.
+	EnableEncryption(ctx context.Context, device string) (*SuperblockInfo, error)
+	// EnableVerity enables the verity feature, for use with fs-verity.
+	EnableVerity(ctx context.Context, device string) (*SuperblockInfo, error)
+	// RegenerateUUID gives a filesystem a new random UUID.
+	RegenerateUUID(ctx context.Context, device string) (string, error)
+	// SetUUID sets the UUID of a filesystem.
+	SetUUID(ctx context.Context, device string, uuid UUID) (string, error)
+	// SetLabel sets the volume label of a filesystem.
+	SetLabel(ctx context.Context, device, label string, policy LabelPolicy) (string, error)
+	// EnableChecksumSeed enables the metadata_csum_seed feature, decoupling
+	// metadata checksums from the UUID.
+	EnableChecksumSeed(ctx context.Context, device string) (*SuperblockInfo, error)
+	// DisableChecksumSeed disables the metadata_csum_seed feature on an
+	// unmounted filesystem.
+	DisableChecksumSeed(ctx context.Context, device string) (*SuperblockInfo, error)
+	// ResizeFilesystem resizes an ext4 filesystem.
+	ResizeFilesystem(ctx context.Context, opts ResizeOptions) (*ResizeResult, error)
+	// GrowToFillDevice resizes an ext4 filesystem to use all of the space
+	// available on its underlying device.
+	GrowToFillDevice(ctx context.Context, device string) (*ResizeResult, error)
+	// GrowPartitionAndFilesystem expands a partition to the end of the disk,
+	// and grows the ext4 filesystem on it to fill the partition.
+	GrowPartitionAndFilesystem(ctx context.Context, disk string, partitionNumber int) (*ResizeResult, error)
+	// SafeShrink checks an ext4 filesystem, then shrinks it (with an undo
+	// file) to the target size.
+	SafeShrink(ctx context.Context, device string, targetSize int64, opts SafetyOptions) (*ResizeResult, error)
+	// EstimateShrink estimates how small a filesystem could be shrunk.
+	EstimateShrink(ctx context.Context, device string, opts ShrinkEstimateOptions) (*ShrinkEstimate, error)
+	// WipeDevice destroys the contents of a block device, eg. before it is
+	// formatted.
+	WipeDevice(ctx context.Context, device string, opts WipeOptions) error
+	// CheckFilesystem checks (and optionally repairs) an ext4 filesystem.
+	CheckFilesystem(ctx context.Context, opts CheckOptions) (*CheckResult, error)
+
+	// Mount an ext4 filesystem on a block device at the target directory.
+	Mount(ctx context.Context, device, target string, opts MountOptions) error
+	// Unmount the filesystem mounted at the target directory.
+	Unmount(ctx context.Context, target string, opts UnmountOptions) error
+	// IsMounted returns true if the filesystem on a device is mounted.
+	IsMounted(ctx context.Context, device string) (bool, error)
+	// Trim discards the unused blocks of a mounted filesystem.
+	Trim(ctx context.Context, mountPoint string, opts TrimOptions) (uint64, error)
+
+	// VerifyExt4 checks that a device contains an ext4 filesystem.
+	VerifyExt4(ctx context.Context, device string) (*SuperblockInfo, error)
+	// HealthSummary assesses the health of a filesystem.
+	HealthSummary(ctx context.Context, device string) (*FilesystemHealth, error)
+	// ReadSuperblock returns the superblock information of an ext4 filesystem.
+	ReadSuperblock(ctx context.Context, device string) (*SuperblockInfo, error)
+	// ListBlockGroups returns the block groups of an ext4 filesystem.
+	ListBlockGroups(ctx context.Context, device string) ([]BlockGroup, error)
+	// ListBadBlocks returns the bad blocks recorded in an ext4 filesystem.
+	ListBadBlocks(ctx context.Context, device string) ([]uint64, error)
+	// DumpJournal parses the journal of an unmounted ext4 filesystem.
+	DumpJournal(ctx context.Context, device string) (*Journal, error)
+	// FindFilesUsingBlocks maps filesystem blocks to the inodes, and path
+	// names, using them.
+	FindFilesUsingBlocks(ctx context.Context, device string, blocks []uint64) ([]BlockOwner, error)
+
+	// ExportTar writes the contents of an unmounted ext4 filesystem to w as a
+	// tar stream.
+	ExportTar(ctx context.Context, device string, w io.Writer) error
+	// ExtractDirectory recursively copies a directory tree out of an
+	// unmounted ext4 filesystem onto the host filesystem.
+	ExtractDirectory(ctx context.Context, device, srcPath, destDir string) error
+	// WriteFileToImage copies a file from the host into an unmounted ext4
+	// filesystem.
+	WriteFileToImage(ctx context.Context, device, hostPath, imagePath string) error
+	// MakeDirectoryInImage creates a directory in an unmounted ext4
+	// filesystem. If the directory already exists, the error wraps
+	// fs.ErrExist.
+	MakeDirectoryInImage(ctx context.Context, device, imagePath string) error
+	// SymlinkInImage creates a symbolic link in an unmounted ext4 filesystem.
+	SymlinkInImage(ctx context.Context, device, target, imagePath string) error
+	// RemoveFromImage removes a file, symbolic link, or empty directory from
+	// an unmounted ext4 filesystem. If it doesn't exist, the error wraps
+	// fs.ErrNotExist.
+	RemoveFromImage(ctx context.Context, device, imagePath string) error
+
+	// RunCommand runs a command other than those of e2fsprogs (eg.
+	// cryptsetup), in the same way as the e2fsprogs commands.
+	RunCommand(ctx context.Context, name string, args []string, opts RunOptions) ([]byte, error)
+}
+
+var _ FilesystemManager = (*Client)(nil)
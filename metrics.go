@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the Prometheus collectors updated by a client.
+type metrics struct {
+	operations *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+	failures   *prometheus.CounterVec
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	var m metrics
+	var err error
+
+	m.operations, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ext4",
+		Name:      "operations_total",
+		Help:      "Total number of commands executed, by tool.",
+	}, []string{"tool"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.durations, err = register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ext4",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of executed commands, by tool.",
+		// Commands range from milliseconds (dumpe2fs) to hours (e2fsck), the
+		// largest bucket is about 11.6 hours.
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 12),
+	}, []string{"tool"}))
+	if err != nil {
+		return nil, err
+	}
+
+	m.failures, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ext4",
+		Name:      "operation_failures_total",
+		Help:      "Total number of failed commands, by tool and exit code.",
+	}, []string{"tool", "exit_code"}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// register registers the collector, reusing an identical collector if one has
+// already been registered (eg. by another client sharing the registry).
+func register[T prometheus.Collector](reg prometheus.Registerer, collector T) (T, error) {
+	if err := reg.Register(collector); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return collector, fmt.Errorf("failed to register metrics: %w", err)
+	}
+
+	return collector, nil
+}
+
+// observe records the outcome of a command.
+func (m *metrics) observe(cmdName string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.operations.WithLabelValues(cmdName).Inc()
+	m.durations.WithLabelValues(cmdName).Observe(duration.Seconds())
+	if err != nil {
+		m.failures.WithLabelValues(cmdName, strconv.Itoa(exitCode(err))).Inc()
+	}
+}
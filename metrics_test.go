@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMetricsRegistry(t *testing.T) {
+	ctx := context.Background()
+
+	reg := prometheus.NewRegistry()
+
+	c := ext4.NewClient(ext4.WithMetricsRegistry(reg))
+
+	imagePath := createTestImage(t, c, "")
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	// Clients may share a registry.
+	c = ext4.NewClient(ext4.WithMetricsRegistry(reg))
+
+	_, err = c.ReadSuperblock(ctx, filepath.Join(t.TempDir(), "missing.img"))
+	require.Error(t, err)
+
+	expected := `
+# HELP ext4_operation_failures_total Total number of failed commands, by tool and exit code.
+# TYPE ext4_operation_failures_total counter
+ext4_operation_failures_total{exit_code="2",tool="dumpe2fs"} 1
+# HELP ext4_operations_total Total number of commands executed, by tool.
+# TYPE ext4_operations_total counter
+ext4_operations_total{tool="dumpe2fs"} 2
+ext4_operations_total{tool="mke2fs"} 1
+`
+	err = testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"ext4_operations_total", "ext4_operation_failures_total")
+	require.NoError(t, err)
+
+	count, err := testutil.GatherAndCount(reg, "ext4_operation_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	t.Log("Registering metrics that conflict with existing collectors")
+
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ext4",
+		Name:      "operations_total",
+		Help:      "Not a counter.",
+	}))
+
+	c = ext4.NewClient(ext4.WithMetricsRegistry(reg))
+
+	_, err = c.ReadSuperblock(ctx, imagePath)
+	require.ErrorContains(t, err, "failed to register metrics")
+}
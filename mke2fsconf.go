@@ -0,0 +1,272 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mke2fsConfigEnv is the environment variable mke2fs reads the location of
+// its configuration file from.
+const mke2fsConfigEnv = "MKE2FS_CONFIG"
+
+var mke2fsConfigNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Mke2fsConfig is the configuration of mke2fs (see mke2fs.conf(5)), which
+// provides the defaults for each filesystem and usage type.
+type Mke2fsConfig struct {
+	// Defaults are used unless overridden by a filesystem or usage type.
+	Defaults Mke2fsProfile
+	// FSTypes are the profiles of the filesystem types (eg. "ext4") and
+	// usage types (eg. "small") selected with -t and -T.
+	FSTypes map[string]Mke2fsProfile
+}
+
+// Mke2fsProfile are the tunables of the defaults, or of a filesystem or usage
+// type, in mke2fs.conf. Unset fields are omitted.
+type Mke2fsProfile struct {
+	// BaseFeatures are the features enabled for every filesystem.
+	BaseFeatures []string
+	// DefaultFeatures are the features enabled unless -O is given.
+	DefaultFeatures []string
+	// Features are enabled (or disabled, with a leading "^") in addition to
+	// the base and default features.
+	Features []string
+	// BlockSize in bytes (-1 chooses it based on the size of the filesystem).
+	BlockSize int
+	// InodeSize in bytes.
+	InodeSize int
+	// InodeRatio is the number of bytes per inode.
+	InodeRatio int
+	// ReservedRatio is the percentage of blocks reserved for the super-user.
+	ReservedRatio *float64
+	// FlexBGSize is the number of block groups packed into a flex_bg group.
+	FlexBGSize int
+	// HashAlg is the hash algorithm of indexed directories (eg. "half_md4").
+	HashAlg string
+	// DefaultMountOptions are stored in the superblock as the default mount
+	// options (eg. "acl", "user_xattr").
+	DefaultMountOptions []string
+	// ErrorBehavior is the kernel behavior when errors are detected.
+	ErrorBehavior ErrorBehavior
+	// LazyItableInit, if set, controls whether the inode tables are left
+	// uninitialized.
+	LazyItableInit *bool
+	// EnablePeriodicFsck, if set, controls whether the filesystem is checked
+	// periodically (based on the mount count and time).
+	EnablePeriodicFsck *bool
+	// Extra are additional tunables (eg. "cluster_size"), by name.
+	Extra map[string]string
+}
+
+// DefaultMke2fsConfig returns a configuration equivalent to the
+// mke2fs.conf shipped with upstream e2fsprogs (without features that older
+// releases don't support), so that filesystems are created the same way
+// regardless of the defaults of the host's distribution.
+func DefaultMke2fsConfig() *Mke2fsConfig {
+	reservedRatio := 5.0
+	periodicFsck := false
+
+	return &Mke2fsConfig{
+		Defaults: Mke2fsProfile{
+			BaseFeatures:        []string{"sparse_super", "large_file", "filetype", "resize_inode", "dir_index", "ext_attr"},
+			DefaultMountOptions: []string{"acl", "user_xattr"},
+			EnablePeriodicFsck:  &periodicFsck,
+			BlockSize:           4096,
+			InodeSize:           256,
+			InodeRatio:          16384,
+			ReservedRatio:       &reservedRatio,
+		},
+		FSTypes: map[string]Mke2fsProfile{
+			string(Ext3):            {Features: []string{"has_journal"}},
+			string(Ext4):            {Features: []string{"has_journal", "extent", "huge_file", "flex_bg", "metadata_csum", "64bit", "dir_nlink", "extra_isize"}},
+			string(UsageSmall):      {BlockSize: 1024, InodeRatio: 4096},
+			string(UsageFloppy):     {BlockSize: 1024, InodeRatio: 8192},
+			string(UsageBig):        {InodeRatio: 32768},
+			string(UsageHuge):       {InodeRatio: 65536},
+			string(UsageNews):       {InodeRatio: 4096},
+			string(UsageLargeFile):  {InodeRatio: 1 << 20, BlockSize: -1},
+			string(UsageLargeFile4): {InodeRatio: 4 << 20, BlockSize: -1},
+			string(UsageHurd):       {BlockSize: 4096, InodeSize: 128, Extra: map[string]string{"warn_y2038_dates": "0"}},
+		},
+	}
+}
+
+// Validate checks the configuration for obvious mistakes.
+func (cfg *Mke2fsConfig) Validate() error {
+	errs := []error{cfg.Defaults.validate("defaults")}
+	for name, profile := range cfg.FSTypes {
+		if !mke2fsConfigNameRegexp.MatchString(name) {
+			errs = append(errs, invalidOption("malformed mke2fs.conf type %q", name))
+		}
+		errs = append(errs, profile.validate(name))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p Mke2fsProfile) validate(name string) error {
+	var errs []error
+	if p.BlockSize != 0 && p.BlockSize != -1 && !validBlockSize(p.BlockSize) {
+		errs = append(errs, invalidOption("%s: invalid block size %d", name, p.BlockSize))
+	}
+	if p.InodeSize != 0 && (!isPowerOfTwo(p.InodeSize) || p.InodeSize < 128) {
+		errs = append(errs, invalidOption("%s: invalid inode size %d", name, p.InodeSize))
+	}
+	if p.InodeRatio < 0 {
+		errs = append(errs, invalidOption("%s: invalid inode ratio %d", name, p.InodeRatio))
+	}
+	if p.ReservedRatio != nil && (*p.ReservedRatio < 0 || *p.ReservedRatio > 50) {
+		errs = append(errs, invalidOption("%s: reserved ratio %g is out of range", name, *p.ReservedRatio))
+	}
+	if p.FlexBGSize != 0 && !isPowerOfTwo(p.FlexBGSize) {
+		errs = append(errs, invalidOption("%s: invalid flex_bg size %d", name, p.FlexBGSize))
+	}
+	if err := p.ErrorBehavior.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	for _, list := range [][]string{p.BaseFeatures, p.DefaultFeatures, p.Features, p.DefaultMountOptions} {
+		for _, value := range list {
+			if !mke2fsConfigNameRegexp.MatchString(strings.TrimPrefix(value, "^")) {
+				errs = append(errs, invalidOption("%s: malformed value %q", name, value))
+			}
+		}
+	}
+	for tunable, value := range p.Extra {
+		if !mke2fsConfigNameRegexp.MatchString(tunable) || strings.ContainsAny(value, "\n{}") {
+			errs = append(errs, invalidOption("%s: malformed tunable %s = %q", name, tunable, value))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// String returns the configuration in the syntax of mke2fs.conf.
+func (cfg *Mke2fsConfig) String() string {
+	var sb strings.Builder
+
+	sb.WriteString("[defaults]\n")
+	for _, line := range cfg.Defaults.tunables() {
+		sb.WriteString("\t" + line + "\n")
+	}
+
+	names := make([]string, 0, len(cfg.FSTypes))
+	for name := range cfg.FSTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb.WriteString("\n[fs_types]\n")
+	for _, name := range names {
+		sb.WriteString("\t" + name + " = {\n")
+		for _, line := range cfg.FSTypes[name].tunables() {
+			sb.WriteString("\t\t" + line + "\n")
+		}
+		sb.WriteString("\t}\n")
+	}
+
+	return sb.String()
+}
+
+// tunables returns the "name = value" lines of the profile.
+func (p Mke2fsProfile) tunables() []string {
+	var lines []string
+	addList := func(name string, values []string) {
+		if len(values) > 0 {
+			lines = append(lines, name+" = "+strings.Join(values, ","))
+		}
+	}
+	addInt := func(name string, value int) {
+		if value != 0 {
+			lines = append(lines, name+" = "+strconv.Itoa(value))
+		}
+	}
+	addBool := func(name string, value *bool) {
+		if value != nil {
+			lines = append(lines, name+" = "+boolOption(*value))
+		}
+	}
+
+	addList("base_features", p.BaseFeatures)
+	addList("default_features", p.DefaultFeatures)
+	addList("features", p.Features)
+	addInt("blocksize", p.BlockSize)
+	addInt("inode_size", p.InodeSize)
+	addInt("inode_ratio", p.InodeRatio)
+	if p.ReservedRatio != nil {
+		lines = append(lines, "reserved_ratio = "+strconv.FormatFloat(*p.ReservedRatio, 'f', -1, 64))
+	}
+	addInt("flex_bg_size", p.FlexBGSize)
+	if p.HashAlg != "" {
+		lines = append(lines, "hash_alg = "+p.HashAlg)
+	}
+	addList("default_mntopts", p.DefaultMountOptions)
+	if p.ErrorBehavior != "" {
+		lines = append(lines, "errors = "+string(p.ErrorBehavior))
+	}
+	addBool("lazy_itable_init", p.LazyItableInit)
+	addBool("enable_periodic_fsck", p.EnablePeriodicFsck)
+
+	extra := make([]string, 0, len(p.Extra))
+	for name := range p.Extra {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		lines = append(lines, name+" = "+p.Extra[name])
+	}
+
+	return lines
+}
+
+// hasFSType returns true if the configuration defines the filesystem or usage
+// type.
+func (cfg *Mke2fsConfig) hasFSType(name string) bool {
+	_, ok := cfg.FSTypes[name]
+	return ok
+}
+
+// writeMke2fsConfig writes the configuration to a temporary file on the local
+// host (within the chroot, if configured), returning the path of the file as
+// seen by mke2fs, and a function that removes it.
+func (c *Client) writeMke2fsConfig(cfg *Mke2fsConfig) (string, func(), error) {
+	f, err := os.CreateTemp(filepath.Join(c.chroot, os.TempDir()), "mke2fs-*.conf")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create mke2fs.conf: %w", err)
+	}
+	remove := func() { _ = os.Remove(f.Name()) }
+
+	if _, err := f.WriteString(cfg.String()); err != nil {
+		_ = f.Close()
+		remove()
+		return "", nil, fmt.Errorf("failed to write mke2fs.conf: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to write mke2fs.conf: %w", err)
+	}
+
+	return filepath.Join(os.TempDir(), filepath.Base(f.Name())), remove, nil
+}
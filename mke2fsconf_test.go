@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMke2fsConfig(t *testing.T) {
+	lazy := false
+
+	cfg := &ext4.Mke2fsConfig{
+		Defaults: ext4.Mke2fsProfile{
+			BaseFeatures: []string{"sparse_super", "filetype"},
+			BlockSize:    4096,
+		},
+		FSTypes: map[string]ext4.Mke2fsProfile{
+			"ext4":   {Features: []string{"has_journal", "extent", "^64bit"}, LazyItableInit: &lazy},
+			"images": {InodeRatio: 65536, Extra: map[string]string{"cluster_size": "16384"}},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, `[defaults]
+	base_features = sparse_super,filetype
+	blocksize = 4096
+
+[fs_types]
+	ext4 = {
+		features = has_journal,extent,^64bit
+		lazy_itable_init = 0
+	}
+	images = {
+		inode_ratio = 65536
+		cluster_size = 16384
+	}
+`, cfg.String())
+
+	for name, cfg := range map[string]*ext4.Mke2fsConfig{
+		"block size": {Defaults: ext4.Mke2fsProfile{BlockSize: 3000}},
+		"type name":  {FSTypes: map[string]ext4.Mke2fsProfile{"ext4 = {": {}}},
+		"feature":    {FSTypes: map[string]ext4.Mke2fsProfile{"ext4": {Features: []string{"extent\n"}}}},
+		"tunable":    {FSTypes: map[string]ext4.Mke2fsProfile{"ext4": {Extra: map[string]string{"hash_alg": "}"}}}},
+	} {
+		require.ErrorIs(t, cfg.Validate(), ext4.ErrInvalidOptions, name)
+	}
+
+	t.Log("Creating a filesystem with the default configuration")
+
+	ctx := context.Background()
+
+	// An environment that would otherwise break mke2fs.
+	c := ext4.NewClient(ext4.WithEnvironment(map[string]string{"MKE2FS_CONFIG": "/nonexistent"}))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+		Config: ext4.DefaultMke2fsConfig(),
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	// Filesystems smaller than 512 MiB use the small usage type.
+	require.Equal(t, 1024, sb.BlockSize)
+	require.Contains(t, sb.Features, "metadata_csum")
+	require.NotContains(t, sb.Features, "orphan_file")
+
+	t.Log("Creating a filesystem with a custom usage type")
+
+	cfg = ext4.DefaultMke2fsConfig()
+	cfg.FSTypes["images"] = ext4.Mke2fsProfile{InodeRatio: 1 << 20}
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		Size:      64 * ext4.MiB,
+		UsageType: "images",
+		Config:    cfg,
+	})
+	require.NoError(t, err)
+
+	sb, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(64), sb.InodeCount)
+
+	delete(cfg.FSTypes, "ext4")
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Config: cfg,
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
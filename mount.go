@@ -0,0 +1,209 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DataMode is the journaling mode used for file data.
+type DataMode string
+
+const (
+	// DataOrdered writes data to the filesystem before its metadata is
+	// committed to the journal (the default).
+	DataOrdered DataMode = "ordered"
+	// DataJournal commits all data to the journal before it is written to
+	// the filesystem.
+	DataJournal DataMode = "journal"
+	// DataWriteback does not order data writes with respect to the journal.
+	DataWriteback DataMode = "writeback"
+)
+
+// MountOptions provides options for mounting an ext4 filesystem.
+type MountOptions struct {
+	// ReadOnly mounts the filesystem read-only.
+	ReadOnly bool
+	// NoExec disallows executing binaries on the filesystem.
+	NoExec bool
+	// NoSuid ignores setuid and setgid bits.
+	NoSuid bool
+	// NoDev disallows access to device nodes on the filesystem.
+	NoDev bool
+	// NoAtime disables updating access times.
+	NoAtime bool
+	// Sync performs all I/O synchronously.
+	Sync bool
+	// DataMode is the journaling mode for file data.
+	DataMode DataMode
+	// Commit is how often data and metadata are synced to disk (rounded up to
+	// whole seconds).
+	Commit time.Duration
+	// ErrorBehavior is the kernel behavior when errors are detected.
+	ErrorBehavior ErrorBehavior
+	// Discard issues discard/TRIM commands as blocks are freed.
+	Discard bool
+	// NoLoad skips loading the journal (eg. to mount a filesystem with a
+	// corrupt journal read-only).
+	NoLoad bool
+	// Extra are additional filesystem specific (data) mount options.
+	Extra []string
+}
+
+// data returns the filesystem specific mount options, as passed to mount(2).
+func (opts MountOptions) data() string {
+	var data []string
+	if opts.DataMode != "" {
+		data = append(data, "data="+string(opts.DataMode))
+	}
+	if opts.Commit > 0 {
+		commit := opts.Commit / time.Second
+		if opts.Commit%time.Second != 0 {
+			commit++
+		}
+		data = append(data, "commit="+strconv.FormatInt(int64(commit), 10))
+	}
+	if opts.ErrorBehavior != "" {
+		data = append(data, "errors="+string(opts.ErrorBehavior))
+	}
+	if opts.Discard {
+		data = append(data, "discard")
+	}
+	if opts.NoLoad {
+		data = append(data, "noload")
+	}
+	data = append(data, opts.Extra...)
+
+	return strings.Join(data, ",")
+}
+
+// UnmountOptions provides options for unmounting a filesystem.
+type UnmountOptions struct {
+	// Force unmounting, even if busy (may cause data loss).
+	Force bool
+	// Lazy detaches the filesystem immediately, cleaning up once it is no
+	// longer busy.
+	Lazy bool
+}
+
+// Mount an ext4 filesystem on a block device at the target directory, using
+// the mount(2) system call (which requires CAP_SYS_ADMIN). Image files must be
+// attached to a loop device first. Commands are not involved, so the executor
+// (and chroot) are not used.
+func (c *Client) Mount(ctx context.Context, device, target string, opts MountOptions) (err error) {
+	_, span := c.startSpan(ctx, "Mount", device)
+	defer endSpan(span, &err)
+
+	if err := opts.ErrorBehavior.Validate(); err != nil {
+		return err
+	}
+
+	if err := mount(device, target, opts); err != nil {
+		// The kernel only logs why it refused to mount the filesystem.
+		if !KernelSupportsCasefold() && hasCasefold(device) {
+			return fmt.Errorf("%w: %w", ErrCasefoldUnsupported, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Unmount the filesystem mounted at the target directory, using the
+// umount2(2) system call.
+func (c *Client) Unmount(ctx context.Context, target string, opts UnmountOptions) (err error) {
+	_, span := c.startSpan(ctx, "Unmount", target)
+	defer endSpan(span, &err)
+
+	return unmount(target, opts)
+}
+
+// IsMounted returns true if the filesystem on a block device, or image file
+// (via a loop device), is currently mounted. The device is examined on the
+// local host (within the chroot, if configured). Linux only.
+func (c *Client) IsMounted(ctx context.Context, device string) (_ bool, err error) {
+	_, span := c.startSpan(ctx, "IsMounted", device)
+	defer endSpan(span, &err)
+
+	mountPoint, err := findMountPoint(filepath.Join(c.chroot, device))
+	if err != nil {
+		return false, fmt.Errorf("failed to determine if %s is mounted: %w", device, err)
+	}
+
+	return mountPoint != "", nil
+}
+
+// mountPoint returns where the filesystem on a device is mounted (or "" if it
+// isn't mounted). Mounts can only be detected on the local host, so for other
+// executors (and platforms) devices are assumed to be unmounted.
+func (c *Client) mountPoint(device string) (string, error) {
+	if _, local := c.executor.(*LocalExecutor); !local {
+		return "", nil
+	}
+
+	mountPoint, err := findMountPoint(filepath.Join(c.chroot, device))
+	if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to determine if %s is mounted: %w", device, err)
+	}
+
+	return mountPoint, nil
+}
+
+// mountedError is returned when a device that must be unmounted is mounted.
+type mountedError struct {
+	device     string
+	mountPoint string
+}
+
+func (e *mountedError) Error() string {
+	return fmt.Sprintf("%s is mounted at %s, unmount it first", e.device, e.mountPoint)
+}
+
+// checkUnmounted returns a *mountedError if the device is mounted (see
+// mountPoint).
+func (c *Client) checkUnmounted(device string) error {
+	mountPoint, err := c.mountPoint(device)
+	if err != nil {
+		return err
+	}
+	if mountPoint != "" {
+		return &mountedError{device: device, mountPoint: mountPoint}
+	}
+
+	return nil
+}
+
+// requireUnmounted checks that a device isn't mounted (see checkUnmounted),
+// then locks it for an offline operation. The caller must call the returned
+// function to unlock it.
+func (c *Client) requireUnmounted(ctx context.Context, device string) (func(), error) {
+	if err := c.checkUnmounted(device); err != nil {
+		return nil, err
+	}
+
+	return c.lockDevice(ctx, device)
+}
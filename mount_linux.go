@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func mount(device, target string, opts MountOptions) error {
+	var flags uintptr
+	if opts.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	if opts.NoExec {
+		flags |= syscall.MS_NOEXEC
+	}
+	if opts.NoSuid {
+		flags |= syscall.MS_NOSUID
+	}
+	if opts.NoDev {
+		flags |= syscall.MS_NODEV
+	}
+	if opts.NoAtime {
+		flags |= syscall.MS_NOATIME
+	}
+	if opts.Sync {
+		flags |= syscall.MS_SYNCHRONOUS
+	}
+
+	if err := syscall.Mount(device, target, "ext4", flags, opts.data()); err != nil {
+		return fmt.Errorf("failed to mount %s at %s: %w", device, target, err)
+	}
+
+	return nil
+}
+
+func unmount(target string, opts UnmountOptions) error {
+	var flags int
+	if opts.Force {
+		flags |= syscall.MNT_FORCE
+	}
+	if opts.Lazy {
+		flags |= syscall.MNT_DETACH
+	}
+
+	if err := syscall.Unmount(target, flags); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// findMountPoint returns where the filesystem on a block device, or on a loop
+// device backed by an image file, is mounted (or "" if it isn't mounted).
+func findMountPoint(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	devices := make(map[string]bool)
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		devices[fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))] = true
+	case syscall.S_IFREG:
+		loopDevices, err := findLoopDevices(path)
+		if err != nil {
+			return "", err
+		}
+		for _, dev := range loopDevices {
+			devices[dev] = true
+		}
+	}
+
+	if len(devices) == 0 {
+		return "", nil
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Each line is of the form:
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && devices[fields[2]] {
+			return unescapeMountPath(fields[4]), nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// findLoopDevices returns the device numbers ("major:minor") of the loop
+// devices backed by the given file.
+func findLoopDevices(path string) ([]string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, backingFile := range backingFiles {
+		backingPath, err := os.ReadFile(backingFile)
+		if err != nil {
+			// The loop device was probably detached.
+			continue
+		}
+
+		// Compare by inode, as the backing path may be non-canonical.
+		var backingSt syscall.Stat_t
+		if err := syscall.Stat(strings.TrimSpace(string(backingPath)), &backingSt); err != nil ||
+			backingSt.Dev != st.Dev || backingSt.Ino != st.Ino {
+			continue
+		}
+
+		dev, err := os.ReadFile(filepath.Join(filepath.Dir(filepath.Dir(backingFile)), "dev"))
+		if err != nil {
+			continue
+		}
+
+		devices = append(devices, strings.TrimSpace(string(dev)))
+	}
+
+	return devices, nil
+}
+
+// unescapeMountPath decodes the octal escapes (eg. "\040" for a space) used
+// for special characters in /proc/self/mountinfo.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(path[i])
+	}
+
+	return sb.String()
+}
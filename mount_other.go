@@ -0,0 +1,34 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import "errors"
+
+func mount(_, _ string, _ MountOptions) error {
+	return errors.New("mounting is not supported on this platform")
+}
+
+func unmount(_ string, _ UnmountOptions) error {
+	return errors.New("unmounting is not supported on this platform")
+}
+
+func findMountPoint(_ string) (string, error) {
+	return "", errors.ErrUnsupported
+}
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	mountPath := t.TempDir()
+
+	err = c.Mount(ctx, devPath, mountPath, ext4.MountOptions{
+		ReadOnly: true,
+		NoExec:   true,
+		DataMode: ext4.DataJournal,
+		// Rounded up to whole seconds.
+		Commit: 1500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	mounts, err := os.ReadFile("/proc/self/mounts")
+	require.NoError(t, err)
+
+	var mountLine string
+	for _, line := range strings.Split(string(mounts), "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 && fields[1] == mountPath {
+			mountLine = line
+		}
+	}
+	require.NotEmpty(t, mountLine, "filesystem not mounted")
+	require.Contains(t, mountLine, "ro,")
+	require.Contains(t, mountLine, "noexec")
+	require.Contains(t, mountLine, "data=journal")
+	require.Contains(t, mountLine, "commit=2")
+
+	err = os.WriteFile(filepath.Join(mountPath, "test.txt"), []byte("hello"), 0o644)
+	require.Error(t, err, "expected read-only filesystem")
+
+	require.NoError(t, c.Unmount(ctx, mountPath, ext4.UnmountOptions{}))
+
+	t.Log("Unmounting a filesystem that isn't mounted")
+
+	require.Error(t, c.Unmount(ctx, mountPath, ext4.UnmountOptions{}))
+}
+
+func TestIsMounted(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   32 * ext4.MiB,
+	})
+	require.NoError(t, err)
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	mounted, err := c.IsMounted(ctx, devPath)
+	require.NoError(t, err)
+	require.False(t, mounted)
+
+	mountPath := t.TempDir()
+	require.NoError(t, c.Mount(ctx, devPath, mountPath, ext4.MountOptions{}))
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	mounted, err = c.IsMounted(ctx, devPath)
+	require.NoError(t, err)
+	require.True(t, mounted)
+
+	t.Log("Checking the backing image file")
+
+	mounted, err = c.IsMounted(ctx, imagePath)
+	require.NoError(t, err)
+	require.True(t, mounted)
+
+	t.Log("Shrinking the mounted filesystem")
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: devPath,
+		Size:   16 * ext4.MiB,
+	})
+	require.ErrorIs(t, err, ext4.ErrShrinkMounted)
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: devPath,
+		Shrink: true,
+	})
+	require.ErrorIs(t, err, ext4.ErrShrinkMounted)
+
+	require.NoError(t, c.Unmount(ctx, mountPath, ext4.UnmountOptions{}))
+
+	mounted, err = c.IsMounted(ctx, devPath)
+	require.NoError(t, err)
+	require.False(t, mounted)
+
+	require.NoError(t, c.Mount(ctx, devPath, mountPath, ext4.MountOptions{}))
+
+	t.Log("Growing the mounted filesystem")
+
+	result, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: devPath,
+		Size:   64 * ext4.MiB,
+	})
+	if err != nil && strings.Contains(err.Error(), "Permission denied") {
+		t.Skip("online resizing is not permitted")
+	}
+	require.NoError(t, err)
+	require.True(t, result.Online)
+	require.Greater(t, result.NewBlockCount, result.OldBlockCount)
+}
@@ -0,0 +1,238 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package nbd attaches disk images (eg. qcow2) to network block devices using
+// qemu-nbd, so that they can be used wherever a block device is required.
+package nbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the format of a disk image.
+type Format string
+
+const (
+	// FormatRaw is a raw disk image.
+	FormatRaw Format = "raw"
+	// FormatQCOW2 is a QEMU copy-on-write (version 2) disk image.
+	FormatQCOW2 Format = "qcow2"
+)
+
+// ErrNoFreeDevice is returned when all network block devices are in use.
+var ErrNoFreeDevice = errors.New("no free nbd device found")
+
+// defaultTimeout is how long to wait for a device to connect or disconnect,
+// by default.
+const defaultTimeout = 10 * time.Second
+
+// pollInterval is how often the state of a device is polled while waiting
+// for it to connect or disconnect.
+const pollInterval = 50 * time.Millisecond
+
+// sysBlockDir is where the kernel exposes the state of block devices.
+const sysBlockDir = "/sys/block"
+
+// Options provides options for attaching a disk image.
+type Options struct {
+	// Format of the image. If unset, qemu-nbd will probe the format (which
+	// is unsafe for untrusted raw images).
+	Format Format
+	// ReadOnly attaches the image read-only.
+	ReadOnly bool
+	// QemuNBDPath is the path of the qemu-nbd binary (by default $PATH is
+	// searched).
+	QemuNBDPath string
+	// Timeout is how long to wait for the device to connect, and to
+	// disconnect when detached (default 10s).
+	Timeout time.Duration
+}
+
+// LoadModule loads the nbd kernel module, if it isn't already loaded.
+func LoadModule(ctx context.Context) error {
+	if _, err := os.Stat("/sys/module/nbd"); err == nil {
+		return nil
+	}
+
+	if out, err := exec.CommandContext(ctx, "modprobe", "nbd").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load nbd module: %w: %s", err, out)
+	}
+
+	return nil
+}
+
+// CreateImage creates a new (empty) disk image of the given format and size
+// (in bytes) using qemu-img.
+func CreateImage(ctx context.Context, path string, format Format, size int64) error {
+	cmd := exec.CommandContext(ctx, "qemu-img", "create", "-f", string(format), path, strconv.FormatInt(size, 10))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create image: %w: %s", err, out)
+	}
+
+	return nil
+}
+
+// Attach attaches the image at path to a free network block device, returning
+// the path of the device, and a function that detaches it. Requires the nbd
+// kernel module to be loaded (see LoadModule), and CAP_SYS_ADMIN.
+func Attach(ctx context.Context, path string, opts Options) (string, func() error, error) {
+	qemuNBDPath := opts.QemuNBDPath
+	if qemuNBDPath == "" {
+		qemuNBDPath = "qemu-nbd"
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	devices, err := FreeDevices()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var args []string
+	if opts.Format != "" {
+		args = append(args, "--format", string(opts.Format))
+	}
+	if opts.ReadOnly {
+		args = append(args, "--read-only")
+	}
+
+	for _, device := range devices {
+		cmd := exec.CommandContext(ctx, qemuNBDPath, append(args, "--connect", device, path)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			// The device may have been claimed by another process since we
+			// listed the free devices.
+			if strings.Contains(string(out), "Device or resource busy") {
+				continue
+			}
+
+			return "", nil, fmt.Errorf("failed to attach %s: %w: %s", path, err, out)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := waitFor(waitCtx, device, true)
+		cancel()
+		if err != nil {
+			_ = detach(device, opts.QemuNBDPath, timeout)
+			return "", nil, fmt.Errorf("failed waiting for %s to connect: %w", device, err)
+		}
+
+		return device, func() error {
+			return detach(device, opts.QemuNBDPath, timeout)
+		}, nil
+	}
+
+	return "", nil, ErrNoFreeDevice
+}
+
+// Detach disconnects a network block device, waiting for the disconnection to
+// complete (for at most 10s, unless ctx has a deadline). If qemuNBDPath is
+// empty, $PATH is searched for qemu-nbd.
+func Detach(ctx context.Context, device, qemuNBDPath string) error {
+	if qemuNBDPath == "" {
+		qemuNBDPath = "qemu-nbd"
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	if out, err := exec.CommandContext(ctx, qemuNBDPath, "--disconnect", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to detach %s: %w: %s", device, err, out)
+	}
+
+	if err := waitFor(ctx, device, false); err != nil {
+		return fmt.Errorf("failed waiting for %s to disconnect: %w", device, err)
+	}
+
+	return nil
+}
+
+// detach detaches a device attached by Attach, waiting at most timeout.
+func detach(device, qemuNBDPath string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return Detach(ctx, device, qemuNBDPath)
+}
+
+// FreeDevices returns the network block devices that are not connected, in
+// numerical order.
+func FreeDevices() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(sysBlockDir, "nbd*"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no nbd devices found (is the nbd module loaded?): %w", os.ErrNotExist)
+	}
+
+	var numbers []int
+	for _, p := range paths {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(p), "nbd"))
+		if err != nil {
+			continue
+		}
+
+		if !connected(filepath.Base(p)) {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+
+	devices := make([]string, len(numbers))
+	for i, n := range numbers {
+		devices[i] = fmt.Sprintf("/dev/nbd%d", n)
+	}
+
+	return devices, nil
+}
+
+// connected returns true if a network block device is connected to a server
+// (which is indicated by the presence of its pid attribute).
+func connected(name string) bool {
+	_, err := os.Stat(filepath.Join(sysBlockDir, name, "pid"))
+	return err == nil
+}
+
+// waitFor waits for a device to either connect or disconnect.
+func waitFor(ctx context.Context, device string, wantConnected bool) error {
+	name := filepath.Base(device)
+	for connected(name) != wantConnected {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+
+	return nil
+}
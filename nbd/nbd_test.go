@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nbd_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/nbd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttach(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("attaching nbd devices requires root")
+	}
+
+	for _, name := range []string{"qemu-img", "qemu-nbd"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+
+	ctx := context.Background()
+
+	if err := nbd.LoadModule(ctx); err != nil {
+		t.Skipf("nbd module unavailable: %v", err)
+	}
+
+	for _, format := range []nbd.Format{nbd.FormatRaw, nbd.FormatQCOW2} {
+		format := format
+		t.Run(string(format), func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "disk."+string(format))
+			require.NoError(t, nbd.CreateImage(ctx, imagePath, format, 64<<20))
+
+			device, detach, err := nbd.Attach(ctx, imagePath, nbd.Options{Format: format})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = detach()
+			})
+
+			free, err := nbd.FreeDevices()
+			require.NoError(t, err)
+			require.NotContains(t, free, device)
+
+			c := ext4.NewClient()
+
+			_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{Device: device, Label: "nbd"})
+			require.NoError(t, err)
+
+			sb, err := c.ReadSuperblock(ctx, device)
+			require.NoError(t, err)
+			require.Equal(t, "nbd", sb.Label)
+
+			t.Log("Detaching the device")
+
+			require.NoError(t, detach())
+
+			free, err = nbd.FreeDevices()
+			require.NoError(t, err)
+			require.Contains(t, free, device)
+		})
+	}
+}
@@ -17,11 +17,242 @@
 
 package ext4
 
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
 type ClientOption func(*Client)
 
 // WithPath sets the path of the directory containing the e2fsprogs binaries.
+// The path may contain multiple directories separated by the OS specific path
+// list separator (as with $PATH).
+//
+// Deprecated: use WithSearchPath instead.
 func WithPath(path string) ClientOption {
+	return WithSearchPath(filepath.SplitList(path)...)
+}
+
+// WithSearchPath sets the directories that will be searched (in order) for
+// the e2fsprogs binaries. By default $PATH, /sbin and /usr/sbin are searched.
+// Only applies to the default local executor.
+func WithSearchPath(dirs ...string) ClientOption {
+	return func(c *Client) {
+		c.searchPath = dirs
+	}
+}
+
+// WithToolPath overrides the location of a specific binary (eg. "mke2fs"),
+// bypassing the search path.
+func WithToolPath(name, path string) ClientOption {
+	return func(c *Client) {
+		c.toolPaths[name] = path
+	}
+}
+
+// WithMke2fsPath overrides the location of the mke2fs binary.
+func WithMke2fsPath(path string) ClientOption {
+	return WithToolPath("mke2fs", path)
+}
+
+// WithResize2fsPath overrides the location of the resize2fs binary.
+func WithResize2fsPath(path string) ClientOption {
+	return WithToolPath("resize2fs", path)
+}
+
+// WithE2fsckPath overrides the location of the e2fsck binary.
+func WithE2fsckPath(path string) ClientOption {
+	return WithToolPath("e2fsck", path)
+}
+
+// WithDebugfsPath overrides the location of the debugfs binary.
+func WithDebugfsPath(path string) ClientOption {
+	return WithToolPath("debugfs", path)
+}
+
+// WithDumpe2fsPath overrides the location of the dumpe2fs binary.
+func WithDumpe2fsPath(path string) ClientOption {
+	return WithToolPath("dumpe2fs", path)
+}
+
+// WithLogger sets the logger used to record every command executed by the
+// client (at debug level).
+func WithLogger(logger *slog.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithEnvironment sets additional environment variables (eg. MKE2FS_CONFIG,
+// E2FSPROGS_FAKE_TIME) for the commands executed by the client. Variables are
+// applied on top of the inherited environment.
+func WithEnvironment(env map[string]string) ClientOption {
+	return func(c *Client) {
+		c.env = env
+	}
+}
+
+// WithChroot runs all commands chrooted into the given directory (which
+// requires CAP_SYS_CHROOT). Binaries are looked up within the chroot, and
+// all paths (eg. devices) are interpreted relative to the new root. Only
+// applies to the default local executor.
+func WithChroot(dir string) ClientOption {
+	return func(c *Client) {
+		c.chroot = dir
+	}
+}
+
+// WithCgroup places all commands into the given cgroup v2 directory (eg.
+// /sys/fs/cgroup/e2fsprogs), so that memory and block I/O limits configured on
+// the cgroup apply to them. The cgroup must already exist. Only applies to the
+// default local executor, on Linux.
+func WithCgroup(dir string) ClientOption {
+	return func(c *Client) {
+		c.cgroup = dir
+	}
+}
+
+// WithGracePeriod sends SIGTERM to commands (and any helpers they spawned)
+// when their context is cancelled, only forcibly killing them if they have not
+// exited within the grace period. By default commands are killed immediately.
+// Only applies to the default local executor.
+func WithGracePeriod(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.gracePeriod = d
+	}
+}
+
+// WithExecutor sets the executor used to run commands, eg. to run them on a
+// remote host. By default commands are executed locally.
+func WithExecutor(executor Executor) ClientOption {
+	return func(c *Client) {
+		c.executor = executor
+	}
+}
+
+// WithDryRun puts the client into dry-run mode. Instead of executing commands
+// that would modify a filesystem, methods return a *DryRunError describing the
+// exact command line. Read-only inspection commands (eg. dumpe2fs) are still
+// executed, as their output may be needed to plan subsequent commands.
+func WithDryRun() ClientOption {
+	return func(c *Client) {
+		c.dryRun = true
+	}
+}
+
+// WithRetry retries commands that fail due to transient conditions (eg. EBUSY
+// or the device being in use), which are common immediately after partition
+// table changes while udev is still processing events. Each command is
+// attempted at most attempts times, waiting backoff before the first retry
+// and doubling the wait after each subsequent failure.
+func WithRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retries = attempts
+		c.backoff = backoff
+	}
+}
+
+// WithIOPriority runs commands with the given I/O scheduling class and level
+// (0-7, lower is higher priority) using ionice(1), eg. so that background
+// checks don't starve production workloads. The level is ignored for the idle
+// class.
+func WithIOPriority(class IOPriorityClass, level int) ClientOption {
+	return func(c *Client) {
+		c.ioPriority = &ioPriority{class: class, level: level}
+	}
+}
+
+// WithCPUPriority runs commands with the given niceness (-20 to 19, higher is
+// lower priority) using nice(1).
+func WithCPUPriority(niceness int) ClientOption {
+	return func(c *Client) {
+		c.cpuPriority = &niceness
+	}
+}
+
+// WithBusyBoxCompat enables support for minimal environments where tools are
+// provided by BusyBox applets. Each tool is probed once to detect whether it
+// is BusyBox, and if so the command line is checked against the restricted set
+// of options the applet supports, returning an *UnsupportedOptionError rather
+// than letting the applet fail (or silently ignore the option).
+func WithBusyBoxCompat() ClientOption {
+	return func(c *Client) {
+		c.busyboxCompat = true
+	}
+}
+
+// WithUndoDir saves an undo file in dir for every operation that modifies an
+// existing filesystem with mke2fs, resize2fs, e2fsck or tune2fs (but not
+// e2label, used by SetLabel), unless the caller gives one explicitly. The undo
+// files can then be listed, pruned, and applied (see UndoLastOperation). The
+// directory is on the local host (within the chroot, if configured). Only
+// applies to the default local executor.
+func WithUndoDir(dir string) ClientOption {
+	return func(c *Client) {
+		c.undoDir = dir
+	}
+}
+
+// WithDeviceFlock additionally takes an exclusive flock(2) on the device node
+// while modifying it, so that operations are also serialized against other
+// processes (and udev) following the same convention. Operations are always
+// serialized within a client. Only applies to the default local executor, on
+// Linux.
+func WithDeviceFlock() ClientOption {
+	return func(c *Client) {
+		c.flockDevices = true
+	}
+}
+
+// WithTracerProvider records OpenTelemetry spans for each operation, and each
+// command spawned, using the given tracer provider.
+func WithTracerProvider(tp trace.TracerProvider) ClientOption {
+	return func(c *Client) {
+		c.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithMetricsRegistry exports Prometheus metrics (counts, durations, and
+// failures of the commands executed by the client) to the given registry.
+// Clients may share a registry. If the metrics can't be registered (eg. the
+// registry has conflicting collectors with the same names), every command run
+// by the client fails with the error.
+func WithMetricsRegistry(reg prometheus.Registerer) ClientOption {
+	return func(c *Client) {
+		c.metrics, c.optionErr = newMetrics(reg)
+	}
+}
+
+// WithCommandHook registers a function that is called before and after every
+// command executed by the client (eg. for audit logging). Hooks are called
+// synchronously, in the order they were registered.
+func WithCommandHook(hook func(CommandEvent)) ClientOption {
+	return func(c *Client) {
+		c.hooks = append(c.hooks, hook)
+	}
+}
+
+// WithOutput streams the stdout and stderr of executed commands to the given
+// writers (either may be nil), as the output is produced. Streamed output isn't
+// all kept in memory, so only the end of long reports (eg. the problems found
+// by e2fsck) is parsed.
+func WithOutput(stdout, stderr io.Writer) ClientOption {
+	return func(c *Client) {
+		c.stdout = stdout
+		c.stderr = stderr
+	}
+}
+
+// WithOutputLines calls fn for each line of output produced by executed
+// commands, as the output is produced. Calls are serialized. As with
+// WithOutput, only the end of long reports is parsed.
+func WithOutputLines(fn func(stream OutputStream, line string)) ClientOption {
 	return func(c *Client) {
-		c.path = path
+		c.onLine = fn
 	}
 }
@@ -0,0 +1,367 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolPaths(t *testing.T) {
+	ctx := context.Background()
+
+	imagePath := createTestImage(t, ext4.NewClient(), "")
+
+	t.Log("Using an empty search path")
+
+	c := ext4.NewClient(ext4.WithSearchPath(t.TempDir()))
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.True(t, errors.Is(err, os.ErrNotExist), "expected command not found error")
+
+	t.Log("Overriding the path of a specific tool")
+
+	dumpe2fsPath, err := exec.LookPath("dumpe2fs")
+	if errors.Is(err, exec.ErrNotFound) {
+		dumpe2fsPath = "/sbin/dumpe2fs"
+	}
+
+	toolPath := filepath.Join(t.TempDir(), "my-dumpe2fs")
+	require.NoError(t, os.Symlink(dumpe2fsPath, toolPath))
+
+	c = ext4.NewClient(ext4.WithSearchPath(t.TempDir()), ext4.WithDumpe2fsPath(toolPath))
+
+	_, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+}
+
+func TestWithLogger(t *testing.T) {
+	ctx := context.Background()
+
+	imagePath := createTestImage(t, ext4.NewClient(), "")
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	c := ext4.NewClient(ext4.WithLogger(logger))
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	var entry struct {
+		Msg      string   `json:"msg"`
+		Path     string   `json:"path"`
+		Args     []string `json:"args"`
+		ExitCode int      `json:"exitCode"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	require.Equal(t, "dumpe2fs", filepath.Base(entry.Path))
+	require.Equal(t, []string{"-h", imagePath}, entry.Args)
+	require.Zero(t, entry.ExitCode)
+}
+
+func TestWithEnvironment(t *testing.T) {
+	ctx := context.Background()
+
+	confPath := filepath.Join(t.TempDir(), "mke2fs.conf")
+	err := os.WriteFile(confPath, []byte(`[defaults]
+	inode_size = 512
+
+[fs_types]
+	ext4 = {
+		features = has_journal,extent,huge_file,flex_bg,metadata_csum,64bit,dir_nlink,extra_isize
+	}
+`), 0o644)
+	require.NoError(t, err)
+
+	c := ext4.NewClient(ext4.WithEnvironment(map[string]string{
+		"MKE2FS_CONFIG": confPath,
+	}))
+
+	imagePath := createTestImage(t, c, "")
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, 512, sb.InodeSize)
+}
+
+func TestWithChroot(t *testing.T) {
+	ctx := context.Background()
+
+	t.Log("Looking up tools within an empty chroot")
+
+	c := ext4.NewClient(ext4.WithChroot(t.TempDir()))
+
+	_, err := c.ReadSuperblock(ctx, "/dev/null")
+	require.True(t, errors.Is(err, os.ErrNotExist), "expected command not found error")
+}
+
+func TestWithDryRun(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient(ext4.WithDryRun())
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+		Label:  "test",
+	})
+	require.ErrorIs(t, err, ext4.ErrDryRun)
+
+	var dryRunErr *ext4.DryRunError
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, "mke2fs", filepath.Base(dryRunErr.Argv[0]))
+	require.Equal(t, []string{"-v", "-t", "ext4", "-L", "test", imagePath, "64M"}, dryRunErr.Argv[1:])
+
+	_, err = os.Stat(imagePath)
+	require.True(t, os.IsNotExist(err), "filesystem should not have been created")
+
+	t.Log("Executing read-only commands in dry-run mode")
+
+	imagePath = createTestImage(t, ext4.NewClient(), "")
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   128 * ext4.MiB,
+	})
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, "resize2fs", filepath.Base(dryRunErr.Argv[0]))
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(65536), sb.BlockCount)
+
+	t.Log("Capturing command input in dry-run mode")
+
+	err = c.WriteFileToImage(ctx, imagePath, "/etc/hostname", "/etc/hostname")
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, "cd /etc\nwrite /etc/hostname hostname\n", dryRunErr.Stdin)
+}
+
+func TestWithCommandHook(t *testing.T) {
+	ctx := context.Background()
+
+	var events []ext4.CommandEvent
+	c := ext4.NewClient(ext4.WithCommandHook(func(event ext4.CommandEvent) {
+		events = append(events, event)
+	}))
+
+	imagePath := createTestImage(t, c, "")
+
+	require.Len(t, events, 2)
+
+	require.Equal(t, ext4.CommandStarted, events[0].Phase)
+	require.Equal(t, "mke2fs", filepath.Base(events[0].Path))
+
+	require.Equal(t, ext4.CommandFinished, events[1].Phase)
+	require.Equal(t, events[0].Args, events[1].Args)
+	require.NotZero(t, events[1].Duration)
+	require.Zero(t, events[1].ExitCode)
+	require.Contains(t, events[1].Stdout, "Filesystem UUID")
+	require.NoError(t, events[1].Err)
+
+	t.Log("Recording failed commands")
+
+	events = nil
+
+	_, err := c.ReadSuperblock(ctx, imagePath+".missing")
+	require.Error(t, err)
+
+	require.Len(t, events, 2)
+	require.NotZero(t, events[1].ExitCode)
+	require.NotEmpty(t, events[1].Stderr)
+	require.Error(t, events[1].Err)
+}
+
+func TestWithOutput(t *testing.T) {
+	ctx := context.Background()
+
+	var stdout, stderr bytes.Buffer
+	var lines []string
+	c := ext4.NewClient(
+		ext4.WithOutput(&stdout, &stderr),
+		ext4.WithOutputLines(func(stream ext4.OutputStream, line string) {
+			lines = append(lines, stream.String()+": "+line)
+		}),
+	)
+
+	imagePath := createTestImage(t, c, "")
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Contains(t, stdout.String(), "Filesystem UUID")
+	require.Contains(t, stderr.String(), "dumpe2fs")
+
+	require.Contains(t, lines, "stdout: Filesystem volume name:   <none>")
+	require.Contains(t, lines, "stderr: "+strings.TrimSpace(strings.Split(stderr.String(), "\n")[0]))
+}
+
+func TestWithOutputLinesBounded(t *testing.T) {
+	ctx := context.Background()
+
+	// A stand-in for dumpe2fs that reports far more on stderr than is kept.
+	toolPath := filepath.Join(t.TempDir(), "dumpe2fs")
+	script := "#!/bin/sh\n" +
+		"seq 1 100000 >&2\n" +
+		"echo done >&2\n" +
+		"exit 1\n"
+	require.NoError(t, os.WriteFile(toolPath, []byte(script), 0o755))
+
+	var count int
+	c := ext4.NewClient(ext4.WithDumpe2fsPath(toolPath), ext4.WithOutputLines(func(ext4.OutputStream, string) {
+		count++
+	}))
+
+	_, err := c.ReadSuperblock(ctx, "/dev/null")
+
+	var cmdErr *ext4.CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	require.Equal(t, 100001, count)
+
+	t.Log("Checking only the tail of stderr is kept")
+
+	require.Less(t, len(cmdErr.Stderr), 100<<10)
+	require.True(t, strings.HasSuffix(cmdErr.Stderr, "99999\n100000\ndone\n"))
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+
+	imagePath := createTestImage(t, ext4.NewClient(), "")
+
+	dumpe2fsPath, err := exec.LookPath("dumpe2fs")
+	if errors.Is(err, exec.ErrNotFound) {
+		dumpe2fsPath = "/sbin/dumpe2fs"
+	}
+
+	// A wrapper that reports the device as busy on the first two invocations.
+	dir := t.TempDir()
+	countPath := filepath.Join(dir, "count")
+	toolPath := filepath.Join(dir, "dumpe2fs")
+	script := "#!/bin/sh\n" +
+		"echo x >> " + countPath + "\n" +
+		"if [ $(wc -l < " + countPath + ") -le 2 ]; then\n" +
+		"  echo \"dumpe2fs: Device or resource busy while trying to open $2\" >&2\n" +
+		"  exit 1\n" +
+		"fi\n" +
+		"exec " + dumpe2fsPath + " \"$@\"\n"
+	require.NoError(t, os.WriteFile(toolPath, []byte(script), 0o755))
+
+	t.Log("Without retries")
+
+	c := ext4.NewClient(ext4.WithDumpe2fsPath(toolPath))
+
+	_, err = c.ReadSuperblock(ctx, imagePath)
+	require.ErrorContains(t, err, "Device or resource busy")
+
+	t.Log("With retries")
+
+	require.NoError(t, os.Remove(countPath))
+
+	c = ext4.NewClient(ext4.WithDumpe2fsPath(toolPath), ext4.WithRetry(3, time.Millisecond))
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(65536), sb.BlockCount)
+
+	count, err := os.ReadFile(countPath)
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(string(count), "x"))
+}
+
+func TestWithPriority(t *testing.T) {
+	ctx := context.Background()
+
+	imagePath := createTestImage(t, ext4.NewClient(), "")
+
+	var events []ext4.CommandEvent
+	c := ext4.NewClient(
+		ext4.WithIOPriority(ext4.IOPriorityBestEffort, 7),
+		ext4.WithCPUPriority(10),
+		ext4.WithCommandHook(func(event ext4.CommandEvent) {
+			events = append(events, event)
+		}),
+	)
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	require.Len(t, events, 2)
+	require.Equal(t, "ionice", filepath.Base(events[0].Path))
+	require.Equal(t, []string{"-c", "2", "-n", "7"}, events[0].Args[:4])
+	require.Equal(t, "nice", filepath.Base(events[0].Args[4]))
+	require.Equal(t, []string{"-n", "10"}, events[0].Args[5:7])
+	require.Equal(t, "dumpe2fs", filepath.Base(events[0].Args[7]))
+}
+
+func TestWithCgroup(t *testing.T) {
+	ctx := context.Background()
+
+	imagePath := createTestImage(t, ext4.NewClient(), "")
+
+	t.Log("Using a non-existent cgroup")
+
+	c := ext4.NewClient(ext4.WithCgroup(filepath.Join(t.TempDir(), "missing")))
+
+	_, err := c.ReadSuperblock(ctx, imagePath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	t.Log("Using a real cgroup")
+
+	cgroupRoot := "/sys/fs/cgroup"
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		// Hybrid hierarchy.
+		cgroupRoot = filepath.Join(cgroupRoot, "unified")
+	}
+
+	cgroupPath := filepath.Join(cgroupRoot, "ext4-test-"+filepath.Base(t.TempDir()))
+	if err := os.Mkdir(cgroupPath, 0o755); err != nil {
+		t.Skipf("unable to create cgroup: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = os.Remove(cgroupPath)
+	})
+
+	// A wrapper that reports the cgroup it is running in.
+	toolPath := filepath.Join(t.TempDir(), "dumpe2fs")
+	require.NoError(t, os.WriteFile(toolPath, []byte("#!/bin/sh\ncat /proc/self/cgroup\n"), 0o755))
+
+	var stdout bytes.Buffer
+	c = ext4.NewClient(ext4.WithCgroup(cgroupPath),
+		ext4.WithDumpe2fsPath(toolPath),
+		ext4.WithOutput(&stdout, nil))
+
+	_, _ = c.ReadSuperblock(ctx, imagePath)
+	require.Contains(t, stdout.String(), "0::/"+filepath.Base(cgroupPath))
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxRetainedOutput is how much of each output stream of a command is kept in
+// memory (eg. for CommandError.Stderr) once it's streamed to the caller.
+const maxRetainedOutput = 64 << 10
+
+// OutputStream identifies an output stream of a command.
+type OutputStream int
+
+const (
+	// Stdout is the standard output stream.
+	Stdout OutputStream = iota
+	// Stderr is the standard error stream.
+	Stderr
+)
+
+func (s OutputStream) String() string {
+	if s == Stderr {
+		return "stderr"
+	}
+
+	return "stdout"
+}
+
+// outputWriters returns the writers for a command's stdout and stderr, teeing
+// output to any caller provided writers and line callbacks. The returned flush
+// function must be called once the command has exited.
+func (c *Client) outputWriters(out, errOut io.Writer) (io.Writer, io.Writer, func()) {
+	stdoutWriters := []io.Writer{out}
+	stderrWriters := []io.Writer{errOut}
+
+	if c.stdout != nil {
+		stdoutWriters = append(stdoutWriters, c.stdout)
+	}
+	if c.stderr != nil {
+		stderrWriters = append(stderrWriters, c.stderr)
+	}
+
+	flush := func() {}
+	if c.onLine != nil {
+		// stdout and stderr may be written concurrently, so serialize callbacks.
+		var mu sync.Mutex
+		stdoutLines := &lineWriter{mu: &mu, fn: func(line string) { c.onLine(Stdout, line) }}
+		stderrLines := &lineWriter{mu: &mu, fn: func(line string) { c.onLine(Stderr, line) }}
+
+		stdoutWriters = append(stdoutWriters, stdoutLines)
+		stderrWriters = append(stderrWriters, stderrLines)
+
+		flush = func() {
+			stdoutLines.Flush()
+			stderrLines.Flush()
+		}
+	}
+
+	return io.MultiWriter(stdoutWriters...), io.MultiWriter(stderrWriters...), flush
+}
+
+// lineWriter is an io.Writer that calls fn for each complete line written.
+type lineWriter struct {
+	mu  *sync.Mutex
+	fn  func(line string)
+	buf bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+
+		line := w.buf.Next(i + 1)
+		w.fn(string(bytes.TrimRight(line, "\r\n")))
+	}
+
+	return len(p), nil
+}
+
+// Flush calls fn for any remaining partial line.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.fn(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+// tailBuffer is an io.Writer that keeps only the last limit bytes written (or
+// everything if limit is zero).
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	// Trim lazily, so that each byte is copied a bounded number of times.
+	if b.limit > 0 && len(b.buf) > 2*b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+	}
+
+	return len(p), nil
+}
+
+// Bytes returns the retained output.
+func (b *tailBuffer) Bytes() []byte {
+	if b.limit > 0 && len(b.buf) > b.limit {
+		return b.buf[len(b.buf)-b.limit:]
+	}
+
+	return b.buf
+}
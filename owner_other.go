@@ -0,0 +1,34 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import "io/fs"
+
+// fileOwner returns the user and group IDs that own a host file. Ownership is
+// not available on this platform, so files are treated as owned by root.
+func fileOwner(_ fs.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// fileDevice returns the major and minor numbers of a host device node.
+// Device numbers are not available on this platform.
+func fileDevice(_ fs.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+func parseUint32(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(v)
+}
+
+func parseUint64(s string) uint64 {
+	v, _ := strconv.ParseUint(s, 10, 64)
+	return v
+}
+
+// parseRanges parses a comma separated list of numbers and number ranges.
+func parseRanges(s string) []Range {
+	var ranges []Range
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		start, end, found := strings.Cut(item, "-")
+		r := Range{Start: parseUint64(start), End: parseUint64(start)}
+		if found {
+			r.End = parseUint64(end)
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges
+}
+
+func parseHexUint32(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 16, 32)
+	return uint32(v)
+}
+
+// parseList parses a whitespace separated list of words ("(none)" if empty).
+func parseList(s string) []string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || (len(fields) == 1 && fields[0] == "(none)") {
+		return nil
+	}
+
+	return fields
+}
+
+// firstField returns the first whitespace separated word in s.
+func firstField(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return fields[0]
+}
+
+// parseTime parses a timestamp as formatted by e2fsprogs (ctime), returning
+// the zero time if the value is unset.
+func parseTime(s string) time.Time {
+	t, err := time.ParseInLocation(time.ANSIC, s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
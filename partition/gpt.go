@@ -0,0 +1,320 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature     = "EFI PART"
+	gptRevision      = 0x00010000
+	gptHeaderSize    = 92
+	gptEntryCount    = 128
+	gptEntrySize     = 128
+	gptMaxNameLength = 36
+)
+
+// gptHeader is the on-disk layout of a GPT header.
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC32    uint32
+	Reserved       uint32
+	MyLBA          uint64
+	AlternateLBA   uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	EntryCount     uint32
+	EntrySize      uint32
+	EntriesCRC32   uint32
+}
+
+// gptEntry is the on-disk layout of a GPT partition entry.
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [72]byte
+}
+
+func writeGPT(f *os.File, table *Table, sectors int64) error {
+	sectorSize := int64(table.SectorSize)
+	entriesSectors := (gptEntryCount*gptEntrySize + sectorSize - 1) / sectorSize
+
+	// The protective MBR, primary header and entries are at the start of the
+	// device, and the backup entries and header at the end.
+	firstUsable := 2 + entriesSectors
+	lastUsable := sectors - 2 - entriesSectors
+	if lastUsable < firstUsable {
+		return fmt.Errorf("device is too small for a GPT")
+	}
+
+	extents, err := layout(table, firstUsable, lastUsable)
+	if err != nil {
+		return err
+	}
+
+	if table.DiskID == "" {
+		if table.DiskID, err = randomGUID(); err != nil {
+			return err
+		}
+	}
+	diskGUID, err := encodeGUID(table.DiskID)
+	if err != nil {
+		return fmt.Errorf("invalid disk ID: %w", err)
+	}
+
+	entries := make([]gptEntry, gptEntryCount)
+	for i := range table.Partitions {
+		p := &table.Partitions[i]
+		if p.Number > gptEntryCount {
+			return fmt.Errorf("partition number %d exceeds %d", p.Number, gptEntryCount)
+		}
+
+		if p.Type == "" {
+			p.Type = TypeLinuxFilesystem
+		}
+		typeGUID, err := encodeGUID(p.Type)
+		if err != nil {
+			return fmt.Errorf("invalid type for partition %d: %w", p.Number, err)
+		}
+
+		if p.UUID == "" {
+			if p.UUID, err = randomGUID(); err != nil {
+				return err
+			}
+		}
+		uniqueGUID, err := encodeGUID(p.UUID)
+		if err != nil {
+			return fmt.Errorf("invalid UUID for partition %d: %w", p.Number, err)
+		}
+
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > gptMaxNameLength {
+			return fmt.Errorf("name of partition %d exceeds %d characters", p.Number, gptMaxNameLength)
+		}
+
+		entry := gptEntry{
+			TypeGUID:   typeGUID,
+			UniqueGUID: uniqueGUID,
+			FirstLBA:   uint64(extents[i][0]),
+			LastLBA:    uint64(extents[i][1]),
+			Attributes: p.Attributes,
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry.Name[j*2:], c)
+		}
+		entries[p.Number-1] = entry
+	}
+
+	var entriesBuf bytes.Buffer
+	if err := binary.Write(&entriesBuf, binary.LittleEndian, entries); err != nil {
+		return err
+	}
+
+	primary := gptHeader{
+		Revision:       gptRevision,
+		HeaderSize:     gptHeaderSize,
+		MyLBA:          1,
+		AlternateLBA:   uint64(sectors - 1),
+		FirstUsableLBA: uint64(firstUsable),
+		LastUsableLBA:  uint64(lastUsable),
+		DiskGUID:       diskGUID,
+		EntriesLBA:     2,
+		EntryCount:     gptEntryCount,
+		EntrySize:      gptEntrySize,
+		EntriesCRC32:   crc32.ChecksumIEEE(entriesBuf.Bytes()),
+	}
+	copy(primary.Signature[:], gptSignature)
+
+	backup := primary
+	backup.MyLBA, backup.AlternateLBA = primary.AlternateLBA, primary.MyLBA
+	backup.EntriesLBA = uint64(lastUsable + 1)
+
+	// The protective MBR covers the whole device (or as much of it as can be
+	// described).
+	mbr := make([]byte, 512)
+	entry := mbr[mbrEntriesOffset:]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = mbrTypeProtective
+	copy(entry[5:8], []byte{0xFF, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], 1)
+	binary.LittleEndian.PutUint32(entry[12:], uint32(min(sectors-1, 0xFFFFFFFF)))
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	for _, w := range []struct {
+		data []byte
+		lba  int64
+	}{
+		{mbr, 0},
+		{entriesBuf.Bytes(), 2},
+		{encodeGPTHeader(primary, sectorSize), 1},
+		{entriesBuf.Bytes(), lastUsable + 1},
+		{encodeGPTHeader(backup, sectorSize), sectors - 1},
+	} {
+		if _, err := f.WriteAt(w.data, w.lba*sectorSize); err != nil {
+			return fmt.Errorf("failed to write partition table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// encodeGPTHeader encodes a header (computing its checksum), padded to a
+// whole sector.
+func encodeGPTHeader(h gptHeader, sectorSize int64) []byte {
+	h.HeaderCRC32 = 0
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, h)
+	binary.LittleEndian.PutUint32(buf.Bytes()[16:], crc32.ChecksumIEEE(buf.Bytes()[:gptHeaderSize]))
+
+	sector := make([]byte, sectorSize)
+	copy(sector, buf.Bytes())
+	return sector
+}
+
+func readGPT(f *os.File, sectorSize int) (*Table, error) {
+	header, err := readGPTHeader(f, int64(sectorSize))
+	if err != nil {
+		return nil, err
+	}
+
+	entriesBuf := make([]byte, int(header.EntryCount)*int(header.EntrySize))
+	if _, err := f.ReadAt(entriesBuf, int64(header.EntriesLBA)*int64(sectorSize)); err != nil {
+		return nil, fmt.Errorf("failed to read GPT entries: %w", err)
+	}
+	if crc32.ChecksumIEEE(entriesBuf) != header.EntriesCRC32 {
+		return nil, errors.New("GPT entries checksum mismatch")
+	}
+
+	table := &Table{
+		Type:       GPT,
+		DiskID:     decodeGUID(header.DiskGUID),
+		SectorSize: sectorSize,
+	}
+
+	for i := 0; i < int(header.EntryCount); i++ {
+		var entry gptEntry
+		raw := entriesBuf[i*int(header.EntrySize):]
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		if entry.TypeGUID == [16]byte{} {
+			continue
+		}
+
+		if entry.LastLBA < entry.FirstLBA || entry.LastLBA >= uint64(math.MaxInt64/int64(sectorSize)) {
+			return nil, fmt.Errorf("invalid GPT entry %d: LBAs %d to %d", i+1, entry.FirstLBA, entry.LastLBA)
+		}
+
+		name := make([]uint16, 0, gptMaxNameLength)
+		for j := 0; j < len(entry.Name); j += 2 {
+			c := binary.LittleEndian.Uint16(entry.Name[j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+
+		table.Partitions = append(table.Partitions, Partition{
+			Number: i + 1,
+			Start:  int64(entry.FirstLBA) * int64(sectorSize),
+			Size:   int64(entry.LastLBA-entry.FirstLBA+1) * int64(sectorSize),
+			Type:   decodeGUID(entry.TypeGUID),
+			Name:   string(utf16.Decode(name)),
+			UUID:   decodeGUID(entry.UniqueGUID),
+
+			Attributes: entry.Attributes,
+		})
+	}
+
+	return table, nil
+}
+
+func readGPTHeader(f *os.File, sectorSize int64) (*gptHeader, error) {
+	buf := make([]byte, gptHeaderSize)
+	if _, err := f.ReadAt(buf, sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header: %w", err)
+	}
+
+	var header gptHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if string(header.Signature[:]) != gptSignature {
+		return nil, fmt.Errorf("%w: bad GPT signature", ErrNoPartitionTable)
+	}
+
+	crc := header.HeaderCRC32
+	binary.LittleEndian.PutUint32(buf[16:], 0)
+	if crc32.ChecksumIEEE(buf) != crc {
+		return nil, errors.New("GPT header checksum mismatch")
+	}
+
+	// Entries are 128 bytes, multiplied by a power of two (but never larger
+	// than a sector, in practice).
+	if header.EntrySize < gptEntrySize || header.EntrySize&(header.EntrySize-1) != 0 ||
+		int64(header.EntrySize) > sectorSize || header.EntryCount > 1024 {
+		return nil, fmt.Errorf("unsupported GPT entry layout")
+	}
+
+	return &header, nil
+}
+
+// encodeGUID encodes a textual GUID in its mixed-endian on-disk form.
+func encodeGUID(s string) ([16]byte, error) {
+	var guid [16]byte
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 || len(s) != 36 {
+		return guid, fmt.Errorf("malformed GUID %q", s)
+	}
+
+	// The first three fields are little-endian.
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(guid[8:], b[8:])
+
+	return guid, nil
+}
+
+func decodeGUID(guid [16]byte) string {
+	return strings.ToUpper(fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(guid[0:]),
+		binary.LittleEndian.Uint16(guid[4:]),
+		binary.LittleEndian.Uint16(guid[6:]),
+		guid[8:10], guid[10:16]))
+}
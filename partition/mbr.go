@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// mbrEntriesOffset is the offset of the partition entries in the MBR.
+	mbrEntriesOffset = 446
+	// mbrEntryCount is the number of (primary) partition entries.
+	mbrEntryCount = 4
+	// mbrTypeProtective is the partition type of a GPT protective MBR.
+	mbrTypeProtective = 0xEE
+	// mbrBootable is the status of an active partition.
+	mbrBootable = 0x80
+	// mbrMaxSectors is the largest sector address an MBR can describe.
+	mbrMaxSectors = 0xFFFFFFFF
+)
+
+func writeMBR(f *os.File, table *Table, sectors int64) error {
+	if len(table.Partitions) > mbrEntryCount {
+		return fmt.Errorf("an MBR supports at most %d partitions", mbrEntryCount)
+	}
+
+	extents, err := layout(table, 1, min(sectors, mbrMaxSectors)-1)
+	if err != nil {
+		return err
+	}
+
+	var signature uint32
+	if table.DiskID == "" {
+		guid, err := randomGUID()
+		if err != nil {
+			return err
+		}
+		table.DiskID = strings.ToLower(guid[:8])
+	}
+	if s, err := strconv.ParseUint(table.DiskID, 16, 32); err == nil {
+		signature = uint32(s)
+	} else {
+		return fmt.Errorf("invalid disk ID %q", table.DiskID)
+	}
+
+	// Preserve any boot code.
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return fmt.Errorf("failed to read MBR: %w", err)
+	}
+	if mbr[mbrEntriesOffset+4] == mbrTypeProtective {
+		clear(mbr[:mbrEntriesOffset])
+	}
+	clear(mbr[mbrEntriesOffset:])
+
+	binary.LittleEndian.PutUint32(mbr[440:], signature)
+
+	for i := range table.Partitions {
+		p := &table.Partitions[i]
+		if p.Number > mbrEntryCount {
+			return fmt.Errorf("partition number %d exceeds %d", p.Number, mbrEntryCount)
+		}
+
+		if p.Type == "" {
+			p.Type = TypeMBRLinux
+		}
+		partType, err := strconv.ParseUint(p.Type, 16, 8)
+		if err != nil || partType == 0 {
+			return fmt.Errorf("invalid type %q for partition %d", p.Type, p.Number)
+		}
+		p.Type = fmt.Sprintf("%02x", partType)
+
+		entry := mbr[mbrEntriesOffset+(p.Number-1)*16:]
+		if p.Bootable {
+			entry[0] = mbrBootable
+		}
+		// CHS addressing is obsolete, so mark it as out of range.
+		copy(entry[1:4], []byte{0xFE, 0xFF, 0xFF})
+		entry[4] = byte(partType)
+		copy(entry[5:8], []byte{0xFE, 0xFF, 0xFF})
+		binary.LittleEndian.PutUint32(entry[8:], uint32(extents[i][0]))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(extents[i][1]-extents[i][0]+1))
+	}
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("failed to write partition table: %w", err)
+	}
+
+	// Wipe any GPT headers, so the device isn't mistaken for a GPT disk.
+	sectorSize := int64(table.SectorSize)
+	for _, lba := range []int64{1, sectors - 1} {
+		header := make([]byte, len(gptSignature))
+		if _, err := f.ReadAt(header, lba*sectorSize); err == nil && string(header) == gptSignature {
+			if _, err := f.WriteAt(make([]byte, sectorSize), lba*sectorSize); err != nil {
+				return fmt.Errorf("failed to wipe GPT header: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func readMBR(mbr []byte, sectorSize int) (*Table, error) {
+	table := &Table{
+		Type:       MBR,
+		DiskID:     fmt.Sprintf("%08x", binary.LittleEndian.Uint32(mbr[440:])),
+		SectorSize: sectorSize,
+	}
+
+	for i := 0; i < mbrEntryCount; i++ {
+		entry := mbr[mbrEntriesOffset+i*16:]
+		if entry[4] == 0 {
+			continue
+		}
+
+		table.Partitions = append(table.Partitions, Partition{
+			Number:   i + 1,
+			Start:    int64(binary.LittleEndian.Uint32(entry[8:])) * int64(sectorSize),
+			Size:     int64(binary.LittleEndian.Uint32(entry[12:])) * int64(sectorSize),
+			Type:     fmt.Sprintf("%02x", entry[4]),
+			Bootable: entry[0] == mbrBootable,
+		})
+	}
+
+	return table, nil
+}
@@ -0,0 +1,336 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package partition reads and writes GPT and MBR partition tables on block
+// devices and image files, so that filesystems can be created on freshly
+// carved partitions without external tooling.
+//
+// Partitions on block devices (including loop devices attached with partition
+// scanning) are accessed using Path. For image files, a filesystem can be
+// created inside a partition by passing its offset to mke2fs, eg.
+// ext4.CreateOptions{ExtendedOptions: ext4.ExtendedOptions{Offset: p.Start}}.
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/dpeckett/ext4/internal/randuuid"
+)
+
+// TableType is the type of a partition table.
+type TableType string
+
+const (
+	// GPT is a GUID partition table.
+	GPT TableType = "gpt"
+	// MBR is a legacy (DOS) master boot record partition table.
+	MBR TableType = "mbr"
+)
+
+// Well known GPT partition types.
+const (
+	TypeLinuxFilesystem = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	TypeEFISystem       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	TypeLinuxSwap       = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	TypeBIOSBoot        = "21686148-6449-6E6F-744E-656564454649"
+)
+
+// Well known MBR partition types.
+const (
+	TypeMBRLinux     = "83"
+	TypeMBRLinuxSwap = "82"
+	TypeMBREFISystem = "ef"
+)
+
+// alignment is the default alignment of partitions (1 MiB), which suits the
+// erase blocks of most storage devices.
+const alignment = 1 << 20
+
+// ErrNoPartitionTable is returned when a device has no (recognized) partition
+// table.
+var ErrNoPartitionTable = errors.New("no partition table found")
+
+// Table is a partition table.
+type Table struct {
+	// Type of the partition table.
+	Type TableType
+	// DiskID is the GUID of a GPT disk, or the 32-bit hexadecimal signature of
+	// an MBR disk. If unset, a random identifier is generated.
+	DiskID string
+	// SectorSize is the logical sector size in bytes. If unset, it is
+	// determined from the device (or 512 bytes for image files).
+	SectorSize int
+	// Partitions in the table.
+	Partitions []Partition
+}
+
+// Partition is an entry in a partition table.
+type Partition struct {
+	// Number of the partition (starting at one). If unset, the lowest free
+	// number is assigned when the table is written.
+	Number int
+	// Start is the offset of the partition in bytes. If unset, the partition
+	// starts after the previous partition (aligned to 1 MiB).
+	Start int64
+	// Size of the partition in bytes. If unset, the partition uses the
+	// remaining space (only the last partition may do this).
+	Size int64
+	// Type of the partition, a GUID for GPT (eg. TypeLinuxFilesystem), or a
+	// hexadecimal byte for MBR (eg. TypeMBRLinux).
+	Type string
+	// Name of the partition (GPT only, max 36 characters).
+	Name string
+	// UUID is the unique GUID of the partition (GPT only). If unset, a random
+	// one is generated.
+	UUID string
+	// Attributes are the attribute flags of the partition (GPT only).
+	Attributes uint64
+	// Bootable marks the partition as active (MBR only).
+	Bootable bool
+}
+
+// Create writes a new partition table to a device or image file (which must
+// already be large enough), replacing any existing table. Returns the table
+// with all offsets, sizes and identifiers resolved.
+func Create(path string, table Table) (*Table, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if table.SectorSize == 0 {
+		table.SectorSize, err = sectorSize(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := write(f, &table); err != nil {
+		return nil, err
+	}
+
+	// Let the kernel know about the new partitions (if this is a block
+	// device).
+	if err := rereadPartitions(f); err != nil {
+		return nil, err
+	}
+
+	return &table, nil
+}
+
+// Read reads the partition table of a device or image file.
+func Read(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return read(f)
+}
+
+// Resize changes the size (in bytes) of a partition, eg. after the underlying
+// device has been expanded. A size of zero grows the partition to fill the
+// space available after it. For GPT, the backup table is also relocated to the
+// end of the device. The filesystem within the partition must be resized
+// separately (it should be shrunk before the partition, or grown after it).
+func Resize(path string, number int, size int64) (*Partition, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table, err := read(f)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(table.Partitions, func(p Partition) bool {
+		return p.Number == number
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("partition %d not found", number)
+	}
+
+	// Only the resized partition may use the remaining space.
+	table.Partitions[i].Size = size
+	if err := write(f, table); err != nil {
+		return nil, err
+	}
+
+	// The kernel can resize a single partition while the others (or the
+	// partition itself) are in use, unlike re-reading the whole table.
+	if err := resizeKernelPartition(f, &table.Partitions[i]); err != nil {
+		return nil, err
+	}
+
+	return &table.Partitions[i], nil
+}
+
+// Path returns the path of a partition on a block device, eg. /dev/sda1, or
+// /dev/nvme0n1p1 (for devices whose names end in a digit).
+func Path(device string, number int) string {
+	if base := filepath.Base(device); base != "" && unicode.IsDigit(rune(base[len(base)-1])) {
+		return fmt.Sprintf("%sp%d", device, number)
+	}
+
+	return fmt.Sprintf("%s%d", device, number)
+}
+
+// write lays out the partitions of the table, and writes it to the device.
+// The caller is responsible for informing the kernel of the changes.
+func write(f *os.File, table *Table) error {
+	if table.SectorSize < 512 || table.SectorSize&(table.SectorSize-1) != 0 {
+		return fmt.Errorf("invalid sector size %d", table.SectorSize)
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	sectors := size / int64(table.SectorSize)
+
+	switch table.Type {
+	case GPT:
+		err = writeGPT(f, table, sectors)
+	case MBR:
+		err = writeMBR(f, table, sectors)
+	default:
+		return fmt.Errorf("unsupported partition table type %q", table.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func read(f *os.File) (*Table, error) {
+	sectorSize, err := sectorSize(f)
+	if err != nil {
+		return nil, err
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("failed to read MBR: %w", err)
+	}
+
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return nil, ErrNoPartitionTable
+	}
+
+	if mbr[mbrEntriesOffset+4] == mbrTypeProtective {
+		return readGPT(f, sectorSize)
+	}
+
+	return readMBR(mbr, sectorSize)
+}
+
+// layout resolves the start and size (in sectors) of each partition, given
+// the first and last (inclusive) usable sectors.
+func layout(table *Table, firstUsable, lastUsable int64) ([][2]int64, error) {
+	sectorSize := int64(table.SectorSize)
+	alignSectors := max(alignment/sectorSize, 1)
+
+	extents := make([][2]int64, len(table.Partitions))
+	next := firstUsable
+	for i, p := range table.Partitions {
+		if p.Start%sectorSize != 0 || p.Size%sectorSize != 0 {
+			return nil, fmt.Errorf("partition %d is not aligned to the sector size", i+1)
+		}
+		if p.Size < 0 || p.Start < 0 {
+			return nil, fmt.Errorf("partition %d has a negative offset or size", i+1)
+		}
+
+		start := p.Start / sectorSize
+		if start == 0 {
+			start = (next + alignSectors - 1) / alignSectors * alignSectors
+		}
+
+		end := start + p.Size/sectorSize - 1
+		if p.Size == 0 {
+			// Use all the space up to the following partition.
+			end = lastUsable
+			for j, other := range table.Partitions {
+				if j != i && other.Start/sectorSize > start && other.Start/sectorSize-1 < end {
+					end = other.Start/sectorSize - 1
+				}
+			}
+			if j := i + 1; j < len(table.Partitions) && table.Partitions[j].Start == 0 {
+				return nil, fmt.Errorf("partition %d uses the remaining space, but is followed by another partition", i+1)
+			}
+		}
+
+		if start < firstUsable || end > lastUsable || end < start {
+			return nil, fmt.Errorf("partition %d does not fit on the device", i+1)
+		}
+
+		for j := 0; j < i; j++ {
+			if start <= extents[j][1] && end >= extents[j][0] {
+				return nil, fmt.Errorf("partition %d overlaps partition %d", i+1, j+1)
+			}
+		}
+
+		extents[i] = [2]int64{start, end}
+		next = end + 1
+	}
+
+	used := make(map[int]bool)
+	for i, p := range table.Partitions {
+		if p.Number < 0 || used[p.Number] {
+			return nil, fmt.Errorf("partition %d has an invalid or duplicate number %d", i+1, p.Number)
+		}
+		if p.Number > 0 {
+			used[p.Number] = true
+		}
+	}
+
+	for i := range table.Partitions {
+		if table.Partitions[i].Number == 0 {
+			n := 1
+			for used[n] {
+				n++
+			}
+			used[n] = true
+			table.Partitions[i].Number = n
+		}
+		table.Partitions[i].Start = extents[i][0] * sectorSize
+		table.Partitions[i].Size = (extents[i][1] - extents[i][0] + 1) * sectorSize
+	}
+
+	return extents, nil
+}
+
+// randomGUID returns a random (version 4) GUID.
+func randomGUID() (string, error) {
+	b, err := randuuid.New()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])), nil
+}
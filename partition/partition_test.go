@@ -0,0 +1,252 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition_test
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/dpeckett/ext4/partition"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGPT(t *testing.T) {
+	imagePath := createDisk(t, 64<<20)
+
+	table, err := partition.Create(imagePath, partition.Table{
+		Type: partition.GPT,
+		Partitions: []partition.Partition{
+			{Size: 8 << 20, Type: partition.TypeEFISystem, Name: "EFI"},
+			{Type: partition.TypeLinuxFilesystem, Name: "root"},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, table.Partitions, 2)
+	require.Equal(t, int64(1<<20), table.Partitions[0].Start)
+	require.Equal(t, int64(8<<20), table.Partitions[0].Size)
+	require.Equal(t, int64(9<<20), table.Partitions[1].Start)
+	// The backup GPT occupies the last 33 sectors.
+	require.Equal(t, int64(64<<20)-int64(9<<20)-33*512, table.Partitions[1].Size)
+
+	read, err := partition.Read(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, table, read)
+
+	t.Log("Growing the disk and partition")
+
+	require.NoError(t, os.Truncate(imagePath, 128<<20))
+
+	p, err := partition.Resize(imagePath, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(128<<20)-int64(9<<20)-33*512, p.Size)
+
+	read, err = partition.Read(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, p.Size, read.Partitions[1].Size)
+	require.Equal(t, table.Partitions[1].UUID, read.Partitions[1].UUID)
+
+	t.Log("Creating a filesystem in the partition")
+
+	ctx := context.Background()
+	c := ext4.NewClient()
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:          imagePath,
+		Size:            ext4.Size(p.Size),
+		ExtendedOptions: ext4.ExtendedOptions{Offset: p.Start},
+	})
+	require.NoError(t, err)
+
+	read, err = partition.Read(imagePath)
+	require.NoError(t, err)
+	require.Len(t, read.Partitions, 2)
+
+	t.Log("Overlapping partitions")
+
+	_, err = partition.Create(imagePath, partition.Table{
+		Type: partition.GPT,
+		Partitions: []partition.Partition{
+			{Start: 1 << 20, Size: 8 << 20},
+			{Start: 4 << 20, Size: 8 << 20},
+		},
+	})
+	require.Error(t, err)
+}
+
+func TestGPTCorrupt(t *testing.T) {
+	imagePath := createDisk(t, 16<<20)
+
+	_, err := partition.Create(imagePath, partition.Table{
+		Type:       partition.GPT,
+		Partitions: []partition.Partition{{Type: partition.TypeLinuxFilesystem}},
+	})
+	require.NoError(t, err)
+
+	disk, err := os.ReadFile(imagePath)
+	require.NoError(t, err)
+
+	// The primary header is in the second sector, followed by the entries.
+	header, entries := disk[512:1024], disk[1024:]
+
+	t.Log("Reading an entry that ends before it starts")
+
+	corrupt := slices.Clone(disk)
+	binary.LittleEndian.PutUint64(corrupt[1024+40:], binary.LittleEndian.Uint64(entries[32:])-1)
+	writeGPT(t, imagePath, corrupt)
+
+	_, err = partition.Read(imagePath)
+	require.ErrorContains(t, err, "invalid GPT entry 1")
+
+	t.Log("Reading entries that aren't a power of two in size")
+
+	corrupt = slices.Clone(disk)
+	binary.LittleEndian.PutUint32(corrupt[512+84:], 3*binary.LittleEndian.Uint32(header[84:]))
+	writeGPT(t, imagePath, corrupt)
+
+	_, err = partition.Read(imagePath)
+	require.ErrorContains(t, err, "unsupported GPT entry layout")
+}
+
+// writeGPT writes a disk image, after recomputing the checksums of its
+// primary GPT header and entries.
+func writeGPT(t *testing.T, imagePath string, disk []byte) {
+	header := disk[512:1024]
+	entryCount, entrySize := binary.LittleEndian.Uint32(header[80:]), binary.LittleEndian.Uint32(header[84:])
+
+	entries := disk[1024:]
+	if size := int(entryCount * entrySize); size <= len(entries) {
+		binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries[:size]))
+	}
+
+	binary.LittleEndian.PutUint32(header[16:], 0)
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:binary.LittleEndian.Uint32(header[12:])]))
+
+	require.NoError(t, os.WriteFile(imagePath, disk, 0o644))
+}
+
+func TestMBR(t *testing.T) {
+	imagePath := createDisk(t, 64<<20)
+
+	table, err := partition.Create(imagePath, partition.Table{
+		Type:   partition.MBR,
+		DiskID: "12345678",
+		Partitions: []partition.Partition{
+			{Size: 16 << 20, Type: partition.TypeMBREFISystem, Bootable: true},
+			{},
+		},
+	})
+	require.NoError(t, err)
+
+	read, err := partition.Read(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, table, read)
+
+	require.Equal(t, "12345678", read.DiskID)
+	require.Len(t, read.Partitions, 2)
+	require.True(t, read.Partitions[0].Bootable)
+	require.Equal(t, "ef", read.Partitions[0].Type)
+	require.Equal(t, "83", read.Partitions[1].Type)
+	require.Equal(t, int64(64<<20)-int64(17<<20), read.Partitions[1].Size)
+
+	t.Log("Shrinking a partition")
+
+	p, err := partition.Resize(imagePath, 2, 8<<20)
+	require.NoError(t, err)
+	require.Equal(t, int64(8<<20), p.Size)
+
+	t.Log("Replacing with a GPT")
+
+	_, err = partition.Create(imagePath, partition.Table{
+		Type:       partition.GPT,
+		Partitions: []partition.Partition{{}},
+	})
+	require.NoError(t, err)
+
+	read, err = partition.Read(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, partition.GPT, read.Type)
+
+	t.Log("Reading an unpartitioned disk")
+
+	_, err = partition.Read(createDisk(t, 1<<20))
+	require.ErrorIs(t, err, partition.ErrNoPartitionTable)
+}
+
+func TestKernelPartitionScan(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("attaching loop devices requires root")
+	}
+
+	imagePath := createDisk(t, 64<<20)
+
+	table, err := partition.Create(imagePath, partition.Table{
+		Type: partition.GPT,
+		Partitions: []partition.Partition{
+			{Size: 8 << 20, Type: partition.TypeEFISystem},
+			{},
+		},
+	})
+	require.NoError(t, err)
+
+	device, detach, err := loopback.Attach(imagePath, loopback.Options{PartitionScan: true})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	// The kernel verifies the checksums of the GPT, and ignores it if they are
+	// invalid.
+	for _, p := range table.Partitions {
+		name := filepath.Base(partition.Path(device, p.Number))
+		data, err := os.ReadFile(filepath.Join("/sys/class/block", name, "size"))
+		if os.IsNotExist(err) && p.Number == 1 {
+			t.Skip("kernel does not support GPT partitions")
+		}
+		require.NoError(t, err)
+
+		sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		require.NoError(t, err)
+		require.Equal(t, p.Size, sectors*512)
+	}
+}
+
+func TestPath(t *testing.T) {
+	require.Equal(t, "/dev/sda1", partition.Path("/dev/sda", 1))
+	require.Equal(t, "/dev/nvme0n1p2", partition.Path("/dev/nvme0n1", 2))
+	require.Equal(t, "/dev/loop0p1", partition.Path("/dev/loop0", 1))
+}
+
+func createDisk(t *testing.T, size int64) string {
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+	require.NoError(t, os.Truncate(imagePath, size))
+
+	return imagePath
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package partition
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sectorSize returns the logical sector size of a block device (or 512 bytes
+// for regular files).
+func sectorSize(f *os.File) (int, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 {
+		return 512, nil
+	}
+
+	return unix.IoctlGetInt(int(f.Fd()), unix.BLKSSZGET)
+}
+
+// rereadPartitions asks the kernel to re-read the partition table of a block
+// device (regular files are ignored).
+func rereadPartitions(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+
+	// Loop devices without partition scanning enabled don't support
+	// re-reading partitions, which isn't an error.
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.BLKRRPART, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("failed to re-read partitions: %w", err)
+	}
+
+	return nil
+}
+
+// resizeKernelPartition tells the kernel the new size of a partition on a
+// block device, without re-reading the whole partition table (which fails
+// when any partition is in use). If the kernel doesn't know about the
+// partition, the table is re-read instead. Regular files are ignored.
+func resizeKernelPartition(f *os.File, p *Partition) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+
+	part := unix.BlkpgPartition{
+		Start:  p.Start,
+		Length: p.Size,
+		Pno:    int32(p.Number),
+	}
+	arg := unix.BlkpgIoctlArg{
+		Op:      unix.BLKPG_RESIZE_PARTITION,
+		Datalen: int32(unsafe.Sizeof(part)),
+		Data:    (*byte)(unsafe.Pointer(&part)),
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKPG, uintptr(unsafe.Pointer(&arg)))
+	switch {
+	case errno == 0:
+		return nil
+	case errno == unix.ENXIO || errno == unix.EINVAL:
+		// The partition doesn't exist (or the device isn't partitioned).
+		return rereadPartitions(f)
+	default:
+		return fmt.Errorf("failed to resize partition %d: %w", p.Number, errno)
+	}
+}
@@ -0,0 +1,346 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// IDMapping maps a contiguous range of host user (or group) IDs to IDs within
+// the filesystem, as with user namespaces.
+type IDMapping struct {
+	// HostID is the first host ID in the range.
+	HostID uint32
+	// ID is the first ID within the filesystem that HostID is mapped to.
+	ID uint32
+	// Size is the number of IDs in the range.
+	Size uint32
+}
+
+// ModeOverride overrides the permissions of the files matching a pattern.
+type ModeOverride struct {
+	// Pattern is matched (using path.Match) against the slash separated path
+	// of each file, relative to the root directory (eg. "etc/shadow").
+	Pattern string
+	// Mode is the permission bits (including setuid, setgid and sticky) to
+	// apply to matching files.
+	Mode fs.FileMode
+}
+
+// PopulateOptions control how the contents of CreateOptions.RootDirectory are
+// copied into a new filesystem. mke2fs copies host ownership and permissions
+// verbatim, which is rarely correct when building eg. a container rootfs as an
+// unprivileged user.
+type PopulateOptions struct {
+	// UIDMap maps host user IDs to user IDs within the filesystem.
+	UIDMap []IDMapping
+	// GIDMap maps host group IDs to group IDs within the filesystem.
+	GIDMap []IDMapping
+	// UID is the owner of files whose host user ID is not mapped. If unset,
+	// the host user ID is preserved.
+	UID *uint32
+	// GID is the group of files whose host group ID is not mapped. If unset,
+	// the host group ID is preserved.
+	GID *uint32
+	// Modes override the permissions of matching files. Where multiple
+	// overrides match a file, the last one wins.
+	Modes []ModeOverride
+	// Exclude are patterns (matched using path.Match against the slash
+	// separated path of each file, relative to the root directory) of files
+	// to leave out of the filesystem. Excluding a directory excludes all of
+	// its contents. The rest of the root directory is staged (hard linked
+	// where possible) alongside it, so that excluded files are never copied.
+	Exclude []string
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts PopulateOptions) Validate() error {
+	for _, pattern := range opts.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return invalidOption("bad exclude pattern %q", pattern)
+		}
+	}
+
+	for _, override := range opts.Modes {
+		if _, err := path.Match(override.Pattern, ""); err != nil {
+			return invalidOption("bad mode pattern %q", override.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// populate fixes up the ownership, and permissions, of the files copied into
+// a filesystem from the host rootDir by mke2fs -d (skipping excluded files,
+// which are left out by stageRootDirectory). The requests are run first (eg.
+// to restore the metadata of staged files).
+func (c *Client) populate(ctx context.Context, device, rootDir string, opts PopulateOptions, requests []string) error {
+	err := filepath.WalkDir(rootDir, func(hostPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(rootDir, hostPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		imagePath := path.Join("/", relPath)
+
+		if relPath != "." && matchesAny(opts.Exclude, relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hostUID, hostGID := fileOwner(fi)
+		if uid, ok := mapID(opts.UIDMap, opts.UID, hostUID); ok {
+			requests = append(requests, debugfsRequest("sif", imagePath, "uid", strconv.FormatUint(uint64(uid), 10)))
+		}
+		if gid, ok := mapID(opts.GIDMap, opts.GID, hostGID); ok {
+			requests = append(requests, debugfsRequest("sif", imagePath, "gid", strconv.FormatUint(uint64(gid), 10)))
+		}
+
+		for i := len(opts.Modes) - 1; i >= 0; i-- {
+			if ok, _ := path.Match(opts.Modes[i].Pattern, relPath); ok {
+				mode := inodeMode(fi.Mode().Type() | opts.Modes[i].Mode)
+				requests = append(requests, debugfsRequest("sif", imagePath, "mode", "0"+strconv.FormatUint(uint64(mode), 8)))
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk root directory: %w", err)
+	}
+
+	if len(requests) == 0 {
+		return nil
+	}
+
+	_, err = c.debugfs(ctx, device, true, requests...)
+	return err
+}
+
+// stageRootDirectory stages the files of rootDir that aren't excluded in a
+// new directory for mke2fs -d, so that excluded files are never copied into
+// the filesystem. The caller must remove the staging directory.
+//
+// Files are hard linked into the staging directory where possible, which
+// preserves all of their metadata. Otherwise (eg. across filesystems) they're
+// copied, and the returned debugfs requests restore their ownership,
+// permissions and modification times (and create device nodes and FIFOs).
+// Directories are always recreated, so lose any extended attributes.
+func (c *Client) stageRootDirectory(rootDir string, exclude []string) (string, []string, error) {
+	// Staging alongside the root directory allows files to be hard linked.
+	stagingDir, err := os.MkdirTemp(filepath.Dir(filepath.Clean(rootDir)), ".ext4-populate-")
+	if err != nil {
+		stagingDir, err = os.MkdirTemp("", "ext4-populate-")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+	}
+
+	var requests []string
+	err = filepath.WalkDir(rootDir, func(hostPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Eg. when staging the host's root directory.
+		if hostPath == stagingDir {
+			return filepath.SkipDir
+		}
+
+		relPath, err := filepath.Rel(rootDir, hostPath)
+		if err != nil {
+			return err
+		}
+		imagePath := path.Join("/", filepath.ToSlash(relPath))
+
+		if relPath != "." && matchesAny(exclude, filepath.ToSlash(relPath)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		stagedPath := filepath.Join(stagingDir, relPath)
+		mode := fi.Mode()
+		switch {
+		case mode.IsDir():
+			if relPath != "." {
+				if err := os.Mkdir(stagedPath, 0o755); err != nil {
+					return err
+				}
+			}
+		case os.Link(hostPath, stagedPath) == nil:
+			// Hard links share the metadata of the original.
+			return nil
+		case mode.IsRegular():
+			f, err := os.Open(hostPath)
+			if err != nil {
+				return err
+			}
+			err = writeStagedFile(stagedPath, f)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case mode&fs.ModeSymlink != 0:
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, stagedPath); err != nil {
+				return err
+			}
+		case mode&fs.ModeNamedPipe != 0:
+			requests = append(requests,
+				debugfsRequest("cd", path.Dir(imagePath)),
+				debugfsRequest("mknod", path.Base(imagePath), "p"))
+		case mode&fs.ModeDevice != 0:
+			devType := "b"
+			if mode&fs.ModeCharDevice != 0 {
+				devType = "c"
+			}
+
+			major, minor := fileDevice(fi)
+			requests = append(requests,
+				debugfsRequest("cd", path.Dir(imagePath)),
+				debugfsRequest("mknod", path.Base(imagePath), devType,
+					strconv.FormatUint(uint64(major), 10), strconv.FormatUint(uint64(minor), 10)))
+		default:
+			// debugfs can't create sockets (which are only meaningful while
+			// bound by a process anyway).
+			if c.logger != nil {
+				c.logger.Warn("Skipping socket", slog.String("path", hostPath))
+			}
+			return nil
+		}
+
+		uid, gid := fileOwner(fi)
+		requests = append(requests,
+			debugfsRequest("sif", imagePath, "uid", strconv.FormatUint(uint64(uid), 10)),
+			debugfsRequest("sif", imagePath, "gid", strconv.FormatUint(uint64(gid), 10)),
+			debugfsRequest("sif", imagePath, "mode", "0"+strconv.FormatUint(uint64(inodeMode(mode)), 8)),
+			debugfsRequest("sif", imagePath, "mtime", "@"+strconv.FormatInt(fi.ModTime().Unix(), 10)))
+
+		return nil
+	})
+	if err != nil {
+		_ = os.RemoveAll(stagingDir)
+		return "", nil, fmt.Errorf("failed to stage root directory: %w", err)
+	}
+
+	return stagingDir, requests, nil
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mapID maps a host ID to an ID within the filesystem, returning false if the
+// host ID should be preserved.
+func mapID(mappings []IDMapping, defaultID *uint32, hostID uint32) (uint32, bool) {
+	for _, m := range mappings {
+		if hostID >= m.HostID && hostID-m.HostID < m.Size {
+			return m.ID + (hostID - m.HostID), true
+		}
+	}
+
+	if defaultID != nil {
+		return *defaultID, true
+	}
+
+	return 0, false
+}
+
+// Mode bits of an ext4 inode.
+const (
+	inodeModeSetuid  = 0o4000
+	inodeModeSetgid  = 0o2000
+	inodeModeSticky  = 0o1000
+	inodeModeFIFO    = 0o010000
+	inodeModeChar    = 0o020000
+	inodeModeDir     = 0o040000
+	inodeModeBlock   = 0o060000
+	inodeModeRegular = 0o100000
+	inodeModeSymlink = 0o120000
+	inodeModeSocket  = 0o140000
+)
+
+// inodeMode converts a file mode into the mode of an ext4 inode.
+func inodeMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= inodeModeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= inodeModeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= inodeModeSticky
+	}
+
+	switch {
+	case mode.IsDir():
+		m |= inodeModeDir
+	case mode&fs.ModeSymlink != 0:
+		m |= inodeModeSymlink
+	case mode&fs.ModeNamedPipe != 0:
+		m |= inodeModeFIFO
+	case mode&fs.ModeSocket != 0:
+		m |= inodeModeSocket
+	case mode&fs.ModeCharDevice != 0:
+		m |= inodeModeChar
+	case mode&fs.ModeDevice != 0:
+		m |= inodeModeBlock
+	default:
+		m |= inodeModeRegular
+	}
+
+	return m
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestPopulateCopied(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	// Files on a separate filesystem can't be hard linked into the staging
+	// directory, so are copied.
+	rootDir := t.TempDir()
+	if err := unix.Mount("tmpfs", rootDir, "tmpfs", 0, "size=16m"); err != nil {
+		t.Skipf("unable to mount tmpfs: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = unix.Unmount(rootDir, unix.MNT_DETACH)
+	})
+
+	require.NoError(t, os.Mkdir(filepath.Join(rootDir, "secret"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "secret", "key"), []byte("hello"), 0o600))
+	require.NoError(t, os.Chown(filepath.Join(rootDir, "secret", "key"), 1000, 1000))
+	require.NoError(t, os.Symlink("secret/key", filepath.Join(rootDir, "key")))
+	require.NoError(t, unix.Mkfifo(filepath.Join(rootDir, "fifo"), 0o640))
+	require.NoError(t, unix.Mknod(filepath.Join(rootDir, "null"), unix.S_IFCHR|0o666, int(unix.Mkdev(1, 3))))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "notes.tmp"), []byte("x"), 0o644))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{
+		RootDirectory: rootDir,
+		Populate:      &ext4.PopulateOptions{Exclude: []string{"*.tmp"}},
+	})
+	require.NoError(t, err)
+
+	_, _, mode := statInImage(t, imagePath, "/secret")
+	require.Equal(t, "0700", mode)
+
+	uid, gid, mode := statInImage(t, imagePath, "/secret/key")
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 1000, gid)
+	require.Equal(t, "0600", mode)
+
+	_, _, mode = statInImage(t, imagePath, "/key")
+	require.Equal(t, "0777", mode)
+
+	_, _, mode = statInImage(t, imagePath, "/fifo")
+	require.Equal(t, "0640", mode)
+
+	out, err := exec.Command("debugfs", "-R", "stat /null", imagePath).Output()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "Type: character special")
+	require.Contains(t, string(out), "Device major/minor number: 01:03")
+
+	out, err = exec.Command("debugfs", "-R", "cat /secret/key", imagePath).Output()
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(out))
+
+	out, err = exec.Command("debugfs", "-R", "stat /notes.tmp", imagePath).CombinedOutput()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "File not found")
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		NoFix:  true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+}
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopulate(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "etc", "shadow"), []byte("root:*::0:::::"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, ".git", "objects"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, ".git", "objects", "abc"), []byte("x"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "notes.tmp"), []byte("x"), 0o644))
+	require.NoError(t, os.Symlink("etc/shadow", filepath.Join(rootDir, "shadow")))
+
+	hostUID := uint32(os.Getuid())
+	defaultGID := uint32(100)
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	_, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{
+		RootDirectory: rootDir,
+		Populate: &ext4.PopulateOptions{
+			UIDMap: []ext4.IDMapping{{HostID: hostUID, ID: 100000, Size: 1}},
+			GID:    &defaultGID,
+			Modes: []ext4.ModeOverride{
+				{Pattern: "etc/*", Mode: 0o644},
+				{Pattern: "etc/shadow", Mode: 0o600},
+			},
+			Exclude: []string{".git", "*.tmp"},
+		},
+	})
+	require.NoError(t, err)
+
+	// The files are staged alongside the root directory.
+	entries, err := os.ReadDir(filepath.Dir(rootDir))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), "ext4-populate", "staging directory not removed")
+	}
+
+	uid, gid, mode := statInImage(t, imagePath, "/etc/shadow")
+	require.Equal(t, 100000, uid)
+	require.Equal(t, 100, gid)
+	require.Equal(t, "0600", mode)
+
+	uid, gid, mode = statInImage(t, imagePath, "/etc")
+	require.Equal(t, 100000, uid)
+	require.Equal(t, 100, gid)
+	require.Equal(t, "0755", mode)
+
+	uid, _, _ = statInImage(t, imagePath, "/shadow")
+	require.Equal(t, 100000, uid)
+
+	t.Log("Checking excluded files were left out")
+
+	for _, name := range []string{"/.git", "/notes.tmp"} {
+		out, err := exec.Command("debugfs", "-R", "stat "+name, imagePath).CombinedOutput()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "File not found")
+	}
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		NoFix:  true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+}
+
+func TestPopulateRemote(t *testing.T) {
+	ctx := context.Background()
+
+	// The root directory is staged on the local host, not the remote one.
+	e := &ext4test.RecordingExecutor{}
+	c := ext4.NewClient(ext4.WithExecutor(e))
+
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:        "/dev/sdb",
+		RootDirectory: "/srv/rootfs",
+		Populate:      &ext4.PopulateOptions{Exclude: []string{"tmp/*"}},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+	require.Empty(t, e.Argv())
+}
+
+var debugfsStatRegexp = regexp.MustCompile(`Mode:\s+(\d+)\s+Flags.*\n.*\nUser:\s+(\d+)\s+Group:\s+(\d+)`)
+
+// statInImage returns the ownership, and permissions, of a file in an image.
+func statInImage(t *testing.T, imagePath, path string) (int, int, string) {
+	out, err := exec.Command("debugfs", "-R", "stat "+path, imagePath).Output()
+	require.NoError(t, err)
+
+	m := debugfsStatRegexp.FindSubmatch(out)
+	require.NotNil(t, m, "unexpected debugfs output: %s", out)
+
+	uid, err := strconv.Atoi(string(m[2]))
+	require.NoError(t, err)
+
+	gid, err := strconv.Atoi(string(m[3]))
+	require.NoError(t, err)
+
+	return uid, gid, string(m[1])
+}
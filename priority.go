@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import "strconv"
+
+// IOPriorityClass is an I/O scheduling class, as understood by ionice(1).
+type IOPriorityClass int
+
+const (
+	// IOPriorityRealtime is given first access to the disk, regardless of
+	// what else is going on in the system.
+	IOPriorityRealtime IOPriorityClass = 1
+	// IOPriorityBestEffort is the default scheduling class.
+	IOPriorityBestEffort IOPriorityClass = 2
+	// IOPriorityIdle only gets disk time when no other process has asked
+	// for disk I/O for a defined grace period.
+	IOPriorityIdle IOPriorityClass = 3
+)
+
+// ioPriority is the I/O scheduling class and level to run commands with.
+type ioPriority struct {
+	class IOPriorityClass
+	level int
+}
+
+// withPriority wraps a command line with ionice and/or nice, if an I/O or CPU
+// priority has been configured.
+func (c *Client) withPriority(cmdPath string, cmdArgs []string) (string, []string, error) {
+	if c.cpuPriority != nil {
+		nicePath, err := c.findExecutable("nice")
+		if err != nil {
+			return "", nil, err
+		}
+
+		cmdArgs = append([]string{"-n", strconv.Itoa(*c.cpuPriority), cmdPath}, cmdArgs...)
+		cmdPath = nicePath
+	}
+
+	if c.ioPriority != nil {
+		ionicePath, err := c.findExecutable("ionice")
+		if err != nil {
+			return "", nil, err
+		}
+
+		ioniceArgs := []string{"-c", strconv.Itoa(int(c.ioPriority.class))}
+		// The idle class has no priority levels.
+		if c.ioPriority.class != IOPriorityIdle {
+			ioniceArgs = append(ioniceArgs, "-n", strconv.Itoa(c.ioPriority.level))
+		}
+
+		cmdArgs = append(append(ioniceArgs, cmdPath), cmdArgs...)
+		cmdPath = ionicePath
+	}
+
+	return cmdPath, cmdArgs, nil
+}
@@ -0,0 +1,173 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// QuotaType is a type of disk quota.
+type QuotaType string
+
+const (
+	// UserQuota limits the usage of each user.
+	UserQuota QuotaType = "usrquota"
+	// GroupQuota limits the usage of each group.
+	GroupQuota QuotaType = "grpquota"
+	// ProjectQuota limits the usage of each project (directory tree), and
+	// requires inodes of at least 256 bytes.
+	ProjectQuota QuotaType = "prjquota"
+)
+
+// validateQuotaTypes checks that the quota types are known, and not repeated.
+func validateQuotaTypes(types []QuotaType) error {
+	for i, t := range types {
+		if t != UserQuota && t != GroupQuota && t != ProjectQuota {
+			return invalidOption("unknown quota type %q", t)
+		}
+		if slices.Contains(types[:i], t) {
+			return invalidOption("duplicate quota type %q", t)
+		}
+	}
+
+	return nil
+}
+
+// Quotas returns the types of quota enabled on the filesystem.
+func (sb *SuperblockInfo) Quotas() []QuotaType {
+	var types []QuotaType
+	if sb.UserQuotaInode != 0 {
+		types = append(types, UserQuota)
+	}
+	if sb.GroupQuotaInode != 0 {
+		types = append(types, GroupQuota)
+	}
+	if sb.ProjectQuotaInode != 0 {
+		types = append(types, ProjectQuota)
+	}
+
+	return types
+}
+
+// EnableQuotas enables quota tracking on an unmounted filesystem with
+// tune2fs, using the ext4 quota feature (in which quota usage is stored in
+// hidden inodes, and kept up to date by the kernel and e2fsck, so no quota
+// files need to be initialized). Returns the updated superblock.
+func (c *Client) EnableQuotas(ctx context.Context, device string, types ...QuotaType) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "EnableQuotas", device)
+	defer endSpan(span, &err)
+
+	if len(types) == 0 {
+		return nil, invalidOption("at least one quota type is required")
+	}
+
+	return c.setQuotas(ctx, device, types, "")
+}
+
+// DisableQuotas disables quota tracking on an unmounted filesystem with
+// tune2fs, removing the quota feature once no quota types remain. Returns the
+// updated superblock.
+func (c *Client) DisableQuotas(ctx context.Context, device string, types ...QuotaType) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "DisableQuotas", device)
+	defer endSpan(span, &err)
+
+	if len(types) == 0 {
+		return nil, invalidOption("at least one quota type is required")
+	}
+
+	return c.setQuotas(ctx, device, types, "^")
+}
+
+// setQuotas enables (or with the "^" prefix, disables) quota types.
+func (c *Client) setQuotas(ctx context.Context, device string, types []QuotaType, prefix string) (*SuperblockInfo, error) {
+	if device == "" {
+		return nil, invalidOption("device is required")
+	}
+
+	if err := validateQuotaTypes(types); err != nil {
+		return nil, err
+	}
+
+	unlock, err := c.requireUnmounted(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" && slices.Contains(types, ProjectQuota) && sb.InodeSize < 256 {
+		return nil, invalidOption("project quotas require inodes of at least 256 bytes (found %d)", sb.InodeSize)
+	}
+
+	quotaTypes := make([]string, len(types))
+	for i, t := range types {
+		quotaTypes[i] = prefix + string(t)
+	}
+
+	if err := c.tune2fs(ctx, device, "-Q", strings.Join(quotaTypes, ",")); err != nil {
+		return nil, fmt.Errorf("failed to update quotas: %w", err)
+	}
+
+	return c.ReadSuperblock(ctx, device)
+}
+
+// QuotaCheck scans the filesystem mounted at mountPoint with quotacheck, and
+// creates fresh quota files (eg. aquota.user) in its root directory. This is
+// only needed for filesystems mounted with legacy quota files (eg. with the
+// usrjquota mount option), rather than the quota feature (see EnableQuotas).
+// Quotas must then be turned on with quotaon.
+func (c *Client) QuotaCheck(ctx context.Context, mountPoint string, types ...QuotaType) (err error) {
+	ctx, span := c.startSpan(ctx, "QuotaCheck", mountPoint)
+	defer endSpan(span, &err)
+
+	if len(types) == 0 {
+		return invalidOption("at least one quota type is required")
+	}
+
+	if err := validateQuotaTypes(types); err != nil {
+		return err
+	}
+
+	// Create new files rather than reading the existing ones, and scan the
+	// filesystem without remounting it read-only.
+	cmdArgs := []string{"--create-files", "--no-remount"}
+	for _, t := range types {
+		switch t {
+		case UserQuota:
+			cmdArgs = append(cmdArgs, "--user")
+		case GroupQuota:
+			cmdArgs = append(cmdArgs, "--group")
+		case ProjectQuota:
+			cmdArgs = append(cmdArgs, "--project")
+		}
+	}
+	cmdArgs = append(cmdArgs, mountPoint)
+
+	if _, err := c.run(ctx, "quotacheck", cmdArgs...); err != nil {
+		return fmt.Errorf("failed to initialize quota files: %w", err)
+	}
+
+	return nil
+}
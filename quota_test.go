@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateFilesystemWithQuotas(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+
+	inodeSize := 256
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		Size:      64 * ext4.MiB,
+		InodeSize: &inodeSize,
+		Quotas:    []ext4.QuotaType{ext4.UserQuota, ext4.GroupQuota, ext4.ProjectQuota},
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "quota")
+	require.Contains(t, sb.Features, "project")
+	require.Equal(t, []ext4.QuotaType{ext4.UserQuota, ext4.GroupQuota, ext4.ProjectQuota}, sb.Quotas())
+
+	t.Log("Creating a filesystem with invalid quota options")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Quotas: []ext4.QuotaType{"diskquota"},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	inodeSize = 128
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:    imagePath,
+		InodeSize: &inodeSize,
+		Quotas:    []ext4.QuotaType{ext4.ProjectQuota},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestEnableQuotas(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Empty(t, sb.Quotas())
+
+	sb, err = c.EnableQuotas(ctx, imagePath, ext4.UserQuota)
+	require.NoError(t, err)
+	require.Equal(t, []ext4.QuotaType{ext4.UserQuota}, sb.Quotas())
+
+	sb, err = c.EnableQuotas(ctx, imagePath, ext4.GroupQuota, ext4.ProjectQuota)
+	require.NoError(t, err)
+	require.Equal(t, []ext4.QuotaType{ext4.UserQuota, ext4.GroupQuota, ext4.ProjectQuota}, sb.Quotas())
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+
+	t.Log("Disabling quotas")
+
+	sb, err = c.DisableQuotas(ctx, imagePath, ext4.UserQuota)
+	require.NoError(t, err)
+	require.Equal(t, []ext4.QuotaType{ext4.GroupQuota, ext4.ProjectQuota}, sb.Quotas())
+
+	sb, err = c.DisableQuotas(ctx, imagePath, ext4.GroupQuota, ext4.ProjectQuota)
+	require.NoError(t, err)
+	require.Empty(t, sb.Quotas())
+	require.NotContains(t, sb.Features, "quota")
+
+	_, err = c.EnableQuotas(ctx, imagePath)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = c.EnableQuotas(ctx, imagePath, ext4.UserQuota, ext4.UserQuota)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestQuotaCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Log("Checking quotas in dry-run mode")
+
+	c := ext4.NewClient(ext4.WithDryRun(), ext4.WithToolPath("quotacheck", "/usr/sbin/quotacheck"))
+
+	err := c.QuotaCheck(ctx, "/srv", ext4.UserQuota, ext4.GroupQuota)
+	var dryRunErr *ext4.DryRunError
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, []string{"--create-files", "--no-remount", "--user", "--group", "/srv"}, dryRunErr.Argv[1:])
+
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	if _, err := exec.LookPath("quotacheck"); err != nil {
+		t.Skip("quotacheck not found")
+	}
+
+	c = ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	mountPath := t.TempDir()
+	if out, err := exec.Command("mount", "-o", "loop,usrjquota=aquota.user,jqfmt=vfsv1", imagePath, mountPath).CombinedOutput(); err != nil {
+		t.Skipf("unable to mount image: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	require.NoError(t, c.QuotaCheck(ctx, mountPath, ext4.UserQuota))
+	require.FileExists(t, filepath.Join(mountPath, "aquota.user"))
+}
@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysClassBlockDir is where the kernel exposes the block devices (and their
+// partitions).
+const sysClassBlockDir = "/sys/class/block"
+
+// defaultRAIDBlockSize is the block size assumed when deriving the stride from
+// RAID geometry, if none is given (the mke2fs default for most filesystems).
+const defaultRAIDBlockSize = 4096
+
+// RAIDGeometry describes the layout of a striped RAID array (eg. RAID 0, 5, 6
+// or 10), so that the filesystem can align its allocations to the stripes.
+type RAIDGeometry struct {
+	// ChunkSize is the amount of data written to each disk before moving on
+	// to the next (sometimes called the stripe unit).
+	ChunkSize Size
+	// DataDisks is the number of disks holding data in each stripe, excluding
+	// parity (eg. 3 for a four disk RAID 5 array).
+	DataDisks int
+}
+
+// Validate checks the geometry for obvious mistakes.
+func (g RAIDGeometry) Validate() error {
+	var errs []error
+	if g.ChunkSize <= 0 {
+		errs = append(errs, invalidOption("invalid RAID chunk size %d", int64(g.ChunkSize)))
+	}
+	if g.DataDisks <= 0 {
+		errs = append(errs, invalidOption("invalid number of RAID data disks %d", g.DataDisks))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Stride returns the stride and stripe_width extended options (in filesystem
+// blocks) for the geometry. The chunk size must be a multiple of the block
+// size.
+func (g RAIDGeometry) Stride(blockSize int) (stride, stripeWidth int, err error) {
+	if err := g.Validate(); err != nil {
+		return 0, 0, err
+	}
+	if !validBlockSize(blockSize) {
+		return 0, 0, invalidOption("invalid block size %d", blockSize)
+	}
+	if g.ChunkSize%Size(blockSize) != 0 {
+		return 0, 0, invalidOption("RAID chunk size %s is not a multiple of the block size %d", g.ChunkSize, blockSize)
+	}
+
+	stride = int(g.ChunkSize / Size(blockSize))
+	return stride, stride * g.DataDisks, nil
+}
+
+// ReadRAIDGeometry reads the RAID geometry of a block device (eg. an md or
+// device-mapper array, or a partition of one) from the I/O topology the kernel
+// exposes in sysfs. Returns nil if the device doesn't report a striped layout,
+// or isn't a block device (eg. an image file).
+func ReadRAIDGeometry(device string) (*RAIDGeometry, error) {
+	fi, err := os.Stat(device)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, nil
+	}
+
+	// Resolve symlinks (eg. /dev/mapper/data -> /dev/dm-0) to find the kernel
+	// name of the device.
+	path, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceDir, err := filepath.EvalSymlinks(filepath.Join(sysClassBlockDir, filepath.Base(path)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s in sysfs: %w", device, err)
+	}
+
+	// Partitions inherit the queue of their parent device.
+	queueDir := filepath.Join(deviceDir, "queue")
+	if _, err := os.Stat(filepath.Join(deviceDir, "partition")); err == nil {
+		queueDir = filepath.Join(filepath.Dir(deviceDir), "queue")
+	}
+
+	minimumIOSize, err := readSysfsUint(filepath.Join(queueDir, "minimum_io_size"))
+	if err != nil {
+		return nil, err
+	}
+	optimalIOSize, err := readSysfsUint(filepath.Join(queueDir, "optimal_io_size"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Devices that aren't striped report an optimal I/O size of zero (or
+	// equal to the minimum).
+	if minimumIOSize == 0 || optimalIOSize <= minimumIOSize || optimalIOSize%minimumIOSize != 0 {
+		return nil, nil
+	}
+
+	return &RAIDGeometry{
+		ChunkSize: Size(minimumIOSize),
+		DataDisks: int(optimalIOSize / minimumIOSize),
+	}, nil
+}
+
+// readSysfsUint reads an unsigned integer attribute from sysfs.
+func readSysfsUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRAIDGeometry(t *testing.T) {
+	// A four disk RAID 5 array, with 512 KiB chunks.
+	geometry := ext4.RAIDGeometry{ChunkSize: 512 * ext4.KiB, DataDisks: 3}
+
+	stride, stripeWidth, err := geometry.Stride(4096)
+	require.NoError(t, err)
+	require.Equal(t, 128, stride)
+	require.Equal(t, 384, stripeWidth)
+
+	_, _, err = ext4.RAIDGeometry{ChunkSize: 2 * ext4.KiB, DataDisks: 2}.Stride(4096)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, _, err = ext4.RAIDGeometry{ChunkSize: 64 * ext4.KiB}.Stride(4096)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	t.Log("Reading the geometry of an image file")
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+
+	detected, err := ext4.ReadRAIDGeometry(imagePath)
+	require.NoError(t, err)
+	require.Nil(t, detected)
+
+	t.Log("Creating a filesystem with RAID geometry")
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:       imagePath,
+		Size:         64 * ext4.MiB,
+		RAIDGeometry: &geometry,
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, 4096, sb.BlockSize)
+	require.Equal(t, uint64(128), sb.RAIDStride)
+	require.Equal(t, uint64(384), sb.RAIDStripeWidth)
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:             imagePath,
+		Size:               64 * ext4.MiB,
+		DetectRAIDGeometry: true,
+	})
+	require.NoError(t, err)
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"detect":   {Device: imagePath, RAIDGeometry: &geometry, DetectRAIDGeometry: true},
+		"stride":   {Device: imagePath, RAIDGeometry: &geometry, ExtendedOptions: ext4.ExtendedOptions{Stride: 16}},
+		"geometry": {Device: imagePath, RAIDGeometry: &ext4.RAIDGeometry{ChunkSize: 1000, DataDisks: 2}},
+	} {
+		require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+	}
+}
@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrShrinkMounted is returned when attempting to shrink a mounted filesystem,
+// which the kernel does not support. The filesystem must be unmounted first.
+var ErrShrinkMounted = errors.New("mounted filesystems cannot be shrunk")
+
+// ResizeResult describes the outcome of resizing a filesystem.
+type ResizeResult struct {
+	// OldBlockCount is the size of the filesystem in blocks before resizing.
+	OldBlockCount uint64 `json:"oldBlockCount"`
+	// NewBlockCount is the size of the filesystem in blocks after resizing.
+	NewBlockCount uint64 `json:"newBlockCount"`
+	// BlockSize in bytes.
+	BlockSize int `json:"blockSize"`
+	// Online is true if the filesystem was mounted and resized online.
+	Online bool `json:"online"`
+	// Check is the result of the filesystem check performed before resizing
+	// (if requested).
+	Check *CheckResult `json:"check,omitempty"`
+}
+
+var (
+	resize2fsMinimumSizeRegexp = regexp.MustCompile(`Estimated minimum size of the filesystem: (\d+)`)
+	resize2fsNewSizeRegexp     = regexp.MustCompile(`(?:is now|is already) (\d+) \((\d+)k\) blocks long`)
+	resize2fsOnlineRegexp      = regexp.MustCompile(`on-line resiz`)
+)
+
+// ParseResizeResult parses the output of resize2fs. The old block count isn't
+// reported by resize2fs, so is left unset.
+func ParseResizeResult(out []byte) (*ResizeResult, error) {
+	var result ResizeResult
+	var found bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := resize2fsNewSizeRegexp.FindStringSubmatch(line); m != nil {
+			result.NewBlockCount = parseUint64(m[1])
+			result.BlockSize = int(parseUint64(m[2])) * 1024
+			found = true
+		} else if resize2fsOnlineRegexp.MatchString(line) {
+			result.Online = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("unexpected resize2fs output")
+	}
+
+	return &result, nil
+}
+
+// resizeProgressWidth is the number of characters in each resize2fs -p
+// progress bar.
+const resizeProgressWidth = 40
+
+var resize2fsBeginPassRegexp = regexp.MustCompile(`^Begin pass (\d+) \(max = (\d+)\)$`)
+
+// resizeProgressWriter parses the progress bars written by resize2fs -p. Each
+// pass begins with a "Begin pass N (max = M)" line, followed by a label and a
+// bar that is filled in with one "X" per 1/40th of the pass.
+type resizeProgressWriter struct {
+	progress func(pass int, cur, max float64)
+	line     []byte
+	pass     int
+	max      float64
+	filled   int
+	inBar    bool
+}
+
+func (w *resizeProgressWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch {
+		case b == '\n':
+			if m := resize2fsBeginPassRegexp.FindSubmatch(w.line); m != nil {
+				w.pass = int(parseUint32(string(m[1])))
+				w.max = float64(parseUint64(string(m[2])))
+				w.filled = 0
+			}
+			w.line = w.line[:0]
+			w.inBar = false
+		case b == '\b':
+			// The bar is drawn empty, then the cursor is moved back to its start.
+			w.inBar = true
+		case b == 'X' && w.inBar && w.pass > 0:
+			if w.filled < resizeProgressWidth {
+				w.filled++
+				w.progress(w.pass, w.max*float64(w.filled)/resizeProgressWidth, w.max)
+			}
+		default:
+			if !w.inBar {
+				w.line = append(w.line, b)
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+// minimumBlockCount returns resize2fs's estimate of the minimum size (in
+// blocks) that a filesystem can be shrunk to.
+func (c *Client) minimumBlockCount(ctx context.Context, device string) (uint64, error) {
+	out, err := c.run(ctx, "resize2fs", "-P", device)
+	if err != nil {
+		return 0, err
+	}
+
+	m := resize2fsMinimumSizeRegexp.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("unexpected resize2fs output")
+	}
+
+	return parseUint64(string(m[1])), nil
+}
@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeFilesystem(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	result, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   128 * ext4.MiB,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(65536), result.OldBlockCount)
+	require.Equal(t, uint64(131072), result.NewBlockCount)
+	require.Equal(t, 1024, result.BlockSize)
+	require.False(t, result.Online)
+
+	t.Log("Resizing to the current size")
+
+	result, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   128 * ext4.MiB,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, result.OldBlockCount, result.NewBlockCount)
+}
+
+func TestResizeFilesystemProgress(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	// Populate the filesystem so that shrinking it requires relocating data.
+	hostPath := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(hostPath, make([]byte, 256*1024), 0o644))
+
+	for i := 0; i < 32; i++ {
+		err := c.WriteFileToImage(ctx, imagePath, hostPath, fmt.Sprintf("/file%d", i))
+		require.NoError(t, err)
+	}
+
+	passes := make(map[int]float64)
+	_, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   16 * ext4.MiB,
+		Force:  true,
+		Progress: func(pass int, cur, max float64) {
+			passes[pass] = cur / max
+		},
+	})
+	require.NoError(t, err)
+
+	require.NotEmpty(t, passes)
+	for pass, completion := range passes {
+		require.Equal(t, 1.0, completion, "pass %d did not complete", pass)
+	}
+}
+
+func TestResizeFilesystemCheck(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	// Make it appear as though the filesystem has been mounted since it was
+	// last checked.
+	cmd := exec.Command("debugfs", "-w", "-f", "-", imagePath)
+	cmd.Stdin = strings.NewReader("ssv mtime 20200101\nssv lastcheck 20100101\n")
+	require.NoError(t, cmd.Run())
+
+	_, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   32 * ext4.MiB,
+	})
+	require.ErrorContains(t, err, "e2fsck -f")
+
+	t.Log("Resizing with a check first")
+
+	result, err := c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   32 * ext4.MiB,
+		Check:  true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(32768), result.NewBlockCount)
+	require.NotNil(t, result.Check)
+	require.True(t, result.Check.Status.OK())
+
+	t.Log("Resizing an inconsistent filesystem")
+
+	imagePath = filepath.Join(t.TempDir(), "noextent.img")
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:   imagePath,
+		Size:     64 * ext4.MiB,
+		Features: "^extent,^64bit",
+	})
+	require.NoError(t, err)
+
+	hostPath := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(hostPath, []byte("hello"), 0o644))
+	require.NoError(t, c.WriteFileToImage(ctx, imagePath, hostPath, "/a"))
+	require.NoError(t, c.WriteFileToImage(ctx, imagePath, hostPath, "/b"))
+
+	// Cross-link the files, which preening can't repair.
+	out, err := exec.Command("debugfs", "-R", "bmap /a 0", imagePath).Output()
+	require.NoError(t, err)
+	err = exec.Command("debugfs", "-w", "-R", "sif /b block[0] "+strings.TrimSpace(string(out)), imagePath).Run()
+	require.NoError(t, err)
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{
+		Device: imagePath,
+		Size:   32 * ext4.MiB,
+		Check:  true,
+	})
+	var checkErr *ext4.CheckError
+	require.ErrorAs(t, err, &checkErr)
+	require.NotZero(t, checkErr.Status&ext4.CheckErrorsUncorrected)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(65536), sb.BlockCount, "filesystem was resized")
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// transientErrors are fragments of error messages that indicate a command
+// failed due to a (likely) temporary condition, eg. udev still holding the
+// device open after a partition table change.
+var transientErrors = [][]byte{
+	[]byte("Device or resource busy"),
+	[]byte("is in use"),
+	[]byte("is apparently in use"),
+}
+
+// isTransientError reports whether the stderr of a failed command indicates
+// that it is worth retrying.
+func isTransientError(errOut []byte) bool {
+	for _, msg := range transientErrors {
+		if bytes.Contains(errOut, msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDelay returns how long to wait before the next attempt, doubling the
+// backoff after each failed attempt.
+func (c *Client) retryDelay(attempt int) time.Duration {
+	return c.backoff << (attempt - 1)
+}
+
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
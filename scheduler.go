@@ -0,0 +1,334 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScrubPollInterval is how often the scheduler looks for devices that
+// are due to be scrubbed, unless configured otherwise.
+const DefaultScrubPollInterval = time.Minute
+
+// ErrScrubDeferred is passed to the OnDeferred callback of a scheduler when a
+// device is due to be scrubbed, but the policy doesn't currently allow it.
+var ErrScrubDeferred = errors.New("scrub deferred")
+
+// MaintenanceWindow is a recurring period of time (in the local time zone)
+// during which scrubs may be started.
+type MaintenanceWindow struct {
+	// Start is the offset from midnight at which the window opens.
+	Start time.Duration
+	// Duration of the window (windows may extend past midnight).
+	Duration time.Duration
+	// Weekdays on which the window opens (every day if empty).
+	Weekdays []time.Weekday
+}
+
+// Contains returns true if t falls within the window.
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	// A window that opened the day before may still be open.
+	for _, days := range []int{0, -1} {
+		midnight := time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, t.Location())
+		if len(w.Weekdays) > 0 && !slices.Contains(w.Weekdays, midnight.Weekday()) {
+			continue
+		}
+
+		open := midnight.Add(w.Start)
+		if !t.Before(open) && t.Before(open.Add(w.Duration)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScrubPolicy controls when a scheduler scrubs devices.
+type ScrubPolicy struct {
+	// Interval is how often each device is scrubbed.
+	Interval time.Duration
+	// MaxLoadAverage defers scrubs while the one minute load average is above
+	// this threshold (no limit if zero). Linux only.
+	MaxLoadAverage float64
+	// Windows restricts when scrubs may be started (any time if empty).
+	// Scrubs already in progress are not interrupted when a window closes.
+	Windows []MaintenanceWindow
+	// Parallelism is the maximum number of devices scrubbed at once (default
+	// one).
+	Parallelism int
+	// PollInterval is how often the scheduler looks for devices that are due
+	// (default DefaultScrubPollInterval).
+	PollInterval time.Duration
+}
+
+// ScrubResult is the outcome of scrubbing a device.
+type ScrubResult struct {
+	// Device that was scrubbed.
+	Device string
+	// Started is when the scrub started.
+	Started time.Time
+	// Duration the scrub took.
+	Duration time.Duration
+	// Health of the filesystem on the device (if the scrub succeeded).
+	Health *FilesystemHealth
+	// Err is the error returned by the scrub (if any).
+	Err error
+}
+
+// SchedulerOptions provides options for a scrub scheduler.
+type SchedulerOptions struct {
+	// Devices to scrub.
+	Devices []string
+	// Policy controls when devices are scrubbed.
+	Policy ScrubPolicy
+	// Scrub scrubs a single device. The default is HealthSummary, which runs a
+	// read-only consistency check (skipped for mounted filesystems).
+	Scrub func(ctx context.Context, device string) (*FilesystemHealth, error)
+	// OnResult, if set, is called after each scrub.
+	OnResult func(ScrubResult)
+	// OnDeferred, if set, is called (on every poll) when a device is due but
+	// the policy doesn't allow it to be scrubbed yet. The reason wraps
+	// ErrScrubDeferred.
+	OnDeferred func(device string, reason error)
+	// LoadAverage returns the one minute load average (by default it is read
+	// from /proc/loadavg).
+	LoadAverage func() (float64, error)
+	// Now returns the current time (default time.Now).
+	Now func() time.Time
+}
+
+// Scheduler periodically scrubs a set of devices, according to a policy. It is
+// a building block for maintenance daemons.
+type Scheduler struct {
+	opts SchedulerOptions
+
+	mu      sync.Mutex
+	last    map[string]ScrubResult
+	running map[string]bool
+}
+
+// NewScheduler returns a scheduler that scrubs devices using the client. Call
+// Run to start it.
+func (c *Client) NewScheduler(opts SchedulerOptions) (*Scheduler, error) {
+	if opts.Scrub == nil {
+		opts.Scrub = c.HealthSummary
+	}
+
+	return NewScheduler(opts)
+}
+
+// NewScheduler returns a scheduler. opts.Scrub must be set (see
+// Client.NewScheduler for a scheduler that uses a client).
+func NewScheduler(opts SchedulerOptions) (*Scheduler, error) {
+	if len(opts.Devices) == 0 {
+		return nil, invalidOption("at least one device is required")
+	}
+	if opts.Scrub == nil {
+		return nil, invalidOption("scrub function is required")
+	}
+	if opts.Policy.Interval <= 0 {
+		return nil, invalidOption("invalid scrub interval %s", opts.Policy.Interval)
+	}
+	if opts.Policy.MaxLoadAverage < 0 {
+		return nil, invalidOption("invalid maximum load average %g", opts.Policy.MaxLoadAverage)
+	}
+	for _, w := range opts.Policy.Windows {
+		if w.Start < 0 || w.Start >= 24*time.Hour || w.Duration <= 0 || w.Duration > 24*time.Hour {
+			return nil, invalidOption("invalid maintenance window (start %s, duration %s)", w.Start, w.Duration)
+		}
+	}
+
+	if opts.Policy.Parallelism <= 0 {
+		opts.Policy.Parallelism = 1
+	}
+	if opts.Policy.PollInterval <= 0 {
+		opts.Policy.PollInterval = DefaultScrubPollInterval
+	}
+	if opts.LoadAverage == nil {
+		opts.LoadAverage = loadAverage
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	return &Scheduler{
+		opts:    opts,
+		last:    make(map[string]ScrubResult),
+		running: make(map[string]bool),
+	}, nil
+}
+
+// Run scrubs devices as they become due, until the context is cancelled
+// (which also cancels any scrubs in progress). Devices that have never been
+// scrubbed are due immediately. Returns the context's error.
+func (s *Scheduler) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ticker := time.NewTicker(s.opts.Policy.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, device := range s.due() {
+			wg.Add(1)
+			go func(device string) {
+				defer wg.Done()
+				s.scrub(ctx, device)
+			}(device)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// LastResults returns the most recent result for each device that has been
+// scrubbed.
+func (s *Scheduler) LastResults() map[string]ScrubResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make(map[string]ScrubResult, len(s.last))
+	for device, result := range s.last {
+		results[device] = result
+	}
+
+	return results
+}
+
+// due returns the devices that should be scrubbed now, marking them as
+// running.
+func (s *Scheduler) due() []string {
+	now := s.opts.Now()
+
+	s.mu.Lock()
+	var due []string
+	for _, device := range s.opts.Devices {
+		if s.running[device] {
+			continue
+		}
+
+		if last, ok := s.last[device]; ok && now.Before(last.Started.Add(s.opts.Policy.Interval)) {
+			continue
+		}
+
+		due = append(due, device)
+	}
+	s.mu.Unlock()
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	if err := s.allowed(now); err != nil {
+		if s.opts.OnDeferred != nil {
+			for _, device := range due {
+				s.opts.OnDeferred(device, err)
+			}
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Leave the remaining devices for a later poll.
+	if free := s.opts.Policy.Parallelism - len(s.running); len(due) > free {
+		due = due[:max(free, 0)]
+	}
+
+	for _, device := range due {
+		s.running[device] = true
+	}
+
+	return due
+}
+
+// allowed returns an error wrapping ErrScrubDeferred if the policy doesn't
+// allow scrubs to start at the given time.
+func (s *Scheduler) allowed(now time.Time) error {
+	if len(s.opts.Policy.Windows) > 0 && !slices.ContainsFunc(s.opts.Policy.Windows, func(w MaintenanceWindow) bool {
+		return w.Contains(now)
+	}) {
+		return fmt.Errorf("%w: outside of maintenance windows", ErrScrubDeferred)
+	}
+
+	if s.opts.Policy.MaxLoadAverage > 0 {
+		load, err := s.opts.LoadAverage()
+		if err != nil {
+			return fmt.Errorf("%w: failed to read load average: %w", ErrScrubDeferred, err)
+		}
+
+		if load > s.opts.Policy.MaxLoadAverage {
+			return fmt.Errorf("%w: load average %.2f exceeds %.2f", ErrScrubDeferred, load, s.opts.Policy.MaxLoadAverage)
+		}
+	}
+
+	return nil
+}
+
+// scrub scrubs a device, and records the result.
+func (s *Scheduler) scrub(ctx context.Context, device string) {
+	result := ScrubResult{
+		Device:  device,
+		Started: s.opts.Now(),
+	}
+	start := time.Now()
+	result.Health, result.Err = s.opts.Scrub(ctx, device)
+	result.Duration = time.Since(start)
+
+	// Don't record scrubs that were interrupted by shutdown.
+	interrupted := ctx.Err() != nil && result.Err != nil
+
+	s.mu.Lock()
+	if !interrupted {
+		s.last[device] = result
+	}
+	delete(s.running, device)
+	s.mu.Unlock()
+
+	if !interrupted && s.opts.OnResult != nil {
+		s.opts.OnResult(result)
+	}
+}
+
+// loadAverage returns the one minute load average of the host.
+func loadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("failed to parse load average: %q", data)
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -0,0 +1,223 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	// Sunday 2023-01-01 is the reference day.
+	at := func(day int, hour, min int) time.Time {
+		return time.Date(2023, 1, 1+day, hour, min, 0, 0, time.UTC)
+	}
+
+	w := ext4.MaintenanceWindow{Start: 2 * time.Hour, Duration: 3 * time.Hour}
+	require.False(t, w.Contains(at(0, 1, 59)))
+	require.True(t, w.Contains(at(0, 2, 0)))
+	require.True(t, w.Contains(at(3, 4, 59)))
+	require.False(t, w.Contains(at(0, 5, 0)))
+
+	t.Log("Windows on specific weekdays")
+
+	w = ext4.MaintenanceWindow{Start: 2 * time.Hour, Duration: time.Hour, Weekdays: []time.Weekday{time.Saturday, time.Sunday}}
+	require.True(t, w.Contains(at(0, 2, 30)))
+	require.False(t, w.Contains(at(1, 2, 30)))
+	require.True(t, w.Contains(at(6, 2, 30)))
+
+	t.Log("Windows extending past midnight")
+
+	w = ext4.MaintenanceWindow{Start: 23 * time.Hour, Duration: 2 * time.Hour, Weekdays: []time.Weekday{time.Sunday}}
+	require.True(t, w.Contains(at(0, 23, 30)))
+	require.True(t, w.Contains(at(1, 0, 30)))
+	require.False(t, w.Contains(at(1, 1, 0)))
+	require.False(t, w.Contains(at(0, 0, 30)))
+}
+
+func TestScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := ext4.NewClient()
+
+	devices := []string{createTestImage(t, c, ""), createTestImage(t, c, "")}
+
+	results := make(chan ext4.ScrubResult, len(devices))
+	s, err := c.NewScheduler(ext4.SchedulerOptions{
+		Devices: devices,
+		Policy: ext4.ScrubPolicy{
+			Interval:     time.Hour,
+			Parallelism:  2,
+			PollInterval: 10 * time.Millisecond,
+		},
+		OnResult: func(result ext4.ScrubResult) {
+			results <- result
+		},
+	})
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	scrubbed := make(map[string]bool)
+	for range devices {
+		result := <-results
+		require.NoError(t, result.Err)
+		require.Equal(t, ext4.Healthy, result.Health.Verdict)
+		scrubbed[result.Device] = true
+	}
+	require.Len(t, scrubbed, len(devices))
+
+	// Neither device is due again for an hour.
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, results)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	require.Len(t, s.LastResults(), len(devices))
+}
+
+func TestSchedulerPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	devices := []string{"/dev/vda", "/dev/vdb", "/dev/vdc"}
+
+	var load atomic.Value
+	load.Store(8.0)
+
+	var mu sync.Mutex
+	deferred := make(map[string]error)
+	scrubs := make(map[string]int)
+
+	var running, maxRunning atomic.Int32
+	s, err := ext4.NewScheduler(ext4.SchedulerOptions{
+		Devices: devices,
+		Policy: ext4.ScrubPolicy{
+			Interval:       50 * time.Millisecond,
+			MaxLoadAverage: 4,
+			PollInterval:   5 * time.Millisecond,
+		},
+		Scrub: func(ctx context.Context, device string) (*ext4.FilesystemHealth, error) {
+			if n := running.Add(1); n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			defer running.Add(-1)
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			scrubs[device]++
+			mu.Unlock()
+
+			if device == "/dev/vdc" {
+				return nil, errors.New("bad disk")
+			}
+
+			return &ext4.FilesystemHealth{Verdict: ext4.Healthy}, nil
+		},
+		OnDeferred: func(device string, reason error) {
+			mu.Lock()
+			deferred[device] = reason
+			mu.Unlock()
+		},
+		LoadAverage: func() (float64, error) {
+			return load.Load().(float64), nil
+		},
+	})
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	t.Log("Deferring scrubs while the load is high")
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(deferred) == len(devices)
+	}, time.Second, 5*time.Millisecond)
+
+	mu.Lock()
+	require.ErrorIs(t, deferred["/dev/vda"], ext4.ErrScrubDeferred)
+	require.Empty(t, scrubs)
+	mu.Unlock()
+
+	t.Log("Scrubbing once the load drops")
+
+	load.Store(0.5)
+
+	// Each device should be scrubbed repeatedly, as the interval is short.
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, device := range devices {
+			if scrubs[device] < 2 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 5*time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	require.Equal(t, int32(1), maxRunning.Load())
+
+	last := s.LastResults()
+	require.NoError(t, last["/dev/vda"].Err)
+	require.EqualError(t, last["/dev/vdc"].Err, "bad disk")
+}
+
+func TestNewSchedulerInvalidOptions(t *testing.T) {
+	c := ext4.NewClient()
+
+	_, err := c.NewScheduler(ext4.SchedulerOptions{Policy: ext4.ScrubPolicy{Interval: time.Hour}})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = c.NewScheduler(ext4.SchedulerOptions{Devices: []string{"/dev/vda"}})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = c.NewScheduler(ext4.SchedulerOptions{
+		Devices: []string{"/dev/vda"},
+		Policy: ext4.ScrubPolicy{
+			Interval: time.Hour,
+			Windows:  []ext4.MaintenanceWindow{{Start: 25 * time.Hour, Duration: time.Hour}},
+		},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = ext4.NewScheduler(ext4.SchedulerOptions{
+		Devices: []string{"/dev/vda"},
+		Policy:  ext4.ScrubPolicy{Interval: time.Hour},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions, "scrub function is required")
+}
@@ -0,0 +1,227 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// ErrBelowMinimumSize is returned when asked to shrink a filesystem below its
+// minimum size (plus the safety margin).
+var ErrBelowMinimumSize = errors.New("target size is below the minimum filesystem size")
+
+// DefaultShrinkMargin is the fraction of the minimum filesystem size that is
+// kept free (by default) when shrinking a filesystem.
+const DefaultShrinkMargin = 0.1
+
+// SafetyOptions provides options for safely shrinking a filesystem.
+type SafetyOptions struct {
+	// Margin is the fraction of the estimated minimum filesystem size that
+	// must remain free after shrinking (default DefaultShrinkMargin). The
+	// estimate is not exact, so leaving some headroom is strongly advised.
+	Margin *float64
+	// UndoFile is where the blocks overwritten by the shrink are saved, so
+	// they can be restored using e2undo. If unset, the file is saved in the
+	// undo directory (see WithUndoDir), or else a temporary file is created
+	// (only supported by the local executor).
+	UndoFile string
+	// KeepUndoFile keeps the temporary undo file after a successful shrink.
+	// Undo files are always kept if the shrink fails.
+	KeepUndoFile bool
+}
+
+// SafeShrink shrinks an unmounted ext4 filesystem to the target size (in
+// bytes), taking the precautions advised for resize2fs. The filesystem is
+// forcibly checked (and repaired) first, the target size is verified to be
+// comfortably above the minimum size, the shrink is performed with an undo
+// file, and finally the filesystem is checked again.
+func (c *Client) SafeShrink(ctx context.Context, device string, targetSize int64, opts SafetyOptions) (_ *ResizeResult, err error) {
+	ctx, span := c.startSpan(ctx, "SafeShrink", device)
+	defer endSpan(span, &err)
+
+	margin := DefaultShrinkMargin
+	if opts.Margin != nil {
+		margin = *opts.Margin
+	}
+
+	if device == "" {
+		return nil, invalidOption("device is required")
+	}
+	if targetSize <= 0 {
+		return nil, invalidOption("invalid target size %d", targetSize)
+	}
+	if margin < 0 {
+		return nil, invalidOption("invalid margin %g", margin)
+	}
+
+	var mounted *mountedError
+	unlock, err := c.requireUnmounted(ctx, device)
+	if errors.As(err, &mounted) {
+		return nil, fmt.Errorf("%w: %w", ErrShrinkMounted, err)
+	} else if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// resize2fs refuses to shrink a filesystem that hasn't been checked since it
+	// was last mounted.
+	if _, err := c.checkFilesystem(ctx, CheckOptions{Device: device, Force: true}); err != nil {
+		return nil, fmt.Errorf("failed to check filesystem before shrinking: %w", err)
+	}
+
+	sb, err := c.ReadSuperblock(ctx, device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	targetBlockCount := uint64(targetSize) / uint64(sb.BlockSize)
+	if targetBlockCount >= sb.BlockCount {
+		return nil, invalidOption("target size of %d blocks is not smaller than the filesystem (%d blocks)", targetBlockCount, sb.BlockCount)
+	}
+
+	minBlockCount, err := c.minimumBlockCount(ctx, device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate minimum filesystem size: %w", err)
+	}
+
+	requiredBlockCount := withMargin(minBlockCount, margin)
+	if targetBlockCount < requiredBlockCount {
+		return nil, fmt.Errorf("%w: %d blocks requested, at least %d blocks required", ErrBelowMinimumSize, targetBlockCount, requiredBlockCount)
+	}
+
+	undoFile, err := c.autoUndoFile(device, opts.UndoFile)
+	if err != nil {
+		return nil, err
+	}
+	temporary := undoFile == ""
+	if temporary {
+		undoFile, err = c.createUndoFile(device)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := c.resizeFilesystem(ctx, ResizeOptions{
+		Device:   device,
+		Size:     Size(targetBlockCount) * Size(sb.BlockSize),
+		UndoFile: undoFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to shrink filesystem (undo file %s): %w", undoFile, err)
+	}
+
+	if _, err := c.checkFilesystem(ctx, CheckOptions{Device: device, Force: true, NoFix: true}); err != nil {
+		return nil, fmt.Errorf("filesystem check failed after shrinking (undo file %s): %w", undoFile, err)
+	}
+
+	if result.NewBlockCount != targetBlockCount {
+		return nil, fmt.Errorf("filesystem is %d blocks after shrinking, expected %d (undo file %s)", result.NewBlockCount, targetBlockCount, undoFile)
+	}
+
+	if temporary && !opts.KeepUndoFile {
+		_ = os.Remove(filepath.Join(c.chroot, undoFile))
+	}
+
+	return result, nil
+}
+
+// createUndoFile creates a temporary undo file for a device, returning its
+// path (relative to the chroot, if configured).
+func (c *Client) createUndoFile(device string) (string, error) {
+	if _, local := c.executor.(*LocalExecutor); !local {
+		return "", invalidOption("an undo file is required when using a remote executor")
+	}
+
+	f, err := os.CreateTemp(filepath.Join(c.chroot, os.TempDir()), filepath.Base(device)+"-*.e2undo")
+	if err != nil {
+		return "", fmt.Errorf("failed to create undo file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to create undo file: %w", err)
+	}
+
+	return filepath.Join(os.TempDir(), filepath.Base(f.Name())), nil
+}
+
+// ShrinkEstimateOptions provides options for estimating the size of a shrunk
+// filesystem.
+type ShrinkEstimateOptions struct {
+	// Slack is the fraction of the estimated minimum filesystem size that is
+	// left free (default DefaultShrinkMargin, matching SafeShrink).
+	Slack *float64
+}
+
+// ShrinkEstimate is the estimated outcome of shrinking a filesystem.
+type ShrinkEstimate struct {
+	// BlockSize in bytes.
+	BlockSize int `json:"blockSize"`
+	// BlockCount is the current size of the filesystem in blocks.
+	BlockCount uint64 `json:"blockCount"`
+	// MinimumBlockCount is the estimated minimum size of the filesystem in
+	// blocks.
+	MinimumBlockCount uint64 `json:"minimumBlockCount"`
+	// Size is the size in bytes (including slack) that the filesystem, and so
+	// its image file, could be shrunk to.
+	Size int64 `json:"size"`
+}
+
+// EstimateShrink estimates how small a filesystem (eg. an image file) could
+// be made by shrinking it, without modifying it. This lets pipelines budget
+// for space before committing to a shrink (eg. using SafeShrink).
+func (c *Client) EstimateShrink(ctx context.Context, device string, opts ShrinkEstimateOptions) (_ *ShrinkEstimate, err error) {
+	ctx, span := c.startSpan(ctx, "EstimateShrink", device)
+	defer endSpan(span, &err)
+
+	slack := DefaultShrinkMargin
+	if opts.Slack != nil {
+		slack = *opts.Slack
+	}
+	if slack < 0 {
+		return nil, invalidOption("invalid slack %g", slack)
+	}
+
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+
+	minBlockCount, err := c.minimumBlockCount(ctx, device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to estimate minimum filesystem size: %w", err)
+	}
+
+	// Filesystems are never grown by shrinking.
+	blockCount := min(withMargin(minBlockCount, slack), sb.BlockCount)
+
+	return &ShrinkEstimate{
+		BlockSize:         sb.BlockSize,
+		BlockCount:        sb.BlockCount,
+		MinimumBlockCount: minBlockCount,
+		Size:              int64(blockCount) * int64(sb.BlockSize),
+	}, nil
+}
+
+// withMargin adds a margin (as a fraction) to a block count.
+func withMargin(blockCount uint64, margin float64) uint64 {
+	return blockCount + uint64(math.Ceil(float64(blockCount)*margin))
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeShrink(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	hostPath := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(hostPath, make([]byte, 1<<20), 0o644))
+
+	for i := 0; i < 8; i++ {
+		err := c.WriteFileToImage(ctx, imagePath, hostPath, fmt.Sprintf("/file%d", i))
+		require.NoError(t, err)
+	}
+
+	t.Log("Shrinking below the minimum size")
+
+	_, err := c.SafeShrink(ctx, imagePath, 4<<20, ext4.SafetyOptions{})
+	require.ErrorIs(t, err, ext4.ErrBelowMinimumSize)
+
+	t.Log("Growing instead of shrinking")
+
+	_, err = c.SafeShrink(ctx, imagePath, 128<<20, ext4.SafetyOptions{})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	t.Log("Shrinking the filesystem")
+
+	undoFile := filepath.Join(t.TempDir(), "shrink.e2undo")
+	result, err := c.SafeShrink(ctx, imagePath, 32<<20, ext4.SafetyOptions{
+		UndoFile: undoFile,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(65536), result.OldBlockCount)
+	require.Equal(t, uint64(32768), result.NewBlockCount)
+
+	require.FileExists(t, undoFile)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(32768), sb.BlockCount)
+
+	t.Log("Shrinking with a temporary undo file")
+
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	margin := 0.0
+	_, err = c.SafeShrink(ctx, imagePath, 24<<20, ext4.SafetyOptions{Margin: &margin})
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "temporary undo file not removed")
+}
+
+func TestEstimateShrink(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	estimate, err := c.EstimateShrink(ctx, imagePath, ext4.ShrinkEstimateOptions{})
+	require.NoError(t, err)
+
+	require.Equal(t, 1024, estimate.BlockSize)
+	require.Equal(t, uint64(65536), estimate.BlockCount)
+	require.NotZero(t, estimate.MinimumBlockCount)
+	require.Greater(t, estimate.Size, int64(estimate.MinimumBlockCount)*1024)
+	require.Less(t, estimate.Size, int64(64<<20))
+
+	t.Log("Shrinking and truncating to the estimate")
+
+	result, err := c.SafeShrink(ctx, imagePath, estimate.Size, ext4.SafetyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, estimate.Size, int64(result.NewBlockCount)*int64(result.BlockSize))
+
+	require.NoError(t, os.Truncate(imagePath, estimate.Size))
+
+	check, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+	require.True(t, check.Status.OK())
+
+	t.Log("Estimating without slack")
+
+	slack := 0.0
+	estimate, err = c.EstimateShrink(ctx, imagePath, ext4.ShrinkEstimateOptions{Slack: &slack})
+	require.NoError(t, err)
+	require.Equal(t, int64(estimate.MinimumBlockCount)*1024, estimate.Size)
+}
@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size is a quantity of bytes, eg. the size of a filesystem.
+type Size int64
+
+// Common sizes (e2fsprogs units are always powers of two).
+const (
+	Byte Size = 1
+	KiB       = 1024 * Byte
+	MiB       = 1024 * KiB
+	GiB       = 1024 * MiB
+	TiB       = 1024 * GiB
+)
+
+// sectorSize is the unit of the "s" suffix understood by e2fsprogs.
+const sectorSize = 512
+
+// sizeUnits are the suffixes accepted by ParseSize, longest first.
+var sizeUnits = []struct {
+	suffix string
+	size   Size
+}{
+	{"KiB", KiB}, {"MiB", MiB}, {"GiB", GiB}, {"TiB", TiB},
+	{"K", KiB}, {"k", KiB}, {"M", MiB}, {"m", MiB},
+	{"G", GiB}, {"g", GiB}, {"T", TiB}, {"t", TiB},
+	{"s", sectorSize}, {"B", Byte},
+}
+
+// ParseSize parses a size with a unit suffix, eg. "64M", "1GiB" or "2048s".
+// The K, M, G and T suffixes are powers of two (as they are for e2fsprogs),
+// and s is 512 byte sectors. Sizes without a unit (which e2fsprogs interprets
+// as a count of blocks) and decimal units (eg. "1GB") are rejected as
+// ambiguous.
+func ParseSize(s string) (Size, error) {
+	for _, unit := range sizeUnits {
+		digits, ok := strings.CutSuffix(s, unit.suffix)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil || n < 0 {
+			return 0, invalidOption("malformed size %q", s)
+		}
+		if n > math.MaxInt64/int64(unit.size) {
+			return 0, invalidOption("size %q is too large", s)
+		}
+
+		return Size(n) * unit.size, nil
+	}
+
+	return 0, invalidOption("size %q is missing a unit suffix (eg. K, M or G)", s)
+}
+
+// Validate checks that the size can be represented on the command line of
+// e2fsprogs.
+func (s Size) Validate() error {
+	if s < 0 {
+		return invalidOption("invalid size %d", int64(s))
+	}
+	if s%sectorSize != 0 {
+		return invalidOption("size %d is not a multiple of %d bytes", int64(s), sectorSize)
+	}
+
+	return nil
+}
+
+// MarshalArg returns the size with the largest unit suffix that represents it
+// exactly, eg. "64M".
+func (s Size) MarshalArg() string {
+	for _, unit := range []struct {
+		suffix string
+		size   Size
+	}{{"T", TiB}, {"G", GiB}, {"M", MiB}, {"K", KiB}} {
+		if s%unit.size == 0 {
+			return strconv.FormatInt(int64(s/unit.size), 10) + unit.suffix
+		}
+	}
+
+	return strconv.FormatInt(int64(s/sectorSize), 10) + "s"
+}
+
+// String returns the size with a unit suffix.
+func (s Size) String() string {
+	if s%sectorSize != 0 {
+		return strconv.FormatInt(int64(s), 10) + "B"
+	}
+
+	return s.MarshalArg()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Size) UnmarshalText(text []byte) error {
+	size, err := ParseSize(string(text))
+	if err != nil {
+		return fmt.Errorf("failed to parse size: %w", err)
+	}
+
+	*s = size
+	return nil
+}
+
+// blocks returns the size as a count of filesystem blocks.
+func (s Size) blocks(blockSize int) uint64 {
+	return uint64(s) / uint64(blockSize)
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSize(t *testing.T) {
+	for s, expected := range map[string]ext4.Size{
+		"64M":   64 * ext4.MiB,
+		"64m":   64 * ext4.MiB,
+		"1GiB":  ext4.GiB,
+		"2048s": ext4.MiB,
+		"4096B": 4 * ext4.KiB,
+		"2T":    2 * ext4.TiB,
+	} {
+		size, err := ext4.ParseSize(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, size, s)
+	}
+
+	for _, s := range []string{"", "512", "1GB", "-1M", "1.5G", "16777216T"} {
+		_, err := ext4.ParseSize(s)
+		require.ErrorIs(t, err, ext4.ErrInvalidOptions, s)
+	}
+
+	for expected, size := range map[string]ext4.Size{
+		"64M":   64 * ext4.MiB,
+		"1536M": 1536 * ext4.MiB,
+		"2G":    2 * ext4.GiB,
+		"5K":    5 * ext4.KiB,
+		"1s":    512,
+	} {
+		require.NoError(t, size.Validate())
+		require.Equal(t, expected, size.MarshalArg())
+	}
+
+	require.ErrorIs(t, ext4.Size(1000).Validate(), ext4.ErrInvalidOptions)
+	require.ErrorIs(t, ext4.Size(-ext4.MiB).Validate(), ext4.ErrInvalidOptions)
+	require.Equal(t, "1000B", ext4.Size(1000).String())
+
+	var opts struct {
+		Size ext4.Size `json:"size"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"size":"128M"}`), &opts))
+	require.Equal(t, 128*ext4.MiB, opts.Size)
+
+	data, err := json.Marshal(opts)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"size":"128M"}`, string(data))
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrSparsifyMounted is returned when attempting to punch holes in the image
+// of a mounted filesystem.
+var ErrSparsifyMounted = errors.New("mounted filesystems cannot be sparsified")
+
+// SparsifyImage punches holes (FALLOC_FL_PUNCH_HOLE) in an image file over
+// the blocks that are unallocated in the filesystem's block bitmaps, so they
+// no longer use any space on the host. The apparent size of the image doesn't
+// change. This dramatically reduces the size of images that have had files
+// deleted, or that were copied without preserving holes. Returns the number of
+// bytes covered by holes punched (some of which may already have been
+// sparse).
+//
+// The filesystem must be unmounted and its journal recovered (eg. with
+// CheckFilesystem), as blocks allocated by an unrecovered transaction are
+// still marked as free. The image file is on the local host (within the
+// chroot, if configured), and the host filesystem must support hole punching.
+func (c *Client) SparsifyImage(ctx context.Context, imagePath string) (_ uint64, err error) {
+	ctx, span := c.startSpan(ctx, "SparsifyImage", imagePath)
+	defer endSpan(span, &err)
+
+	if imagePath == "" {
+		return 0, invalidOption("image path is required")
+	}
+
+	var mounted *mountedError
+	unlock, err := c.requireUnmounted(ctx, imagePath)
+	if errors.As(err, &mounted) {
+		return 0, fmt.Errorf("%w: %w", ErrSparsifyMounted, err)
+	} else if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	sb, err := c.VerifyExt4(ctx, imagePath)
+	if err != nil {
+		return 0, err
+	}
+	if sb.HasFeature("needs_recovery") {
+		return 0, fmt.Errorf("journal of %s needs recovery, check the filesystem first", imagePath)
+	}
+
+	groups, err := c.ListBlockGroups(ctx, imagePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read block bitmaps: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(c.chroot, imagePath), os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	blockSize := uint64(sb.BlockSize)
+
+	var punched uint64
+	for _, r := range freeExtents(groups) {
+		offset, length := r.Start*blockSize, (r.End-r.Start+1)*blockSize
+		if err := punchHole(f, int64(offset), int64(length)); err != nil {
+			return punched, fmt.Errorf("failed to punch hole over blocks %d-%d: %w", r.Start, r.End, err)
+		}
+		punched += length
+	}
+
+	if err := f.Sync(); err != nil {
+		return punched, fmt.Errorf("failed to sync image: %w", err)
+	}
+
+	return punched, nil
+}
+
+// freeExtents returns the free block ranges of the block groups, merging those
+// that are contiguous (eg. spanning the boundary between groups).
+func freeExtents(groups []BlockGroup) []Range {
+	var extents []Range
+	for _, bg := range groups {
+		for _, r := range bg.FreeBlocks {
+			if n := len(extents); n > 0 && extents[n-1].End+1 == r.Start {
+				extents[n-1].End = r.End
+				continue
+			}
+			extents = append(extents, r)
+		}
+	}
+
+	return extents
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSparsifyImage(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateImage(ctx, imagePath, 64<<20, ext4.CreateOptions{})
+	require.NoError(t, err)
+
+	hostDir := t.TempDir()
+
+	data := make([]byte, 16<<20)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "random.bin"), data, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "hello.txt"), []byte("Hello, world!"), 0o644))
+
+	require.NoError(t, c.WriteFileToImage(ctx, imagePath, filepath.Join(hostDir, "random.bin"), "/random.bin"))
+	require.NoError(t, c.WriteFileToImage(ctx, imagePath, filepath.Join(hostDir, "hello.txt"), "/hello.txt"))
+	require.NoError(t, c.RemoveFromImage(ctx, imagePath, "/random.bin"))
+
+	before := allocatedSize(t, imagePath)
+	require.Greater(t, before, int64(16<<20))
+
+	punched, err := c.SparsifyImage(ctx, imagePath)
+	require.NoError(t, err)
+	require.Greater(t, punched, uint64(16<<20))
+
+	after := allocatedSize(t, imagePath)
+	require.Less(t, after, before-(16<<20))
+
+	fi, err := os.Stat(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(64<<20), fi.Size())
+
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+
+	destDir := t.TempDir()
+	require.NoError(t, c.ExtractDirectory(ctx, imagePath, "/hello.txt", destDir))
+
+	got, err := os.ReadFile(filepath.Join(destDir, "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(got))
+
+	_, err = c.SparsifyImage(ctx, "")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+// allocatedSize returns the space used by a file on the host.
+func allocatedSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
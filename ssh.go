@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SSHExecutor runs commands on a remote host using the ssh client. The remote
+// command's exit status is propagated through ssh, so errors can be inspected
+// in the same way as for local commands.
+type SSHExecutor struct {
+	// Host to connect to, either a hostname or an alias from the SSH config.
+	Host string
+	// User to login as (optional).
+	User string
+	// Port to connect to (optional).
+	Port int
+	// IdentityFile is the private key used for authentication (optional).
+	IdentityFile string
+	// Options are additional ssh configuration options (eg. "StrictHostKeyChecking=no").
+	Options []string
+	// SSHPath is the path of the ssh binary (defaults to "ssh").
+	SSHPath string
+}
+
+// LookPath returns the binary name unchanged, it is resolved using the remote
+// host's $PATH (extended with /sbin and /usr/sbin).
+func (e *SSHExecutor) LookPath(name string) (string, error) {
+	return name, nil
+}
+
+func (e *SSHExecutor) Run(ctx context.Context, cmd *Command) error {
+	if len(cmd.ExtraFiles) > 0 {
+		return ErrExtraFilesUnsupported
+	}
+
+	sshPath := e.SSHPath
+	if sshPath == "" {
+		sshPath = "ssh"
+	}
+
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if e.User != "" {
+		sshArgs = append(sshArgs, "-l", e.User)
+	}
+	if e.Port != 0 {
+		sshArgs = append(sshArgs, "-p", strconv.Itoa(e.Port))
+	}
+	if e.IdentityFile != "" {
+		sshArgs = append(sshArgs, "-i", e.IdentityFile)
+	}
+	for _, opt := range e.Options {
+		sshArgs = append(sshArgs, "-o", opt)
+	}
+	sshArgs = append(sshArgs, "--", e.Host, remoteCommandLine(cmd))
+
+	execCmd := exec.CommandContext(ctx, sshPath, sshArgs...)
+	execCmd.Stdin = cmd.Stdin
+	execCmd.Stdout = cmd.Stdout
+	execCmd.Stderr = cmd.Stderr
+
+	return execCmd.Run()
+}
+
+// remoteCommandLine builds a shell command line that runs the command on a
+// remote host (or in a container), with the e2fsprogs sbin directories on the
+// $PATH.
+func remoteCommandLine(cmd *Command) string {
+	words := []string{"exec", "env", `PATH="$PATH:/sbin:/usr/sbin"`}
+	for _, env := range cmd.Env {
+		words = append(words, shellQuote(env))
+	}
+
+	words = append(words, shellQuote(cmd.Path))
+	for _, arg := range cmd.Args {
+		words = append(words, shellQuote(arg))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// shellQuote quotes a string for use as a single word in a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHExecutor(t *testing.T) {
+	ctx := context.Background()
+
+	// A stand-in for ssh that runs the remote command line locally.
+	sshPath := filepath.Join(t.TempDir(), "ssh")
+	err := os.WriteFile(sshPath, []byte("#!/bin/sh\nfor last; do :; done\nexec sh -c \"$last\"\n"), 0o755)
+	require.NoError(t, err)
+
+	c := ext4.NewClient(ext4.WithExecutor(&ext4.SSHExecutor{
+		Host:    "example.com",
+		SSHPath: sshPath,
+	}))
+
+	imagePath := filepath.Join(t.TempDir(), "it's an image.img")
+
+	fs, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   64 * ext4.MiB,
+		Label:  "remote",
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, fs.UUID, sb.UUID)
+	require.Equal(t, "remote", sb.Label)
+
+	t.Log("Passing stdin to the remote command")
+
+	err = c.MakeDirectoryInImage(ctx, imagePath, "/etc")
+	require.NoError(t, err)
+
+	hostPath := filepath.Join(t.TempDir(), "hostname")
+	err = os.WriteFile(hostPath, []byte("remote"), 0o644)
+	require.NoError(t, err)
+
+	err = c.WriteFileToImage(ctx, imagePath, hostPath, "/etc/hostname")
+	require.NoError(t, err)
+
+	t.Log("Propagating remote exit codes")
+
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: filepath.Join(t.TempDir(), "missing.img"),
+	})
+	require.Error(t, err)
+
+	var checkErr *ext4.CheckError
+	require.ErrorAs(t, err, &checkErr)
+	require.NotZero(t, checkErr.Status&ext4.CheckOperationalError)
+}
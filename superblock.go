@@ -0,0 +1,549 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// superblockOffset is where the primary superblock begins.
+	superblockOffset = 1024
+	// superblockSize is the size of the on-disk superblock.
+	superblockSize = 1024
+	// superblockMagic is the magic number of ext2/3/4 filesystems.
+	superblockMagic = 0xEF53
+)
+
+// ErrCorruptSuperblock is returned when a superblock can't be parsed (eg. the
+// magic number or checksum doesn't match).
+var ErrCorruptSuperblock = errors.New("corrupt superblock")
+
+// crc32cTable is the table of the CRC32C (Castagnoli) checksums used for ext4
+// metadata.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// featureKind is the superblock field a feature flag is stored in.
+type featureKind int
+
+const (
+	featureCompat featureKind = iota
+	featureIncompat
+	featureROCompat
+)
+
+// featureFlags are the feature flags known to e2fsprogs, in the order they
+// are reported by dumpe2fs.
+var featureFlags = []struct {
+	kind featureKind
+	mask uint32
+	name string
+}{
+	{featureCompat, 0x0001, "dir_prealloc"},
+	{featureCompat, 0x0002, "imagic_inodes"},
+	{featureCompat, 0x0004, string(HasJournal)},
+	{featureCompat, 0x0008, string(ExtAttr)},
+	{featureCompat, 0x0010, string(ResizeInode)},
+	{featureCompat, 0x0020, string(DirIndex)},
+	{featureCompat, 0x0040, "lazy_bg"},
+	{featureCompat, 0x0080, "exclude_inode"},
+	{featureCompat, 0x0100, "snapshot_bitmap"},
+	{featureCompat, 0x0200, string(SparseSuper2)},
+	{featureCompat, 0x0400, string(FastCommit)},
+	{featureCompat, 0x0800, string(StableInodes)},
+	{featureCompat, 0x1000, string(OrphanFile)},
+	{featureIncompat, 0x0001, "compression"},
+	{featureIncompat, 0x0002, string(Filetype)},
+	{featureIncompat, 0x0004, "needs_recovery"},
+	{featureIncompat, 0x0008, "journal_dev"},
+	{featureIncompat, 0x0010, string(MetaBG)},
+	{featureIncompat, 0x0040, string(Extent)},
+	{featureIncompat, 0x0080, string(Has64Bit)},
+	{featureIncompat, 0x0100, string(MMP)},
+	{featureIncompat, 0x0200, string(FlexBG)},
+	{featureIncompat, 0x0400, string(EAInode)},
+	{featureIncompat, 0x1000, "dirdata"},
+	{featureIncompat, 0x2000, string(MetadataCsumSeed)},
+	{featureIncompat, 0x4000, string(LargeDir)},
+	{featureIncompat, 0x8000, string(InlineData)},
+	{featureIncompat, 0x10000, string(Encrypt)},
+	{featureIncompat, 0x20000, string(Casefold)},
+	{featureROCompat, 0x0001, string(SparseSuper)},
+	{featureROCompat, 0x0002, string(LargeFile)},
+	{featureROCompat, 0x0008, string(HugeFile)},
+	{featureROCompat, 0x0010, string(UninitBG)},
+	{featureROCompat, 0x0020, string(DirNlink)},
+	{featureROCompat, 0x0040, string(ExtraIsize)},
+	{featureROCompat, 0x0080, "has_snapshot"},
+	{featureROCompat, 0x0100, string(Quota)},
+	{featureROCompat, 0x0200, string(Bigalloc)},
+	{featureROCompat, 0x0400, string(MetadataCsum)},
+	{featureROCompat, 0x0800, "replica"},
+	{featureROCompat, 0x1000, "read-only"},
+	{featureROCompat, 0x2000, string(Project)},
+	{featureROCompat, 0x4000, "shared_blocks"},
+	{featureROCompat, 0x8000, string(Verity)},
+	{featureROCompat, 0x10000, "orphan_present"},
+}
+
+// featureNames returns the names of the feature flags set in the compat,
+// incompat and ro_compat fields of a superblock. Unknown flags are named as
+// they are by dumpe2fs (eg. "FEATURE_I11").
+func featureNames(compat, incompat, roCompat uint32) []string {
+	var names []string
+	for kind, mask := range []uint32{compat, incompat, roCompat} {
+		for bit := 0; bit < 32; bit++ {
+			m := uint32(1) << bit
+			if mask&m == 0 {
+				continue
+			}
+
+			name := fmt.Sprintf("FEATURE_%c%d", "CIR"[kind], bit)
+			for _, f := range featureFlags {
+				if f.kind == featureKind(kind) && f.mask == m {
+					name = f.name
+					break
+				}
+			}
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// mountOptionNames are the default mount options, by bit.
+var mountOptionNames = map[uint32]string{
+	0x0001: "debug",
+	0x0002: "bsdgroups",
+	0x0004: "user_xattr",
+	0x0008: "acl",
+	0x0010: "uid16",
+	0x0100: "nobarrier",
+	0x0200: "block_validity",
+	0x0400: "discard",
+	0x0800: "nodelalloc",
+}
+
+// journalModeMask selects the journalling mode from the default mount options.
+const journalModeMask = 0x0060
+
+var journalModeNames = map[uint32]string{
+	0x0020: "journal_data",
+	0x0040: "journal_data_ordered",
+	0x0060: "journal_data_writeback",
+}
+
+var (
+	errorBehaviorNames = map[uint16]string{1: "Continue", 2: "Remount read-only", 3: "Panic"}
+	creatorOSNames     = map[uint32]string{0: "Linux", 1: "Hurd", 2: "Masix", 3: "FreeBSD", 4: "Lites"}
+	hashAlgorithmNames = map[uint8]string{0: "legacy", 1: "half_md4", 2: "tea", 6: "siphash"}
+)
+
+// ReadSuperblockFrom parses the primary superblock of a filesystem from a
+// device or image file (or anything else that can be read at an offset),
+// without running dumpe2fs. Fields stored in the journal (eg. JournalFeatures,
+// JournalSequence and JournalStart) are not reported.
+func ReadSuperblockFrom(r io.ReaderAt) (*SuperblockInfo, error) {
+	return readSuperblockAt(r, superblockOffset)
+}
+
+// ReadBackupSuperblockFrom parses a backup superblock (eg. one returned by
+// BackupSuperblocks) at the given block of a filesystem with the given block
+// size, for when the primary superblock is damaged.
+func ReadBackupSuperblockFrom(r io.ReaderAt, block uint64, blockSize int) (*SuperblockInfo, error) {
+	if !validBlockSize(blockSize) {
+		return nil, invalidOption("invalid block size %d", blockSize)
+	}
+
+	return readSuperblockAt(r, int64(block)*int64(blockSize))
+}
+
+// BackupSuperblocks returns the block numbers of the backup superblocks of a
+// filesystem.
+func (sb *SuperblockInfo) BackupSuperblocks() []uint64 {
+	if sb.BlocksPerGroup == 0 || sb.BlockCount <= sb.FirstBlock {
+		return nil
+	}
+	groups := (sb.BlockCount - sb.FirstBlock + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup
+
+	var blocks []uint64
+	addGroup := func(group uint64) {
+		if group > 0 && group < groups {
+			blocks = append(blocks, sb.FirstBlock+group*sb.BlocksPerGroup)
+		}
+	}
+
+	switch {
+	case sb.HasFeature(SparseSuper2):
+		for _, group := range sb.BackupBlockGroups {
+			addGroup(group)
+		}
+	case sb.HasFeature(SparseSuper):
+		// Groups 1 and the powers of 3, 5 and 7.
+		addGroup(1)
+		for _, base := range []uint64{3, 5, 7} {
+			for group := base; group < groups; group *= base {
+				addGroup(group)
+			}
+		}
+		slices.Sort(blocks)
+	default:
+		for group := uint64(1); group < groups; group++ {
+			addGroup(group)
+		}
+	}
+
+	return blocks
+}
+
+// ReadSuperblockFile parses the primary superblock of a device or image file
+// on the local host, without running dumpe2fs (eg. in minimal containers that
+// don't have e2fsprogs installed). See ReadSuperblockFrom.
+func ReadSuperblockFile(device string) (*SuperblockInfo, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadSuperblockFrom(f)
+}
+
+// updateSuperblocks rewrites the primary and backup superblocks of a device
+// (or image file) on the local host, without running tune2fs. The update
+// function modifies the raw on-disk superblock, whose checksum is then
+// recomputed (if metadata checksums are enabled). Backup superblocks that
+// can't be parsed are left alone.
+func updateSuperblocks(device string, update func(sb *SuperblockInfo, buf []byte) error) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sb, err := ReadSuperblockFrom(f)
+	if err != nil {
+		return err
+	}
+
+	offsets := []int64{superblockOffset}
+	for _, block := range sb.BackupSuperblocks() {
+		offsets = append(offsets, int64(block)*int64(sb.BlockSize))
+	}
+
+	buf := make([]byte, superblockSize)
+	for i, offset := range offsets {
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return fmt.Errorf("failed to read superblock: %w", err)
+		}
+		if i > 0 {
+			if _, err := decodeSuperblock(buf); err != nil {
+				continue
+			}
+		}
+
+		if err := update(sb, buf); err != nil {
+			return err
+		}
+		if sb.HasFeature(MetadataCsum) {
+			binary.LittleEndian.PutUint32(buf[0x3FC:], ^crc32.Checksum(buf[:0x3FC], crc32cTable))
+		}
+
+		if _, err := f.WriteAt(buf, offset); err != nil {
+			return fmt.Errorf("failed to write superblock: %w", err)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// formatUUID formats the UUID of a filesystem as dumpe2fs does ("<none>" if
+// it has been cleared).
+func formatUUID(b [16]byte) string {
+	if b == [16]byte{} {
+		return "<none>"
+	}
+
+	return string(UUIDFromBytes(b))
+}
+
+func readSuperblockAt(r io.ReaderAt, offset int64) (*SuperblockInfo, error) {
+	buf := make([]byte, superblockSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: truncated at offset %d", ErrCorruptSuperblock, offset)
+		}
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	return decodeSuperblock(buf)
+}
+
+// decodeSuperblock parses an on-disk superblock (see the ext4 disk layout
+// documentation) into the same form as reported by dumpe2fs.
+func decodeSuperblock(buf []byte) (*SuperblockInfo, error) {
+	le := binary.LittleEndian
+	u8 := func(off int) uint8 { return buf[off] }
+	u16 := func(off int) uint16 { return le.Uint16(buf[off:]) }
+	u32 := func(off int) uint32 { return le.Uint32(buf[off:]) }
+	u64 := func(off int) uint64 { return le.Uint64(buf[off:]) }
+	// lohi combines the low and high halves of a 64-bit count.
+	lohi := func(lo, hi int, is64Bit bool) uint64 {
+		v := uint64(u32(lo))
+		if is64Bit {
+			v |= uint64(u32(hi)) << 32
+		}
+		return v
+	}
+	// timestamp combines a 32-bit timestamp with its high byte.
+	timestamp := func(lo, hi int) time.Time {
+		secs := int64(u32(lo)) | int64(u8(hi))<<32
+		if secs == 0 {
+			return time.Time{}
+		}
+		return time.Unix(secs, 0)
+	}
+
+	magic := u16(0x38)
+	if magic != superblockMagic {
+		return nil, fmt.Errorf("%w: bad magic number 0x%04X", ErrCorruptSuperblock, magic)
+	}
+
+	var sb SuperblockInfo
+	sb.Magic = magic
+	sb.Revision = int(u32(0x4C))
+	sb.Features = featureNames(u32(0x5C), u32(0x60), u32(0x64))
+
+	if sb.HasFeature(MetadataCsum) {
+		sb.ChecksumType = "unknown"
+		if u8(0x175) == 1 {
+			sb.ChecksumType = "crc32c"
+		}
+
+		sb.Checksum = u32(0x3FC)
+		if sum := ^crc32.Checksum(buf[:0x3FC], crc32cTable); sum != sb.Checksum {
+			return nil, fmt.Errorf("%w: checksum 0x%08x does not match 0x%08x", ErrCorruptSuperblock, sb.Checksum, sum)
+		}
+	}
+	if sb.HasFeature(MetadataCsumSeed) {
+		sb.ChecksumSeed = u32(0x270)
+	}
+
+	is64Bit := sb.HasFeature(Has64Bit)
+
+	sb.Label = cString(buf[0x78:0x88])
+	sb.LastMountedOn = cString(buf[0x88:0xC8])
+	sb.UUID = formatUUID([16]byte(buf[0x68:0x78]))
+
+	if flags := u32(0x160); flags != 0 {
+		for _, flag := range []struct {
+			mask uint32
+			name string
+		}{{0x1, "signed_directory_hash"}, {0x2, "unsigned_directory_hash"}, {0x4, "test_filesystem"}} {
+			if flags&flag.mask != 0 {
+				sb.Flags = append(sb.Flags, flag.name)
+			}
+		}
+	}
+
+	if sb.HasFeature(Casefold) {
+		sb.Encoding = "ENCODING_" + strconv.Itoa(int(u16(0x27C)))
+		if u16(0x27C) == 1 {
+			sb.Encoding = "utf8-12.1"
+		}
+	}
+
+	mountOpts := u32(0x100)
+	if mode := mountOpts & journalModeMask; mode != 0 {
+		sb.DefaultMountOptions = append(sb.DefaultMountOptions, journalModeNames[mode])
+	}
+	for bit := 0; bit < 32; bit++ {
+		m := uint32(1) << bit
+		if mountOpts&m == 0 || m&journalModeMask != 0 {
+			continue
+		}
+		name, ok := mountOptionNames[m]
+		if !ok {
+			name = "MNTOPT_" + strconv.Itoa(bit)
+		}
+		sb.DefaultMountOptions = append(sb.DefaultMountOptions, name)
+	}
+
+	state := u16(0x3A)
+	sb.State = "not clean"
+	if state&0x1 != 0 {
+		sb.State = "clean"
+	}
+	if state&0x2 != 0 {
+		sb.State += " with errors"
+	}
+
+	var ok bool
+	if sb.ErrorBehavior, ok = errorBehaviorNames[u16(0x3C)]; !ok {
+		sb.ErrorBehavior = "Unknown (continue)"
+	}
+	if sb.CreatorOS, ok = creatorOSNames[u32(0x48)]; !ok {
+		sb.CreatorOS = "(unknown os)"
+	}
+
+	sb.InodeCount = uint64(u32(0x0))
+	sb.BlockCount = lohi(0x4, 0x150, is64Bit)
+	sb.ReservedBlockCount = lohi(0x8, 0x154, is64Bit)
+	sb.FreeBlocks = lohi(0xC, 0x158, is64Bit)
+	sb.FreeInodes = uint64(u32(0x10))
+	sb.FirstBlock = uint64(u32(0x14))
+
+	logBlockSize := u32(0x18)
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("%w: invalid block size", ErrCorruptSuperblock)
+	}
+	sb.BlockSize = 1024 << logBlockSize
+	if sb.HasFeature(Bigalloc) {
+		logClusterSize := u32(0x1C)
+		if logClusterSize > 29 {
+			return nil, fmt.Errorf("%w: invalid cluster size", ErrCorruptSuperblock)
+		}
+		sb.ClusterSize = 1024 << logClusterSize
+	}
+
+	sb.BlocksPerGroup = uint64(u32(0x20))
+	sb.InodesPerGroup = uint64(u32(0x28))
+	if sb.BlocksPerGroup == 0 || sb.InodesPerGroup == 0 {
+		return nil, fmt.Errorf("%w: empty block groups", ErrCorruptSuperblock)
+	}
+
+	// The first data block is 1 with 1KiB blocks (the superblock fills block
+	// 0), and 0 otherwise. The filesystem has to extend past it.
+	if sb.FirstBlock > 1 || (sb.FirstBlock == 1 && sb.BlockSize != 1024) {
+		return nil, fmt.Errorf("%w: invalid first data block %d", ErrCorruptSuperblock, sb.FirstBlock)
+	}
+	if sb.BlockCount <= sb.FirstBlock {
+		return nil, fmt.Errorf("%w: invalid block count %d", ErrCorruptSuperblock, sb.BlockCount)
+	}
+
+	// Every block group has the same number of inodes, so a block count that
+	// disagrees with the inode count (eg. a stray high word) is corrupt.
+	groups := (sb.BlockCount - sb.FirstBlock + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup
+	if groups > math.MaxUint32/sb.InodesPerGroup || groups*sb.InodesPerGroup != sb.InodeCount {
+		return nil, fmt.Errorf("%w: %d block groups of %d inodes don't hold %d inodes", ErrCorruptSuperblock, groups, sb.InodesPerGroup, sb.InodeCount)
+	}
+
+	// Revision 0 filesystems have fixed inode sizes.
+	sb.InodeSize = 128
+	sb.FirstInode = 11
+	if sb.Revision > 0 {
+		sb.InodeSize = int(u16(0x58))
+		sb.FirstInode = uint64(u32(0x54))
+	}
+	if is64Bit {
+		sb.DescriptorSize = int(u16(0xFE))
+	}
+
+	sb.ReservedGDTBlocks = uint64(u16(0xCE))
+	sb.FirstMetaBlockGroup = uint64(u32(0x104))
+	if logGroupsPerFlex := u8(0x174); logGroupsPerFlex > 0 && logGroupsPerFlex < 32 {
+		sb.FlexBlockGroupSize = 1 << logGroupsPerFlex
+	}
+	sb.RAIDStride = uint64(u16(0x164))
+	sb.RAIDStripeWidth = uint64(u32(0x170))
+
+	sb.Created = timestamp(0x108, 0x276)
+	sb.LastMounted = timestamp(0x2C, 0x275)
+	sb.LastWritten = timestamp(0x30, 0x274)
+	sb.LastChecked = timestamp(0x40, 0x277)
+	sb.MountCount = int(u16(0x34))
+	sb.MaxMountCount = int(int16(u16(0x36)))
+	sb.CheckInterval = time.Duration(u32(0x44)) * time.Second
+
+	sb.ErrorCount = int(u32(0x194))
+	sb.FirstErrorTime = timestamp(0x198, 0x278)
+	sb.LastErrorTime = timestamp(0x1CC, 0x279)
+
+	if sb.HasFeature(MMP) {
+		sb.MMPBlock = u64(0x168)
+		sb.MMPUpdateInterval = time.Duration(u16(0x166)) * time.Second
+	}
+
+	sb.UserQuotaInode = uint64(u32(0x240))
+	sb.GroupQuotaInode = uint64(u32(0x244))
+	sb.ProjectQuotaInode = uint64(u32(0x26C))
+
+	sb.JournalInode = uint64(u32(0xE0))
+	if journalUUID := buf[0xD0:0xE0]; !isZero(journalUUID) {
+		sb.JournalUUID = string(UUIDFromBytes([16]byte(journalUUID)))
+	}
+	// The inode of an internal journal is backed up in the superblock,
+	// including its size.
+	if sb.JournalInode != 0 && u8(0xFD) == 1 {
+		size := uint64(u32(0x10C+16*4)) | uint64(u32(0x10C+15*4))<<32
+		sb.JournalBlocks = size / uint64(sb.BlockSize)
+	}
+
+	if sb.HasFeature(DirIndex) || u8(0xFC) != 0 {
+		if sb.HashAlgorithm, ok = hashAlgorithmNames[u8(0xFC)]; !ok {
+			sb.HashAlgorithm = "HASHALG_" + strconv.Itoa(int(u8(0xFC)))
+		}
+	}
+	if hashSeed := buf[0xEC:0xFC]; !isZero(hashSeed) {
+		sb.HashSeed = string(UUIDFromBytes([16]byte(hashSeed)))
+	}
+
+	if sb.HasFeature(SparseSuper2) {
+		for _, off := range []int{0x24C, 0x250} {
+			if group := u32(off); group != 0 {
+				sb.BackupBlockGroups = append(sb.BackupBlockGroups, uint64(group))
+			}
+		}
+	}
+
+	return &sb, nil
+}
+
+// cString returns the NUL terminated string stored in a fixed size field.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSuperblockFrom(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4":          {Label: "native"},
+		"ext2":          {Type: ext4.Ext2},
+		"bigalloc":      {Bigalloc: &ext4.BigallocOptions{}},
+		"sparse_super2": {FeatureSet: ext4.FeatureSet{ext4.SparseSuper2: true}, ChecksumSeed: true},
+		"meta_bg":       {FeatureSet: ext4.FeatureSet{ext4.MetaBG: true, ext4.ResizeInode: false}},
+		"casefold":      {Casefold: &ext4.CasefoldOptions{}, FeatureSet: ext4.FeatureSet{ext4.MMP: true}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.Device = filepath.Join(t.TempDir(), "ext4.img")
+			opts.Size = 64 * ext4.MiB
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			expected, err := c.ReadSuperblock(ctx, opts.Device)
+			require.NoError(t, err)
+
+			// Stored in the journal, rather than the superblock.
+			expected.JournalFeatures = nil
+			expected.JournalSequence = 0
+			expected.JournalStart = 0
+
+			f, err := os.Open(opts.Device)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			sb, err := ext4.ReadSuperblockFrom(f)
+			require.NoError(t, err)
+
+			require.Empty(t, ext4.Diff(*expected, *sb))
+		})
+	}
+}
+
+func TestReadBackupSuperblockFrom(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	sb, err := ext4.ReadSuperblockFrom(f)
+	require.NoError(t, err)
+
+	groups, err := c.ListBlockGroups(ctx, imagePath)
+	require.NoError(t, err)
+
+	var expected []uint64
+	for _, bg := range groups {
+		if bg.BackupSuperblock {
+			expected = append(expected, *bg.Superblock)
+		}
+	}
+	require.Equal(t, expected, sb.BackupSuperblocks())
+
+	for _, block := range sb.BackupSuperblocks() {
+		backup, err := ext4.ReadBackupSuperblockFrom(f, block, sb.BlockSize)
+		require.NoError(t, err)
+		require.Equal(t, sb.UUID, backup.UUID)
+		require.Equal(t, sb.BlockCount, backup.BlockCount)
+	}
+
+	t.Log("Corrupting the primary superblock")
+
+	_, err = f.WriteAt([]byte{0xFF}, 1024+0x78)
+	require.NoError(t, err)
+
+	_, err = ext4.ReadSuperblockFrom(f)
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+
+	_, err = f.WriteAt(make([]byte, 1024), 1024)
+	require.NoError(t, err)
+
+	_, err = ext4.ReadSuperblockFrom(f)
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+
+	backup, err := ext4.ReadBackupSuperblockFrom(f, expected[0], sb.BlockSize)
+	require.NoError(t, err)
+	require.Equal(t, sb.UUID, backup.UUID)
+}
+
+func TestReadSuperblockFile(t *testing.T) {
+	imagePath := createTestImage(t, ext4.NewClient(), "")
+
+	sb, err := ext4.ReadSuperblockFile(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint16(0xEF53), sb.Magic)
+	require.Contains(t, sb.Features, "has_journal")
+
+	_, err = ext4.ReadSuperblockFile(filepath.Join(t.TempDir(), "missing.img"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	emptyPath := filepath.Join(t.TempDir(), "empty.img")
+	require.NoError(t, os.WriteFile(emptyPath, nil, 0o644))
+
+	_, err = ext4.ReadSuperblockFile(emptyPath)
+	require.ErrorIs(t, err, ext4.ErrCorruptSuperblock)
+}
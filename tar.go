@@ -0,0 +1,267 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paxXattrPrefix is the prefix of PAX records holding extended attributes.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// CreateFilesystemFromTar creates an ext4 filesystem on the device, populated
+// with the contents of a tar stream (eg. an OCI image layer). Ownership,
+// permissions, modification times, extended attributes, symbolic and hard
+// links, and device nodes are all preserved, without requiring any special
+// privileges. The stream is staged in a temporary directory on the local host,
+// so enough free space is required to hold its contents, and commands must be
+// run locally too (ie. with the local executor). opts.RootDirectory and
+// opts.Populate must not be set.
+func (c *Client) CreateFilesystemFromTar(ctx context.Context, device string, r io.Reader, opts CreateOptions) (_ *CreatedFilesystem, err error) {
+	ctx, span := c.startSpan(ctx, "CreateFilesystemFromTar", device)
+	defer endSpan(span, &err)
+
+	if opts.RootDirectory != "" || opts.Populate != nil {
+		return nil, invalidOption("root directory and populate are not supported with a tar stream")
+	}
+	if _, local := c.executor.(*LocalExecutor); !local {
+		return nil, invalidOption("tar streams are only supported when commands are run locally")
+	}
+
+	opts.Device = device
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	stagingDir, err := os.MkdirTemp("", "ext4-tar-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	rootDir := filepath.Join(stagingDir, "root")
+	requests, err := extractTar(r, rootDir, filepath.Join(stagingDir, "xattrs"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract tar stream: %w", err)
+	}
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	opts.RootDirectory = rootDir
+	fs, err := c.createFilesystem(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.debugfs(ctx, device, true, requests...); err != nil {
+		return nil, fmt.Errorf("failed to apply tar metadata: %w", err)
+	}
+
+	return fs, nil
+}
+
+// extractTar stages the contents of a tar stream in rootDir, returning the
+// debugfs requests required to restore the metadata that can't be represented
+// on the host without privileges (eg. ownership and device nodes). The values
+// of extended attributes are written to files in xattrDir.
+func extractTar(r io.Reader, rootDir, xattrDir string) ([]string, error) {
+	for _, dir := range []string{rootDir, xattrDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	var requests []string
+	seen := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		imagePath := path.Clean("/" + hdr.Name)
+		hostPath, err := stagingPath(rootDir, imagePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if imagePath != "/" {
+			if err := os.MkdirAll(filepath.Dir(hostPath), 0o755); err != nil {
+				return nil, err
+			}
+		}
+
+		// Files are staged with permissive modes, so that mke2fs can read them
+		// (and they can be cleaned up), the real mode is set afterwards.
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(hostPath, 0o755); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			if err := writeStagedFile(hostPath, tr); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			_ = os.Remove(hostPath)
+			if err := os.Symlink(hdr.Linkname, hostPath); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			targetPath, err := stagingPath(rootDir, path.Clean("/"+hdr.Linkname))
+			if err != nil {
+				return nil, err
+			}
+
+			_ = os.Remove(hostPath)
+			if err := os.Link(targetPath, hostPath); err != nil {
+				return nil, err
+			}
+
+			// Hard links share the metadata of their target.
+			continue
+		case tar.TypeChar, tar.TypeBlock:
+			devType := "c"
+			if hdr.Typeflag == tar.TypeBlock {
+				devType = "b"
+			}
+
+			// As with write, mknod links the new inode into the current
+			// directory under the literal name.
+			requests = append(requests,
+				debugfsRequest("cd", path.Dir(imagePath)),
+				debugfsRequest("mknod", path.Base(imagePath), devType,
+					strconv.FormatInt(hdr.Devmajor, 10), strconv.FormatInt(hdr.Devminor, 10)))
+		case tar.TypeFifo:
+			requests = append(requests,
+				debugfsRequest("cd", path.Dir(imagePath)),
+				debugfsRequest("mknod", path.Base(imagePath), "p"))
+		default:
+			// Eg. PAX global headers.
+			continue
+		}
+
+		seen[imagePath] = true
+		requests = append(requests,
+			debugfsRequest("sif", imagePath, "uid", strconv.Itoa(hdr.Uid)),
+			debugfsRequest("sif", imagePath, "gid", strconv.Itoa(hdr.Gid)),
+			debugfsRequest("sif", imagePath, "mode", "0"+strconv.FormatUint(uint64(inodeMode(hdr.FileInfo().Mode())), 8)),
+			debugfsRequest("sif", imagePath, "mtime", "@"+strconv.FormatInt(hdr.ModTime.Unix(), 10)))
+
+		var xattrs []string
+		for key := range hdr.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				xattrs = append(xattrs, key)
+			}
+		}
+		sort.Strings(xattrs)
+
+		for _, key := range xattrs {
+			valuePath := filepath.Join(xattrDir, strconv.Itoa(len(requests)))
+			if err := os.WriteFile(valuePath, []byte(hdr.PAXRecords[key]), 0o600); err != nil {
+				return nil, err
+			}
+
+			requests = append(requests, debugfsRequest("ea_set", "-f", valuePath, imagePath, strings.TrimPrefix(key, paxXattrPrefix)))
+		}
+	}
+
+	// Directories implied by the stream, but without their own entries, are
+	// owned by root (rather than whoever is running the extraction).
+	err := filepath.WalkDir(rootDir, func(hostPath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(rootDir, hostPath)
+		if err != nil {
+			return err
+		}
+
+		imagePath := path.Join("/", filepath.ToSlash(relPath))
+		if !seen[imagePath] {
+			requests = append(requests,
+				debugfsRequest("sif", imagePath, "uid", "0"),
+				debugfsRequest("sif", imagePath, "gid", "0"))
+		}
+
+		return nil
+	})
+
+	return requests, err
+}
+
+// stagingPath returns the host path at which a file from a tar stream is
+// staged, refusing to traverse any symbolic links (which could otherwise be
+// used to write outside of the staging directory).
+func stagingPath(rootDir, imagePath string) (string, error) {
+	hostPath := rootDir
+	components := strings.Split(strings.TrimPrefix(imagePath, "/"), "/")
+	for i, component := range components {
+		if component == "" {
+			continue
+		}
+		hostPath = filepath.Join(hostPath, component)
+
+		if i == len(components)-1 {
+			break
+		}
+
+		fi, err := os.Lstat(hostPath)
+		if err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s: path traverses a symbolic link", imagePath)
+		}
+	}
+
+	return hostPath, nil
+}
+
+func writeStagedFile(hostPath string, r io.Reader) error {
+	_ = os.Remove(hostPath)
+
+	f, err := os.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/ext4test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateFilesystemFromTar(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	buf := bytes.NewBuffer(testTar(t))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	require.NoError(t, os.WriteFile(imagePath, nil, 0o644))
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	_, err := c.CreateFilesystemFromTar(ctx, imagePath, buf, ext4.CreateOptions{})
+	require.NoError(t, err)
+
+	uid, gid, mode := statInImage(t, imagePath, "/etc/hosts")
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 1001, gid)
+	require.Equal(t, "0640", mode)
+
+	stat := debugfsOutput(t, imagePath, "stat /etc/hosts")
+	require.Contains(t, stat, "Links: 2")
+	require.Contains(t, stat, "mtime: 0x65423dc0")
+
+	require.Contains(t, debugfsOutput(t, imagePath, "ea_get /etc/hosts user.origin"), "layer")
+	require.Contains(t, debugfsOutput(t, imagePath, "stat /hosts"), "Fast link dest: \"etc/hosts\"")
+
+	stat = debugfsOutput(t, imagePath, "stat /dev/null")
+	require.Contains(t, stat, "Type: character special")
+	require.Contains(t, stat, "Device major/minor number: 01:03")
+
+	require.Contains(t, debugfsOutput(t, imagePath, "stat /run/fifo"), "Type: FIFO")
+
+	// Implied directories are owned by root.
+	uid, gid, _ = statInImage(t, imagePath, "/run")
+	require.Zero(t, uid)
+	require.Zero(t, gid)
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{
+		Device: imagePath,
+		Force:  true,
+		NoFix:  true,
+	})
+	require.NoError(t, err)
+	require.Empty(t, result.Problems)
+
+	t.Log("Rejecting entries that traverse symbolic links")
+
+	buf.Reset()
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: t.TempDir()}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "escape/file", Mode: 0o644}))
+	require.NoError(t, tw.Close())
+
+	_, err = c.CreateFilesystemFromTar(ctx, imagePath, buf, ext4.CreateOptions{})
+	require.ErrorContains(t, err, "traverses a symbolic link")
+}
+
+// testTar returns a tar stream containing one of each supported file type.
+func testTar(t *testing.T) []byte {
+	modTime := time.Date(2023, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755}},
+		{
+			hdr: tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       "etc/hosts",
+				Mode:       0o640,
+				Uid:        1000,
+				Gid:        1001,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.origin": "layer"},
+			},
+			data: "127.0.0.1 localhost\n",
+		},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hosts.bak", Linkname: "etc/hosts"}},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "hosts", Linkname: "etc/hosts", Mode: 0o777}},
+		{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+		{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0o600}},
+	} {
+		entry.hdr.ModTime = modTime
+		entry.hdr.Size = int64(len(entry.data))
+		entry.hdr.Format = tar.FormatPAX
+		require.NoError(t, tw.WriteHeader(&entry.hdr))
+		_, err := tw.Write([]byte(entry.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func debugfsOutput(t *testing.T, imagePath, request string) string {
+	out, err := exec.Command("debugfs", "-R", request, imagePath).Output()
+	require.NoError(t, err)
+
+	return string(out)
+}
+
+func TestCreateFilesystemFromTarRemote(t *testing.T) {
+	ctx := context.Background()
+
+	// The stream is staged on the local host, not the remote one.
+	e := &ext4test.RecordingExecutor{}
+	c := ext4.NewClient(ext4.WithExecutor(e))
+
+	_, err := c.CreateFilesystemFromTar(ctx, "/dev/sdb", bytes.NewReader(nil), ext4.CreateOptions{})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+	require.Empty(t, e.Argv())
+}
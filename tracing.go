@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of spans created by the client.
+const tracerName = "github.com/dpeckett/ext4"
+
+var (
+	deviceKey   = attribute.Key("ext4.device")
+	toolKey     = attribute.Key("ext4.tool")
+	pathKey     = attribute.Key("ext4.path")
+	argsKey     = attribute.Key("ext4.args")
+	exitCodeKey = attribute.Key("ext4.exit_code")
+)
+
+// startSpan starts a span for a public operation against a device.
+func (c *Client) startSpan(ctx context.Context, operation, device string) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, "ext4."+operation, trace.WithAttributes(deviceKey.String(device)))
+}
+
+// endSpan records the outcome of a public operation, given a pointer to the
+// error it returns (eg. defer endSpan(span, &err)).
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// startCommandSpan starts a span for a spawned command.
+func (c *Client) startCommandSpan(ctx context.Context, cmdName string, cmd *Command) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, cmdName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			toolKey.String(cmdName),
+			pathKey.String(cmd.Path),
+			argsKey.StringSlice(cmd.Args),
+		))
+}
+
+// endCommandSpan records the outcome of a spawned command.
+func endCommandSpan(span trace.Span, err error) {
+	span.SetAttributes(exitCodeKey.Int(exitCode(err)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWithTracerProvider(t *testing.T) {
+	ctx := context.Background()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	c := ext4.NewClient(ext4.WithTracerProvider(tp))
+
+	imagePath := createTestImage(t, c, "")
+
+	_, err := c.ReadSuperblock(ctx, filepath.Join(t.TempDir(), "missing.img"))
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 4)
+
+	require.Equal(t, "mke2fs", spans[0].Name())
+	require.Equal(t, "ext4.CreateFilesystem", spans[1].Name())
+	require.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	require.Contains(t, spans[1].Attributes(), attribute.String("ext4.device", imagePath))
+	require.Contains(t, spans[0].Attributes(), attribute.String("ext4.tool", "mke2fs"))
+	require.Contains(t, spans[0].Attributes(), attribute.Int("ext4.exit_code", 0))
+
+	t.Log("Recording failed commands")
+
+	require.Equal(t, "dumpe2fs", spans[2].Name())
+	require.Equal(t, codes.Error, spans[2].Status().Code)
+	require.Contains(t, spans[2].Attributes(), attribute.Int("ext4.exit_code", 2))
+	require.Equal(t, "ext4.ReadSuperblock", spans[3].Name())
+
+	t.Log("Recording failed operations")
+
+	require.Equal(t, codes.Unset, spans[1].Status().Code)
+	require.Equal(t, codes.Error, spans[3].Status().Code)
+	require.Equal(t, err.Error(), spans[3].Status().Description)
+	require.Len(t, spans[3].Events(), 1)
+	require.Equal(t, "exception", spans[3].Events()[0].Name)
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// fstrimTrimmedRegexp matches the verbose output of fstrim, eg.
+// "/mnt: 54.7 MiB (57367552 bytes) trimmed".
+var fstrimTrimmedRegexp = regexp.MustCompile(`\((\d+) bytes\) trimmed`)
+
+// TrimOptions provides options for trimming a mounted filesystem.
+type TrimOptions struct {
+	// Offset in bytes within the filesystem at which to start searching for
+	// free blocks to discard.
+	Offset int64
+	// Length in bytes of the region to search (zero for the whole filesystem).
+	Length int64
+	// MinimumExtent is the minimum contiguous free range in bytes to discard.
+	// Smaller ranges are skipped, which makes trimming faster (but less
+	// thorough) on fragmented filesystems.
+	MinimumExtent int64
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts TrimOptions) Validate() error {
+	var errs []error
+	if opts.Offset < 0 {
+		errs = append(errs, invalidOption("invalid trim offset %d", opts.Offset))
+	}
+	if opts.Length < 0 {
+		errs = append(errs, invalidOption("invalid trim length %d", opts.Length))
+	}
+	if opts.MinimumExtent < 0 {
+		errs = append(errs, invalidOption("invalid minimum extent %d", opts.MinimumExtent))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Trim discards the unused blocks of the filesystem mounted at mountPoint
+// using fstrim, returning the number of bytes trimmed. The kernel remembers
+// which block groups have been trimmed, so repeated trims of an idle
+// filesystem may report zero bytes.
+func (c *Client) Trim(ctx context.Context, mountPoint string, opts TrimOptions) (_ uint64, err error) {
+	ctx, span := c.startSpan(ctx, "Trim", mountPoint)
+	defer endSpan(span, &err)
+
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+
+	cmdArgs := []string{"--verbose"}
+	if opts.Offset > 0 {
+		cmdArgs = append(cmdArgs, "--offset", strconv.FormatInt(opts.Offset, 10))
+	}
+	if opts.Length > 0 {
+		cmdArgs = append(cmdArgs, "--length", strconv.FormatInt(opts.Length, 10))
+	}
+	if opts.MinimumExtent > 0 {
+		cmdArgs = append(cmdArgs, "--minimum", strconv.FormatInt(opts.MinimumExtent, 10))
+	}
+	cmdArgs = append(cmdArgs, mountPoint)
+
+	out, err := c.run(ctx, "fstrim", cmdArgs...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to trim %s: %w", mountPoint, err)
+	}
+
+	return parseTrimmed(out)
+}
+
+// parseTrimmed parses the number of bytes trimmed from the output of fstrim.
+func parseTrimmed(out []byte) (uint64, error) {
+	m := fstrimTrimmedRegexp.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("failed to parse fstrim output: %q", out)
+	}
+
+	return strconv.ParseUint(string(m[1]), 10, 64)
+}
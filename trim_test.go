@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrim(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	mountPath := t.TempDir()
+	require.NoError(t, c.Mount(ctx, devPath, mountPath, ext4.MountOptions{}))
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	trimmed, err := c.Trim(ctx, mountPath, ext4.TrimOptions{})
+	require.NoError(t, err)
+	require.Greater(t, trimmed, uint64(32<<20))
+
+	t.Log("Trimming an already trimmed region")
+
+	trimmed, err = c.Trim(ctx, mountPath, ext4.TrimOptions{
+		Offset:        0,
+		Length:        1 << 20,
+		MinimumExtent: 4096,
+	})
+	require.NoError(t, err)
+	require.Zero(t, trimmed)
+
+	t.Log("Trimming via a directory within the filesystem")
+
+	_, err = c.Trim(ctx, filepath.Join(mountPath, "lost+found"), ext4.TrimOptions{})
+	require.NoError(t, err)
+
+	_, err = c.Trim(ctx, filepath.Join(mountPath, "missing"), ext4.TrimOptions{})
+	require.Error(t, err)
+
+	_, err = c.Trim(ctx, mountPath, ext4.TrimOptions{MinimumExtent: -1})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
@@ -0,0 +1,242 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// undoFileExt is the extension of the undo files saved in the undo directory.
+const undoFileExt = ".e2undo"
+
+// ErrNoUndoFile is returned when there is no undo file to apply to a device.
+var ErrNoUndoFile = errors.New("no undo file found")
+
+// UndoFile is an undo file saved in the undo directory (see WithUndoDir).
+type UndoFile struct {
+	// Path of the undo file (relative to the chroot, if configured).
+	Path string `json:"path"`
+	// Device the undo file applies to.
+	Device string `json:"device"`
+	// Created is when the operation that saved the undo file began.
+	Created time.Time `json:"created"`
+	// Size of the undo file in bytes.
+	Size int64 `json:"size"`
+}
+
+// PruneUndoOptions provides options for pruning the undo directory.
+type PruneUndoOptions struct {
+	// Device, if set, only prunes the undo files of a single device.
+	Device string
+	// OlderThan, if set, only prunes undo files older than this.
+	OlderThan time.Duration
+	// KeepLast is the number of most recent undo files of each device that
+	// are always kept.
+	KeepLast int
+}
+
+// autoUndoFile returns the undo file to use for an operation that modifies
+// device: the caller's, if given, otherwise a new file in the undo directory
+// (if configured, and the device exists).
+func (c *Client) autoUndoFile(device, undoFile string) (string, error) {
+	if undoFile != "" || c.undoDir == "" {
+		return undoFile, nil
+	}
+	if _, local := c.executor.(*LocalExecutor); !local {
+		return "", nil
+	}
+
+	// There is nothing to undo if the device (eg. an image file) is about to
+	// be created.
+	if _, err := os.Stat(filepath.Join(c.chroot, device)); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.chroot, c.undoDir), 0o700); err != nil {
+		return "", fmt.Errorf("failed to create undo directory: %w", err)
+	}
+
+	name := url.PathEscape(device) + "." + strconv.FormatInt(time.Now().UnixNano(), 10) + undoFileExt
+	return filepath.Join(c.undoDir, name), nil
+}
+
+// tune2fs runs tune2fs on device, saving an undo file in the undo directory
+// (if configured, see WithUndoDir).
+func (c *Client) tune2fs(ctx context.Context, device string, cmdArgs ...string) error {
+	undoFile, err := c.autoUndoFile(device, "")
+	if err != nil {
+		return err
+	}
+	if undoFile != "" {
+		cmdArgs = append(cmdArgs, "-z", undoFile)
+	}
+
+	_, err = c.run(ctx, "tune2fs", append(cmdArgs, device)...)
+	return err
+}
+
+// ListUndoFiles returns the undo files saved in the undo directory (see
+// WithUndoDir) for a device (or for every device, if empty), oldest first.
+func (c *Client) ListUndoFiles(device string) ([]UndoFile, error) {
+	if c.undoDir == "" {
+		return nil, invalidOption("no undo directory configured")
+	}
+
+	entries, err := os.ReadDir(filepath.Join(c.chroot, c.undoDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read undo directory: %w", err)
+	}
+
+	var undoFiles []UndoFile
+	for _, entry := range entries {
+		undoFile, ok := parseUndoFileName(entry.Name())
+		if !ok || (device != "" && undoFile.Device != device) {
+			continue
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		undoFile.Path = filepath.Join(c.undoDir, entry.Name())
+		undoFile.Size = fi.Size()
+		undoFiles = append(undoFiles, undoFile)
+	}
+
+	sort.SliceStable(undoFiles, func(i, j int) bool {
+		return undoFiles[i].Created.Before(undoFiles[j].Created)
+	})
+
+	return undoFiles, nil
+}
+
+// parseUndoFileName parses the device and creation time of an undo file from
+// its name.
+func parseUndoFileName(name string) (UndoFile, bool) {
+	name, ok := strings.CutSuffix(name, undoFileExt)
+	if !ok {
+		return UndoFile{}, false
+	}
+
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return UndoFile{}, false
+	}
+
+	device, err := url.PathUnescape(name[:i])
+	if err != nil {
+		return UndoFile{}, false
+	}
+
+	nanos, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return UndoFile{}, false
+	}
+
+	return UndoFile{Device: device, Created: time.Unix(0, nanos)}, true
+}
+
+// PruneUndoFiles removes undo files from the undo directory (see WithUndoDir),
+// returning those removed. Undo files can only be applied in reverse order, so
+// once a file has been removed, any older undo files of the same device are
+// unusable too.
+func (c *Client) PruneUndoFiles(opts PruneUndoOptions) ([]UndoFile, error) {
+	if opts.OlderThan < 0 || opts.KeepLast < 0 {
+		return nil, invalidOption("invalid prune options")
+	}
+
+	undoFiles, err := c.ListUndoFiles(opts.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the newer undo files of each device, walking newest first.
+	newer := make(map[string]int)
+	var pruned []UndoFile
+	for i := len(undoFiles) - 1; i >= 0; i-- {
+		undoFile := undoFiles[i]
+
+		keep := newer[undoFile.Device] < opts.KeepLast ||
+			(opts.OlderThan > 0 && time.Since(undoFile.Created) < opts.OlderThan)
+		newer[undoFile.Device]++
+		if keep {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(c.chroot, undoFile.Path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pruned, fmt.Errorf("failed to remove undo file: %w", err)
+		}
+		pruned = append(pruned, undoFile)
+	}
+
+	return pruned, nil
+}
+
+// UndoLastOperation reverts the most recent operation on an unmounted device
+// by applying its undo file from the undo directory (see WithUndoDir) with
+// e2undo. The undo file is then removed, so that calling it again reverts the
+// operation before. Returns the undo file that was applied, or ErrNoUndoFile.
+func (c *Client) UndoLastOperation(ctx context.Context, device string) (_ *UndoFile, err error) {
+	ctx, span := c.startSpan(ctx, "UndoLastOperation", device)
+	defer endSpan(span, &err)
+
+	if device == "" {
+		return nil, invalidOption("device is required")
+	}
+
+	unlock, err := c.requireUnmounted(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	undoFiles, err := c.ListUndoFiles(device)
+	if err != nil {
+		return nil, err
+	}
+	if len(undoFiles) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoUndoFile, device)
+	}
+
+	undoFile := undoFiles[len(undoFiles)-1]
+	if _, err := c.run(ctx, "e2undo", undoFile.Path, device); err != nil {
+		return nil, fmt.Errorf("failed to apply undo file %s: %w", undoFile.Path, err)
+	}
+
+	if err := os.Remove(filepath.Join(c.chroot, undoFile.Path)); err != nil {
+		return nil, fmt.Errorf("failed to remove applied undo file: %w", err)
+	}
+
+	return &undoFile, nil
+}
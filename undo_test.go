@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndoDir(t *testing.T) {
+	ctx := context.Background()
+
+	undoDir := t.TempDir()
+	c := ext4.NewClient(ext4.WithUndoDir(undoDir))
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: imagePath,
+		Size:   32 * ext4.MiB,
+	})
+	require.NoError(t, err)
+
+	// Nothing existed to undo.
+	undoFiles, err := c.ListUndoFiles(imagePath)
+	require.NoError(t, err)
+	require.Empty(t, undoFiles)
+
+	require.NoError(t, os.Truncate(imagePath, 64<<20))
+
+	before, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{Device: imagePath})
+	require.NoError(t, err)
+
+	undoFiles, err = c.ListUndoFiles(imagePath)
+	require.NoError(t, err)
+	require.Len(t, undoFiles, 1)
+	require.Equal(t, imagePath, undoFiles[0].Device)
+	require.Equal(t, undoDir, filepath.Dir(undoFiles[0].Path))
+	require.NotZero(t, undoFiles[0].Size)
+	require.WithinDuration(t, time.Now(), undoFiles[0].Created, time.Minute)
+
+	t.Log("Undoing the resize")
+
+	applied, err := c.UndoLastOperation(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, undoFiles[0], *applied)
+
+	after, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, before.BlockCount, after.BlockCount)
+
+	_, err = c.UndoLastOperation(ctx, imagePath)
+	require.ErrorIs(t, err, ext4.ErrNoUndoFile)
+
+	t.Log("Undoing a UUID change")
+
+	_, err = c.SetUUID(ctx, imagePath, "5c0a2dd4-4a6e-4d3e-8e6f-7a5f0e0c9b11")
+	require.NoError(t, err)
+
+	_, err = c.UndoLastOperation(ctx, imagePath)
+	require.NoError(t, err)
+
+	after, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, before.UUID, after.UUID)
+
+	t.Log("Pruning undo files")
+
+	for i := 0; i < 3; i++ {
+		_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true})
+		require.NoError(t, err)
+	}
+
+	// Read-only checks can't change anything.
+	_, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, NoFix: true})
+	require.NoError(t, err)
+
+	undoFiles, err = c.ListUndoFiles("")
+	require.NoError(t, err)
+	require.Len(t, undoFiles, 3)
+
+	pruned, err := c.PruneUndoFiles(ext4.PruneUndoOptions{OlderThan: time.Hour})
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	pruned, err = c.PruneUndoFiles(ext4.PruneUndoOptions{KeepLast: 1})
+	require.NoError(t, err)
+	require.Equal(t, []ext4.UndoFile{undoFiles[1], undoFiles[0]}, pruned)
+
+	remaining, err := c.ListUndoFiles(imagePath)
+	require.NoError(t, err)
+	require.Equal(t, undoFiles[2:], remaining)
+
+	_, err = ext4.NewClient().ListUndoFiles(imagePath)
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
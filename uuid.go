@@ -0,0 +1,269 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/dpeckett/ext4/internal/randuuid"
+)
+
+// incompatChecksumSeed is the incompatible feature flag of
+// metadata_csum_seed.
+const incompatChecksumSeed = 0x2000
+
+// UUID is the UUID of a filesystem in its textual form, or one of the keywords
+// understood by mke2fs and tune2fs.
+type UUID string
+
+const (
+	// RandomUUID generates a new random UUID.
+	RandomUUID UUID = "random"
+	// TimeUUID generates a new time-based UUID.
+	TimeUUID UUID = "time"
+	// ClearUUID clears the UUID (setting it to all zeroes).
+	ClearUUID UUID = "clear"
+)
+
+// ParseUUID parses the textual form of a UUID, eg.
+// "c1b9d5a2-f162-11cf-9ece-0020afc76f16".
+func ParseUUID(s string) (UUID, error) {
+	if !uuidRegexp.MatchString(s) {
+		return "", invalidOption("malformed UUID %q", s)
+	}
+
+	return UUID(strings.ToLower(s)), nil
+}
+
+// UUIDFromBytes returns the textual form of a binary UUID.
+func UUIDFromBytes(b [16]byte) UUID {
+	return UUID(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+}
+
+// NewRandomUUID returns a new random (version 4) UUID.
+func NewRandomUUID() (UUID, error) {
+	b, err := randuuid.New()
+	if err != nil {
+		return "", err
+	}
+
+	return UUIDFromBytes(b), nil
+}
+
+// Bytes returns the binary form of a literal UUID (or all zeroes for
+// ClearUUID).
+func (u UUID) Bytes() ([16]byte, error) {
+	var b [16]byte
+	if u == ClearUUID {
+		return b, nil
+	}
+	if !uuidRegexp.MatchString(string(u)) {
+		return b, invalidOption("malformed UUID %q", string(u))
+	}
+
+	_, err := hex.Decode(b[:], []byte(strings.ReplaceAll(string(u), "-", "")))
+	return b, err
+}
+
+// IsKeyword returns true if the UUID is one of the keywords (RandomUUID,
+// TimeUUID or ClearUUID) rather than a literal UUID.
+func (u UUID) IsKeyword() bool {
+	switch u {
+	case RandomUUID, TimeUUID, ClearUUID:
+		return true
+	default:
+		return false
+	}
+}
+
+// Validate checks that the UUID is either well formed or a keyword.
+func (u UUID) Validate() error {
+	if u != "" && !u.IsKeyword() && !uuidRegexp.MatchString(string(u)) {
+		return invalidOption("malformed UUID %q", string(u))
+	}
+
+	return nil
+}
+
+// MarshalArg returns the UUID in the syntax of the -U option.
+func (u UUID) MarshalArg() string {
+	return string(u)
+}
+
+// RegenerateUUID gives a filesystem a new random UUID (eg. after copying a
+// golden image), returning the new UUID.
+func (c *Client) RegenerateUUID(ctx context.Context, device string) (string, error) {
+	return c.SetUUID(ctx, device, RandomUUID)
+}
+
+// SetUUID sets the UUID of a filesystem, returning the new UUID. The UUID may
+// also be one of the keywords RandomUUID, TimeUUID or ClearUUID.
+//
+// Changing the UUID of a filesystem with metadata checksums would otherwise
+// require every checksum to be rewritten (which is only possible on a freshly
+// checked, unmounted filesystem), so the metadata_csum_seed feature is
+// enabled first, which decouples the checksums from the UUID. Mounting such a
+// filesystem requires Linux 4.4 or later.
+func (c *Client) SetUUID(ctx context.Context, device string, uuid UUID) (_ string, err error) {
+	ctx, span := c.startSpan(ctx, "SetUUID", device)
+	defer endSpan(span, &err)
+
+	if device == "" {
+		return "", invalidOption("device is required")
+	}
+	if uuid == "" {
+		return "", invalidOption("UUID is required")
+	}
+	if err := uuid.Validate(); err != nil {
+		return "", err
+	}
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	return c.setUUID(ctx, device, uuid)
+}
+
+// setUUID sets the UUID of the filesystem, the caller must hold the device
+// lock.
+func (c *Client) setUUID(ctx context.Context, device string, uuid UUID) (string, error) {
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return "", err
+	}
+
+	cmdArgs := []string{"-U", uuid.MarshalArg()}
+	if sb.HasFeature(MetadataCsum) && !sb.HasFeature(MetadataCsumSeed) {
+		cmdArgs = append([]string{"-O", "metadata_csum_seed"}, cmdArgs...)
+	}
+
+	if err := c.tune2fs(ctx, device, cmdArgs...); err != nil {
+		return "", fmt.Errorf("failed to set UUID: %w", err)
+	}
+
+	sb, err = c.ReadSuperblock(ctx, device)
+	if err != nil {
+		return "", fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	return sb.UUID, nil
+}
+
+// EnableChecksumSeed enables the metadata_csum_seed feature on a filesystem
+// with metadata checksums (this is possible while it is mounted), storing the
+// seed derived from its current UUID in the superblock. The UUID can then be
+// changed cheaply, without rewriting every checksum. Mounting the filesystem
+// requires Linux 4.4 or later. Returns the updated superblock.
+func (c *Client) EnableChecksumSeed(ctx context.Context, device string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "EnableChecksumSeed", device)
+	defer endSpan(span, &err)
+
+	return c.enableFeature(ctx, device, MetadataCsumSeed)
+}
+
+// DisableChecksumSeed disables the metadata_csum_seed feature on an unmounted
+// filesystem, so that its checksums are once again derived from the UUID (eg.
+// so it can be mounted by older kernels). If the UUID has changed since the
+// seed was stored, tune2fs rewrites every checksum, which takes time
+// proportional to the amount of metadata. Returns the updated superblock.
+func (c *Client) DisableChecksumSeed(ctx context.Context, device string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "DisableChecksumSeed", device)
+	defer endSpan(span, &err)
+
+	if device == "" {
+		return nil, invalidOption("device is required")
+	}
+
+	unlock, err := c.requireUnmounted(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sb, err := c.VerifyExt4(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+
+	if !sb.HasFeature(MetadataCsumSeed) {
+		return sb, nil
+	}
+
+	if err := c.tune2fs(ctx, device, "-O", "^metadata_csum_seed"); err != nil {
+		return nil, fmt.Errorf("failed to disable metadata_csum_seed feature: %w", err)
+	}
+
+	return c.ReadSuperblock(ctx, device)
+}
+
+// SetUUIDFile sets the UUID of an unmounted filesystem on the local host (in
+// the primary and backup superblocks), without running tune2fs (eg. in minimal
+// containers that don't have e2fsprogs installed). The UUID may also be one of
+// the keywords RandomUUID or ClearUUID. Returns the new UUID.
+//
+// As with SetUUID, the metadata_csum_seed feature is enabled on filesystems
+// with metadata checksums, so that the existing checksums remain valid.
+// Filesystems with the older uninit_bg group descriptor checksums (which are
+// also derived from the UUID) aren't supported.
+func SetUUIDFile(device string, uuid UUID) (string, error) {
+	var value [16]byte
+	var err error
+	switch uuid {
+	case "":
+		return "", invalidOption("UUID is required")
+	case RandomUUID:
+		if value, err = randuuid.New(); err != nil {
+			return "", err
+		}
+	case TimeUUID:
+		return "", invalidOption("time-based UUIDs can only be generated by tune2fs")
+	default:
+		if value, err = uuid.Bytes(); err != nil {
+			return "", err
+		}
+	}
+
+	err = updateSuperblocks(device, func(sb *SuperblockInfo, buf []byte) error {
+		if sb.HasFeature(UninitBG) {
+			return fmt.Errorf("changing the UUID requires rewriting the group descriptor checksums (%s), use SetUUID", UninitBG)
+		}
+
+		if sb.HasFeature(MetadataCsum) && !sb.HasFeature(MetadataCsumSeed) {
+			// Store the seed derived from the current UUID.
+			le := binary.LittleEndian
+			le.PutUint32(buf[0x270:], ^crc32.Checksum(buf[0x68:0x78], crc32cTable))
+			le.PutUint32(buf[0x60:], le.Uint32(buf[0x60:])|incompatChecksumSeed)
+		}
+
+		copy(buf[0x68:0x78], value[:])
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to set UUID: %w", err)
+	}
+
+	return formatUUID(value), nil
+}
@@ -0,0 +1,261 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUID(t *testing.T) {
+	uuid, err := ext4.ParseUUID("C1B9D5A2-F162-11CF-9ECE-0020AFC76F16")
+	require.NoError(t, err)
+	require.Equal(t, ext4.UUID("c1b9d5a2-f162-11cf-9ece-0020afc76f16"), uuid)
+	require.False(t, uuid.IsKeyword())
+	require.NoError(t, uuid.Validate())
+
+	_, err = ext4.ParseUUID("random")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	require.Equal(t, ext4.UUID("00010203-0405-0607-0809-0a0b0c0d0e0f"),
+		ext4.UUIDFromBytes([16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}))
+
+	for _, uuid := range []ext4.UUID{ext4.RandomUUID, ext4.TimeUUID, ext4.ClearUUID} {
+		require.True(t, uuid.IsKeyword())
+		require.NoError(t, uuid.Validate())
+	}
+
+	require.ErrorIs(t, ext4.UUID("not-a-uuid").Validate(), ext4.ErrInvalidOptions)
+
+	t.Log("Generating a random UUID")
+
+	uuid, err = ext4.NewRandomUUID()
+	require.NoError(t, err)
+	require.NoError(t, uuid.Validate())
+
+	b, err := uuid.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, byte(0x40), b[6]&0xf0, "version 4")
+	require.Equal(t, byte(0x80), b[8]&0xc0, "variant 1")
+}
+
+func TestSetUUID(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	before, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, before.Features, "metadata_csum")
+
+	// Make it appear as though the filesystem has been mounted since it was
+	// last checked (which would otherwise prevent rewriting the checksums).
+	cmd := exec.Command("debugfs", "-w", "-f", "-", imagePath)
+	cmd.Stdin = strings.NewReader("ssv mtime 20200101\nssv lastcheck 20100101\n")
+	require.NoError(t, cmd.Run())
+
+	uuid, err := c.RegenerateUUID(ctx, imagePath)
+	require.NoError(t, err)
+	require.NotEmpty(t, uuid)
+	require.NotEqual(t, before.UUID, uuid)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "metadata_csum_seed")
+
+	t.Log("Setting a specific UUID")
+
+	uuid, err = c.SetUUID(ctx, imagePath, "01234567-89ab-cdef-0123-456789abcdef")
+	require.NoError(t, err)
+	require.Equal(t, "01234567-89ab-cdef-0123-456789abcdef", uuid)
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+
+	t.Log("Clearing the UUID")
+
+	uuid, err = c.SetUUID(ctx, imagePath, ext4.ClearUUID)
+	require.NoError(t, err)
+	require.Equal(t, "<none>", uuid)
+
+	t.Log("Setting a malformed UUID")
+
+	_, err = c.SetUUID(ctx, imagePath, "not-a-uuid")
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestChecksumSeed(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := filepath.Join(t.TempDir(), "ext4.img")
+	_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:       imagePath,
+		Size:         64 * ext4.MiB,
+		ChecksumSeed: true,
+	})
+	require.NoError(t, err)
+
+	sb, err := c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "metadata_csum_seed")
+	require.NotZero(t, sb.ChecksumSeed)
+
+	seed := sb.ChecksumSeed
+
+	_, err = c.RegenerateUUID(ctx, imagePath)
+	require.NoError(t, err)
+
+	sb, err = c.ReadSuperblock(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, seed, sb.ChecksumSeed, "seed should be unchanged")
+
+	t.Log("Disabling the checksum seed")
+
+	sb, err = c.DisableChecksumSeed(ctx, imagePath)
+	require.NoError(t, err)
+	require.NotContains(t, sb.Features, "metadata_csum_seed")
+	require.Zero(t, sb.ChecksumSeed)
+
+	result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: imagePath, Force: true, NoFix: true})
+	require.NoError(t, err)
+	require.True(t, result.Status.OK())
+
+	t.Log("Enabling the checksum seed")
+
+	sb, err = c.EnableChecksumSeed(ctx, imagePath)
+	require.NoError(t, err)
+	require.Contains(t, sb.Features, "metadata_csum_seed")
+	require.NotEqual(t, seed, sb.ChecksumSeed, "seed should be derived from the new UUID")
+
+	t.Log("Creating a filesystem without metadata checksums")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device:       imagePath,
+		Features:     "^metadata_csum",
+		ChecksumSeed: true,
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+}
+
+func TestSetUUIDFile(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	for name, opts := range map[string]ext4.CreateOptions{
+		"ext4":          {},
+		"ext2":          {Type: ext4.Ext2},
+		"checksum_seed": {ChecksumSeed: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.Device = filepath.Join(t.TempDir(), "ext4.img")
+			opts.Size = 64 * ext4.MiB
+
+			_, err := c.CreateFilesystem(ctx, opts)
+			require.NoError(t, err)
+
+			before, err := ext4.ReadSuperblockFile(opts.Device)
+			require.NoError(t, err)
+
+			uuid, err := ext4.SetUUIDFile(opts.Device, "01234567-89ab-cdef-0123-456789abcdef")
+			require.NoError(t, err)
+			require.Equal(t, "01234567-89ab-cdef-0123-456789abcdef", uuid)
+
+			sb, err := c.ReadSuperblock(ctx, opts.Device)
+			require.NoError(t, err)
+			require.Equal(t, uuid, sb.UUID)
+			if before.HasFeature(ext4.MetadataCsum) {
+				require.Contains(t, sb.Features, "metadata_csum_seed")
+			}
+
+			result, err := c.CheckFilesystem(ctx, ext4.CheckOptions{Device: opts.Device, Force: true, NoFix: true})
+			require.NoError(t, err)
+			require.True(t, result.Status.OK())
+
+			t.Log("Generating a random UUID")
+
+			uuid, err = ext4.SetUUIDFile(opts.Device, ext4.RandomUUID)
+			require.NoError(t, err)
+			require.NoError(t, ext4.UUID(uuid).Validate())
+			require.NotEqual(t, before.UUID, uuid)
+
+			f, err := os.Open(opts.Device)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			for _, block := range sb.BackupSuperblocks() {
+				backup, err := ext4.ReadBackupSuperblockFrom(f, block, sb.BlockSize)
+				require.NoError(t, err)
+				require.Equal(t, uuid, backup.UUID)
+			}
+
+			t.Log("Clearing the UUID")
+
+			uuid, err = ext4.SetUUIDFile(opts.Device, ext4.ClearUUID)
+			require.NoError(t, err)
+			require.Equal(t, "<none>", uuid)
+
+			sb, err = c.ReadSuperblock(ctx, opts.Device)
+			require.NoError(t, err)
+			require.Equal(t, uuid, sb.UUID)
+
+			native, err := ext4.ReadSuperblockFile(opts.Device)
+			require.NoError(t, err)
+			require.Equal(t, uuid, native.UUID)
+
+			result, err = c.CheckFilesystem(ctx, ext4.CheckOptions{Device: opts.Device, Force: true, NoFix: true})
+			require.NoError(t, err)
+			require.True(t, result.Status.OK())
+
+			t.Log("Setting an unsupported UUID")
+
+			_, err = ext4.SetUUIDFile(opts.Device, "not-a-uuid")
+			require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+			_, err = ext4.SetUUIDFile(opts.Device, ext4.TimeUUID)
+			require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+		})
+	}
+
+	t.Run("uninit_bg", func(t *testing.T) {
+		imagePath := filepath.Join(t.TempDir(), "ext4.img")
+		_, err := c.CreateFilesystem(ctx, ext4.CreateOptions{
+			Device:     imagePath,
+			Size:       64 * ext4.MiB,
+			FeatureSet: ext4.FeatureSet{ext4.MetadataCsum: false, ext4.UninitBG: true},
+		})
+		require.NoError(t, err)
+
+		_, err = ext4.SetUUIDFile(imagePath, ext4.RandomUUID)
+		require.ErrorContains(t, err, "uninit_bg")
+	})
+}
@@ -0,0 +1,255 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// ErrInvalidOptions is matched (using errors.Is) by errors returned when
+// options fail validation.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// maxLabelLength is the maximum length of a volume label in bytes.
+const maxLabelLength = 16
+
+// minLargeInodeSize is the minimum inode size of features that store data in
+// the extra space of large inodes (eg. project quotas and inline data).
+const minLargeInodeSize = 256
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts CreateOptions) Validate() error {
+	var errs []error
+	if opts.Device == "" {
+		errs = append(errs, invalidOption("device is required"))
+	}
+	if err := opts.Size.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.BlockSize != nil && !validBlockSize(*opts.BlockSize) {
+		errs = append(errs, invalidOption("invalid block size %d", *opts.BlockSize))
+	}
+	if opts.ClusterSize != nil && (!isPowerOfTwo(*opts.ClusterSize) || *opts.ClusterSize < 2048 || *opts.ClusterSize > 256<<20) {
+		errs = append(errs, invalidOption("invalid cluster size %d", *opts.ClusterSize))
+	}
+	if opts.InodeSize != nil && (!isPowerOfTwo(*opts.InodeSize) || *opts.InodeSize < 128) {
+		errs = append(errs, invalidOption("invalid inode size %d", *opts.InodeSize))
+	}
+	if opts.ReservedBlocksPercentage != nil && (*opts.ReservedBlocksPercentage < 0 || *opts.ReservedBlocksPercentage > 50) {
+		errs = append(errs, invalidOption("reserved blocks percentage %d is out of range", *opts.ReservedBlocksPercentage))
+	}
+	if _, err := opts.LabelPolicy.Apply(opts.Label); err != nil {
+		errs = append(errs, err)
+	}
+	if err := opts.UUID.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := opts.Type.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.Type == Ext2 && (opts.Journal || opts.JournalOptions != (JournalOptions{})) {
+		errs = append(errs, invalidOption("ext2 filesystems don't have a journal"))
+	}
+	if opts.Type == Ext2 || opts.Type == Ext3 {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"bigalloc", opts.Bigalloc != nil},
+			{"casefold", opts.Casefold != nil},
+			{"checksum seed", opts.ChecksumSeed},
+			{"encryption", opts.Encryption},
+			{"inline data", opts.InlineData},
+			{"verity", opts.Verity},
+		} {
+			if option.set {
+				errs = append(errs, invalidOption("%s requires an ext4 filesystem", option.name))
+			}
+		}
+	}
+	if err := opts.ErrorBehavior.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.Config != nil {
+		if err := opts.Config.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		// mke2fs refuses to create filesystems its configuration doesn't
+		// define (other than ext2).
+		if fsType := opts.fsType(); fsType != Ext2 && !opts.Config.hasFSType(string(fsType)) {
+			errs = append(errs, invalidOption("mke2fs config doesn't define the %s filesystem type", fsType))
+		}
+	}
+	// Custom configurations may define their own usage types.
+	if opts.Config == nil || !opts.Config.hasFSType(string(opts.UsageType)) {
+		if err := opts.UsageType.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := opts.CreatorOS.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := opts.ExtendedOptions.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := opts.JournalOptions.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.Populate != nil {
+		if opts.RootDirectory == "" {
+			errs = append(errs, invalidOption("populate requires a root directory"))
+		}
+		if err := opts.Populate.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.Wipe != nil {
+		if err := opts.Wipe.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	features := opts.features()
+	if err := opts.FeatureSet.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.ClusterSize != nil && opts.Bigalloc == nil && !features.Enabled(Bigalloc) {
+		errs = append(errs, invalidOption("cluster size requires the bigalloc feature"))
+	}
+	if opts.ChecksumSeed && features.Disabled(MetadataCsum) {
+		errs = append(errs, invalidOption("checksum seed requires the metadata_csum feature"))
+	}
+	if opts.Bigalloc != nil {
+		blockSize := 0
+		if opts.BlockSize != nil {
+			blockSize = *opts.BlockSize
+		}
+		if opts.ClusterSize != nil {
+			errs = append(errs, invalidOption("bigalloc and cluster size are mutually exclusive"))
+		}
+		if features.Disabled(Bigalloc) {
+			errs = append(errs, invalidOption("bigalloc conflicts with features %q", opts.Features))
+		}
+		if features.Disabled(Extent) || features.Disabled("extents") {
+			errs = append(errs, invalidOption("bigalloc requires the extent feature"))
+		}
+		if err := opts.Bigalloc.validate(blockSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.RAIDGeometry != nil || opts.DetectRAIDGeometry {
+		if opts.RAIDGeometry != nil && opts.DetectRAIDGeometry {
+			errs = append(errs, invalidOption("RAID geometry and detecting it are mutually exclusive"))
+		}
+		if opts.ExtendedOptions.Stride != 0 || opts.ExtendedOptions.StripeWidth != 0 {
+			errs = append(errs, invalidOption("RAID geometry and an explicit stride or stripe width are mutually exclusive"))
+		}
+	}
+	if opts.RAIDGeometry != nil {
+		if _, _, err := opts.RAIDGeometry.Stride(opts.raidBlockSize()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.Casefold != nil {
+		if err := opts.Casefold.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateQuotaTypes(opts.Quotas); err != nil {
+		errs = append(errs, err)
+	}
+	if slices.Contains(opts.Quotas, ProjectQuota) && opts.InodeSize != nil && *opts.InodeSize < minLargeInodeSize {
+		errs = append(errs, invalidOption("project quotas require inodes of at least %d bytes", minLargeInodeSize))
+	}
+	if opts.InlineData && opts.InodeSize != nil && *opts.InodeSize < minLargeInodeSize {
+		errs = append(errs, invalidOption("inline data requires inodes of at least %d bytes", minLargeInodeSize))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts ResizeOptions) Validate() error {
+	var errs []error
+	if opts.Device == "" {
+		errs = append(errs, invalidOption("device is required"))
+	}
+	if err := opts.Size.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.Enable64Bit && opts.Disable64Bit {
+		errs = append(errs, invalidOption("enable and disable 64-bit are mutually exclusive"))
+	}
+	if opts.Shrink && opts.Size != 0 {
+		errs = append(errs, invalidOption("shrink (to the minimum size) and an explicit size %s are mutually exclusive", opts.Size))
+	}
+	// resize2fs converts the filesystem in place, silently ignoring any new
+	// size.
+	if opts.Enable64Bit || opts.Disable64Bit {
+		if opts.Shrink {
+			errs = append(errs, invalidOption("converting the 64-bit feature can't be combined with shrink"))
+		}
+		if opts.Size != 0 {
+			errs = append(errs, invalidOption("converting the 64-bit feature can't be combined with an explicit size %s", opts.Size))
+		}
+	}
+	if opts.RAIDStride != nil && *opts.RAIDStride <= 0 {
+		errs = append(errs, invalidOption("invalid RAID stride %d", *opts.RAIDStride))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts CheckOptions) Validate() error {
+	var errs []error
+	if opts.Device == "" {
+		errs = append(errs, invalidOption("device is required"))
+	}
+	if opts.Preen && opts.NoFix {
+		errs = append(errs, invalidOption("preen and no fix are mutually exclusive"))
+	}
+	if opts.AppendBadBlocksFile != "" && opts.BadBlocksFile != "" {
+		errs = append(errs, invalidOption("append bad blocks file and bad blocks file are mutually exclusive"))
+	}
+	if opts.Blocksize != nil && !validBlockSize(*opts.Blocksize) {
+		errs = append(errs, invalidOption("invalid block size %d", *opts.Blocksize))
+	}
+	if opts.Superblock != nil && *opts.Superblock <= 0 {
+		errs = append(errs, invalidOption("invalid superblock %d", *opts.Superblock))
+	}
+
+	return errors.Join(errs...)
+}
+
+func invalidOption(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOptions, fmt.Sprintf(format, a...))
+}
+
+// validBlockSize returns true if the block size is supported by e2fsprogs.
+func validBlockSize(size int) bool {
+	return isPowerOfTwo(size) && size >= 1024 && size <= 65536
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
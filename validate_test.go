@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	blockSize := 3000
+	inodeSize := 64
+	clusterSize := 65536
+
+	t.Run("Create", func(t *testing.T) {
+		require.NoError(t, ext4.CreateOptions{
+			Device: "/dev/null",
+			Label:  "data",
+			UUID:   "c1b9d5a2-f162-11cf-9ece-0020afc76f16",
+		}.Validate())
+		require.NoError(t, ext4.CreateOptions{
+			Device:      "/dev/null",
+			ClusterSize: &clusterSize,
+			FeatureSet:  ext4.FeatureSet{ext4.Bigalloc: true},
+		}.Validate())
+
+		for name, opts := range map[string]ext4.CreateOptions{
+			"missing device":     {},
+			"invalid size":       {Device: "/dev/null", Size: 1000},
+			"invalid block size": {Device: "/dev/null", BlockSize: &blockSize},
+			"invalid inode size": {Device: "/dev/null", InodeSize: &inodeSize},
+			"long label":         {Device: "/dev/null", Label: "a-very-long-volume-label"},
+			"malformed uuid":     {Device: "/dev/null", UUID: "not-a-uuid"},
+			"error behavior":     {Device: "/dev/null", ErrorBehavior: "explode"},
+			"usage type":         {Device: "/dev/null", UsageType: "tiny"},
+			"creator os":         {Device: "/dev/null", CreatorOS: "windows"},
+			"cluster size":       {Device: "/dev/null", ClusterSize: &clusterSize},
+			"bigalloc cluster":   {Device: "/dev/null", Bigalloc: &ext4.BigallocOptions{ClusterSize: 3 << 20}},
+			"bigalloc extents":   {Device: "/dev/null", Bigalloc: &ext4.BigallocOptions{}, Features: "^extent"},
+		} {
+			require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+		}
+	})
+
+	t.Run("Resize", func(t *testing.T) {
+		require.NoError(t, ext4.ResizeOptions{Device: "/dev/null", Size: 1 * ext4.GiB}.Validate())
+
+		for name, opts := range map[string]ext4.ResizeOptions{
+			"missing device": {},
+			"64-bit":         {Device: "/dev/null", Enable64Bit: true, Disable64Bit: true},
+			"shrink":         {Device: "/dev/null", Shrink: true, Size: 1 * ext4.GiB},
+			"negative size":  {Device: "/dev/null", Size: -1 * ext4.GiB},
+			"64-bit shrink":  {Device: "/dev/null", Enable64Bit: true, Shrink: true},
+			"64-bit size":    {Device: "/dev/null", Disable64Bit: true, Size: 1 * ext4.GiB},
+		} {
+			require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+		}
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		require.NoError(t, ext4.CheckOptions{Device: "/dev/null", NoFix: true}.Validate())
+
+		for name, opts := range map[string]ext4.CheckOptions{
+			"missing device":     {},
+			"preen":              {Device: "/dev/null", Preen: true, NoFix: true},
+			"invalid block size": {Device: "/dev/null", Blocksize: &blockSize},
+		} {
+			require.ErrorIs(t, opts.Validate(), ext4.ErrInvalidOptions, name)
+		}
+	})
+
+	t.Run("Before Executing", func(t *testing.T) {
+		var events int
+		c := ext4.NewClient(ext4.WithCommandHook(func(ext4.CommandEvent) {
+			events++
+		}))
+
+		_, err := c.ResizeFilesystem(context.Background(), ext4.ResizeOptions{
+			Device:       "/dev/null",
+			Enable64Bit:  true,
+			Disable64Bit: true,
+		})
+		require.True(t, errors.Is(err, ext4.ErrInvalidOptions))
+		require.Zero(t, events)
+	})
+}
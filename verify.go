@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ext4Magic is the superblock magic number shared by ext2, ext3 and ext4.
+const ext4Magic = 0xEF53
+
+// NotExt4Error is returned when a device does not contain an ext2/3/4
+// filesystem (eg. it is unformatted, or holds another filesystem).
+type NotExt4Error struct {
+	// Device that was examined.
+	Device string
+	// Magic is the superblock magic number found on the device (or zero if the
+	// superblock could not be read).
+	Magic uint16
+	// Err is the underlying error (if any).
+	Err error
+}
+
+func (e *NotExt4Error) Error() string {
+	if e.Magic != 0 {
+		return fmt.Sprintf("%s does not contain an ext4 filesystem (bad magic 0x%04X)", e.Device, e.Magic)
+	}
+
+	return fmt.Sprintf("%s does not contain an ext4 filesystem: %v", e.Device, e.Err)
+}
+
+func (e *NotExt4Error) Unwrap() error {
+	return e.Err
+}
+
+// VerifyExt4 checks that a device contains an ext4 (or ext2/3) filesystem,
+// returning its superblock. If it doesn't, a *NotExt4Error is returned. Use
+// this to guard against operating on the wrong device. Note that e2fsck is not
+// gated on this check, as it is able to recover a filesystem from a backup
+// superblock when the primary has been damaged.
+func (c *Client) VerifyExt4(ctx context.Context, device string) (_ *SuperblockInfo, err error) {
+	ctx, span := c.startSpan(ctx, "VerifyExt4", device)
+	defer endSpan(span, &err)
+
+	sb, err := c.ReadSuperblock(ctx, device)
+	if err != nil {
+		var cmdErr *CommandError
+		if errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, "Bad magic number in super-block") {
+			return nil, &NotExt4Error{Device: device, Err: err}
+		}
+
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
+	}
+
+	if sb.Magic != ext4Magic {
+		return nil, &NotExt4Error{Device: device, Magic: sb.Magic}
+	}
+
+	return sb, nil
+}
@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyExt4(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	imagePath := createTestImage(t, c, "")
+
+	sb, err := c.VerifyExt4(ctx, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint16(0xEF53), sb.Magic)
+
+	t.Log("Verifying an unformatted device")
+
+	blankPath := filepath.Join(t.TempDir(), "blank.img")
+	require.NoError(t, os.WriteFile(blankPath, make([]byte, 8<<20), 0o644))
+
+	_, err = c.VerifyExt4(ctx, blankPath)
+	var notExt4 *ext4.NotExt4Error
+	require.ErrorAs(t, err, &notExt4)
+	require.Equal(t, blankPath, notExt4.Device)
+
+	t.Log("Resizing an unformatted device")
+
+	_, err = c.ResizeFilesystem(ctx, ext4.ResizeOptions{Device: blankPath})
+	require.ErrorAs(t, err, &notExt4)
+
+	t.Log("Verifying a missing device")
+
+	_, err = c.VerifyExt4(ctx, filepath.Join(t.TempDir(), "missing.img"))
+	require.Error(t, err)
+	require.False(t, errors.As(err, &notExt4))
+}
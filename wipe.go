@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrWipeMounted is returned when attempting to wipe a mounted device.
+var ErrWipeMounted = errors.New("mounted devices cannot be wiped")
+
+// WipeMethod is how the contents of a device are destroyed.
+type WipeMethod string
+
+const (
+	// WipeDiscard discards (TRIMs/unmaps) all blocks, which is near instant on
+	// SSDs and thinly provisioned volumes. Discarded blocks usually read back
+	// as zeros, but this is not guaranteed.
+	WipeDiscard WipeMethod = "discard"
+	// WipeSecureDiscard discards all blocks, and requires the device to also
+	// erase any copies of them (eg. in flash translation layers). Not all
+	// devices support this.
+	WipeSecureDiscard WipeMethod = "secure-discard"
+	// WipeZero overwrites all blocks with zeros, for devices that don't
+	// support discard (eg. spinning disks). The kernel offloads this to the
+	// device where possible.
+	WipeZero WipeMethod = "zero"
+)
+
+// WipeOptions provides options for wiping a device.
+type WipeOptions struct {
+	// Method used to wipe the device (default WipeDiscard).
+	Method WipeMethod
+	// Offset in bytes from the start of the device at which to begin.
+	Offset int64
+	// Length in bytes of the region to wipe (zero for the rest of the device).
+	Length int64
+}
+
+// Validate checks the options for obvious mistakes, before any command is run.
+func (opts WipeOptions) Validate() error {
+	var errs []error
+	switch opts.Method {
+	case "", WipeDiscard, WipeSecureDiscard, WipeZero:
+	default:
+		errs = append(errs, invalidOption("unknown wipe method %q", opts.Method))
+	}
+	if opts.Offset < 0 {
+		errs = append(errs, invalidOption("invalid wipe offset %d", opts.Offset))
+	}
+	if opts.Length < 0 {
+		errs = append(errs, invalidOption("invalid wipe length %d", opts.Length))
+	}
+
+	return errors.Join(errs...)
+}
+
+// WipeDevice destroys the contents of a block device using blkdiscard, eg.
+// before formatting it. Mounted devices are refused with ErrWipeMounted. The
+// offset and length must be aligned to the logical sector size of the device.
+func (c *Client) WipeDevice(ctx context.Context, device string, opts WipeOptions) (err error) {
+	ctx, span := c.startSpan(ctx, "WipeDevice", device)
+	defer endSpan(span, &err)
+
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	unlock, err := c.lockDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return c.wipeDevice(ctx, device, opts)
+}
+
+// wipeDevice wipes the device, the caller must hold the device lock.
+func (c *Client) wipeDevice(ctx context.Context, device string, opts WipeOptions) error {
+	mountPoint, err := c.mountPoint(device)
+	if err != nil {
+		return err
+	}
+
+	if mountPoint != "" {
+		return fmt.Errorf("%w: %s is mounted at %s", ErrWipeMounted, device, mountPoint)
+	}
+
+	var cmdArgs []string
+	switch opts.Method {
+	case WipeSecureDiscard:
+		cmdArgs = append(cmdArgs, "--secure")
+	case WipeZero:
+		cmdArgs = append(cmdArgs, "--zeroout")
+	}
+	if opts.Offset > 0 {
+		cmdArgs = append(cmdArgs, "--offset", strconv.FormatInt(opts.Offset, 10))
+	}
+	if opts.Length > 0 {
+		cmdArgs = append(cmdArgs, "--length", strconv.FormatInt(opts.Length, 10))
+	}
+	cmdArgs = append(cmdArgs, device)
+
+	if _, err := c.run(ctx, "blkdiscard", cmdArgs...); err != nil {
+		return fmt.Errorf("failed to wipe %s: %w", device, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ext4_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/ext4"
+	"github.com/dpeckett/ext4/loopback"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWipeDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices require root")
+	}
+
+	ctx := context.Background()
+
+	c := ext4.NewClient()
+
+	data := make([]byte, 4<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	imagePath := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, os.WriteFile(imagePath, data, 0o644))
+
+	devPath, detach, err := loopback.Attach(imagePath, loopback.Options{})
+	if err != nil {
+		t.Skipf("unable to attach loop device: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = detach()
+	})
+
+	t.Log("Zeroing part of the device")
+
+	err = c.WipeDevice(ctx, devPath, ext4.WipeOptions{
+		Method: ext4.WipeZero,
+		Offset: 1 << 20,
+		Length: 1 << 20,
+	})
+	require.NoError(t, err)
+
+	wiped, err := os.ReadFile(devPath)
+	require.NoError(t, err)
+	require.Equal(t, data[:1<<20], wiped[:1<<20])
+	require.Equal(t, make([]byte, 1<<20), wiped[1<<20:2<<20])
+	require.Equal(t, data[2<<20:], wiped[2<<20:])
+
+	t.Log("Discarding the device before formatting")
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: devPath,
+		Wipe:   &ext4.WipeOptions{Method: ext4.WipeDiscard},
+	})
+	require.NoError(t, err)
+
+	_, err = c.VerifyExt4(ctx, devPath)
+	require.NoError(t, err)
+
+	wiped, err = os.ReadFile(devPath)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(wiped, data[3<<20:(3<<20)+4096]), "device was not wiped")
+
+	t.Log("Wiping a mounted device")
+
+	mountPath := t.TempDir()
+	require.NoError(t, c.Mount(ctx, devPath, mountPath, ext4.MountOptions{}))
+	t.Cleanup(func() {
+		_ = c.Unmount(ctx, mountPath, ext4.UnmountOptions{Lazy: true})
+	})
+
+	err = c.WipeDevice(ctx, devPath, ext4.WipeOptions{})
+	require.ErrorIs(t, err, ext4.ErrWipeMounted)
+}
+
+func TestWipeDeviceInvalidOptions(t *testing.T) {
+	ctx := context.Background()
+
+	c := ext4.NewClient(ext4.WithDryRun())
+
+	err := c.WipeDevice(ctx, "/dev/sdz", ext4.WipeOptions{Method: "shred"})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	err = c.WipeDevice(ctx, "/dev/sdz", ext4.WipeOptions{Offset: -1})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	_, err = c.CreateFilesystem(ctx, ext4.CreateOptions{
+		Device: "/dev/sdz",
+		Wipe:   &ext4.WipeOptions{Length: -1},
+	})
+	require.ErrorIs(t, err, ext4.ErrInvalidOptions)
+
+	t.Log("Wiping in dry-run mode")
+
+	err = c.WipeDevice(ctx, "/dev/sdz", ext4.WipeOptions{Method: ext4.WipeSecureDiscard})
+	var dryRunErr *ext4.DryRunError
+	require.ErrorAs(t, err, &dryRunErr)
+	require.Equal(t, "blkdiscard", filepath.Base(dryRunErr.Argv[0]))
+	require.Equal(t, []string{"--secure", "/dev/sdz"}, dryRunErr.Argv[1:])
+}